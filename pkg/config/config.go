@@ -25,6 +25,17 @@ type Config struct {
 	HTTPPort       string `mapstructure:"HTTPD_PORT"`
 	SSHTimeout     int    `mapstructure:"SSH_TIMEOUT"`
 
+	SSHHostKeyChecking string `mapstructure:"SSH_HOST_KEY_CHECKING"`
+
+	GatewaySelectStrategy      string `mapstructure:"GATEWAY_SELECT_STRATEGY"`
+	GatewayHealthCheckInterval int    `mapstructure:"GATEWAY_HEALTH_CHECK_INTERVAL"`
+	GatewayIdleTimeout         int    `mapstructure:"GATEWAY_IDLE_TIMEOUT"`
+
+	EnableSSHCertificate        bool   `mapstructure:"ENABLE_SSH_CERTIFICATE"`
+	SSHCertificateCAKey         string `mapstructure:"SSH_CERTIFICATE_CA_KEY"`
+	SSHCertificateTTL           int    `mapstructure:"SSH_CERTIFICATE_TTL"`
+	SSHCertificateSourceAddress string `mapstructure:"SSH_CERTIFICATE_SOURCE_ADDRESS"`
+
 	LogLevel string `mapstructure:"LOG_LEVEL"`
 
 	Comment             string `mapstructure:"COMMENT"`
@@ -45,8 +56,48 @@ type Config struct {
 	RedisDBIndex  int      `mapstructure:"REDIS_DB_ROOM"`
 	RedisClusters []string `mapstructure:"REDIS_CLUSTERS"`
 
-	EnableLocalPortForward bool `mapstructure:"ENABLE_LOCAL_PORT_FORWARD"`
-	EnableVscodeSupport    bool `mapstructure:"ENABLE_VSCODE_SUPPORT"`
+	EnableLocalPortForward  bool   `mapstructure:"ENABLE_LOCAL_PORT_FORWARD"`
+	EnableRemotePortForward bool   `mapstructure:"ENABLE_REMOTE_PORT_FORWARD"`
+	// PortForwardAllowedPorts 是允许转发的目标端口, 为空时拒绝所有端口
+	PortForwardAllowedPorts string `mapstructure:"PORT_FORWARD_ALLOWED_PORTS"`
+	EnableVscodeSupport     bool   `mapstructure:"ENABLE_VSCODE_SUPPORT"`
+
+	BatchExecConcurrency int `mapstructure:"BATCH_EXEC_CONCURRENCY"`
+
+	EnableBuiltinSQLShell       bool `mapstructure:"ENABLE_BUILTIN_SQL_SHELL"`
+	EnableBuiltinRedisConsole   bool `mapstructure:"ENABLE_BUILTIN_REDIS_CONSOLE"`
+	EnableBuiltinMongoDBConsole bool `mapstructure:"ENABLE_BUILTIN_MONGODB_CONSOLE"`
+
+	CommandRiskRules string `mapstructure:"COMMAND_RISK_RULES"`
+	DataMaskingRules string `mapstructure:"DATA_MASKING_RULES"`
+	QueryGuardrails  string `mapstructure:"QUERY_GUARDRAILS"`
+
+	EnableMySQLProxy bool   `mapstructure:"ENABLE_MYSQL_PROXY"`
+	MySQLProxyHost   string `mapstructure:"MYSQL_PROXY_HOST"`
+	MySQLProxyPort   string `mapstructure:"MYSQL_PROXY_PORT"`
+
+	MySQLProxySSLCert    string `mapstructure:"MYSQL_PROXY_SSL_CERT"`
+	MySQLProxySSLKey     string `mapstructure:"MYSQL_PROXY_SSL_KEY"`
+	MySQLProxyRequireSSL bool   `mapstructure:"MYSQL_PROXY_REQUIRE_SSL"`
+	MySQLProxyMaskParams bool   `mapstructure:"MYSQL_PROXY_MASK_PARAMS"`
+
+	EnablePostgreSQLProxy  bool   `mapstructure:"ENABLE_POSTGRESQL_PROXY"`
+	PostgreSQLProxyHost    string `mapstructure:"POSTGRESQL_PROXY_HOST"`
+	PostgreSQLProxyPort    string `mapstructure:"POSTGRESQL_PROXY_PORT"`
+	PostgreSQLProxySSLCert string `mapstructure:"POSTGRESQL_PROXY_SSL_CERT"`
+	PostgreSQLProxySSLKey  string `mapstructure:"POSTGRESQL_PROXY_SSL_KEY"`
+
+	EnableRedisProxy  bool   `mapstructure:"ENABLE_REDIS_PROXY"`
+	RedisProxyHost    string `mapstructure:"REDIS_PROXY_HOST"`
+	RedisProxyPort    string `mapstructure:"REDIS_PROXY_PORT"`
+	RedisProxySSLCert string `mapstructure:"REDIS_PROXY_SSL_CERT"`
+	RedisProxySSLKey  string `mapstructure:"REDIS_PROXY_SSL_KEY"`
+
+	EnableMongoDBProxy  bool   `mapstructure:"ENABLE_MONGODB_PROXY"`
+	MongoDBProxyHost    string `mapstructure:"MONGODB_PROXY_HOST"`
+	MongoDBProxyPort    string `mapstructure:"MONGODB_PROXY_PORT"`
+	MongoDBProxySSLCert string `mapstructure:"MONGODB_PROXY_SSL_CERT"`
+	MongoDBProxySSLKey  string `mapstructure:"MONGODB_PROXY_SSL_KEY"`
 
 	RootPath          string
 	DataFolderPath    string
@@ -125,8 +176,44 @@ func getDefaultConfig() Config {
 		RedisPort:           "6379",
 		RedisPassword:       "",
 
-		EnableLocalPortForward: false,
-		EnableVscodeSupport:    false,
+		SSHHostKeyChecking: "tofu",
+
+		GatewaySelectStrategy:      "lowest_latency",
+		GatewayHealthCheckInterval: 30,
+		GatewayIdleTimeout:         300,
+
+		EnableSSHCertificate: false,
+		SSHCertificateCAKey:  filepath.Join(keyFolderPath, "ssh_ca"),
+		SSHCertificateTTL:    3600,
+
+		EnableLocalPortForward:  false,
+		EnableRemotePortForward: false,
+		PortForwardAllowedPorts: "",
+		EnableVscodeSupport:     false,
+
+		BatchExecConcurrency: 10,
+
+		EnableBuiltinSQLShell:       false,
+		EnableBuiltinRedisConsole:   false,
+		EnableBuiltinMongoDBConsole: false,
+
+		CommandRiskRules: defaultCommandRiskRules,
+
+		EnableMySQLProxy: false,
+		MySQLProxyHost:   "0.0.0.0",
+		MySQLProxyPort:   "3307",
+
+		EnablePostgreSQLProxy: false,
+		PostgreSQLProxyHost:   "0.0.0.0",
+		PostgreSQLProxyPort:   "5433",
+
+		EnableRedisProxy: false,
+		RedisProxyHost:   "0.0.0.0",
+		RedisProxyPort:   "6380",
+
+		EnableMongoDBProxy: false,
+		MongoDBProxyHost:   "0.0.0.0",
+		MongoDBProxyPort:   "27018",
 	}
 
 }
@@ -187,6 +274,13 @@ func loadConfigFromFile(path string, conf *Config) {
 	}
 }
 
+// 数据库命令记录的默认风险分值规则, 每行为 "<分值> <规则>", 取命中规则中最高的分值
+const defaultCommandRiskRules = `90 DROP DATABASE, DROP SCHEMA, FLUSHALL
+80 DELETE, UPDATE WITHOUT WHERE
+70 DROP, TRUNCATE, FLUSHDB
+50 DDL, DCL
+20 DML`
+
 const (
 	prefixName = "[KoKo]-"
 
@@ -0,0 +1,233 @@
+package datamask
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/meowgen/koko/pkg/config"
+	"github.com/meowgen/koko/pkg/logger"
+)
+
+// Masker 按脱敏规则处理数据库代理返回的结果集
+type Masker struct {
+	columns []*Policy
+	values  []*Policy
+}
+
+// NewMasker 创建脱敏器, 没有规则时返回 nil
+func NewMasker(policies []*Policy) *Masker {
+	m := &Masker{}
+	for _, p := range policies {
+		if p.Value != nil {
+			m.values = append(m.values, p)
+		} else {
+			m.columns = append(m.columns, p)
+		}
+	}
+	if len(m.columns) == 0 && len(m.values) == 0 {
+		return nil
+	}
+	return m
+}
+
+var (
+	configMaskerOnce sync.Once
+	configMasker     *Masker
+)
+
+// ConfigMasker 返回配置文件中 DATA_MASKING_RULES 的脱敏器, 没有配置时为 nil
+func ConfigMasker() *Masker {
+	configMaskerOnce.Do(func() {
+		policies, err := ParsePolicies(config.GetConf().DataMaskingRules)
+		if err != nil {
+			// 规则有误时拒绝返回所有字符串值, 避免敏感数据泄露
+			logger.Errorf("Config DATA_MASKING_RULES is invalid, mask all values: %s", err)
+			policies = []*Policy{{Action: ActionMask, Columns: [][]string{{"*"}}}}
+		}
+		configMasker = NewMasker(policies)
+	})
+	return configMasker
+}
+
+// Column 是结果集中的列, 没有来源表的列 (如表达式) Schema 和 Table 为空
+type Column struct {
+	Schema string
+	Table  string
+	Name   string
+	// Text 表示值是文本, 只有文本的值使用 VALUE 规则
+	Text bool
+}
+
+// ResultSet 是一个结果集的脱敏计划
+type ResultSet struct {
+	masker   *Masker
+	columns  []Column
+	policies []*Policy
+	applied  []string
+}
+
+// NewResultSet 创建结果集的脱敏计划, m 为空时返回 nil
+func (m *Masker) NewResultSet() *ResultSet {
+	if m == nil {
+		return nil
+	}
+	return &ResultSet{masker: m}
+}
+
+// AddColumn 按顺序添加结果集的列, 返回整列是否需要脱敏
+func (rs *ResultSet) AddColumn(c Column) bool {
+	return rs.AddColumns([]Column{c})
+}
+
+// AddColumns 添加来源不确定的列, candidates 是列可能的来源, 任一来源命中规则即整列脱敏
+func (rs *ResultSet) AddColumns(candidates []Column) bool {
+	if rs == nil {
+		return false
+	}
+	if len(candidates) == 0 {
+		candidates = []Column{{}}
+	}
+	c := candidates[0]
+	var policy *Policy
+	for _, candidate := range candidates {
+		for _, p := range rs.masker.columns {
+			if p.MatchColumn(candidate.Schema, candidate.Table, candidate.Name) {
+				c, policy = candidate, p
+				break
+			}
+		}
+		if policy != nil {
+			break
+		}
+	}
+	return rs.add(c, policy)
+}
+
+// AddDerivedColumn 添加不直接来自表的列 (如表达式), tables 是语句读取的表.
+// 值可能由表中需要脱敏的列计算得到, 任一表可能有需要脱敏的列时整列脱敏
+func (rs *ResultSet) AddDerivedColumn(c Column, tables []Column) bool {
+	if rs == nil {
+		return false
+	}
+	var policy *Policy
+	for _, p := range rs.masker.columns {
+		if p.MatchColumn("", "", c.Name) {
+			policy = p
+			break
+		}
+	}
+	for i := 0; policy == nil && i < len(tables); i++ {
+		for _, p := range rs.masker.columns {
+			if p.MatchTable(tables[i].Schema, tables[i].Table) {
+				c.Schema, c.Table, policy = tables[i].Schema, tables[i].Table, p
+				break
+			}
+		}
+	}
+	return rs.add(c, policy)
+}
+
+// AddUnknownColumn 添加无法确定来源的列, 有整列脱敏规则时都使用第一条规则脱敏
+func (rs *ResultSet) AddUnknownColumn(c Column) bool {
+	if rs == nil {
+		return false
+	}
+	var policy *Policy
+	if len(rs.masker.columns) > 0 {
+		policy = rs.masker.columns[0]
+	}
+	return rs.add(c, policy)
+}
+
+func (rs *ResultSet) add(c Column, policy *Policy) bool {
+	rs.columns = append(rs.columns, c)
+	rs.policies = append(rs.policies, policy)
+	return policy != nil
+}
+
+// Active 表示结果集的行需要检查, 没有整列脱敏的列且没有 VALUE 规则时不需要改写
+func (rs *ResultSet) Active() bool {
+	if rs == nil {
+		return false
+	}
+	if len(rs.masker.values) > 0 {
+		return true
+	}
+	for _, p := range rs.policies {
+		if p != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// MaskColumn 表示整列都需要脱敏, 非文本的列需要改为字符串类型返回给客户端
+func (rs *ResultSet) MaskColumn(i int) bool {
+	return rs != nil && i < len(rs.policies) && rs.policies[i] != nil
+}
+
+// Mask 对第 i 列的值脱敏, NULL 保持不变, 返回是否有改动
+func (rs *ResultSet) Mask(i int, value []byte) ([]byte, bool) {
+	if rs == nil || value == nil || i >= len(rs.columns) {
+		return value, false
+	}
+	if p := rs.policies[i]; p != nil {
+		rs.record(i, p)
+		return p.Apply(value), true
+	}
+	if !rs.columns[i].Text {
+		return value, false
+	}
+	changed := false
+	for _, p := range rs.masker.values {
+		var ok bool
+		if value, ok = p.ApplyValue(value); ok {
+			rs.record(i, p)
+			changed = true
+		}
+	}
+	return value, changed
+}
+
+// Applied 返回实际执行的脱敏, 如 shop.users.phone: partial(3,4)
+func (rs *ResultSet) Applied() []string {
+	if rs == nil {
+		return nil
+	}
+	return rs.applied
+}
+
+func (rs *ResultSet) record(i int, p *Policy) {
+	c := rs.columns[i]
+	name := c.Name
+	if c.Table != "" {
+		name = c.Table + "." + name
+		if c.Schema != "" {
+			name = c.Schema + "." + name
+		}
+	}
+	entry := name + ": " + p.String()
+	for _, v := range rs.applied {
+		if v == entry {
+			return
+		}
+	}
+	rs.applied = append(rs.applied, entry)
+}
+
+// MergeApplied 合并多个结果集的脱敏记录
+func MergeApplied(items []string, applied ...string) []string {
+	for _, entry := range applied {
+		found := false
+		for _, v := range items {
+			if strings.EqualFold(v, entry) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			items = append(items, entry)
+		}
+	}
+	return items
+}
@@ -0,0 +1,89 @@
+package datamask
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestResultSet_Mask(t *testing.T) {
+	policies, err := ParsePolicies("partial(3,4) COLUMN users.phone\nmask VALUE \\d{6}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs := NewMasker(policies).NewResultSet()
+	columns := []Column{
+		{Schema: "shop", Table: "users", Name: "id"},
+		{Schema: "shop", Table: "users", Name: "phone", Text: true},
+		{Schema: "shop", Table: "users", Name: "note", Text: true},
+	}
+	for i, c := range columns {
+		if masked := rs.AddColumn(c); masked != (i == 1) {
+			t.Errorf("column %s masked = %v", c.Name, masked)
+		}
+	}
+	if !rs.Active() {
+		t.Fatal("result set should be active")
+	}
+	if _, ok := rs.Mask(0, []byte("123456")); ok {
+		t.Error("non-text column should not be masked by value rule")
+	}
+	if got, ok := rs.Mask(1, []byte("13800138000")); !ok || string(got) != "138****8000" {
+		t.Errorf("unexpected phone %q", got)
+	}
+	if got, ok := rs.Mask(1, nil); ok || got != nil {
+		t.Error("NULL should not be masked")
+	}
+	if got, ok := rs.Mask(2, []byte("code 123456")); !ok || string(got) != "code ******" {
+		t.Errorf("unexpected note %q", got)
+	}
+	expected := []string{"shop.users.phone: partial(3,4)", "shop.users.note: mask"}
+	if applied := rs.Applied(); !reflect.DeepEqual(applied, expected) {
+		t.Errorf("applied should be %v but %v", expected, applied)
+	}
+	if merged := MergeApplied(expected[:1], expected...); len(merged) != 2 {
+		t.Errorf("unexpected merged %v", merged)
+	}
+}
+
+func TestNewMasker(t *testing.T) {
+	if m := NewMasker(nil); m != nil {
+		t.Error("masker without policies should be nil")
+	}
+	var m *Masker
+	rs := m.NewResultSet()
+	if rs.AddColumn(Column{Name: "phone"}) || rs.Active() {
+		t.Error("nil result set should not mask")
+	}
+}
+
+func TestResultSet_AddDerivedColumn(t *testing.T) {
+	policies, err := ParsePolicies("partial(3,4) COLUMN shop.users.phone\nhash COLUMN *.customers.email")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs := NewMasker(policies).NewResultSet()
+	if !rs.AddDerivedColumn(Column{Name: "p"}, []Column{{Schema: "shop", Table: "users"}}) {
+		t.Error("expression over masked table should be masked")
+	}
+	if rs.AddDerivedColumn(Column{Name: "total"}, []Column{{Schema: "shop", Table: "orders"}}) {
+		t.Error("expression over unmasked table should not be masked")
+	}
+	if rs.AddDerivedColumn(Column{Name: "email"}, nil) {
+		t.Error("expression without tables should not be masked")
+	}
+	if !rs.AddUnknownColumn(Column{Name: "total"}) {
+		t.Error("unknown column should be masked")
+	}
+	expected := []string{"shop.users.p: partial(3,4)"}
+	rs.Mask(0, []byte("13800138000"))
+	if applied := rs.Applied(); !reflect.DeepEqual(applied, expected) {
+		t.Errorf("applied should be %v but %v", expected, applied)
+	}
+
+	// 只有列名的规则可能命中任何表的列
+	policies, _ = ParsePolicies("mask COLUMN mobile")
+	rs = NewMasker(policies).NewResultSet()
+	if !rs.AddDerivedColumn(Column{Name: "total"}, []Column{{Schema: "shop", Table: "orders"}}) {
+		t.Error("expression should be masked by column only rule")
+	}
+}
@@ -0,0 +1,202 @@
+package datamask
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// 脱敏的方式
+const (
+	// ActionMask 把整个值替换为 ******
+	ActionMask = "mask"
+	// ActionHash 把值替换为 SHA-256 的十六进制摘要, 相同的值脱敏后相同
+	ActionHash = "hash"
+	// ActionPartial 保留开头和结尾的部分字符, 中间的字符替换为 *
+	ActionPartial = "partial"
+)
+
+const (
+	maskedValue = "******"
+
+	defaultKeepStart = 3
+	defaultKeepEnd   = 4
+)
+
+// Policy 是一条脱敏规则, 每行一条, 格式为:
+//
+//	<方式> COLUMN <列>[, <列>...]
+//	<方式> VALUE <正则表达式>
+//
+// 方式是 mask, hash 或 partial, partial 可以指定保留的字符数, 如 partial(3,4).
+// 列是以点分隔的 [schema.][table.]column, 可以使用通配符 *, 不区分大小写;
+// VALUE 规则对字符串值中匹配正则的部分脱敏. 例如:
+//
+//	partial(3,4) COLUMN *.users.phone, customers.mobile
+//	hash COLUMN crm.*.email
+//	mask VALUE \b\d{16,19}\b
+type Policy struct {
+	Action    string
+	KeepStart int
+	KeepEnd   int
+
+	// Columns 是拆分之后的列名, 从右向左依次对应 column, table 和 schema
+	Columns [][]string
+	Value   *regexp.Regexp
+}
+
+var actionPattern = regexp.MustCompile(`^(?i)(mask|hash|partial)(?:\(\s*(\d+)\s*,\s*(\d+)\s*\))?$`)
+
+// ParsePolicies 解析多行的脱敏规则, 忽略空行和以 # 开头的注释
+func ParsePolicies(content string) ([]*Policy, error) {
+	var policies []*Policy
+	for _, line := range strings.Split(content, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		policy, err := ParsePolicy(line)
+		if err != nil {
+			return nil, err
+		}
+		policies = append(policies, policy)
+	}
+	return policies, nil
+}
+
+// ParsePolicy 解析一条脱敏规则
+func ParsePolicy(line string) (*Policy, error) {
+	fields := strings.SplitN(line, " ", 3)
+	if len(fields) < 3 {
+		return nil, fmt.Errorf("masking rule %q: expect <action> COLUMN|VALUE <pattern>", line)
+	}
+	matches := actionPattern.FindStringSubmatch(fields[0])
+	if matches == nil {
+		return nil, fmt.Errorf("masking rule %q: unknown action %q", line, fields[0])
+	}
+	policy := &Policy{Action: strings.ToLower(matches[1])}
+	if policy.Action == ActionPartial {
+		policy.KeepStart, policy.KeepEnd = defaultKeepStart, defaultKeepEnd
+		if matches[2] != "" {
+			policy.KeepStart, _ = strconv.Atoi(matches[2])
+			policy.KeepEnd, _ = strconv.Atoi(matches[3])
+		}
+	}
+	pattern := strings.TrimSpace(fields[2])
+	switch strings.ToUpper(fields[1]) {
+	case "COLUMN":
+		for _, name := range strings.Split(pattern, ",") {
+			name = strings.ToLower(strings.TrimSpace(name))
+			if name == "" {
+				continue
+			}
+			parts := strings.Split(name, ".")
+			if len(parts) > 3 {
+				return nil, fmt.Errorf("masking rule %q: invalid column %q", line, name)
+			}
+			for _, part := range parts {
+				if _, err := path.Match(part, ""); err != nil || part == "" {
+					return nil, fmt.Errorf("masking rule %q: invalid column %q", line, name)
+				}
+			}
+			policy.Columns = append(policy.Columns, parts)
+		}
+		if len(policy.Columns) == 0 {
+			return nil, fmt.Errorf("masking rule %q: missing column", line)
+		}
+	case "VALUE":
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("masking rule %q: %s", line, err)
+		}
+		policy.Value = re
+	default:
+		return nil, fmt.Errorf("masking rule %q: expect COLUMN or VALUE", line)
+	}
+	return policy, nil
+}
+
+// MatchColumn 判断列是否命中规则, 结果集中没有 schema 或表名时只匹配对应位置为 * 的规则
+func (p *Policy) MatchColumn(schema, table, column string) bool {
+	names := []string{strings.ToLower(column), strings.ToLower(table), strings.ToLower(schema)}
+	for _, parts := range p.Columns {
+		matched := true
+		for i := range parts {
+			part := parts[len(parts)-1-i]
+			if ok, _ := path.Match(part, names[i]); !ok {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return true
+		}
+	}
+	return false
+}
+
+// MatchTable 判断规则是否可能命中表中的某一列, 只有列名的规则命中所有的表
+func (p *Policy) MatchTable(schema, table string) bool {
+	names := []string{strings.ToLower(table), strings.ToLower(schema)}
+	for _, parts := range p.Columns {
+		matched := true
+		for i := 0; i < len(parts)-1; i++ {
+			part := parts[len(parts)-2-i]
+			if ok, _ := path.Match(part, names[i]); !ok {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return true
+		}
+	}
+	return false
+}
+
+// Apply 按规则的方式对整个值脱敏
+func (p *Policy) Apply(value []byte) []byte {
+	switch p.Action {
+	case ActionHash:
+		sum := sha256.Sum256(value)
+		return []byte(hex.EncodeToString(sum[:]))
+	case ActionPartial:
+		return partial(value, p.KeepStart, p.KeepEnd)
+	}
+	return []byte(maskedValue)
+}
+
+// ApplyValue 对值中匹配正则的部分脱敏, 返回是否有改动
+func (p *Policy) ApplyValue(value []byte) ([]byte, bool) {
+	if p.Value == nil || !p.Value.Match(value) {
+		return value, false
+	}
+	return p.Value.ReplaceAllFunc(value, p.Apply), true
+}
+
+// String 返回规则的方式, 用于审计记录
+func (p *Policy) String() string {
+	if p.Action == ActionPartial {
+		return fmt.Sprintf("%s(%d,%d)", p.Action, p.KeepStart, p.KeepEnd)
+	}
+	return p.Action
+}
+
+// partial 保留开头和结尾的字符, 值的字符数不超过保留的字符数时全部替换
+func partial(value []byte, keepStart, keepEnd int) []byte {
+	if !utf8.Valid(value) {
+		return []byte(maskedValue)
+	}
+	runes := []rune(string(value))
+	if len(runes) <= keepStart+keepEnd {
+		return []byte(strings.Repeat("*", len(runes)))
+	}
+	masked := string(runes[:keepStart]) + strings.Repeat("*", len(runes)-keepStart-keepEnd) +
+		string(runes[len(runes)-keepEnd:])
+	return []byte(masked)
+}
@@ -0,0 +1,124 @@
+package datamask
+
+import (
+	"testing"
+)
+
+func TestParsePolicies(t *testing.T) {
+	content := `
+# 手机号保留前三位和后四位
+partial(3,4) COLUMN *.users.phone, customers.mobile
+hash COLUMN crm.*.email
+mask VALUE \b\d{16}\b
+`
+	policies, err := ParsePolicies(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(policies) != 3 {
+		t.Fatalf("expect 3 policies but %d", len(policies))
+	}
+	if p := policies[0]; p.Action != ActionPartial || p.KeepStart != 3 || p.KeepEnd != 4 || len(p.Columns) != 2 {
+		t.Errorf("unexpected partial policy %+v", p)
+	}
+	if p := policies[2]; p.Action != ActionMask || p.Value == nil {
+		t.Errorf("unexpected value policy %+v", p)
+	}
+
+	for _, line := range []string{
+		"mask",
+		"blur COLUMN users.phone",
+		"mask ROW users.phone",
+		"mask COLUMN a.b.c.d",
+		"mask COLUMN users.[",
+		"mask VALUE (",
+	} {
+		if _, err := ParsePolicy(line); err == nil {
+			t.Errorf("rule %q should be invalid", line)
+		}
+	}
+}
+
+func TestPolicy_MatchColumn(t *testing.T) {
+	p, err := ParsePolicy("mask COLUMN *.users.phone, mobile, crm.*.email")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		schema, table, column string
+		expected              bool
+	}{
+		{"shop", "users", "phone", true},
+		{"shop", "USERS", "Phone", true},
+		{"", "users", "phone", true},
+		{"shop", "orders", "phone", false},
+		{"", "", "mobile", true},
+		{"crm", "contacts", "email", true},
+		{"shop", "contacts", "email", false},
+		{"", "", "email", false},
+	}
+	for _, tt := range tests {
+		if got := p.MatchColumn(tt.schema, tt.table, tt.column); got != tt.expected {
+			t.Errorf("MatchColumn(%q, %q, %q) = %v, expect %v", tt.schema, tt.table, tt.column, got, tt.expected)
+		}
+	}
+}
+
+func TestPolicy_MatchTable(t *testing.T) {
+	tests := []struct {
+		rule          string
+		schema, table string
+		expected      bool
+	}{
+		{"mask COLUMN *.users.phone", "shop", "users", true},
+		{"mask COLUMN users.phone", "shop", "Users", true},
+		{"mask COLUMN *.users.phone", "shop", "orders", false},
+		{"mask COLUMN crm.*.email", "crm", "contacts", true},
+		{"mask COLUMN crm.*.email", "shop", "contacts", false},
+		{"mask COLUMN phone", "shop", "orders", true},
+	}
+	for _, tt := range tests {
+		p, err := ParsePolicy(tt.rule)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := p.MatchTable(tt.schema, tt.table); got != tt.expected {
+			t.Errorf("%s: MatchTable(%q, %q) = %v, expect %v", tt.rule, tt.schema, tt.table, got, tt.expected)
+		}
+	}
+}
+
+func TestPolicy_Apply(t *testing.T) {
+	tests := []struct {
+		rule     string
+		value    string
+		expected string
+	}{
+		{"mask COLUMN c", "13800138000", "******"},
+		{"partial COLUMN c", "13800138000", "138****8000"},
+		{"partial(1,1) COLUMN c", "张三丰", "张*丰"},
+		{"partial(2,2) COLUMN c", "abc", "***"},
+		{"hash COLUMN c", "abc", "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"},
+	}
+	for _, tt := range tests {
+		p, err := ParsePolicy(tt.rule)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(p.Apply([]byte(tt.value))); got != tt.expected {
+			t.Errorf("%q apply %q = %q, expect %q", tt.rule, tt.value, got, tt.expected)
+		}
+	}
+
+	p, err := ParsePolicy(`partial(0,4) VALUE \b\d{16}\b`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, ok := p.ApplyValue([]byte("card 6222020200112233 paid"))
+	if !ok || string(got) != "card ************2233 paid" {
+		t.Errorf("unexpected value masking %q", got)
+	}
+	if _, ok = p.ApplyValue([]byte("no card")); ok {
+		t.Error("value without card number should not be masked")
+	}
+}
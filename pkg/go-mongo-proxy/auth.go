@@ -0,0 +1,269 @@
+package mongoProxy
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/xdg-go/scram"
+	"go.mongodb.org/mongo-driver/x/bsonx/bsoncore"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/wiremessage"
+)
+
+const (
+	mechanismSHA1   = "SCRAM-SHA-1"
+	mechanismSHA256 = "SCRAM-SHA-256"
+	mechanismPlain  = "PLAIN"
+
+	// authDatabase 是后端系统用户的认证数据库
+	authDatabase = "admin"
+
+	iterationsSHA1   = 10000
+	iterationsSHA256 = 15000
+
+	// https://github.com/mongodb/mongo/blob/master/src/mongo/base/error_codes.yml
+	codeBadValue             = 2
+	codeHostUnreachable      = 6
+	codeUnauthorized         = 13
+	codeAuthenticationFailed = 18
+	codeMechanismUnavailable = 334
+
+	errMsgAuthFailed = "Authentication failed."
+)
+
+var supportedMechanisms = []string{mechanismSHA256, mechanismSHA1}
+
+// commandError 是后端返回的 ok 为 0 的回复
+type commandError struct {
+	Code     int32
+	CodeName string
+	Message  string
+}
+
+func (e *commandError) Error() string {
+	return fmt.Sprintf("%s (%d): %s", e.CodeName, e.Code, e.Message)
+}
+
+func newCommandError(doc bsoncore.Document) *commandError {
+	errMsg, failed := replyError(doc)
+	if !failed {
+		return nil
+	}
+	code, _ := doc.Lookup("code").AsInt64OK()
+	codeName, _ := doc.Lookup("codeName").StringValueOK()
+	return &commandError{Code: int32(code), CodeName: codeName, Message: errMsg}
+}
+
+// errorDocument 生成 MongoDB 格式的错误回复
+func errorDocument(code int32, codeName, errMsg string) bsoncore.Document {
+	return bsoncore.NewDocumentBuilder().
+		AppendDouble("ok", 0).
+		AppendString("errmsg", errMsg).
+		AppendInt32("code", code).
+		AppendString("codeName", codeName).
+		Build()
+}
+
+func okDocument() bsoncore.Document {
+	return bsoncore.NewDocumentBuilder().AppendDouble("ok", 1).Build()
+}
+
+func saslDocument(payload string, done bool) bsoncore.Document {
+	return bsoncore.NewDocumentBuilder().
+		AppendInt32("conversationId", 1).
+		AppendBoolean("done", done).
+		AppendBinary("payload", 0, []byte(payload)).
+		AppendDouble("ok", 1).
+		Build()
+}
+
+// mongoPasswordDigest MongoDB 的 SCRAM-SHA-1 使用 md5(user:mongo:password) 的十六进制作为密码
+func mongoPasswordDigest(username, password string) string {
+	sum := md5.Sum([]byte(username + ":mongo:" + password))
+	return hex.EncodeToString(sum[:])
+}
+
+func newScramClient(mechanism, username, password string) (*scram.Client, error) {
+	switch mechanism {
+	case mechanismSHA256:
+		return scram.SHA256.NewClient(username, password, "")
+	case mechanismSHA1:
+		return scram.SHA1.NewClientUnprepped(username, mongoPasswordDigest(username, password), "")
+	}
+	return nil, fmt.Errorf("unsupported mechanism %s", mechanism)
+}
+
+// secretLookup 根据客户端登录使用的用户名(连接令牌)返回密钥
+type secretLookup func(username string) (string, error)
+
+// saslServer 代理作为 SCRAM 服务端, 使用连接令牌的密钥校验客户端
+type saslServer struct {
+	conv *scram.ServerConversation
+
+	// skipEmptyExchange 为 true 时最后一步直接返回 done, 不需要客户端再发送空的 saslContinue
+	skipEmptyExchange bool
+
+	// err 是查找连接令牌失败的原因, 只用于日志
+	err error
+}
+
+func newSaslServer(mechanism string, lookup secretLookup) (*saslServer, error) {
+	var (
+		hashGen    scram.HashGeneratorFcn
+		iterations int
+	)
+	switch mechanism {
+	case mechanismSHA256:
+		hashGen, iterations = scram.SHA256, iterationsSHA256
+	case mechanismSHA1:
+		hashGen, iterations = scram.SHA1, iterationsSHA1
+	default:
+		return nil, fmt.Errorf("unsupported mechanism %s", mechanism)
+	}
+	s := &saslServer{}
+	server, err := hashGen.NewServer(func(username string) (scram.StoredCredentials, error) {
+		secret, err := lookup(username)
+		if err != nil {
+			s.err = err
+			return scram.StoredCredentials{}, err
+		}
+		client, err := newScramClient(mechanism, username, secret)
+		if err != nil {
+			return scram.StoredCredentials{}, err
+		}
+		salt := make([]byte, 16)
+		if _, err = rand.Read(salt); err != nil {
+			return scram.StoredCredentials{}, err
+		}
+		return client.GetStoredCredentials(scram.KeyFactors{Salt: string(salt), Iters: iterations}), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	s.conv = server.NewConversation()
+	return s, nil
+}
+
+// Step 处理客户端的一步消息, 返回需要发送给客户端的消息
+func (s *saslServer) Step(payload []byte) (string, error) {
+	resp, err := s.conv.Step(string(payload))
+	if err != nil {
+		if s.err != nil {
+			return "", s.err
+		}
+		return "", err
+	}
+	return resp, nil
+}
+
+// Done 返回 SCRAM 会话是否已经完成校验
+func (s *saslServer) Done() bool {
+	return s.conv.Done() && s.conv.Valid()
+}
+
+// Username 返回客户端登录使用的用户名
+func (s *saslServer) Username() string {
+	return s.conv.Username()
+}
+
+// parsePlainPayload 解析 PLAIN 机制的 authzid\0username\0password
+func parsePlainPayload(payload []byte) (string, string, error) {
+	parts := bytes.Split(payload, []byte{0})
+	if len(parts) != 3 {
+		return "", "", errors.New("invalid PLAIN payload")
+	}
+	return string(parts[1]), string(parts[2]), nil
+}
+
+// roundTrip 向后端发送一个 OP_MSG 命令并读取回复
+func roundTrip(w io.Writer, r *bufio.Reader, doc bsoncore.Document) (bsoncore.Document, error) {
+	if _, err := w.Write(newOpMsg(wiremessage.NextRequestID(), 0, doc)); err != nil {
+		return nil, err
+	}
+	msg, err := readWireMessage(r)
+	if err != nil {
+		return nil, err
+	}
+	return decodeReply(msg)
+}
+
+// authUpstream 使用系统用户通过 SCRAM 登录后端 MongoDB, 后端支持时优先使用 SCRAM-SHA-256
+func authUpstream(w io.Writer, r *bufio.Reader, username, password string) error {
+	if username == "" {
+		return nil
+	}
+	reply, err := roundTrip(w, r, bsoncore.NewDocumentBuilder().
+		AppendInt32("isMaster", 1).
+		AppendString("saslSupportedMechs", authDatabase+"."+username).
+		AppendString("$db", authDatabase).
+		Build())
+	if err != nil {
+		return err
+	}
+	if cmdErr := newCommandError(reply); cmdErr != nil {
+		return cmdErr
+	}
+	mechanism := mechanismSHA1
+	if mechs, ok := reply.Lookup("saslSupportedMechs").ArrayOK(); ok {
+		values, _ := mechs.Values()
+		for _, v := range values {
+			if name, _ := v.StringValueOK(); name == mechanismSHA256 {
+				mechanism = mechanismSHA256
+			}
+		}
+	}
+	client, err := newScramClient(mechanism, username, password)
+	if err != nil {
+		return err
+	}
+	conv := client.NewConversation()
+	payload, err := conv.Step("")
+	if err != nil {
+		return err
+	}
+	reply, err = roundTrip(w, r, bsoncore.NewDocumentBuilder().
+		AppendInt32("saslStart", 1).
+		AppendString("mechanism", mechanism).
+		AppendBinary("payload", 0, []byte(payload)).
+		AppendDocument("options", bsoncore.NewDocumentBuilder().
+			AppendBoolean("skipEmptyExchange", true).Build()).
+		AppendString("$db", authDatabase).
+		Build())
+	if err != nil {
+		return err
+	}
+	for {
+		if cmdErr := newCommandError(reply); cmdErr != nil {
+			return cmdErr
+		}
+		done, _ := reply.Lookup("done").BooleanOK()
+		if !conv.Done() {
+			_, challenge, _ := reply.Lookup("payload").BinaryOK()
+			if payload, err = conv.Step(string(challenge)); err != nil {
+				return err
+			}
+		}
+		if done {
+			break
+		}
+		// 后端不支持 skipEmptyExchange 时, 校验服务端签名之后还需要再发送一次空的 saslContinue
+		reply, err = roundTrip(w, r, bsoncore.NewDocumentBuilder().
+			AppendInt32("saslContinue", 1).
+			AppendValue("conversationId", reply.Lookup("conversationId")).
+			AppendBinary("payload", 0, []byte(payload)).
+			AppendString("$db", authDatabase).
+			Build())
+		if err != nil {
+			return err
+		}
+	}
+	if !conv.Valid() {
+		return errors.New("invalid server signature")
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package mongoProxy
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/x/bsonx/bsoncore"
+)
+
+// fakeUpstream 使用代理的 SCRAM 服务端模拟后端 MongoDB, 只接受 app/secret 登录
+func fakeUpstream(t *testing.T, server net.Conn, mechs ...string) {
+	defer server.Close()
+	r := bufio.NewReader(server)
+	var sasl *saslServer
+	for {
+		msg, err := readWireMessage(r)
+		if err != nil {
+			return
+		}
+		cmd, err := decodeCommand(msg)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if cmd.Database != authDatabase {
+			t.Errorf("%s should use admin database but %s", cmd.Name, cmd.Database)
+		}
+		var reply bsoncore.Document
+		_, payload, _ := cmd.Doc.Lookup("payload").BinaryOK()
+		switch cmd.Name {
+		case "isMaster":
+			values := make([]bsoncore.Value, 0, len(mechs))
+			for _, mech := range mechs {
+				values = append(values, bsoncore.Value{Type: bsontype.String, Data: bsoncore.AppendString(nil, mech)})
+			}
+			reply = bsoncore.NewDocumentBuilder().
+				AppendArray("saslSupportedMechs", bsoncore.BuildArray(nil, values...)).
+				AppendDouble("ok", 1).Build()
+		case "saslStart":
+			mechanism, _ := cmd.Doc.Lookup("mechanism").StringValueOK()
+			if sasl, err = newSaslServer(mechanism, func(username string) (string, error) {
+				if username != "app" {
+					return "", errors.New("unknown user")
+				}
+				return "secret", nil
+			}); err != nil {
+				t.Error(err)
+				return
+			}
+			fallthrough
+		case "saslContinue":
+			resp, err := sasl.Step(payload)
+			if err != nil {
+				reply = errorDocument(codeAuthenticationFailed, "AuthenticationFailed", errMsgAuthFailed)
+				break
+			}
+			reply = saslDocument(resp, sasl.Done())
+		default:
+			t.Errorf("unexpected command %s", cmd.Name)
+			return
+		}
+		if _, err = server.Write(newReply(cmd, reply)); err != nil {
+			return
+		}
+	}
+}
+
+func TestAuthUpstream(t *testing.T) {
+	tests := []struct {
+		mechs    []string
+		password string
+		failed   bool
+	}{
+		{mechs: []string{mechanismSHA256, mechanismSHA1}, password: "secret"},
+		{mechs: []string{mechanismSHA1}, password: "secret"},
+		{mechs: []string{mechanismSHA256}, password: "wrong", failed: true},
+	}
+	for _, tt := range tests {
+		client, server := net.Pipe()
+		go fakeUpstream(t, server, tt.mechs...)
+		err := authUpstream(client, bufio.NewReader(client), "app", tt.password)
+		_ = client.Close()
+		var cmdErr *commandError
+		switch {
+		case tt.failed && !errors.As(err, &cmdErr):
+			t.Errorf("%v: auth with wrong password should fail with server error but %v", tt.mechs, err)
+		case !tt.failed && err != nil:
+			t.Errorf("%v: auth failed: %s", tt.mechs, err)
+		}
+	}
+}
+
+func TestParsePlainPayload(t *testing.T) {
+	token, secret, err := parsePlainPayload([]byte("\x00token\x00secret"))
+	if err != nil || token != "token" || secret != "secret" {
+		t.Errorf("unexpected token %q secret %q err %v", token, secret, err)
+	}
+	if _, _, err = parsePlainPayload([]byte("token")); err == nil {
+		t.Error("payload without separator should be rejected")
+	}
+}
+
+func TestMongoPasswordDigest(t *testing.T) {
+	// echo -n 'user:mongo:pencil' | md5sum
+	if got := mongoPasswordDigest("user", "pencil"); got != "1c33006ec1ffd90f9cadcbcc0e118200" {
+		t.Errorf("unexpected digest %s", got)
+	}
+}
@@ -0,0 +1,238 @@
+package mongoProxy
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/x/bsonx/bsoncore"
+
+	"github.com/meowgen/koko/pkg/sqlparser"
+)
+
+// 代理不审计的连接维护类命令, 直接转发到后端
+var ignoredCommands = map[string]bool{
+	"ping":           true,
+	"buildinfo":      true,
+	"getmore":        true,
+	"killcursors":    true,
+	"endsessions":    true,
+	"getlasterror":   true,
+	"getparameter":   true,
+	"getcmdlineopts": true,
+}
+
+// 认证相关的命令由代理处理, 不转发到后端
+var authCommands = map[string]bool{
+	"saslstart":    true,
+	"saslcontinue": true,
+	"authenticate": true,
+	"getnonce":     true,
+	"logout":       true,
+}
+
+// formatCommand 以 mongosh 的格式输出命令, 用于命令过滤和记录
+func formatCommand(cmd *command) string {
+	coll := collectionRef(cmd.Collection)
+	doc := cmd.Doc
+	switch strings.ToLower(cmd.Name) {
+	case "find":
+		args := []string{formatValueOr(doc.Lookup("filter"), "{}")}
+		if projection, ok := doc.Lookup("projection").DocumentOK(); ok {
+			args = append(args, formatDocument(projection))
+		}
+		s := fmt.Sprintf("%s.find(%s)", coll, strings.Join(args, ", "))
+		if sort, ok := doc.Lookup("sort").DocumentOK(); ok {
+			s += ".sort(" + formatDocument(sort) + ")"
+		}
+		if skip, ok := doc.Lookup("skip").AsInt64OK(); ok && skip > 0 {
+			s += fmt.Sprintf(".skip(%d)", skip)
+		}
+		if limit, ok := doc.Lookup("limit").AsInt64OK(); ok && limit != 0 {
+			s += fmt.Sprintf(".limit(%d)", limit)
+		}
+		return s
+	case "insert":
+		docs := commandDocuments(cmd, "documents")
+		if len(docs) == 1 {
+			return fmt.Sprintf("%s.insertOne(%s)", coll, formatDocument(docs[0]))
+		}
+		parts := make([]string, 0, len(docs))
+		for _, d := range docs {
+			parts = append(parts, formatDocument(d))
+		}
+		return fmt.Sprintf("%s.insertMany([%s])", coll, strings.Join(parts, ","))
+	case "update":
+		updates := commandDocuments(cmd, "updates")
+		parts := make([]string, 0, len(updates))
+		for _, u := range updates {
+			method := "updateOne"
+			if multi, _ := u.Lookup("multi").BooleanOK(); multi {
+				method = "updateMany"
+			}
+			parts = append(parts, fmt.Sprintf("%s.%s(%s, %s)", coll, method,
+				formatValueOr(u.Lookup("q"), "{}"), formatValueOr(u.Lookup("u"), "{}")))
+		}
+		return strings.Join(parts, "; ")
+	case "delete":
+		deletes := commandDocuments(cmd, "deletes")
+		parts := make([]string, 0, len(deletes))
+		for _, d := range deletes {
+			method := "deleteMany"
+			if limit, _ := d.Lookup("limit").AsInt64OK(); limit == 1 {
+				method = "deleteOne"
+			}
+			parts = append(parts, fmt.Sprintf("%s.%s(%s)", coll, method, formatValueOr(d.Lookup("q"), "{}")))
+		}
+		return strings.Join(parts, "; ")
+	case "aggregate":
+		pipeline := formatValueOr(doc.Lookup("pipeline"), "[]")
+		if cmd.Collection == "" {
+			// { aggregate: 1 } 是数据库级别的聚合
+			return "db.aggregate(" + pipeline + ")"
+		}
+		return coll + ".aggregate(" + pipeline + ")"
+	case "count":
+		return coll + ".count(" + formatValueOr(doc.Lookup("query"), "{}") + ")"
+	case "distinct":
+		key, _ := doc.Lookup("key").StringValueOK()
+		return fmt.Sprintf("%s.distinct(%s, %s)", coll, strconv.Quote(key),
+			formatValueOr(doc.Lookup("query"), "{}"))
+	case "findandmodify":
+		options := filterDocument(doc, func(key string) bool {
+			return key == cmd.Name || isCommandMetaKey(key)
+		})
+		return coll + ".findAndModify(" + formatDocument(options) + ")"
+	case "drop":
+		return coll + ".drop()"
+	case "create":
+		return "db.createCollection(" + strconv.Quote(cmd.Collection) + ")"
+	case "createindexes":
+		return coll + ".createIndexes(" + formatValueOr(doc.Lookup("indexes"), "[]") + ")"
+	case "dropindexes":
+		return coll + ".dropIndexes(" + formatValueOr(doc.Lookup("index"), "") + ")"
+	case "dropdatabase":
+		return "db.dropDatabase()"
+	}
+	return "db.runCommand(" + formatDocument(filterDocument(doc, isCommandMetaKey)) + ")"
+}
+
+// commandStatement 识别命令的类型和操作的集合, 用于命令记录
+func commandStatement(cmd *command) *sqlparser.Statement {
+	name := strings.ToLower(cmd.Name)
+	database := cmd.Database
+	hasFilter := false
+	switch name {
+	case "update", "delete":
+		key := name + "s"
+		docs := commandDocuments(cmd, key)
+		hasFilter = len(docs) > 0
+		for _, d := range docs {
+			if q, ok := d.Lookup("q").DocumentOK(); !ok || isEmptyDocument(q) {
+				hasFilter = false
+			}
+		}
+	case "findandmodify":
+		q, ok := cmd.Doc.Lookup("query").DocumentOK()
+		hasFilter = ok && !isEmptyDocument(q)
+	case "renamecollection":
+		// renameCollection 的参数是包含数据库的完整名称
+		database = ""
+	}
+	return sqlparser.MongoStatement(cmd.Name, database, cmd.Collection, hasFilter)
+}
+
+func isEmptyDocument(doc bsoncore.Document) bool {
+	elems, err := doc.Elements()
+	return err != nil || len(elems) == 0
+}
+
+// collectionRef 返回 mongosh 中引用集合的表达式, 集合名不是合法标识符时使用 getCollection
+func collectionRef(name string) string {
+	if name == "" {
+		return "db"
+	}
+	for i, r := range name {
+		if r == '_' || r == '$' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || i > 0 && r >= '0' && r <= '9' {
+			continue
+		}
+		return "db.getCollection(" + strconv.Quote(name) + ")"
+	}
+	return "db." + name
+}
+
+// commandDocuments 返回写命令中的文档, 优先使用 OP_MSG 的文档序列
+func commandDocuments(cmd *command, key string) []bsoncore.Document {
+	if docs, ok := cmd.Sequences[key]; ok {
+		return docs
+	}
+	arr, ok := cmd.Doc.Lookup(key).ArrayOK()
+	if !ok {
+		return nil
+	}
+	values, err := arr.Values()
+	if err != nil {
+		return nil
+	}
+	docs := make([]bsoncore.Document, 0, len(values))
+	for _, v := range values {
+		if d, ok := v.DocumentOK(); ok {
+			docs = append(docs, d)
+		}
+	}
+	return docs
+}
+
+// isCommandMetaKey 判断是否是驱动附加的会话和路由字段, 如 $db, lsid
+func isCommandMetaKey(key string) bool {
+	return strings.HasPrefix(key, "$") || key == "lsid" || key == "txnNumber"
+}
+
+// filterDocument 返回去掉 drop 匹配字段之后的文档
+func filterDocument(doc bsoncore.Document, drop func(key string) bool) bsoncore.Document {
+	elems, err := doc.Elements()
+	if err != nil {
+		return doc
+	}
+	idx, dst := bsoncore.ReserveLength(nil)
+	for _, elem := range elems {
+		if drop(elem.Key()) {
+			continue
+		}
+		dst = append(dst, elem...)
+	}
+	dst, _ = bsoncore.AppendDocumentEnd(dst, idx)
+	return dst
+}
+
+// formatDocument 以 relaxed extended JSON 输出文档
+func formatDocument(doc bsoncore.Document) string {
+	data, err := bson.MarshalExtJSON(bson.Raw(doc), false, false)
+	if err != nil {
+		return doc.String()
+	}
+	return string(data)
+}
+
+// formatValue 以 relaxed extended JSON 输出任意 BSON 值
+func formatValue(v bsoncore.Value) string {
+	if doc, ok := v.DocumentOK(); ok {
+		return formatDocument(doc)
+	}
+	const prefix = `{"v":`
+	wrapped := bsoncore.BuildDocument(nil, bsoncore.AppendValueElement(nil, "v", v))
+	s := formatDocument(wrapped)
+	if strings.HasPrefix(s, prefix) && strings.HasSuffix(s, "}") {
+		return s[len(prefix) : len(s)-1]
+	}
+	return v.String()
+}
+
+// formatValueOr 在值不存在时返回 def
+func formatValueOr(v bsoncore.Value, def string) string {
+	if v.Type == 0 {
+		return def
+	}
+	return formatValue(v)
+}
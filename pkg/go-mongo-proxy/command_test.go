@@ -0,0 +1,128 @@
+package mongoProxy
+
+import (
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/x/bsonx/bsoncore"
+)
+
+// mustParseDocument 把 extended JSON 转换为保持字段顺序的 BSON 文档
+func mustParseDocument(t *testing.T, s string) bsoncore.Document {
+	t.Helper()
+	var doc bson.D
+	if err := bson.UnmarshalExtJSON([]byte(s), false, &doc); err != nil {
+		t.Fatal(err)
+	}
+	data, err := bson.Marshal(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func newTestCommand(t *testing.T, s string) *command {
+	t.Helper()
+	cmd := &command{Doc: mustParseDocument(t, s)}
+	elem := cmd.Doc.Index(0)
+	cmd.Name = elem.Key()
+	cmd.Collection, _ = elem.Value().StringValueOK()
+	return cmd
+}
+
+func TestFormatCommand(t *testing.T) {
+	tests := []struct {
+		doc      string
+		expected string
+	}{
+		{
+			doc: `{"find":"users","filter":{"age":{"$gt":18}},"sort":{"name":1},"limit":10,` +
+				`"$db":"shop","lsid":{"id":1}}`,
+			expected: `db.users.find({"age":{"$gt":18}}).sort({"name":1}).limit(10)`,
+		},
+		{
+			doc:      `{"find":"order-items"}`,
+			expected: `db.getCollection("order-items").find({})`,
+		},
+		{
+			doc:      `{"insert":"users","documents":[{"name":"tom"}]}`,
+			expected: `db.users.insertOne({"name":"tom"})`,
+		},
+		{
+			doc:      `{"update":"users","updates":[{"q":{"name":"tom"},"u":{"$set":{"age":20}},"multi":true}]}`,
+			expected: `db.users.updateMany({"name":"tom"}, {"$set":{"age":20}})`,
+		},
+		{
+			doc:      `{"delete":"users","deletes":[{"q":{},"limit":1}]}`,
+			expected: `db.users.deleteOne({})`,
+		},
+		{
+			doc:      `{"aggregate":"users","pipeline":[{"$match":{"age":1}}]}`,
+			expected: `db.users.aggregate([{"$match":{"age":1}}])`,
+		},
+		{
+			doc:      `{"aggregate":1,"pipeline":[{"$currentOp":{}}]}`,
+			expected: `db.aggregate([{"$currentOp":{}}])`,
+		},
+		{
+			doc:      `{"distinct":"users","key":"name"}`,
+			expected: `db.users.distinct("name", {})`,
+		},
+		{
+			doc:      `{"findAndModify":"users","query":{"a":1},"remove":true,"$db":"shop"}`,
+			expected: `db.users.findAndModify({"query":{"a":1},"remove":true})`,
+		},
+		{
+			doc:      `{"drop":"users"}`,
+			expected: `db.users.drop()`,
+		},
+		{
+			doc:      `{"dropDatabase":1,"$db":"shop"}`,
+			expected: `db.dropDatabase()`,
+		},
+		{
+			doc:      `{"listCollections":1,"nameOnly":true,"$db":"shop"}`,
+			expected: `db.runCommand({"listCollections":1,"nameOnly":true})`,
+		},
+	}
+	for _, tt := range tests {
+		if got := formatCommand(newTestCommand(t, tt.doc)); got != tt.expected {
+			t.Errorf("format command should be %s but %s", tt.expected, got)
+		}
+	}
+}
+
+func TestFormatCommand_DocumentSequence(t *testing.T) {
+	cmd := newTestCommand(t, `{"insert":"users"}`)
+	cmd.Sequences = map[string][]bsoncore.Document{"documents": {
+		mustParseDocument(t, `{"a":1}`),
+		mustParseDocument(t, `{"a":2}`),
+	}}
+	if got := formatCommand(cmd); got != `db.users.insertMany([{"a":1},{"a":2}])` {
+		t.Errorf("unexpected input %s", got)
+	}
+}
+
+func TestCommandStatement(t *testing.T) {
+	tests := []struct {
+		doc      string
+		typ      string
+		hasWhere bool
+		target   string
+	}{
+		{`{"delete":"users","deletes":[{"q":{"name":"tom"},"limit":1}],"$db":"shop"}`, "DELETE", true, "shop.users"},
+		{`{"delete":"users","deletes":[{"q":{"name":"tom"}},{"q":{}}],"$db":"shop"}`, "DELETE", false, "shop.users"},
+		{`{"update":"users","updates":[{"q":{},"u":{"$set":{"a":1}}}],"$db":"shop"}`, "UPDATE", false, "shop.users"},
+		{`{"findAndModify":"users","query":{"a":1},"remove":true,"$db":"shop"}`, "UPDATE", true, "shop.users"},
+		{`{"renameCollection":"shop.a","to":"shop.b","$db":"admin"}`, "RENAME", false, "shop.a"},
+		{`{"dropDatabase":1,"$db":"shop"}`, "DROP", false, "shop"},
+	}
+	for _, tt := range tests {
+		cmd := newTestCommand(t, tt.doc)
+		cmd.Database, _ = cmd.Doc.Lookup("$db").StringValueOK()
+		stmt := commandStatement(cmd)
+		if stmt.Type != tt.typ || stmt.HasWhere != tt.hasWhere || len(stmt.Targets) != 1 || stmt.Targets[0] != tt.target {
+			t.Errorf("commandStatement(%s) = %s where=%v %q", tt.doc, stmt.Type, stmt.HasWhere, stmt.Targets)
+		}
+	}
+}
@@ -0,0 +1,231 @@
+package mongoProxy
+
+import (
+	"bufio"
+	"crypto/tls"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/x/bsonx/bsoncore"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/wiremessage"
+
+	"github.com/meowgen/koko/pkg/jms-sdk-go/model"
+	"github.com/meowgen/koko/pkg/jms-sdk-go/service"
+	"github.com/meowgen/koko/pkg/logger"
+	"github.com/meowgen/koko/pkg/proxybase"
+	"github.com/meowgen/koko/pkg/sqlparser"
+)
+
+type Connection struct {
+	id         int32
+	conn       net.Conn
+	reader     *bufio.Reader
+	upstream   net.Conn
+	host       string
+	port       string
+	JmsService *service.JMService
+	FakeServer *FakeServer
+
+	Username    string
+	Password    string
+	Database    string
+	Token       *service.TokenAuthInfoResponse
+	CurrSession *CurrSession
+
+	sasl   *saslServer
+	filter *proxybase.CommandFilter
+
+	// 客户端最后一步登录命令, 连接后端成功后再回复 authDone
+	authCmd  *command
+	authDone bsoncore.Document
+
+	// 已转发到后端等待回复的命令, 按请求的 requestID 保存
+	resultMu sync.Mutex
+	results  map[int32]*commandResult
+
+	writeMu   sync.Mutex
+	mu        sync.Mutex
+	closeOnce sync.Once
+	endOnce   sync.Once
+}
+
+func NewConnection(fakeSrv *FakeServer, conn net.Conn) *Connection {
+	if fakeSrv.TLSConfig != nil {
+		conn = tls.Server(conn, fakeSrv.TLSConfig)
+	}
+	return &Connection{
+		id:         fakeSrv.nextConnectionID(),
+		conn:       conn,
+		reader:     bufio.NewReader(conn),
+		JmsService: fakeSrv.JmsService,
+		FakeServer: fakeSrv,
+		results:    make(map[int32]*commandResult),
+	}
+}
+
+func (c *Connection) setUpstream(conn net.Conn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.upstream = conn
+}
+
+// writeMessage 向客户端写一个完整的消息, 代理的回复和后端的回复可能同时写入
+func (c *Connection) writeMessage(data []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	_, err := c.conn.Write(data)
+	return err
+}
+
+// writeReply 回复客户端的命令, 客户端设置了 moreToCome 时不需要回复
+func (c *Connection) writeReply(cmd *command, doc bsoncore.Document) {
+	if cmd.MoreToCome {
+		return
+	}
+	if err := c.writeMessage(newReply(cmd, doc)); err != nil {
+		logger.Debugf("MongoDB proxy write reply to %s failed: %s", c.conn.RemoteAddr(), err)
+	}
+}
+
+// Close 关闭客户端和后端 MongoDB 连接, 并结束当前会话
+func (c *Connection) Close() {
+	c.closeOnce.Do(func() {
+		c.mu.Lock()
+		upstream := c.upstream
+		c.mu.Unlock()
+		if c.CurrSession != nil {
+			c.CurrSession.SwSess.Cancel()
+		}
+		_ = c.conn.Close()
+		if upstream != nil {
+			_ = upstream.Close()
+		}
+	})
+}
+
+type Request struct {
+	conn     *Connection
+	currSess *CurrSession
+}
+
+// Handle 检查并记录客户端的命令, 返回需要转发到后端的数据, 为空时不转发
+func (req *Request) Handle(msg *wireMessage) []byte {
+	c := req.conn
+	cmd, err := decodeCommand(msg)
+	if err != nil {
+		// 无法解析的消息(如 OP_COMPRESSED)无法审计, 不转发到后端
+		logger.Infof("Session %s: MongoDB proxy reject message: %s", req.currSess.Sess.ID, err)
+		c.writeReply(&command{RequestID: msg.RequestID, OpCode: wiremessage.OpMsg},
+			errorDocument(codeBadValue, "BadValue", err.Error()))
+		return nil
+	}
+	name := strings.ToLower(cmd.Name)
+	switch {
+	case name == "hello" || name == "ismaster":
+		// 由代理回复, 避免客户端发现后端副本集的其它节点后绕过代理直连
+		c.writeReply(cmd, helloDocument(cmd, c.id))
+		return nil
+	case name == "logout":
+		c.writeReply(cmd, okDocument())
+		return nil
+	case authCommands[name]:
+		c.writeReply(cmd, errorDocument(codeAuthenticationFailed, "AuthenticationFailed",
+			"re-authentication is not supported by the proxy"))
+		return nil
+	case ignoredCommands[name]:
+		return msg.Raw
+	}
+
+	input := formatCommand(cmd)
+	stmt := commandStatement(cmd)
+	if cmd.Database != "" {
+		c.mu.Lock()
+		c.Database = cmd.Database
+		c.mu.Unlock()
+	}
+	c.recordPrompt(input)
+	if allowed, errMsg := c.filter.Check(c.CurrSession, input); !allowed {
+		logger.Infof("Session %s: MongoDB proxy forbid command: %s", req.currSess.Sess.ID, input)
+		c.recordReplay([]byte(errMsg + "\r\n"))
+		c.recordCommand(input, stmt, errMsg, model.DangerLevel, time.Now())
+		c.writeReply(cmd, errorDocument(codeUnauthorized, "Unauthorized", errMsg))
+		return nil
+	}
+	if cmd.MoreToCome {
+		c.recordCommand(input, stmt, "", model.NormalLevel, time.Now())
+		return msg.Raw
+	}
+	c.resultMu.Lock()
+	c.results[cmd.RequestID] = newCommandResult(input, stmt)
+	c.resultMu.Unlock()
+	return msg.Raw
+}
+
+// Response 处理后端返回的消息, 只在读取后端的 goroutine 中使用
+type Response struct {
+	conn     *Connection
+	currSess *CurrSession
+}
+
+// Handle 把回复转发给客户端, 并记录对应命令的执行结果
+func (res *Response) Handle(msg *wireMessage) error {
+	c := res.conn
+	if err := c.writeMessage(msg.Raw); err != nil {
+		return err
+	}
+	c.resultMu.Lock()
+	result, ok := c.results[msg.ResponseTo]
+	delete(c.results, msg.ResponseTo)
+	c.resultMu.Unlock()
+	if !ok {
+		return nil
+	}
+	var output string
+	if doc, err := decodeReply(msg); err != nil {
+		logger.Debugf("Session %s: MongoDB proxy decode reply err: %s", res.currSess.Sess.ID, err)
+	} else {
+		output = formatReply(doc)
+	}
+	c.recordReplay([]byte(output + "\r\n"))
+	c.recordCommand(result.Input, result.Statement, output, model.NormalLevel, result.CreatedAt)
+	return nil
+}
+
+// flushResults 会话结束时记录尚未返回的命令
+func (c *Connection) flushResults() {
+	c.resultMu.Lock()
+	results := c.results
+	c.results = make(map[int32]*commandResult)
+	c.resultMu.Unlock()
+	for _, result := range results {
+		c.recordCommand(result.Input, result.Statement, "", model.NormalLevel, result.CreatedAt)
+	}
+}
+
+// recordPrompt 以 mongosh 的提示符格式记录命令
+func (c *Connection) recordPrompt(input string) {
+	c.mu.Lock()
+	database := c.Database
+	c.mu.Unlock()
+	c.recordReplay([]byte(database + "> " + input + "\r\n"))
+}
+
+func (c *Connection) recordCommand(input string, stmt *sqlparser.Statement, output string, riskLevel int64, createdAt time.Time) {
+	sess := c.CurrSession
+	if sess == nil || sess.CmdRecorder == nil {
+		return
+	}
+	cmd := sess.NewCommand(input, output, riskLevel, createdAt)
+	sqlparser.TagCommand(cmd, []*sqlparser.Statement{stmt})
+	sess.CmdRecorder.RecordCommand(cmd)
+}
+
+func (c *Connection) recordReplay(p []byte) {
+	sess := c.CurrSession
+	if sess == nil || sess.ReplRecorder == nil {
+		return
+	}
+	sess.ReplRecorder.Record(p)
+}
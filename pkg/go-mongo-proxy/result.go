@@ -0,0 +1,106 @@
+package mongoProxy
+
+import (
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"go.mongodb.org/mongo-driver/x/bsonx/bsoncore"
+
+	"github.com/meowgen/koko/pkg/sqlparser"
+)
+
+const (
+	maxPreviewDocuments = 20
+	maxOutputLength     = 4096
+)
+
+// commandResult 记录一条已转发的命令, 等待后端按 responseTo 返回回复
+type commandResult struct {
+	Input     string
+	Statement *sqlparser.Statement
+	CreatedAt time.Time
+}
+
+func newCommandResult(input string, stmt *sqlparser.Statement) *commandResult {
+	return &commandResult{
+		Input:     input,
+		Statement: stmt,
+		CreatedAt: time.Now(),
+	}
+}
+
+// formatReply 输出后端的执行结果, 用于命令记录
+func formatReply(doc bsoncore.Document) string {
+	output := formatReplyDocument(doc)
+	if len(output) > maxOutputLength {
+		output = truncateString(output, maxOutputLength) + "..."
+	}
+	return output
+}
+
+func formatReplyDocument(doc bsoncore.Document) string {
+	if errMsg, failed := replyError(doc); failed {
+		return "MongoServerError: " + errMsg
+	}
+	if writeErrors, ok := doc.Lookup("writeErrors").ArrayOK(); ok {
+		if values, err := writeErrors.Values(); err == nil && len(values) > 0 {
+			if first, ok := values[0].DocumentOK(); ok {
+				errMsg, _ := first.Lookup("errmsg").StringValueOK()
+				return "MongoBulkWriteError: " + errMsg
+			}
+		}
+	}
+	if cursor, ok := doc.Lookup("cursor").DocumentOK(); ok {
+		batch, ok := cursor.Lookup("firstBatch").ArrayOK()
+		if !ok {
+			batch, ok = cursor.Lookup("nextBatch").ArrayOK()
+		}
+		if ok {
+			return formatBatch(batch)
+		}
+	}
+	return formatDocument(filterDocument(doc, isReplyMetaKey))
+}
+
+// formatBatch 每行输出一个文档, 最多输出 maxPreviewDocuments 个
+func formatBatch(batch bsoncore.Array) string {
+	values, err := batch.Values()
+	if err != nil {
+		return batch.String()
+	}
+	lines := make([]string, 0, len(values))
+	for i, v := range values {
+		if i == maxPreviewDocuments {
+			lines = append(lines, fmt.Sprintf("(%d documents, %d shown)", len(values), maxPreviewDocuments))
+			break
+		}
+		lines = append(lines, formatValue(v))
+	}
+	return strings.Join(lines, "\r\n")
+}
+
+// replyError 返回 ok 不为 1 的回复中的错误信息
+func replyError(doc bsoncore.Document) (string, bool) {
+	if ok, _ := doc.Lookup("ok").AsInt64OK(); ok == 1 {
+		return "", false
+	}
+	errMsg, _ := doc.Lookup("errmsg").StringValueOK()
+	return errMsg, true
+}
+
+func isReplyMetaKey(key string) bool {
+	return strings.HasPrefix(key, "$") || key == "ok" || key == "operationTime"
+}
+
+func truncateString(s string, length int) string {
+	if len(s) <= length {
+		return s
+	}
+	s = s[:length]
+	for len(s) > 0 && !utf8.ValidString(s) {
+		s = s[:len(s)-1]
+	}
+	return s
+}
@@ -0,0 +1,52 @@
+package mongoProxy
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestFormatReply(t *testing.T) {
+	tests := []struct {
+		doc      string
+		expected string
+	}{
+		{
+			doc:      `{"cursor":{"firstBatch":[{"a":1},{"a":2}],"id":0,"ns":"shop.users"},"ok":1.0}`,
+			expected: "{\"a\":1}\r\n{\"a\":2}",
+		},
+		{
+			doc:      `{"n":1,"ok":1.0,"$clusterTime":{"t":1},"operationTime":1}`,
+			expected: `{"n":1}`,
+		},
+		{
+			doc:      `{"ok":0.0,"errmsg":"ns not found","code":26}`,
+			expected: "MongoServerError: ns not found",
+		},
+		{
+			doc:      `{"n":0,"writeErrors":[{"index":0,"code":11000,"errmsg":"E11000 duplicate key error"}],"ok":1.0}`,
+			expected: "MongoBulkWriteError: E11000 duplicate key error",
+		},
+	}
+	for _, tt := range tests {
+		if got := formatReply(mustParseDocument(t, tt.doc)); got != tt.expected {
+			t.Errorf("format reply should be %q but %q", tt.expected, got)
+		}
+	}
+}
+
+func TestFormatReply_Preview(t *testing.T) {
+	docs := make([]string, 0, maxPreviewDocuments+5)
+	for i := 0; i < maxPreviewDocuments+5; i++ {
+		docs = append(docs, fmt.Sprintf(`{"i":%d}`, i))
+	}
+	reply := mustParseDocument(t, `{"cursor":{"firstBatch":[`+strings.Join(docs, ",")+`]},"ok":1}`)
+	lines := strings.Split(formatReply(reply), "\r\n")
+	if len(lines) != maxPreviewDocuments+1 {
+		t.Fatalf("should show %d documents but %d lines", maxPreviewDocuments, len(lines))
+	}
+	expected := fmt.Sprintf("(%d documents, %d shown)", maxPreviewDocuments+5, maxPreviewDocuments)
+	if lines[len(lines)-1] != expected {
+		t.Errorf("last line should be %q but %q", expected, lines[len(lines)-1])
+	}
+}
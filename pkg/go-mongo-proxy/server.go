@@ -0,0 +1,382 @@
+package mongoProxy
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/x/bsonx/bsoncore"
+
+	"github.com/meowgen/koko/pkg/jms-sdk-go/service"
+	"github.com/meowgen/koko/pkg/logger"
+	"github.com/meowgen/koko/pkg/proxy"
+	"github.com/meowgen/koko/pkg/proxybase"
+)
+
+const (
+	dialTimeout = 15 * time.Second
+
+	defaultDatabase = "test"
+
+	// 代理在握手时声明的服务器能力, 对应 MongoDB 5.0
+	maxBsonObjectSize = 16 * 1024 * 1024
+	maxWriteBatchSize = 100000
+	maxWireVersion    = 13
+)
+
+// errUpstreamAuthFailed 后端登录失败, 错误回复已经转发给客户端
+var errUpstreamAuthFailed = errors.New("upstream auth failed")
+
+const proxyName = "MongoDB"
+
+type FakeServer struct {
+	*proxybase.Server
+	JmsService *service.JMService
+
+	// TLSConfig 不为空时客户端必须使用 TLS 连接
+	TLSConfig *tls.Config
+
+	connID int32
+}
+
+func NewFakeServer(addr string, jmsService *service.JMService) *FakeServer {
+	fs := &FakeServer{JmsService: jmsService}
+	fs.Server = proxybase.NewServer(proxyName, addr, func(conn net.Conn) proxybase.Conn {
+		return NewConnection(fs, conn)
+	})
+	return fs
+}
+
+type CurrSession = proxybase.Session
+
+// nextConnectionID 返回 hello 回复中的 connectionId
+func (fs *FakeServer) nextConnectionID() int32 {
+	return atomic.AddInt32(&fs.connID, 1)
+}
+
+// Serve 完成客户端的 SASL 登录, 连接后端后双向代理消息直到一端断开或者会话被终断
+func (c *Connection) Serve() {
+	defer c.Close()
+
+	if err := c.acceptClient(); err != nil {
+		if err != io.EOF {
+			logger.Errorf("MongoDB proxy client %s login failed: %s", c.conn.RemoteAddr(), err)
+		}
+		return
+	}
+
+	token := c.Token
+	attrs := token.Info.Application.Attrs
+	c.host = attrs.Host
+	c.port = strconv.Itoa(attrs.Port)
+	c.Username = token.Info.SystemUserAuthInfo.Username
+	c.Password = token.Info.SystemUserAuthInfo.Password
+	c.Database = attrs.Database
+	if c.Database == "" {
+		c.Database = defaultDatabase
+	}
+	rules, err := proxybase.LoadFilterRules(c.JmsService, token)
+	if err != nil {
+		logger.Errorf("MongoDB proxy get command filter rules err: %s", err)
+		c.writeReply(c.authCmd, errorDocument(codeAuthenticationFailed, "AuthenticationFailed", errMsgAuthFailed))
+		return
+	}
+	c.filter = proxybase.NewCommandFilter(proxyName, c.JmsService, rules, proxybase.MatchRules)
+	c.CurrSession = proxybase.NewSession(proxyName, c.JmsService, token, c.conn.RemoteAddr().String())
+	proxy.AddCommonSwitch(c.CurrSession.SwSess)
+	defer proxy.RemoveCommonSwitch(c.CurrSession.SwSess)
+
+	address := net.JoinHostPort(c.host, c.port)
+	mongo, upstreamReader, err := c.connectUpstream(address)
+	if err != nil {
+		logger.Errorf("MongoDB proxy connect to %s err: %s", address, err)
+		if !errors.Is(err, errUpstreamAuthFailed) {
+			c.writeReply(c.authCmd, errorDocument(codeHostUnreachable, "HostUnreachable",
+				fmt.Sprintf("couldn't connect to server %s", address)))
+		}
+		return
+	}
+
+	if err = c.CurrSession.CreateSessionCallback(); err != nil {
+		logger.Errorf("MongoDB proxy create session err: %s", err)
+		return
+	}
+	defer c.endSession()
+	if err = c.CurrSession.ConnectedSuccessCallback(); err != nil {
+		logger.Errorf("Session %s: MongoDB proxy update session success err: %s",
+			c.CurrSession.Sess.ID, err)
+	}
+	c.CurrSession.StartRecord()
+	logger.Infof("Session %s: MongoDB proxy %s connected %s", c.CurrSession.Sess.ID,
+		c.conn.RemoteAddr(), address)
+
+	done := make(chan struct{}, 2)
+	// Read commands from client, check them with filter rules, then forward to server
+	go func() {
+		if err := c.proxyRequests(mongo); err != nil && err != io.EOF {
+			logger.Debugf("Session %s: MongoDB proxy client read err: %s", c.CurrSession.Sess.ID, err)
+		}
+		done <- struct{}{}
+	}()
+	// Read replies from server, record them, then forward to client
+	go func() {
+		if err := c.proxyResponses(upstreamReader); err != nil && err != io.EOF {
+			logger.Debugf("Session %s: MongoDB proxy server read err: %s", c.CurrSession.Sess.ID, err)
+		}
+		done <- struct{}{}
+	}()
+
+	select {
+	case <-done:
+	case <-c.CurrSession.SwSess.Ctx.Done():
+		logger.Infof("Session %s: MongoDB proxy terminated", c.CurrSession.Sess.ID)
+	}
+}
+
+// acceptClient 回复登录之前的握手命令, 使用 SCRAM 或 PLAIN 校验客户端的连接令牌和密钥.
+// 返回时最后一步登录命令还未回复, 连接后端成功之后再回复客户端
+func (c *Connection) acceptClient() error {
+	for {
+		msg, err := readWireMessage(c.reader)
+		if err != nil {
+			return err
+		}
+		cmd, err := decodeCommand(msg)
+		if err != nil {
+			c.writeReply(&command{RequestID: msg.RequestID, OpCode: msg.OpCode},
+				errorDocument(codeBadValue, "BadValue", err.Error()))
+			continue
+		}
+		var authenticated bool
+		switch strings.ToLower(cmd.Name) {
+		case "hello", "ismaster":
+			c.writeReply(cmd, helloDocument(cmd, c.id))
+		case "ping":
+			c.writeReply(cmd, okDocument())
+		case "saslstart":
+			authenticated, err = c.saslStart(cmd)
+		case "saslcontinue":
+			authenticated, err = c.saslContinue(cmd)
+		default:
+			c.writeReply(cmd, errorDocument(codeUnauthorized, "Unauthorized",
+				fmt.Sprintf("command %s requires authentication", cmd.Name)))
+		}
+		if err != nil || authenticated {
+			return err
+		}
+	}
+}
+
+func (c *Connection) saslStart(cmd *command) (bool, error) {
+	mechanism, _ := cmd.Doc.Lookup("mechanism").StringValueOK()
+	_, payload, _ := cmd.Doc.Lookup("payload").BinaryOK()
+	if mechanism == mechanismPlain {
+		tokenID, secret, err := parsePlainPayload(payload)
+		if err == nil {
+			err = c.checkToken(tokenID, secret)
+		}
+		if err != nil {
+			c.writeReply(cmd, errorDocument(codeAuthenticationFailed, "AuthenticationFailed", errMsgAuthFailed))
+			return false, err
+		}
+		c.authCmd, c.authDone = cmd, saslDocument("", true)
+		return true, nil
+	}
+	sasl, err := newSaslServer(mechanism, c.lookupSecret)
+	if err != nil {
+		c.writeReply(cmd, errorDocument(codeMechanismUnavailable, "MechanismUnavailable",
+			fmt.Sprintf("Received authentication for mechanism %s which is not enabled", mechanism)))
+		return false, nil
+	}
+	if options, ok := cmd.Doc.Lookup("options").DocumentOK(); ok {
+		sasl.skipEmptyExchange, _ = options.Lookup("skipEmptyExchange").BooleanOK()
+	}
+	resp, err := sasl.Step(payload)
+	if err != nil {
+		c.writeReply(cmd, errorDocument(codeAuthenticationFailed, "AuthenticationFailed", errMsgAuthFailed))
+		return false, err
+	}
+	c.sasl = sasl
+	c.writeReply(cmd, saslDocument(resp, false))
+	return false, nil
+}
+
+func (c *Connection) saslContinue(cmd *command) (bool, error) {
+	sasl := c.sasl
+	if sasl == nil {
+		c.writeReply(cmd, errorDocument(codeBadValue, "BadValue", "No SASL session state found"))
+		return false, nil
+	}
+	if sasl.Done() {
+		// 客户端不支持 skipEmptyExchange 时发送的最后一次空消息
+		c.authCmd, c.authDone = cmd, saslDocument("", true)
+		return true, nil
+	}
+	_, payload, _ := cmd.Doc.Lookup("payload").BinaryOK()
+	resp, err := sasl.Step(payload)
+	if err != nil {
+		c.sasl = nil
+		c.writeReply(cmd, errorDocument(codeAuthenticationFailed, "AuthenticationFailed", errMsgAuthFailed))
+		return false, fmt.Errorf("user %s: %w", sasl.Username(), err)
+	}
+	if !sasl.Done() || !sasl.skipEmptyExchange {
+		c.writeReply(cmd, saslDocument(resp, false))
+		return false, nil
+	}
+	c.authCmd, c.authDone = cmd, saslDocument(resp, true)
+	return true, nil
+}
+
+// lookupSecret 作为 SCRAM 的用户查找函数, 用户名是连接令牌, 密码是令牌的密钥
+func (c *Connection) lookupSecret(tokenID string) (string, error) {
+	token, err := c.getToken(tokenID)
+	if err != nil {
+		return "", err
+	}
+	c.Token = token
+	return token.Info.Secret, nil
+}
+
+// checkToken 校验 PLAIN 登录使用的连接令牌和密钥
+func (c *Connection) checkToken(tokenID, secret string) error {
+	token, err := c.getToken(tokenID)
+	if err != nil {
+		return err
+	}
+	if token.Info.Secret != secret {
+		return fmt.Errorf("user %s token secret mismatch", token.Info.User.String())
+	}
+	c.Token = token
+	return nil
+}
+
+// getToken 获取连接令牌并校验应用授权
+func (c *Connection) getToken(tokenID string) (*service.TokenAuthInfoResponse, error) {
+	token, err := c.JmsService.GetConnectTokenAuth(tokenID)
+	if err != nil {
+		return nil, fmt.Errorf("invalid token: %w", err)
+	}
+	if token.Info.Application == nil || token.Info.SystemUserAuthInfo == nil || token.Info.User == nil {
+		return nil, fmt.Errorf("not an application token: %v", token.Err)
+	}
+	perm, err := c.JmsService.ValidateApplicationPermission(token.Info.User.ID,
+		token.Info.Application.ID, token.Info.SystemUserAuthInfo.ID)
+	if err != nil || !perm.HasPermission {
+		return nil, fmt.Errorf("user %s has no permission to %s", token.Info.User.String(),
+			token.Info.Application.String())
+	}
+	return &token, nil
+}
+
+// helloDocument 生成代理的 hello 回复, 客户端请求时返回支持的 SCRAM 机制
+func helloDocument(cmd *command, connectionID int32) bsoncore.Document {
+	builder := bsoncore.NewDocumentBuilder()
+	if strings.EqualFold(cmd.Name, "hello") {
+		builder.AppendBoolean("isWritablePrimary", true)
+	} else {
+		builder.AppendBoolean("ismaster", true)
+	}
+	builder.AppendBoolean("helloOk", true).
+		AppendInt32("maxBsonObjectSize", maxBsonObjectSize).
+		AppendInt32("maxMessageSizeBytes", maxMessageSize).
+		AppendInt32("maxWriteBatchSize", maxWriteBatchSize).
+		AppendDateTime("localTime", time.Now().UnixNano()/int64(time.Millisecond)).
+		AppendInt32("logicalSessionTimeoutMinutes", 30).
+		AppendInt32("connectionId", connectionID).
+		AppendInt32("minWireVersion", 0).
+		AppendInt32("maxWireVersion", maxWireVersion).
+		AppendBoolean("readOnly", false)
+	if _, err := cmd.Doc.LookupErr("saslSupportedMechs"); err == nil {
+		mechs := make([]bsoncore.Value, 0, len(supportedMechanisms))
+		for _, mech := range supportedMechanisms {
+			mechs = append(mechs, bsoncore.Value{Type: bsontype.String, Data: bsoncore.AppendString(nil, mech)})
+		}
+		builder.AppendArray("saslSupportedMechs", bsoncore.BuildArray(nil, mechs...))
+	}
+	return builder.AppendDouble("ok", 1).Build()
+}
+
+// connectUpstream 连接后端 MongoDB, 按应用配置使用 TLS, 使用系统用户登录后完成客户端的登录
+func (c *Connection) connectUpstream(address string) (net.Conn, *bufio.Reader, error) {
+	attrs := c.Token.Info.Application.Attrs
+	mongo, err := net.DialTimeout("tcp", address, dialTimeout)
+	if err != nil {
+		return nil, nil, err
+	}
+	c.setUpstream(mongo)
+	if attrs.UseSSL {
+		tlsConfig, err := proxybase.UpstreamTLSConfig(c.host, attrs)
+		if err != nil {
+			return nil, nil, err
+		}
+		tlsConn := tls.Client(mongo, tlsConfig)
+		if err = tlsConn.Handshake(); err != nil {
+			return nil, nil, fmt.Errorf("tls handshake: %w", err)
+		}
+		mongo = tlsConn
+		c.setUpstream(mongo)
+	}
+	reader := bufio.NewReader(mongo)
+
+	if err = authUpstream(mongo, reader, c.Username, c.Password); err != nil {
+		var cmdErr *commandError
+		if errors.As(err, &cmdErr) {
+			c.writeReply(c.authCmd, errorDocument(cmdErr.Code, cmdErr.CodeName, cmdErr.Message))
+			return nil, nil, fmt.Errorf("%w: %s", errUpstreamAuthFailed, cmdErr)
+		}
+		return nil, nil, err
+	}
+	c.writeReply(c.authCmd, c.authDone)
+	return mongo, reader, nil
+}
+
+// endSession 结束录像, 命令记录并通知 core 会话断开, 可重复调用
+func (c *Connection) endSession() {
+	c.endOnce.Do(func() {
+		if c.CurrSession == nil {
+			return
+		}
+		c.flushResults()
+		c.CurrSession.End()
+	})
+}
+
+// proxyRequests 逐个读取客户端消息, 通过命令过滤后转发到后端并记录
+func (c *Connection) proxyRequests(mongo net.Conn) error {
+	req := &Request{conn: c, currSess: c.CurrSession}
+	for {
+		msg, err := readWireMessage(c.reader)
+		if err != nil {
+			return err
+		}
+		forward := req.Handle(msg)
+		if forward == nil {
+			continue
+		}
+		if _, err = mongo.Write(forward); err != nil {
+			return err
+		}
+	}
+}
+
+// proxyResponses 逐个读取后端回复, 转发给客户端后记录执行结果
+func (c *Connection) proxyResponses(reader *bufio.Reader) error {
+	res := &Response{conn: c, currSess: c.CurrSession}
+	for {
+		msg, err := readWireMessage(reader)
+		if err != nil {
+			return err
+		}
+		if err = res.Handle(msg); err != nil {
+			return err
+		}
+	}
+}
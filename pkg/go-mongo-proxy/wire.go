@@ -0,0 +1,254 @@
+package mongoProxy
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/x/bsonx/bsoncore"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/wiremessage"
+)
+
+// https://www.mongodb.com/docs/manual/reference/mongodb-wire-protocol/
+
+const (
+	headerLength   = 16
+	maxMessageSize = 48000000
+
+	// OP_MSG flag bits
+	flagChecksumPresent = 1 << 0
+	flagMoreToCome      = 1 << 1
+)
+
+var errMalformedMessage = errors.New("malformed wire message")
+
+// wireMessage 是一个完整的 MongoDB 消息, Raw 包含消息头
+type wireMessage struct {
+	Raw        []byte
+	RequestID  int32
+	ResponseTo int32
+	OpCode     wiremessage.OpCode
+	Body       []byte
+}
+
+func readWireMessage(r io.Reader) (*wireMessage, error) {
+	header := make([]byte, headerLength)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	length := int32(binary.LittleEndian.Uint32(header))
+	if length < headerLength || length > maxMessageSize {
+		return nil, fmt.Errorf("invalid message length %d", length)
+	}
+	raw := make([]byte, length)
+	copy(raw, header)
+	if _, err := io.ReadFull(r, raw[headerLength:]); err != nil {
+		return nil, err
+	}
+	_, requestID, responseTo, opCode, body, _ := wiremessage.ReadHeader(raw)
+	return &wireMessage{
+		Raw:        raw,
+		RequestID:  requestID,
+		ResponseTo: responseTo,
+		OpCode:     opCode,
+		Body:       body,
+	}, nil
+}
+
+// command 是从 OP_MSG 或 OP_QUERY 中解析出的命令
+type command struct {
+	RequestID  int32
+	OpCode     wiremessage.OpCode
+	Database   string
+	Name       string
+	Collection string
+	Doc        bsoncore.Document
+
+	// Sequences 是 OP_MSG 中 kind 1 的文档序列, 如 insert 的 documents
+	Sequences map[string][]bsoncore.Document
+
+	// MoreToCome 表示客户端不需要回复, 如 w:0 的写操作
+	MoreToCome bool
+}
+
+func decodeCommand(msg *wireMessage) (*command, error) {
+	cmd := &command{RequestID: msg.RequestID, OpCode: msg.OpCode}
+	switch msg.OpCode {
+	case wiremessage.OpMsg:
+		if err := cmd.decodeMsg(msg.Body); err != nil {
+			return nil, err
+		}
+	case wiremessage.OpQuery:
+		if err := cmd.decodeQuery(msg.Body); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported opcode %s", msg.OpCode)
+	}
+	elem, err := cmd.Doc.IndexErr(0)
+	if err != nil {
+		return nil, fmt.Errorf("%w: empty command", errMalformedMessage)
+	}
+	cmd.Name = elem.Key()
+	if collection, ok := elem.Value().StringValueOK(); ok {
+		cmd.Collection = collection
+	}
+	if database, ok := cmd.Doc.Lookup("$db").StringValueOK(); ok {
+		cmd.Database = database
+	}
+	return cmd, nil
+}
+
+func (cmd *command) decodeMsg(body []byte) error {
+	flags, rem, ok := wiremessage.ReadMsgFlags(body)
+	if !ok {
+		return errMalformedMessage
+	}
+	cmd.MoreToCome = flags&flagMoreToCome != 0
+	if flags&flagChecksumPresent != 0 {
+		if len(rem) < 4 {
+			return errMalformedMessage
+		}
+		rem = rem[:len(rem)-4]
+	}
+	for len(rem) > 0 {
+		var sectionType wiremessage.SectionType
+		if sectionType, rem, ok = wiremessage.ReadMsgSectionType(rem); !ok {
+			return errMalformedMessage
+		}
+		switch sectionType {
+		case wiremessage.SingleDocument:
+			if cmd.Doc, rem, ok = wiremessage.ReadMsgSectionSingleDocument(rem); !ok {
+				return errMalformedMessage
+			}
+		case wiremessage.DocumentSequence:
+			var identifier string
+			var docs []bsoncore.Document
+			if identifier, docs, rem, ok = wiremessage.ReadMsgSectionDocumentSequence(rem); !ok {
+				return errMalformedMessage
+			}
+			if cmd.Sequences == nil {
+				cmd.Sequences = make(map[string][]bsoncore.Document)
+			}
+			cmd.Sequences[identifier] = docs
+		default:
+			return fmt.Errorf("%w: unknown section type %d", errMalformedMessage, sectionType)
+		}
+	}
+	if cmd.Doc == nil {
+		return fmt.Errorf("%w: missing body section", errMalformedMessage)
+	}
+	return nil
+}
+
+// decodeQuery 解析 OP_QUERY, 对 $cmd 集合的查询是命令, 其它是旧版本的 find
+func (cmd *command) decodeQuery(body []byte) error {
+	_, rem, ok := wiremessage.ReadQueryFlags(body)
+	if !ok {
+		return errMalformedMessage
+	}
+	var namespace string
+	if namespace, rem, ok = wiremessage.ReadQueryFullCollectionName(rem); !ok {
+		return errMalformedMessage
+	}
+	if _, rem, ok = wiremessage.ReadQueryNumberToSkip(rem); !ok {
+		return errMalformedMessage
+	}
+	if _, rem, ok = wiremessage.ReadQueryNumberToReturn(rem); !ok {
+		return errMalformedMessage
+	}
+	query, _, ok := wiremessage.ReadQueryQuery(rem)
+	if !ok {
+		return errMalformedMessage
+	}
+	database, collection := namespace, ""
+	if i := strings.IndexByte(namespace, '.'); i >= 0 {
+		database, collection = namespace[:i], namespace[i+1:]
+	}
+	if wrapped, ok := query.Lookup("$query").DocumentOK(); ok {
+		query = wrapped
+	}
+	if collection == "$cmd" {
+		cmd.Doc = query
+	} else {
+		cmd.Doc = bsoncore.NewDocumentBuilder().
+			AppendString("find", collection).
+			AppendDocument("filter", query).
+			Build()
+	}
+	// OP_QUERY 中的命令没有 $db, 补上后与 OP_MSG 一致
+	if _, err := cmd.Doc.LookupErr("$db"); err != nil {
+		cmd.Database = database
+		cmd.Doc = appendElement(cmd.Doc, bsoncore.AppendStringElement(nil, "$db", database))
+	}
+	return nil
+}
+
+// appendElement 在文档末尾追加一个元素
+func appendElement(doc bsoncore.Document, elem []byte) bsoncore.Document {
+	idx, dst := bsoncore.ReserveLength(nil)
+	dst = append(dst, doc[4:len(doc)-1]...)
+	dst = append(dst, elem...)
+	dst, _ = bsoncore.AppendDocumentEnd(dst, idx)
+	return dst
+}
+
+// newReply 按请求的消息类型生成回复
+func newReply(cmd *command, doc bsoncore.Document) []byte {
+	if cmd.OpCode == wiremessage.OpQuery {
+		return newOpReply(cmd.RequestID, doc)
+	}
+	return newOpMsg(wiremessage.NextRequestID(), cmd.RequestID, doc)
+}
+
+func newOpMsg(requestID, responseTo int32, doc bsoncore.Document) []byte {
+	idx, dst := wiremessage.AppendHeaderStart(nil, requestID, responseTo, wiremessage.OpMsg)
+	dst = wiremessage.AppendMsgFlags(dst, 0)
+	dst = wiremessage.AppendMsgSectionType(dst, wiremessage.SingleDocument)
+	dst = append(dst, doc...)
+	return bsoncore.UpdateLength(dst, idx, int32(len(dst[idx:])))
+}
+
+func newOpReply(responseTo int32, doc bsoncore.Document) []byte {
+	idx, dst := wiremessage.AppendHeaderStart(nil, wiremessage.NextRequestID(), responseTo, wiremessage.OpReply)
+	dst = wiremessage.AppendReplyFlags(dst, 0)
+	dst = wiremessage.AppendReplyCursorID(dst, 0)
+	dst = wiremessage.AppendReplyStartingFrom(dst, 0)
+	dst = wiremessage.AppendReplyNumberReturned(dst, 1)
+	dst = append(dst, doc...)
+	return bsoncore.UpdateLength(dst, idx, int32(len(dst[idx:])))
+}
+
+// decodeReply 返回 OP_MSG 或 OP_REPLY 中的回复文档
+func decodeReply(msg *wireMessage) (bsoncore.Document, error) {
+	switch msg.OpCode {
+	case wiremessage.OpMsg:
+		cmd := &command{}
+		if err := cmd.decodeMsg(msg.Body); err != nil {
+			return nil, err
+		}
+		return cmd.Doc, nil
+	case wiremessage.OpReply:
+		_, rem, ok := wiremessage.ReadReplyFlags(msg.Body)
+		if !ok {
+			return nil, errMalformedMessage
+		}
+		if _, rem, ok = wiremessage.ReadReplyCursorID(rem); !ok {
+			return nil, errMalformedMessage
+		}
+		if _, rem, ok = wiremessage.ReadReplyStartingFrom(rem); !ok {
+			return nil, errMalformedMessage
+		}
+		if _, rem, ok = wiremessage.ReadReplyNumberReturned(rem); !ok {
+			return nil, errMalformedMessage
+		}
+		doc, _, ok := wiremessage.ReadReplyDocument(rem)
+		if !ok {
+			return nil, errMalformedMessage
+		}
+		return doc, nil
+	}
+	return nil, fmt.Errorf("unsupported reply opcode %s", msg.OpCode)
+}
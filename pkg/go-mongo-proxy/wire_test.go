@@ -0,0 +1,119 @@
+package mongoProxy
+
+import (
+	"bytes"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/x/bsonx/bsoncore"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/wiremessage"
+)
+
+func newTestOpMsg(doc bsoncore.Document, identifier string, docs ...bsoncore.Document) []byte {
+	idx, dst := wiremessage.AppendHeaderStart(nil, 7, 0, wiremessage.OpMsg)
+	dst = wiremessage.AppendMsgFlags(dst, 0)
+	dst = wiremessage.AppendMsgSectionType(dst, wiremessage.SingleDocument)
+	dst = append(dst, doc...)
+	if identifier != "" {
+		dst = wiremessage.AppendMsgSectionType(dst, wiremessage.DocumentSequence)
+		seqIdx, seq := bsoncore.ReserveLength(dst)
+		seq = append(seq, identifier...)
+		seq = append(seq, 0)
+		for _, d := range docs {
+			seq = append(seq, d...)
+		}
+		dst = bsoncore.UpdateLength(seq, seqIdx, int32(len(seq[seqIdx:])))
+	}
+	return bsoncore.UpdateLength(dst, idx, int32(len(dst[idx:])))
+}
+
+func newTestOpQuery(namespace string, query bsoncore.Document) []byte {
+	idx, dst := wiremessage.AppendHeaderStart(nil, 9, 0, wiremessage.OpQuery)
+	dst = wiremessage.AppendQueryFlags(dst, 0)
+	dst = wiremessage.AppendQueryFullCollectionName(dst, namespace)
+	dst = wiremessage.AppendQueryNumberToSkip(dst, 0)
+	dst = wiremessage.AppendQueryNumberToReturn(dst, -1)
+	dst = append(dst, query...)
+	return bsoncore.UpdateLength(dst, idx, int32(len(dst[idx:])))
+}
+
+func mustReadCommand(t *testing.T, raw []byte) *command {
+	t.Helper()
+	msg, err := readWireMessage(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd, err := decodeCommand(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cmd
+}
+
+func TestDecodeCommand_OpMsg(t *testing.T) {
+	doc := bsoncore.NewDocumentBuilder().
+		AppendString("insert", "users").
+		AppendString("$db", "shop").
+		Build()
+	user := bsoncore.NewDocumentBuilder().AppendString("name", "tom").Build()
+	cmd := mustReadCommand(t, newTestOpMsg(doc, "documents", user, user))
+	if cmd.Name != "insert" || cmd.Collection != "users" || cmd.Database != "shop" || cmd.RequestID != 7 {
+		t.Fatalf("unexpected command %+v", cmd)
+	}
+	if len(cmd.Sequences["documents"]) != 2 {
+		t.Errorf("document sequence should have 2 documents but %d", len(cmd.Sequences["documents"]))
+	}
+	if cmd.MoreToCome {
+		t.Error("moreToCome should not be set")
+	}
+}
+
+func TestDecodeCommand_OpQuery(t *testing.T) {
+	query := bsoncore.NewDocumentBuilder().
+		AppendDocument("$query", bsoncore.NewDocumentBuilder().AppendInt32("isMaster", 1).Build()).
+		Build()
+	cmd := mustReadCommand(t, newTestOpQuery("admin.$cmd", query))
+	if cmd.Name != "isMaster" || cmd.Database != "admin" {
+		t.Fatalf("unexpected command %+v", cmd)
+	}
+	if db, _ := cmd.Doc.Lookup("$db").StringValueOK(); db != "admin" {
+		t.Errorf("$db should be added but %q", db)
+	}
+
+	filter := bsoncore.NewDocumentBuilder().AppendInt32("age", 18).Build()
+	cmd = mustReadCommand(t, newTestOpQuery("shop.users", filter))
+	if cmd.Name != "find" || cmd.Collection != "users" || cmd.Database != "shop" {
+		t.Fatalf("legacy query should be a find command but %+v", cmd)
+	}
+	if got := formatCommand(cmd); got != `db.users.find({"age":18})` {
+		t.Errorf("unexpected input %s", got)
+	}
+}
+
+func TestNewReply(t *testing.T) {
+	doc := okDocument()
+	for _, opCode := range []wiremessage.OpCode{wiremessage.OpMsg, wiremessage.OpQuery} {
+		raw := newReply(&command{RequestID: 11, OpCode: opCode}, doc)
+		msg, err := readWireMessage(bytes.NewReader(raw))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg.ResponseTo != 11 {
+			t.Errorf("%s reply responseTo should be 11 but %d", opCode, msg.ResponseTo)
+		}
+		reply, err := decodeReply(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(reply, doc) {
+			t.Errorf("%s reply document mismatch", opCode)
+		}
+	}
+}
+
+func TestReadWireMessage_InvalidLength(t *testing.T) {
+	raw := newReply(&command{RequestID: 1, OpCode: wiremessage.OpMsg}, okDocument())
+	raw[0], raw[1], raw[2], raw[3] = 4, 0, 0, 0
+	if _, err := readWireMessage(bytes.NewReader(raw)); err == nil {
+		t.Error("message shorter than header should be rejected")
+	}
+}
@@ -0,0 +1,247 @@
+package mysqlProxy
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// https://dev.mysql.com/doc/internals/en/authentication-method.html
+
+const (
+	authNativePassword      = "mysql_native_password"
+	authCachingSHA2Password = "caching_sha2_password"
+)
+
+const (
+	iAuthMoreData   byte = 0x01
+	iAuthSwitchData byte = 0xfe
+
+	// caching_sha2_password 的 AuthMoreData 状态
+	cachingSHA2RequestPublicKey byte = 0x02
+	cachingSHA2FastAuthSuccess  byte = 0x03
+	cachingSHA2PerformFullAuth  byte = 0x04
+)
+
+const scrambleLength = 20
+
+var errUnsupportedAuthPlugin = errors.New("unsupported auth plugin")
+
+func isSupportedAuthPlugin(plugin string) bool {
+	return plugin == authNativePassword || plugin == authCachingSHA2Password
+}
+
+// scrambleAuthData 按认证插件计算 auth-response
+func scrambleAuthData(plugin string, scramble []byte, password string) ([]byte, error) {
+	switch plugin {
+	case authNativePassword:
+		return ScramblePassword(scramble, password), nil
+	case authCachingSHA2Password:
+		return scrambleSHA256Password(scramble, password), nil
+	}
+	return nil, fmt.Errorf("%w: %s", errUnsupportedAuthPlugin, plugin)
+}
+
+// scrambleSHA256Password hashes password for caching_sha2_password
+// XOR(SHA256(password), SHA256(SHA256(SHA256(password)), scramble))
+func scrambleSHA256Password(scramble []byte, password string) []byte {
+	if len(password) == 0 {
+		return nil
+	}
+
+	crypt := sha256.New()
+	crypt.Write([]byte(password))
+	message1 := crypt.Sum(nil)
+
+	crypt.Reset()
+	crypt.Write(message1)
+	message1Hash := crypt.Sum(nil)
+
+	crypt.Reset()
+	crypt.Write(message1Hash)
+	crypt.Write(scramble)
+	message2 := crypt.Sum(nil)
+
+	for i := range message1 {
+		message1[i] ^= message2[i]
+	}
+	return message1
+}
+
+// encryptPassword encrypts the NUL-terminated password XOR scramble with the server RSA public key
+func encryptPassword(password string, scramble []byte, pub *rsa.PublicKey) ([]byte, error) {
+	plain := make([]byte, len(password)+1)
+	copy(plain, password)
+	for i := range plain {
+		plain[i] ^= scramble[i%len(scramble)]
+	}
+	return rsa.EncryptOAEP(sha1.New(), rand.Reader, pub, plain, nil)
+}
+
+func parsePublicKey(data []byte) (*rsa.PublicKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("invalid public key")
+	}
+	pkix, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	pub, ok := pkix.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.New("public key is not RSA")
+	}
+	return pub, nil
+}
+
+// trimScramble 去掉 auth-plugin-data 末尾的 NUL
+func trimScramble(data []byte) []byte {
+	if len(data) > scrambleLength {
+		return data[:scrambleLength]
+	}
+	return bytes.TrimRight(data, "\x00")
+}
+
+/*
+AuthSwitchRequestPacket represents Protocol::AuthSwitchRequest
+https://dev.mysql.com/doc/internals/en/connection-phase-packets.html#packet-Protocol::AuthSwitchRequest
+*/
+type AuthSwitchRequestPacket struct {
+	header         *PacketHeader
+	PluginName     []byte
+	AuthPluginData []byte
+}
+
+func NewAuthSwitchRequestPacket(sequenceId uint8, plugin string, scramble []byte) *AuthSwitchRequestPacket {
+	return &AuthSwitchRequestPacket{
+		header:         &PacketHeader{SequenceId: sequenceId},
+		PluginName:     []byte(plugin),
+		AuthPluginData: scramble,
+	}
+}
+
+func (r *AuthSwitchRequestPacket) Decode(packet []byte) error {
+	if len(packet) < 5 || packet[4] != iAuthSwitchData {
+		return errMalformedPacket
+	}
+	r.header = &PacketHeader{
+		Length:     uint32(len(packet) - 4),
+		SequenceId: packet[3],
+	}
+	var position int
+	r.PluginName, position = readNullTerminatedString(packet[4:], 1)
+	r.AuthPluginData = trimScramble(packet[4+position:])
+	return nil
+}
+
+func (r *AuthSwitchRequestPacket) Encode() ([]byte, error) {
+	buf := make([]byte, 0, len(r.PluginName)+len(r.AuthPluginData)+3)
+	buf = append(buf, iAuthSwitchData)
+	buf = append(buf, r.PluginName...)
+	buf = append(buf, 0x00)
+	buf = append(buf, r.AuthPluginData...)
+	buf = append(buf, 0x00)
+	return encodePacket(r.header.SequenceId, buf), nil
+}
+
+// authUpstream 按后端要求的插件完成认证, 处理 AuthSwitchRequest, caching_sha2_password 的快速认证和完整认证,
+// 返回后端最终的 OK 或 ERR 包
+func authUpstream(rw io.ReadWriter, authPacket *AuthorizationPacket, handshake *InitialHandshakePacket,
+	password string, secure bool) ([]byte, error) {
+	plugin := string(handshake.AuthPluginName)
+	if !handshake.CapabilitiesFlags.Has(clientPluginAuth) || !isSupportedAuthPlugin(plugin) {
+		plugin = authNativePassword
+	}
+	scramble := trimScramble(handshake.AuthPluginData)
+	authResp, err := scrambleAuthData(plugin, scramble, password)
+	if err != nil {
+		return nil, err
+	}
+	authPacket.Password = authResp
+	authPacket.AuthPluginName = []byte(plugin)
+	data, err := authPacket.Encode()
+	if err != nil {
+		return nil, err
+	}
+	if _, err = rw.Write(data); err != nil {
+		return nil, err
+	}
+
+	for {
+		packet, err := readPacket(rw)
+		if err != nil {
+			return nil, err
+		}
+		if len(packet) < 5 {
+			return nil, errMalformedPacket
+		}
+		sequenceId := packet[3]
+		switch packet[4] {
+		case iOK, iERR:
+			return packet, nil
+		case iAuthSwitchData:
+			switchRequest := &AuthSwitchRequestPacket{}
+			if err = switchRequest.Decode(packet); err != nil {
+				return nil, err
+			}
+			plugin = string(switchRequest.PluginName)
+			scramble = switchRequest.AuthPluginData
+			if authResp, err = scrambleAuthData(plugin, scramble, password); err != nil {
+				return nil, err
+			}
+			if _, err = rw.Write(encodePacket(sequenceId+1, authResp)); err != nil {
+				return nil, err
+			}
+		case iAuthMoreData:
+			if plugin != authCachingSHA2Password || len(packet) < 6 {
+				return nil, fmt.Errorf("unexpected auth more data for %s", plugin)
+			}
+			switch packet[5] {
+			case cachingSHA2FastAuthSuccess:
+				// 随后会收到 OK 包
+			case cachingSHA2PerformFullAuth:
+				if secure {
+					// 已经是 TLS 连接, 直接发送明文密码
+					plain := append([]byte(password), 0x00)
+					if _, err = rw.Write(encodePacket(sequenceId+1, plain)); err != nil {
+						return nil, err
+					}
+					continue
+				}
+				request := encodePacket(sequenceId+1, []byte{cachingSHA2RequestPublicKey})
+				if _, err = rw.Write(request); err != nil {
+					return nil, err
+				}
+				keyPacket, err := readPacket(rw)
+				if err != nil {
+					return nil, err
+				}
+				if len(keyPacket) < 5 || keyPacket[4] != iAuthMoreData {
+					return nil, errors.New("unexpected public key response")
+				}
+				pub, err := parsePublicKey(keyPacket[5:])
+				if err != nil {
+					return nil, err
+				}
+				encrypted, err := encryptPassword(password, scramble, pub)
+				if err != nil {
+					return nil, err
+				}
+				if _, err = rw.Write(encodePacket(keyPacket[3]+1, encrypted)); err != nil {
+					return nil, err
+				}
+			default:
+				return nil, fmt.Errorf("unexpected caching_sha2_password state 0x%02x", packet[5])
+			}
+		default:
+			return nil, fmt.Errorf("unsupported auth response 0x%02x", packet[4])
+		}
+	}
+}
@@ -0,0 +1,303 @@
+package mysqlProxy
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"net"
+	"testing"
+)
+
+// 以下数据包取自 mysql 8.0 的抓包
+
+var (
+	// caching_sha2_password 握手时服务端下发的 scramble 及 "secret" 对应的 auth-response
+	cachingSHA2Scramble = []byte{90, 105, 74, 126, 30, 48, 37, 56, 3, 23, 115, 127, 69,
+		22, 41, 84, 32, 123, 43, 118}
+	cachingSHA2AuthResp = []byte{102, 32, 5, 35, 143, 161, 140, 241, 171, 232, 56,
+		139, 43, 14, 107, 196, 249, 170, 147, 60, 220, 204, 120, 178, 214, 15,
+		184, 150, 26, 61, 57, 235}
+
+	// AuthSwitchRequest: 切换到 caching_sha2_password
+	switchToCachingSHA2 = []byte{44, 0, 0, 2, 254, 99, 97, 99, 104, 105, 110, 103, 95,
+		115, 104, 97, 50, 95, 112, 97, 115, 115, 119, 111, 114, 100, 0, 101,
+		11, 26, 18, 94, 97, 22, 72, 2, 46, 70, 106, 29, 55, 45, 94, 76, 90, 84,
+		50, 0}
+
+	// AuthSwitchRequest: 切换到 mysql_native_password, 以及客户端的回复
+	switchToNative = []byte{44, 0, 0, 2, 254, 109, 121, 115, 113, 108, 95, 110, 97,
+		116, 105, 118, 101, 95, 112, 97, 115, 115, 119, 111, 114, 100, 0, 96,
+		71, 63, 8, 1, 58, 75, 12, 69, 95, 66, 60, 117, 31, 48, 31, 89, 39, 55,
+		31, 0}
+	switchToNativeReply = []byte{20, 0, 0, 3, 202, 41, 195, 164, 34, 226, 49, 103,
+		21, 211, 167, 199, 227, 116, 8, 48, 57, 71, 149, 146}
+
+	fastAuthSuccessPacket = []byte{2, 0, 0, 2, 1, 3}
+	fullAuthPacket        = []byte{2, 0, 0, 2, 1, 4}
+)
+
+func TestScrambleSHA256Password(t *testing.T) {
+	scramble := []byte{10, 47, 74, 111, 75, 73, 34, 48, 88, 76, 114, 74, 37, 13, 3, 80, 82, 2, 23, 21}
+	expected := "f490e76f66d9d86665ce54d98c78d0acfe2fb0b08b423da807144873d30b312c"
+	if result := hex.EncodeToString(scrambleSHA256Password(scramble, "secret")); result != expected {
+		t.Errorf("scramble should be %s but %s", expected, result)
+	}
+	if result := scrambleSHA256Password(cachingSHA2Scramble, "secret"); !bytes.Equal(result, cachingSHA2AuthResp) {
+		t.Errorf("scramble should be %v but %v", cachingSHA2AuthResp, result)
+	}
+}
+
+func TestAuthSwitchRequestPacket(t *testing.T) {
+	cases := []struct {
+		packet []byte
+		plugin string
+		reply  []byte
+	}{
+		{switchToCachingSHA2, authCachingSHA2Password, nil},
+		{switchToNative, authNativePassword, switchToNativeReply},
+	}
+	for _, c := range cases {
+		switchRequest := &AuthSwitchRequestPacket{}
+		if err := switchRequest.Decode(c.packet); err != nil {
+			t.Fatal(err)
+		}
+		if string(switchRequest.PluginName) != c.plugin || len(switchRequest.AuthPluginData) != scrambleLength {
+			t.Fatalf("unexpected auth switch request %s %v", switchRequest.PluginName,
+				switchRequest.AuthPluginData)
+		}
+		authResp, err := scrambleAuthData(c.plugin, switchRequest.AuthPluginData, "secret")
+		if err != nil {
+			t.Fatal(err)
+		}
+		reply := encodePacket(switchRequest.header.SequenceId+1, authResp)
+		if c.reply != nil && !bytes.Equal(reply, c.reply) {
+			t.Errorf("%s reply should be %v but %v", c.plugin, c.reply, reply)
+		}
+		data, _ := switchRequest.Encode()
+		if !bytes.Equal(data, c.packet) {
+			t.Errorf("encoded auth switch request should be %v but %v", c.packet, data)
+		}
+	}
+}
+
+func TestAuthorizationPacket_DecodePacket(t *testing.T) {
+	flags := clientProtocol41 | clientSecureConn | clientConnectWithDB | clientPluginAuth |
+		clientPluginAuthLenEncClientData | clientConnectAttrs
+	part1 := make([]byte, 32)
+	part1[0], part1[1], part1[2], part1[3] = byte(flags), byte(flags>>8), byte(flags>>16), byte(flags>>24)
+	part1[8] = 0xff
+	payload := append([]byte{}, part1...)
+	payload = append(payload, "root\x00"...)
+	payload = append(payload, byte(len(cachingSHA2AuthResp)))
+	payload = append(payload, cachingSHA2AuthResp...)
+	payload = append(payload, "test\x00caching_sha2_password\x00"...)
+	payload = append(payload, 0x0a, 0x03, '_', 'o', 's', 0x05, 'L', 'i', 'n', 'u', 'x')
+	packet := buildPacket(1, payload...)
+
+	authPacket := &AuthorizationPacket{}
+	if err := authPacket.DecodePacket(packet); err != nil {
+		t.Fatal(err)
+	}
+	if string(authPacket.Username) != "root" || string(authPacket.Database) != "test" ||
+		string(authPacket.AuthPluginName) != authCachingSHA2Password {
+		t.Errorf("unexpected handshake response %s %s %s", authPacket.Username,
+			authPacket.Database, authPacket.AuthPluginName)
+	}
+	if !bytes.Equal(authPacket.Password, cachingSHA2AuthResp) {
+		t.Errorf("auth response should be %v but %v", cachingSHA2AuthResp, authPacket.Password)
+	}
+	data, err := authPacket.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, packet) {
+		t.Errorf("encoded handshake response should be %v but %v", packet, data)
+	}
+}
+
+func newTestAuthPacket() *AuthorizationPacket {
+	authPacket := &AuthorizationPacket{
+		header:      &PacketHeader{SequenceId: 1},
+		PacketPart1: make([]byte, 32),
+		Username:    []byte("root"),
+	}
+	authPacket.SetCapabilityFlags(clientProtocol41 | clientSecureConn | clientPluginAuth)
+	return authPacket
+}
+
+// runAuthUpstream 在 pipe 上执行 authUpstream, server 模拟后端的认证过程
+func runAuthUpstream(t *testing.T, plugin string, secure bool, server func(conn net.Conn) error) []byte {
+	client, serverConn := net.Pipe()
+	defer client.Close()
+	errCh := make(chan error, 1)
+	go func() {
+		defer serverConn.Close()
+		errCh <- server(serverConn)
+	}()
+	handshake := &InitialHandshakePacket{
+		CapabilitiesFlags: clientProtocol41 | clientSecureConn | clientPluginAuth,
+		AuthPluginData:    append(append([]byte{}, cachingSHA2Scramble...), 0x00),
+		AuthPluginName:    []byte(plugin),
+	}
+	packet, err := authUpstream(client, newTestAuthPacket(), handshake, "secret", secure)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = <-errCh; err != nil {
+		t.Fatal(err)
+	}
+	return packet
+}
+
+func expectAuthResponse(conn net.Conn, plugin string, authResp []byte) error {
+	data, err := readPacket(conn)
+	if err != nil {
+		return err
+	}
+	authPacket := &AuthorizationPacket{}
+	if err = authPacket.DecodePacket(data); err != nil {
+		return err
+	}
+	if string(authPacket.AuthPluginName) != plugin || !bytes.Equal(authPacket.Password, authResp) {
+		return errUnexpectedPacket(data)
+	}
+	return nil
+}
+
+type errUnexpectedPacket []byte
+
+func (e errUnexpectedPacket) Error() string {
+	return "unexpected packet " + hex.EncodeToString(e)
+}
+
+func TestAuthUpstream_FastAuth(t *testing.T) {
+	ok := buildPacket(3, 0x00, 0x00, 0x00, 0x02, 0x00, 0x00, 0x00)
+	packet := runAuthUpstream(t, authCachingSHA2Password, false, func(conn net.Conn) error {
+		if err := expectAuthResponse(conn, authCachingSHA2Password, cachingSHA2AuthResp); err != nil {
+			return err
+		}
+		if _, err := conn.Write(fastAuthSuccessPacket); err != nil {
+			return err
+		}
+		_, err := conn.Write(ok)
+		return err
+	})
+	if !bytes.Equal(packet, ok) {
+		t.Errorf("result should be %v but %v", ok, packet)
+	}
+}
+
+func TestAuthUpstream_AuthSwitch(t *testing.T) {
+	ok := buildPacket(4, 0x00, 0x00, 0x00, 0x02, 0x00, 0x00, 0x00)
+	packet := runAuthUpstream(t, authCachingSHA2Password, false, func(conn net.Conn) error {
+		if err := expectAuthResponse(conn, authCachingSHA2Password, cachingSHA2AuthResp); err != nil {
+			return err
+		}
+		if _, err := conn.Write(switchToNative); err != nil {
+			return err
+		}
+		data, err := readPacket(conn)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(data, switchToNativeReply) {
+			return errUnexpectedPacket(data)
+		}
+		_, err = conn.Write(ok)
+		return err
+	})
+	if !bytes.Equal(packet, ok) {
+		t.Errorf("result should be %v but %v", ok, packet)
+	}
+}
+
+func TestAuthUpstream_FullAuthTLS(t *testing.T) {
+	ok := buildPacket(4, 0x00, 0x00, 0x00, 0x02, 0x00, 0x00, 0x00)
+	packet := runAuthUpstream(t, authCachingSHA2Password, true, func(conn net.Conn) error {
+		if err := expectAuthResponse(conn, authCachingSHA2Password, cachingSHA2AuthResp); err != nil {
+			return err
+		}
+		if _, err := conn.Write(fullAuthPacket); err != nil {
+			return err
+		}
+		data, err := readPacket(conn)
+		if err != nil {
+			return err
+		}
+		if expected := buildPacket(3, []byte("secret\x00")...); !bytes.Equal(data, expected) {
+			return errUnexpectedPacket(data)
+		}
+		_, err = conn.Write(ok)
+		return err
+	})
+	if !bytes.Equal(packet, ok) {
+		t.Errorf("result should be %v but %v", ok, packet)
+	}
+}
+
+func TestAuthUpstream_FullAuthRSA(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubKey := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+	errPacket := buildPacket(8, append([]byte{0xff, 0x15, 0x04, '#', '2', '8', '0', '0', '0'},
+		"Access denied"...)...)
+	packet := runAuthUpstream(t, authNativePassword, false, func(conn net.Conn) error {
+		if err := expectAuthResponse(conn, authNativePassword,
+			ScramblePassword(cachingSHA2Scramble, "secret")); err != nil {
+			return err
+		}
+		// 后端要求改用 caching_sha2_password, 随后要求完整认证
+		if _, err := conn.Write(switchToCachingSHA2); err != nil {
+			return err
+		}
+		if _, err := readPacket(conn); err != nil {
+			return err
+		}
+		if _, err := conn.Write(buildPacket(4, iAuthMoreData, cachingSHA2PerformFullAuth)); err != nil {
+			return err
+		}
+		data, err := readPacket(conn)
+		if err != nil {
+			return err
+		}
+		if expected := buildPacket(5, cachingSHA2RequestPublicKey); !bytes.Equal(data, expected) {
+			return errUnexpectedPacket(data)
+		}
+		if _, err = conn.Write(buildPacket(6, append([]byte{iAuthMoreData}, pubKey...)...)); err != nil {
+			return err
+		}
+		if data, err = readPacket(conn); err != nil {
+			return err
+		}
+		if getSequenceID(data) != 7 {
+			return errUnexpectedPacket(data)
+		}
+		plain, err := rsa.DecryptOAEP(sha1.New(), rand.Reader, key, data[4:], nil)
+		if err != nil {
+			return err
+		}
+		switchRequest := &AuthSwitchRequestPacket{}
+		_ = switchRequest.Decode(switchToCachingSHA2)
+		for i := range plain {
+			plain[i] ^= switchRequest.AuthPluginData[i%scrambleLength]
+		}
+		if string(plain) != "secret\x00" {
+			return errUnexpectedPacket(plain)
+		}
+		_, err = conn.Write(errPacket)
+		return err
+	})
+	if !bytes.Equal(packet, errPacket) {
+		t.Errorf("result should be %v but %v", errPacket, packet)
+	}
+}
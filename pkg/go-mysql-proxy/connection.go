@@ -2,13 +2,17 @@ package mysqlProxy
 
 import (
 	"bytes"
-	"fmt"
+	"github.com/meowgen/koko/pkg/datamask"
+	"github.com/meowgen/koko/pkg/guardrail"
 	"github.com/meowgen/koko/pkg/jms-sdk-go/model"
 	"github.com/meowgen/koko/pkg/jms-sdk-go/service"
 	"github.com/meowgen/koko/pkg/logger"
-	"github.com/meowgen/koko/pkg/proxy"
+	"github.com/meowgen/koko/pkg/proxybase"
+	"github.com/meowgen/koko/pkg/sqlparser"
 	"golang.org/x/text/encoding/charmap"
 	"net"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -16,68 +20,105 @@ var mySqlPrompt = []byte("mysql>")
 
 type Connection struct {
 	conn       net.Conn
+	upstream   net.Conn
 	host       string
 	port       string
 	JmsService *service.JMService
 	FakeServer *FakeServer
-	Finished   *chan struct{}
+
+	Username    string
+	Password    string
+	Token       *service.TokenAuthInfoResponse
+	CurrSession *CurrSession
+
+	filter     *proxybase.CommandFilter
+	sqlMatcher *sqlparser.Matcher
+	masker     *datamask.Masker
+	// guard 是应用的查询限制, threadID 是后端连接的线程 ID, 语句超时后用于 KILL QUERY
+	guard    guardrail.Policy
+	threadID uint32
+	guardMu  sync.Mutex
+	txTimer  *time.Timer
+
+	clientCapabilities CapabilityFlag
+	clientSequenceId   uint8
+	resultMu           sync.Mutex
+	result             *queryResult
+	// serverStatus 是最后一个结果的服务端状态, 终止语句后用于构造结果集结束包, 由 resultMu 保护
+	serverStatus uint16
+	// localInfile 在服务端返回 LOCAL INFILE Request 后到客户端发送空包之前为 true,
+	// 期间客户端的数据包是文件内容, 不作为命令解析, 由 resultMu 保护
+	localInfile bool
+
+	stmtMu sync.Mutex
+	stmts  map[uint32]*preparedStatement
+
+	mu        sync.Mutex
+	closeOnce sync.Once
+	endOnce   sync.Once
 }
 
-func NewConnection(fakeSrv *FakeServer) *Connection {
+func NewConnection(fakeSrv *FakeServer, conn net.Conn) *Connection {
 	return &Connection{
-		host:       fakeSrv.Host,
-		port:       fmt.Sprintf(":%d", fakeSrv.Port),
-		conn:       fakeSrv.Conn,
+		conn:       conn,
 		JmsService: fakeSrv.JmsService,
 		FakeServer: fakeSrv,
+		stmts:      make(map[uint32]*preparedStatement),
+		masker:     datamask.ConfigMasker(),
+
+		serverStatus: serverStatusAutocommit,
 	}
 }
 
-func (fs *FakeServer) GetRecorders() (*proxy.ReplyRecorder, *proxy.CommandRecorder) {
-	return fs.GetReplayRecorder(), fs.GetCommandRecorder()
+func (c *Connection) setClientConn(conn net.Conn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.conn = conn
 }
 
-func (fs *FakeServer) GetReplayRecorder() *proxy.ReplyRecorder {
-	info := &proxy.ReplyInfo{
-		Width:     80,
-		Height:    36,
-		TimeStamp: time.Now(),
-	}
-	termConf, err := fs.JmsService.GetTerminalConfig()
-	recorder, err := proxy.NewReplayRecord(fs.CurrSession.sess.ID, fs.JmsService,
-		proxy.NewReplayStorage(fs.JmsService, &termConf),
-		info)
+// writeErr 向客户端返回 ERR 包
+func (c *Connection) writeErr(sequenceId uint8, code uint16, sqlState, msg string) {
+	data, err := NewErrPacket(sequenceId, code, sqlState, msg).Encode()
 	if err != nil {
-		logger.Error(err)
+		return
+	}
+	if _, err = c.conn.Write(data); err != nil {
+		logger.Errorf("MySQL proxy write err packet to %s failed: %s", c.conn.RemoteAddr(), err)
 	}
-	return recorder
 }
 
-func (fs *FakeServer) GetCommandRecorder() *proxy.CommandRecorder {
-	termConf, _ := fs.JmsService.GetTerminalConfig()
-	cmdR := proxy.CommandRecorder{
-		SessionID:  fs.CurrSession.sess.ID,
-		Storage:    proxy.NewCommandStorage(fs.JmsService, &termConf),
-		Queue:      make(chan *model.Command, 10),
-		Closed:     make(chan struct{}),
-		JmsService: fs.JmsService,
-	}
-	go cmdR.Record()
-	return &cmdR
+func (c *Connection) setUpstream(conn net.Conn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.upstream = conn
 }
 
+// Close 关闭客户端和后端 MySQL 连接, 并结束当前会话
+func (c *Connection) Close() {
+	c.closeOnce.Do(func() {
+		c.mu.Lock()
+		conn, upstream := c.conn, c.upstream
+		c.mu.Unlock()
+		if c.CurrSession != nil {
+			c.CurrSession.SwSess.Cancel()
+		}
+		_ = conn.Close()
+		if upstream != nil {
+			_ = upstream.Close()
+		}
+	})
+}
+
+// Request 检查和记录客户端的命令, 超过最大长度的命令由多个数据包拼接为一个完整的包后处理
 type Request struct {
-	buf        bytes.Buffer
-	jmsService *service.JMService
-	currSess   *CurrSession
-	fs         *FakeServer
+	buf      bytes.Buffer
+	conn     *Connection
+	currSess *CurrSession
 }
 
 type Response struct {
-	buf        bytes.Buffer
-	jmsService *service.JMService
-	currSess   *CurrSession
-	fs         *FakeServer
+	conn     *Connection
+	currSess *CurrSession
 }
 
 func beatify(b []byte) []byte {
@@ -90,77 +131,357 @@ func getPacketType(packet []byte) byte {
 	return packet[4]
 }
 
-func (req *Request) Write(packet []byte) (n int, err error) {
+func getSequenceID(packet []byte) uint8 {
+	return packet[3]
+}
+
+// decodeQuery 解析 COM_QUERY 和 COM_STMT_PREPARE 包中的 SQL 语句,
+// 客户端开启 clientQueryAttributes 时 COM_QUERY 的语句之前带有查询属性
+func decodeQuery(packet []byte, flags CapabilityFlag) ([]byte, error) {
+	query := packet[5:]
+	if getPacketType(packet) == ComQuery && flags.Has(clientQueryAttributes) {
+		var err error
+		if query, err = skipQueryAttributes(query); err != nil {
+			return nil, err
+		}
+	}
+	decoder := charmap.CodePage866.NewDecoder()
+	cmdBytes, err := decoder.Bytes(query)
+	if err != nil {
+		return query, nil
+	}
+	return cmdBytes, nil
+}
+
+// skipQueryAttributes 跳过 COM_QUERY 语句之前的查询属性, 返回 SQL 语句
+// https://dev.mysql.com/doc/dev/mysql-server/latest/page_protocol_com_query.html
+func skipQueryAttributes(b []byte) ([]byte, error) {
+	paramCount, isNull, n := readLengthEncodedInteger(b)
+	if isNull {
+		return nil, errMalformedPacket
+	}
+	position := n
+	// parameter_set_count, 目前固定为 1
+	if _, isNull, n = readLengthEncodedInteger(b[position:]); isNull {
+		return nil, errMalformedPacket
+	}
+	position += n
+	if paramCount == 0 {
+		return b[position:], nil
+	}
+	if paramCount > uint64(len(b)) {
+		return nil, errMalformedPacket
+	}
+	count := int(paramCount)
+	bitmapLength := (count + 7) / 8
+	if len(b) < position+bitmapLength+1 {
+		return nil, errMalformedPacket
+	}
+	nullBitmap := b[position : position+bitmapLength]
+	position += bitmapLength
+	// new_params_bind_flag, 查询属性总是带有类型和名称
+	if b[position] != 0x01 {
+		return nil, errMalformedPacket
+	}
+	position++
+	paramTypes := make([]byte, 0, count*2)
+	for i := 0; i < count; i++ {
+		if len(b) < position+2 {
+			return nil, errMalformedPacket
+		}
+		paramTypes = append(paramTypes, b[position], b[position+1])
+		position += 2
+		_, _, n, err := readLengthEncodedString(b[position:])
+		if err != nil || n == 0 {
+			return nil, errMalformedPacket
+		}
+		position += n
+	}
+	for i := 0; i < count; i++ {
+		if nullBitmap[i/8]&(1<<(uint(i)%8)) != 0 || paramTypes[i*2] == fieldTypeNULL {
+			continue
+		}
+		if position >= len(b) {
+			return nil, errMalformedPacket
+		}
+		_, _, n, err := readBinaryValue(b[position:], paramTypes[i*2], paramTypes[i*2+1]&0x80 != 0)
+		if err != nil {
+			return nil, err
+		}
+		position += n
+	}
+	return b[position:], nil
+}
 
-	packetType := getPacketType(packet)
+// Allow 检查客户端的数据包是否可以转发到后端, 被拒绝的语句直接向客户端返回 ERR 包
+func (req *Request) Allow(packet []byte) bool {
+	if len(packet) < 5 {
+		return true
+	}
+	if packetType := getPacketType(packet); packetType != ComQuery && packetType != ComStmtPrepare {
+		return true
+	}
+	query, err := decodeQuery(packet, req.conn.clientCapabilities)
+	if err != nil {
+		// 无法解析的语句不能按规则检查, 直接拒绝
+		logger.Errorf("Session %s: MySQL proxy decode query err: %s", req.currSess.Sess.ID, err)
+		req.conn.writeErr(getSequenceID(packet)+1, ErrCodeAccessDenied, SQLStateAccessDenied,
+			"Malformed query packet")
+		return false
+	}
+	cmdBytes := bytes.Trim(query, "\x00")
+	if len(cmdBytes) == 0 {
+		return true
+	}
+	allowed, msg := req.conn.filter.Check(req.currSess, string(cmdBytes))
+	if allowed {
+		return true
+	}
+	logger.Infof("Session %s: MySQL proxy forbid command: %s", req.currSess.Sess.ID, cmdBytes)
+	req.conn.writeErr(getSequenceID(packet)+1, ErrCodeAccessDenied, SQLStateAccessDenied, msg)
+	cmdBytes = beatify(cmdBytes)
+	req.conn.flushResult()
+	req.conn.recordReplay(append(append([]byte{}, mySqlPrompt...), cmdBytes...))
+	req.conn.recordReplay([]byte(msg + "\r\n"))
+	req.conn.recordCommand(cmdBytes, msg, nil, nil, model.DangerLevel, time.Now())
+	return false
+}
 
-	switch packetType {
+func (req *Request) Write(packet []byte) (n int, err error) {
+	if len(packet) < 5 {
+		return len(packet), nil
+	}
+	switch getPacketType(packet) {
 	case ComQuit:
-		fmt.Printf("\nПроизошёл выход.\n")
-		req.currSess.cmdRecorder.End()
-		req.currSess.replRecorder.End()
-		req.currSess.DisConnectedCallback()
+		logger.Infof("Session %s: MySQL proxy client quit", req.currSess.Sess.ID)
+		req.conn.endSession()
 		return len(packet), nil
-	case ComStmtPrepare:
 	case ComQuery:
-		if packet[5] == 0x00 {
-			req.buf.Write(packet[7:])
-		} else {
-			req.buf.Write(packet[5:])
+		query, _ := decodeQuery(packet, req.conn.clientCapabilities)
+		req.buf.Write(query)
+	case ComStmtPrepare:
+		query, _ := decodeQuery(packet, req.conn.clientCapabilities)
+		query = bytes.Trim(query, "\x00")
+		req.conn.beginResult(newPrepareResult(query, req.conn.clientCapabilities.Has(clientDeprecateEOF)))
+		return len(packet), nil
+	case ComStmtExecute:
+		req.writeExecute(packet)
+		return len(packet), nil
+	case comStmtFetch:
+		req.writeFetch(packet)
+		return len(packet), nil
+	case comStmtSendLongData:
+		// 没有响应包, 不影响正在记录的结果
+		if stmt := req.conn.getStatement(packet); stmt != nil {
+			stmt.appendLongData(packet)
+		}
+		return len(packet), nil
+	case ComStmtClose:
+		if id, ok := getStatementId(packet); ok {
+			req.conn.stmtMu.Lock()
+			delete(req.conn.stmts, id)
+			req.conn.stmtMu.Unlock()
+		}
+		return len(packet), nil
+	case comStmtReset:
+		if stmt := req.conn.getStatement(packet); stmt != nil {
+			stmt.longData = nil
 		}
 	}
 
-	//if packet[4] != 3 {
-	//	req.buf.Write(packet[5:])
-	//} else {
-	//	req.buf.Write(packet[7:])
-	//}
-
-	decoder := charmap.CodePage866.NewDecoder()
-	cmdBytes, err := decoder.Bytes(req.buf.Bytes())
-
-	if len(cmdBytes) == 0 {
+	if req.buf.Len() == 0 {
+		req.conn.beginResult(nil)
 		return len(packet), nil
 	}
-	cmdBytes = beatify(cmdBytes)
-
-	fmt.Printf("\nКоманда: %s", string(cmdBytes))
-
-	cmd := &model.Command{
-		SessionID:  req.currSess.sess.ID,
-		OrgID:      req.currSess.sess.OrgID,
-		Input:      string(cmdBytes),
-		Output:     "",
-		User:       req.currSess.sess.User,
-		Server:     req.currSess.sess.Asset,
-		SystemUser: req.currSess.sess.SystemUser,
-		Timestamp:  time.Now().Unix(),
-		RiskLevel:  0,
-	}
-	finalCmdBytes := append(mySqlPrompt, cmdBytes...)
-	req.currSess.cmdRecorder.RecordCommand(cmd)
-	req.currSess.replRecorder.Record(finalCmdBytes)
-	dumpByteSlice(packet)
+	cmdBytes := beatify(req.buf.Bytes())
 	req.buf.Reset()
+	logger.Debugf("Session %s: MySQL proxy command: %s", req.currSess.Sess.ID, cmdBytes)
+	req.conn.recordReplay(append(append([]byte{}, mySqlPrompt...), cmdBytes...))
+	req.conn.beginResult(newQueryResult(cmdBytes, req.conn.clientCapabilities.Has(clientDeprecateEOF)))
 	return len(packet), nil
+}
 
+// writeExecute 用绑定的参数还原预处理语句, 作为一条命令记录
+func (req *Request) writeExecute(packet []byte) {
+	stmt := req.conn.getStatement(packet)
+	if stmt == nil {
+		req.conn.beginResult(nil)
+		return
+	}
+	params, err := stmt.decodeExecute(packet, req.conn.clientCapabilities)
+	if err != nil {
+		logger.Debugf("Session %s: MySQL proxy decode statement %d params err: %s",
+			req.currSess.Sess.ID, stmt.ID, err)
+	}
+	cmdBytes := beatify(interpolateParams(stmt.Query, params, req.conn.FakeServer.MaskStmtParams))
+	logger.Debugf("Session %s: MySQL proxy execute statement: %s", req.currSess.Sess.ID, cmdBytes)
+	req.conn.recordReplay(append(append([]byte{}, mySqlPrompt...), cmdBytes...))
+	result := newExecuteResult(cmdBytes, req.conn.clientCapabilities.Has(clientDeprecateEOF))
+	result.Statement = stmt
+	req.conn.beginResult(result)
 }
 
-func (res *Response) Write(packet []byte) (n int, err error) {
+// writeFetch 读取游标的行, 使用执行时的列定义解析和脱敏
+func (req *Request) writeFetch(packet []byte) {
+	stmt := req.conn.getStatement(packet)
+	if stmt == nil {
+		req.conn.beginResult(nil)
+		return
+	}
+	req.conn.stmtMu.Lock()
+	hasCursor := stmt.cursorColumns != nil
+	req.conn.stmtMu.Unlock()
+	if !hasCursor {
+		req.conn.beginResult(nil)
+		return
+	}
+	req.conn.beginResult(newFetchResult(stmt, req.conn.clientCapabilities.Has(clientDeprecateEOF)))
+}
 
-	res.buf.Write(packet[7:])
-	//fmt.Printf("\npacket %s", packet)
-	//
-	//if packet[4] != 0xff {
-	//	fmt.Printf("\nКоманда успешно выполнилась.")
-	//	res.buf.Reset()
-	//	return len(packet), nil
-	//}
-	//if len(packet) > 11 {
-	//	fmt.Printf("\nОтвет от сервера: %v\n", &res.buf)
-	//	res.buf.Reset()
-	//}
-	//dumpByteSlice(packet)
+// Handle 解析服务端返回的数据包, 返回转发给客户端的数据包, 结果集脱敏时可能被改写
+func (res *Response) Handle(packet []byte) []byte {
+	res.conn.resultMu.Lock()
+	result := res.conn.result
+	if result != nil {
+		packet = result.Feed(packet)
+		if result.Done() {
+			res.conn.result = nil
+		}
+		if result.statusKnown {
+			res.conn.serverStatus = result.status
+		}
+		if result.localInfile {
+			// 在转发给客户端之前设置, 客户端收到后才会发送文件内容
+			res.conn.localInfile = true
+			result.localInfile = false
+		}
+	}
+	res.conn.resultMu.Unlock()
+	if result != nil && result.Done() {
+		res.conn.recordResult(result)
+	}
+	return packet
+}
 
-	return len(packet), nil
+// beginResult 开始记录新命令的执行结果, 上一条未完成的结果直接记录
+func (c *Connection) beginResult(result *queryResult) {
+	if result != nil {
+		result.masker = c.masker
+		result.guard = c.guard
+		if c.masker != nil && len(result.Input) > 0 {
+			result.candidates = c.maskCandidates(string(result.Input))
+		}
+	}
+	c.resultMu.Lock()
+	prev := c.result
+	c.result = result
+	if result != nil {
+		result.status = c.serverStatus
+		if c.guard.MaxRows > 0 {
+			result.stopQuery = func() { go c.stopTruncatedQuery(result) }
+		}
+		c.startStatementTimer(result)
+	}
+	c.resultMu.Unlock()
+	if prev != nil {
+		c.recordResult(prev)
+	}
+}
+
+// isLocalInfile 表示客户端正在发送 LOCAL INFILE 的文件内容
+func (c *Connection) isLocalInfile() bool {
+	c.resultMu.Lock()
+	defer c.resultMu.Unlock()
+	return c.localInfile
+}
+
+func (c *Connection) setLocalInfile(localInfile bool) {
+	c.resultMu.Lock()
+	defer c.resultMu.Unlock()
+	c.localInfile = localInfile
+}
+
+func (c *Connection) flushResult() {
+	c.beginResult(nil)
+}
+
+func (c *Connection) getStatement(packet []byte) *preparedStatement {
+	id, ok := getStatementId(packet)
+	if !ok {
+		return nil
+	}
+	c.stmtMu.Lock()
+	defer c.stmtMu.Unlock()
+	return c.stmts[id]
+}
+
+func (c *Connection) recordResult(result *queryResult) {
+	if result.timer != nil {
+		result.timer.Stop()
+	}
+	c.trackTransaction(result)
+	if result.prepare {
+		// 预处理语句在执行时才记录
+		if stmt := result.Statement; stmt != nil {
+			c.stmtMu.Lock()
+			c.stmts[stmt.ID] = stmt
+			c.stmtMu.Unlock()
+		}
+		return
+	}
+	if result.cursor && result.Statement != nil {
+		c.stmtMu.Lock()
+		result.Statement.cursorColumns = result.columns
+		result.Statement.cursorMask = result.maskSet
+		c.stmtMu.Unlock()
+	}
+	masked := result.maskedColumns()
+	if result.fetch {
+		// 游标的行不单独记录命令
+		if len(masked) > 0 && c.CurrSession != nil {
+			logger.Infof("Session %s: MySQL proxy masked fetched rows: %s",
+				c.CurrSession.Sess.ID, strings.Join(masked, ", "))
+		}
+		if len(result.violations) > 0 && c.CurrSession != nil {
+			logger.Infof("Session %s: MySQL proxy fetched rows violate guardrail: %s",
+				c.CurrSession.Sess.ID, strings.Join(result.violations, ", "))
+		}
+		return
+	}
+	output := result.Output()
+	if output != "" {
+		c.recordReplay([]byte(output + "\r\n"))
+	}
+	c.recordCommand(result.Input, output, masked, result.violations, model.NormalLevel, result.CreatedAt)
+}
+
+func (c *Connection) recordCommand(input []byte, output string, masked, violations []string, riskLevel int64,
+	createdAt time.Time) {
+	sess := c.CurrSession
+	if sess == nil || sess.CmdRecorder == nil {
+		return
+	}
+	cmd := sess.NewCommand(string(input), output, riskLevel, createdAt)
+	if len(masked) > 0 {
+		cmd.MaskedColumns = masked
+		logger.Infof("Session %s: MySQL proxy masked result of %q: %s",
+			sess.Sess.ID, input, strings.Join(masked, ", "))
+	}
+	if len(violations) > 0 {
+		cmd.Violations = violations
+		logger.Infof("Session %s: MySQL proxy command %q violates guardrail: %s",
+			sess.Sess.ID, input, strings.Join(violations, ", "))
+	}
+	if c.sqlMatcher != nil {
+		sqlparser.TagCommand(cmd, c.sqlMatcher.Classify(string(input)))
+	}
+	sess.CmdRecorder.RecordCommand(cmd)
+}
+
+func (c *Connection) recordReplay(p []byte) {
+	sess := c.CurrSession
+	if sess == nil || sess.ReplRecorder == nil {
+		return
+	}
+	sess.ReplRecorder.Record(p)
 }
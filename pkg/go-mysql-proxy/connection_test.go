@@ -0,0 +1,220 @@
+package mysqlProxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/meowgen/koko/pkg/jms-sdk-go/model"
+	"github.com/meowgen/koko/pkg/jms-sdk-go/service"
+	"github.com/meowgen/koko/pkg/proxy"
+	"github.com/meowgen/koko/pkg/proxybase"
+	"github.com/meowgen/koko/pkg/sqlparser"
+)
+
+// bufConn 记录代理写给客户端的数据
+type bufConn struct {
+	net.Conn
+	buf bytes.Buffer
+}
+
+func (c *bufConn) Write(p []byte) (int, error) { return c.buf.Write(p) }
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// newConfirmJMService 返回处理命令复核的 core 服务, 复核工单的状态为 *state
+func newConfirmJMService(t *testing.T, state *string) *service.JMService {
+	mux := http.NewServeMux()
+	mux.HandleFunc(service.CommandConfirmURL, func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, model.CommandTicketInfo{TicketInfo: model.TicketInfo{
+			CheckReq: model.ReqInfo{Method: http.MethodGet, URL: "/ticket/status/"},
+			CloseReq: model.ReqInfo{Method: http.MethodDelete, URL: "/ticket/status/"},
+		}})
+	})
+	mux.HandleFunc("/ticket/status/", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, model.TicketState{State: *state, Processor: "admin"})
+	})
+	return newTestJMService(t, mux)
+}
+
+func newFilterRequest(jmsService *service.JMService, rules model.FilterRules) (*Request, *bufConn) {
+	client := &bufConn{}
+	matcher := sqlparser.NewMatcher(sqlparser.DialectMySQL, "shop")
+	filter := proxybase.NewCommandFilter(proxyName, jmsService, rules, matcher.Match)
+	filter.ConfirmInterval = 10 * time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	sess := &CurrSession{
+		Sess:   &model.Session{ID: "session"},
+		SwSess: &proxy.SwitchSession{ID: "session", Ctx: ctx, Cancel: cancel},
+	}
+	c := &Connection{
+		conn:        client,
+		JmsService:  jmsService,
+		CurrSession: sess,
+		sqlMatcher:  matcher,
+		filter:      filter,
+		stmts:       make(map[uint32]*preparedStatement),
+	}
+	return &Request{conn: c, currSess: sess}, client
+}
+
+// errPacketBytes 返回拒绝命令时代理写给客户端的 ERR 包
+func errPacketBytes(sequenceId uint8, msg string) []byte {
+	payload := append([]byte{0xff, 0xcb, 0x04, '#', '4', '2', '0', '0', '0'}, msg...)
+	return append([]byte{byte(len(payload)), 0x00, 0x00, sequenceId}, payload...)
+}
+
+func TestRequest_AllowFilterRules(t *testing.T) {
+	rules := model.FilterRules{
+		{ID: "allow-tmp", Type: model.TypeRegex, RePattern: `(?i)drop table tmp_\w+`, Action: model.ActionAllow},
+		{ID: "deny-drop", Type: model.TypeSQL, Content: "DROP", Action: model.ActionDeny},
+		{ID: "confirm-delete", Type: model.TypeSQL, Content: "DELETE WITHOUT WHERE", Action: model.ActionConfirm},
+	}
+	const (
+		dropMsg   = "Command `drop table users` is forbidden"
+		deleteMsg = "admin rejected: Command `delete from logs` is forbidden"
+	)
+	tests := []struct {
+		name    string
+		sql     string
+		state   string
+		allowed bool
+		errMsg  string
+	}{
+		{"no rule", "select * from users", "", true, ""},
+		{"allow rule", "drop table tmp_orders", "", true, ""},
+		{"deny rule", "drop table users", "", false, dropMsg},
+		{"confirm approved", "delete from logs", model.TicketApproved, true, ""},
+		{"confirm rejected", "delete from logs", model.TicketRejected, false, deleteMsg},
+	}
+	var state string
+	jmsService := newConfirmJMService(t, &state)
+	for _, packetType := range []byte{ComQuery, ComStmtPrepare} {
+		for _, tt := range tests {
+			state = tt.state
+			req, client := newFilterRequest(jmsService, rules)
+			packet := encodePacket(0, append([]byte{packetType}, tt.sql...))
+			if allowed := req.Allow(packet); allowed != tt.allowed {
+				t.Errorf("%s %#x: Allow(%q) = %v, want %v", tt.name, packetType, tt.sql, allowed, tt.allowed)
+				continue
+			}
+			var expected []byte
+			if !tt.allowed {
+				expected = errPacketBytes(1, tt.errMsg)
+			}
+			if !bytes.Equal(client.buf.Bytes(), expected) {
+				t.Errorf("%s %#x: client should receive %q but %q", tt.name, packetType,
+					expected, client.buf.Bytes())
+			}
+		}
+	}
+}
+
+func TestRequest_AllowQueryAttributes(t *testing.T) {
+	rules := model.FilterRules{
+		{ID: "deny-drop", Type: model.TypeSQL, Content: "DROP", Action: model.ActionDeny},
+	}
+	// 一个名为 trace 的字符串属性, 值为 abc
+	attrs := []byte{0x01, 0x01, 0x00, 0x01, fieldTypeString, 0x00, 0x05, 't', 'r', 'a', 'c', 'e', 0x03, 'a', 'b', 'c'}
+	tests := []struct {
+		name    string
+		payload []byte
+		allowed bool
+		errMsg  string
+	}{
+		{"no attributes", append([]byte{ComQuery, 0x00, 0x01}, "drop table users"...), false,
+			"Command `drop table users` is forbidden"},
+		{"attributes", append(append([]byte{ComQuery}, attrs...), "drop table users"...), false,
+			"Command `drop table users` is forbidden"},
+		{"attributes allowed", append(append([]byte{ComQuery}, attrs...), "select 1"...), true, ""},
+		{"malformed attributes", append([]byte{ComQuery}, attrs[:10]...), false, "Malformed query packet"},
+	}
+	jmsService := newConfirmJMService(t, new(string))
+	for _, tt := range tests {
+		req, client := newFilterRequest(jmsService, rules)
+		req.conn.clientCapabilities = clientQueryAttributes
+		if allowed := req.Allow(encodePacket(0, tt.payload)); allowed != tt.allowed {
+			t.Errorf("%s: Allow = %v, want %v", tt.name, allowed, tt.allowed)
+			continue
+		}
+		var expected []byte
+		if !tt.allowed {
+			expected = errPacketBytes(1, tt.errMsg)
+		}
+		if !bytes.Equal(client.buf.Bytes(), expected) {
+			t.Errorf("%s: client should receive %q but %q", tt.name, expected, client.buf.Bytes())
+		}
+	}
+}
+
+// scriptConn 依次返回预先写好的客户端数据, 记录代理写给客户端的数据
+type scriptConn struct {
+	bufConn
+	r io.Reader
+}
+
+func (c *scriptConn) Read(p []byte) (int, error) { return c.r.Read(p) }
+
+func TestConnection_ProxyRequests(t *testing.T) {
+	rules := model.FilterRules{
+		{ID: "deny-drop", Type: model.TypeSQL, Content: "DROP", Action: model.ActionDeny},
+	}
+	// 超过最大长度的语句, 被拒绝的部分在第二个数据包中
+	query := append([]byte{ComQuery}, "select 1 /*"...)
+	query = append(query, bytes.Repeat([]byte{'x'}, maxPacketSize-len(query))...)
+	tests := []struct {
+		name        string
+		localInfile bool
+		packets     [][]byte
+		forwarded   bool
+	}{
+		{"split query", false, [][]byte{encodePacket(0, query),
+			encodePacket(1, []byte("*/; drop table users"))}, false},
+		{"split query allowed", false, [][]byte{encodePacket(0, query),
+			encodePacket(1, []byte("*/"))}, true},
+		{"local infile data", true, [][]byte{encodePacket(2, []byte{ComQuit, 'd', 'a', 't', 'a'}),
+			encodePacket(3, nil)}, true},
+	}
+	jmsService := newConfirmJMService(t, new(string))
+	for _, tt := range tests {
+		req, _ := newFilterRequest(jmsService, rules)
+		c := req.conn
+		c.localInfile = tt.localInfile
+		client := &scriptConn{r: bytes.NewReader(bytes.Join(tt.packets, nil))}
+		c.conn = client
+		upstream := &bufConn{}
+		if err := c.proxyRequests(upstream); err != io.EOF {
+			t.Fatalf("%s: proxyRequests should end with EOF but %v", tt.name, err)
+		}
+		var expected []byte
+		if tt.forwarded {
+			expected = bytes.Join(tt.packets, nil)
+		}
+		if !bytes.Equal(upstream.buf.Bytes(), expected) {
+			t.Errorf("%s: forwarded %d bytes, want %d", tt.name, upstream.buf.Len(), len(expected))
+		}
+		if tt.forwarded == (client.buf.Len() > 0) {
+			t.Errorf("%s: client received %q", tt.name, client.buf.Bytes())
+		}
+		// 拒绝命令的 ERR 包在最后一个数据包之后编号
+		last := tt.packets[len(tt.packets)-1]
+		if !tt.forwarded && (client.buf.Len() < 5 || client.buf.Bytes()[3] != last[3]+1 ||
+			client.buf.Bytes()[4] != iERR) {
+			t.Errorf("%s: client should receive ERR with sequence %d", tt.name, last[3]+1)
+		}
+		if c.CurrSession.SwSess.Ctx.Err() != nil {
+			t.Errorf("%s: session should not end", tt.name)
+		}
+		if c.isLocalInfile() {
+			t.Errorf("%s: local infile should end with an empty packet", tt.name)
+		}
+	}
+}
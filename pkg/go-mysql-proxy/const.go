@@ -30,3 +30,21 @@ const (
 	comSetOption
 	comStmtFetch
 )
+
+const maxPacketSize = 1<<24 - 1
+
+const (
+	iOK  byte = 0x00
+	iEOF byte = 0xfe
+	iERR byte = 0xff
+)
+
+const (
+	// ER_SPECIFIC_ACCESS_DENIED_ERROR
+	ErrCodeAccessDenied  uint16 = 1227
+	SQLStateAccessDenied        = "42000"
+
+	// CR_CONN_HOST_ERROR
+	ErrCodeConnectFailed uint16 = 2003
+	SQLStateGeneral             = "HY000"
+)
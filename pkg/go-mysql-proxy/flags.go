@@ -68,6 +68,9 @@ const (
 	clientCanHandleExpiredPasswords
 	clientSessionTrack
 	clientDeprecateEOF
+	clientOptionalResultsetMetadata
+	clientZstdCompressionAlgorithm
+	clientQueryAttributes
 )
 
 var flags = map[CapabilityFlag]string{
@@ -96,4 +99,7 @@ var flags = map[CapabilityFlag]string{
 	clientCanHandleExpiredPasswords:  "clientCanHandleExpiredPasswords",
 	clientSessionTrack:               "clientSessionTrack",
 	clientDeprecateEOF:               "clientDeprecateEOF",
+	clientOptionalResultsetMetadata:  "clientOptionalResultsetMetadata",
+	clientZstdCompressionAlgorithm:   "clientZstdCompressionAlgorithm",
+	clientQueryAttributes:            "clientQueryAttributes",
 }
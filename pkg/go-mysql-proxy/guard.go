@@ -0,0 +1,199 @@
+package mysqlProxy
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/meowgen/koko/pkg/guardrail"
+	"github.com/meowgen/koko/pkg/jms-sdk-go/model"
+	"github.com/meowgen/koko/pkg/logger"
+)
+
+const (
+	serverStatusInTrans    uint16 = 0x0001
+	serverStatusAutocommit uint16 = 0x0002
+
+	// errQueryInterrupted 是 KILL QUERY 终止语句后返回的错误码 ER_QUERY_INTERRUPTED
+	errQueryInterrupted uint16 = 1317
+)
+
+// truncateRow 丢弃超过最大行数的行, 返回是否丢弃. 第一次截断时终止后端的语句, 不再读取之后的行
+func (r *queryResult) truncateRow() bool {
+	if r.guard.MaxRows <= 0 || r.rowCount <= r.guard.MaxRows {
+		return false
+	}
+	if !r.truncated && !r.fetch && r.stopQuery != nil {
+		r.stopped = true
+		r.stopQuery()
+	}
+	r.truncated = true
+	r.dropping = r.continuation
+	r.seqShift++
+	return true
+}
+
+// truncatedTerminator 在结果集结束包中增加一个警告, 提示客户端结果被截断
+func (r *queryResult) truncatedTerminator(packet []byte) []byte {
+	r.outputs = append(r.outputs, r.guard.RowsTruncated())
+	r.violate(guardrail.ViolationMaxRows)
+	payload := packet[4:]
+	position := 1
+	if r.deprecateEOF {
+		_, _, n := readLengthEncodedInteger(payload[position:])
+		position += n
+		_, _, n = readLengthEncodedInteger(payload[position:])
+		position += n + 2
+	}
+	if len(payload) < position+2 {
+		return packet
+	}
+	warnings := binary.LittleEndian.Uint16(payload[position:])
+	binary.LittleEndian.PutUint16(payload[position:], warnings+1)
+	return packet
+}
+
+// interruptedTerminator 把终止语句后返回的 ERR 包替换为结果集结束包, 客户端收到截断的结果集
+func (r *queryResult) interruptedTerminator(packet []byte) []byte {
+	status := r.status &^ serverMoreResultsExists
+	payload := []byte{iEOF, 0x00, 0x00, byte(status), byte(status >> 8)}
+	if r.deprecateEOF {
+		payload = append(payload, 0x00, 0x00)
+	}
+	return encodePacket(packet[3], payload)
+}
+
+func (r *queryResult) violate(name string) {
+	violation := r.guard.Violation(name)
+	for _, v := range r.violations {
+		if v == violation {
+			return
+		}
+	}
+	r.violations = append(r.violations, violation)
+}
+
+// trackStatus 记录 OK 或 EOF 包中的服务端状态, 用于判断是否在事务中
+func (r *queryResult) trackStatus(status uint16) {
+	r.status = status
+	r.statusKnown = true
+}
+
+// startStatementTimer 语句超时后使用新的后端连接执行 KILL QUERY
+func (c *Connection) startStatementTimer(result *queryResult) {
+	if c.guard.StatementTimeout <= 0 || result.prepare {
+		return
+	}
+	result.timer = time.AfterFunc(c.guard.StatementTimeout, func() {
+		c.resultMu.Lock()
+		running := c.result == result
+		if running {
+			result.outputs = append(result.outputs, c.guard.StatementTimedOut())
+			result.violate(guardrail.ViolationStatementTimeout)
+		}
+		c.resultMu.Unlock()
+		if !running {
+			return
+		}
+		logger.Infof("Session %s: MySQL proxy statement exceeded %s, kill query on thread %d",
+			c.CurrSession.Sess.ID, c.guard.StatementTimeout, c.threadID)
+		if err := c.killQuery(); err != nil {
+			logger.Errorf("Session %s: MySQL proxy kill query err: %s", c.CurrSession.Sess.ID, err)
+		}
+	})
+}
+
+// stopTruncatedQuery 结果集超过最大行数后使用新的后端连接执行 KILL QUERY
+func (c *Connection) stopTruncatedQuery(result *queryResult) {
+	c.resultMu.Lock()
+	running := c.result == result
+	c.resultMu.Unlock()
+	if !running {
+		return
+	}
+	logger.Infof("Session %s: MySQL proxy result exceeded %d rows, kill query on thread %d",
+		c.CurrSession.Sess.ID, c.guard.MaxRows, c.threadID)
+	if err := c.killQuery(); err != nil {
+		logger.Errorf("Session %s: MySQL proxy kill query err: %s", c.CurrSession.Sess.ID, err)
+	}
+}
+
+// trackTransaction 按语句结束时的服务端状态开始或停止事务计时, 事务超时后断开后端连接, 由后端回滚事务
+func (c *Connection) trackTransaction(result *queryResult) {
+	if c.guard.TransactionTimeout <= 0 || !result.statusKnown {
+		return
+	}
+	inTrans := result.status&serverStatusInTrans != 0
+	c.guardMu.Lock()
+	defer c.guardMu.Unlock()
+	switch {
+	case inTrans && c.txTimer == nil:
+		c.txTimer = time.AfterFunc(c.guard.TransactionTimeout, c.transactionTimeout)
+	case !inTrans && c.txTimer != nil:
+		c.txTimer.Stop()
+		c.txTimer = nil
+	}
+}
+
+func (c *Connection) transactionTimeout() {
+	msg := c.guard.TransactionTimedOut()
+	logger.Infof("Session %s: MySQL proxy %s, close connection", c.CurrSession.Sess.ID, msg)
+	c.recordReplay([]byte(msg + "\r\n"))
+	violations := []string{c.guard.Violation(guardrail.ViolationTransactionTimeout)}
+	c.recordCommand([]byte("ROLLBACK"), msg, nil, violations, model.NormalLevel, time.Now())
+	c.Close()
+}
+
+func (c *Connection) stopGuardTimers() {
+	c.guardMu.Lock()
+	defer c.guardMu.Unlock()
+	if c.txTimer != nil {
+		c.txTimer.Stop()
+		c.txTimer = nil
+	}
+}
+
+// killQuery 使用系统用户建立新的后端连接, 终止当前连接正在执行的语句
+func (c *Connection) killQuery() error {
+	address := net.JoinHostPort(c.host, c.port)
+	mysql, _, packet, err := c.dialUpstream(address, newAuthPacket(c.Username), nil)
+	if mysql != nil {
+		defer mysql.Close()
+	}
+	if err != nil {
+		return err
+	}
+	if packet[4] != iOK {
+		return errors.New("kill connection login failed")
+	}
+	_ = mysql.SetDeadline(time.Now().Add(dialTimeout))
+	query := fmt.Sprintf("KILL QUERY %d", c.threadID)
+	if _, err = mysql.Write(encodePacket(0, append([]byte{ComQuery}, query...))); err != nil {
+		return err
+	}
+	if packet, err = readPacket(mysql); err != nil {
+		return err
+	}
+	if len(packet) > 4 && packet[4] == iERR {
+		errPacket := ErrPacket{}
+		_ = errPacket.Decode(packet[4:])
+		return errors.New(formatErrPacket(&errPacket))
+	}
+	return nil
+}
+
+// newAuthPacket 创建代理自己登录后端使用的 HandshakeResponse41
+func newAuthPacket(username string) *AuthorizationPacket {
+	authPacket := &AuthorizationPacket{
+		header:      &PacketHeader{SequenceId: 1},
+		PacketPart1: make([]byte, 32),
+		Username:    []byte(username),
+	}
+	binary.LittleEndian.PutUint32(authPacket.PacketPart1[4:8], maxPacketSize)
+	authPacket.PacketPart1[8] = byte(charsetUTF8)
+	authPacket.SetCapabilityFlags(clientLongPassword | clientProtocol41 | clientTransactions |
+		clientSecureConn | clientPluginAuth)
+	return authPacket
+}
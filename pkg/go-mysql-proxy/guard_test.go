@@ -0,0 +1,103 @@
+package mysqlProxy
+
+import (
+	"encoding/binary"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/meowgen/koko/pkg/guardrail"
+)
+
+func TestQueryResult_TruncateRows(t *testing.T) {
+	result := newQueryResult([]byte("select name from t"), true)
+	result.guard = guardrail.Policy{MaxRows: 1}
+	result.Feed(buildPacket(1, 0x01))
+	result.Feed(buildPacket(2, columnDefinitionPayload("name")...))
+	if packet := result.Feed(buildPacket(3, lenEncString("a")...)); packet == nil {
+		t.Fatal("the first row should be forwarded")
+	}
+	for seq, value := range []string{"b", "c"} {
+		if packet := result.Feed(buildPacket(uint8(seq+4), lenEncString(value)...)); packet != nil {
+			t.Errorf("row %q should be dropped", value)
+		}
+	}
+	packet := result.Feed(buildPacket(6, 0xfe, 0x00, 0x00, 0x22, 0x00, 0x01, 0x00))
+	if !result.Done() {
+		t.Fatal("result should be done")
+	}
+	if packet[3] != 4 {
+		t.Errorf("terminator should be renumbered to 4 but %d", packet[3])
+	}
+	if warnings := binary.LittleEndian.Uint16(packet[4+5:]); warnings != 2 {
+		t.Errorf("terminator should have 2 warnings but %d", warnings)
+	}
+	if !strings.Contains(result.Output(), "Result truncated to 1 rows") {
+		t.Errorf("output should contain truncated message: %q", result.Output())
+	}
+	if expected := []string{"max_rows=1"}; !reflect.DeepEqual(result.violations, expected) {
+		t.Errorf("violations should be %v but %v", expected, result.violations)
+	}
+	if result.status&serverStatusInTrans != 0 || !result.statusKnown {
+		t.Errorf("unexpected server status 0x%04x", result.status)
+	}
+}
+
+func TestQueryResult_TrackTransactionStatus(t *testing.T) {
+	result := newQueryResult([]byte("begin"), false)
+	result.Feed(buildPacket(1, 0x00, 0x00, 0x00, 0x03, 0x00, 0x00, 0x00))
+	if !result.Done() || result.status&serverStatusInTrans == 0 {
+		t.Errorf("status of begin should be in transaction but 0x%04x", result.status)
+	}
+}
+
+func TestQueryResult_StopTruncatedQuery(t *testing.T) {
+	for _, deprecateEOF := range []bool{true, false} {
+		result := newQueryResult([]byte("select name from t"), deprecateEOF)
+		result.guard = guardrail.Policy{MaxRows: 1}
+		result.status = serverStatusAutocommit | serverStatusInTrans
+		stops := 0
+		result.stopQuery = func() { stops++ }
+		result.Feed(buildPacket(1, 0x01))
+		result.Feed(buildPacket(2, columnDefinitionPayload("name")...))
+		seq := uint8(3)
+		if !deprecateEOF {
+			result.Feed(buildPacket(seq, 0xfe, 0x00, 0x00, 0x02, 0x00))
+			seq++
+		}
+		for _, value := range []string{"a", "b", "c"} {
+			result.Feed(buildPacket(seq, lenEncString(value)...))
+			seq++
+		}
+		if stops != 1 {
+			t.Fatalf("query should be stopped once but %d", stops)
+		}
+		// KILL QUERY 终止语句后服务端返回 ER_QUERY_INTERRUPTED
+		errPacket := NewErrPacket(seq, errQueryInterrupted, "70100", "Query execution was interrupted")
+		data, err := errPacket.Encode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		packet := result.Feed(data)
+		if !result.Done() {
+			t.Fatal("result should be done")
+		}
+		if packet[3] != seq-2 || packet[4] != iEOF || !isResultSetTerminator(packet[4:], deprecateEOF) {
+			t.Fatalf("error should be replaced by terminator %d but %v", seq-2, packet)
+		}
+		warnings, status := packet[4+1:], packet[4+3:]
+		if deprecateEOF {
+			warnings, status = packet[4+5:], packet[4+3:]
+		}
+		if binary.LittleEndian.Uint16(warnings) != 1 {
+			t.Errorf("terminator should have 1 warning but %v", packet)
+		}
+		if binary.LittleEndian.Uint16(status) != serverStatusAutocommit|serverStatusInTrans {
+			t.Errorf("terminator should keep server status but %v", packet)
+		}
+		if output := result.Output(); !strings.Contains(output, "Result truncated to 1 rows") ||
+			strings.Contains(output, "interrupted") {
+			t.Errorf("unexpected output %q", output)
+		}
+	}
+}
@@ -0,0 +1,214 @@
+package mysqlProxy
+
+import (
+	"strings"
+
+	"github.com/meowgen/koko/pkg/datamask"
+)
+
+const (
+	charsetUTF8   uint16 = 33
+	charsetBinary uint16 = 63
+
+	flagBinary   uint16 = 0x0080
+	flagZeroFill uint16 = 0x0040
+	flagNum      uint16 = 0x8000
+
+	maskedColumnLength uint32 = 1024
+)
+
+// isStringColumn 判断列的值在 text 和 binary protocol 中都是 length encoded string
+func isStringColumn(column *ColumnDefinition) bool {
+	switch column.Type {
+	case fieldTypeVarChar, fieldTypeJSON, fieldTypeEnum, fieldTypeSet, fieldTypeTinyBLOB,
+		fieldTypeMediumBLOB, fieldTypeLongBLOB, fieldTypeBLOB, fieldTypeVarString, fieldTypeString:
+		return true
+	}
+	return false
+}
+
+// maskCandidates 返回语句读取的表, 用于判断表达式的列是否需要脱敏
+func (c *Connection) maskCandidates(query string) []datamask.Column {
+	if c.masker == nil || c.sqlMatcher == nil {
+		return nil
+	}
+	var candidates []datamask.Column
+	for _, stmt := range c.sqlMatcher.Classify(query) {
+		for _, target := range stmt.Targets {
+			schema, table := "", target
+			if i := strings.LastIndexByte(target, '.'); i >= 0 {
+				schema, table = target[:i], target[i+1:]
+			}
+			candidates = append(candidates, datamask.Column{Schema: schema, Table: table})
+		}
+	}
+	return candidates
+}
+
+// addMaskColumn 按列定义中的来源表和列添加脱敏计划, 列名和表名可能是别名, 不用于匹配规则.
+// 表达式和派生表的列没有来源表, 按语句读取的表判断, 无法解析的列整列脱敏
+func (r *queryResult) addMaskColumn(column *ColumnDefinition, decoded bool) bool {
+	col := datamask.Column{
+		Schema: string(column.Schema),
+		Table:  string(column.OrgTable),
+		Name:   string(column.OrgName),
+		Text:   isStringColumn(column) && column.CharacterSet != charsetBinary,
+	}
+	switch {
+	case !decoded:
+		return r.maskSet.AddUnknownColumn(col)
+	case len(column.OrgTable) == 0:
+		col.Name = string(column.Name)
+		return r.maskSet.AddDerivedColumn(col, r.candidates)
+	case len(column.OrgName) == 0:
+		col.Name = string(column.Name)
+		return r.maskSet.AddUnknownColumn(col)
+	}
+	return r.maskSet.AddColumn(col)
+}
+
+// maskColumnDefinition 把需要脱敏的非字符串列改为 VAR_STRING, 客户端按字符串解析脱敏后的值
+func maskColumnDefinition(packet []byte, column *ColumnDefinition) []byte {
+	if isStringColumn(column) {
+		return packet
+	}
+	masked := *column
+	masked.Type = fieldTypeVarString
+	masked.CharacterSet = charsetUTF8
+	masked.Flags &^= flagUnsigned | flagBinary | flagZeroFill | flagNum
+	masked.Decimals = 0
+	if masked.ColumnLength < maskedColumnLength {
+		masked.ColumnLength = maskedColumnLength
+	}
+	return encodePacket(packet[3], masked.Encode())
+}
+
+// maskRow 对结果集的一行脱敏, 返回改写后的数据包和用于命令记录的各列的值
+func (r *queryResult) maskRow(packet []byte) ([]byte, [][]byte, error) {
+	payload := packet[4:]
+	var values, raws [][]byte
+	var err error
+	if r.binary {
+		values, raws, err = splitBinaryRow(payload, r.columns)
+	} else {
+		values, err = decodeTextRow(payload, r.columnCount)
+	}
+	if err != nil {
+		return packet, nil, err
+	}
+	changed := false
+	for i, value := range values {
+		masked, ok := r.maskSet.Mask(i, value)
+		if !ok {
+			continue
+		}
+		changed = true
+		values[i] = masked
+		if r.binary {
+			raws[i] = appendLengthEncodedString(nil, masked)
+		}
+	}
+	if !changed {
+		return packet, values, nil
+	}
+	var newPayload []byte
+	if r.binary {
+		bitmapLength := (len(r.columns) + 7 + 2) / 8
+		newPayload = append(newPayload, payload[:1+bitmapLength]...)
+		for _, raw := range raws {
+			newPayload = append(newPayload, raw...)
+		}
+	} else {
+		for _, value := range values {
+			if value == nil {
+				newPayload = append(newPayload, 0xfb)
+				continue
+			}
+			newPayload = appendLengthEncodedString(newPayload, value)
+		}
+	}
+	if len(newPayload) >= maxPacketSize {
+		return packet, nil, errMalformedPacket
+	}
+	return encodePacket(packet[3], newPayload), values, nil
+}
+
+// splitBinaryRow 解析 binary protocol 的行, 返回各列的文本形式和原始的编码
+func splitBinaryRow(payload []byte, columns []*ColumnDefinition) ([][]byte, [][]byte, error) {
+	bitmapLength := (len(columns) + 7 + 2) / 8
+	if len(payload) < 1+bitmapLength || payload[0] != iOK {
+		return nil, nil, errMalformedPacket
+	}
+	nullBitmap := payload[1 : 1+bitmapLength]
+	position := 1 + bitmapLength
+	values := make([][]byte, 0, len(columns))
+	raws := make([][]byte, 0, len(columns))
+	for i, column := range columns {
+		if nullBitmap[(i+2)/8]&(1<<(uint(i+2)%8)) != 0 {
+			values = append(values, nil)
+			raws = append(raws, nil)
+			continue
+		}
+		value, _, n, err := readBinaryValue(payload[position:], column.Type, column.Flags&flagUnsigned != 0)
+		if err != nil {
+			return nil, nil, err
+		}
+		if value == nil {
+			value = []byte{}
+		}
+		values = append(values, value)
+		raws = append(raws, payload[position:position+n])
+		position += n
+	}
+	return values, raws, nil
+}
+
+// nullRow 返回所有列都为 NULL 的行, 用于无法脱敏的行
+func (r *queryResult) nullRow(packet []byte) []byte {
+	var payload []byte
+	if r.binary {
+		bitmapLength := (len(r.columns) + 7 + 2) / 8
+		payload = append(payload, iOK)
+		bitmap := make([]byte, bitmapLength)
+		for i := range r.columns {
+			bitmap[(i+2)/8] |= 1 << (uint(i+2) % 8)
+		}
+		payload = append(payload, bitmap...)
+	} else {
+		for i := 0; i < r.columnCount; i++ {
+			payload = append(payload, 0xfb)
+		}
+	}
+	return encodePacket(packet[3], payload)
+}
+
+// feedMaskedRow 对结果集的行脱敏, 无法解析的行替换为 NULL, 不把原始的值返回给客户端
+func (r *queryResult) feedMaskedRow(packet []byte) []byte {
+	if r.continuation {
+		// 超过 16MB 的行分为多个数据包, 无法改写, 丢弃之后的数据包
+		r.dropping = true
+		return r.nullRow(packet)
+	}
+	masked, values, err := r.maskRow(packet)
+	if err != nil {
+		return r.nullRow(packet)
+	}
+	if len(r.rows) < maxPreviewRows {
+		r.rows = append(r.rows, values)
+	}
+	return masked
+}
+
+// renumber 丢弃数据包之后, 调整同一响应中后续数据包的序号
+func (r *queryResult) renumber(packet []byte) []byte {
+	if r.seqShift == 0 {
+		return packet
+	}
+	packet[3] -= r.seqShift
+	return packet
+}
+
+// maskedColumns 返回所有结果集实际执行的脱敏
+func (r *queryResult) maskedColumns() []string {
+	return datamask.MergeApplied(r.masked, r.maskSet.Applied()...)
+}
@@ -0,0 +1,147 @@
+package mysqlProxy
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/meowgen/koko/pkg/datamask"
+	"github.com/meowgen/koko/pkg/sqlparser"
+)
+
+func newTestMasker(t *testing.T, content string) *datamask.Masker {
+	policies, err := datamask.ParsePolicies(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return datamask.NewMasker(policies)
+}
+
+func TestQueryResult_MaskTextResultSet(t *testing.T) {
+	result := newQueryResult([]byte("select id, name from t"), true)
+	result.masker = newTestMasker(t, "mask COLUMN t.id\npartial(1,1) COLUMN test.t.name")
+	result.Feed(buildPacket(1, 0x02))
+	id := columnDefinitionPayload("id")
+	id[len(id)-6] = fieldTypeLong
+	packet := result.Feed(buildPacket(2, id...))
+	column := &ColumnDefinition{}
+	if err := column.Decode(packet[4:]); err != nil {
+		t.Fatal(err)
+	}
+	if packet[3] != 2 || column.Type != fieldTypeVarString || column.CharacterSet != charsetUTF8 ||
+		string(column.Name) != "id" {
+		t.Errorf("unexpected masked column definition %+v", column)
+	}
+	result.Feed(buildPacket(3, columnDefinitionPayload("name")...))
+
+	packet = result.Feed(buildPacket(4, append(lenEncString("42"), lenEncString("koko")...)...))
+	row, err := decodeTextRow(packet[4:], 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if packet[3] != 4 || string(row[0]) != "******" || string(row[1]) != "k**o" {
+		t.Errorf("unexpected masked row %q", row)
+	}
+	packet = result.Feed(buildPacket(5, append(lenEncString("7"), 0xfb)...))
+	if row, _ = decodeTextRow(packet[4:], 2); row[1] != nil {
+		t.Errorf("NULL should be kept but %q", row[1])
+	}
+	result.Feed(buildPacket(6, 0xfe, 0x00, 0x00, 0x22, 0x00, 0x00, 0x00))
+	if !result.Done() {
+		t.Fatal("result should be done")
+	}
+	if output := result.Output(); strings.Contains(output, "koko") || !strings.Contains(output, "| ****** | k**o |") {
+		t.Errorf("unexpected result table %q", output)
+	}
+	expected := []string{"test.t.id: mask", "test.t.name: partial(1,1)"}
+	if masked := result.maskedColumns(); !reflect.DeepEqual(masked, expected) {
+		t.Errorf("masked columns should be %v but %v", expected, masked)
+	}
+}
+
+func TestQueryResult_MaskBinaryResultSet(t *testing.T) {
+	result := newExecuteResult([]byte("select id, name from t"), true)
+	result.masker = newTestMasker(t, "hash COLUMN id\nmask VALUE ok")
+	result.Feed(buildPacket(1, 0x02))
+	id := columnDefinitionPayload("id")
+	id[len(id)-6] = fieldTypeLong
+	result.Feed(buildPacket(2, id...))
+	result.Feed(buildPacket(3, columnDefinitionPayload("name")...))
+	packet := result.Feed(buildPacket(4, append([]byte{0x00, 0x00, 0x2a, 0x00, 0x00, 0x00}, lenEncString("koko")...)...))
+
+	columns := []*ColumnDefinition{{Type: fieldTypeVarString}, {Type: fieldTypeVarString}}
+	row, _, err := splitBinaryRow(packet[4:], columns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash := "73475cb40a568e8da8a045ced110137e159f890ac4da883b6b17dc651b3a8049"
+	if string(row[0]) != hash || string(row[1]) != "k******o" {
+		t.Errorf("unexpected masked row %q", row)
+	}
+}
+
+func TestQueryResult_MaskLargeRow(t *testing.T) {
+	result := newQueryResult([]byte("select note from t"), true)
+	result.masker = newTestMasker(t, "mask COLUMN note")
+	result.Feed(buildPacket(1, 0x01))
+	result.Feed(buildPacket(2, columnDefinitionPayload("note")...))
+
+	payload := make([]byte, maxPacketSize)
+	payload[0], payload[1], payload[2], payload[3] = 0xfd, 0xff, 0xff, 0xff
+	packet := result.Feed(buildPacket(3, payload...))
+	if row, err := decodeTextRow(packet[4:], 1); err != nil || row[0] != nil {
+		t.Errorf("large row should be replaced by NULL but %q", row)
+	}
+	if packet = result.Feed(buildPacket(4, 0x00, 0x00)); packet != nil {
+		t.Error("continuation packet should be dropped")
+	}
+	packet = result.Feed(buildPacket(5, 0xfe, 0x00, 0x00, 0x22, 0x00, 0x00, 0x00))
+	if !result.Done() || packet[3] != 4 {
+		t.Errorf("terminator should be renumbered but %d", packet[3])
+	}
+}
+
+// sourceColumnPayload 返回指定别名和来源的列定义, 表达式的来源表和列为空
+func sourceColumnPayload(table, orgTable, name, orgName string) []byte {
+	var payload []byte
+	for _, s := range []string{"def", "shop", table, orgTable, name, orgName} {
+		payload = append(payload, lenEncString(s)...)
+	}
+	payload = append(payload, 0x0c, 0x21, 0x00, 0xff, 0x00, 0x00, 0x00, 0xfd, 0x00, 0x00, 0x00, 0x00, 0x00)
+	return payload
+}
+
+func TestQueryResult_MaskAliasAndExpression(t *testing.T) {
+	tests := []struct {
+		name   string
+		query  string
+		column []byte
+		masked bool
+	}{
+		{"alias", "select phone as p from users u", sourceColumnPayload("u", "users", "p", "phone"), true},
+		{"other column", "select name from users", sourceColumnPayload("users", "users", "name", "name"), false},
+		{"concat", "select concat(phone, '') from users", sourceColumnPayload("", "", "concat(phone, '')", ""), true},
+		{"lower", "select lower(phone) as x from users", sourceColumnPayload("", "", "x", ""), true},
+		{"derived table", "select p from (select phone p from users) t", sourceColumnPayload("t", "", "p", ""), true},
+		{"expression without table", "select '13800138000' as phone2", sourceColumnPayload("", "", "phone2", ""), false},
+		{"malformed column", "select phone from users", []byte{0x01}, true},
+	}
+	for _, tt := range tests {
+		c := &Connection{
+			masker:     newTestMasker(t, "partial(3,4) COLUMN *.users.phone"),
+			sqlMatcher: sqlparser.NewMatcher(sqlparser.DialectMySQL, "shop"),
+		}
+		result := newQueryResult([]byte(tt.query), true)
+		c.beginResult(result)
+		result.Feed(buildPacket(1, 0x01))
+		result.Feed(buildPacket(2, tt.column...))
+		packet := result.Feed(buildPacket(3, lenEncString("13800138000")...))
+		row, err := decodeTextRow(packet[4:], 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if masked := string(row[0]) != "13800138000"; masked != tt.masked {
+			t.Errorf("%s: column masked = %v, want %v (%q)", tt.name, masked, tt.masked, row[0])
+		}
+	}
+}
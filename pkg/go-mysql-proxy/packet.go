@@ -0,0 +1,213 @@
+package mysqlProxy
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+var errMalformedPacket = errors.New("malformed packet")
+
+/*
+Length encoded integer and string
+https://dev.mysql.com/doc/internals/en/integer.html#packet-Protocol::LengthEncodedInteger
+*/
+
+func readLengthEncodedInteger(b []byte) (num uint64, isNull bool, n int) {
+	if len(b) == 0 {
+		return 0, true, 0
+	}
+	switch b[0] {
+	case 0xfb:
+		return 0, true, 1
+	case 0xfc:
+		if len(b) < 3 {
+			return 0, true, len(b)
+		}
+		return uint64(binary.LittleEndian.Uint16(b[1:3])), false, 3
+	case 0xfd:
+		if len(b) < 4 {
+			return 0, true, len(b)
+		}
+		return uint64(b[1]) | uint64(b[2])<<8 | uint64(b[3])<<16, false, 4
+	case 0xfe:
+		if len(b) < 9 {
+			return 0, true, len(b)
+		}
+		return binary.LittleEndian.Uint64(b[1:9]), false, 9
+	}
+	return uint64(b[0]), false, 1
+}
+
+func readLengthEncodedString(b []byte) ([]byte, bool, int, error) {
+	num, isNull, n := readLengthEncodedInteger(b)
+	if num < 1 {
+		return b[n:n], isNull, n, nil
+	}
+	end := uint64(n) + num
+	if end > uint64(len(b)) {
+		return nil, false, len(b), errMalformedPacket
+	}
+	return b[n:end], false, int(end), nil
+}
+
+/*
+OkPacket represents OK packet sent by MySQL Server
+https://dev.mysql.com/doc/internals/en/packet-OK_Packet.html
+*/
+type OkPacket struct {
+	AffectedRows uint64
+	LastInsertId uint64
+	StatusFlags  uint16
+	Warnings     uint16
+	Info         []byte
+}
+
+func (r *OkPacket) Decode(payload []byte) error {
+	if len(payload) < 1 || (payload[0] != iOK && payload[0] != iEOF) {
+		return errMalformedPacket
+	}
+	position := 1
+	var n int
+	r.AffectedRows, _, n = readLengthEncodedInteger(payload[position:])
+	position += n
+	r.LastInsertId, _, n = readLengthEncodedInteger(payload[position:])
+	position += n
+	if len(payload) < position+4 {
+		return nil
+	}
+	r.StatusFlags = binary.LittleEndian.Uint16(payload[position : position+2])
+	r.Warnings = binary.LittleEndian.Uint16(payload[position+2 : position+4])
+	position += 4
+	r.Info = payload[position:]
+	return nil
+}
+
+/*
+EOFPacket represents EOF packet sent by MySQL Server
+https://dev.mysql.com/doc/internals/en/packet-EOF_Packet.html
+*/
+type EOFPacket struct {
+	Warnings    uint16
+	StatusFlags uint16
+}
+
+func (r *EOFPacket) Decode(payload []byte) error {
+	if len(payload) < 1 || payload[0] != iEOF {
+		return errMalformedPacket
+	}
+	if len(payload) >= 5 {
+		r.Warnings = binary.LittleEndian.Uint16(payload[1:3])
+		r.StatusFlags = binary.LittleEndian.Uint16(payload[3:5])
+	}
+	return nil
+}
+
+// Decode decodes the ERR packet payload sent by MySQL Server
+func (r *ErrPacket) Decode(payload []byte) error {
+	if len(payload) < 3 || payload[0] != iERR {
+		return errMalformedPacket
+	}
+	r.ErrorCode = binary.LittleEndian.Uint16(payload[1:3])
+	position := 3
+	if len(payload) >= position+6 && payload[position] == '#' {
+		r.SQLState = string(payload[position+1 : position+6])
+		position += 6
+	}
+	r.ErrorMessage = string(payload[position:])
+	return nil
+}
+
+/*
+ColumnDefinition represents Protocol::ColumnDefinition41
+https://dev.mysql.com/doc/internals/en/com-query-response.html#packet-Protocol::ColumnDefinition41
+*/
+type ColumnDefinition struct {
+	Catalog      []byte
+	Schema       []byte
+	Table        []byte
+	OrgTable     []byte
+	Name         []byte
+	OrgName      []byte
+	CharacterSet uint16
+	ColumnLength uint32
+	Type         byte
+	Flags        uint16
+	Decimals     byte
+}
+
+func (r *ColumnDefinition) Decode(payload []byte) error {
+	position := 0
+	fields := []*[]byte{&r.Catalog, &r.Schema, &r.Table, &r.OrgTable, &r.Name, &r.OrgName}
+	for _, field := range fields {
+		value, _, n, err := readLengthEncodedString(payload[position:])
+		if err != nil {
+			return err
+		}
+		*field = value
+		position += n
+	}
+	// length of fixed-length fields [0c]
+	_, _, n := readLengthEncodedInteger(payload[position:])
+	position += n
+	if len(payload) < position+10 {
+		return errMalformedPacket
+	}
+	r.CharacterSet = binary.LittleEndian.Uint16(payload[position : position+2])
+	r.ColumnLength = binary.LittleEndian.Uint32(payload[position+2 : position+6])
+	r.Type = payload[position+6]
+	r.Flags = binary.LittleEndian.Uint16(payload[position+7 : position+9])
+	r.Decimals = payload[position+9]
+	return nil
+}
+
+// decodeTextRow decodes a ProtocolText::ResultsetRow, NULL values are returned as nil
+func decodeTextRow(payload []byte, columnCount int) ([][]byte, error) {
+	row := make([][]byte, 0, columnCount)
+	position := 0
+	for i := 0; i < columnCount; i++ {
+		value, isNull, n, err := readLengthEncodedString(payload[position:])
+		if err != nil {
+			return row, err
+		}
+		if isNull {
+			value = nil
+		} else if value == nil {
+			value = []byte{}
+		}
+		row = append(row, value)
+		position += n
+	}
+	return row, nil
+}
+
+func appendLengthEncodedInteger(b []byte, n uint64) []byte {
+	switch {
+	case n <= 250:
+		return append(b, byte(n))
+	case n <= 0xffff:
+		return append(b, 0xfc, byte(n), byte(n>>8))
+	case n <= 0xffffff:
+		return append(b, 0xfd, byte(n), byte(n>>8), byte(n>>16))
+	}
+	return append(b, 0xfe, byte(n), byte(n>>8), byte(n>>16), byte(n>>24),
+		byte(n>>32), byte(n>>40), byte(n>>48), byte(n>>56))
+}
+
+// Encode encodes the payload of a ColumnDefinition41 packet
+func (r *ColumnDefinition) Encode() []byte {
+	var payload []byte
+	for _, field := range [][]byte{r.Catalog, r.Schema, r.Table, r.OrgTable, r.Name, r.OrgName} {
+		payload = appendLengthEncodedString(payload, field)
+	}
+	payload = append(payload, 0x0c)
+	payload = append(payload, byte(r.CharacterSet), byte(r.CharacterSet>>8))
+	payload = append(payload, byte(r.ColumnLength), byte(r.ColumnLength>>8),
+		byte(r.ColumnLength>>16), byte(r.ColumnLength>>24))
+	payload = append(payload, r.Type, byte(r.Flags), byte(r.Flags>>8), r.Decimals, 0x00, 0x00)
+	return payload
+}
+
+func appendLengthEncodedString(b []byte, s []byte) []byte {
+	b = appendLengthEncodedInteger(b, uint64(len(s)))
+	return append(b, s...)
+}
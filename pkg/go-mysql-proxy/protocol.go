@@ -6,6 +6,7 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"io"
 	"math/rand"
 	"net"
 	"time"
@@ -93,13 +94,17 @@ func (r *FakeHandshakePacket) NewHandshakePacket(connID []byte) error {
 	rand.Read(salt)
 	r.Salt = []byte(randStringRunes(8))
 
-	r.ServerCapabilities = []byte{0xff, 0xf7}
+	// clientCompress is not advertised, the proxy parses plain packets only.
+	// clientSSL is advertised by EnableSSL
+	r.ServerCapabilities = []byte{0xdf, 0xf7}
 
 	r.ServerLanguage = byte(0xff)
 
 	r.ServerStatus = []byte{0x02, 0x00}
 
-	r.ExtendedServerCapabilities = []byte{0xff, 0xdf}
+	// only clientMultiStatements to clientDeprecateEOF, the proxy can not parse packets of
+	// optional resultset metadata, zstd compression, query attributes or multi factor auth
+	r.ExtendedServerCapabilities = []byte{0xff, 0x01}
 
 	r.AuthenticationPluginLength = byte(0x15)
 
@@ -114,6 +119,20 @@ func (r *FakeHandshakePacket) NewHandshakePacket(connID []byte) error {
 	return nil
 }
 
+// EnableSSL advertises clientSSL, so that the client can upgrade the connection
+func (r *FakeHandshakePacket) EnableSSL() {
+	r.ServerCapabilities[1] |= byte(clientSSL >> 8)
+}
+
+// CapabilityFlags 返回向客户端声明的全部 capability flags
+func (r *FakeHandshakePacket) CapabilityFlags() CapabilityFlag {
+	if len(r.ServerCapabilities) < 2 || len(r.ExtendedServerCapabilities) < 2 {
+		return 0
+	}
+	return CapabilityFlag(binary.LittleEndian.Uint16(r.ServerCapabilities)) |
+		CapabilityFlag(binary.LittleEndian.Uint16(r.ExtendedServerCapabilities))<<16
+}
+
 func (r *FakeHandshakePacket) Encode() ([]byte, error) {
 	buf := make([]byte, 0)
 	buf = append(buf, r.Protocol)
@@ -159,6 +178,39 @@ func (r *FakeHandshakePacket) Encode() ([]byte, error) {
 	return newBuf, nil
 }
 
+// readPacket reads one whole packet, header included, from the connection
+func readPacket(r io.Reader) ([]byte, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	length := uint32(header[0]) | uint32(header[1])<<8 | uint32(header[2])<<16
+	data := make([]byte, 4+length)
+	copy(data, header)
+	if _, err := io.ReadFull(r, data[4:]); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// joinPackets 把一条超过最大长度的命令的多个数据包拼接为一个包, 使用最后一个包的序号,
+// 拒绝命令时返回的 ERR 包在其后编号. 长度字段不再有意义, 只用于解析命令
+func joinPackets(packets [][]byte) []byte {
+	if len(packets) == 1 {
+		return packets[0]
+	}
+	size := 4
+	for _, packet := range packets {
+		size += len(packet) - 4
+	}
+	command := make([]byte, 4, size)
+	copy(command, packets[len(packets)-1][:4])
+	for _, packet := range packets {
+		command = append(command, packet[4:]...)
+	}
+	return command
+}
+
 /*
 InitialHandshakePacket represents initial handshake packet sent by MySQL Server
 */
@@ -176,104 +228,193 @@ type InitialHandshakePacket struct {
 	header            *PacketHeader
 }
 
+/*
+AuthorizationPacket represents Protocol::HandshakeResponse41 sent by the client
+https://dev.mysql.com/doc/internals/en/connection-phase-packets.html#packet-Protocol::HandshakeResponse41
+*/
 type AuthorizationPacket struct {
-	header      *PacketHeader
-	PacketPart1 []byte
-	Username    []byte
-	Password    []byte
-	CapData     []byte
-	CapData2    []byte
-	PacketPart2 []byte
+	header         *PacketHeader
+	PacketPart1    []byte
+	Username       []byte
+	Password       []byte
+	Database       []byte
+	AuthPluginName []byte
+	ConnectAttrs   []byte
 }
 
 func (r *AuthorizationPacket) Decode(conn net.Conn) error {
-
-	data := make([]byte, 1024)
-	_, err := conn.Read(data)
+	data, err := readPacket(conn)
 	if err != nil {
 		return err
 	}
+	return r.DecodePacket(data)
+}
 
+// DecodePacket decodes the handshake response packet already read from the client
+func (r *AuthorizationPacket) DecodePacket(data []byte) error {
+	if len(data) < 4 {
+		return errMalformedPacket
+	}
 	header := &PacketHeader{}
 	ln := []byte{data[0], data[1], data[2], 0x00}
 	header.Length = binary.LittleEndian.Uint32(ln)
 	header.SequenceId = data[3]
 	r.header = header
+	if int(header.Length)+4 > len(data) || header.Length < 32 {
+		return errors.New("malformed handshake response packet")
+	}
 
 	payload := data[4 : header.Length+4]
 
-	position := 0
-
-	r.PacketPart1 = payload[position : position+32]
+	/*
+		4 capability flags, 4 max-packet size, 1 character set, 23 reserved
+	*/
+	r.PacketPart1 = payload[:32]
+	position := 32
+	flags := r.CapabilityFlags()
 
-	position += 32
+	index := bytes.IndexByte(payload[position:], 0x00)
+	if index == -1 {
+		return errors.New("malformed handshake response packet")
+	}
+	r.Username = payload[position : position+index]
+	position += index + 1
 
-	for _, element := range payload[position:] {
-		r.Username = append(r.Username, element)
-		if element == 0x00 {
-			break
+	/*
+		auth-response is length encoded with clientPluginAuthLenEncClientData,
+		1 byte length prefixed with clientSecureConn, otherwise NUL-terminated
+	*/
+	switch {
+	case flags.Has(clientPluginAuthLenEncClientData):
+		value, _, n, err := readLengthEncodedString(payload[position:])
+		if err != nil {
+			return err
+		}
+		r.Password = value
+		position += n
+	case flags.Has(clientSecureConn):
+		if position >= len(payload) {
+			return errors.New("malformed handshake response packet")
+		}
+		end := position + 1 + int(payload[position])
+		if end > len(payload) {
+			return errors.New("malformed handshake response packet")
 		}
+		r.Password = payload[position+1 : end]
+		position = end
+	default:
+		index = bytes.IndexByte(payload[position:], 0x00)
+		if index == -1 {
+			return errors.New("malformed handshake response packet")
+		}
+		r.Password = payload[position : position+index]
+		position += index + 1
 	}
 
-	position += len(r.Username) + 1
-
-	r.Password = payload[position : position+20]
+	if flags.Has(clientConnectWithDB) && position < len(payload) {
+		r.Database, position = readNullTerminatedString(payload, position)
+	}
+	if flags.Has(clientPluginAuth) && position < len(payload) {
+		r.AuthPluginName, position = readNullTerminatedString(payload, position)
+	}
+	if flags.Has(clientConnectAttrs) && position < len(payload) {
+		r.ConnectAttrs = payload[position:]
+	}
+	return nil
+}
 
-	position += 20
+// readNullTerminatedString reads string[NUL], the string is allowed to miss the terminator at the end of payload
+func readNullTerminatedString(payload []byte, position int) ([]byte, int) {
+	index := bytes.IndexByte(payload[position:], 0x00)
+	if index == -1 {
+		return payload[position:], len(payload)
+	}
+	return payload[position : position+index], position + index + 1
+}
 
-	for _, element := range payload[position:] {
-		r.CapData = append(r.CapData, element)
-		if element == 0x00 {
-			break
-		}
+// CapabilityFlags returns the capability flags sent by the client
+func (r *AuthorizationPacket) CapabilityFlags() CapabilityFlag {
+	if len(r.PacketPart1) < 4 {
+		return 0
 	}
+	return CapabilityFlag(binary.LittleEndian.Uint32(r.PacketPart1[:4]))
+}
 
-	position += len(r.CapData)
+func (r *AuthorizationPacket) SetCapabilityFlags(flags CapabilityFlag) {
+	if len(r.PacketPart1) < 4 {
+		return
+	}
+	binary.LittleEndian.PutUint32(r.PacketPart1[:4], uint32(flags))
+}
 
-	r.PacketPart2 = payload[position:]
+func (r *AuthorizationPacket) SequenceId() uint8 {
+	return r.header.SequenceId
+}
 
-	//fmt.Printf("\n\n--------------------------Decode--------------------------\n\n")
-	//dumpByteSlice(data[:header.Length+4])
+func (r *AuthorizationPacket) SetSequenceId(sequenceId uint8) {
+	r.header.SequenceId = sequenceId
+}
 
-	return nil
+// SSLRequest returns the SSLRequest packet to be sent before this handshake response
+func (r *AuthorizationPacket) SSLRequest(sequenceId uint8) *SSLRequestPacket {
+	req := &SSLRequestPacket{
+		header:          &PacketHeader{Length: sslRequestPayloadLength, SequenceId: sequenceId},
+		CapabilityFlags: r.CapabilityFlags() | clientSSL,
+	}
+	if len(r.PacketPart1) >= 9 {
+		req.MaxPacketSize = binary.LittleEndian.Uint32(r.PacketPart1[4:8])
+		req.CharacterSet = r.PacketPart1[8]
+	}
+	return req
 }
 
 func (r AuthorizationPacket) Encode() ([]byte, error) {
+	flags := r.CapabilityFlags()
 	buf := make([]byte, 0)
 	buf = append(buf, r.PacketPart1...)
 	buf = append(buf, r.Username...)
 	buf = append(buf, 0x00)
-	buf = append(buf, byte(len(r.Password)))
-	buf = append(buf, r.Password...)
-	buf = append(buf, r.CapData...)
-	buf = append(buf, r.PacketPart2...)
-
-	h := PacketHeader{
-		Length:     uint32(len(buf)),
-		SequenceId: r.header.SequenceId,
+	switch {
+	case flags.Has(clientPluginAuthLenEncClientData):
+		buf = appendLengthEncodedInteger(buf, uint64(len(r.Password)))
+		buf = append(buf, r.Password...)
+	case flags.Has(clientSecureConn):
+		if len(r.Password) > 0xff {
+			return nil, errors.New("auth response too long")
+		}
+		buf = append(buf, byte(len(r.Password)))
+		buf = append(buf, r.Password...)
+	default:
+		buf = append(buf, r.Password...)
+		buf = append(buf, 0x00)
+	}
+	if flags.Has(clientConnectWithDB) {
+		buf = append(buf, r.Database...)
+		buf = append(buf, 0x00)
+	}
+	if flags.Has(clientPluginAuth) {
+		buf = append(buf, r.AuthPluginName...)
+		buf = append(buf, 0x00)
+	}
+	if flags.Has(clientConnectAttrs) {
+		buf = append(buf, r.ConnectAttrs...)
 	}
 
-	newBuf := make([]byte, 0, h.Length+4)
-
-	ln := make([]byte, 4)
-	binary.LittleEndian.PutUint32(ln, h.Length)
-
-	newBuf = append(newBuf, ln[:3]...)
-	newBuf = append(newBuf, h.SequenceId)
-	newBuf = append(newBuf, buf...)
-
-	//fmt.Printf("\n\n--------------------------Encode--------------------------\n\n")
-	//dumpByteSlice(newBuf)
-
-	return newBuf, nil
+	return encodePacket(r.header.SequenceId, buf), nil
+}
 
+// encodePacket prepends the packet header to the payload
+func encodePacket(sequenceId uint8, payload []byte) []byte {
+	ln := len(payload)
+	buf := make([]byte, 0, ln+4)
+	buf = append(buf, byte(ln), byte(ln>>8), byte(ln>>16), sequenceId)
+	return append(buf, payload...)
 }
 
 // Decode decodes the first packet received from the MySQl Server
 // It's a handshake packet
 func (r *InitialHandshakePacket) Decode(conn net.Conn) error {
-	data := make([]byte, 1024)
-	_, err := conn.Read(data)
+	data, err := readPacket(conn)
 	if err != nil {
 		return err
 	}
@@ -452,6 +593,55 @@ func (r InitialHandshakePacket) String() string {
 	return r.CapabilitiesFlags.String()
 }
 
+/*
+ErrPacket represents ERR packet sent to the client
+https://dev.mysql.com/doc/internals/en/packet-ERR_Packet.html
+*/
+type ErrPacket struct {
+	header       *PacketHeader
+	ErrorCode    uint16
+	SQLState     string
+	ErrorMessage string
+}
+
+func NewErrPacket(sequenceId uint8, code uint16, sqlState, msg string) *ErrPacket {
+	return &ErrPacket{
+		header:       &PacketHeader{SequenceId: sequenceId},
+		ErrorCode:    code,
+		SQLState:     sqlState,
+		ErrorMessage: msg,
+	}
+}
+
+// Encode encodes the ErrPacket to bytes, clientProtocol41 format
+func (r *ErrPacket) Encode() ([]byte, error) {
+	buf := make([]byte, 0, 9+len(r.ErrorMessage))
+	buf = append(buf, iERR)
+	code := make([]byte, 2)
+	binary.LittleEndian.PutUint16(code, r.ErrorCode)
+	buf = append(buf, code...)
+	buf = append(buf, '#')
+	sqlState := make([]byte, 5)
+	copy(sqlState, r.SQLState)
+	buf = append(buf, sqlState...)
+	buf = append(buf, r.ErrorMessage...)
+	if len(buf) > maxPacketSize {
+		return nil, errors.New("err packet too large")
+	}
+
+	r.header.Length = uint32(len(buf))
+	newBuf := make([]byte, 0, r.header.Length+4)
+
+	ln := make([]byte, 4)
+	binary.LittleEndian.PutUint32(ln, r.header.Length)
+
+	newBuf = append(newBuf, ln[:3]...)
+	newBuf = append(newBuf, r.header.SequenceId)
+	newBuf = append(newBuf, buf...)
+
+	return newBuf, nil
+}
+
 func ScramblePassword(scramble []byte, password string) []byte {
 	if len(password) == 0 {
 		return nil
@@ -0,0 +1,83 @@
+package mysqlProxy
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestErrPacket_Encode(t *testing.T) {
+	p := NewErrPacket(1, ErrCodeAccessDenied, SQLStateAccessDenied, "denied")
+	data, err := p.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []byte{0x0f, 0x00, 0x00, 0x01, 0xff, 0xcb, 0x04, '#', '4', '2', '0', '0', '0',
+		'd', 'e', 'n', 'i', 'e', 'd'}
+	if !bytes.Equal(data, expected) {
+		t.Errorf("err packet should be %v but %v", expected, data)
+	}
+}
+
+func TestReadPacket(t *testing.T) {
+	stream := []byte{0x03, 0x00, 0x00, 0x00, ComQuery, 'a', 'b', 0x01, 0x00, 0x00, 0x01, ComQuit}
+	r := bytes.NewReader(stream)
+	packet, err := readPacket(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(packet, stream[:7]) {
+		t.Errorf("first packet should be %v but %v", stream[:7], packet)
+	}
+	packet, err = readPacket(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if getPacketType(packet) != ComQuit || getSequenceID(packet) != 1 {
+		t.Errorf("second packet should be COM_QUIT but %v", packet)
+	}
+	if _, err = readPacket(r); err == nil {
+		t.Error("read from empty stream should fail")
+	}
+}
+
+func TestSSLRequestPacket(t *testing.T) {
+	authPacket := &AuthorizationPacket{
+		PacketPart1: make([]byte, 32),
+	}
+	authPacket.SetCapabilityFlags(clientProtocol41 | clientSecureConn)
+	authPacket.PacketPart1[8] = 0xff
+	data, err := authPacket.SSLRequest(1).Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isSSLRequestPacket(data) {
+		t.Fatalf("packet should be ssl request: %v", data)
+	}
+	req := &SSLRequestPacket{}
+	if err = req.Decode(data); err != nil {
+		t.Fatal(err)
+	}
+	if !req.CapabilityFlags.Has(clientSSL) || req.CharacterSet != 0xff || req.header.SequenceId != 1 {
+		t.Errorf("unexpected ssl request %+v", req)
+	}
+}
+
+func TestFakeHandshakePacket_CapabilityFlags(t *testing.T) {
+	p := &FakeHandshakePacket{}
+	_ = p.NewHandshakePacket(nil)
+	flags := p.CapabilityFlags()
+	for _, flag := range []CapabilityFlag{clientProtocol41, clientPluginAuth, clientDeprecateEOF} {
+		if !flags.Has(flag) {
+			t.Errorf("handshake should advertise %s", flag)
+		}
+	}
+	for _, flag := range []CapabilityFlag{clientCompress, clientSSL, clientOptionalResultsetMetadata,
+		clientZstdCompressionAlgorithm, clientQueryAttributes} {
+		if flags.Has(flag) {
+			t.Errorf("handshake should not advertise %s", flag)
+		}
+	}
+	if unknown := flags &^ (clientDeprecateEOF<<1 - 1); unknown != 0 {
+		t.Errorf("handshake should not advertise %#x", uint32(unknown))
+	}
+}
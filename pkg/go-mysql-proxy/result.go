@@ -0,0 +1,394 @@
+package mysqlProxy
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/olekukonko/tablewriter"
+
+	"github.com/meowgen/koko/pkg/datamask"
+	"github.com/meowgen/koko/pkg/guardrail"
+)
+
+const (
+	maxPreviewRows      = 10
+	maxPreviewCellWidth = 64
+	maxOutputLength     = 4096
+
+	serverMoreResultsExists uint16 = 0x0008
+)
+
+type resultState int
+
+const (
+	stateResponse resultState = iota
+	stateColumnDefinition
+	stateColumnEOF
+	stateRows
+	stateSkip
+	stateDone
+)
+
+// queryResult 记录一条语句的执行结果, 由服务端返回的数据包逐步填充
+type queryResult struct {
+	Input     []byte
+	CreatedAt time.Time
+
+	deprecateEOF bool
+	state        resultState
+	continuation bool
+
+	// binary 结果集的行使用 binary protocol, 对应 COM_STMT_EXECUTE
+	binary bool
+	// prepare 对应 COM_STMT_PREPARE, 成功后 Statement 记录预处理的语句
+	prepare   bool
+	Statement *preparedStatement
+	skip      int
+	// cursor 表示 COM_STMT_EXECUTE 打开了游标, 结果集由之后的 COM_STMT_FETCH 返回
+	cursor bool
+	// fetch 对应 COM_STMT_FETCH, 使用执行时的列定义, 不单独记录命令
+	fetch bool
+
+	columnCount int
+	columns     []*ColumnDefinition
+	rows        [][][]byte
+	rowCount    int
+
+	// masker 不为空时对结果集脱敏, maskSet 是当前结果集的脱敏计划, candidates 是语句读取的表
+	masker     *datamask.Masker
+	maskSet    *datamask.ResultSet
+	masked     []string
+	candidates []datamask.Column
+	// localInfile 表示服务端返回了 LOCAL INFILE Request, 客户端之后发送的是文件内容
+	localInfile bool
+
+	// 无法脱敏的超长行被替换为 NULL, 之后的数据包需要调整序号
+	dropping bool
+	seqShift uint8
+
+	// guard 是会话的查询限制, 超过最大行数的行被丢弃, truncated 表示结果集被截断.
+	// stopQuery 在第一次截断时终止后端的语句, stopped 表示之后的 ERR 包是终止语句的结果
+	guard      guardrail.Policy
+	truncated  bool
+	stopQuery  func()
+	stopped    bool
+	timer      *time.Timer
+	violations []string
+	// status 是最后一个 OK 或 EOF 包中的服务端状态
+	status      uint16
+	statusKnown bool
+
+	outputs []string
+}
+
+func newQueryResult(input []byte, deprecateEOF bool) *queryResult {
+	return &queryResult{
+		Input:        input,
+		CreatedAt:    time.Now(),
+		deprecateEOF: deprecateEOF,
+	}
+}
+
+func newExecuteResult(input []byte, deprecateEOF bool) *queryResult {
+	result := newQueryResult(input, deprecateEOF)
+	result.binary = true
+	return result
+}
+
+// newFetchResult 使用游标的列定义解析 COM_STMT_FETCH 返回的行
+func newFetchResult(stmt *preparedStatement, deprecateEOF bool) *queryResult {
+	result := newQueryResult(nil, deprecateEOF)
+	result.binary = true
+	result.fetch = true
+	result.state = stateRows
+	result.columns = stmt.cursorColumns
+	result.columnCount = len(stmt.cursorColumns)
+	result.maskSet = stmt.cursorMask
+	return result
+}
+
+func newPrepareResult(query []byte, deprecateEOF bool) *queryResult {
+	result := newQueryResult(query, deprecateEOF)
+	result.prepare = true
+	return result
+}
+
+func (r *queryResult) Done() bool {
+	return r.state == stateDone
+}
+
+// Feed 解析一个服务端数据包, 语句的所有结果都返回后进入完成状态;
+// 返回转发给客户端的数据包, 结果集脱敏时可能被改写, 为空时不转发
+func (r *queryResult) Feed(packet []byte) []byte {
+	if r.state == stateDone || len(packet) < 5 {
+		return packet
+	}
+	payload := packet[4:]
+	continuation := r.continuation
+	r.continuation = len(payload) == maxPacketSize
+	if continuation {
+		if r.dropping {
+			r.dropping = r.continuation
+			r.seqShift++
+			return nil
+		}
+		return r.renumber(packet)
+	}
+	packet = r.renumber(packet)
+	switch r.state {
+	case stateResponse:
+		switch payload[0] {
+		case iOK:
+			if r.prepare {
+				r.feedPrepareOk(payload)
+				return packet
+			}
+			ok := OkPacket{}
+			if err := ok.Decode(payload); err != nil {
+				r.finish(0)
+				return packet
+			}
+			r.outputs = append(r.outputs, formatOkPacket(&ok))
+			r.trackStatus(ok.StatusFlags)
+			r.finish(ok.StatusFlags)
+		case iERR:
+			errPacket := ErrPacket{}
+			_ = errPacket.Decode(payload)
+			r.outputs = append(r.outputs, formatErrPacket(&errPacket))
+			r.finish(0)
+		case 0xfb:
+			// LOCAL INFILE Request, 后续由客户端发送文件内容
+			r.outputs = append(r.outputs, "LOCAL INFILE request")
+			r.localInfile = true
+			r.state = stateDone
+		default:
+			num, _, _ := readLengthEncodedInteger(payload)
+			r.columnCount = int(num)
+			r.columns = make([]*ColumnDefinition, 0, r.columnCount)
+			r.rows = nil
+			r.rowCount = 0
+			r.truncated = false
+			r.masked = r.maskedColumns()
+			r.maskSet = r.masker.NewResultSet()
+			r.state = stateColumnDefinition
+		}
+	case stateColumnDefinition:
+		column := &ColumnDefinition{}
+		err := column.Decode(payload)
+		if err != nil {
+			column = &ColumnDefinition{Name: []byte("?")}
+		}
+		if r.addMaskColumn(column, err == nil) && err == nil {
+			packet = maskColumnDefinition(packet, column)
+		}
+		r.columns = append(r.columns, column)
+		if len(r.columns) >= r.columnCount {
+			if r.deprecateEOF {
+				r.state = stateRows
+			} else {
+				r.state = stateColumnEOF
+			}
+		}
+	case stateColumnEOF:
+		eof := EOFPacket{}
+		if err := eof.Decode(payload); err == nil && eof.StatusFlags&serverStatusCursorExists != 0 {
+			// 使用游标时结果集由 COM_STMT_FETCH 返回
+			r.cursor = true
+			r.state = stateDone
+			return packet
+		}
+		r.state = stateRows
+	case stateSkip:
+		r.skip--
+		if r.skip <= 0 {
+			r.state = stateDone
+		}
+	case stateRows:
+		if isResultSetTerminator(payload, r.deprecateEOF) {
+			var status uint16
+			if r.deprecateEOF {
+				ok := OkPacket{}
+				_ = ok.Decode(payload)
+				status = ok.StatusFlags
+			} else {
+				eof := EOFPacket{}
+				_ = eof.Decode(payload)
+				status = eof.StatusFlags
+			}
+			r.outputs = append(r.outputs, r.formatResultSet())
+			if r.truncated {
+				packet = r.truncatedTerminator(packet)
+			}
+			r.trackStatus(status)
+			r.finish(status)
+			return packet
+		}
+		if payload[0] == iERR {
+			errPacket := ErrPacket{}
+			_ = errPacket.Decode(payload)
+			if r.stopped && errPacket.ErrorCode == errQueryInterrupted {
+				// 超过最大行数后终止了语句, 按截断的结果集返回
+				r.outputs = append(r.outputs, r.formatResultSet())
+				packet = r.truncatedTerminator(r.interruptedTerminator(packet))
+				r.finish(0)
+				return packet
+			}
+			r.outputs = append(r.outputs, r.formatResultSet(), formatErrPacket(&errPacket))
+			r.finish(0)
+			return packet
+		}
+		r.rowCount++
+		if r.truncateRow() {
+			return nil
+		}
+		if r.maskSet.Active() {
+			return r.feedMaskedRow(packet)
+		}
+		if len(r.rows) < maxPreviewRows {
+			var row [][]byte
+			var err error
+			if r.binary {
+				row, err = decodeBinaryRow(payload, r.columns)
+			} else {
+				row, err = decodeTextRow(payload, r.columnCount)
+			}
+			if err == nil {
+				r.rows = append(r.rows, row)
+			}
+		}
+	}
+	return packet
+}
+
+// feedPrepareOk 记录预处理的语句, 并跳过随后的参数和列定义
+func (r *queryResult) feedPrepareOk(payload []byte) {
+	ok := StmtPrepareOkPacket{}
+	if err := ok.Decode(payload); err != nil {
+		r.state = stateDone
+		return
+	}
+	r.Statement = &preparedStatement{
+		ID:         ok.StatementId,
+		Query:      r.Input,
+		ParamCount: int(ok.ParamCount),
+	}
+	for _, count := range []uint16{ok.ParamCount, ok.ColumnCount} {
+		if count == 0 {
+			continue
+		}
+		r.skip += int(count)
+		if !r.deprecateEOF {
+			r.skip++
+		}
+	}
+	if r.skip == 0 {
+		r.state = stateDone
+		return
+	}
+	r.state = stateSkip
+}
+
+func (r *queryResult) finish(status uint16) {
+	if status&serverMoreResultsExists != 0 {
+		r.state = stateResponse
+		return
+	}
+	r.state = stateDone
+}
+
+// Output 返回用于命令记录的结果摘要
+func (r *queryResult) Output() string {
+	output := strings.Join(r.outputs, "\r\n")
+	if len(output) > maxOutputLength {
+		output = truncateString(output, maxOutputLength) + "..."
+	}
+	return output
+}
+
+func isResultSetTerminator(payload []byte, deprecateEOF bool) bool {
+	if payload[0] != iEOF {
+		return false
+	}
+	if deprecateEOF {
+		return len(payload) < maxPacketSize
+	}
+	return len(payload) < 9
+}
+
+func formatOkPacket(ok *OkPacket) string {
+	rowWord := "rows"
+	if ok.AffectedRows == 1 {
+		rowWord = "row"
+	}
+	output := fmt.Sprintf("Query OK, %d %s affected", ok.AffectedRows, rowWord)
+	if ok.Warnings > 0 {
+		output += fmt.Sprintf(", %d warning(s)", ok.Warnings)
+	}
+	if len(ok.Info) > 0 {
+		output += "\r\n" + string(ok.Info)
+	}
+	return output
+}
+
+func formatErrPacket(errPacket *ErrPacket) string {
+	if errPacket.SQLState == "" {
+		return fmt.Sprintf("ERROR %d: %s", errPacket.ErrorCode, errPacket.ErrorMessage)
+	}
+	return fmt.Sprintf("ERROR %d (%s): %s", errPacket.ErrorCode, errPacket.SQLState,
+		errPacket.ErrorMessage)
+}
+
+// formatResultSet 以 mysql 命令行的格式输出结果集预览
+func (r *queryResult) formatResultSet() string {
+	var buf bytes.Buffer
+	if r.rowCount == 0 {
+		return "Empty set"
+	}
+	table := tablewriter.NewWriter(&buf)
+	table.SetAutoFormatHeaders(false)
+	table.SetAutoWrapText(false)
+	table.SetAlignment(tablewriter.ALIGN_LEFT)
+	table.SetHeaderAlignment(tablewriter.ALIGN_LEFT)
+	table.SetNewLine("\r\n")
+	header := make([]string, 0, len(r.columns))
+	for _, column := range r.columns {
+		header = append(header, string(column.Name))
+	}
+	table.SetHeader(header)
+	for _, row := range r.rows {
+		cells := make([]string, 0, len(row))
+		for _, value := range row {
+			if value == nil {
+				cells = append(cells, "NULL")
+				continue
+			}
+			cells = append(cells, truncateString(string(value), maxPreviewCellWidth))
+		}
+		table.Append(cells)
+	}
+	table.Render()
+	rowWord := "rows"
+	if r.rowCount == 1 {
+		rowWord = "row"
+	}
+	if r.rowCount > len(r.rows) {
+		buf.WriteString(fmt.Sprintf("%d %s in set (%d shown)", r.rowCount, rowWord, len(r.rows)))
+	} else {
+		buf.WriteString(fmt.Sprintf("%d %s in set", r.rowCount, rowWord))
+	}
+	return buf.String()
+}
+
+func truncateString(s string, length int) string {
+	if len(s) <= length {
+		return s
+	}
+	s = s[:length]
+	for len(s) > 0 && !utf8.ValidString(s) {
+		s = s[:len(s)-1]
+	}
+	return s
+}
@@ -0,0 +1,112 @@
+package mysqlProxy
+
+import (
+	"strings"
+	"testing"
+)
+
+func buildPacket(seq uint8, payload ...byte) []byte {
+	ln := len(payload)
+	return append([]byte{byte(ln), byte(ln >> 8), byte(ln >> 16), seq}, payload...)
+}
+
+func lenEncString(s string) []byte {
+	return append([]byte{byte(len(s))}, s...)
+}
+
+func columnDefinitionPayload(name string) []byte {
+	var payload []byte
+	for _, s := range []string{"def", "test", "t", "t", name, name} {
+		payload = append(payload, lenEncString(s)...)
+	}
+	payload = append(payload, 0x0c, 0x21, 0x00, 0xff, 0x00, 0x00, 0x00, 0xfd, 0x00, 0x00, 0x00, 0x00, 0x00)
+	return payload
+}
+
+func TestQueryResult_FeedOK(t *testing.T) {
+	result := newQueryResult([]byte("delete from t"), false)
+	result.Feed(buildPacket(1, 0x00, 0x03, 0x00, 0x02, 0x00, 0x00, 0x00))
+	if !result.Done() {
+		t.Fatal("result should be done after OK packet")
+	}
+	if output := result.Output(); output != "Query OK, 3 rows affected" {
+		t.Errorf("unexpected output %q", output)
+	}
+}
+
+func TestQueryResult_FeedErr(t *testing.T) {
+	result := newQueryResult([]byte("select * from nope"), false)
+	payload := append([]byte{0xff, 0x7a, 0x04, '#', '4', '2', 'S', '0', '2'}, "Table 'test.nope' doesn't exist"...)
+	result.Feed(buildPacket(1, payload...))
+	if !result.Done() {
+		t.Fatal("result should be done after ERR packet")
+	}
+	expected := "ERROR 1146 (42S02): Table 'test.nope' doesn't exist"
+	if output := result.Output(); output != expected {
+		t.Errorf("output should be %q but %q", expected, output)
+	}
+}
+
+func TestQueryResult_FeedResultSet(t *testing.T) {
+	for _, deprecateEOF := range []bool{false, true} {
+		result := newQueryResult([]byte("select id, name from t"), deprecateEOF)
+		seq := uint8(1)
+		result.Feed(buildPacket(seq, 0x02))
+		for _, name := range []string{"id", "name"} {
+			seq++
+			result.Feed(buildPacket(seq, columnDefinitionPayload(name)...))
+		}
+		if !deprecateEOF {
+			seq++
+			result.Feed(buildPacket(seq, 0xfe, 0x00, 0x00, 0x22, 0x00))
+		}
+		for i := 0; i < maxPreviewRows+2; i++ {
+			seq++
+			row := append(lenEncString("1"), 0xfb)
+			result.Feed(buildPacket(seq, row...))
+		}
+		if result.Done() {
+			t.Fatal("result should not be done before terminator")
+		}
+		seq++
+		if deprecateEOF {
+			result.Feed(buildPacket(seq, 0xfe, 0x00, 0x00, 0x22, 0x00, 0x00, 0x00))
+		} else {
+			result.Feed(buildPacket(seq, 0xfe, 0x00, 0x00, 0x22, 0x00))
+		}
+		if !result.Done() {
+			t.Fatal("result should be done after terminator")
+		}
+		output := result.Output()
+		if !strings.Contains(output, "| id | name |") || !strings.Contains(output, "| 1  | NULL |") {
+			t.Errorf("unexpected result table %q", output)
+		}
+		if !strings.HasSuffix(output, "12 rows in set (10 shown)") {
+			t.Errorf("unexpected result summary %q", output)
+		}
+	}
+}
+
+func TestQueryResult_MoreResults(t *testing.T) {
+	result := newQueryResult([]byte("update t set a=1; update t set a=2"), false)
+	result.Feed(buildPacket(1, 0x00, 0x01, 0x00, 0x08, 0x00, 0x00, 0x00))
+	if result.Done() {
+		t.Fatal("result should wait more results")
+	}
+	result.Feed(buildPacket(2, 0x00, 0x02, 0x00, 0x02, 0x00, 0x00, 0x00))
+	if !result.Done() {
+		t.Fatal("result should be done")
+	}
+	expected := "Query OK, 1 row affected\r\nQuery OK, 2 rows affected"
+	if output := result.Output(); output != expected {
+		t.Errorf("output should be %q but %q", expected, output)
+	}
+}
+
+func TestQueryResult_FeedLocalInfile(t *testing.T) {
+	r := newQueryResult([]byte("load data local infile 'a.csv' into table t"), true)
+	r.Feed(buildPacket(1, append([]byte{0xfb}, "a.csv"...)...))
+	if !r.Done() || !r.localInfile {
+		t.Errorf("LOCAL INFILE request should finish the result and start sending data")
+	}
+}
@@ -2,233 +2,405 @@ package mysqlProxy
 
 import (
 	"bytes"
-	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
-	"github.com/meowgen/koko/pkg/common"
-	modelCommon "github.com/meowgen/koko/pkg/jms-sdk-go/common"
-	"github.com/meowgen/koko/pkg/jms-sdk-go/model"
-	"github.com/meowgen/koko/pkg/jms-sdk-go/service"
-	"github.com/meowgen/koko/pkg/proxy"
 	"io"
-	"log"
 	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/meowgen/koko/pkg/guardrail"
+	"github.com/meowgen/koko/pkg/jms-sdk-go/service"
+	"github.com/meowgen/koko/pkg/logger"
+	"github.com/meowgen/koko/pkg/proxy"
+	"github.com/meowgen/koko/pkg/proxybase"
+	"github.com/meowgen/koko/pkg/sqlparser"
 )
 
+const dialTimeout = 15 * time.Second
+
+// upstreamRequiredFlags 改变 OK/EOF 包的格式, 客户端使用时后端也必须支持
+const upstreamRequiredFlags = clientProtocol41 | clientDeprecateEOF | clientSessionTrack
+
+// errUpstreamAuthFailed 后端登录失败, ERR 包已经转发给客户端
+var errUpstreamAuthFailed = errors.New("upstream auth failed")
+
+const proxyName = "MySQL"
+
 type FakeServer struct {
-	Conn        net.Conn
-	JmsService  *service.JMService
-	Host        string
-	Port        int
-	Username    string
-	Password    string
-	CurrSession *CurrSession
-	Token       *service.TokenAuthInfoResponse
-}
+	*proxybase.Server
+	JmsService *service.JMService
+
+	// TLSConfig 不为空时允许客户端使用 SSL 连接, RequireSSL 拒绝非 SSL 连接
+	TLSConfig  *tls.Config
+	RequireSSL bool
 
-type CurrSession struct {
-	sess                     *model.Session
-	replRecorder             *proxy.ReplyRecorder
-	cmdRecorder              *proxy.CommandRecorder
-	CreateSessionCallback    func() error
-	ConnectedSuccessCallback func() error
-	ConnectedFailedCallback  func(err error) error
-	DisConnectedCallback     func() error
-	SwSess                   *proxy.SwitchSession
+	// MaskStmtParams 记录预处理语句时隐藏绑定的参数值
+	MaskStmtParams bool
 }
 
-func (fs *FakeServer) Start() {
-	listener, err := net.Listen("tcp", "192.168.0.36:8888")
-	if err != nil {
-		listener, err = net.Listen("tcp", "192.168.0.34:8888")
-	} // открываем слушающий сокет
-	for {
-		conn, err := listener.Accept() // принимаем TCP-соединение от клиента и создаем новый сокет
-		if err != nil {
-			continue
-		}
-		go fs.handleClient(conn) // обрабатываем запросы клиента в отдельной го-рутине
-	}
+func NewFakeServer(addr string, jmsService *service.JMService) *FakeServer {
+	fs := &FakeServer{JmsService: jmsService}
+	fs.Server = proxybase.NewServer(proxyName, addr, func(conn net.Conn) proxybase.Conn {
+		return NewConnection(fs, conn)
+	})
+	return fs
 }
 
+type CurrSession = proxybase.Session
+
 var connID = []byte{0x00, 0x00, 0x00, 0x00}
 
-func (fs *FakeServer) handleClient(conn net.Conn) {
-	defer func() {
-		if fs.CurrSession != nil {
-			if fs.CurrSession.cmdRecorder != nil && fs.CurrSession.replRecorder != nil {
-				fs.CurrSession.cmdRecorder.End()
-				fs.CurrSession.replRecorder.End()
-			}
-			err := fs.CurrSession.DisConnectedCallback()
-			if err != nil {
-				fmt.Printf("error on disconnecting session")
-			}
-		}
-		fs.Conn.Close()
-	}()
-	fs.Conn = conn
+var connIDLock sync.Mutex
 
+func nextConnID() []byte {
+	connIDLock.Lock()
+	defer connIDLock.Unlock()
 	fakeHandshakePacket := &FakeHandshakePacket{}
+	fakeHandshakePacket.IncrementConnectID(connID)
+	copy(connID, fakeHandshakePacket.ThreadId)
+	id := make([]byte, len(connID))
+	copy(id, connID)
+	return id
+}
 
-	_ = fakeHandshakePacket.NewHandshakePacket(connID)
-	packet, err := fakeHandshakePacket.Encode()
+// Serve 与客户端握手并校验连接令牌, 连接后端后双向代理数据包直到一端断开或者会话被终断
+func (c *Connection) Serve() {
+	defer c.Close()
+
+	authPacket, err := c.acceptClient()
 	if err != nil {
-		fmt.Printf("%s", err)
+		logger.Errorf("MySQL proxy client %s login failed: %s", c.conn.RemoteAddr(), err)
 		return
 	}
-	go conn.Write(packet)
-
-	authPacket := GetAuthPacket(conn)
-	username, password := authPacket.Username, authPacket.Password
-	username = bytes.Trim(username, "\x00")
-	token, err := fs.JmsService.GetConnectTokenAuth(string(username))
-	fs.Token = &token
 
+	token := c.Token
+	c.host = token.Info.Application.Attrs.Host
+	c.port = strconv.Itoa(token.Info.Application.Attrs.Port)
+	c.Username = token.Info.SystemUserAuthInfo.Username
+	c.Password = token.Info.SystemUserAuthInfo.Password
+	rules, err := proxybase.LoadFilterRules(c.JmsService, token)
 	if err != nil {
-		fmt.Printf("\ninvalid token: %s", err)
+		logger.Errorf("MySQL proxy get command filter rules err: %s", err)
 		return
 	}
+	database := string(authPacket.Database)
+	if database == "" {
+		database = token.Info.Application.Attrs.Database
+	}
+	c.sqlMatcher = sqlparser.NewMatcher(sqlparser.DialectMySQL, database)
+	c.filter = proxybase.NewCommandFilter(proxyName, c.JmsService, rules, c.sqlMatcher.Match)
+	c.guard = guardrail.ForApplication(token.Info.Application.Name)
+	c.CurrSession = proxybase.NewSession(proxyName, c.JmsService, token, c.conn.RemoteAddr().String())
+	proxy.AddCommonSwitch(c.CurrSession.SwSess)
+	defer proxy.RemoveCommonSwitch(c.CurrSession.SwSess)
 
-	checkConnectPermFunc := func() (model.ExpireInfo, error) {
-		return fs.JmsService.ValidateApplicationPermission(fs.Token.Info.User.ID,
-			fs.Token.Info.Application.ID, fs.Token.Info.SystemUserAuthInfo.ID)
+	address := net.JoinHostPort(c.host, c.port)
+	mysql, err := c.connectUpstream(address, authPacket)
+	if err != nil {
+		logger.Errorf("MySQL proxy connect to %s err: %s", address, err)
+		if !errors.Is(err, errUpstreamAuthFailed) {
+			c.writeErr(c.clientSequenceId+1, ErrCodeConnectFailed, SQLStateGeneral,
+				fmt.Sprintf("Can't connect to MySQL server on '%s'", address))
+		}
+		return
 	}
-	perm, _ := checkConnectPermFunc()
-	if !perm.HasPermission {
-		fmt.Printf("\nno perm")
+
+	if err = c.CurrSession.CreateSessionCallback(); err != nil {
+		logger.Errorf("MySQL proxy create session err: %s", err)
 		return
 	}
-	fakeSalt := append(fakeHandshakePacket.Salt, fakeHandshakePacket.Salt2...)
+	defer c.endSession()
+	defer c.stopGuardTimers()
+	if err = c.CurrSession.ConnectedSuccessCallback(); err != nil {
+		logger.Errorf("Session %s: MySQL proxy update session success err: %s",
+			c.CurrSession.Sess.ID, err)
+	}
+	c.CurrSession.StartRecord()
+	logger.Infof("Session %s: MySQL proxy %s connected %s", c.CurrSession.Sess.ID,
+		c.conn.RemoteAddr(), address)
 
-	tokenPass := token.Info.Secret
-	scrambledTokenPass := ScramblePassword(fakeSalt, tokenPass)
+	done := make(chan struct{}, 2)
+	// Read packets from client, check them with filter rules, then forward to server
+	go func() {
+		if err := c.proxyRequests(mysql); err != nil && err != io.EOF {
+			logger.Debugf("Session %s: MySQL proxy client read err: %s", c.CurrSession.Sess.ID, err)
+		}
+		done <- struct{}{}
+	}()
+	// Read packets from server, parse the result, then forward to client
+	go func() {
+		if err := c.proxyResponses(mysql); err != nil && err != io.EOF {
+			logger.Debugf("Session %s: MySQL proxy server read err: %s", c.CurrSession.Sess.ID, err)
+		}
+		done <- struct{}{}
+	}()
 
-	// соль токен-пароль пароль
-	//fmt.Printf("\nsalt : %v tokenp : %s p : %v", fakeSalt, hex.EncodeToString(scrambledTokenPass), hex.EncodeToString(password))
+	select {
+	case <-done:
+	case <-c.CurrSession.SwSess.Ctx.Done():
+		logger.Infof("Session %s: MySQL proxy terminated", c.CurrSession.Sess.ID)
+	}
+}
 
-	if !bytes.Equal(scrambledTokenPass, password) {
-		fmt.Printf("\nwrong pass\n")
-		return
+// acceptClient 与客户端握手, 必要时升级为 TLS, 校验连接令牌和授权
+func (c *Connection) acceptClient() (*AuthorizationPacket, error) {
+	tlsConfig := c.FakeServer.TLSConfig
+	fakeHandshakePacket := &FakeHandshakePacket{}
+	_ = fakeHandshakePacket.NewHandshakePacket(nil)
+	fakeHandshakePacket.ThreadId = nextConnID()
+	if tlsConfig != nil {
+		fakeHandshakePacket.EnableSSL()
+	}
+	packet, err := fakeHandshakePacket.Encode()
+	if err != nil {
+		return nil, err
+	}
+	if _, err = c.conn.Write(packet); err != nil {
+		return nil, err
 	}
 
-	fs.Host = token.Info.Application.Attrs.Host
-	fs.Port = token.Info.Application.Attrs.Port
-
-	fs.Username = token.Info.SystemUserAuthInfo.Username
-	fs.Password = token.Info.SystemUserAuthInfo.Password
-	apiSession := &model.Session{
-		ID:           common.UUID(),
-		User:         token.Info.User.String(),
-		SystemUser:   token.Info.SystemUserAuthInfo.String(),
-		LoginFrom:    "DT",
-		RemoteAddr:   conn.RemoteAddr().String(),
-		Protocol:     token.Info.SystemUserAuthInfo.Protocol,
-		UserID:       token.Info.User.ID,
-		SystemUserID: token.Info.SystemUserAuthInfo.ID,
-		Asset:        token.Info.Application.String(),
-		AssetID:      token.Info.Application.ID,
-		OrgID:        token.Info.Application.OrgID,
-	}
-	var ctx, cancel = context.WithCancel(context.Background())
-	fs.CurrSession = &CurrSession{
-		sess: apiSession,
-		CreateSessionCallback: func() error {
-			apiSession.DateStart = modelCommon.NewNowUTCTime()
-			return fs.JmsService.CreateSession(*apiSession)
-		},
-		ConnectedSuccessCallback: func() error {
-			return fs.JmsService.SessionSuccess(apiSession.ID)
-		},
-		ConnectedFailedCallback: func(err error) error {
-			return fs.JmsService.SessionFailed(apiSession.ID, err)
-		},
-		DisConnectedCallback: func() error {
-			return fs.JmsService.SessionDisconnect(apiSession.ID)
-		},
-		SwSess: &proxy.SwitchSession{
-			ID:            apiSession.ID,
-			MaxIdleTime:   120,
-			KeepAliveTime: 10000,
-			Ctx:           ctx,
-			Cancel:        cancel,
-		},
-	}
-
-	proxy.AddCommonSwitch(fs.CurrSession.SwSess)
-
-	authPacket.Username = []byte(fs.Username)
-	authPacket.Password = []byte(fs.Password)
-	connection := NewConnection(fs)
-
-	address := fmt.Sprintf("%s%s", connection.host, connection.port)
-	mysql, err := net.Dial("tcp", address)
+	data, err := readPacket(c.conn)
 	if err != nil {
-		log.Printf("Failed to connection to MySQL: %s", err.Error())
-		return
+		return nil, err
+	}
+	if tlsConfig != nil && isSSLRequestPacket(data) {
+		tlsConn := tls.Server(c.conn, tlsConfig)
+		if err = tlsConn.Handshake(); err != nil {
+			return nil, fmt.Errorf("tls handshake: %w", err)
+		}
+		c.setClientConn(tlsConn)
+		if data, err = readPacket(c.conn); err != nil {
+			return nil, err
+		}
+	} else if c.FakeServer.RequireSSL {
+		c.writeErr(getSequenceID(data)+1, ErrCodeAccessDenied, SQLStateAccessDenied,
+			"Connections using insecure transport are prohibited")
+		return nil, errors.New("client does not use SSL")
 	}
 
-	handshakePacket := &InitialHandshakePacket{}
-	err = handshakePacket.Decode(mysql)
+	authPacket := &AuthorizationPacket{}
+	if err = authPacket.DecodePacket(data); err != nil {
+		return nil, err
+	}
+	// 客户端只能使用代理声明过的 capability flags
+	authPacket.SetCapabilityFlags(authPacket.CapabilityFlags() & fakeHandshakePacket.CapabilityFlags())
+	c.clientCapabilities = authPacket.CapabilityFlags()
+	c.clientSequenceId = authPacket.SequenceId()
+	fakeSalt := make([]byte, 0, scrambleLength)
+	fakeSalt = append(fakeSalt, fakeHandshakePacket.Salt...)
+	fakeSalt = append(fakeSalt, fakeHandshakePacket.Salt2...)
+	plugin := authNativePassword
+	if c.clientCapabilities.Has(clientPluginAuth) && len(authPacket.AuthPluginName) > 0 {
+		plugin = string(authPacket.AuthPluginName)
+	}
+	if !isSupportedAuthPlugin(plugin) {
+		// 客户端使用了不支持的认证插件, 要求其切换为 mysql_native_password
+		plugin = authNativePassword
+		if authPacket.Password, err = c.switchClientAuth(plugin, fakeSalt); err != nil {
+			return nil, err
+		}
+	}
 
+	token, err := c.JmsService.GetConnectTokenAuth(string(authPacket.Username))
 	if err != nil {
-		log.Printf("Failed ot decode handshake initial packet: %s", err.Error())
-		return
+		c.writeErr(c.clientSequenceId+1, ErrCodeAccessDenied, SQLStateAccessDenied, "Invalid token")
+		return nil, fmt.Errorf("invalid token: %w", err)
 	}
+	if token.Info.Application == nil || token.Info.SystemUserAuthInfo == nil || token.Info.User == nil {
+		c.writeErr(c.clientSequenceId+1, ErrCodeAccessDenied, SQLStateAccessDenied, "Invalid token")
+		return nil, fmt.Errorf("not an application token: %v", token.Err)
+	}
+	c.Token = &token
 
-	salt := handshakePacket.AuthPluginData[:len(handshakePacket.AuthPluginData)-1]
+	perm, err := c.JmsService.ValidateApplicationPermission(token.Info.User.ID,
+		token.Info.Application.ID, token.Info.SystemUserAuthInfo.ID)
+	if err != nil || !perm.HasPermission {
+		c.writeErr(c.clientSequenceId+1, ErrCodeAccessDenied, SQLStateAccessDenied, "No permission")
+		return nil, fmt.Errorf("user %s has no permission to %s", token.Info.User.String(),
+			token.Info.Application.String())
+	}
+	scrambledTokenPass, _ := scrambleAuthData(plugin, fakeSalt, token.Info.Secret)
+	if !bytes.Equal(scrambledTokenPass, authPacket.Password) {
+		c.writeErr(c.clientSequenceId+1, ErrCodeAccessDenied, SQLStateAccessDenied, "Invalid token")
+		return nil, fmt.Errorf("user %s token secret mismatch", token.Info.User.String())
+	}
+	if plugin == authCachingSHA2Password {
+		// 令牌校验通过, 告知客户端快速认证成功, 登录结果等后端认证完成后再转发
+		c.clientSequenceId++
+		fastAuth := encodePacket(c.clientSequenceId, []byte{iAuthMoreData, cachingSHA2FastAuthSuccess})
+		if _, err = c.conn.Write(fastAuth); err != nil {
+			return nil, err
+		}
+	}
+	return authPacket, nil
+}
 
-	passwd := ScramblePassword(salt, string(authPacket.Password))
-	authPacket.Password = passwd
+// switchClientAuth 向客户端发送 AuthSwitchRequest, 返回客户端按新插件计算的 auth-response
+func (c *Connection) switchClientAuth(plugin string, scramble []byte) ([]byte, error) {
+	switchRequest, _ := NewAuthSwitchRequestPacket(c.clientSequenceId+1, plugin, scramble).Encode()
+	if _, err := c.conn.Write(switchRequest); err != nil {
+		return nil, err
+	}
+	packet, err := readPacket(c.conn)
+	if err != nil {
+		return nil, err
+	}
+	c.clientSequenceId = getSequenceID(packet)
+	return packet[4:], nil
+}
 
-	res, err := authPacket.Encode()
+// connectUpstream 连接后端 MySQL, 按应用配置升级 TLS, 使用系统用户登录并把登录结果转发给客户端
+func (c *Connection) connectUpstream(address string, authPacket *AuthorizationPacket) (net.Conn, error) {
+	authPacket.Username = []byte(c.Username)
+	mysql, handshakePacket, packet, err := c.dialUpstream(address, authPacket, c.setUpstream)
 	if err != nil {
-		log.Printf("%s", err.Error())
-		return
+		return nil, err
 	}
+	c.threadID = handshakePacket.ConnectionId
+	// 后端与客户端的包序号可能因 TLS 不同, 登录结果按客户端的序号转发
+	packet[3] = c.clientSequenceId + 1
+	if _, err = c.conn.Write(packet); err != nil {
+		return nil, err
+	}
+	switch packet[4] {
+	case iOK:
+		return mysql, nil
+	case iERR:
+		errPacket := ErrPacket{}
+		_ = errPacket.Decode(packet[4:])
+		return nil, fmt.Errorf("%w: %s", errUpstreamAuthFailed, formatErrPacket(&errPacket))
+	default:
+		return nil, fmt.Errorf("unsupported auth response 0x%02x", packet[4])
+	}
+}
 
-	_, err = mysql.Write(res)
+// dialUpstream 连接后端 MySQL 并使用系统用户登录, 返回握手包和登录结果,
+// setConn 不为空时在连接建立和升级 TLS 后调用, 用于关闭会话时断开连接
+func (c *Connection) dialUpstream(address string, authPacket *AuthorizationPacket,
+	setConn func(net.Conn)) (net.Conn, *InitialHandshakePacket, []byte, error) {
+	attrs := c.Token.Info.Application.Attrs
+	mysql, err := net.DialTimeout("tcp", address, dialTimeout)
 	if err != nil {
-		log.Printf("%s", err.Error())
-		return
+		return nil, nil, nil, err
+	}
+	if setConn != nil {
+		setConn(mysql)
 	}
 
-	if err := fs.CurrSession.CreateSessionCallback(); err != nil {
-		log.Printf("%s", err.Error())
-		return
+	handshakePacket := &InitialHandshakePacket{}
+	if err = handshakePacket.Decode(mysql); err != nil {
+		return mysql, nil, nil, fmt.Errorf("decode handshake: %w", err)
 	}
-	if err := fs.CurrSession.ConnectedSuccessCallback(); err != nil {
-		log.Printf("%s", err.Error())
-		return
+
+	flags := authPacket.CapabilityFlags() &^ clientSSL
+	if missing := flags & upstreamRequiredFlags &^ handshakePacket.CapabilitiesFlags; missing != 0 {
+		// 客户端按这些 flags 解析后端返回的包, 后端不支持时无法代理
+		return mysql, nil, nil, fmt.Errorf("server does not support capabilities:\n%s", missing)
+	}
+	flags &= handshakePacket.CapabilitiesFlags | clientPluginAuth
+	if handshakePacket.CapabilitiesFlags.Has(clientPluginAuth) {
+		flags |= clientPluginAuth
 	}
-	fs.CurrSession.replRecorder, fs.CurrSession.cmdRecorder = fs.GetRecorders()
+	authPacket.SetCapabilityFlags(flags)
+	sequenceId := uint8(1)
+	if attrs.UseSSL {
+		if !handshakePacket.CapabilitiesFlags.Has(clientSSL) {
+			return mysql, nil, nil, errors.New("server does not support SSL")
+		}
+		tlsConfig, err := proxybase.UpstreamTLSConfig(c.host, attrs)
+		if err != nil {
+			return mysql, nil, nil, err
+		}
+		sslRequest, _ := authPacket.SSLRequest(sequenceId).Encode()
+		if _, err = mysql.Write(sslRequest); err != nil {
+			return mysql, nil, nil, err
+		}
+		tlsConn := tls.Client(mysql, tlsConfig)
+		if err = tlsConn.Handshake(); err != nil {
+			return mysql, nil, nil, fmt.Errorf("tls handshake: %w", err)
+		}
+		mysql = tlsConn
+		if setConn != nil {
+			setConn(mysql)
+		}
+		authPacket.SetCapabilityFlags(flags | clientSSL)
+		sequenceId++
+	}
+	authPacket.SetSequenceId(sequenceId)
 
-	var request bytes.Buffer
-	// Copy bytes from client to server and requestParser
-	go io.Copy(io.MultiWriter(mysql, &Request{request, connection.JmsService, fs.CurrSession,
-		connection.FakeServer}), connection.conn)
+	packet, err := authUpstream(mysql, authPacket, handshakePacket, c.Password, attrs.UseSSL)
+	if err != nil {
+		return mysql, nil, nil, err
+	}
+	return mysql, handshakePacket, packet, nil
+}
 
-	// Copy bytes from server to client and responseParser
-	var response bytes.Buffer
-	go io.Copy(io.MultiWriter(connection.conn, &Response{response, connection.JmsService, fs.CurrSession,
-		connection.FakeServer}), mysql)
+// endSession 结束录像, 命令记录并通知 core 会话断开, 可重复调用
+func (c *Connection) endSession() {
+	c.endOnce.Do(func() {
+		if c.CurrSession == nil {
+			return
+		}
+		c.flushResult()
+		c.CurrSession.End()
+	})
+}
 
+// proxyRequests 逐个读取客户端数据包, 通过命令过滤后转发到后端并记录
+func (c *Connection) proxyRequests(mysql net.Conn) error {
+	req := &Request{conn: c, currSess: c.CurrSession}
 	for {
-		select {
-		case <-fs.CurrSession.SwSess.Ctx.Done():
-			return
-		default:
+		packet, err := readPacket(c.conn)
+		if err != nil {
+			return err
+		}
+		if c.isLocalInfile() {
+			// LOCAL INFILE 的文件内容直接转发, 以空包结束
+			if len(packet) == 4 {
+				c.setLocalInfile(false)
+			}
+			if _, err = mysql.Write(packet); err != nil {
+				return err
+			}
+			continue
+		}
+		packets := [][]byte{packet}
+		for len(packet)-4 == maxPacketSize {
+			if packet, err = readPacket(c.conn); err != nil {
+				return err
+			}
+			packets = append(packets, packet)
+		}
+		command := joinPackets(packets)
+		if !req.Allow(command) {
 			continue
 		}
+		for _, packet = range packets {
+			if _, err = mysql.Write(packet); err != nil {
+				return err
+			}
+		}
+		_, _ = req.Write(command)
 	}
-
 }
 
-func GetAuthPacket(conn net.Conn) *AuthorizationPacket {
-	authorizationPacket := &AuthorizationPacket{}
-	authorizationPacket.Decode(conn)
-	//if err != nil {
-	//	fmt.Println(err)
-	//	GetAuthPacket(conn)
-	//}
-	return authorizationPacket
+// proxyResponses 逐个读取后端数据包, 解析执行结果后转发给客户端
+func (c *Connection) proxyResponses(mysql net.Conn) error {
+	res := &Response{conn: c, currSess: c.CurrSession}
+	for {
+		packet, err := readPacket(mysql)
+		if err != nil {
+			return err
+		}
+		packet = res.Handle(packet)
+		if packet == nil {
+			continue
+		}
+		if _, err = c.conn.Write(packet); err != nil {
+			return err
+		}
+	}
 }
@@ -0,0 +1,105 @@
+package mysqlProxy
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/meowgen/koko/pkg/config"
+	"github.com/meowgen/koko/pkg/jms-sdk-go/service"
+	"github.com/meowgen/koko/pkg/proxybase"
+)
+
+// newTestJMService 返回请求 handler 的 core 服务
+func newTestJMService(t *testing.T, handler http.Handler) *service.JMService {
+	config.GlobalConfig = &config.Config{}
+	ts := httptest.NewServer(handler)
+	t.Cleanup(ts.Close)
+	jmsService, err := service.NewAuthJMService(service.JMSCoreHost(ts.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return jmsService
+}
+
+// startTestServer 在随机端口启动代理, 测试结束时停止
+func startTestServer(t *testing.T, jmsService *service.JMService) (*FakeServer, string, chan error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs := NewFakeServer(ln.Addr().String(), jmsService)
+	serveErr := make(chan error, 1)
+	go func() { serveErr <- fs.Serve(ln) }()
+	t.Cleanup(fs.Stop)
+	return fs, ln.Addr().String(), serveErr
+}
+
+func dialTestServer(t *testing.T, addr string) net.Conn {
+	client, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = client.Close() })
+	_ = client.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err = readPacket(client); err != nil {
+		t.Fatalf("read handshake: %s", err)
+	}
+	return client
+}
+
+func TestFakeServer_InvalidToken(t *testing.T) {
+	jmsService := newTestJMService(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"detail": "token not found"}`, http.StatusNotFound)
+	}))
+	_, addr, _ := startTestServer(t, jmsService)
+	client := dialTestServer(t, addr)
+
+	authPacket := newTestAuthPacket()
+	authPacket.Username = []byte("unknown-token")
+	data, err := authPacket.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = client.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	packet, err := readPacket(client)
+	if err != nil {
+		t.Fatalf("read login result: %s", err)
+	}
+	expected, _ := NewErrPacket(2, ErrCodeAccessDenied, SQLStateAccessDenied, "Invalid token").Encode()
+	if !bytes.Equal(packet, expected) {
+		t.Errorf("login result should be %v but %v", expected, packet)
+	}
+}
+
+func TestFakeServer_Stop(t *testing.T) {
+	fs, addr, serveErr := startTestServer(t, newTestJMService(t, http.NotFoundHandler()))
+	client := dialTestServer(t, addr)
+
+	stopped := make(chan struct{})
+	go func() {
+		fs.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Stop should return after closing connections")
+	}
+	if err := <-serveErr; !errors.Is(err, proxybase.ErrServerClosed) {
+		t.Errorf("Serve should return ErrServerClosed but %v", err)
+	}
+	if _, err := client.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("client connection should be closed but %v", err)
+	}
+	if _, err := net.DialTimeout("tcp", addr, time.Second); err == nil {
+		t.Error("listener should be closed")
+	}
+}
@@ -0,0 +1,437 @@
+package mysqlProxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/meowgen/koko/pkg/datamask"
+)
+
+// https://dev.mysql.com/doc/internals/en/prepared-statements.html
+
+const (
+	fieldTypeDecimal byte = iota
+	fieldTypeTiny
+	fieldTypeShort
+	fieldTypeLong
+	fieldTypeFloat
+	fieldTypeDouble
+	fieldTypeNULL
+	fieldTypeTimestamp
+	fieldTypeLongLong
+	fieldTypeInt24
+	fieldTypeDate
+	fieldTypeTime
+	fieldTypeDateTime
+	fieldTypeYear
+	fieldTypeNewDate
+	fieldTypeVarChar
+	fieldTypeBit
+)
+
+const (
+	fieldTypeJSON byte = iota + 0xf5
+	fieldTypeNewDecimal
+	fieldTypeEnum
+	fieldTypeSet
+	fieldTypeTinyBLOB
+	fieldTypeMediumBLOB
+	fieldTypeLongBLOB
+	fieldTypeBLOB
+	fieldTypeVarString
+	fieldTypeString
+	fieldTypeGeometry
+)
+
+const (
+	flagUnsigned uint16 = 0x0020
+
+	// COM_STMT_EXECUTE 的 flags, 开启 clientQueryAttributes 时表示带有参数个数
+	cursorTypeParameterCountAvailable byte = 0x08
+
+	serverStatusCursorExists uint16 = 0x0040
+
+	maskedParamValue = "'******'"
+	maxLongDataSize  = 1024
+)
+
+// preparedStatement 记录客户端预处理的语句, 执行时用参数还原 SQL
+type preparedStatement struct {
+	ID         uint32
+	Query      []byte
+	ParamCount int
+
+	// 客户端只在第一次执行时发送参数类型
+	paramTypes []byte
+	longData   map[int][]byte
+
+	// 使用游标执行时记录列定义和脱敏计划, 用于解析 COM_STMT_FETCH 返回的行
+	cursorColumns []*ColumnDefinition
+	cursorMask    *datamask.ResultSet
+}
+
+/*
+StmtPrepareOkPacket represents COM_STMT_PREPARE_OK
+https://dev.mysql.com/doc/internals/en/com-stmt-prepare-response.html
+*/
+type StmtPrepareOkPacket struct {
+	StatementId  uint32
+	ColumnCount  uint16
+	ParamCount   uint16
+	WarningCount uint16
+}
+
+func (r *StmtPrepareOkPacket) Decode(payload []byte) error {
+	if len(payload) < 12 || payload[0] != iOK {
+		return errMalformedPacket
+	}
+	r.StatementId = binary.LittleEndian.Uint32(payload[1:5])
+	r.ColumnCount = binary.LittleEndian.Uint16(payload[5:7])
+	r.ParamCount = binary.LittleEndian.Uint16(payload[7:9])
+	r.WarningCount = binary.LittleEndian.Uint16(payload[10:12])
+	return nil
+}
+
+func getStatementId(packet []byte) (uint32, bool) {
+	if len(packet) < 9 {
+		return 0, false
+	}
+	return binary.LittleEndian.Uint32(packet[5:9]), true
+}
+
+// decodeExecute 解析 COM_STMT_EXECUTE 的参数, 返回 SQL 字面量形式的参数值
+func (s *preparedStatement) decodeExecute(packet []byte, flags CapabilityFlag) ([]string, error) {
+	payload := packet[4:]
+	if len(payload) < 10 {
+		return nil, errMalformedPacket
+	}
+	cursorFlags := payload[5]
+	position := 10
+	paramCount := s.ParamCount
+	if flags.Has(clientQueryAttributes) && cursorFlags&cursorTypeParameterCountAvailable != 0 {
+		num, _, n := readLengthEncodedInteger(payload[position:])
+		position += n
+		paramCount = int(num)
+	}
+	if paramCount == 0 {
+		return nil, nil
+	}
+	bitmapLength := (paramCount + 7) / 8
+	if len(payload) < position+bitmapLength+1 {
+		return nil, errMalformedPacket
+	}
+	nullBitmap := payload[position : position+bitmapLength]
+	position += bitmapLength
+	newParamsBound := payload[position] == 0x01
+	position++
+
+	paramTypes := s.paramTypes
+	if newParamsBound {
+		paramTypes = make([]byte, 0, paramCount*2)
+		for i := 0; i < paramCount; i++ {
+			if len(payload) < position+2 {
+				return nil, errMalformedPacket
+			}
+			paramTypes = append(paramTypes, payload[position], payload[position+1])
+			position += 2
+			if flags.Has(clientQueryAttributes) {
+				// 参数名, 普通参数为空
+				_, _, n, err := readLengthEncodedString(payload[position:])
+				if err != nil {
+					return nil, err
+				}
+				position += n
+			}
+		}
+		s.paramTypes = paramTypes
+	}
+	if len(paramTypes) < paramCount*2 {
+		return nil, errors.New("missing parameter types")
+	}
+
+	params := make([]string, 0, paramCount)
+	for i := 0; i < paramCount; i++ {
+		if data, ok := s.longData[i]; ok {
+			params = append(params, formatStringValue(data))
+			continue
+		}
+		if nullBitmap[i/8]&(1<<(uint(i)%8)) != 0 {
+			params = append(params, "NULL")
+			continue
+		}
+		fieldType := paramTypes[i*2]
+		unsigned := paramTypes[i*2+1]&0x80 != 0
+		value, isString, n, err := readBinaryValue(payload[position:], fieldType, unsigned)
+		if err != nil {
+			return params, err
+		}
+		switch {
+		case fieldType == fieldTypeNULL:
+			params = append(params, "NULL")
+		case isString:
+			params = append(params, formatStringValue(value))
+		default:
+			params = append(params, string(value))
+		}
+		position += n
+	}
+	s.longData = nil
+	return params, nil
+}
+
+// appendLongData 记录 COM_STMT_SEND_LONG_DATA 发送的参数内容
+func (s *preparedStatement) appendLongData(packet []byte) {
+	if len(packet) < 11 {
+		return
+	}
+	paramId := int(binary.LittleEndian.Uint16(packet[9:11]))
+	if s.longData == nil {
+		s.longData = make(map[int][]byte)
+	}
+	data := append(s.longData[paramId], packet[11:]...)
+	if len(data) > maxLongDataSize {
+		data = data[:maxLongDataSize]
+	}
+	s.longData[paramId] = data
+}
+
+// readBinaryValue 解析 binary protocol 的值, 返回值的文本形式, 是否为字符串和读取的长度
+// https://dev.mysql.com/doc/internals/en/binary-protocol-value.html
+func readBinaryValue(b []byte, fieldType byte, unsigned bool) ([]byte, bool, int, error) {
+	var size int
+	switch fieldType {
+	case fieldTypeNULL:
+		return nil, false, 0, nil
+	case fieldTypeTiny:
+		size = 1
+	case fieldTypeShort, fieldTypeYear:
+		size = 2
+	case fieldTypeLong, fieldTypeInt24, fieldTypeFloat:
+		size = 4
+	case fieldTypeLongLong, fieldTypeDouble:
+		size = 8
+	case fieldTypeDate, fieldTypeDateTime, fieldTypeTimestamp:
+		value, n, err := readBinaryDateTime(b)
+		return value, true, n, err
+	case fieldTypeTime:
+		value, n, err := readBinaryTime(b)
+		return value, true, n, err
+	case fieldTypeDecimal, fieldTypeNewDecimal:
+		value, _, n, err := readLengthEncodedString(b)
+		return value, false, n, err
+	case fieldTypeVarChar, fieldTypeBit, fieldTypeJSON, fieldTypeEnum, fieldTypeSet,
+		fieldTypeTinyBLOB, fieldTypeMediumBLOB, fieldTypeLongBLOB, fieldTypeBLOB,
+		fieldTypeVarString, fieldTypeString, fieldTypeGeometry:
+		value, _, n, err := readLengthEncodedString(b)
+		return value, true, n, err
+	default:
+		return nil, false, 0, fmt.Errorf("unsupported field type 0x%02x", fieldType)
+	}
+	if len(b) < size {
+		return nil, false, 0, errMalformedPacket
+	}
+	var value string
+	switch fieldType {
+	case fieldTypeFloat:
+		v := math.Float32frombits(binary.LittleEndian.Uint32(b))
+		value = strconv.FormatFloat(float64(v), 'g', -1, 32)
+	case fieldTypeDouble:
+		v := math.Float64frombits(binary.LittleEndian.Uint64(b))
+		value = strconv.FormatFloat(v, 'g', -1, 64)
+	default:
+		var v uint64
+		for i := size - 1; i >= 0; i-- {
+			v = v<<8 | uint64(b[i])
+		}
+		if unsigned {
+			value = strconv.FormatUint(v, 10)
+		} else {
+			// 按长度做符号扩展
+			shift := uint(64 - size*8)
+			value = strconv.FormatInt(int64(v<<shift)>>shift, 10)
+		}
+	}
+	return []byte(value), false, size, nil
+}
+
+func readBinaryDateTime(b []byte) ([]byte, int, error) {
+	if len(b) < 1 || len(b) < 1+int(b[0]) {
+		return nil, 0, errMalformedPacket
+	}
+	length := int(b[0])
+	data := b[1 : 1+length]
+	var year, month, day, hour, minute, second, microSecond int
+	if length >= 4 {
+		year = int(binary.LittleEndian.Uint16(data[0:2]))
+		month, day = int(data[2]), int(data[3])
+	}
+	if length >= 7 {
+		hour, minute, second = int(data[4]), int(data[5]), int(data[6])
+	}
+	if length >= 11 {
+		microSecond = int(binary.LittleEndian.Uint32(data[7:11]))
+	}
+	value := fmt.Sprintf("%04d-%02d-%02d", year, month, day)
+	if length > 4 {
+		value += fmt.Sprintf(" %02d:%02d:%02d", hour, minute, second)
+	}
+	if length > 7 {
+		value += fmt.Sprintf(".%06d", microSecond)
+	}
+	return []byte(value), 1 + length, nil
+}
+
+func readBinaryTime(b []byte) ([]byte, int, error) {
+	if len(b) < 1 || len(b) < 1+int(b[0]) {
+		return nil, 0, errMalformedPacket
+	}
+	length := int(b[0])
+	data := b[1 : 1+length]
+	var negative bool
+	var days, hour, minute, second, microSecond int
+	if length >= 8 {
+		negative = data[0] == 1
+		days = int(binary.LittleEndian.Uint32(data[1:5]))
+		hour, minute, second = int(data[5]), int(data[6]), int(data[7])
+	}
+	if length >= 12 {
+		microSecond = int(binary.LittleEndian.Uint32(data[8:12]))
+	}
+	value := fmt.Sprintf("%02d:%02d:%02d", days*24+hour, minute, second)
+	if length > 8 {
+		value += fmt.Sprintf(".%06d", microSecond)
+	}
+	if negative {
+		value = "-" + value
+	}
+	return []byte(value), 1 + length, nil
+}
+
+// formatStringValue 把字符串参数转换成 SQL 字面量, 非文本内容使用十六进制
+func formatStringValue(value []byte) string {
+	if !utf8.Valid(value) {
+		return "0x" + hex.EncodeToString(value)
+	}
+	var buf strings.Builder
+	buf.WriteByte('\'')
+	for _, c := range string(value) {
+		switch c {
+		case '\'':
+			buf.WriteString("\\'")
+		case '\\':
+			buf.WriteString("\\\\")
+		case 0:
+			buf.WriteString("\\0")
+		case '\n':
+			buf.WriteString("\\n")
+		case '\r':
+			buf.WriteString("\\r")
+		default:
+			buf.WriteRune(c)
+		}
+	}
+	buf.WriteByte('\'')
+	return buf.String()
+}
+
+// interpolateParams 把 SQL 中的 ? 占位符替换成参数值, 忽略字符串, 标识符和注释中的 ?
+func interpolateParams(query []byte, params []string, mask bool) []byte {
+	var buf bytes.Buffer
+	paramIndex := 0
+	for i := 0; i < len(query); i++ {
+		c := query[i]
+		switch {
+		case c == '\'' || c == '"' || c == '`':
+			end := skipQuoted(query, i)
+			buf.Write(query[i:end])
+			i = end - 1
+			continue
+		case c == '#' || (c == '-' && i+2 < len(query) && query[i+1] == '-' &&
+			(query[i+2] == ' ' || query[i+2] == '\t')):
+			end := bytes.IndexByte(query[i:], '\n')
+			if end == -1 {
+				end = len(query) - i
+			}
+			buf.Write(query[i : i+end])
+			i += end - 1
+			continue
+		case c == '/' && i+1 < len(query) && query[i+1] == '*':
+			end := bytes.Index(query[i+2:], []byte("*/"))
+			if end == -1 {
+				end = len(query) - i - 2
+			} else {
+				end += 2
+			}
+			buf.Write(query[i : i+2+end])
+			i += 2 + end - 1
+			continue
+		case c == '?' && paramIndex < len(params):
+			value := params[paramIndex]
+			if mask && value != "NULL" {
+				value = maskedParamValue
+			}
+			buf.WriteString(value)
+			paramIndex++
+			continue
+		}
+		buf.WriteByte(c)
+	}
+	return buf.Bytes()
+}
+
+// skipQuoted 返回从 start 开始的引号字符串结束后的位置
+func skipQuoted(query []byte, start int) int {
+	quote := query[start]
+	for i := start + 1; i < len(query); i++ {
+		switch query[i] {
+		case '\\':
+			if quote != '`' {
+				i++
+			}
+		case quote:
+			if i+1 < len(query) && query[i+1] == quote {
+				i++
+				continue
+			}
+			return i + 1
+		}
+	}
+	return len(query)
+}
+
+// decodeBinaryRow decodes a ProtocolBinary::ResultsetRow, NULL values are returned as nil
+func decodeBinaryRow(payload []byte, columns []*ColumnDefinition) ([][]byte, error) {
+	row := make([][]byte, 0, len(columns))
+	if len(payload) < 1 || payload[0] != iOK {
+		return row, errMalformedPacket
+	}
+	bitmapLength := (len(columns) + 7 + 2) / 8
+	if len(payload) < 1+bitmapLength {
+		return row, errMalformedPacket
+	}
+	nullBitmap := payload[1 : 1+bitmapLength]
+	position := 1 + bitmapLength
+	for i, column := range columns {
+		if nullBitmap[(i+2)/8]&(1<<(uint(i+2)%8)) != 0 {
+			row = append(row, nil)
+			continue
+		}
+		value, _, n, err := readBinaryValue(payload[position:], column.Type, column.Flags&flagUnsigned != 0)
+		if err != nil {
+			return row, err
+		}
+		position += n
+		if value == nil {
+			value = []byte{}
+		}
+		row = append(row, value)
+	}
+	return row, nil
+}
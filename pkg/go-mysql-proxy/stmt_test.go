@@ -0,0 +1,112 @@
+package mysqlProxy
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPreparedStatement_DecodeExecute(t *testing.T) {
+	stmt := &preparedStatement{
+		ID:         1,
+		Query:      []byte("select * from t where id = ? and name = ? and note = ? and score > ? and created > ?"),
+		ParamCount: 5,
+	}
+	payload := []byte{ComStmtExecute, 0x01, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00}
+	// null bitmap: 第三个参数为 NULL
+	payload = append(payload, 0x04, 0x01)
+	payload = append(payload,
+		fieldTypeLongLong, 0x00,
+		fieldTypeVarString, 0x00,
+		fieldTypeVarString, 0x00,
+		fieldTypeDouble, 0x00,
+		fieldTypeDateTime, 0x00)
+	payload = append(payload, 0xfe, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff)
+	payload = append(payload, lenEncString("it's")...)
+	payload = append(payload, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0xf8, 0x3f)
+	payload = append(payload, 0x07, 0xe6, 0x07, 0x0a, 0x12, 0x08, 0x1e, 0x00)
+
+	params, err := stmt.decodeExecute(buildPacket(0, payload...), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"-2", `'it\'s'`, "NULL", "1.5", "'2022-10-18 08:30:00'"}
+	if strings.Join(params, ",") != strings.Join(expected, ",") {
+		t.Fatalf("params should be %v but %v", expected, params)
+	}
+
+	// 再次执行时客户端不再发送参数类型
+	payload = []byte{ComStmtExecute, 0x01, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x1e, 0x00}
+	payload = append(payload, 0x07, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00)
+	params, err = stmt.decodeExecute(buildPacket(0, payload...), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(params) != 5 || params[0] != "7" || params[4] != "NULL" {
+		t.Errorf("unexpected params %v", params)
+	}
+}
+
+func TestPreparedStatement_LongData(t *testing.T) {
+	stmt := &preparedStatement{ID: 2, Query: []byte("insert into t values (?, ?)"), ParamCount: 2}
+	longData := append([]byte{comStmtSendLongData, 0x02, 0x00, 0x00, 0x00, 0x01, 0x00}, "hello"...)
+	stmt.appendLongData(buildPacket(0, longData...))
+	payload := []byte{ComStmtExecute, 0x02, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x01,
+		fieldTypeTiny, 0x80, fieldTypeBLOB, 0x00, 0xff}
+	params, err := stmt.decodeExecute(buildPacket(0, payload...), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := string(interpolateParams(stmt.Query, params, false))
+	if query != "insert into t values (255, 'hello')" {
+		t.Errorf("unexpected query %q", query)
+	}
+}
+
+func TestInterpolateParams(t *testing.T) {
+	query := []byte("select '?', `a?`, \"it\\\"?\" /* ? */ from t where a = ? -- ?\nand b = ? # ?")
+	expected := "select '?', `a?`, \"it\\\"?\" /* ? */ from t where a = 1 -- ?\nand b = NULL # ?"
+	if result := string(interpolateParams(query, []string{"1", "NULL"}, false)); result != expected {
+		t.Errorf("query should be %q but %q", expected, result)
+	}
+	expected = "select * from t where a = '******' and b = NULL"
+	query = []byte("select * from t where a = ? and b = ?")
+	if result := string(interpolateParams(query, []string{"'secret'", "NULL"}, true)); result != expected {
+		t.Errorf("masked query should be %q but %q", expected, result)
+	}
+}
+
+func TestQueryResult_Prepare(t *testing.T) {
+	result := newPrepareResult([]byte("select name from t where id = ?"), false)
+	result.Feed(buildPacket(1, 0x00, 0x05, 0x00, 0x00, 0x00, 0x01, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00))
+	for seq := uint8(2); seq < 6; seq++ {
+		if result.Done() {
+			t.Fatalf("prepare result should skip definitions, seq %d", seq)
+		}
+		result.Feed(buildPacket(seq, columnDefinitionPayload("?")...))
+	}
+	if !result.Done() {
+		t.Fatal("prepare result should be done")
+	}
+	if stmt := result.Statement; stmt == nil || stmt.ID != 5 || stmt.ParamCount != 1 {
+		t.Errorf("unexpected prepared statement %+v", stmt)
+	}
+}
+
+func TestQueryResult_FeedBinaryResultSet(t *testing.T) {
+	result := newExecuteResult([]byte("select id, name from t"), true)
+	result.Feed(buildPacket(1, 0x02))
+	id := columnDefinitionPayload("id")
+	id[len(id)-6] = fieldTypeLong
+	result.Feed(buildPacket(2, id...))
+	result.Feed(buildPacket(3, columnDefinitionPayload("name")...))
+	result.Feed(buildPacket(4, append([]byte{0x00, 0x00, 0x2a, 0x00, 0x00, 0x00}, lenEncString("koko")...)...))
+	result.Feed(buildPacket(5, 0x00, 0x08, 0x00, 0x00, 0x00, 0x00))
+	result.Feed(buildPacket(6, 0xfe, 0x00, 0x00, 0x22, 0x00, 0x00, 0x00))
+	if !result.Done() {
+		t.Fatal("result should be done")
+	}
+	output := result.Output()
+	if !strings.Contains(output, "| 42 | koko |") || !strings.Contains(output, "| 0  | NULL |") {
+		t.Errorf("unexpected result table %q", output)
+	}
+}
@@ -0,0 +1,49 @@
+package mysqlProxy
+
+import "encoding/binary"
+
+const sslRequestPayloadLength = 32
+
+/*
+SSLRequestPacket represents Protocol::SSLRequest, a truncated handshake response
+https://dev.mysql.com/doc/internals/en/connection-phase-packets.html#packet-Protocol::SSLRequest
+*/
+type SSLRequestPacket struct {
+	header          *PacketHeader
+	CapabilityFlags CapabilityFlag
+	MaxPacketSize   uint32
+	CharacterSet    uint8
+}
+
+func isSSLRequestPacket(packet []byte) bool {
+	if len(packet) != 4+sslRequestPayloadLength {
+		return false
+	}
+	flags := CapabilityFlag(binary.LittleEndian.Uint32(packet[4:8]))
+	return flags.Has(clientSSL)
+}
+
+func (r *SSLRequestPacket) Decode(packet []byte) error {
+	if len(packet) < 4+sslRequestPayloadLength {
+		return errMalformedPacket
+	}
+	r.header = &PacketHeader{
+		Length:     sslRequestPayloadLength,
+		SequenceId: packet[3],
+	}
+	payload := packet[4:]
+	r.CapabilityFlags = CapabilityFlag(binary.LittleEndian.Uint32(payload[0:4]))
+	r.MaxPacketSize = binary.LittleEndian.Uint32(payload[4:8])
+	r.CharacterSet = payload[8]
+	return nil
+}
+
+func (r *SSLRequestPacket) Encode() ([]byte, error) {
+	buf := make([]byte, 4+sslRequestPayloadLength)
+	binary.LittleEndian.PutUint32(buf, sslRequestPayloadLength)
+	buf[3] = r.header.SequenceId
+	binary.LittleEndian.PutUint32(buf[4:8], uint32(r.CapabilityFlags))
+	binary.LittleEndian.PutUint32(buf[8:12], r.MaxPacketSize)
+	buf[12] = r.CharacterSet
+	return buf, nil
+}
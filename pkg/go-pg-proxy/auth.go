@@ -0,0 +1,116 @@
+package pgProxy
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+
+	"github.com/lib/pq/scram"
+)
+
+const saslMechanismSCRAM = "SCRAM-SHA-256"
+
+// md5Password computes "md5" + md5(md5(password + user) + salt)
+func md5Password(user, password string, salt []byte) string {
+	inner := md5.Sum([]byte(password + user))
+	outer := md5.Sum(append([]byte(hex.EncodeToString(inner[:])), salt...))
+	return "md5" + hex.EncodeToString(outer[:])
+}
+
+func newPasswordMessage(password string) []byte {
+	return newMessage(msgPassword, append([]byte(password), 0x00))
+}
+
+// decodePasswordMessage 返回 PasswordMessage 中的密码
+func decodePasswordMessage(msg []byte) (string, error) {
+	if getMessageType(msg) != msgPassword {
+		return "", fmt.Errorf("expected password message but got %q", getMessageType(msg))
+	}
+	password, _, err := readCString(getMessageBody(msg), 0)
+	return password, err
+}
+
+// authUpstream 按后端要求的方式完成认证 (cleartext, md5, SCRAM-SHA-256),
+// 返回后端最终的 AuthenticationOk 或 ErrorResponse 消息
+func authUpstream(rw io.ReadWriter, user, password string) ([]byte, error) {
+	var sc *scram.Client
+	for {
+		msg, err := readMessage(rw)
+		if err != nil {
+			return nil, err
+		}
+		switch getMessageType(msg) {
+		case msgErrorResponse:
+			return msg, nil
+		case msgAuthentication:
+		default:
+			return nil, fmt.Errorf("unexpected message %q during authentication", getMessageType(msg))
+		}
+		body := getMessageBody(msg)
+		code, position, err := readInt32(body, 0)
+		if err != nil {
+			return nil, err
+		}
+		var reply []byte
+		switch code {
+		case authOK:
+			return msg, nil
+		case authCleartextPassword:
+			reply = newPasswordMessage(password)
+		case authMD5Password:
+			if len(body) < position+4 {
+				return nil, errMalformedMessage
+			}
+			reply = newPasswordMessage(md5Password(user, password, body[position:position+4]))
+		case authSASL:
+			if !hasSASLMechanism(body[position:], saslMechanismSCRAM) {
+				return nil, fmt.Errorf("unsupported SASL mechanisms %q", body[position:])
+			}
+			sc = scram.NewClient(sha256.New, user, password)
+			sc.Step(nil)
+			if sc.Err() != nil {
+				return nil, sc.Err()
+			}
+			out := sc.Out()
+			data := append([]byte(saslMechanismSCRAM), 0x00, 0x00, 0x00, 0x00, 0x00)
+			binary.BigEndian.PutUint32(data[len(saslMechanismSCRAM)+1:], uint32(len(out)))
+			reply = newMessage(msgPassword, append(data, out...))
+		case authSASLContinue, authSASLFinal:
+			if sc == nil {
+				return nil, fmt.Errorf("unexpected SASL message %d", code)
+			}
+			sc.Step(body[position:])
+			if sc.Err() != nil {
+				return nil, fmt.Errorf("SCRAM-SHA-256: %w", sc.Err())
+			}
+			if code == authSASLFinal {
+				// 等待 AuthenticationOk
+				continue
+			}
+			reply = newMessage(msgPassword, sc.Out())
+		default:
+			return nil, fmt.Errorf("unsupported authentication method %d", code)
+		}
+		if _, err = rw.Write(reply); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func hasSASLMechanism(data []byte, mechanism string) bool {
+	position := 0
+	for position < len(data) && data[position] != 0x00 {
+		name, next, err := readCString(data, position)
+		if err != nil {
+			return false
+		}
+		if name == mechanism {
+			return true
+		}
+		position = next
+	}
+	return false
+}
@@ -0,0 +1,88 @@
+package pgProxy
+
+import (
+	"net"
+	"testing"
+)
+
+func TestMD5Password(t *testing.T) {
+	password := md5Password("postgres", "secret", []byte{0x01, 0x02, 0x03, 0x04})
+	if len(password) != 35 || password[:3] != "md5" {
+		t.Fatalf("unexpected md5 password %s", password)
+	}
+	if password != md5Password("postgres", "secret", []byte{0x01, 0x02, 0x03, 0x04}) {
+		t.Error("md5 password should be stable")
+	}
+	if password == md5Password("postgres", "secret", []byte{0x04, 0x03, 0x02, 0x01}) {
+		t.Error("md5 password should depend on salt")
+	}
+}
+
+func TestHasSASLMechanism(t *testing.T) {
+	data := []byte("SCRAM-SHA-256-PLUS\x00SCRAM-SHA-256\x00\x00")
+	if !hasSASLMechanism(data, saslMechanismSCRAM) {
+		t.Error("SCRAM-SHA-256 should be found")
+	}
+	if hasSASLMechanism([]byte("SCRAM-SHA-256-PLUS\x00\x00"), saslMechanismSCRAM) {
+		t.Error("SCRAM-SHA-256 should not be found")
+	}
+}
+
+// fakeUpstream 模拟后端的认证流程, 要求客户端发送 password 并返回 reply
+func fakeUpstream(t *testing.T, server net.Conn, request []byte, password string, reply []byte) {
+	defer server.Close()
+	if _, err := server.Write(request); err != nil {
+		t.Error(err)
+		return
+	}
+	msg, err := readMessage(server)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	got, err := decodePasswordMessage(msg)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if got != password {
+		t.Errorf("password should be %s but %s", password, got)
+	}
+	_, _ = server.Write(reply)
+}
+
+func TestAuthUpstream_MD5(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	salt := []byte{0x0a, 0x0b, 0x0c, 0x0d}
+	go fakeUpstream(t, server, newAuthenticationMessage(authMD5Password, salt),
+		md5Password("app", "secret", salt), newAuthenticationMessage(authOK, nil))
+
+	msg, err := authUpstream(client, "app", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if getMessageType(msg) != msgAuthentication {
+		t.Errorf("auth result should be AuthenticationOk but %q", msg)
+	}
+}
+
+func TestAuthUpstream_Failed(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	failed := NewErrorResponse(severityFatal, codeInvalidPassword, `password authentication failed for user "app"`)
+	go fakeUpstream(t, server, newAuthenticationMessage(authCleartextPassword, nil),
+		"wrong", failed.Encode())
+
+	msg, err := authUpstream(client, "app", "wrong")
+	if err != nil {
+		t.Fatal(err)
+	}
+	errResponse := ErrorResponse{}
+	if err = errResponse.Decode(msg); err != nil {
+		t.Fatal(err)
+	}
+	if errResponse.Code != codeInvalidPassword {
+		t.Errorf("error code should be %s but %s", codeInvalidPassword, errResponse.Code)
+	}
+}
@@ -0,0 +1,198 @@
+package pgProxy
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/meowgen/koko/pkg/logger"
+)
+
+// relationQuery 查询表的 schema, 表名和所有列, attnum 与 RowDescription 中的列号对应
+const relationQuery = `SELECT n.nspname, c.relname, a.attnum, a.attname FROM pg_catalog.pg_class c
+JOIN pg_catalog.pg_namespace n ON n.oid = c.relnamespace
+JOIN pg_catalog.pg_attribute a ON a.attrelid = c.oid
+WHERE c.oid = %d AND NOT a.attisdropped`
+
+// relation 是结果列来源的表, Columns 按列号记录列名
+type relation struct {
+	Schema  string
+	Table   string
+	Columns map[int]string
+}
+
+// column 返回列号对应的列名, 表或者列不存在时返回 false
+func (r *relation) column(attrNum int) (string, bool) {
+	if r == nil {
+		return "", false
+	}
+	name, ok := r.Columns[attrNum]
+	return name, ok
+}
+
+// catalog 缓存按表 OID 查询的表结构, 同一个 OID 只查询一次, 查询失败时不缓存
+type catalog struct {
+	load func(oid uint32) (*relation, error)
+
+	mu        sync.Mutex
+	relations map[uint32]*relation
+}
+
+func newCatalog(load func(oid uint32) (*relation, error)) *catalog {
+	return &catalog{
+		load:      load,
+		relations: make(map[uint32]*relation),
+	}
+}
+
+// resolve 查询结果列中尚未缓存的来源表, 需在持有 resultMu 之前调用, 避免查询时阻塞其他语句
+func (ct *catalog) resolve(columns []column) {
+	if ct == nil {
+		return
+	}
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	failed := make(map[uint32]bool)
+	for _, c := range columns {
+		if c.TableOID == 0 || failed[c.TableOID] {
+			continue
+		}
+		if _, ok := ct.relations[c.TableOID]; ok {
+			continue
+		}
+		rel, err := ct.load(c.TableOID)
+		if err != nil {
+			logger.Errorf("PostgreSQL proxy load relation %d err: %s", c.TableOID, err)
+			failed[c.TableOID] = true
+			continue
+		}
+		ct.relations[c.TableOID] = rel
+	}
+}
+
+// relation 返回已经缓存的表, 没有查询过或者查询失败时为 nil
+func (ct *catalog) relation(oid uint32) *relation {
+	if ct == nil {
+		return nil
+	}
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	return ct.relations[oid]
+}
+
+// loadRelation 经单独的后端连接查询表结构, 不影响客户端连接上的事务和结果
+func (c *Connection) loadRelation(oid uint32) (*relation, error) {
+	conn, err := c.catalogConnection()
+	if err != nil {
+		return nil, err
+	}
+	_ = conn.SetDeadline(time.Now().Add(dialTimeout))
+	rows, err := simpleQuery(conn, fmt.Sprintf(relationQuery, oid))
+	if err != nil {
+		// 连接的状态未知, 下次查询时重新连接
+		c.closeCatalogConn()
+		return nil, err
+	}
+	_ = conn.SetDeadline(time.Time{})
+	if len(rows) == 0 || len(rows[0]) != 4 {
+		return nil, fmt.Errorf("relation %d not found", oid)
+	}
+	rel := &relation{Schema: rows[0][0], Table: rows[0][1], Columns: make(map[int]string, len(rows))}
+	for _, row := range rows {
+		if len(row) != 4 {
+			return nil, errMalformedMessage
+		}
+		attrNum, err := strconv.Atoi(row[2])
+		if err != nil {
+			return nil, err
+		}
+		rel.Columns[attrNum] = row[3]
+	}
+	return rel, nil
+}
+
+// catalogConnection 返回查询表结构的后端连接, 第一次使用时使用系统用户登录
+func (c *Connection) catalogConnection() (net.Conn, error) {
+	c.mu.Lock()
+	conn := c.catalogConn
+	c.mu.Unlock()
+	if conn != nil {
+		return conn, nil
+	}
+	address := net.JoinHostPort(c.host, c.port)
+	conn, msg, err := c.dialUpstream(address, &StartupMessage{}, c.setCatalogConn)
+	if err == nil && getMessageType(msg) == msgErrorResponse {
+		errResponse := ErrorResponse{}
+		_ = errResponse.Decode(msg)
+		err = &errResponse
+	}
+	if err == nil {
+		_ = conn.SetDeadline(time.Now().Add(dialTimeout))
+		_, err = readUntilReady(conn)
+	}
+	if err != nil {
+		c.closeCatalogConn()
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (c *Connection) setCatalogConn(conn net.Conn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		_ = conn.Close()
+		return
+	}
+	c.catalogConn = conn
+}
+
+func (c *Connection) closeCatalogConn() {
+	c.mu.Lock()
+	conn := c.catalogConn
+	c.catalogConn = nil
+	c.mu.Unlock()
+	if conn != nil {
+		_ = conn.Close()
+	}
+}
+
+// simpleQuery 使用 Query 消息执行语句, 返回文本格式的所有行, NULL 值为空字符串
+func simpleQuery(conn net.Conn, query string) ([][]string, error) {
+	if _, err := conn.Write(newMessage(msgQuery, append([]byte(query), 0x00))); err != nil {
+		return nil, err
+	}
+	return readUntilReady(conn)
+}
+
+// readUntilReady 读取后端消息直到 ReadyForQuery, 返回其中 DataRow 的值
+func readUntilReady(conn net.Conn) ([][]string, error) {
+	var rows [][]string
+	var queryErr error
+	for {
+		msg, err := readMessage(conn)
+		if err != nil {
+			return nil, err
+		}
+		switch getMessageType(msg) {
+		case msgDataRow:
+			values, err := decodeDataRow(getMessageBody(msg))
+			if err != nil {
+				return nil, err
+			}
+			row := make([]string, len(values))
+			for i, value := range values {
+				row[i] = string(value)
+			}
+			rows = append(rows, row)
+		case msgErrorResponse:
+			errResponse := ErrorResponse{}
+			_ = errResponse.Decode(msg)
+			queryErr = &errResponse
+		case msgReadyForQuery:
+			return rows, queryErr
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package pgProxy
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestSimpleQuery(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	go func() {
+		query, err := readMessage(server)
+		if err != nil || getMessageType(query) != msgQuery {
+			return
+		}
+		var stream bytes.Buffer
+		stream.Write(rowDescription("nspname", "relname", "attnum", "attname"))
+		stream.Write(dataRow([]byte("public"), []byte("users"), []byte("2"), []byte("phone")))
+		stream.Write(commandComplete("SELECT 1"))
+		stream.Write(newReadyForQuery('I'))
+		_, _ = server.Write(stream.Bytes())
+
+		if _, err = readMessage(server); err != nil {
+			return
+		}
+		stream.Reset()
+		stream.Write(NewErrorResponse(severityError, codeInsufficientPrivilege, "permission denied").Encode())
+		stream.Write(newReadyForQuery('I'))
+		_, _ = server.Write(stream.Bytes())
+	}()
+
+	rows, err := simpleQuery(client, "select 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := [][]string{{"public", "users", "2", "phone"}}
+	if !reflect.DeepEqual(rows, expected) {
+		t.Errorf("rows should be %v but %v", expected, rows)
+	}
+	var errResponse *ErrorResponse
+	if _, err = simpleQuery(client, "select 1"); !errors.As(err, &errResponse) || errResponse.Code != codeInsufficientPrivilege {
+		t.Errorf("query should fail with error response but %v", err)
+	}
+}
+
+func TestCatalog_Resolve(t *testing.T) {
+	loads := 0
+	ct := newCatalog(func(oid uint32) (*relation, error) {
+		loads++
+		if rel, ok := testRelations[oid]; ok {
+			return rel, nil
+		}
+		return nil, errors.New("relation not found")
+	})
+	columns := []column{{TableOID: usersOID, AttrNum: 2}, {TableOID: usersOID, AttrNum: 3}, {}, {TableOID: 99999}}
+	ct.resolve(columns)
+	ct.resolve(columns)
+	// users 只查询一次, 查询失败的表每次都重新查询
+	if loads != 3 {
+		t.Errorf("catalog should load 3 times but %d", loads)
+	}
+	if name, ok := ct.relation(usersOID).column(2); !ok || name != "phone" {
+		t.Errorf("column 2 should be phone but %q", name)
+	}
+	if _, ok := ct.relation(99999).column(2); ok {
+		t.Error("unknown relation should not have columns")
+	}
+}
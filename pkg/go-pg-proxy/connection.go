@@ -0,0 +1,412 @@
+package pgProxy
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/meowgen/koko/pkg/datamask"
+	"github.com/meowgen/koko/pkg/guardrail"
+	"github.com/meowgen/koko/pkg/jms-sdk-go/model"
+	"github.com/meowgen/koko/pkg/jms-sdk-go/service"
+	"github.com/meowgen/koko/pkg/logger"
+	"github.com/meowgen/koko/pkg/proxybase"
+	"github.com/meowgen/koko/pkg/sqlparser"
+)
+
+const pgPromptFormat = "%s=> "
+
+type Connection struct {
+	conn       net.Conn
+	upstream   net.Conn
+	host       string
+	port       string
+	JmsService *service.JMService
+	FakeServer *FakeServer
+
+	Username    string
+	Password    string
+	Database    string
+	Token       *service.TokenAuthInfoResponse
+	CurrSession *CurrSession
+
+	filter     *proxybase.CommandFilter
+	sqlMatcher *sqlparser.Matcher
+	masker     *datamask.Masker
+	// catalog 按结果列的表 OID 查询来源表, 使用单独的后端连接 catalogConn
+	catalog     *catalog
+	catalogConn net.Conn
+	// guard 是应用的查询限制, txTimer 在事务开始时计时
+	guard   guardrail.Policy
+	guardMu sync.Mutex
+	txTimer *time.Timer
+
+	// 后端下发的 BackendKeyData, 用于转发客户端的 CancelRequest
+	cancelKey string
+
+	// 等待后端响应的语句, 按消息发送的顺序排列
+	resultMu sync.Mutex
+	results  []*queryResult
+
+	mu        sync.Mutex
+	closed    bool
+	closeOnce sync.Once
+	endOnce   sync.Once
+}
+
+func NewConnection(fakeSrv *FakeServer, conn net.Conn) *Connection {
+	return &Connection{
+		conn:       conn,
+		JmsService: fakeSrv.JmsService,
+		FakeServer: fakeSrv,
+		masker:     datamask.ConfigMasker(),
+	}
+}
+
+func (c *Connection) setClientConn(conn net.Conn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.conn = conn
+}
+
+func (c *Connection) setUpstream(conn net.Conn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.upstream = conn
+}
+
+// writeErr 向客户端返回 ErrorResponse
+func (c *Connection) writeErr(severity, code, msg string) {
+	data := NewErrorResponse(severity, code, msg).Encode()
+	if _, err := c.conn.Write(data); err != nil {
+		logger.Errorf("PostgreSQL proxy write error response to %s failed: %s", c.conn.RemoteAddr(), err)
+	}
+}
+
+// Close 关闭客户端和后端 PostgreSQL 连接, 并结束当前会话
+func (c *Connection) Close() {
+	c.closeOnce.Do(func() {
+		c.mu.Lock()
+		conn, upstream, catalogConn := c.conn, c.upstream, c.catalogConn
+		c.closed = true
+		c.catalogConn = nil
+		c.mu.Unlock()
+		if c.CurrSession != nil {
+			c.CurrSession.SwSess.Cancel()
+		}
+		if c.cancelKey != "" {
+			c.FakeServer.removeCancelKey(c.cancelKey)
+		}
+		_ = conn.Close()
+		if upstream != nil {
+			_ = upstream.Close()
+		}
+		if catalogConn != nil {
+			_ = catalogConn.Close()
+		}
+	})
+}
+
+type Request struct {
+	conn     *Connection
+	currSess *CurrSession
+
+	stmts   map[string]*preparedStatement
+	portals map[string]*portal
+
+	// Parse 被拒绝后丢弃直到 Sync 的消息, 错误在 Sync 对应的 ReadyForQuery 之前返回
+	discarding bool
+	deniedErr  []byte
+}
+
+func newRequest(c *Connection) *Request {
+	return &Request{
+		conn:     c,
+		currSess: c.CurrSession,
+		stmts:    make(map[string]*preparedStatement),
+		portals:  make(map[string]*portal),
+	}
+}
+
+// Handle 检查并记录客户端的消息, 返回需要转发到后端的消息, 为空时不转发
+func (req *Request) Handle(msg []byte) []byte {
+	msgType := getMessageType(msg)
+	if req.discarding {
+		switch msgType {
+		case msgSync:
+			req.discarding = false
+			sync := newQueryResult(resultSync, nil)
+			sync.beforeReady, req.deniedErr = req.deniedErr, nil
+			req.conn.pushResult(sync)
+			return msg
+		case msgTerminate:
+			req.conn.endSession()
+			return msg
+		}
+		return nil
+	}
+
+	switch msgType {
+	case msgTerminate:
+		logger.Infof("Session %s: PostgreSQL proxy client terminate", req.currSess.Sess.ID)
+		req.conn.endSession()
+	case msgQuery:
+		query, _, err := readCString(getMessageBody(msg), 0)
+		if err != nil {
+			break
+		}
+		cmdBytes := trimQuery(query)
+		if len(cmdBytes) == 0 {
+			req.conn.pushResult(newQueryResult(resultSimple, nil))
+			break
+		}
+		if errMsg, ok := req.check(cmdBytes); !ok {
+			// 用 Sync 代替被拒绝的语句, 错误在后端返回 ReadyForQuery 之前发送给客户端
+			sync := newQueryResult(resultSync, nil)
+			sync.beforeReady = errMsg
+			req.conn.pushResult(sync)
+			return newMessage(msgSync, nil)
+		}
+		req.conn.recordPrompt(cmdBytes)
+		result := newQueryResult(resultSimple, cmdBytes)
+		result.candidates = req.conn.maskCandidates(query)
+		req.conn.pushResult(result)
+	case msgParse:
+		stmt, err := decodeParse(msg)
+		if err != nil {
+			break
+		}
+		if cmdBytes := trimQuery(stmt.Query); len(cmdBytes) > 0 {
+			if errMsg, ok := req.check(cmdBytes); !ok {
+				req.discarding = true
+				req.deniedErr = errMsg
+				return nil
+			}
+		}
+		req.stmts[stmt.Name] = stmt
+	case msgBind:
+		p, stmt, err := decodeBind(msg, req.stmts)
+		if err != nil {
+			logger.Debugf("Session %s: PostgreSQL proxy decode bind err: %s", req.currSess.Sess.ID, err)
+			break
+		}
+		if stmt == nil {
+			delete(req.portals, p.Name)
+			break
+		}
+		req.portals[p.Name] = p
+	case msgDescribe:
+		// 记录列定义, 之后 Execute 返回的行没有 RowDescription
+		result := newQueryResult(resultDescribe, nil)
+		if kind, name, err := decodeClose(msg); err == nil {
+			if stmt := req.stmts[name]; kind == 'S' && stmt != nil {
+				result.desc = stmt.desc
+				result.candidates = req.conn.maskCandidates(stmt.Query)
+			} else if p := req.portals[name]; kind == 'P' && p != nil {
+				result.desc = p.desc
+				result.candidates = req.conn.maskCandidates(p.Query)
+			}
+		}
+		req.conn.pushResult(result)
+	case msgExecute:
+		var cmdBytes []byte
+		var executed *portal
+		if name, err := decodeExecutePortal(msg); err == nil {
+			if p := req.portals[name]; p != nil {
+				executed = p
+				cmdBytes = trimQuery(interpolateParams(p.Query, p.Params))
+			}
+		}
+		if len(cmdBytes) > 0 {
+			logger.Debugf("Session %s: PostgreSQL proxy execute: %s", req.currSess.Sess.ID, cmdBytes)
+			req.conn.recordPrompt(cmdBytes)
+		}
+		result := newQueryResult(resultExecute, cmdBytes)
+		result.portal = executed
+		req.conn.pushResult(result)
+	case msgSync:
+		req.conn.pushResult(newQueryResult(resultSync, nil))
+	case msgClose:
+		kind, name, err := decodeClose(msg)
+		if err != nil {
+			break
+		}
+		if kind == 'S' {
+			delete(req.stmts, name)
+		} else {
+			delete(req.portals, name)
+		}
+	}
+	return msg
+}
+
+// check 检查语句是否允许执行, 不允许时记录命令并返回发送给客户端的 ErrorResponse
+func (req *Request) check(cmdBytes []byte) ([]byte, bool) {
+	allowed, msg := req.conn.filter.Check(req.conn.CurrSession, string(cmdBytes))
+	if allowed {
+		return nil, true
+	}
+	logger.Infof("Session %s: PostgreSQL proxy forbid command: %s", req.currSess.Sess.ID, cmdBytes)
+	req.conn.recordPrompt(cmdBytes)
+	req.conn.recordReplay([]byte(msg + "\r\n"))
+	req.conn.recordCommand(cmdBytes, msg, nil, nil, model.DangerLevel, time.Now())
+	return NewErrorResponse(severityError, codeInsufficientPrivilege, msg).Encode(), false
+}
+
+// Response 处理后端返回的消息, 只在读取后端的 goroutine 中使用
+type Response struct {
+	conn     *Connection
+	currSess *CurrSession
+}
+
+// Handle 解析后端消息, 需在转发给客户端之前调用; 返回转发给客户端的数据, 为空时不转发,
+// 结果集脱敏时消息可能被改写, 被拒绝语句的错误在 ReadyForQuery 之前返回
+func (res *Response) Handle(msg []byte) []byte {
+	c := res.conn
+	switch getMessageType(msg) {
+	case msgBackendKeyData:
+		body := getMessageBody(msg)
+		if len(body) == 8 && c.cancelKey == "" {
+			c.cancelKey = string(body)
+			c.FakeServer.addCancelKey(c.cancelKey, net.JoinHostPort(c.host, c.port))
+		}
+	case msgReadyForQuery:
+		c.trackTransaction(msg)
+		if prefix := c.completeResults(msg); len(prefix) > 0 {
+			return append(prefix, msg...)
+		}
+	case msgRowDescription:
+		// 在处理结果之前查询列的来源表
+		c.catalog.resolve(decodeRowDescription(getMessageBody(msg)))
+		return c.feedResult(msg)
+	case msgNoData, msgDataRow, msgCommandComplete, msgEmptyQueryResponse,
+		msgPortalSuspended, msgErrorResponse:
+		return c.feedResult(msg)
+	}
+	return msg
+}
+
+func (c *Connection) pushResult(result *queryResult) {
+	result.masker = c.masker
+	result.catalog = c.catalog
+	result.guard = c.guard
+	c.resultMu.Lock()
+	defer c.resultMu.Unlock()
+	c.results = append(c.results, result)
+	c.startStatementTimer(result)
+}
+
+// feedResult 把后端消息交给最早的未完成语句, Execute 完成后立即记录
+func (c *Connection) feedResult(msg []byte) []byte {
+	c.resultMu.Lock()
+	if len(c.results) == 0 || c.results[0].kind == resultSync {
+		c.resultMu.Unlock()
+		return msg
+	}
+	result := c.results[0]
+	msg = result.Feed(msg)
+	done := (result.kind == resultExecute || result.kind == resultDescribe) && result.Done()
+	if done {
+		c.results = c.results[1:]
+	}
+	c.resultMu.Unlock()
+	if done {
+		c.recordResult(result)
+	}
+	return msg
+}
+
+// completeResults 处理 ReadyForQuery, 结束对应的 Query 或 Sync 之前的所有语句
+func (c *Connection) completeResults(msg []byte) []byte {
+	var finished []*queryResult
+	var beforeReady []byte
+	c.resultMu.Lock()
+	for len(c.results) > 0 {
+		result := c.results[0]
+		c.results = c.results[1:]
+		if result.kind == resultSync {
+			beforeReady = result.beforeReady
+			break
+		}
+		if result.kind == resultSimple {
+			result.Feed(msg)
+			finished = append(finished, result)
+			break
+		}
+		// 出错后被后端跳过的 Execute 没有结果
+		if len(result.outputs) > 0 {
+			finished = append(finished, result)
+		}
+	}
+	c.resultMu.Unlock()
+	for _, result := range finished {
+		c.recordResult(result)
+	}
+	return beforeReady
+}
+
+// flushResults 会话结束时记录尚未完成的语句
+func (c *Connection) flushResults() {
+	c.resultMu.Lock()
+	results := c.results
+	c.results = nil
+	c.resultMu.Unlock()
+	for _, result := range results {
+		if result.kind != resultSync {
+			c.recordResult(result)
+		}
+	}
+}
+
+func (c *Connection) recordResult(result *queryResult) {
+	if result.timer != nil {
+		result.timer.Stop()
+	}
+	if len(result.Input) == 0 {
+		return
+	}
+	output := result.Output()
+	if output != "" {
+		c.recordReplay([]byte(output + "\r\n"))
+	}
+	c.recordCommand(result.Input, output, result.maskedColumns(), result.violations, model.NormalLevel,
+		result.CreatedAt)
+}
+
+func (c *Connection) recordPrompt(cmdBytes []byte) {
+	prompt := fmt.Sprintf(pgPromptFormat, c.Database)
+	c.recordReplay(append(append([]byte(prompt), cmdBytes...), '\r', '\n'))
+}
+
+func (c *Connection) recordCommand(input []byte, output string, masked, violations []string, riskLevel int64,
+	createdAt time.Time) {
+	sess := c.CurrSession
+	if sess == nil || sess.CmdRecorder == nil {
+		return
+	}
+	cmd := sess.NewCommand(string(input), output, riskLevel, createdAt)
+	if len(masked) > 0 {
+		cmd.MaskedColumns = masked
+		logger.Infof("Session %s: PostgreSQL proxy masked result of %q: %s",
+			sess.Sess.ID, input, strings.Join(masked, ", "))
+	}
+	if len(violations) > 0 {
+		cmd.Violations = violations
+		logger.Infof("Session %s: PostgreSQL proxy command %q violates guardrail: %s",
+			sess.Sess.ID, input, strings.Join(violations, ", "))
+	}
+	if c.sqlMatcher != nil {
+		sqlparser.TagCommand(cmd, c.sqlMatcher.Classify(string(input)))
+	}
+	sess.CmdRecorder.RecordCommand(cmd)
+}
+
+func (c *Connection) recordReplay(p []byte) {
+	sess := c.CurrSession
+	if sess == nil || sess.ReplRecorder == nil {
+		return
+	}
+	sess.ReplRecorder.Record(p)
+}
@@ -0,0 +1,80 @@
+package pgProxy
+
+// https://www.postgresql.org/docs/current/protocol-message-formats.html
+
+const (
+	protocolVersion3 uint32 = 196608
+
+	sslRequestCode    uint32 = 80877103
+	gssEncRequestCode uint32 = 80877104
+	cancelRequestCode uint32 = 80877102
+
+	maxStartupPacketSize = 10000
+	maxMessageSize       = 1 << 30
+)
+
+// 前端 (客户端) 消息类型
+const (
+	msgQuery     byte = 'Q'
+	msgParse     byte = 'P'
+	msgBind      byte = 'B'
+	msgExecute   byte = 'E'
+	msgSync      byte = 'S'
+	msgClose     byte = 'C'
+	msgDescribe  byte = 'D'
+	msgPassword  byte = 'p'
+	msgTerminate byte = 'X'
+)
+
+// 后端 (服务端) 消息类型
+const (
+	msgAuthentication       byte = 'R'
+	msgBackendKeyData       byte = 'K'
+	msgReadyForQuery        byte = 'Z'
+	msgRowDescription       byte = 'T'
+	msgDataRow              byte = 'D'
+	msgCommandComplete      byte = 'C'
+	msgEmptyQueryResponse   byte = 'I'
+	msgErrorResponse        byte = 'E'
+	msgPortalSuspended      byte = 's'
+	msgParameterDescription byte = 't'
+	msgNoData               byte = 'n'
+	msgNoticeResponse       byte = 'N'
+)
+
+const (
+	authOK                = 0
+	authCleartextPassword = 3
+	authMD5Password       = 5
+	authSASL              = 10
+	authSASLContinue      = 11
+	authSASLFinal         = 12
+)
+
+const (
+	severityError   = "ERROR"
+	severityFatal   = "FATAL"
+	severityWarning = "WARNING"
+
+	// SQLSTATE
+	codeInsufficientPrivilege      = "42501"
+	codeInvalidPassword            = "28P01"
+	codeInvalidAuthSpecification   = "28000"
+	codeProtocolViolation          = "08P01"
+	codeConnectionFailure          = "08006"
+	codeSQLClientUnableToEstablish = "08001"
+	codeWarning                    = "01000"
+	codeIdleInTransactionTimeout   = "25P03"
+)
+
+// 常用类型的 OID, 用于解析 binary 格式的参数和结果
+const (
+	oidBool   uint32 = 16
+	oidBytea  uint32 = 17
+	oidInt8   uint32 = 20
+	oidInt2   uint32 = 21
+	oidInt4   uint32 = 23
+	oidText   uint32 = 25
+	oidFloat4 uint32 = 700
+	oidFloat8 uint32 = 701
+)
@@ -0,0 +1,310 @@
+package pgProxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"math"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// https://www.postgresql.org/docs/current/protocol-flow.html#PROTOCOL-FLOW-EXT-QUERY
+
+const formatBinary = 1
+
+// preparedStatement 记录 Parse 消息中的语句, 名称为空的是未命名语句
+type preparedStatement struct {
+	Name      string
+	Query     string
+	ParamOIDs []uint32
+
+	// desc 由 Describe 语句返回的 RowDescription 填充
+	desc *description
+}
+
+// portal 记录 Bind 消息绑定参数后待执行的语句
+type portal struct {
+	Name   string
+	Query  string
+	Params []string
+	// ResultFormats 是 Bind 指定的结果列格式, 只有一个时用于所有列
+	ResultFormats []int
+
+	stmt *preparedStatement
+	// desc 由 Describe portal 返回的 RowDescription 填充
+	desc *description
+}
+
+func decodeParse(msg []byte) (*preparedStatement, error) {
+	body := getMessageBody(msg)
+	stmt := &preparedStatement{}
+	var err error
+	position := 0
+	if stmt.Name, position, err = readCString(body, position); err != nil {
+		return nil, err
+	}
+	if stmt.Query, position, err = readCString(body, position); err != nil {
+		return nil, err
+	}
+	count, position, err := readInt16(body, position)
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < count; i++ {
+		var oid int32
+		if oid, position, err = readInt32(body, position); err != nil {
+			return nil, err
+		}
+		stmt.ParamOIDs = append(stmt.ParamOIDs, uint32(oid))
+	}
+	stmt.desc = &description{}
+	return stmt, nil
+}
+
+// decodeBind 解析 Bind 消息, 返回 SQL 字面量形式的参数值组成的 portal 和绑定的语句
+func decodeBind(msg []byte, stmts map[string]*preparedStatement) (*portal, *preparedStatement, error) {
+	body := getMessageBody(msg)
+	var portalName, stmtName string
+	var err error
+	position := 0
+	if portalName, position, err = readCString(body, position); err != nil {
+		return nil, nil, err
+	}
+	if stmtName, position, err = readCString(body, position); err != nil {
+		return nil, nil, err
+	}
+	stmt := stmts[stmtName]
+	formats, position, err := readFormatCodes(body, position)
+	if err != nil {
+		return nil, nil, err
+	}
+	formatCount := len(formats)
+	paramCount, position, err := readInt16(body, position)
+	if err != nil {
+		return nil, nil, err
+	}
+	params := make([]string, 0, paramCount)
+	for i := 0; i < paramCount; i++ {
+		var length int32
+		if length, position, err = readInt32(body, position); err != nil {
+			return nil, nil, err
+		}
+		if length < 0 {
+			params = append(params, "NULL")
+			continue
+		}
+		if position+int(length) > len(body) {
+			return nil, nil, errMalformedMessage
+		}
+		value := body[position : position+int(length)]
+		position += int(length)
+
+		format := 0
+		switch {
+		case formatCount == 1:
+			format = formats[0]
+		case i < formatCount:
+			format = formats[i]
+		}
+		if format != formatBinary {
+			params = append(params, quoteLiteral(value))
+			continue
+		}
+		var oid uint32
+		if stmt != nil && i < len(stmt.ParamOIDs) {
+			oid = stmt.ParamOIDs[i]
+		}
+		params = append(params, formatBinaryParam(value, oid))
+	}
+	p := &portal{Name: portalName, Params: params, stmt: stmt, desc: &description{}}
+	if stmt != nil {
+		p.Query = stmt.Query
+	}
+	// 旧版本的客户端可能省略结果列格式
+	if position < len(body) {
+		if p.ResultFormats, _, err = readFormatCodes(body, position); err != nil {
+			return nil, nil, err
+		}
+	}
+	return p, stmt, nil
+}
+
+func readFormatCodes(body []byte, position int) ([]int, int, error) {
+	count, position, err := readInt16(body, position)
+	if err != nil {
+		return nil, position, err
+	}
+	formats := make([]int, count)
+	for i := range formats {
+		if formats[i], position, err = readInt16(body, position); err != nil {
+			return nil, position, err
+		}
+	}
+	return formats, position, nil
+}
+
+// resultFormat 返回第 i 个结果列的格式
+func (p *portal) resultFormat(i int) int {
+	switch {
+	case len(p.ResultFormats) == 1:
+		return p.ResultFormats[0]
+	case i < len(p.ResultFormats):
+		return p.ResultFormats[i]
+	}
+	return 0
+}
+
+func decodeExecutePortal(msg []byte) (string, error) {
+	name, _, err := readCString(getMessageBody(msg), 0)
+	return name, err
+}
+
+// decodeClose 返回关闭的对象类型 ('S' 语句, 'P' portal) 和名称, Describe 消息的格式相同
+func decodeClose(msg []byte) (byte, string, error) {
+	body := getMessageBody(msg)
+	if len(body) < 1 {
+		return 0, "", errMalformedMessage
+	}
+	name, _, err := readCString(body, 1)
+	return body[0], name, err
+}
+
+// formatBinaryValue 把 binary 格式的值按类型转换成文本
+func formatBinaryValue(value []byte, oid uint32) (string, bool) {
+	switch {
+	case oid == oidBool && len(value) == 1:
+		return strconv.FormatBool(value[0] != 0), true
+	case oid == oidInt2 && len(value) == 2:
+		return strconv.FormatInt(int64(int16(binary.BigEndian.Uint16(value))), 10), true
+	case oid == oidInt4 && len(value) == 4:
+		return strconv.FormatInt(int64(int32(binary.BigEndian.Uint32(value))), 10), true
+	case oid == oidInt8 && len(value) == 8:
+		return strconv.FormatInt(int64(binary.BigEndian.Uint64(value)), 10), true
+	case oid == oidFloat4 && len(value) == 4:
+		v := math.Float32frombits(binary.BigEndian.Uint32(value))
+		return strconv.FormatFloat(float64(v), 'g', -1, 32), true
+	case oid == oidFloat8 && len(value) == 8:
+		v := math.Float64frombits(binary.BigEndian.Uint64(value))
+		return strconv.FormatFloat(v, 'g', -1, 64), true
+	}
+	return "\\x" + hex.EncodeToString(value), false
+}
+
+func formatBinaryParam(value []byte, oid uint32) string {
+	text, isNumeric := formatBinaryValue(value, oid)
+	if isNumeric {
+		return text
+	}
+	if oid != oidBytea && oid != 0 && utf8.Valid(value) {
+		return quoteLiteral(value)
+	}
+	return "'" + text + "'"
+}
+
+// quoteLiteral 把文本转换成 SQL 字符串字面量
+func quoteLiteral(value []byte) string {
+	return "'" + strings.ReplaceAll(string(value), "'", "''") + "'"
+}
+
+// interpolateParams 把 SQL 中的 $n 占位符替换成参数值, 忽略字符串, 标识符和注释中的占位符
+func interpolateParams(query string, params []string) string {
+	if len(params) == 0 {
+		return query
+	}
+	var buf strings.Builder
+	for i := 0; i < len(query); i++ {
+		c := query[i]
+		switch {
+		case c == '\'' || c == '"':
+			end := skipQuoted(query, i)
+			buf.WriteString(query[i:end])
+			i = end - 1
+			continue
+		case c == '-' && strings.HasPrefix(query[i:], "--"):
+			end := strings.IndexByte(query[i:], '\n')
+			if end == -1 {
+				end = len(query) - i
+			}
+			buf.WriteString(query[i : i+end])
+			i += end - 1
+			continue
+		case c == '/' && strings.HasPrefix(query[i:], "/*"):
+			end := strings.Index(query[i+2:], "*/")
+			if end == -1 {
+				end = len(query) - i
+			} else {
+				end += 4
+			}
+			buf.WriteString(query[i : i+end])
+			i += end - 1
+			continue
+		case c == '$':
+			j := i + 1
+			for j < len(query) && query[j] >= '0' && query[j] <= '9' {
+				j++
+			}
+			if j > i+1 {
+				n, err := strconv.Atoi(query[i+1 : j])
+				if err == nil && n >= 1 && n <= len(params) {
+					buf.WriteString(params[n-1])
+					i = j - 1
+					continue
+				}
+				break
+			}
+			if end := skipDollarQuoted(query, i); end > i {
+				buf.WriteString(query[i:end])
+				i = end - 1
+				continue
+			}
+		}
+		buf.WriteByte(c)
+	}
+	return buf.String()
+}
+
+// skipQuoted 返回从 start 开始的引号字符串结束后的位置, 同时处理 E 前缀字符串中的反斜杠转义
+func skipQuoted(query string, start int) int {
+	quote := query[start]
+	escape := quote == '\'' && start > 0 && (query[start-1] == 'E' || query[start-1] == 'e')
+	for i := start + 1; i < len(query); i++ {
+		switch query[i] {
+		case '\\':
+			if escape {
+				i++
+			}
+		case quote:
+			if i+1 < len(query) && query[i+1] == quote {
+				i++
+				continue
+			}
+			return i + 1
+		}
+	}
+	return len(query)
+}
+
+// skipDollarQuoted 返回 $tag$...$tag$ 结束后的位置, 不是 dollar quote 时返回 start
+func skipDollarQuoted(query string, start int) int {
+	end := strings.IndexByte(query[start+1:], '$')
+	if end == -1 {
+		return start
+	}
+	tag := query[start : start+end+2]
+	for _, r := range tag[1 : len(tag)-1] {
+		if !(r == '_' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9') {
+			return start
+		}
+	}
+	closing := strings.Index(query[start+len(tag):], tag)
+	if closing == -1 {
+		return len(query)
+	}
+	return start + len(tag) + closing + len(tag)
+}
+
+func trimQuery(query string) []byte {
+	return bytes.TrimSpace([]byte(query))
+}
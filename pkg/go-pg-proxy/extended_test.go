@@ -0,0 +1,111 @@
+package pgProxy
+
+import (
+	"strings"
+	"testing"
+)
+
+func appendInt16(b []byte, v uint16) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
+
+func appendInt32(b []byte, v uint32) []byte {
+	return append(b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func buildBind(portalName, stmtName string, formats []int16, params [][]byte) []byte {
+	body := append([]byte(portalName), 0x00)
+	body = append(body, stmtName...)
+	body = append(body, 0x00)
+	body = appendInt16(body, uint16(len(formats)))
+	for _, f := range formats {
+		body = appendInt16(body, uint16(f))
+	}
+	body = appendInt16(body, uint16(len(params)))
+	for _, p := range params {
+		if p == nil {
+			body = appendInt32(body, 0xffffffff)
+			continue
+		}
+		body = appendInt32(body, uint32(len(p)))
+		body = append(body, p...)
+	}
+	// result format codes
+	body = append(body, 0x00, 0x00)
+	return newMessage(msgBind, body)
+}
+
+func TestDecodeParseAndBind(t *testing.T) {
+	parse := append([]byte("s1\x00select * from t where id = $1 and name = $2 and note = $3\x00"),
+		0x00, 0x03, 0x00, 0x00, 0x00, 0x17, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00)
+	stmt, err := decodeParse(newMessage(msgParse, parse))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stmt.Name != "s1" || len(stmt.ParamOIDs) != 3 || stmt.ParamOIDs[0] != oidInt4 {
+		t.Fatalf("unexpected statement %+v", stmt)
+	}
+	stmts := map[string]*preparedStatement{stmt.Name: stmt}
+
+	bind := buildBind("", "s1", []int16{1, 0, 0},
+		[][]byte{{0x00, 0x00, 0x00, 0x2a}, []byte("it's"), nil})
+	p, bound, err := decodeBind(bind, stmts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Name != "" || p.Query != stmt.Query || bound != stmt {
+		t.Fatalf("unexpected portal %+v or statement %+v", p, bound)
+	}
+	params := p.Params
+	expected := []string{"42", "'it''s'", "NULL"}
+	if strings.Join(params, ",") != strings.Join(expected, ",") {
+		t.Fatalf("params should be %v but %v", expected, params)
+	}
+	query := interpolateParams(stmt.Query, params)
+	if query != "select * from t where id = 42 and name = 'it''s' and note = NULL" {
+		t.Errorf("unexpected query %s", query)
+	}
+
+	_, bound, err = decodeBind(buildBind("p1", "missing", nil, nil), stmts)
+	if err != nil || bound != nil {
+		t.Errorf("unknown statement should not be bound: %v %v", bound, err)
+	}
+}
+
+func TestInterpolateParams(t *testing.T) {
+	params := []string{"1", "'a'"}
+	tests := []struct {
+		query    string
+		expected string
+	}{
+		{"select $1, $2", "select 1, 'a'"},
+		{"select '$1', \"$2\", $2", "select '$1', \"$2\", 'a'"},
+		{"select $1 -- $2\n, $2 /* $1 */", "select 1 -- $2\n, 'a' /* $1 */"},
+		{"select $tag$ $1 $tag$, $$ $2 $$, $1", "select $tag$ $1 $tag$, $$ $2 $$, 1"},
+		{"select E'\\' $1', $3", "select E'\\' $1', $3"},
+	}
+	for _, tt := range tests {
+		if got := interpolateParams(tt.query, params); got != tt.expected {
+			t.Errorf("interpolate %q should be %q but %q", tt.query, tt.expected, got)
+		}
+	}
+}
+
+func TestFormatBinaryParam(t *testing.T) {
+	tests := []struct {
+		value    []byte
+		oid      uint32
+		expected string
+	}{
+		{[]byte{0x01}, oidBool, "true"},
+		{[]byte{0xff, 0xfe}, oidInt2, "-2"},
+		{[]byte{0x3f, 0xf8, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}, oidFloat8, "1.5"},
+		{[]byte{0xde, 0xad}, oidBytea, `'\xdead'`},
+		{[]byte("text"), 25, "'text'"},
+	}
+	for _, tt := range tests {
+		if got := formatBinaryParam(tt.value, tt.oid); got != tt.expected {
+			t.Errorf("binary param %v(%d) should be %s but %s", tt.value, tt.oid, tt.expected, got)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package pgProxy
+
+import (
+	"encoding/binary"
+	"time"
+
+	"github.com/meowgen/koko/pkg/guardrail"
+	"github.com/meowgen/koko/pkg/jms-sdk-go/model"
+	"github.com/meowgen/koko/pkg/logger"
+)
+
+// ReadyForQuery 中的事务状态
+const (
+	txIdle   byte = 'I'
+	txFailed byte = 'E'
+	txActive byte = 'T'
+)
+
+// truncateRow 丢弃超过最大行数的行, 返回是否丢弃
+func (r *queryResult) truncateRow() bool {
+	if r.guard.MaxRows <= 0 || r.rowCount <= r.guard.MaxRows {
+		return false
+	}
+	r.truncated = true
+	return true
+}
+
+// truncatedNotice 结果集被截断时在结束消息之前发送 NoticeResponse 提示客户端
+func (r *queryResult) truncatedNotice(msg []byte) []byte {
+	if !r.truncated {
+		return msg
+	}
+	r.truncated = false
+	notice := r.guard.RowsTruncated()
+	r.outputs = append(r.outputs, notice)
+	r.violate(guardrail.ViolationMaxRows)
+	return append(newNoticeResponse(notice), msg...)
+}
+
+func (r *queryResult) violate(name string) {
+	violation := r.guard.Violation(name)
+	for _, v := range r.violations {
+		if v == violation {
+			return
+		}
+	}
+	r.violations = append(r.violations, violation)
+}
+
+// newNoticeResponse 返回 WARNING 级别的 NoticeResponse, 字段与 ErrorResponse 相同
+func newNoticeResponse(msg string) []byte {
+	notice := NewErrorResponse(severityWarning, codeWarning, msg).Encode()
+	notice[0] = msgNoticeResponse
+	return notice
+}
+
+// newCancelRequest 返回取消后端正在执行的语句的 CancelRequest
+func newCancelRequest(cancelKey string) []byte {
+	packet := make([]byte, 8, 16)
+	binary.BigEndian.PutUint32(packet[0:4], 16)
+	binary.BigEndian.PutUint32(packet[4:8], cancelRequestCode)
+	return append(packet, cancelKey...)
+}
+
+// startStatementTimer 语句超时后向后端发送 CancelRequest
+func (c *Connection) startStatementTimer(result *queryResult) {
+	if c.guard.StatementTimeout <= 0 || len(result.Input) == 0 {
+		return
+	}
+	result.timer = time.AfterFunc(c.guard.StatementTimeout, func() {
+		c.resultMu.Lock()
+		running := false
+		for _, pending := range c.results {
+			if pending == result && !result.done {
+				running = true
+				result.outputs = append(result.outputs, c.guard.StatementTimedOut())
+				result.violate(guardrail.ViolationStatementTimeout)
+				break
+			}
+		}
+		c.resultMu.Unlock()
+		if !running {
+			return
+		}
+		logger.Infof("Session %s: PostgreSQL proxy statement exceeded %s, send cancel request",
+			c.CurrSession.Sess.ID, c.guard.StatementTimeout)
+		if c.cancelKey == "" {
+			logger.Errorf("Session %s: PostgreSQL proxy cancel statement err: no backend key data",
+				c.CurrSession.Sess.ID)
+			return
+		}
+		if err := c.FakeServer.cancelRequest(newCancelRequest(c.cancelKey)); err != nil {
+			logger.Errorf("Session %s: PostgreSQL proxy cancel statement err: %s", c.CurrSession.Sess.ID, err)
+		}
+	})
+}
+
+// trackTransaction 按 ReadyForQuery 的事务状态开始或停止事务计时, 事务超时后断开后端连接, 由后端回滚事务
+func (c *Connection) trackTransaction(msg []byte) {
+	body := getMessageBody(msg)
+	if c.guard.TransactionTimeout <= 0 || len(body) != 1 {
+		return
+	}
+	inTrans := body[0] == txActive || body[0] == txFailed
+	c.guardMu.Lock()
+	defer c.guardMu.Unlock()
+	switch {
+	case inTrans && c.txTimer == nil:
+		c.txTimer = time.AfterFunc(c.guard.TransactionTimeout, c.transactionTimeout)
+	case body[0] == txIdle && c.txTimer != nil:
+		c.txTimer.Stop()
+		c.txTimer = nil
+	}
+}
+
+func (c *Connection) transactionTimeout() {
+	msg := c.guard.TransactionTimedOut()
+	logger.Infof("Session %s: PostgreSQL proxy %s, close connection", c.CurrSession.Sess.ID, msg)
+	c.writeErr(severityFatal, codeIdleInTransactionTimeout, msg)
+	c.recordReplay([]byte(msg + "\r\n"))
+	violations := []string{c.guard.Violation(guardrail.ViolationTransactionTimeout)}
+	c.recordCommand([]byte("ROLLBACK"), msg, nil, violations, model.NormalLevel, time.Now())
+	c.Close()
+}
+
+func (c *Connection) stopGuardTimers() {
+	c.guardMu.Lock()
+	defer c.guardMu.Unlock()
+	if c.txTimer != nil {
+		c.txTimer.Stop()
+		c.txTimer = nil
+	}
+}
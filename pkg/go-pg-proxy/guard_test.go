@@ -0,0 +1,55 @@
+package pgProxy
+
+import (
+	"encoding/binary"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/meowgen/koko/pkg/guardrail"
+	"github.com/meowgen/koko/pkg/jms-sdk-go/model"
+	"github.com/meowgen/koko/pkg/proxybase"
+	"github.com/meowgen/koko/pkg/sqlparser"
+)
+
+func TestResponse_TruncateRows(t *testing.T) {
+	c := &Connection{
+		CurrSession: &CurrSession{Sess: &model.Session{}},
+		sqlMatcher:  sqlparser.NewMatcher(sqlparser.DialectPostgreSQL, "shop"),
+		filter:      proxybase.NewCommandFilter(proxyName, nil, nil, proxybase.MatchRules),
+		guard:       guardrail.Policy{MaxRows: 2},
+	}
+	req, res := newRequest(c), &Response{conn: c}
+	req.Handle(newMessage(msgQuery, []byte("select name from users\x00")))
+	res.Handle(typedRowDescription([]string{"name"}, []uint32{oidText}))
+	for i, name := range []string{"a", "b", "c", "d"} {
+		msg := res.Handle(dataRow([]byte(name)))
+		if dropped := msg == nil; dropped != (i >= 2) {
+			t.Errorf("row %q dropped: %v", name, dropped)
+		}
+	}
+	result := c.results[0]
+	msg := res.Handle(commandComplete("SELECT 4"))
+	if getMessageType(msg) != msgNoticeResponse {
+		t.Fatalf("notice should be sent before CommandComplete but %q", msg[0])
+	}
+	notice := ErrorResponse{}
+	_ = notice.Decode(append([]byte{msgErrorResponse}, msg[1:]...))
+	if notice.Severity != severityWarning || !strings.Contains(notice.Message, "truncated to 2 rows") {
+		t.Errorf("unexpected notice %+v", notice)
+	}
+	if rest := msg[1+binary.BigEndian.Uint32(msg[1:5]):]; getMessageType(rest) != msgCommandComplete {
+		t.Errorf("CommandComplete should follow the notice but %q", rest[0])
+	}
+	res.Handle(newReadyForQuery('I'))
+	if expected := []string{"max_rows=2"}; !reflect.DeepEqual(result.violations, expected) {
+		t.Errorf("violations should be %v but %v", expected, result.violations)
+	}
+}
+
+func TestNewCancelRequest(t *testing.T) {
+	packet := newCancelRequest("\x00\x00\x00\x01\x00\x00\x00\x02")
+	if len(packet) != 16 || getStartupCode(packet) != cancelRequestCode {
+		t.Errorf("unexpected cancel request %v", packet)
+	}
+}
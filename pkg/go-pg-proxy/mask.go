@@ -0,0 +1,181 @@
+package pgProxy
+
+import (
+	"encoding/binary"
+	"strings"
+
+	"github.com/meowgen/koko/pkg/datamask"
+)
+
+// description 是 Describe 返回的列定义和脱敏计划, 用于之后 Execute 返回的行
+type description struct {
+	columns []column
+	maskSet *datamask.ResultSet
+}
+
+// textOIDs 是字符串类型的 OID, 只有字符串的值使用 VALUE 规则
+var textOIDs = map[uint32]bool{
+	19:   true, // name
+	25:   true, // text
+	114:  true, // json
+	142:  true, // xml
+	1042: true, // bpchar
+	1043: true, // varchar
+	3802: true, // jsonb
+}
+
+// maskCandidates 返回语句读取的表, 用于判断表达式的列是否需要脱敏
+func (c *Connection) maskCandidates(query string) []datamask.Column {
+	if c.masker == nil || c.sqlMatcher == nil {
+		return nil
+	}
+	var candidates []datamask.Column
+	for _, stmt := range c.sqlMatcher.Classify(query) {
+		for _, target := range stmt.Targets {
+			schema, table := "", target
+			if i := strings.LastIndexByte(target, '.'); i >= 0 {
+				schema, table = target[:i], target[i+1:]
+			}
+			candidates = append(candidates, datamask.Column{Schema: schema, Table: table})
+		}
+	}
+	return candidates
+}
+
+// newMaskSet 按 RowDescription 中列的来源表和列号创建脱敏计划, 列名可能是别名, 不用于匹配规则.
+// 表达式的列按语句读取的表判断, 来源表查询失败的列整列脱敏
+func (r *queryResult) newMaskSet() *datamask.ResultSet {
+	rs := r.masker.NewResultSet()
+	if rs == nil {
+		return nil
+	}
+	for _, c := range r.columns {
+		col := datamask.Column{Name: c.Name, Text: textOIDs[c.OID]}
+		if c.TableOID == 0 {
+			rs.AddDerivedColumn(col, r.candidates)
+			continue
+		}
+		rel := r.catalog.relation(c.TableOID)
+		name, ok := rel.column(c.AttrNum)
+		if !ok {
+			rs.AddUnknownColumn(col)
+			continue
+		}
+		col.Schema, col.Table, col.Name = rel.Schema, rel.Table, name
+		rs.AddColumn(col)
+	}
+	return rs
+}
+
+// maskRowDescription 把需要脱敏的非字符串列改为 text 类型, 客户端按字符串解析脱敏后的值
+func (r *queryResult) maskRowDescription(msg []byte) []byte {
+	if !r.maskSet.Active() {
+		return msg
+	}
+	var masked []byte
+	body := getMessageBody(msg)
+	position := 2
+	for i, c := range r.columns {
+		_, next, err := readCString(body, position)
+		if err != nil || next+18 > len(body) {
+			break
+		}
+		position = next + 18
+		if !r.maskSet.MaskColumn(i) || textOIDs[c.OID] {
+			continue
+		}
+		if masked == nil {
+			masked = append([]byte(nil), msg...)
+		}
+		// type oid(4), type size(2), type modifier(4)
+		field := masked[5+next+6:]
+		binary.BigEndian.PutUint32(field[0:4], oidText)
+		binary.BigEndian.PutUint16(field[4:6], 0xffff)
+		binary.BigEndian.PutUint32(field[6:10], 0xffffffff)
+	}
+	if masked == nil {
+		return msg
+	}
+	return masked
+}
+
+// useDescription 使用之前 Describe 返回的列定义, Describe 语句时结果列格式由 Bind 指定
+func (r *queryResult) useDescription() {
+	p := r.portal
+	desc := p.desc
+	fromStmt := false
+	if desc.columns == nil && p.stmt != nil {
+		desc = p.stmt.desc
+		fromStmt = true
+	}
+	if desc.columns == nil {
+		return
+	}
+	r.columns = make([]column, len(desc.columns))
+	copy(r.columns, desc.columns)
+	if fromStmt {
+		for i := range r.columns {
+			r.columns[i].Format = p.resultFormat(i)
+		}
+	}
+	r.maskSet = desc.maskSet
+}
+
+// feedMaskedRow 对 DataRow 脱敏, 无法解析的行替换为 NULL, 不把原始的值返回给客户端
+func (r *queryResult) feedMaskedRow(msg []byte) []byte {
+	row, err := decodeDataRow(getMessageBody(msg))
+	if err != nil || len(row) != len(r.columns) {
+		return nullDataRow(len(r.columns))
+	}
+	changed := false
+	for i, value := range row {
+		if value == nil {
+			continue
+		}
+		c := r.columns[i]
+		if c.Format == formatBinary && !textOIDs[c.OID] {
+			if !r.maskSet.MaskColumn(i) {
+				continue
+			}
+			text, _ := formatBinaryValue(value, c.OID)
+			value = []byte(text)
+		}
+		if masked, ok := r.maskSet.Mask(i, value); ok {
+			row[i] = masked
+			changed = true
+		}
+	}
+	if len(r.rows) < maxPreviewRows {
+		r.rows = append(r.rows, row)
+	}
+	if !changed {
+		return msg
+	}
+	return encodeDataRow(row)
+}
+
+func encodeDataRow(row [][]byte) []byte {
+	body := make([]byte, 2, 2+len(row)*8)
+	binary.BigEndian.PutUint16(body, uint16(len(row)))
+	for _, value := range row {
+		length := make([]byte, 4)
+		if value == nil {
+			binary.BigEndian.PutUint32(length, 0xffffffff)
+			body = append(body, length...)
+			continue
+		}
+		binary.BigEndian.PutUint32(length, uint32(len(value)))
+		body = append(append(body, length...), value...)
+	}
+	return newMessage(msgDataRow, body)
+}
+
+// nullDataRow 返回所有列都为 NULL 的行, 用于无法脱敏的行
+func nullDataRow(count int) []byte {
+	return encodeDataRow(make([][]byte, count))
+}
+
+// maskedColumns 返回所有结果集实际执行的脱敏
+func (r *queryResult) maskedColumns() []string {
+	return datamask.MergeApplied(r.masked, r.maskSet.Applied()...)
+}
@@ -0,0 +1,178 @@
+package pgProxy
+
+import (
+	"encoding/binary"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/meowgen/koko/pkg/datamask"
+	"github.com/meowgen/koko/pkg/jms-sdk-go/model"
+	"github.com/meowgen/koko/pkg/proxybase"
+	"github.com/meowgen/koko/pkg/sqlparser"
+)
+
+// usersOID 是测试中 public.users 表的 OID
+const usersOID uint32 = 16384
+
+var testRelations = map[uint32]*relation{
+	usersOID: {Schema: "public", Table: "users", Columns: map[int]string{1: "id", 2: "phone", 3: "name", 4: "note"}},
+}
+
+func newMaskConnection(t *testing.T, content string) *Connection {
+	policies, err := datamask.ParsePolicies(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Connection{
+		Database:    "shop",
+		CurrSession: &CurrSession{Sess: &model.Session{}},
+		sqlMatcher:  sqlparser.NewMatcher(sqlparser.DialectPostgreSQL, "shop"),
+		filter:      proxybase.NewCommandFilter(proxyName, nil, nil, proxybase.MatchRules),
+		masker:      datamask.NewMasker(policies),
+		catalog: newCatalog(func(oid uint32) (*relation, error) {
+			if rel, ok := testRelations[oid]; ok {
+				return rel, nil
+			}
+			return nil, errors.New("relation not found")
+		}),
+	}
+}
+
+// sourceColumn 是结果列的来源表和列号, 表达式的列为空
+type sourceColumn struct {
+	tableOID uint32
+	attrNum  uint16
+}
+
+func typedRowDescription(names []string, oids []uint32, sources ...sourceColumn) []byte {
+	body := appendInt16(nil, uint16(len(names)))
+	for i, name := range names {
+		body = append(body, name...)
+		body = append(body, 0x00)
+		var source sourceColumn
+		if i < len(sources) {
+			source = sources[i]
+		}
+		body = appendInt32(body, source.tableOID)
+		body = appendInt16(body, source.attrNum)
+		body = appendInt32(body, oids[i])
+		body = append(body, 0, 4, 0xff, 0xff, 0xff, 0xff, 0, 0)
+	}
+	return newMessage(msgRowDescription, body)
+}
+
+func TestResponse_MaskSimpleQuery(t *testing.T) {
+	c := newMaskConnection(t, "mask COLUMN users.id\npartial(3,4) COLUMN public.users.phone")
+	req, res := newRequest(c), &Response{conn: c}
+	req.Handle(newMessage(msgQuery, []byte("select id, phone, name from users\x00")))
+
+	msg := res.Handle(typedRowDescription([]string{"id", "phone", "name"}, []uint32{oidInt4, oidText, oidText},
+		sourceColumn{usersOID, 1}, sourceColumn{usersOID, 2}, sourceColumn{usersOID, 3}))
+	columns := decodeRowDescription(getMessageBody(msg))
+	if columns[0].OID != oidText || columns[1].OID != oidText {
+		t.Errorf("masked columns should be text: %+v", columns)
+	}
+	msg = res.Handle(dataRow([]byte("42"), []byte("13800138000"), []byte("alice")))
+	row, err := decodeDataRow(getMessageBody(msg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := [][]byte{[]byte("******"), []byte("138****8000"), []byte("alice")}
+	if !reflect.DeepEqual(row, expected) {
+		t.Errorf("masked row should be %q but %q", expected, row)
+	}
+	result := c.results[0]
+	res.Handle(commandComplete("SELECT 1"))
+	res.Handle(newReadyForQuery('I'))
+	masked := []string{"public.users.id: mask", "public.users.phone: partial(3,4)"}
+	if !reflect.DeepEqual(result.maskedColumns(), masked) {
+		t.Errorf("masked columns should be %v but %v", masked, result.maskedColumns())
+	}
+}
+
+func TestResponse_MaskExtendedQuery(t *testing.T) {
+	c := newMaskConnection(t, "hash COLUMN *.users.id\nmask VALUE \\d{11}")
+	req, res := newRequest(c), &Response{conn: c}
+	req.Handle(newMessage(msgParse, []byte("s1\x00select id, note from users where id > $1\x00\x00\x00")))
+	req.Handle(newMessage(msgDescribe, []byte("Ss1\x00")))
+	req.Handle(newMessage(msgSync, nil))
+
+	msg := res.Handle(typedRowDescription([]string{"id", "note"}, []uint32{oidInt4, oidText},
+		sourceColumn{usersOID, 1}, sourceColumn{usersOID, 4}))
+	if columns := decodeRowDescription(getMessageBody(msg)); columns[0].OID != oidText {
+		t.Errorf("masked column should be text: %+v", columns[0])
+	}
+	res.Handle(newReadyForQuery('I'))
+
+	// Bind 指定所有结果列使用 binary 格式
+	bind := buildBind("", "s1", nil, nil)
+	bind = newMessage(msgBind, append(getMessageBody(bind)[:len(getMessageBody(bind))-2], 0x00, 0x01, 0x00, 0x01))
+	req.Handle(bind)
+	req.Handle(newMessage(msgExecute, []byte("\x00\x00\x00\x00\x00")))
+	req.Handle(newMessage(msgSync, nil))
+
+	id := make([]byte, 4)
+	binary.BigEndian.PutUint32(id, 42)
+	msg = res.Handle(dataRow(id, []byte("call 13800138000")))
+	row, err := decodeDataRow(getMessageBody(msg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash := "73475cb40a568e8da8a045ced110137e159f890ac4da883b6b17dc651b3a8049"
+	if string(row[0]) != hash || string(row[1]) != "call ******" {
+		t.Errorf("unexpected masked row %q", row)
+	}
+}
+
+func TestResponse_MaskWithoutDescription(t *testing.T) {
+	c := newMaskConnection(t, "mask COLUMN phone")
+	req, res := newRequest(c), &Response{conn: c}
+	req.Handle(newMessage(msgExecute, []byte("missing\x00\x00\x00\x00\x00")))
+	msg := res.Handle(dataRow([]byte("13800138000")))
+	if row, err := decodeDataRow(getMessageBody(msg)); err != nil || len(row) != 1 || row[0] != nil {
+		t.Errorf("row without description should be NULL but %q", row)
+	}
+}
+
+func TestResponse_MaskAliasAndExpression(t *testing.T) {
+	tests := []struct {
+		name    string
+		query   string
+		columns []string
+		sources []sourceColumn
+		masked  []bool
+	}{
+		{"alias", "select phone as p, name from users", []string{"p", "name"},
+			[]sourceColumn{{usersOID, 2}, {usersOID, 3}}, []bool{true, false}},
+		{"expression", "select phone||'' from users", []string{"?column?"},
+			nil, []bool{true}},
+		{"parenthesized alias", "select (phone) x from users", []string{"x"},
+			[]sourceColumn{{usersOID, 2}}, []bool{true}},
+		{"expression without table", "select '13800138000' as phone2", []string{"phone2"},
+			nil, []bool{false}},
+		{"unknown table", "select phone from archived", []string{"phone"},
+			[]sourceColumn{{99999, 2}}, []bool{true}},
+	}
+	for _, tt := range tests {
+		c := newMaskConnection(t, "partial(3,4) COLUMN public.users.phone")
+		req, res := newRequest(c), &Response{conn: c}
+		req.Handle(newMessage(msgQuery, append([]byte(tt.query), 0x00)))
+		oids := make([]uint32, len(tt.columns))
+		values := make([][]byte, len(tt.columns))
+		for i := range tt.columns {
+			oids[i] = oidText
+			values[i] = []byte("13800138000")
+		}
+		res.Handle(typedRowDescription(tt.columns, oids, tt.sources...))
+		row, err := decodeDataRow(getMessageBody(res.Handle(dataRow(values...))))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, masked := range tt.masked {
+			if got := string(row[i]) != "13800138000"; got != masked {
+				t.Errorf("%s: column %s masked = %v, want %v", tt.name, tt.columns[i], got, masked)
+			}
+		}
+	}
+}
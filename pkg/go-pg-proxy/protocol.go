@@ -0,0 +1,256 @@
+package pgProxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+var errMalformedMessage = errors.New("malformed message")
+
+// readStartupPacket reads the untyped packet sent by the client before startup completes,
+// such as StartupMessage, SSLRequest and CancelRequest
+func readStartupPacket(r io.Reader) ([]byte, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	length := binary.BigEndian.Uint32(header)
+	if length < 8 || length > maxStartupPacketSize {
+		return nil, fmt.Errorf("invalid startup packet length %d", length)
+	}
+	data := make([]byte, length)
+	copy(data, header)
+	if _, err := io.ReadFull(r, data[4:]); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func getStartupCode(packet []byte) uint32 {
+	return binary.BigEndian.Uint32(packet[4:8])
+}
+
+// readMessage reads one whole typed message, type and length included
+func readMessage(r io.Reader) ([]byte, error) {
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	length := binary.BigEndian.Uint32(header[1:])
+	if length < 4 || length > maxMessageSize {
+		return nil, fmt.Errorf("invalid message length %d", length)
+	}
+	data := make([]byte, 1+length)
+	copy(data, header)
+	if _, err := io.ReadFull(r, data[5:]); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func getMessageType(msg []byte) byte {
+	return msg[0]
+}
+
+func getMessageBody(msg []byte) []byte {
+	return msg[5:]
+}
+
+// newMessage prepends the message type and length to the body
+func newMessage(msgType byte, body []byte) []byte {
+	msg := make([]byte, 5, 5+len(body))
+	msg[0] = msgType
+	binary.BigEndian.PutUint32(msg[1:5], uint32(4+len(body)))
+	return append(msg, body...)
+}
+
+func readCString(b []byte, position int) (string, int, error) {
+	if position > len(b) {
+		return "", position, errMalformedMessage
+	}
+	index := bytes.IndexByte(b[position:], 0x00)
+	if index == -1 {
+		return "", position, errMalformedMessage
+	}
+	return string(b[position : position+index]), position + index + 1, nil
+}
+
+func readInt16(b []byte, position int) (int, int, error) {
+	if position+2 > len(b) {
+		return 0, position, errMalformedMessage
+	}
+	return int(binary.BigEndian.Uint16(b[position:])), position + 2, nil
+}
+
+func readInt32(b []byte, position int) (int32, int, error) {
+	if position+4 > len(b) {
+		return 0, position, errMalformedMessage
+	}
+	return int32(binary.BigEndian.Uint32(b[position:])), position + 4, nil
+}
+
+/*
+StartupMessage represents the StartupMessage sent by the client
+https://www.postgresql.org/docs/current/protocol-message-formats.html
+*/
+type StartupMessage struct {
+	ProtocolVersion uint32
+	Parameters      []StartupParameter
+}
+
+type StartupParameter struct {
+	Name  string
+	Value string
+}
+
+func (r *StartupMessage) Decode(packet []byte) error {
+	if len(packet) < 8 {
+		return errMalformedMessage
+	}
+	r.ProtocolVersion = getStartupCode(packet)
+	if r.ProtocolVersion != protocolVersion3 {
+		return fmt.Errorf("unsupported protocol version %d.%d",
+			r.ProtocolVersion>>16, r.ProtocolVersion&0xffff)
+	}
+	body := packet[8:]
+	position := 0
+	for position < len(body) && body[position] != 0x00 {
+		var name, value string
+		var err error
+		if name, position, err = readCString(body, position); err != nil {
+			return err
+		}
+		if value, position, err = readCString(body, position); err != nil {
+			return err
+		}
+		r.Parameters = append(r.Parameters, StartupParameter{Name: name, Value: value})
+	}
+	return nil
+}
+
+func (r *StartupMessage) Get(name string) string {
+	for _, param := range r.Parameters {
+		if param.Name == name {
+			return param.Value
+		}
+	}
+	return ""
+}
+
+func (r *StartupMessage) Set(name, value string) {
+	for i := range r.Parameters {
+		if r.Parameters[i].Name == name {
+			r.Parameters[i].Value = value
+			return
+		}
+	}
+	r.Parameters = append(r.Parameters, StartupParameter{Name: name, Value: value})
+}
+
+func (r *StartupMessage) Encode() []byte {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint32(buf[4:8], r.ProtocolVersion)
+	for _, param := range r.Parameters {
+		buf = append(buf, param.Name...)
+		buf = append(buf, 0x00)
+		buf = append(buf, param.Value...)
+		buf = append(buf, 0x00)
+	}
+	buf = append(buf, 0x00)
+	binary.BigEndian.PutUint32(buf[0:4], uint32(len(buf)))
+	return buf
+}
+
+func newSSLRequest() []byte {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint32(buf[0:4], 8)
+	binary.BigEndian.PutUint32(buf[4:8], sslRequestCode)
+	return buf
+}
+
+func newAuthenticationMessage(code int32, data []byte) []byte {
+	body := make([]byte, 4, 4+len(data))
+	binary.BigEndian.PutUint32(body, uint32(code))
+	return newMessage(msgAuthentication, append(body, data...))
+}
+
+func newReadyForQuery(status byte) []byte {
+	return newMessage(msgReadyForQuery, []byte{status})
+}
+
+/*
+ErrorResponse represents ErrorResponse message, only the common fields are kept
+https://www.postgresql.org/docs/current/protocol-error-fields.html
+*/
+type ErrorResponse struct {
+	Severity string
+	Code     string
+	Message  string
+	Detail   string
+}
+
+func NewErrorResponse(severity, code, msg string) *ErrorResponse {
+	return &ErrorResponse{
+		Severity: severity,
+		Code:     code,
+		Message:  msg,
+	}
+}
+
+func (r *ErrorResponse) Decode(msg []byte) error {
+	if len(msg) < 5 || getMessageType(msg) != msgErrorResponse {
+		return errMalformedMessage
+	}
+	body := getMessageBody(msg)
+	position := 0
+	for position < len(body) && body[position] != 0x00 {
+		field := body[position]
+		value, next, err := readCString(body, position+1)
+		if err != nil {
+			return err
+		}
+		position = next
+		switch field {
+		case 'S':
+			r.Severity = value
+		case 'C':
+			r.Code = value
+		case 'M':
+			r.Message = value
+		case 'D':
+			r.Detail = value
+		}
+	}
+	return nil
+}
+
+func (r *ErrorResponse) Encode() []byte {
+	body := make([]byte, 0, len(r.Message)+32)
+	fields := []struct {
+		field byte
+		value string
+	}{
+		{'S', r.Severity},
+		{'V', r.Severity},
+		{'C', r.Code},
+		{'M', r.Message},
+		{'D', r.Detail},
+	}
+	for _, f := range fields {
+		if f.value == "" {
+			continue
+		}
+		body = append(body, f.field)
+		body = append(body, f.value...)
+		body = append(body, 0x00)
+	}
+	body = append(body, 0x00)
+	return newMessage(msgErrorResponse, body)
+}
+
+func (r *ErrorResponse) Error() string {
+	return fmt.Sprintf("%s: %s (SQLSTATE %s)", r.Severity, r.Message, r.Code)
+}
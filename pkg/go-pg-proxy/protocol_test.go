@@ -0,0 +1,80 @@
+package pgProxy
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestStartupMessage(t *testing.T) {
+	startup := &StartupMessage{ProtocolVersion: protocolVersion3}
+	startup.Set("user", "token")
+	startup.Set("database", "postgres")
+	startup.Set("application_name", "psql")
+	startup.Set("database", "app")
+
+	packet, err := readStartupPacket(bytes.NewReader(startup.Encode()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if getStartupCode(packet) != protocolVersion3 {
+		t.Fatalf("startup code should be %d but %d", protocolVersion3, getStartupCode(packet))
+	}
+	decoded := &StartupMessage{}
+	if err = decoded.Decode(packet); err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded.Parameters) != 3 {
+		t.Fatalf("parameters should be 3 but %v", decoded.Parameters)
+	}
+	if decoded.Get("user") != "token" || decoded.Get("database") != "app" ||
+		decoded.Get("application_name") != "psql" {
+		t.Errorf("unexpected parameters %v", decoded.Parameters)
+	}
+}
+
+func TestReadStartupPacket_SSLRequest(t *testing.T) {
+	packet, err := readStartupPacket(bytes.NewReader(newSSLRequest()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if getStartupCode(packet) != sslRequestCode {
+		t.Errorf("startup code should be SSLRequest but %d", getStartupCode(packet))
+	}
+	if _, err = readStartupPacket(bytes.NewReader([]byte{0x7f, 0x00, 0x00, 0x00})); err == nil {
+		t.Error("oversize startup packet should be rejected")
+	}
+}
+
+func TestReadMessage(t *testing.T) {
+	var buf bytes.Buffer
+	buf.Write(newMessage(msgQuery, []byte("select 1\x00")))
+	buf.Write(newMessage(msgSync, nil))
+	msg, err := readMessage(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query, _, err := readCString(getMessageBody(msg), 0)
+	if err != nil || getMessageType(msg) != msgQuery || query != "select 1" {
+		t.Fatalf("unexpected query message %q", msg)
+	}
+	msg, err = readMessage(&buf)
+	if err != nil || getMessageType(msg) != msgSync || len(getMessageBody(msg)) != 0 {
+		t.Fatalf("unexpected sync message %q", msg)
+	}
+}
+
+func TestErrorResponse(t *testing.T) {
+	errResponse := NewErrorResponse(severityError, codeInsufficientPrivilege, "Command `drop` is forbidden")
+	errResponse.Detail = "rule deny"
+	decoded := ErrorResponse{}
+	if err := decoded.Decode(errResponse.Encode()); err != nil {
+		t.Fatal(err)
+	}
+	if decoded != *errResponse {
+		t.Errorf("error response should be %+v but %+v", *errResponse, decoded)
+	}
+	expected := "ERROR: Command `drop` is forbidden (SQLSTATE 42501)"
+	if decoded.Error() != expected {
+		t.Errorf("error should be %q but %q", expected, decoded.Error())
+	}
+}
@@ -0,0 +1,296 @@
+package pgProxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/olekukonko/tablewriter"
+
+	"github.com/meowgen/koko/pkg/datamask"
+	"github.com/meowgen/koko/pkg/guardrail"
+)
+
+const (
+	maxPreviewRows      = 10
+	maxPreviewCellWidth = 64
+	maxOutputLength     = 4096
+)
+
+type resultKind int
+
+const (
+	// resultSimple 对应 Query 消息, 以 ReadyForQuery 结束
+	resultSimple resultKind = iota
+	// resultExecute 对应 Execute 消息, 以 CommandComplete, EmptyQueryResponse, PortalSuspended 或 ErrorResponse 结束
+	resultExecute
+	// resultSync 对应 Sync 消息, 以 ReadyForQuery 结束, 不记录命令
+	resultSync
+	// resultDescribe 对应 Describe 消息, 以 RowDescription, NoData 或 ErrorResponse 结束, 不记录命令
+	resultDescribe
+)
+
+// column 是 RowDescription 中的列, TableOID 和 AttrNum 是来源表和列号, 表达式的列为 0
+type column struct {
+	Name     string
+	TableOID uint32
+	AttrNum  int
+	OID      uint32
+	Format   int
+}
+
+// queryResult 记录一条语句的执行结果, 由服务端返回的消息逐步填充
+type queryResult struct {
+	Input     []byte
+	CreatedAt time.Time
+
+	kind resultKind
+	done bool
+
+	// beforeReady 在转发 ReadyForQuery 之前发送给客户端, 用于返回被拒绝语句的错误
+	beforeReady []byte
+
+	columns  []column
+	rows     [][][]byte
+	rowCount int
+
+	// desc 记录 Describe 返回的列定义, portal 是 Execute 执行的 portal,
+	// 结果中没有 RowDescription 时使用之前 Describe 的列定义
+	desc   *description
+	portal *portal
+
+	// masker 不为空时对结果集脱敏, catalog 用于确定结果列的来源表, candidates 是语句读取的表
+	masker     *datamask.Masker
+	catalog    *catalog
+	candidates []datamask.Column
+	maskSet    *datamask.ResultSet
+	masked     []string
+
+	// guard 是会话的查询限制, 超过最大行数的行被丢弃, truncated 表示当前结果集被截断
+	guard      guardrail.Policy
+	truncated  bool
+	timer      *time.Timer
+	violations []string
+
+	outputs []string
+}
+
+func newQueryResult(kind resultKind, input []byte) *queryResult {
+	return &queryResult{
+		Input:     input,
+		CreatedAt: time.Now(),
+		kind:      kind,
+	}
+}
+
+func (r *queryResult) Done() bool {
+	return r.done
+}
+
+// Feed 解析一个服务端消息, 语句的所有结果都返回后进入完成状态;
+// 返回转发给客户端的消息, 结果集脱敏时可能被改写, 超过最大行数的行返回空
+func (r *queryResult) Feed(msg []byte) []byte {
+	if r.done || len(msg) < 5 {
+		return msg
+	}
+	body := getMessageBody(msg)
+	switch getMessageType(msg) {
+	case msgRowDescription:
+		r.columns = decodeRowDescription(body)
+		r.rows = nil
+		r.rowCount = 0
+		r.truncated = false
+		r.masked = r.maskedColumns()
+		r.maskSet = r.newMaskSet()
+		msg = r.maskRowDescription(msg)
+		if r.kind == resultDescribe {
+			if r.desc != nil {
+				r.desc.columns, r.desc.maskSet = r.columns, r.maskSet
+			}
+			r.done = true
+		}
+	case msgNoData:
+		if r.kind == resultDescribe {
+			r.done = true
+		}
+	case msgDataRow:
+		if r.columns == nil && r.portal != nil {
+			r.useDescription()
+		}
+		r.rowCount++
+		if r.truncateRow() {
+			return nil
+		}
+		if r.maskSet.Active() {
+			return r.feedMaskedRow(msg)
+		}
+		if r.masker != nil && r.columns == nil {
+			// 不知道列定义时无法脱敏
+			if count, _, err := readInt16(body, 0); err == nil {
+				return nullDataRow(count)
+			}
+			return nullDataRow(0)
+		}
+		if len(r.rows) < maxPreviewRows {
+			if row, err := decodeDataRow(body); err == nil {
+				r.rows = append(r.rows, row)
+			}
+		}
+	case msgCommandComplete:
+		tag, _, _ := readCString(body, 0)
+		if r.columns != nil {
+			r.outputs = append(r.outputs, r.formatResultSet())
+			r.columns = nil
+		} else {
+			r.outputs = append(r.outputs, tag)
+		}
+		msg = r.truncatedNotice(msg)
+		r.finishStatement()
+	case msgPortalSuspended:
+		if r.columns != nil {
+			r.outputs = append(r.outputs, r.formatResultSet())
+			r.columns = nil
+		}
+		msg = r.truncatedNotice(msg)
+		r.finishStatement()
+	case msgEmptyQueryResponse:
+		r.finishStatement()
+	case msgErrorResponse:
+		errResponse := ErrorResponse{}
+		_ = errResponse.Decode(msg)
+		r.outputs = append(r.outputs, formatErrorResponse(&errResponse))
+		r.finishStatement()
+	case msgReadyForQuery:
+		r.done = true
+	}
+	return msg
+}
+
+func (r *queryResult) finishStatement() {
+	if r.kind == resultExecute || r.kind == resultDescribe {
+		r.done = true
+	}
+}
+
+// Output 返回用于命令记录的结果摘要
+func (r *queryResult) Output() string {
+	output := strings.Join(r.outputs, "\r\n")
+	if len(output) > maxOutputLength {
+		output = truncateString(output, maxOutputLength) + "..."
+	}
+	return output
+}
+
+func decodeRowDescription(body []byte) []column {
+	count, position, err := readInt16(body, 0)
+	if err != nil {
+		return nil
+	}
+	columns := make([]column, 0, count)
+	for i := 0; i < count; i++ {
+		var c column
+		if c.Name, position, err = readCString(body, position); err != nil {
+			return columns
+		}
+		// table oid(4), column attribute number(2), type oid(4), type size(2), type modifier(4), format(2)
+		if position+18 > len(body) {
+			return columns
+		}
+		c.TableOID = binary.BigEndian.Uint32(body[position : position+4])
+		c.AttrNum = int(int16(binary.BigEndian.Uint16(body[position+4 : position+6])))
+		c.OID = binary.BigEndian.Uint32(body[position+6 : position+10])
+		c.Format = int(binary.BigEndian.Uint16(body[position+16 : position+18]))
+		position += 18
+		columns = append(columns, c)
+	}
+	return columns
+}
+
+// decodeDataRow decodes a DataRow message body, NULL values are returned as nil
+func decodeDataRow(body []byte) ([][]byte, error) {
+	count, position, err := readInt16(body, 0)
+	if err != nil {
+		return nil, err
+	}
+	row := make([][]byte, 0, count)
+	for i := 0; i < count; i++ {
+		var length int32
+		if length, position, err = readInt32(body, position); err != nil {
+			return row, err
+		}
+		if length < 0 {
+			row = append(row, nil)
+			continue
+		}
+		if position+int(length) > len(body) {
+			return row, errMalformedMessage
+		}
+		row = append(row, body[position:position+int(length)])
+		position += int(length)
+	}
+	return row, nil
+}
+
+func formatErrorResponse(errResponse *ErrorResponse) string {
+	output := fmt.Sprintf("%s:  %s", errResponse.Severity, errResponse.Message)
+	if errResponse.Detail != "" {
+		output += "\r\nDETAIL:  " + errResponse.Detail
+	}
+	return output
+}
+
+// formatResultSet 以 psql 的格式输出结果集预览
+func (r *queryResult) formatResultSet() string {
+	var buf bytes.Buffer
+	table := tablewriter.NewWriter(&buf)
+	table.SetAutoFormatHeaders(false)
+	table.SetAutoWrapText(false)
+	table.SetAlignment(tablewriter.ALIGN_LEFT)
+	table.SetHeaderAlignment(tablewriter.ALIGN_LEFT)
+	table.SetNewLine("\r\n")
+	header := make([]string, 0, len(r.columns))
+	for _, c := range r.columns {
+		header = append(header, c.Name)
+	}
+	table.SetHeader(header)
+	for _, row := range r.rows {
+		cells := make([]string, 0, len(row))
+		for i, value := range row {
+			if value == nil {
+				cells = append(cells, "NULL")
+				continue
+			}
+			text := string(value)
+			if i < len(r.columns) && r.columns[i].Format == formatBinary && !r.maskSet.MaskColumn(i) {
+				text, _ = formatBinaryValue(value, r.columns[i].OID)
+			}
+			cells = append(cells, truncateString(text, maxPreviewCellWidth))
+		}
+		table.Append(cells)
+	}
+	table.Render()
+	rowWord := "rows"
+	if r.rowCount == 1 {
+		rowWord = "row"
+	}
+	if r.rowCount > len(r.rows) {
+		buf.WriteString(fmt.Sprintf("(%d %s, %d shown)", r.rowCount, rowWord, len(r.rows)))
+	} else {
+		buf.WriteString(fmt.Sprintf("(%d %s)", r.rowCount, rowWord))
+	}
+	return buf.String()
+}
+
+func truncateString(s string, length int) string {
+	if len(s) <= length {
+		return s
+	}
+	s = s[:length]
+	for len(s) > 0 && !utf8.ValidString(s) {
+		s = s[:len(s)-1]
+	}
+	return s
+}
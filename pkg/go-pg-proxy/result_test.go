@@ -0,0 +1,113 @@
+package pgProxy
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func rowDescription(names ...string) []byte {
+	body := appendInt16(nil, uint16(len(names)))
+	for _, name := range names {
+		body = append(body, name...)
+		body = append(body, 0x00)
+		// table oid, attribute number, type oid (text), type size, type modifier, format
+		body = append(body, 0, 0, 0, 0, 0, 0, 0, 0, 0, 25, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0, 0)
+	}
+	return newMessage(msgRowDescription, body)
+}
+
+func dataRow(values ...[]byte) []byte {
+	body := appendInt16(nil, uint16(len(values)))
+	for _, v := range values {
+		if v == nil {
+			body = appendInt32(body, 0xffffffff)
+			continue
+		}
+		body = appendInt32(body, uint32(len(v)))
+		body = append(body, v...)
+	}
+	return newMessage(msgDataRow, body)
+}
+
+func commandComplete(tag string) []byte {
+	return newMessage(msgCommandComplete, append([]byte(tag), 0x00))
+}
+
+func TestQueryResult_FeedResultSet(t *testing.T) {
+	result := newQueryResult(resultSimple, []byte("select id, name from t"))
+	for _, msg := range [][]byte{
+		rowDescription("id", "name"),
+		dataRow([]byte("1"), []byte("alice")),
+		dataRow([]byte("2"), nil),
+		commandComplete("SELECT 2"),
+	} {
+		result.Feed(msg)
+	}
+	if result.Done() {
+		t.Fatal("simple query should wait for ReadyForQuery")
+	}
+	result.Feed(newReadyForQuery('I'))
+	if !result.Done() {
+		t.Fatal("simple query should be done")
+	}
+	output := result.Output()
+	for _, s := range []string{"id", "alice", "NULL", "(2 rows)"} {
+		if !strings.Contains(output, s) {
+			t.Errorf("output should contain %q: %s", s, output)
+		}
+	}
+}
+
+func TestQueryResult_MultiStatements(t *testing.T) {
+	result := newQueryResult(resultSimple, []byte("insert into t values (1); update t set id = 2"))
+	result.Feed(commandComplete("INSERT 0 1"))
+	result.Feed(NewErrorResponse(severityError, "23505", "duplicate key").Encode())
+	result.Feed(newReadyForQuery('I'))
+	expected := "INSERT 0 1\r\nERROR:  duplicate key"
+	if result.Output() != expected {
+		t.Errorf("output should be %q but %q", expected, result.Output())
+	}
+}
+
+func TestQueryResult_Execute(t *testing.T) {
+	result := newQueryResult(resultExecute, []byte("delete from t"))
+	result.Feed(commandComplete("DELETE 3"))
+	if !result.Done() || result.Output() != "DELETE 3" {
+		t.Errorf("unexpected execute result %v %q", result.Done(), result.Output())
+	}
+}
+
+func TestConnection_CompleteResults(t *testing.T) {
+	c := &Connection{}
+	first := newQueryResult(resultExecute, []byte("select 1"))
+	second := newQueryResult(resultExecute, []byte("select 2"))
+	denied := newQueryResult(resultSync, nil)
+	denied.beforeReady = NewErrorResponse(severityError, codeInsufficientPrivilege, "forbidden").Encode()
+	c.pushResult(first)
+	c.pushResult(second)
+	c.pushResult(newQueryResult(resultSync, nil))
+	c.pushResult(denied)
+
+	c.feedResult(rowDescription("?column?"))
+	c.feedResult(dataRow([]byte("1")))
+	c.feedResult(commandComplete("SELECT 1"))
+	if !first.Done() || second.Done() {
+		t.Fatal("only the first execute should be done")
+	}
+	// 第二个 Execute 出错后, 后端跳过剩余消息直到 Sync
+	c.feedResult(NewErrorResponse(severityError, "22012", "division by zero").Encode())
+	if !second.Done() {
+		t.Fatal("second execute should be done")
+	}
+	if prefix := c.completeResults(newReadyForQuery('I')); prefix != nil {
+		t.Fatalf("sync without error should not add prefix: %q", prefix)
+	}
+	prefix := c.completeResults(newReadyForQuery('I'))
+	if !bytes.Equal(prefix, denied.beforeReady) {
+		t.Fatalf("denied error should be sent before ReadyForQuery: %q", prefix)
+	}
+	if len(c.results) != 0 {
+		t.Errorf("results should be empty but %d", len(c.results))
+	}
+}
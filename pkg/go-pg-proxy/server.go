@@ -0,0 +1,395 @@
+package pgProxy
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/meowgen/koko/pkg/guardrail"
+	"github.com/meowgen/koko/pkg/jms-sdk-go/service"
+	"github.com/meowgen/koko/pkg/logger"
+	"github.com/meowgen/koko/pkg/proxy"
+	"github.com/meowgen/koko/pkg/proxybase"
+	"github.com/meowgen/koko/pkg/sqlparser"
+)
+
+const dialTimeout = 15 * time.Second
+
+var (
+	// errUpstreamAuthFailed 后端登录失败, ErrorResponse 已经转发给客户端
+	errUpstreamAuthFailed = errors.New("upstream auth failed")
+
+	// errCancelRequest 客户端连接只用于发送 CancelRequest, 不建立会话
+	errCancelRequest = errors.New("cancel request")
+)
+
+const proxyName = "PostgreSQL"
+
+type FakeServer struct {
+	*proxybase.Server
+	JmsService *service.JMService
+
+	// TLSConfig 不为空时接受客户端的 SSLRequest
+	TLSConfig *tls.Config
+
+	// cancelKeys 记录后端下发的 BackendKeyData 对应的后端地址, 用于转发 CancelRequest
+	cancelKeys map[string]string
+	cancelMu   sync.Mutex
+}
+
+func NewFakeServer(addr string, jmsService *service.JMService) *FakeServer {
+	fs := &FakeServer{
+		JmsService: jmsService,
+		cancelKeys: make(map[string]string),
+	}
+	fs.Server = proxybase.NewServer(proxyName, addr, func(conn net.Conn) proxybase.Conn {
+		return NewConnection(fs, conn)
+	})
+	return fs
+}
+
+type CurrSession = proxybase.Session
+
+func (fs *FakeServer) addCancelKey(key, address string) {
+	fs.cancelMu.Lock()
+	defer fs.cancelMu.Unlock()
+	fs.cancelKeys[key] = address
+}
+
+func (fs *FakeServer) removeCancelKey(key string) {
+	fs.cancelMu.Lock()
+	defer fs.cancelMu.Unlock()
+	delete(fs.cancelKeys, key)
+}
+
+// cancelRequest 把客户端的 CancelRequest 转发到对应的后端, 后端不返回任何数据
+func (fs *FakeServer) cancelRequest(packet []byte) error {
+	if len(packet) != 16 {
+		return errMalformedMessage
+	}
+	fs.cancelMu.Lock()
+	address, ok := fs.cancelKeys[string(packet[8:16])]
+	fs.cancelMu.Unlock()
+	if !ok {
+		return errors.New("unknown cancel key")
+	}
+	conn, err := net.DialTimeout("tcp", address, dialTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write(packet)
+	return err
+}
+
+// Serve 与客户端协商 SSL 并校验连接令牌, 连接后端后双向代理消息直到一端断开或者会话被终断
+func (c *Connection) Serve() {
+	defer c.Close()
+
+	startup, err := c.acceptClient()
+	if err != nil {
+		if !errors.Is(err, errCancelRequest) {
+			logger.Errorf("PostgreSQL proxy client %s login failed: %s", c.conn.RemoteAddr(), err)
+		}
+		return
+	}
+
+	token := c.Token
+	attrs := token.Info.Application.Attrs
+	c.host = attrs.Host
+	c.port = strconv.Itoa(attrs.Port)
+	c.Username = token.Info.SystemUserAuthInfo.Username
+	c.Password = token.Info.SystemUserAuthInfo.Password
+	c.Database = attrs.Database
+	if c.Database == "" {
+		c.Database = startup.Get("database")
+	}
+	rules, err := proxybase.LoadFilterRules(c.JmsService, token)
+	if err != nil {
+		logger.Errorf("PostgreSQL proxy get command filter rules err: %s", err)
+		return
+	}
+	c.sqlMatcher = sqlparser.NewMatcher(sqlparser.DialectPostgreSQL, c.Database)
+	c.filter = proxybase.NewCommandFilter(proxyName, c.JmsService, rules, c.sqlMatcher.Match)
+	c.guard = guardrail.ForApplication(token.Info.Application.Name)
+	if c.masker != nil {
+		c.catalog = newCatalog(c.loadRelation)
+	}
+	c.CurrSession = proxybase.NewSession(proxyName, c.JmsService, token, c.conn.RemoteAddr().String())
+	proxy.AddCommonSwitch(c.CurrSession.SwSess)
+	defer proxy.RemoveCommonSwitch(c.CurrSession.SwSess)
+
+	address := net.JoinHostPort(c.host, c.port)
+	pg, err := c.connectUpstream(address, startup)
+	if err != nil {
+		logger.Errorf("PostgreSQL proxy connect to %s err: %s", address, err)
+		if !errors.Is(err, errUpstreamAuthFailed) {
+			c.writeErr(severityFatal, codeSQLClientUnableToEstablish,
+				fmt.Sprintf("could not connect to server %s", address))
+		}
+		return
+	}
+
+	if err = c.CurrSession.CreateSessionCallback(); err != nil {
+		logger.Errorf("PostgreSQL proxy create session err: %s", err)
+		return
+	}
+	defer c.endSession()
+	defer c.stopGuardTimers()
+	if err = c.CurrSession.ConnectedSuccessCallback(); err != nil {
+		logger.Errorf("Session %s: PostgreSQL proxy update session success err: %s",
+			c.CurrSession.Sess.ID, err)
+	}
+	c.CurrSession.StartRecord()
+	logger.Infof("Session %s: PostgreSQL proxy %s connected %s", c.CurrSession.Sess.ID,
+		c.conn.RemoteAddr(), address)
+
+	done := make(chan struct{}, 2)
+	// Read messages from client, check them with filter rules, then forward to server
+	go func() {
+		if err := c.proxyRequests(pg); err != nil && err != io.EOF {
+			logger.Debugf("Session %s: PostgreSQL proxy client read err: %s", c.CurrSession.Sess.ID, err)
+		}
+		done <- struct{}{}
+	}()
+	// Read messages from server, parse the result, then forward to client
+	go func() {
+		if err := c.proxyResponses(pg); err != nil && err != io.EOF {
+			logger.Debugf("Session %s: PostgreSQL proxy server read err: %s", c.CurrSession.Sess.ID, err)
+		}
+		done <- struct{}{}
+	}()
+
+	select {
+	case <-done:
+	case <-c.CurrSession.SwSess.Ctx.Done():
+		logger.Infof("Session %s: PostgreSQL proxy terminated", c.CurrSession.Sess.ID)
+	}
+}
+
+// acceptClient 处理客户端的 SSLRequest 和 StartupMessage, 使用 md5 认证校验连接令牌和授权
+func (c *Connection) acceptClient() (*StartupMessage, error) {
+	var packet []byte
+	var err error
+	for {
+		if packet, err = readStartupPacket(c.conn); err != nil {
+			return nil, err
+		}
+		switch getStartupCode(packet) {
+		case sslRequestCode:
+			tlsConfig := c.FakeServer.TLSConfig
+			if tlsConfig == nil || c.isTLS() {
+				if _, err = c.conn.Write([]byte{'N'}); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			if _, err = c.conn.Write([]byte{'S'}); err != nil {
+				return nil, err
+			}
+			tlsConn := tls.Server(c.conn, tlsConfig)
+			if err = tlsConn.Handshake(); err != nil {
+				return nil, fmt.Errorf("tls handshake: %w", err)
+			}
+			c.setClientConn(tlsConn)
+			continue
+		case gssEncRequestCode:
+			if _, err = c.conn.Write([]byte{'N'}); err != nil {
+				return nil, err
+			}
+			continue
+		case cancelRequestCode:
+			if err = c.FakeServer.cancelRequest(packet); err != nil {
+				logger.Debugf("PostgreSQL proxy forward cancel request err: %s", err)
+			}
+			return nil, errCancelRequest
+		}
+		break
+	}
+
+	startup := &StartupMessage{}
+	if err = startup.Decode(packet); err != nil {
+		return nil, err
+	}
+	if startup.ProtocolVersion != protocolVersion3 {
+		c.writeErr(severityFatal, codeProtocolViolation,
+			fmt.Sprintf("unsupported frontend protocol %d.%d", startup.ProtocolVersion>>16,
+				startup.ProtocolVersion&0xffff))
+		return nil, fmt.Errorf("unsupported protocol version %d", startup.ProtocolVersion)
+	}
+	user := startup.Get("user")
+
+	salt := make([]byte, 4)
+	if _, err = rand.Read(salt); err != nil {
+		return nil, err
+	}
+	if _, err = c.conn.Write(newAuthenticationMessage(authMD5Password, salt)); err != nil {
+		return nil, err
+	}
+	msg, err := readMessage(c.conn)
+	if err != nil {
+		return nil, err
+	}
+	password, err := decodePasswordMessage(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	token, err := c.JmsService.GetConnectTokenAuth(user)
+	if err != nil {
+		c.writeErr(severityFatal, codeInvalidAuthSpecification, "Invalid token")
+		return nil, fmt.Errorf("invalid token: %w", err)
+	}
+	if token.Info.Application == nil || token.Info.SystemUserAuthInfo == nil || token.Info.User == nil {
+		c.writeErr(severityFatal, codeInvalidAuthSpecification, "Invalid token")
+		return nil, fmt.Errorf("not an application token: %v", token.Err)
+	}
+	c.Token = &token
+
+	perm, err := c.JmsService.ValidateApplicationPermission(token.Info.User.ID,
+		token.Info.Application.ID, token.Info.SystemUserAuthInfo.ID)
+	if err != nil || !perm.HasPermission {
+		c.writeErr(severityFatal, codeInvalidAuthSpecification, "No permission")
+		return nil, fmt.Errorf("user %s has no permission to %s", token.Info.User.String(),
+			token.Info.Application.String())
+	}
+	if password != md5Password(user, token.Info.Secret, salt) {
+		c.writeErr(severityFatal, codeInvalidPassword,
+			fmt.Sprintf("password authentication failed for user \"%s\"", user))
+		return nil, fmt.Errorf("user %s token secret mismatch", token.Info.User.String())
+	}
+	return startup, nil
+}
+
+func (c *Connection) isTLS() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, ok := c.conn.(*tls.Conn)
+	return ok
+}
+
+// connectUpstream 连接后端 PostgreSQL, 按应用配置升级 TLS, 使用系统用户登录并把登录结果转发给客户端
+func (c *Connection) connectUpstream(address string, clientStartup *StartupMessage) (net.Conn, error) {
+	pg, msg, err := c.dialUpstream(address, clientStartup, c.setUpstream)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = c.conn.Write(msg); err != nil {
+		return nil, err
+	}
+	if getMessageType(msg) == msgErrorResponse {
+		errResponse := ErrorResponse{}
+		_ = errResponse.Decode(msg)
+		return nil, fmt.Errorf("%w: %s", errUpstreamAuthFailed, errResponse.Error())
+	}
+	return pg, nil
+}
+
+// dialUpstream 连接后端 PostgreSQL 并使用系统用户登录, 返回后端的 AuthenticationOk 或 ErrorResponse,
+// setConn 在连接建立和升级 TLS 后调用, 用于关闭会话时断开连接
+func (c *Connection) dialUpstream(address string, clientStartup *StartupMessage,
+	setConn func(net.Conn)) (net.Conn, []byte, error) {
+	attrs := c.Token.Info.Application.Attrs
+	pg, err := net.DialTimeout("tcp", address, dialTimeout)
+	if err != nil {
+		return nil, nil, err
+	}
+	setConn(pg)
+
+	if attrs.UseSSL {
+		tlsConfig, err := proxybase.UpstreamTLSConfig(c.host, attrs)
+		if err != nil {
+			return nil, nil, err
+		}
+		if _, err = pg.Write(newSSLRequest()); err != nil {
+			return nil, nil, err
+		}
+		reply := make([]byte, 1)
+		if _, err = io.ReadFull(pg, reply); err != nil {
+			return nil, nil, err
+		}
+		if reply[0] != 'S' {
+			return nil, nil, errors.New("server does not support SSL")
+		}
+		tlsConn := tls.Client(pg, tlsConfig)
+		if err = tlsConn.Handshake(); err != nil {
+			return nil, nil, fmt.Errorf("tls handshake: %w", err)
+		}
+		pg = tlsConn
+		setConn(pg)
+	}
+
+	startup := &StartupMessage{ProtocolVersion: protocolVersion3}
+	for _, param := range clientStartup.Parameters {
+		if param.Name == "user" || param.Name == "database" {
+			continue
+		}
+		startup.Set(param.Name, param.Value)
+	}
+	startup.Set("user", c.Username)
+	if c.Database != "" {
+		startup.Set("database", c.Database)
+	}
+	if _, err = pg.Write(startup.Encode()); err != nil {
+		return nil, nil, err
+	}
+
+	msg, err := authUpstream(pg, c.Username, c.Password)
+	if err != nil {
+		return nil, nil, err
+	}
+	return pg, msg, nil
+}
+
+// endSession 结束录像, 命令记录并通知 core 会话断开, 可重复调用
+func (c *Connection) endSession() {
+	c.endOnce.Do(func() {
+		if c.CurrSession == nil {
+			return
+		}
+		c.flushResults()
+		c.CurrSession.End()
+	})
+}
+
+// proxyRequests 逐个读取客户端消息, 通过命令过滤后转发到后端并记录
+func (c *Connection) proxyRequests(pg net.Conn) error {
+	req := newRequest(c)
+	for {
+		msg, err := readMessage(c.conn)
+		if err != nil {
+			return err
+		}
+		forward := req.Handle(msg)
+		if forward == nil {
+			continue
+		}
+		if _, err = pg.Write(forward); err != nil {
+			return err
+		}
+	}
+}
+
+// proxyResponses 逐个读取后端消息, 解析执行结果后转发给客户端
+func (c *Connection) proxyResponses(pg net.Conn) error {
+	res := &Response{conn: c, currSess: c.CurrSession}
+	for {
+		msg, err := readMessage(pg)
+		if err != nil {
+			return err
+		}
+		forward := res.Handle(msg)
+		if forward == nil {
+			continue
+		}
+		if _, err = c.conn.Write(forward); err != nil {
+			return err
+		}
+	}
+}
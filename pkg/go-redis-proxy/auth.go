@@ -0,0 +1,90 @@
+package redisProxy
+
+import (
+	"bufio"
+	"io"
+	"strings"
+)
+
+const (
+	errNoAuth    = "NOAUTH Authentication required."
+	errNoAuthCmd = "NOAUTH HELLO must be called with the client already authenticated, " +
+		"otherwise the HELLO <proto> AUTH <user> <pass> option can be used to authenticate " +
+		"the client and select the RESP protocol version at the same time"
+	errWrongPass = "WRONGPASS invalid username-password pair or user is disabled."
+)
+
+// authArgs 是客户端登录时使用的连接令牌和密钥, 以及需要转发给后端的 HELLO 命令
+type authArgs struct {
+	Token  string
+	Secret string
+
+	// Hello 是去掉 AUTH 选项之后的 HELLO 命令, 客户端使用 AUTH 登录时为空
+	Hello []string
+}
+
+// Equal 判断是否使用同一个连接令牌登录
+func (a *authArgs) Equal(other *authArgs) bool {
+	return a.Token == other.Token && a.Secret == other.Secret
+}
+
+// parseAuthCommand 解析 AUTH <token> <secret> 或 HELLO <proto> AUTH <token> <secret> [SETNAME name],
+// 不是登录命令时 ok 为 false, 登录参数不正确时返回需要回复的错误
+func parseAuthCommand(args []string) (auth *authArgs, errMsg string, ok bool) {
+	switch strings.ToUpper(args[0]) {
+	case "AUTH":
+		switch len(args) {
+		case 3:
+			return &authArgs{Token: args[1], Secret: args[2]}, "", true
+		case 2:
+			// 只有密码时无法确定连接令牌
+			return nil, errWrongPass, true
+		default:
+			return nil, "ERR wrong number of arguments for 'auth' command", true
+		}
+	case "HELLO":
+		hello := []string{args[0]}
+		auth = &authArgs{}
+		for i := 1; i < len(args); i++ {
+			if strings.EqualFold(args[i], "AUTH") {
+				if i+2 >= len(args) {
+					return nil, "ERR Syntax error in HELLO option 'auth'", true
+				}
+				auth.Token, auth.Secret = args[i+1], args[i+2]
+				i += 2
+				continue
+			}
+			hello = append(hello, args[i])
+		}
+		auth.Hello = hello
+		return auth, "", true
+	}
+	return nil, "", false
+}
+
+// authUpstream 使用系统用户登录后端 Redis 并选择数据库, 后端返回错误时返回该错误回复
+func authUpstream(w io.Writer, r *bufio.Reader, username, password, database string) (*Value, error) {
+	var commands [][]string
+	switch {
+	case username != "":
+		commands = append(commands, []string{"AUTH", username, password})
+	case password != "":
+		commands = append(commands, []string{"AUTH", password})
+	}
+	if database != "" && database != "0" {
+		commands = append(commands, []string{"SELECT", database})
+	}
+	for _, args := range commands {
+		if _, err := w.Write(encodeCommand(args...)); err != nil {
+			return nil, err
+		}
+		reply, err := readValue(r)
+		if err != nil {
+			return nil, err
+		}
+		if reply.IsError() {
+			return reply, nil
+		}
+	}
+	return nil, nil
+}
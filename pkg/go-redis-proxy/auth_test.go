@@ -0,0 +1,77 @@
+package redisProxy
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestParseAuthCommand(t *testing.T) {
+	auth, errMsg, ok := parseAuthCommand([]string{"auth", "token", "secret"})
+	if !ok || errMsg != "" || auth.Token != "token" || auth.Secret != "secret" || auth.Hello != nil {
+		t.Fatalf("unexpected auth %+v %s", auth, errMsg)
+	}
+	if _, errMsg, _ = parseAuthCommand([]string{"AUTH", "secret"}); errMsg != errWrongPass {
+		t.Errorf("AUTH without token should be rejected but %q", errMsg)
+	}
+
+	auth, errMsg, ok = parseAuthCommand([]string{"HELLO", "3", "AUTH", "token", "secret", "SETNAME", "cli"})
+	if !ok || errMsg != "" || auth.Token != "token" || auth.Secret != "secret" {
+		t.Fatalf("unexpected hello auth %+v %s", auth, errMsg)
+	}
+	if strings.Join(auth.Hello, " ") != "HELLO 3 SETNAME cli" {
+		t.Errorf("AUTH option should be removed from %q", auth.Hello)
+	}
+	if _, errMsg, _ = parseAuthCommand([]string{"HELLO", "3", "AUTH", "token"}); errMsg == "" {
+		t.Error("HELLO AUTH without secret should be rejected")
+	}
+	if _, _, ok = parseAuthCommand([]string{"GET", "key"}); ok {
+		t.Error("GET should not be an auth command")
+	}
+}
+
+// fakeUpstream 依次读取命令并返回对应的回复
+func fakeUpstream(t *testing.T, server net.Conn, expected []string, replies []string) {
+	defer server.Close()
+	r := bufio.NewReader(server)
+	for i := range expected {
+		args, _, err := readCommand(r)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if strings.Join(args, " ") != expected[i] {
+			t.Errorf("command should be %q but %q", expected[i], args)
+		}
+		if _, err = server.Write([]byte(replies[i])); err != nil {
+			t.Error(err)
+			return
+		}
+	}
+}
+
+func TestAuthUpstream(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	go fakeUpstream(t, server, []string{"AUTH app secret", "SELECT 2"}, []string{"+OK\r\n", "+OK\r\n"})
+
+	errReply, err := authUpstream(client, bufio.NewReader(client), "app", "secret", "2")
+	if err != nil || errReply != nil {
+		t.Fatalf("auth should succeed but %v %v", errReply, err)
+	}
+}
+
+func TestAuthUpstream_Failed(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	go fakeUpstream(t, server, []string{"AUTH wrong"}, []string{"-" + errWrongPass + "\r\n"})
+
+	errReply, err := authUpstream(client, bufio.NewReader(client), "", "wrong", "0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if errReply == nil || errReply.Str != errWrongPass {
+		t.Errorf("auth should fail with %q but %v", errWrongPass, errReply)
+	}
+}
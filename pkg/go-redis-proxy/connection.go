@@ -0,0 +1,250 @@
+package redisProxy
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/meowgen/koko/pkg/jms-sdk-go/model"
+	"github.com/meowgen/koko/pkg/jms-sdk-go/service"
+	"github.com/meowgen/koko/pkg/logger"
+	"github.com/meowgen/koko/pkg/proxybase"
+	"github.com/meowgen/koko/pkg/sqlparser"
+)
+
+// 进入订阅或监控模式后, 后端的回复不再与命令一一对应
+var untrackedCommands = map[string]bool{
+	"SUBSCRIBE":  true,
+	"PSUBSCRIBE": true,
+	"SSUBSCRIBE": true,
+	"MONITOR":    true,
+}
+
+type Connection struct {
+	conn       net.Conn
+	reader     *bufio.Reader
+	upstream   net.Conn
+	host       string
+	port       string
+	JmsService *service.JMService
+	FakeServer *FakeServer
+
+	Username    string
+	Password    string
+	Database    string
+	Token       *service.TokenAuthInfoResponse
+	CurrSession *CurrSession
+
+	auth   *authArgs
+	filter *proxybase.CommandFilter
+
+	// 已转发到后端等待回复的命令, 写客户端时也持有该锁以保证回复顺序
+	resultMu  sync.Mutex
+	results   []*commandResult
+	untracked bool
+
+	mu        sync.Mutex
+	closeOnce sync.Once
+	endOnce   sync.Once
+}
+
+func NewConnection(fakeSrv *FakeServer, conn net.Conn) *Connection {
+	if fakeSrv.TLSConfig != nil {
+		conn = tls.Server(conn, fakeSrv.TLSConfig)
+	}
+	return &Connection{
+		conn:       conn,
+		reader:     bufio.NewReader(conn),
+		JmsService: fakeSrv.JmsService,
+		FakeServer: fakeSrv,
+	}
+}
+
+func (c *Connection) setUpstream(conn net.Conn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.upstream = conn
+}
+
+// writeReply 直接向客户端写回复, 只在会话建立之前使用
+func (c *Connection) writeReply(reply []byte) {
+	if _, err := c.conn.Write(reply); err != nil {
+		logger.Errorf("Redis proxy write reply to %s failed: %s", c.conn.RemoteAddr(), err)
+	}
+}
+
+// Close 关闭客户端和后端 Redis 连接, 并结束当前会话
+func (c *Connection) Close() {
+	c.closeOnce.Do(func() {
+		c.mu.Lock()
+		upstream := c.upstream
+		c.mu.Unlock()
+		if c.CurrSession != nil {
+			c.CurrSession.SwSess.Cancel()
+		}
+		_ = c.conn.Close()
+		if upstream != nil {
+			_ = upstream.Close()
+		}
+	})
+}
+
+type Request struct {
+	conn     *Connection
+	currSess *CurrSession
+}
+
+// Handle 检查并记录客户端的命令, 返回需要转发到后端的数据, 为空时不转发
+func (req *Request) Handle(args []string, raw []byte) []byte {
+	c := req.conn
+	name := strings.ToUpper(args[0])
+	input := formatCommand(args)
+	switch name {
+	case "AUTH", "HELLO":
+		// 客户端重新认证时只校验连接令牌, 后端连接始终使用系统用户
+		auth, errMsg, _ := parseAuthCommand(args)
+		if errMsg == "" && auth.Token != "" && !c.auth.Equal(auth) {
+			errMsg = errWrongPass
+		}
+		if errMsg != "" {
+			c.replyLocal(input, args, newError(errMsg), "(error) "+errMsg, model.NormalLevel)
+			return nil
+		}
+		if name == "AUTH" {
+			c.replyLocal(input, args, newSimpleString("OK"), "OK", model.NormalLevel)
+			return nil
+		}
+		raw = encodeCommand(auth.Hello...)
+	case "QUIT":
+		logger.Infof("Session %s: Redis proxy client quit", req.currSess.Sess.ID)
+	}
+
+	if allowed, msg := c.filter.Check(c.CurrSession, strings.Join(args, " ")); !allowed {
+		logger.Infof("Session %s: Redis proxy forbid command: %s", req.currSess.Sess.ID, input)
+		c.replyLocal(input, args, newError("ERR "+msg), msg, model.DangerLevel)
+		return nil
+	}
+
+	c.recordPrompt(input)
+	c.resultMu.Lock()
+	if untrackedCommands[name] || name == "CLIENT" && len(args) > 1 && strings.EqualFold(args[1], "REPLY") {
+		c.untracked = true
+	}
+	untracked := c.untracked
+	if !untracked {
+		c.results = append(c.results, newCommandResult(input, args))
+	}
+	c.resultMu.Unlock()
+	if untracked {
+		c.recordCommand(input, args, "", model.NormalLevel, time.Now())
+	}
+	return raw
+}
+
+// Response 处理后端返回的回复, 只在读取后端的 goroutine 中使用
+type Response struct {
+	conn     *Connection
+	currSess *CurrSession
+}
+
+// Handle 按命令顺序把回复转发给客户端并记录
+func (res *Response) Handle(reply *Value) error {
+	c := res.conn
+	c.resultMu.Lock()
+	if reply.Type == typePush || c.untracked || len(c.results) == 0 {
+		_, err := c.conn.Write(reply.Raw)
+		c.resultMu.Unlock()
+		return err
+	}
+	result := c.results[0]
+	c.results = c.results[1:]
+	data := reply.Raw
+	if len(result.after) > 0 {
+		data = append(append(make([]byte, 0, len(data)+len(result.after)), data...), result.after...)
+	}
+	_, err := c.conn.Write(data)
+	c.resultMu.Unlock()
+
+	c.recordResult(result, reply)
+	return err
+}
+
+// reply 向客户端返回代理生成的回复, 排在所有已转发命令的回复之后
+func (c *Connection) reply(data []byte) {
+	c.resultMu.Lock()
+	defer c.resultMu.Unlock()
+	if len(c.results) > 0 && !c.untracked {
+		last := c.results[len(c.results)-1]
+		last.after = append(last.after, data...)
+		return
+	}
+	if _, err := c.conn.Write(data); err != nil {
+		logger.Debugf("Redis proxy write reply to %s failed: %s", c.conn.RemoteAddr(), err)
+	}
+}
+
+// replyLocal 记录未转发到后端的命令, 并返回代理生成的回复
+func (c *Connection) replyLocal(input []byte, args []string, data []byte, output string, riskLevel int64) {
+	c.recordPrompt(input)
+	c.recordReplay([]byte(output + "\r\n"))
+	c.recordCommand(input, args, output, riskLevel, time.Now())
+	c.reply(data)
+}
+
+// flushResults 会话结束时记录尚未返回的命令
+func (c *Connection) flushResults() {
+	c.resultMu.Lock()
+	results := c.results
+	c.results = nil
+	c.resultMu.Unlock()
+	for _, result := range results {
+		c.recordCommand(result.Input, result.args, "", model.NormalLevel, result.CreatedAt)
+	}
+}
+
+func (c *Connection) recordResult(result *commandResult, reply *Value) {
+	if strings.EqualFold(result.args[0], "SELECT") && len(result.args) == 2 && !reply.IsError() {
+		c.mu.Lock()
+		c.Database = result.args[1]
+		c.mu.Unlock()
+	}
+	output := formatReply(reply)
+	c.recordReplay([]byte(output + "\r\n"))
+	c.recordCommand(result.Input, result.args, output, model.NormalLevel, result.CreatedAt)
+}
+
+// recordPrompt 以 redis-cli 的提示符格式记录命令
+func (c *Connection) recordPrompt(input []byte) {
+	c.mu.Lock()
+	database := c.Database
+	c.mu.Unlock()
+	prompt := net.JoinHostPort(c.host, c.port)
+	if db, _ := strconv.Atoi(database); db != 0 {
+		prompt += fmt.Sprintf("[%d]", db)
+	}
+	prompt += "> "
+	c.recordReplay(append(append([]byte(prompt), input...), '\r', '\n'))
+}
+
+func (c *Connection) recordCommand(input []byte, args []string, output string, riskLevel int64, createdAt time.Time) {
+	sess := c.CurrSession
+	if sess == nil || sess.CmdRecorder == nil {
+		return
+	}
+	cmd := sess.NewCommand(string(input), output, riskLevel, createdAt)
+	sqlparser.TagCommand(cmd, []*sqlparser.Statement{sqlparser.RedisStatement(maskCommandArgs(args))})
+	sess.CmdRecorder.RecordCommand(cmd)
+}
+
+func (c *Connection) recordReplay(p []byte) {
+	sess := c.CurrSession
+	if sess == nil || sess.ReplRecorder == nil {
+		return
+	}
+	sess.ReplRecorder.Record(p)
+}
@@ -0,0 +1,60 @@
+package redisProxy
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/meowgen/koko/pkg/proxybase"
+)
+
+func TestConnection_ReplyOrder(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	c := &Connection{
+		conn:   server,
+		auth:   &authArgs{Token: "token", Secret: "secret"},
+		filter: proxybase.NewCommandFilter(proxyName, nil, nil, proxybase.MatchRules),
+	}
+	req := &Request{conn: c}
+	res := &Response{conn: c}
+
+	received := make(chan string)
+	go func() {
+		r := bufio.NewReader(client)
+		var replies []string
+		for i := 0; i < 4; i++ {
+			v, err := readValue(r)
+			if err != nil {
+				break
+			}
+			replies = append(replies, string(v.Raw))
+		}
+		received <- strings.Join(replies, "")
+	}()
+
+	for _, args := range [][]string{{"SET", "a", "1"}, {"AUTH", "token", "secret"}, {"GET", "a"}, {"AUTH", "token", "wrong"}} {
+		forward := req.Handle(args, encodeCommand(args...))
+		if strings.EqualFold(args[0], "AUTH") && forward != nil {
+			t.Fatal("AUTH should be answered by proxy")
+		}
+	}
+	if len(c.results) != 2 {
+		t.Fatalf("two commands should wait for replies but %d", len(c.results))
+	}
+	for _, data := range []string{"+OK\r\n", "$1\r\n1\r\n"} {
+		v, err := readValue(bufio.NewReader(strings.NewReader(data)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = res.Handle(v); err != nil && err != io.EOF {
+			t.Fatal(err)
+		}
+	}
+	expected := "+OK\r\n+OK\r\n$1\r\n1\r\n-" + errWrongPass + "\r\n"
+	if got := <-received; got != expected {
+		t.Errorf("replies should be %q but %q", expected, got)
+	}
+}
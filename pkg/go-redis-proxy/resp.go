@@ -0,0 +1,292 @@
+package redisProxy
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// https://redis.io/docs/reference/protocol-spec/
+
+const (
+	typeSimpleString   byte = '+'
+	typeError          byte = '-'
+	typeInteger        byte = ':'
+	typeBulkString     byte = '$'
+	typeArray          byte = '*'
+	typeNull           byte = '_'
+	typeBoolean        byte = '#'
+	typeDouble         byte = ','
+	typeBigNumber      byte = '('
+	typeBulkError      byte = '!'
+	typeVerbatimString byte = '='
+	typeMap            byte = '%'
+	typeSet            byte = '~'
+	typeAttribute      byte = '|'
+	typePush           byte = '>'
+)
+
+const (
+	maxBulkLength   = 512 * 1024 * 1024
+	maxArrayLength  = 1024 * 1024
+	maxInlineLength = 64 * 1024
+	maxNestedDepth  = 128
+)
+
+var (
+	errProtocol = errors.New("protocol error")
+	crlf        = []byte("\r\n")
+)
+
+// Value 表示一个 RESP2/RESP3 值, Raw 保存原始数据用于直接转发
+type Value struct {
+	Type  byte
+	Str   string
+	Int   int64
+	Null  bool
+	Array []*Value
+
+	// Attrs 是 RESP3 中附加在回复之前的属性, 只转发不解析
+	Attrs *Value
+	Raw   []byte
+}
+
+// IsError 判断是否是错误回复
+func (v *Value) IsError() bool {
+	return v.Type == typeError || v.Type == typeBulkError
+}
+
+// readLine 读取一行并去掉结尾的 \r\n
+func readLine(r *bufio.Reader, raw *bytes.Buffer, limit int) ([]byte, error) {
+	var line []byte
+	for {
+		part, isPrefix, err := r.ReadLine()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, part...)
+		if len(line) > limit {
+			return nil, fmt.Errorf("%w: too big line", errProtocol)
+		}
+		if !isPrefix {
+			break
+		}
+	}
+	if raw != nil {
+		raw.Write(line)
+		raw.Write(crlf)
+	}
+	return line, nil
+}
+
+// readValue 读取一个完整的 RESP 值
+func readValue(r *bufio.Reader) (*Value, error) {
+	var raw bytes.Buffer
+	v, err := readValueTo(r, &raw, 0)
+	if err != nil {
+		return nil, err
+	}
+	v.Raw = raw.Bytes()
+	return v, nil
+}
+
+func readValueTo(r *bufio.Reader, raw *bytes.Buffer, depth int) (*Value, error) {
+	if depth > maxNestedDepth {
+		return nil, fmt.Errorf("%w: too deep nested reply", errProtocol)
+	}
+	line, err := readLine(r, raw, maxInlineLength)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 {
+		return nil, fmt.Errorf("%w: empty line", errProtocol)
+	}
+	v := &Value{Type: line[0]}
+	payload := string(line[1:])
+	switch v.Type {
+	case typeSimpleString, typeError, typeDouble, typeBigNumber:
+		v.Str = payload
+	case typeInteger:
+		if v.Int, err = strconv.ParseInt(payload, 10, 64); err != nil {
+			return nil, fmt.Errorf("%w: invalid integer %q", errProtocol, payload)
+		}
+	case typeNull:
+		v.Null = true
+	case typeBoolean:
+		v.Str = payload
+		if payload != "t" && payload != "f" {
+			return nil, fmt.Errorf("%w: invalid boolean %q", errProtocol, payload)
+		}
+	case typeBulkString, typeBulkError, typeVerbatimString:
+		length, err := strconv.Atoi(payload)
+		if err != nil || length < -1 || length > maxBulkLength {
+			return nil, fmt.Errorf("%w: invalid bulk length %q", errProtocol, payload)
+		}
+		if length == -1 {
+			v.Null = true
+			break
+		}
+		data := make([]byte, length+2)
+		if _, err = io.ReadFull(r, data); err != nil {
+			return nil, err
+		}
+		if !bytes.HasSuffix(data, crlf) {
+			return nil, fmt.Errorf("%w: bulk string not end with CRLF", errProtocol)
+		}
+		raw.Write(data)
+		v.Str = string(data[:length])
+	case typeArray, typeSet, typePush, typeMap, typeAttribute:
+		count, err := strconv.Atoi(payload)
+		if err != nil || count < -1 || count > maxArrayLength {
+			return nil, fmt.Errorf("%w: invalid multibulk length %q", errProtocol, payload)
+		}
+		if count == -1 {
+			v.Null = true
+			break
+		}
+		if v.Type == typeMap || v.Type == typeAttribute {
+			count *= 2
+		}
+		v.Array = make([]*Value, 0, count)
+		for i := 0; i < count; i++ {
+			item, err := readValueTo(r, raw, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			v.Array = append(v.Array, item)
+		}
+		if v.Type == typeAttribute {
+			// 属性之后才是真正的回复
+			reply, err := readValueTo(r, raw, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			reply.Attrs = v
+			return reply, nil
+		}
+	default:
+		return nil, fmt.Errorf("%w: unknown reply type %q", errProtocol, v.Type)
+	}
+	return v, nil
+}
+
+// readCommand 读取客户端的命令, 支持 multibulk 和 inline 两种格式
+func readCommand(r *bufio.Reader) ([]string, []byte, error) {
+	for {
+		first, err := r.Peek(1)
+		if err != nil {
+			return nil, nil, err
+		}
+		if first[0] != typeArray {
+			var raw bytes.Buffer
+			line, err := readLine(r, &raw, maxInlineLength)
+			if err != nil {
+				return nil, nil, err
+			}
+			args, err := splitInlineArgs(string(line))
+			if err != nil {
+				return nil, nil, err
+			}
+			if len(args) == 0 {
+				continue
+			}
+			// inline 命令转换成 multibulk 转发给后端
+			return args, encodeCommand(args...), nil
+		}
+		v, err := readValue(r)
+		if err != nil {
+			return nil, nil, err
+		}
+		if v.Null || len(v.Array) == 0 {
+			continue
+		}
+		args := make([]string, 0, len(v.Array))
+		for _, item := range v.Array {
+			if item.Type != typeBulkString || item.Null {
+				return nil, nil, fmt.Errorf("%w: expected bulk string", errProtocol)
+			}
+			args = append(args, item.Str)
+		}
+		return args, v.Raw, nil
+	}
+}
+
+// splitInlineArgs 按 redis-cli 的规则拆分 inline 命令, 支持单双引号
+func splitInlineArgs(line string) ([]string, error) {
+	var args []string
+	i := 0
+	for {
+		for i < len(line) && (line[i] == ' ' || line[i] == '\t') {
+			i++
+		}
+		if i >= len(line) {
+			return args, nil
+		}
+		var arg strings.Builder
+		var quote byte
+		for ; i < len(line); i++ {
+			c := line[i]
+			if quote == 0 {
+				if c == ' ' || c == '\t' {
+					break
+				}
+				if (c == '"' || c == '\'') && arg.Len() == 0 {
+					quote = c
+					continue
+				}
+				arg.WriteByte(c)
+				continue
+			}
+			if c == '\\' && quote == '"' && i+1 < len(line) {
+				i++
+				switch line[i] {
+				case 'n':
+					arg.WriteByte('\n')
+				case 'r':
+					arg.WriteByte('\r')
+				case 't':
+					arg.WriteByte('\t')
+				default:
+					arg.WriteByte(line[i])
+				}
+				continue
+			}
+			if c == quote {
+				quote = 0
+				i++
+				break
+			}
+			arg.WriteByte(c)
+		}
+		if quote != 0 {
+			return nil, fmt.Errorf("%w: unbalanced quotes in request", errProtocol)
+		}
+		args = append(args, arg.String())
+	}
+}
+
+// encodeCommand 把参数编码成 multibulk 格式
+func encodeCommand(args ...string) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(fmt.Sprintf("*%d\r\n", len(args)))
+	for _, arg := range args {
+		buf.WriteString(fmt.Sprintf("$%d\r\n", len(arg)))
+		buf.WriteString(arg)
+		buf.Write(crlf)
+	}
+	return buf.Bytes()
+}
+
+func newSimpleString(s string) []byte {
+	return []byte("+" + s + "\r\n")
+}
+
+// newError 生成错误回复, msg 需以错误码开头, 如 "ERR ..."
+func newError(msg string) []byte {
+	msg = strings.NewReplacer("\r", " ", "\n", " ").Replace(msg)
+	return []byte("-" + msg + "\r\n")
+}
@@ -0,0 +1,90 @@
+package redisProxy
+
+import (
+	"bufio"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestReadValue(t *testing.T) {
+	data := "*3\r\n$3\r\nfoo\r\n$-1\r\n:42\r\n" +
+		"|1\r\n+key-popularity\r\n%1\r\n$1\r\na\r\n,0.1923\r\n#t\r\n" +
+		"%1\r\n+server\r\n$5\r\nredis\r\n" +
+		"-ERR unknown command\r\n"
+	r := bufio.NewReader(strings.NewReader(data))
+
+	v, err := readValue(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.Type != typeArray || len(v.Array) != 3 || v.Array[0].Str != "foo" || !v.Array[1].Null || v.Array[2].Int != 42 {
+		t.Fatalf("unexpected array %+v", v)
+	}
+	if string(v.Raw) != "*3\r\n$3\r\nfoo\r\n$-1\r\n:42\r\n" {
+		t.Errorf("unexpected raw %q", v.Raw)
+	}
+
+	// 属性和回复作为一个整体转发
+	v, err = readValue(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.Type != typeBoolean || v.Attrs == nil || !strings.HasPrefix(string(v.Raw), "|1\r\n") {
+		t.Fatalf("unexpected attribute reply %+v", v)
+	}
+
+	v, err = readValue(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.Type != typeMap || len(v.Array) != 2 {
+		t.Fatalf("unexpected map %+v", v)
+	}
+
+	v, err = readValue(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !v.IsError() || v.Str != "ERR unknown command" {
+		t.Errorf("unexpected error reply %+v", v)
+	}
+}
+
+func TestReadValue_Invalid(t *testing.T) {
+	for _, data := range []string{"$3\r\nfoobar\r\n", "*x\r\n", "?\r\n", ":abc\r\n"} {
+		_, err := readValue(bufio.NewReader(strings.NewReader(data)))
+		if !errors.Is(err, errProtocol) {
+			t.Errorf("%q should be protocol error but %v", data, err)
+		}
+	}
+}
+
+func TestReadCommand(t *testing.T) {
+	data := "\r\nset key \"hello world\\n\" 'it''s'\r\n*2\r\n$3\r\nGET\r\n$3\r\nkey\r\n"
+	r := bufio.NewReader(strings.NewReader(data))
+
+	args, raw, err := readCommand(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"set", "key", "hello world\n", "it", "s"}
+	if strings.Join(args, "|") != strings.Join(expected, "|") {
+		t.Fatalf("args should be %q but %q", expected, args)
+	}
+	if string(raw) != string(encodeCommand(expected...)) {
+		t.Errorf("inline command should be forwarded as multibulk but %q", raw)
+	}
+
+	args, raw, err = readCommand(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(args, " ") != "GET key" || string(raw) != "*2\r\n$3\r\nGET\r\n$3\r\nkey\r\n" {
+		t.Errorf("unexpected command %q %q", args, raw)
+	}
+
+	if _, err = splitInlineArgs(`get "key`); !errors.Is(err, errProtocol) {
+		t.Errorf("unbalanced quotes should be protocol error but %v", err)
+	}
+}
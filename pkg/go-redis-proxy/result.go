@@ -0,0 +1,213 @@
+package redisProxy
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	maxPreviewItems = 20
+	maxOutputLength = 4096
+
+	maskedArgValue = "******"
+)
+
+// commandResult 记录一条已转发的命令, 等待后端按顺序返回回复
+type commandResult struct {
+	Input     []byte
+	CreatedAt time.Time
+
+	args []string
+
+	// after 在该命令的回复之后发送给客户端, 用于保持被拒绝命令的回复顺序
+	after []byte
+}
+
+func newCommandResult(input []byte, args []string) *commandResult {
+	return &commandResult{
+		Input:     input,
+		CreatedAt: time.Now(),
+		args:      args,
+	}
+}
+
+// formatCommand 以 redis-cli 的格式输出命令, 包含空白或特殊字符的参数加上引号
+func formatCommand(args []string) []byte {
+	parts := make([]string, 0, len(args))
+	for i, arg := range maskCommandArgs(args) {
+		if i == 0 {
+			parts = append(parts, arg)
+			continue
+		}
+		parts = append(parts, quoteArg(arg))
+	}
+	return []byte(strings.Join(parts, " "))
+}
+
+// maskCommandArgs 隐藏命令中的密码参数
+func maskCommandArgs(args []string) []string {
+	masked := make([]string, len(args))
+	copy(masked, args)
+	switch strings.ToUpper(args[0]) {
+	case "AUTH":
+		// AUTH [username] password
+		if len(masked) > 1 {
+			masked[len(masked)-1] = maskedArgValue
+		}
+	case "HELLO", "MIGRATE":
+		// HELLO ... AUTH username password, MIGRATE ... AUTH password | AUTH2 username password
+		hello := strings.EqualFold(args[0], "HELLO")
+		for i := 1; i < len(masked); i++ {
+			switch {
+			case strings.EqualFold(args[i], "AUTH") && hello && i+2 < len(masked):
+				masked[i+2] = maskedArgValue
+				i += 2
+			case strings.EqualFold(args[i], "AUTH") && !hello && i+1 < len(masked):
+				masked[i+1] = maskedArgValue
+				i++
+			case strings.EqualFold(args[i], "AUTH2") && i+2 < len(masked):
+				masked[i+2] = maskedArgValue
+				i += 2
+			}
+		}
+	}
+	return masked
+}
+
+func quoteArg(arg string) string {
+	if arg == "" {
+		return `""`
+	}
+	for _, r := range arg {
+		if r <= ' ' || r == '"' || r == '\'' || r == '\\' || r >= utf8.RuneSelf {
+			return formatBulkString(arg)
+		}
+	}
+	return arg
+}
+
+// formatBulkString 按 redis-cli 的方式转义字符串
+func formatBulkString(s string) string {
+	var buf strings.Builder
+	buf.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch c {
+		case '\\', '"':
+			buf.WriteByte('\\')
+			buf.WriteByte(c)
+		case '\n':
+			buf.WriteString(`\n`)
+		case '\r':
+			buf.WriteString(`\r`)
+		case '\t':
+			buf.WriteString(`\t`)
+		default:
+			if c < ' ' || c >= 0x7f {
+				buf.WriteString(fmt.Sprintf(`\x%02x`, c))
+			} else {
+				buf.WriteByte(c)
+			}
+		}
+	}
+	buf.WriteByte('"')
+	return buf.String()
+}
+
+// formatReply 以 redis-cli 的格式输出回复, 用于命令记录
+func formatReply(v *Value) string {
+	output := formatValue(v, "")
+	if len(output) > maxOutputLength {
+		output = truncateString(output, maxOutputLength) + "..."
+	}
+	return output
+}
+
+func formatValue(v *Value, indent string) string {
+	switch v.Type {
+	case typeSimpleString:
+		return v.Str
+	case typeError, typeBulkError:
+		return "(error) " + v.Str
+	case typeInteger:
+		return "(integer) " + strconv.FormatInt(v.Int, 10)
+	case typeDouble:
+		return "(double) " + v.Str
+	case typeBigNumber:
+		return "(big number) " + v.Str
+	case typeBoolean:
+		if v.Str == "t" {
+			return "(true)"
+		}
+		return "(false)"
+	case typeNull:
+		return "(nil)"
+	case typeBulkString, typeVerbatimString:
+		if v.Null {
+			return "(nil)"
+		}
+		if v.Type == typeVerbatimString && len(v.Str) >= 4 && v.Str[3] == ':' {
+			return v.Str[4:]
+		}
+		return formatBulkString(v.Str)
+	case typeArray, typeSet, typePush, typeMap:
+		if v.Null {
+			return "(nil)"
+		}
+		return formatAggregate(v, indent)
+	}
+	return ""
+}
+
+func formatAggregate(v *Value, indent string) string {
+	step := 1
+	if v.Type == typeMap {
+		step = 2
+	}
+	count := len(v.Array) / step
+	if count == 0 {
+		if v.Type == typeMap {
+			return "(empty hash)"
+		}
+		return "(empty array)"
+	}
+	width := len(strconv.Itoa(count))
+	lines := make([]string, 0, count)
+	for i := 0; i < count && i < maxPreviewItems; i++ {
+		prefix := fmt.Sprintf("%*d) ", width, i+1)
+		if v.Type == typeMap {
+			prefix = fmt.Sprintf("%*d# ", width, i+1)
+		}
+		childIndent := indent + strings.Repeat(" ", len(prefix))
+		var item string
+		if v.Type == typeMap {
+			key := v.Array[i*2]
+			item = formatValue(key, childIndent) + " => " + formatValue(v.Array[i*2+1], childIndent)
+		} else {
+			item = formatValue(v.Array[i], childIndent)
+		}
+		line := prefix + item
+		if i > 0 {
+			line = indent + line
+		}
+		lines = append(lines, line)
+	}
+	if count > maxPreviewItems {
+		lines = append(lines, indent+fmt.Sprintf("(%d items, %d shown)", count, maxPreviewItems))
+	}
+	return strings.Join(lines, "\r\n")
+}
+
+func truncateString(s string, length int) string {
+	if len(s) <= length {
+		return s
+	}
+	s = s[:length]
+	for len(s) > 0 && !utf8.ValidString(s) {
+		s = s[:len(s)-1]
+	}
+	return s
+}
@@ -0,0 +1,52 @@
+package redisProxy
+
+import (
+	"bufio"
+	"strings"
+	"testing"
+)
+
+func TestFormatCommand(t *testing.T) {
+	tests := []struct {
+		args     []string
+		expected string
+	}{
+		{[]string{"SET", "key", "hello world"}, `SET key "hello world"`},
+		{[]string{"SET", "key", ""}, `SET key ""`},
+		{[]string{"AUTH", "secret"}, "AUTH ******"},
+		{[]string{"AUTH", "user", "secret"}, "AUTH user ******"},
+		{[]string{"HELLO", "3", "AUTH", "user", "secret", "SETNAME", "cli"}, "HELLO 3 AUTH user ****** SETNAME cli"},
+		{[]string{"MIGRATE", "h", "6379", "k", "0", "5000", "AUTH", "secret"}, "MIGRATE h 6379 k 0 5000 AUTH ******"},
+	}
+	for _, tt := range tests {
+		if got := string(formatCommand(tt.args)); got != tt.expected {
+			t.Errorf("command %q should be %s but %s", tt.args, tt.expected, got)
+		}
+	}
+}
+
+func TestFormatReply(t *testing.T) {
+	tests := []struct {
+		data     string
+		expected string
+	}{
+		{"+OK\r\n", "OK"},
+		{"-ERR wrong type\r\n", "(error) ERR wrong type"},
+		{":3\r\n", "(integer) 3"},
+		{"$-1\r\n", "(nil)"},
+		{"$5\r\nhi\r\n!\r\n", `"hi\r\n!"`},
+		{"*0\r\n", "(empty array)"},
+		{"*2\r\n$1\r\na\r\n*2\r\n:1\r\n:2\r\n", "1) \"a\"\r\n2) 1) (integer) 1\r\n   2) (integer) 2"},
+		{"%1\r\n+key\r\n#f\r\n", "1# key => (false)"},
+		{"=15\r\ntxt:Some string\r\n", "Some string"},
+	}
+	for _, tt := range tests {
+		v, err := readValue(bufio.NewReader(strings.NewReader(tt.data)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := formatReply(v); got != tt.expected {
+			t.Errorf("reply %q should be %q but %q", tt.data, tt.expected, got)
+		}
+	}
+}
@@ -0,0 +1,276 @@
+package redisProxy
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/meowgen/koko/pkg/jms-sdk-go/service"
+	"github.com/meowgen/koko/pkg/logger"
+	"github.com/meowgen/koko/pkg/proxy"
+	"github.com/meowgen/koko/pkg/proxybase"
+)
+
+const dialTimeout = 15 * time.Second
+
+var (
+	// errUpstreamAuthFailed 后端登录失败, 错误回复已经转发给客户端
+	errUpstreamAuthFailed = errors.New("upstream auth failed")
+
+	// errClientQuit 客户端登录前发送了 QUIT
+	errClientQuit = errors.New("client quit")
+)
+
+const proxyName = "Redis"
+
+type FakeServer struct {
+	*proxybase.Server
+	JmsService *service.JMService
+
+	// TLSConfig 不为空时客户端必须使用 TLS 连接, Redis 协议不支持连接后再升级
+	TLSConfig *tls.Config
+}
+
+func NewFakeServer(addr string, jmsService *service.JMService) *FakeServer {
+	fs := &FakeServer{JmsService: jmsService}
+	fs.Server = proxybase.NewServer(proxyName, addr, func(conn net.Conn) proxybase.Conn {
+		return NewConnection(fs, conn)
+	})
+	return fs
+}
+
+type CurrSession = proxybase.Session
+
+// Serve 校验客户端的连接令牌, 连接后端后双向代理命令和回复直到一端断开或者会话被终断
+func (c *Connection) Serve() {
+	defer c.Close()
+
+	if err := c.acceptClient(); err != nil {
+		if !errors.Is(err, errClientQuit) && err != io.EOF {
+			logger.Errorf("Redis proxy client %s login failed: %s", c.conn.RemoteAddr(), err)
+		}
+		return
+	}
+
+	token := c.Token
+	attrs := token.Info.Application.Attrs
+	c.host = attrs.Host
+	c.port = strconv.Itoa(attrs.Port)
+	c.Username = token.Info.SystemUserAuthInfo.Username
+	c.Password = token.Info.SystemUserAuthInfo.Password
+	c.Database = attrs.Database
+	rules, err := proxybase.LoadFilterRules(c.JmsService, token)
+	if err != nil {
+		logger.Errorf("Redis proxy get command filter rules err: %s", err)
+		return
+	}
+	c.filter = proxybase.NewCommandFilter(proxyName, c.JmsService, rules, proxybase.MatchRules)
+	c.CurrSession = proxybase.NewSession(proxyName, c.JmsService, token, c.conn.RemoteAddr().String())
+	proxy.AddCommonSwitch(c.CurrSession.SwSess)
+	defer proxy.RemoveCommonSwitch(c.CurrSession.SwSess)
+
+	address := net.JoinHostPort(c.host, c.port)
+	redis, upstreamReader, err := c.connectUpstream(address)
+	if err != nil {
+		logger.Errorf("Redis proxy connect to %s err: %s", address, err)
+		if !errors.Is(err, errUpstreamAuthFailed) {
+			c.writeReply(newError(fmt.Sprintf("ERR Could not connect to Redis at %s", address)))
+		}
+		return
+	}
+
+	if err = c.CurrSession.CreateSessionCallback(); err != nil {
+		logger.Errorf("Redis proxy create session err: %s", err)
+		return
+	}
+	defer c.endSession()
+	if err = c.CurrSession.ConnectedSuccessCallback(); err != nil {
+		logger.Errorf("Session %s: Redis proxy update session success err: %s",
+			c.CurrSession.Sess.ID, err)
+	}
+	c.CurrSession.StartRecord()
+	logger.Infof("Session %s: Redis proxy %s connected %s", c.CurrSession.Sess.ID,
+		c.conn.RemoteAddr(), address)
+
+	done := make(chan struct{}, 2)
+	// Read commands from client, check them with filter rules, then forward to server
+	go func() {
+		if err := c.proxyRequests(redis); err != nil && err != io.EOF {
+			logger.Debugf("Session %s: Redis proxy client read err: %s", c.CurrSession.Sess.ID, err)
+		}
+		done <- struct{}{}
+	}()
+	// Read replies from server, record them, then forward to client
+	go func() {
+		if err := c.proxyResponses(upstreamReader); err != nil && err != io.EOF {
+			logger.Debugf("Session %s: Redis proxy server read err: %s", c.CurrSession.Sess.ID, err)
+		}
+		done <- struct{}{}
+	}()
+
+	select {
+	case <-done:
+	case <-c.CurrSession.SwSess.Ctx.Done():
+		logger.Infof("Session %s: Redis proxy terminated", c.CurrSession.Sess.ID)
+	}
+}
+
+// acceptClient 等待客户端使用 AUTH 或 HELLO AUTH 登录, 校验连接令牌和授权
+func (c *Connection) acceptClient() error {
+	for {
+		args, _, err := readCommand(c.reader)
+		if err != nil {
+			if errors.Is(err, errProtocol) {
+				c.writeReply(newError("ERR " + err.Error()))
+			}
+			return err
+		}
+		if strings.EqualFold(args[0], "QUIT") {
+			c.writeReply(newSimpleString("OK"))
+			return errClientQuit
+		}
+		auth, errMsg, ok := parseAuthCommand(args)
+		switch {
+		case !ok:
+			errMsg = errNoAuth
+		case errMsg == "" && auth.Token == "":
+			errMsg = errNoAuthCmd
+		}
+		if errMsg != "" {
+			c.writeReply(newError(errMsg))
+			continue
+		}
+		if err = c.checkToken(auth); err != nil {
+			return err
+		}
+		c.auth = auth
+		return nil
+	}
+}
+
+// checkToken 校验连接令牌, 密钥和应用授权, 失败时向客户端返回错误
+func (c *Connection) checkToken(auth *authArgs) error {
+	token, err := c.JmsService.GetConnectTokenAuth(auth.Token)
+	if err != nil {
+		c.writeReply(newError(errWrongPass))
+		return fmt.Errorf("invalid token: %w", err)
+	}
+	if token.Info.Application == nil || token.Info.SystemUserAuthInfo == nil || token.Info.User == nil {
+		c.writeReply(newError(errWrongPass))
+		return fmt.Errorf("not an application token: %v", token.Err)
+	}
+	perm, err := c.JmsService.ValidateApplicationPermission(token.Info.User.ID,
+		token.Info.Application.ID, token.Info.SystemUserAuthInfo.ID)
+	if err != nil || !perm.HasPermission {
+		c.writeReply(newError("NOPERM No permission"))
+		return fmt.Errorf("user %s has no permission to %s", token.Info.User.String(),
+			token.Info.Application.String())
+	}
+	if token.Info.Secret != auth.Secret {
+		c.writeReply(newError(errWrongPass))
+		return fmt.Errorf("user %s token secret mismatch", token.Info.User.String())
+	}
+	c.Token = &token
+	return nil
+}
+
+// connectUpstream 连接后端 Redis, 按应用配置使用 TLS, 使用系统用户登录并把登录结果转发给客户端
+func (c *Connection) connectUpstream(address string) (net.Conn, *bufio.Reader, error) {
+	attrs := c.Token.Info.Application.Attrs
+	redis, err := net.DialTimeout("tcp", address, dialTimeout)
+	if err != nil {
+		return nil, nil, err
+	}
+	c.setUpstream(redis)
+	if attrs.UseSSL {
+		tlsConfig, err := proxybase.UpstreamTLSConfig(c.host, attrs)
+		if err != nil {
+			return nil, nil, err
+		}
+		tlsConn := tls.Client(redis, tlsConfig)
+		if err = tlsConn.Handshake(); err != nil {
+			return nil, nil, fmt.Errorf("tls handshake: %w", err)
+		}
+		redis = tlsConn
+		c.setUpstream(redis)
+	}
+	reader := bufio.NewReader(redis)
+
+	errReply, err := authUpstream(redis, reader, c.Username, c.Password, c.Database)
+	if err != nil {
+		return nil, nil, err
+	}
+	if errReply != nil {
+		c.writeReply(errReply.Raw)
+		return nil, nil, fmt.Errorf("%w: %s", errUpstreamAuthFailed, errReply.Str)
+	}
+	if len(c.auth.Hello) == 0 {
+		c.writeReply(newSimpleString("OK"))
+		return redis, reader, nil
+	}
+	// 客户端使用 HELLO 登录时由后端返回协议版本和服务器信息
+	if _, err = redis.Write(encodeCommand(c.auth.Hello...)); err != nil {
+		return nil, nil, err
+	}
+	reply, err := readValue(reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	c.writeReply(reply.Raw)
+	if reply.IsError() {
+		return nil, nil, fmt.Errorf("%w: %s", errUpstreamAuthFailed, reply.Str)
+	}
+	return redis, reader, nil
+}
+
+// endSession 结束录像, 命令记录并通知 core 会话断开, 可重复调用
+func (c *Connection) endSession() {
+	c.endOnce.Do(func() {
+		if c.CurrSession == nil {
+			return
+		}
+		c.flushResults()
+		c.CurrSession.End()
+	})
+}
+
+// proxyRequests 逐个读取客户端命令, 通过命令过滤后转发到后端并记录
+func (c *Connection) proxyRequests(redis net.Conn) error {
+	req := &Request{conn: c, currSess: c.CurrSession}
+	for {
+		args, raw, err := readCommand(c.reader)
+		if err != nil {
+			if errors.Is(err, errProtocol) {
+				c.reply(newError("ERR " + err.Error()))
+			}
+			return err
+		}
+		forward := req.Handle(args, raw)
+		if forward == nil {
+			continue
+		}
+		if _, err = redis.Write(forward); err != nil {
+			return err
+		}
+	}
+}
+
+// proxyResponses 逐个读取后端回复, 记录执行结果后转发给客户端
+func (c *Connection) proxyResponses(reader *bufio.Reader) error {
+	res := &Response{conn: c, currSess: c.CurrSession}
+	for {
+		reply, err := readValue(reader)
+		if err != nil {
+			return err
+		}
+		if err = res.Handle(reply); err != nil {
+			return err
+		}
+	}
+}
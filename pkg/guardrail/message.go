@@ -0,0 +1,31 @@
+package guardrail
+
+import "fmt"
+
+// RowsTruncated 返回结果集被截断时提示用户的信息
+func (p Policy) RowsTruncated() string {
+	return fmt.Sprintf("Result truncated to %d rows by query guardrail", p.MaxRows)
+}
+
+// StatementTimedOut 返回语句超时被终止时提示用户的信息
+func (p Policy) StatementTimedOut() string {
+	return fmt.Sprintf("Statement exceeded %s and was cancelled by query guardrail", p.StatementTimeout)
+}
+
+// TransactionTimedOut 返回事务超时被回滚时提示用户的信息
+func (p Policy) TransactionTimedOut() string {
+	return fmt.Sprintf("Transaction exceeded %s and was rolled back by query guardrail", p.TransactionTimeout)
+}
+
+// Violation 返回记录在命令中的违反的限制, 如 max_rows=1000
+func (p Policy) Violation(name string) string {
+	switch name {
+	case ViolationMaxRows:
+		return fmt.Sprintf("%s=%d", name, p.MaxRows)
+	case ViolationStatementTimeout:
+		return name + "=" + p.StatementTimeout.String()
+	case ViolationTransactionTimeout:
+		return name + "=" + p.TransactionTimeout.String()
+	}
+	return name
+}
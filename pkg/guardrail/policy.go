@@ -0,0 +1,163 @@
+package guardrail
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/meowgen/koko/pkg/config"
+	"github.com/meowgen/koko/pkg/logger"
+)
+
+// 违反限制时记录在命令中的名称
+const (
+	ViolationMaxRows            = "max_rows"
+	ViolationStatementTimeout   = "statement_timeout"
+	ViolationTransactionTimeout = "transaction_timeout"
+)
+
+// Policy 是数据库会话的查询限制, 为 0 时不限制
+type Policy struct {
+	// MaxRows 是一个结果集返回给客户端的最大行数, 超出的行被丢弃并提示
+	MaxRows int
+	// StatementTimeout 是一条语句的最长执行时间, 超时后终止语句
+	StatementTimeout time.Duration
+	// TransactionTimeout 是事务的最长持续时间, 超时后回滚事务
+	TransactionTimeout time.Duration
+}
+
+// Empty 表示没有任何限制
+func (p Policy) Empty() bool {
+	return p.MaxRows <= 0 && p.StatementTimeout <= 0 && p.TransactionTimeout <= 0
+}
+
+// Rule 是一条查询限制规则, 每行一条, 格式为:
+//
+//	<应用>[,<应用>...] [max_rows=<行数>] [statement_timeout=<时长>] [transaction_timeout=<时长>]
+//
+// 应用是数据库应用的名称, 可以使用通配符 *, 不区分大小写, 使用第一条匹配的规则. 例如:
+//
+//	prod-* max_rows=1000 statement_timeout=30s transaction_timeout=5m
+//	* max_rows=10000
+type Rule struct {
+	Apps   []string
+	Policy Policy
+}
+
+// ParseRules 解析多行的查询限制规则, 忽略空行和以 # 开头的注释
+func ParseRules(content string) ([]Rule, error) {
+	var rules []Rule
+	for _, line := range strings.Split(content, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		rule, err := ParseRule(line)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// ParseRule 解析一条查询限制规则
+func ParseRule(line string) (Rule, error) {
+	var rule Rule
+	fields := strings.Fields(line)
+	if len(fields) < 2 {
+		return rule, fmt.Errorf("guardrail rule %q: expect <apps> <limit>=<value>", line)
+	}
+	for _, app := range strings.Split(fields[0], ",") {
+		app = strings.ToLower(strings.TrimSpace(app))
+		if app == "" {
+			continue
+		}
+		if _, err := path.Match(app, ""); err != nil {
+			return rule, fmt.Errorf("guardrail rule %q: invalid app %q", line, app)
+		}
+		rule.Apps = append(rule.Apps, app)
+	}
+	if len(rule.Apps) == 0 {
+		return rule, fmt.Errorf("guardrail rule %q: missing app", line)
+	}
+	for _, field := range fields[1:] {
+		i := strings.IndexByte(field, '=')
+		if i <= 0 {
+			return rule, fmt.Errorf("guardrail rule %q: invalid limit %q", line, field)
+		}
+		name, value := strings.ToLower(field[:i]), field[i+1:]
+		var err error
+		switch name {
+		case ViolationMaxRows:
+			rule.Policy.MaxRows, err = strconv.Atoi(value)
+			if err == nil && rule.Policy.MaxRows < 0 {
+				err = fmt.Errorf("negative rows")
+			}
+		case ViolationStatementTimeout:
+			rule.Policy.StatementTimeout, err = parseDuration(value)
+		case ViolationTransactionTimeout:
+			rule.Policy.TransactionTimeout, err = parseDuration(value)
+		default:
+			return rule, fmt.Errorf("guardrail rule %q: unknown limit %q", line, name)
+		}
+		if err != nil {
+			return rule, fmt.Errorf("guardrail rule %q: invalid %s %q: %s", line, name, value, err)
+		}
+	}
+	return rule, nil
+}
+
+// parseDuration 解析时长, 没有单位时为秒
+func parseDuration(value string) (time.Duration, error) {
+	if seconds, err := strconv.Atoi(value); err == nil {
+		value = strconv.Itoa(seconds) + "s"
+	}
+	d, err := time.ParseDuration(value)
+	if err == nil && d < 0 {
+		err = fmt.Errorf("negative duration")
+	}
+	return d, err
+}
+
+// Match 判断规则是否适用于应用
+func (r Rule) Match(app string) bool {
+	app = strings.ToLower(app)
+	for _, pattern := range r.Apps {
+		if ok, _ := path.Match(pattern, app); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// MatchPolicy 返回第一条匹配应用的规则的限制
+func MatchPolicy(rules []Rule, app string) Policy {
+	for _, rule := range rules {
+		if rule.Match(app) {
+			return rule.Policy
+		}
+	}
+	return Policy{}
+}
+
+var (
+	configRulesOnce sync.Once
+	configRules     []Rule
+)
+
+// ForApplication 返回配置文件中 QUERY_GUARDRAILS 对应用的查询限制
+func ForApplication(app string) Policy {
+	configRulesOnce.Do(func() {
+		rules, err := ParseRules(config.GetConf().QueryGuardrails)
+		if err != nil {
+			logger.Errorf("Config QUERY_GUARDRAILS is invalid, ignore it: %s", err)
+			return
+		}
+		configRules = rules
+	})
+	return MatchPolicy(configRules, app)
+}
@@ -0,0 +1,62 @@
+package guardrail
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseRules(t *testing.T) {
+	content := `
+# 生产库限制结果行数和执行时间
+prod-*,Billing max_rows=1000 statement_timeout=30s transaction_timeout=5m
+* max_rows=10000 statement_timeout=120
+`
+	rules, err := ParseRules(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != 2 {
+		t.Fatalf("expect 2 rules but %d", len(rules))
+	}
+	expected := Policy{MaxRows: 1000, StatementTimeout: 30 * time.Second, TransactionTimeout: 5 * time.Minute}
+	if p := MatchPolicy(rules, "PROD-mysql"); p != expected {
+		t.Errorf("policy of prod-mysql should be %+v but %+v", expected, p)
+	}
+	if p := MatchPolicy(rules, "billing"); p != expected {
+		t.Errorf("policy of billing should be %+v but %+v", expected, p)
+	}
+	if p := MatchPolicy(rules, "test"); p.MaxRows != 10000 || p.StatementTimeout != 2*time.Minute {
+		t.Errorf("unexpected policy of test %+v", p)
+	}
+	if p := MatchPolicy(rules[:1], "test"); !p.Empty() {
+		t.Errorf("policy of unmatched app should be empty but %+v", p)
+	}
+
+	for _, line := range []string{
+		"prod",
+		"prod max_rows",
+		"prod max_rows=-1",
+		"prod max_rows=ten",
+		"prod statement_timeout=-5s",
+		"prod idle_timeout=5m",
+		"prod-[ max_rows=10",
+	} {
+		if _, err := ParseRule(line); err == nil {
+			t.Errorf("rule %q should be invalid", line)
+		}
+	}
+}
+
+func TestPolicy_Violation(t *testing.T) {
+	p := Policy{MaxRows: 1000, StatementTimeout: 30 * time.Second, TransactionTimeout: 5 * time.Minute}
+	tests := map[string]string{
+		ViolationMaxRows:            "max_rows=1000",
+		ViolationStatementTimeout:   "statement_timeout=30s",
+		ViolationTransactionTimeout: "transaction_timeout=5m0s",
+	}
+	for name, expected := range tests {
+		if v := p.Violation(name); v != expected {
+			t.Errorf("violation %s should be %q but %q", name, expected, v)
+		}
+	}
+}
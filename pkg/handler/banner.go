@@ -37,7 +37,8 @@ func (h *InteractiveHandler) displayBanner(sess io.ReadWriter, user string, term
 		{id: 7, instruct: "r", helpText: lang.T("refresh your assets and nodes")},
 		{id: 8, instruct: "s", helpText: lang.T("Chinese-English-Japanese switch")},
 		{id: 9, instruct: "h", helpText: lang.T("print help")},
-		{id: 10, instruct: "q", helpText: lang.T("exit")},
+		{id: 10, instruct: "x", helpText: lang.T("batch execute command on the assets, such as: x, x g1, x /192.168, x 1,3-5")},
+		{id: 11, instruct: "q", helpText: lang.T("exit")},
 	}
 
 	title := defaultTitle
@@ -0,0 +1,353 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/meowgen/koko/pkg/common"
+	"github.com/meowgen/koko/pkg/config"
+	"github.com/meowgen/koko/pkg/i18n"
+	"github.com/meowgen/koko/pkg/jms-sdk-go/model"
+	"github.com/meowgen/koko/pkg/jms-sdk-go/service"
+	"github.com/meowgen/koko/pkg/logger"
+	"github.com/meowgen/koko/pkg/proxy"
+	"github.com/meowgen/koko/pkg/srvconn"
+)
+
+// getBatchConcurrency 返回批量执行的并发数, 不超过配置的上限
+func getBatchConcurrency(n int) int {
+	limit := config.GetConf().BatchExecConcurrency
+	if limit <= 0 {
+		limit = 1
+	}
+	if n <= 0 || n > limit {
+		return limit
+	}
+	return n
+}
+
+// batchTarget 是批量执行的资产和用户在该资产上授权的系统用户
+type batchTarget struct {
+	asset       model.Asset
+	systemUsers []model.SystemUser
+	err         error
+}
+
+func (t *batchTarget) getSystemUser(id string) (model.SystemUser, bool) {
+	for i := range t.systemUsers {
+		if t.systemUsers[i].ID == id {
+			return t.systemUsers[i], true
+		}
+	}
+	return model.SystemUser{}, false
+}
+
+// batchResult 是单个资产的执行结果
+type batchResult struct {
+	asset model.Asset
+	code  int
+	msg   string
+}
+
+// BatchExecutor 在多个资产上并发执行同一条命令, 输出带主机前缀, 每个资产单独记录会话
+type BatchExecutor struct {
+	jmsService  *service.JMService
+	user        *model.User
+	i18nLang    string
+	concurrency int
+
+	remoteAddr string
+	out        io.Writer
+	outLock    sync.Mutex
+}
+
+func NewBatchExecutor(jmsService *service.JMService, user *model.User, i18nLang string,
+	concurrency int, remoteAddr string, out io.Writer) *BatchExecutor {
+	return &BatchExecutor{
+		jmsService:  jmsService,
+		user:        user,
+		i18nLang:    i18nLang,
+		concurrency: getBatchConcurrency(concurrency),
+		remoteAddr:  remoteAddr,
+		out:         out,
+	}
+}
+
+// forEach 以配置的并发数对 0..n-1 调用 fn
+func (b *BatchExecutor) forEach(n int, fn func(i int)) {
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, b.concurrency)
+	for i := 0; i < n; i++ {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(i int) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			fn(i)
+		}(i)
+	}
+	wg.Wait()
+}
+
+// LoadTargets 获取资产详情和授权的系统用户, 只保留 SSH 协议的系统用户
+func (b *BatchExecutor) LoadTargets(assetIDs []string) []batchTarget {
+	targets := make([]batchTarget, len(assetIDs))
+	b.forEach(len(assetIDs), func(i int) {
+		asset, err := b.jmsService.GetAssetById(assetIDs[i])
+		if err != nil || asset.ID == "" {
+			logger.Errorf("Batch exec get asset %s failed: %v", assetIDs[i], err)
+			targets[i] = batchTarget{asset: model.Asset{ID: assetIDs[i]},
+				err: fmt.Errorf("asset %s not found", assetIDs[i])}
+			return
+		}
+		targets[i].asset = asset
+		systemUsers, err := b.jmsService.GetSystemUsersByUserIdAndAssetId(b.user.ID, asset.ID)
+		if err != nil {
+			logger.Errorf("Batch exec get asset %s system users failed: %s", asset.ID, err)
+			targets[i].err = err
+			return
+		}
+		for j := range systemUsers {
+			if systemUsers[j].Protocol == srvconn.ProtocolSSH {
+				targets[i].systemUsers = append(targets[i].systemUsers, systemUsers[j])
+			}
+		}
+	})
+	return targets
+}
+
+// Run 在所有资产上以选择的系统用户执行命令, 结果按资产顺序返回
+func (b *BatchExecutor) Run(ctx context.Context, targets []batchTarget,
+	systemUser model.SystemUser, command string) []batchResult {
+	lang := i18n.NewLang(b.i18nLang)
+	results := make([]batchResult, len(targets))
+	b.forEach(len(targets), func(i int) {
+		target := &targets[i]
+		results[i] = batchResult{asset: target.asset, code: proxy.ExecExitCodeFailed}
+		select {
+		case <-ctx.Done():
+			results[i].msg = lang.T("Canceled")
+			return
+		default:
+		}
+		switch {
+		case target.err != nil:
+			results[i].msg = target.err.Error()
+			return
+		case !target.asset.IsActive:
+			results[i].msg = lang.T("The asset is inactive")
+			return
+		}
+		sysUser, ok := target.getSystemUser(systemUser.ID)
+		if !ok {
+			results[i].msg = lang.T("No permission")
+			return
+		}
+		results[i].code, results[i].msg = b.execOnAsset(ctx, target.asset, sysUser, command)
+	})
+	return results
+}
+
+func (b *BatchExecutor) execOnAsset(ctx context.Context, asset model.Asset,
+	systemUser model.SystemUser, command string) (int, string) {
+	lang := i18n.NewLang(b.i18nLang)
+	prefix := fmt.Sprintf("[%s] ", asset.Hostname)
+	stdout := newPrefixWriter(b.out, &b.outLock, prefix)
+	stderr := newPrefixWriter(b.out, &b.outLock, prefix)
+	defer stdout.Flush()
+	defer stderr.Flush()
+	conn := newOutputSession(ctx, b.remoteAddr, stderr)
+	srv, err := proxy.NewServer(conn,
+		b.jmsService,
+		proxy.ConnectProtocolType(systemUser.Protocol),
+		proxy.ConnectI18nLang(b.i18nLang),
+		proxy.ConnectUser(b.user),
+		proxy.ConnectAsset(&asset),
+		proxy.ConnectSystemUser(&systemUser),
+	)
+	if err != nil {
+		logger.Errorf("Batch exec on asset %s err: %s", asset.String(), err)
+		return proxy.ExecExitCodeFailed, lang.T("Failed")
+	}
+	logger.Infof("Request %s: user %s batch exec command on %s: %s", conn.Uuid,
+		b.user.Name, asset.String(), command)
+	code := srv.Exec(command, stdout)
+	if code != proxy.ExecExitCodeSuccess {
+		return code, lang.T("Failed")
+	}
+	return code, lang.T("Success")
+}
+
+// DisplaySummary 输出执行结果的汇总表
+func (b *BatchExecutor) DisplaySummary(results []batchResult, width int) {
+	lang := i18n.NewLang(b.i18nLang)
+	labels := []string{lang.T("Hostname"), lang.T("IP"), lang.T("Exit code"), lang.T("Result")}
+	fields := []string{"Hostname", "IP", "Code", "Result"}
+	data := make([]map[string]string, len(results))
+	var success int
+	for i := range results {
+		if results[i].code == proxy.ExecExitCodeSuccess {
+			success++
+		}
+		data[i] = map[string]string{
+			"Hostname": results[i].asset.Hostname,
+			"IP":       results[i].asset.IP,
+			"Code":     strconv.Itoa(results[i].code),
+			"Result":   results[i].msg,
+		}
+	}
+	caption := fmt.Sprintf(lang.T("Total: %d, Success: %d, Failed: %d"),
+		len(results), success, len(results)-success)
+	table := common.WrapperTable{
+		Fields: fields,
+		Labels: labels,
+		FieldsSize: map[string][3]int{
+			"Hostname": {0, 40, 0},
+			"IP":       {0, 15, 40},
+			"Code":     {0, 0, 10},
+			"Result":   {0, 0, 0},
+		},
+		Data:        data,
+		TotalSize:   width,
+		Caption:     caption,
+		TruncPolicy: common.TruncMiddle,
+	}
+	table.Initial()
+	b.outLock.Lock()
+	defer b.outLock.Unlock()
+	_, _ = io.WriteString(b.out, table.Display())
+}
+
+// batchSystemUsers 返回所有资产授权的 SSH 系统用户的并集
+func batchSystemUsers(targets []batchTarget) []model.SystemUser {
+	seen := make(map[string]struct{})
+	result := make([]model.SystemUser, 0, 4)
+	for i := range targets {
+		for _, systemUser := range targets[i].systemUsers {
+			if _, ok := seen[systemUser.ID]; ok {
+				continue
+			}
+			seen[systemUser.ID] = struct{}{}
+			result = append(result, systemUser)
+		}
+	}
+	return result
+}
+
+// matchBatchSystemUser 按名称或者用户名匹配系统用户
+func matchBatchSystemUser(user *model.User, systemUsers []model.SystemUser, key string) []model.SystemUser {
+	matched := make([]model.SystemUser, 0, len(systemUsers))
+	for i := range systemUsers {
+		username := systemUsers[i].Username
+		if systemUsers[i].UsernameSameWithUser {
+			// 此为动态系统用户，系统用户名和登录用户名相同
+			username = user.Username
+		}
+		switch key {
+		case systemUsers[i].Name, username:
+			matched = append(matched, systemUsers[i])
+		}
+	}
+	return matched
+}
+
+func getAssetIDs(assets []map[string]interface{}) []string {
+	ids := make([]string, 0, len(assets))
+	for i := range assets {
+		if id, ok := assets[i]["id"].(string); ok {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// parseIDList 解析列表中的序号, 如 1,3,5-7, 返回从 0 开始的下标
+func parseIDList(s string, max int) ([]int, error) {
+	seen := make(map[int]struct{})
+	result := make([]int, 0, max)
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		start, end := item, item
+		if index := strings.Index(item, "-"); index > 0 {
+			start, end = item[:index], item[index+1:]
+		}
+		startNum, err := strconv.Atoi(strings.TrimSpace(start))
+		if err != nil {
+			return nil, fmt.Errorf("invalid id %q", item)
+		}
+		endNum, err := strconv.Atoi(strings.TrimSpace(end))
+		if err != nil {
+			return nil, fmt.Errorf("invalid id %q", item)
+		}
+		if startNum < 1 || endNum > max || startNum > endNum {
+			return nil, fmt.Errorf("id %q out of range 1-%d", item, max)
+		}
+		for i := startNum; i <= endNum; i++ {
+			if _, ok := seen[i]; !ok {
+				seen[i] = struct{}{}
+				result = append(result, i-1)
+			}
+		}
+	}
+	if len(result) == 0 {
+		return nil, fmt.Errorf("no id in %q", s)
+	}
+	sort.Ints(result)
+	return result, nil
+}
+
+// prefixWriter 按行输出, 每行加上主机前缀, 多个主机共用同一个锁避免输出交错
+type prefixWriter struct {
+	out    io.Writer
+	lock   *sync.Mutex
+	prefix string
+	buf    []byte
+}
+
+func newPrefixWriter(out io.Writer, lock *sync.Mutex, prefix string) *prefixWriter {
+	return &prefixWriter{out: out, lock: lock, prefix: prefix}
+}
+
+func (w *prefixWriter) Write(p []byte) (int, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.buf = append(w.buf, p...)
+	for {
+		index := bytes.IndexByte(w.buf, '\n')
+		if index < 0 {
+			break
+		}
+		line := bytes.TrimSuffix(w.buf[:index], []byte("\r"))
+		if err := w.writeLine(line); err != nil {
+			return 0, err
+		}
+		w.buf = w.buf[index+1:]
+	}
+	return len(p), nil
+}
+
+// Flush 输出没有换行结尾的剩余内容
+func (w *prefixWriter) Flush() {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if len(w.buf) > 0 {
+		_ = w.writeLine(w.buf)
+		w.buf = nil
+	}
+}
+
+func (w *prefixWriter) writeLine(line []byte) error {
+	_, err := io.WriteString(w.out, w.prefix+string(line)+"\n")
+	return err
+}
@@ -0,0 +1,209 @@
+package handler
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/gliderlabs/ssh"
+
+	"github.com/meowgen/koko/pkg/i18n"
+	"github.com/meowgen/koko/pkg/jms-sdk-go/model"
+	"github.com/meowgen/koko/pkg/jms-sdk-go/service"
+	"github.com/meowgen/koko/pkg/logger"
+	"github.com/meowgen/koko/pkg/proxy"
+	"github.com/meowgen/koko/pkg/utils"
+)
+
+// BatchExecCommand 是批量执行的 exec 命令名, 如:
+// ssh user@koko batch [-p 5] [-u root] (-g node | -s keyword | -a host1,host2) command
+const BatchExecCommand = "batch"
+
+// batchTableWidth 是 exec 请求没有终端时汇总表的宽度
+const batchTableWidth = 120
+
+var errBatchExecUsage = errors.New("usage: batch [-p concurrency] [-u system user] " +
+	"(-g node | -s keyword | -a host1,host2) command")
+
+func IsBatchExecCommand(args []string) bool {
+	return len(args) > 0 && args[0] == BatchExecCommand
+}
+
+type batchExecArgs struct {
+	concurrency int
+	systemUser  string
+	node        string
+	search      string
+	hosts       string
+	command     string
+}
+
+func parseBatchExecArgs(args []string, output io.Writer) (batchExecArgs, error) {
+	var opts batchExecArgs
+	fs := flag.NewFlagSet(BatchExecCommand, flag.ContinueOnError)
+	fs.SetOutput(output)
+	fs.IntVar(&opts.concurrency, "p", 0, "concurrency")
+	fs.StringVar(&opts.systemUser, "u", "", "system user name or username")
+	fs.StringVar(&opts.node, "g", "", "node ID, name or key")
+	fs.StringVar(&opts.search, "s", "", "search keyword")
+	fs.StringVar(&opts.hosts, "a", "", "hostnames or IPs separated by comma")
+	if err := fs.Parse(args); err != nil {
+		return opts, err
+	}
+	opts.command = strings.TrimSpace(strings.Join(fs.Args(), " "))
+	var sources int
+	for _, v := range []string{opts.node, opts.search, opts.hosts} {
+		if v != "" {
+			sources++
+		}
+	}
+	if sources != 1 || opts.command == "" {
+		return opts, errBatchExecUsage
+	}
+	return opts, nil
+}
+
+// BatchExecHandler 处理 batch exec 请求, 输出写入标准输出, 全部成功时退出码为 0
+type BatchExecHandler struct {
+	sess       ssh.Session
+	user       *model.User
+	jmsService *service.JMService
+	i18nLang   string
+}
+
+func NewBatchExecHandler(sess ssh.Session, user *model.User, jmsService *service.JMService) *BatchExecHandler {
+	return &BatchExecHandler{
+		sess:       sess,
+		user:       user,
+		jmsService: jmsService,
+		i18nLang:   getUserDefaultLangCode(user),
+	}
+}
+
+func (b *BatchExecHandler) Dispatch() {
+	code := b.run()
+	if err := b.sess.Exit(code); err != nil {
+		logger.Errorf("User %s batch exec send exit status err: %s", b.user.Name, err)
+	}
+}
+
+func (b *BatchExecHandler) run() int {
+	lang := i18n.NewLang(b.i18nLang)
+	stderr := b.sess.Stderr()
+	args, err := parseBatchExecArgs(b.sess.Command()[1:], stderr)
+	if err != nil {
+		// 参数解析错误时 flag 已输出用法
+		if errors.Is(err, errBatchExecUsage) {
+			utils.IgnoreErrWriteString(stderr, errBatchExecUsage.Error()+"\n")
+		}
+		return proxy.ExecExitCodeFailed
+	}
+	assetIDs, err := b.getAssetIDs(args)
+	if err != nil {
+		logger.Errorf("User %s batch exec get assets err: %s", b.user.Name, err)
+		utils.IgnoreErrWriteString(stderr, err.Error()+"\n")
+		return proxy.ExecExitCodeFailed
+	}
+	if len(assetIDs) == 0 {
+		utils.IgnoreErrWriteString(stderr, lang.T("No Assets")+"\n")
+		return proxy.ExecExitCodeFailed
+	}
+	remoteAddr, _, _ := net.SplitHostPort(b.sess.RemoteAddr().String())
+	executor := NewBatchExecutor(b.jmsService, b.user, b.i18nLang, args.concurrency, remoteAddr, b.sess)
+	targets := executor.LoadTargets(assetIDs)
+	systemUsers := batchSystemUsers(targets)
+	if args.systemUser != "" {
+		systemUsers = matchBatchSystemUser(b.user, systemUsers, args.systemUser)
+	}
+	systemUsers = selectHighestPrioritySystemUsers(systemUsers)
+	switch len(systemUsers) {
+	case 0:
+		utils.IgnoreErrWriteString(stderr, lang.T("No system user found.")+"\n")
+		return proxy.ExecExitCodeFailed
+	case 1:
+	default:
+		msg := fmt.Sprintf(lang.T("Must be unique system user for %s"), args.systemUser)
+		utils.IgnoreErrWriteString(stderr, msg+"\n")
+		return proxy.ExecExitCodeFailed
+	}
+	logger.Infof("User %s batch exec command on %d assets: %s", b.user.Name, len(targets), args.command)
+	results := executor.Run(b.sess.Context(), targets, systemUsers[0], args.command)
+	executor.DisplaySummary(results, batchTableWidth)
+	for i := range results {
+		if results[i].code != proxy.ExecExitCodeSuccess {
+			return proxy.ExecExitCodeCommandFailed
+		}
+	}
+	return proxy.ExecExitCodeSuccess
+}
+
+func (b *BatchExecHandler) getAssetIDs(args batchExecArgs) ([]string, error) {
+	switch {
+	case args.node != "":
+		node, err := b.getNode(args.node)
+		if err != nil {
+			return nil, err
+		}
+		res, err := b.jmsService.GetUserNodeAssets(b.user.ID, node.ID, model.PaginationParam{})
+		if err != nil {
+			return nil, err
+		}
+		return getAssetIDs(res.Data), nil
+	case args.search != "":
+		param := model.PaginationParam{Searches: []string{args.search}}
+		res, err := b.jmsService.GetUserPermsAssets(b.user.ID, param)
+		if err != nil {
+			return nil, err
+		}
+		return getAssetIDs(res.Data), nil
+	}
+	allAssets, err := b.jmsService.GetAllUserPermsAssets(b.user.ID)
+	if err != nil {
+		return nil, err
+	}
+	return getAssetIDs(filterAssetsByHosts(allAssets, strings.Split(args.hosts, ","))), nil
+}
+
+// getNode 按 g 命令显示的序号, 节点名称或者节点 key 查找节点
+func (b *BatchExecHandler) getNode(key string) (model.Node, error) {
+	nodes, err := b.jmsService.GetUserNodes(b.user.ID)
+	if err != nil {
+		return model.Node{}, err
+	}
+	model.SortNodesByKey(nodes)
+	if num, err := strconv.Atoi(key); err == nil && num > 0 && num <= len(nodes) {
+		return nodes[num-1], nil
+	}
+	for i := range nodes {
+		switch key {
+		case nodes[i].Name, nodes[i].Key:
+			return nodes[i], nil
+		}
+	}
+	return model.Node{}, fmt.Errorf("not found node %s", key)
+}
+
+// filterAssetsByHosts 返回主机名或者 IP 在列表中的资产
+func filterAssetsByHosts(assets []map[string]interface{}, hosts []string) []map[string]interface{} {
+	hostSet := make(map[string]struct{}, len(hosts))
+	for _, host := range hosts {
+		if host = strings.TrimSpace(host); host != "" {
+			hostSet[host] = struct{}{}
+		}
+	}
+	result := make([]map[string]interface{}, 0, len(hostSet))
+	for i := range assets {
+		hostname, _ := assets[i]["hostname"].(string)
+		ip, _ := assets[i]["ip"].(string)
+		_, matchedHostname := hostSet[hostname]
+		_, matchedIP := hostSet[ip]
+		if matchedHostname || matchedIP {
+			result = append(result, assets[i])
+		}
+	}
+	return result
+}
@@ -0,0 +1,137 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/meowgen/koko/pkg/i18n"
+	"github.com/meowgen/koko/pkg/jms-sdk-go/model"
+	"github.com/meowgen/koko/pkg/logger"
+	"github.com/meowgen/koko/pkg/utils"
+)
+
+// batchExec 处理 x 命令, 在选择的多个资产上批量执行命令.
+// x: 当前搜索的全部资产; x g1: 节点下的资产; x /key: 搜索到的资产; x 1,3,5-7: 当前列表中的资产
+func (h *InteractiveHandler) batchExec(arg string) {
+	lang := i18n.NewLang(h.i18nLang)
+	assetIDs, ok := h.getBatchAssetIDs(arg)
+	if !ok {
+		return
+	}
+	if len(assetIDs) == 0 {
+		utils.IgnoreErrWriteString(h.term, utils.WrapperString(lang.T("No Assets"), utils.Red))
+		utils.IgnoreErrWriteString(h.term, utils.CharNewLine)
+		return
+	}
+	defer h.term.SetPrompt("Opt> ")
+	executor := NewBatchExecutor(h.jmsService, h.user, h.i18nLang, 0, h.sess.RemoteAddr(), h.term)
+	targets := executor.LoadTargets(assetIDs)
+	selectedMsg := fmt.Sprintf(lang.T("Selected %d assets"), len(targets))
+	utils.IgnoreErrWriteString(h.term, utils.WrapperString(selectedMsg, utils.Green))
+	utils.IgnoreErrWriteString(h.term, utils.CharNewLine)
+	systemUser, ok := h.chooseSystemUser(batchSystemUsers(targets))
+	if !ok {
+		return
+	}
+	commandTip := lang.T("Tips: Enter the command to execute on the selected assets, empty to cancel, Ctrl+C to interrupt")
+	utils.IgnoreErrWriteString(h.term, utils.WrapperString(commandTip, utils.Green))
+	utils.IgnoreErrWriteString(h.term, utils.CharNewLine)
+	h.term.SetPrompt("[Command]> ")
+	line, err := h.term.ReadLine()
+	if err != nil {
+		return
+	}
+	command := strings.TrimSpace(line)
+	if command == "" {
+		return
+	}
+	logger.Infof("Request %s: user %s batch exec command on %d assets: %s",
+		h.sess.Uuid, h.user.Name, len(targets), command)
+	ctx, cancel := context.WithCancel(h.sess.Context())
+	defer cancel()
+	go h.watchBatchInterrupt(cancel)
+	results := executor.Run(ctx, targets, systemUser, command)
+	// 关闭读取, 结束等待中断的 goroutine
+	_ = h.sess.Close()
+	w, _ := h.term.GetSize()
+	executor.DisplaySummary(results, w)
+}
+
+// watchBatchInterrupt 批量执行时用户输入 Ctrl+C 则中断执行
+func (h *InteractiveHandler) watchBatchInterrupt(cancel context.CancelFunc) {
+	buf := make([]byte, 1024)
+	for {
+		nr, err := h.sess.Read(buf)
+		if nr > 0 && strings.ContainsRune(string(buf[:nr]), 3) {
+			logger.Infof("Request %s: user %s interrupt batch exec", h.sess.Uuid, h.user.Name)
+			cancel()
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (h *InteractiveHandler) getBatchAssetIDs(arg string) ([]string, bool) {
+	lang := i18n.NewLang(h.i18nLang)
+	u := h.selectHandler
+	switch {
+	case strings.HasPrefix(arg, "g"):
+		num, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(arg, "g")))
+		h.wg.Wait() // 等待node加载完成
+		if err != nil || num <= 0 || num > len(h.nodes) {
+			utils.IgnoreErrWriteString(h.term, lang.T("Invalid node ID")+utils.CharNewLine)
+			return nil, false
+		}
+		res, err := h.jmsService.GetUserNodeAssets(h.user.ID, h.nodes[num-1].ID, model.PaginationParam{})
+		if err != nil {
+			logger.Errorf("Get user %s node assets failed %s", h.user.Name, err)
+			utils.IgnoreErrWriteString(h.term, lang.T("Core API failed")+utils.CharNewLine)
+			return nil, false
+		}
+		return getAssetIDs(res.Data), true
+	case strings.HasPrefix(arg, "/"):
+		param := model.PaginationParam{Searches: []string{strings.TrimSpace(arg[1:])}}
+		res, err := h.jmsService.GetUserPermsAssets(h.user.ID, param)
+		if err != nil {
+			logger.Errorf("Get user perm assets failed: %s", err)
+			utils.IgnoreErrWriteString(h.term, lang.T("Core API failed")+utils.CharNewLine)
+			return nil, false
+		}
+		return getAssetIDs(res.Data), true
+	}
+	switch u.currentType {
+	case TypeAsset, TypeNodeAsset:
+	default:
+		utils.IgnoreErrWriteString(h.term, lang.T("Please search assets first")+utils.CharNewLine)
+		return nil, false
+	}
+	if arg == "" {
+		return getAssetIDs(u.retrieveAll()), true
+	}
+	indexes, err := parseIDList(arg, len(u.currentResult))
+	if err != nil {
+		logger.Debugf("User %s batch exec invalid id list: %s", h.user.Name, err)
+		utils.IgnoreErrWriteString(h.term, lang.T("Invalid ID list")+utils.CharNewLine)
+		return nil, false
+	}
+	assets := make([]map[string]interface{}, 0, len(indexes))
+	for _, index := range indexes {
+		assets = append(assets, u.currentResult[index])
+	}
+	return getAssetIDs(assets), true
+}
+
+// retrieveAll 获取当前搜索的全部结果, 不改变当前的分页
+func (u *UserSelectHandler) retrieveAll() []map[string]interface{} {
+	currentPage := *u.pageInfo
+	hasPre, hasNext := u.hasPre, u.hasNext
+	defer func() {
+		*u.pageInfo = currentPage
+		u.hasPre, u.hasNext = hasPre, hasNext
+	}()
+	return u.Retrieve(PAGESIZEALL, 0, u.searchKeys...)
+}
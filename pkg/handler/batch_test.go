@@ -0,0 +1,87 @@
+package handler
+
+import (
+	"bytes"
+	"io/ioutil"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func TestParseIDList(t *testing.T) {
+	tests := []struct {
+		input   string
+		max     int
+		want    []int
+		wantErr bool
+	}{
+		{"1", 3, []int{0}, false},
+		{"3,1", 3, []int{0, 2}, false},
+		{"1,3,5-7", 8, []int{0, 2, 4, 5, 6}, false},
+		{" 2 - 3 , 2", 3, []int{1, 2}, false},
+		{"0", 3, nil, true},
+		{"4", 3, nil, true},
+		{"3-1", 3, nil, true},
+		{"a", 3, nil, true},
+		{",", 3, nil, true},
+	}
+	for _, tt := range tests {
+		got, err := parseIDList(tt.input, tt.max)
+		if (err != nil) != tt.wantErr {
+			t.Fatalf("parseIDList(%q) err = %v", tt.input, err)
+		}
+		if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+			t.Fatalf("parseIDList(%q) = %v, want %v", tt.input, got, tt.want)
+		}
+	}
+}
+
+func TestPrefixWriter(t *testing.T) {
+	var (
+		out  bytes.Buffer
+		lock sync.Mutex
+	)
+	w1 := newPrefixWriter(&out, &lock, "[web1] ")
+	w2 := newPrefixWriter(&out, &lock, "[web2] ")
+	_, _ = w1.Write([]byte("hel"))
+	_, _ = w2.Write([]byte("foo\r\nbar"))
+	_, _ = w1.Write([]byte("lo\nworld"))
+	w1.Flush()
+	w2.Flush()
+	want := "[web2] foo\n[web1] hello\n[web1] world\n[web2] bar\n"
+	if got := out.String(); got != want {
+		t.Fatalf("output = %q, want %q", got, want)
+	}
+}
+
+func TestParseBatchExecArgs(t *testing.T) {
+	args, err := parseBatchExecArgs([]string{"-p", "5", "-u", "root", "-g", "2", "ls", "-l"}, ioutil.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if args.concurrency != 5 || args.systemUser != "root" || args.node != "2" || args.command != "ls -l" {
+		t.Fatalf("args = %+v", args)
+	}
+	for _, input := range [][]string{
+		{"ls"},
+		{"-g", "1", "-s", "web", "ls"},
+		{"-a", "web1"},
+		{"-x", "ls"},
+	} {
+		if _, err := parseBatchExecArgs(input, ioutil.Discard); err == nil {
+			t.Fatalf("parseBatchExecArgs(%v) should fail", input)
+		}
+	}
+}
+
+func TestFilterAssetsByHosts(t *testing.T) {
+	assets := []map[string]interface{}{
+		{"id": "1", "hostname": "web1", "ip": "10.0.0.1"},
+		{"id": "2", "hostname": "web2", "ip": "10.0.0.2"},
+		{"id": "3", "hostname": "db1", "ip": "10.0.0.3"},
+	}
+	got := getAssetIDs(filterAssetsByHosts(assets, []string{"web1", " 10.0.0.3", ""}))
+	if !reflect.DeepEqual(got, []string{"1", "3"}) {
+		t.Fatalf("filter = %v", got)
+	}
+}
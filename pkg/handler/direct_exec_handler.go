@@ -0,0 +1,96 @@
+package handler
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/meowgen/koko/pkg/config"
+	"github.com/meowgen/koko/pkg/i18n"
+	"github.com/meowgen/koko/pkg/logger"
+	"github.com/meowgen/koko/pkg/proxy"
+	"github.com/meowgen/koko/pkg/utils"
+)
+
+// vscodeShells 是 VSCode Remote-SSH 请求的命令, 之后经标准输入发送安装和启动脚本
+var vscodeShells = map[string]bool{"sh": true, "bash": true, "zsh": true, "fish": true}
+
+// IsVSCodeRequest 判断直连的 exec 请求是否是 VSCode Remote-SSH 的连接.
+// VSCode 请求不带参数的 shell, 其他命令作为 exec 在资产上执行
+func IsVSCodeRequest(command string) bool {
+	if !config.GetConf().EnableVscodeSupport {
+		return false
+	}
+	fields := strings.Fields(command)
+	if len(fields) == 0 {
+		return true
+	}
+	if !vscodeShells[path.Base(fields[0])] {
+		return false
+	}
+	for _, arg := range fields[1:] {
+		if arg != "-l" && arg != "--login" && arg != "-s" {
+			return false
+		}
+	}
+	return true
+}
+
+// DispatchExec 处理 exec 请求, 在唯一匹配的资产上执行命令, 并把命令的退出码返回给用户
+func (d *DirectHandler) DispatchExec() {
+	code := d.execCommand()
+	if err := d.sess.Exit(code); err != nil {
+		logger.Errorf("User %s exec request send exit status err: %s", d.opts.User, err)
+	}
+}
+
+func (d *DirectHandler) execCommand() int {
+	conn := NewExecSession(d.sess)
+	command := d.opts.execCommand
+	var (
+		srv *proxy.Server
+		err error
+	)
+	if d.opts.IsTokenConnection() {
+		srv, err = d.newConnectTokenServer(conn)
+	} else {
+		srv, err = d.newExecServer(conn)
+	}
+	if err != nil {
+		logger.Errorf("User %s exec request err: %s", d.opts.User, err)
+		return proxy.ExecExitCodeFailed
+	}
+	logger.Infof("Request %s: user %s exec command: %s", conn.Uuid, d.opts.User, command)
+	return srv.Exec(command, d.sess)
+}
+
+func (d *DirectHandler) newExecServer(conn *ExecSession) (*proxy.Server, error) {
+	lang := i18n.NewLang(d.i18nLang)
+	if len(d.assets) != 1 {
+		msg := fmt.Sprintf(lang.T("Must be unique asset for %s"), d.opts.targetAsset)
+		utils.IgnoreErrWriteString(conn, msg+"\n")
+		return nil, fmt.Errorf("matched %d assets for %s", len(d.assets), d.opts.targetAsset)
+	}
+	asset := d.assets[0]
+	matched := selectHighestPrioritySystemUsers(d.getMatchedSystemUsers(asset))
+	switch len(matched) {
+	case 0:
+		msg := fmt.Sprintf(lang.T("not found matched username %s"), d.opts.targetSystemUser)
+		utils.IgnoreErrWriteString(conn, msg+"\n")
+		return nil, fmt.Errorf("no found matched system user: %s", d.opts.targetSystemUser)
+	case 1:
+	default:
+		msg := fmt.Sprintf(lang.T("Must be unique system user for %s"), d.opts.targetSystemUser)
+		utils.IgnoreErrWriteString(conn, msg+"\n")
+		return nil, fmt.Errorf("matched %d system users for %s", len(matched), d.opts.targetSystemUser)
+	}
+	d.selectedSystemUser = &matched[0]
+	return proxy.NewServer(conn,
+		d.jmsService,
+		proxy.ConnectProtocolType(d.selectedSystemUser.Protocol),
+		proxy.ConnectUser(d.opts.User),
+		proxy.ConnectAsset(&asset),
+		proxy.ConnectSystemUser(d.selectedSystemUser),
+		proxy.ConnectI18nLang(d.i18nLang),
+	)
+}
@@ -0,0 +1,35 @@
+package handler
+
+import (
+	"testing"
+
+	"github.com/meowgen/koko/pkg/config"
+)
+
+func TestIsVSCodeRequest(t *testing.T) {
+	tests := []struct {
+		command string
+		vscode  bool
+	}{
+		{"bash", true},
+		{"/bin/bash --login", true},
+		{"sh -s", true},
+		{"uptime", false},
+		{"ls -l /tmp", false},
+		{"bash -c 'uptime'", false},
+		{"bash deploy.sh", false},
+	}
+	conf := config.GlobalConfig
+	defer func() { config.GlobalConfig = conf }()
+	for _, enabled := range []bool{true, false} {
+		config.GlobalConfig = &config.Config{EnableVscodeSupport: enabled}
+		for _, tt := range tests {
+			// 开启 vscode 支持时, 直连的 exec 命令仍在资产上执行
+			want := enabled && tt.vscode
+			if got := IsVSCodeRequest(tt.command); got != want {
+				t.Errorf("IsVSCodeRequest(%q) with vscode support %v = %v, want %v",
+					tt.command, enabled, got, want)
+			}
+		}
+	}
+}
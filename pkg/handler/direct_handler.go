@@ -63,6 +63,9 @@ type directOpt struct {
 	tokenInfo *model.ConnectTokenInfo
 
 	sftpMode bool
+
+	// execCommand 不为空时为 exec 请求, 只执行这条命令
+	execCommand string
 }
 
 func (d directOpt) IsTokenConnection() bool {
@@ -111,6 +114,12 @@ func DirectConnectSftpMode(sftpMode bool) DirectOpt {
 	}
 }
 
+func DirectExecCommand(command string) DirectOpt {
+	return func(opts *directOpt) {
+		opts.execCommand = command
+	}
+}
+
 func selectAssetsByDirectOpt(jmsService *service.JMService, opts *directOpt) ([]model.Asset, error) {
 	switch opts.formatType {
 	case FormatUUID:
@@ -141,7 +150,11 @@ func NewDirectHandler(sess ssh.Session, jmsService *service.JMService, optSetter
 
 	defer func() {
 		if err != nil && !opts.sftpMode {
-			utils.IgnoreErrWriteString(sess, errMsg)
+			var w io.Writer = sess
+			if opts.execCommand != "" {
+				w = sess.Stderr()
+			}
+			utils.IgnoreErrWriteString(w, errMsg)
 		}
 	}()
 	if !opts.IsTokenConnection() {
@@ -158,7 +171,12 @@ func NewDirectHandler(sess ssh.Session, jmsService *service.JMService, optSetter
 			return nil, err
 		}
 	}
-	if !opts.sftpMode {
+	switch {
+	case opts.sftpMode:
+	case opts.execCommand != "":
+		// exec 请求不能交互, 提示信息写入标准错误
+		term = utils.NewTerminal(sess.Stderr(), "")
+	default:
 		wrapperSess = NewWrapperSession(sess)
 		term = utils.NewTerminal(wrapperSess, "Opt> ")
 	}
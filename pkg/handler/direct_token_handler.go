@@ -8,6 +8,18 @@ import (
 )
 
 func (d *DirectHandler) LoginConnectToken() {
+	tokenInfo := d.opts.tokenInfo
+	srv, err := d.newConnectTokenServer(d.wrapperSess)
+	if err != nil {
+		logger.Error(err)
+		return
+	}
+	srv.Proxy()
+	logger.Infof("Request %s: token %s proxy end", d.wrapperSess.Uuid, tokenInfo.Id)
+
+}
+
+func (d *DirectHandler) newConnectTokenServer(conn proxy.UserConnection) (*proxy.Server, error) {
 	tokenInfo := d.opts.tokenInfo
 	user := tokenInfo.User
 	systemUserAuthInfo := tokenInfo.SystemUserAuthInfo
@@ -19,9 +31,8 @@ func (d *DirectHandler) LoginConnectToken() {
 	sysId := systemUserAuthInfo.ID
 	systemUserDetail, err := d.jmsService.GetSystemUserById(sysId)
 	if err != nil {
-		utils.IgnoreErrWriteString(d.sess, err.Error())
-		logger.Error(err)
-		return
+		utils.IgnoreErrWriteString(conn, err.Error())
+		return nil, err
 	}
 
 	proxyOpts := make([]proxy.ConnectionOption, 0, 8)
@@ -38,12 +49,5 @@ func (d *DirectHandler) LoginConnectToken() {
 	proxyOpts = append(proxyOpts, proxy.ConnectExpired(expiredAt))
 	proxyOpts = append(proxyOpts, proxy.ConnectSystemAuthInfo(systemUserAuthInfo))
 	// попробовать создать сервер так
-	srv, err := proxy.NewServer(d.wrapperSess, d.jmsService, proxyOpts...)
-	if err != nil {
-		logger.Error(err)
-		return
-	}
-	srv.Proxy()
-	logger.Infof("Request %s: token %s proxy end", d.wrapperSess.Uuid, tokenInfo.Id)
-
+	return proxy.NewServer(conn, d.jmsService, proxyOpts...)
 }
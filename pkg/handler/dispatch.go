@@ -77,6 +77,9 @@ func (h *InteractiveHandler) Dispatch() {
 				h.selectHandler.SetSelectType(TypeK8s)
 				h.selectHandler.Search("")
 				continue
+			case "x":
+				h.batchExec("")
+				continue
 			}
 		default:
 			switch {
@@ -103,6 +106,9 @@ func (h *InteractiveHandler) Dispatch() {
 						continue
 					}
 				}
+			case strings.Index(line, "x ") == 0:
+				h.batchExec(strings.TrimSpace(strings.TrimPrefix(line, "x")))
+				continue
 			case strings.Index(line, "join") == 0:
 				roomID := strings.TrimSpace(strings.TrimPrefix(line, "join"))
 				JoinRoom(h, roomID)
@@ -0,0 +1,65 @@
+package handler
+
+import (
+	"context"
+	"net"
+
+	"github.com/gliderlabs/ssh"
+
+	"github.com/meowgen/koko/pkg/common"
+	"github.com/meowgen/koko/pkg/exchange"
+)
+
+// ExecSession 是 exec 请求的用户连接, 读取请求的标准输入, 提示信息写入标准错误
+type ExecSession struct {
+	Uuid string
+	Sess ssh.Session
+}
+
+func NewExecSession(sess ssh.Session) *ExecSession {
+	return &ExecSession{
+		Uuid: common.UUID(),
+		Sess: sess,
+	}
+}
+
+func (e *ExecSession) Read(p []byte) (int, error) {
+	return e.Sess.Read(p)
+}
+
+func (e *ExecSession) Write(p []byte) (int, error) {
+	return e.Sess.Stderr().Write(p)
+}
+
+func (e *ExecSession) Close() error {
+	return nil
+}
+
+func (e *ExecSession) ID() string {
+	return e.Uuid
+}
+
+func (e *ExecSession) WinCh() <-chan ssh.Window {
+	return nil
+}
+
+func (e *ExecSession) LoginFrom() string {
+	return "ST"
+}
+
+func (e *ExecSession) RemoteAddr() string {
+	host, _, _ := net.SplitHostPort(e.Sess.RemoteAddr().String())
+	return host
+}
+
+func (e *ExecSession) Pty() ssh.Pty {
+	return ssh.Pty{}
+}
+
+func (e *ExecSession) Context() context.Context {
+	return e.Sess.Context()
+}
+
+func (e *ExecSession) HandleRoomEvent(event string, msg *exchange.RoomMessage) {
+
+}
@@ -0,0 +1,94 @@
+package handler
+
+import (
+	"context"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/gliderlabs/ssh"
+
+	"github.com/meowgen/koko/pkg/common"
+	"github.com/meowgen/koko/pkg/exchange"
+)
+
+// ForwardSession 是没有输入的用户连接, 用于端口转发和批量执行. 写入的提示信息输出到 out,
+// out 为空时保存下来, 作为拒绝转发的原因
+type ForwardSession struct {
+	Uuid string
+
+	ctx        context.Context
+	remoteAddr string
+	out        io.Writer
+
+	mu  sync.Mutex
+	msg strings.Builder
+}
+
+func NewForwardSession(ctx context.Context, remoteAddr string) *ForwardSession {
+	return &ForwardSession{
+		Uuid:       common.UUID(),
+		ctx:        ctx,
+		remoteAddr: remoteAddr,
+	}
+}
+
+// newOutputSession 返回提示信息写入 out 的用户连接
+func newOutputSession(ctx context.Context, remoteAddr string, out io.Writer) *ForwardSession {
+	f := NewForwardSession(ctx, remoteAddr)
+	f.out = out
+	return f
+}
+
+// Message 返回写入的提示信息
+func (f *ForwardSession) Message() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return strings.TrimSpace(f.msg.String())
+}
+
+// Read 没有输入, 作为命令的标准输入时命令立即读到结束
+func (f *ForwardSession) Read(p []byte) (int, error) {
+	return 0, io.EOF
+}
+
+func (f *ForwardSession) Write(p []byte) (int, error) {
+	if f.out != nil {
+		return f.out.Write(p)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.msg.Write(p)
+}
+
+func (f *ForwardSession) Close() error {
+	return nil
+}
+
+func (f *ForwardSession) ID() string {
+	return f.Uuid
+}
+
+func (f *ForwardSession) WinCh() <-chan ssh.Window {
+	return nil
+}
+
+func (f *ForwardSession) LoginFrom() string {
+	return "ST"
+}
+
+func (f *ForwardSession) RemoteAddr() string {
+	return f.remoteAddr
+}
+
+func (f *ForwardSession) Pty() ssh.Pty {
+	return ssh.Pty{}
+}
+
+func (f *ForwardSession) Context() context.Context {
+	return f.ctx
+}
+
+func (f *ForwardSession) HandleRoomEvent(event string, msg *exchange.RoomMessage) {
+
+}
@@ -0,0 +1,34 @@
+package hostkey
+
+import (
+	"fmt"
+	"strings"
+)
+
+// 错误信息中的关键字, 用于转换成用户可读的信息
+const (
+	KeyChangedMsg  = "host key has changed"
+	UnknownHostMsg = "host key is unknown"
+)
+
+// KeyChangedError 表示主机密钥与已保存或资产指定的密钥不一致
+type KeyChangedError struct {
+	Host        string
+	Fingerprint string
+	Want        []string
+}
+
+func (e *KeyChangedError) Error() string {
+	return fmt.Sprintf("ssh: %s for %s, possible man-in-the-middle attack (got %s, want %s)",
+		KeyChangedMsg, e.Host, e.Fingerprint, strings.Join(e.Want, ", "))
+}
+
+// UnknownHostError 表示 strict 模式下主机密钥未保存
+type UnknownHostError struct {
+	Host        string
+	Fingerprint string
+}
+
+func (e *UnknownHostError) Error() string {
+	return fmt.Sprintf("ssh: %s for %s (%s)", UnknownHostMsg, e.Host, e.Fingerprint)
+}
@@ -0,0 +1,224 @@
+package hostkey
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	gossh "golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+
+	"github.com/meowgen/koko/pkg/config"
+	"github.com/meowgen/koko/pkg/logger"
+)
+
+// 主机密钥的校验模式
+const (
+	// ModeTOFU 首次连接时信任并保存主机密钥, 之后密钥变化时拒绝连接
+	ModeTOFU = "tofu"
+	// ModeStrict 只允许已保存或资产指定的主机密钥
+	ModeStrict = "strict"
+	// ModeOff 不校验主机密钥
+	ModeOff = "off"
+)
+
+const knownHostsFile = "known_hosts"
+
+// ParseMode 解析校验模式, 为空时使用 tofu
+func ParseMode(mode string) (string, error) {
+	switch mode = strings.ToLower(strings.TrimSpace(mode)); mode {
+	case "":
+		return ModeTOFU, nil
+	case ModeTOFU, ModeStrict, ModeOff:
+		return mode, nil
+	}
+	return "", fmt.Errorf("unknown host key checking mode %q", mode)
+}
+
+// Store 是 OpenSSH known_hosts 格式的主机密钥库, 支持散列的主机名, 通配符和 @revoked
+type Store struct {
+	mode string
+	path string
+
+	mu       sync.Mutex
+	callback gossh.HostKeyCallback
+	// loadErr 是 known_hosts 文件的解析错误, 文件损坏时拒绝所有连接, 不会重新信任主机
+	loadErr error
+}
+
+// NewStore 加载 path 中已保存的主机密钥, 文件不存在时为空
+func NewStore(path, mode string) (*Store, error) {
+	s := &Store{mode: mode, path: path}
+	return s, s.load()
+}
+
+func (s *Store) load() error {
+	if _, err := os.Stat(s.path); os.IsNotExist(err) {
+		return nil
+	}
+	s.callback, s.loadErr = knownhosts.New(s.path)
+	return s.loadErr
+}
+
+// HostKeyCallback 返回校验主机密钥的回调, seeds 是资产指定的 authorized_keys 格式的主机密钥,
+// 指定时只允许这些密钥, 不使用密钥库
+func (s *Store) HostKeyCallback(seeds ...string) gossh.HostKeyCallback {
+	return s.ScopedHostKeyCallback("", seeds...)
+}
+
+// ScopedHostKeyCallback 与 HostKeyCallback 相同, 主机密钥按 scope 分开保存.
+// scope 区分网关或网域所在的网络, 不同网络中相同的地址不共用主机密钥
+func (s *Store) ScopedHostKeyCallback(scope string, seeds ...string) gossh.HostKeyCallback {
+	pinned := parseSeeds(seeds)
+	return func(hostname string, remote net.Addr, key gossh.PublicKey) error {
+		return s.Check(scope, hostname, remote, key, pinned)
+	}
+}
+
+// Check 校验主机密钥, hostname 是连接的 host:port, scope 为空时按 hostname 保存
+func (s *Store) Check(scope, hostname string, remote net.Addr, key gossh.PublicKey, pinned []gossh.PublicKey) error {
+	if s.mode == ModeOff {
+		return nil
+	}
+	hostname = scopedHostname(scope, hostname)
+	host := knownhosts.Normalize(hostname)
+	if len(pinned) > 0 {
+		if containsKey(pinned, key) {
+			return nil
+		}
+		return s.keyChanged(host, remote, key, pinned)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.loadErr != nil {
+		return fmt.Errorf("ssh: load known hosts %s: %w", s.path, s.loadErr)
+	}
+	if s.callback != nil {
+		err := s.callback(hostname, remote, key)
+		var keyErr *knownhosts.KeyError
+		switch {
+		case err == nil:
+			return nil
+		case errors.As(err, &keyErr) && len(keyErr.Want) > 0:
+			want := make([]gossh.PublicKey, 0, len(keyErr.Want))
+			for _, known := range keyErr.Want {
+				want = append(want, known.Key)
+			}
+			return s.keyChanged(host, remote, key, want)
+		case !errors.As(err, &keyErr):
+			logger.Errorf("Check host key of %s err: %s", host, err)
+			return err
+		}
+	}
+	if s.mode == ModeStrict {
+		return &UnknownHostError{Host: host, Fingerprint: gossh.FingerprintSHA256(key)}
+	}
+	if err := s.add(host, key); err != nil {
+		logger.Errorf("Save host key of %s to %s err: %s", host, s.path, err)
+	}
+	logger.Infof("Trust host key of %s on first use: %s %s", host, key.Type(), gossh.FingerprintSHA256(key))
+	return nil
+}
+
+// scopedHostname 在主机名前加上 scope, 如 domain-<id>/10.0.0.5:22 保存为 domain-<id>/10.0.0.5
+func scopedHostname(scope, hostname string) string {
+	if scope == "" {
+		return hostname
+	}
+	host, port, err := net.SplitHostPort(hostname)
+	if err != nil {
+		host, port = hostname, "22"
+	}
+	return net.JoinHostPort(scope+"/"+host, port)
+}
+
+func (s *Store) keyChanged(host string, remote net.Addr, key gossh.PublicKey, want []gossh.PublicKey) error {
+	err := &KeyChangedError{Host: host, Fingerprint: gossh.FingerprintSHA256(key)}
+	for _, k := range want {
+		err.Want = append(err.Want, gossh.FingerprintSHA256(k))
+	}
+	logger.Errorf("Host key of %s (%s) changed, possible man-in-the-middle attack: got %s, want %s",
+		host, remote, err.Fingerprint, strings.Join(err.Want, ", "))
+	return err
+}
+
+// add 把主机密钥追加到 known_hosts 文件并重新加载, 需持有锁
+func (s *Store) add(host string, key gossh.PublicKey) error {
+	f, err := os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = f.WriteString(knownhosts.Line([]string{host}, key) + "\n"); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	return s.load()
+}
+
+func containsKey(keys []gossh.PublicKey, key gossh.PublicKey) bool {
+	marshaled := key.Marshal()
+	for _, k := range keys {
+		if bytes.Equal(k.Marshal(), marshaled) {
+			return true
+		}
+	}
+	return false
+}
+
+func parseSeeds(seeds []string) []gossh.PublicKey {
+	var keys []gossh.PublicKey
+	for _, seed := range seeds {
+		rest := []byte(seed)
+		for len(bytes.TrimSpace(rest)) > 0 {
+			key, _, _, next, err := gossh.ParseAuthorizedKey(rest)
+			if err != nil {
+				logger.Errorf("Parse asset host key err: %s", err)
+				break
+			}
+			keys = append(keys, key)
+			rest = next
+		}
+	}
+	return keys
+}
+
+var (
+	defaultOnce  sync.Once
+	defaultStore *Store
+)
+
+// Default 返回配置的数据目录中的主机密钥库, 校验模式为 SSH_HOST_KEY_CHECKING
+func Default() *Store {
+	defaultOnce.Do(func() {
+		conf := config.GetConf()
+		mode, err := ParseMode(conf.SSHHostKeyChecking)
+		if err != nil {
+			logger.Errorf("Config SSH_HOST_KEY_CHECKING is invalid, use %s: %s", ModeStrict, err)
+			mode = ModeStrict
+		}
+		path := filepath.Join(conf.DataFolderPath, knownHostsFile)
+		if defaultStore, err = NewStore(path, mode); err != nil {
+			logger.Errorf("Load known hosts %s err: %s", path, err)
+		}
+		logger.Infof("SSH host key checking mode %s, known hosts %s", mode, path)
+	})
+	return defaultStore
+}
+
+// HostKeyCallback 使用默认的主机密钥库校验主机密钥
+func HostKeyCallback(seeds ...string) gossh.HostKeyCallback {
+	return Default().HostKeyCallback(seeds...)
+}
+
+// ScopedHostKeyCallback 使用默认的主机密钥库校验主机密钥, 主机密钥按 scope 分开保存
+func ScopedHostKeyCallback(scope string, seeds ...string) gossh.HostKeyCallback {
+	return Default().ScopedHostKeyCallback(scope, seeds...)
+}
@@ -0,0 +1,186 @@
+package hostkey
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	gossh "golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+func newHostKey(t *testing.T) gossh.PublicKey {
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := gossh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+var remote = &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 22}
+
+func TestStoreTOFU(t *testing.T) {
+	path := filepath.Join(t.TempDir(), knownHostsFile)
+	store, err := NewStore(path, ModeTOFU)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := newHostKey(t)
+	callback := store.HostKeyCallback()
+	if err = callback("10.0.0.1:22", remote, key); err != nil {
+		t.Fatalf("first use should be trusted but %s", err)
+	}
+	if err = callback("10.0.0.1:22", remote, key); err != nil {
+		t.Fatalf("trusted key should be accepted but %s", err)
+	}
+
+	// 重新加载后仍然使用已保存的密钥
+	store, err = NewStore(path, ModeTOFU)
+	if err != nil {
+		t.Fatal(err)
+	}
+	callback = store.HostKeyCallback()
+	if err = callback("10.0.0.1:22", remote, key); err != nil {
+		t.Fatalf("saved key should be accepted but %s", err)
+	}
+	var changedErr *KeyChangedError
+	if err = callback("10.0.0.1:22", remote, newHostKey(t)); !errors.As(err, &changedErr) {
+		t.Fatalf("changed key should be rejected but %v", err)
+	}
+	if changedErr.Host != "10.0.0.1" || len(changedErr.Want) != 1 ||
+		changedErr.Want[0] != gossh.FingerprintSHA256(key) {
+		t.Errorf("unexpected key changed error %+v", changedErr)
+	}
+	if err = callback("10.0.0.1:2222", remote, newHostKey(t)); err != nil {
+		t.Errorf("host on another port should be trusted on first use but %s", err)
+	}
+}
+
+func TestStoreScoped(t *testing.T) {
+	path := filepath.Join(t.TempDir(), knownHostsFile)
+	store, err := NewStore(path, ModeTOFU)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := newHostKey(t)
+	if err = store.ScopedHostKeyCallback("domain-a")("10.0.0.1:22", remote, key); err != nil {
+		t.Fatalf("first use should be trusted but %s", err)
+	}
+	// 其他网域或者直连的相同地址是另一台主机
+	otherKey := newHostKey(t)
+	if err = store.ScopedHostKeyCallback("domain-b")("10.0.0.1:22", remote, otherKey); err != nil {
+		t.Fatalf("host in another domain should be trusted on first use but %s", err)
+	}
+	if err = store.HostKeyCallback()("10.0.0.1:22", remote, otherKey); err != nil {
+		t.Fatalf("direct host should be trusted on first use but %s", err)
+	}
+	var changedErr *KeyChangedError
+	err = store.ScopedHostKeyCallback("domain-a")("10.0.0.1:2222", remote, key)
+	if err != nil {
+		t.Fatalf("host on another port should be trusted on first use but %s", err)
+	}
+	err = store.ScopedHostKeyCallback("domain-a")("10.0.0.1:22", remote, otherKey)
+	if !errors.As(err, &changedErr) {
+		t.Fatalf("changed key should be rejected but %v", err)
+	}
+	if changedErr.Host != "domain-a/10.0.0.1" {
+		t.Errorf("unexpected key changed host %s", changedErr.Host)
+	}
+}
+
+func TestStoreStrict(t *testing.T) {
+	path := filepath.Join(t.TempDir(), knownHostsFile)
+	key := newHostKey(t)
+	line := knownhosts.Line([]string{"10.0.0.1"}, key) + "\n"
+	if err := os.WriteFile(path, []byte(line), 0600); err != nil {
+		t.Fatal(err)
+	}
+	store, err := NewStore(path, ModeStrict)
+	if err != nil {
+		t.Fatal(err)
+	}
+	callback := store.HostKeyCallback()
+	if err = callback("10.0.0.1:22", remote, key); err != nil {
+		t.Fatalf("saved key should be accepted but %s", err)
+	}
+	var unknownErr *UnknownHostError
+	if err = callback("10.0.0.2:22", remote, newHostKey(t)); !errors.As(err, &unknownErr) {
+		t.Fatalf("unknown host should be rejected but %v", err)
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != line {
+		t.Errorf("strict mode should not save host key but %q", content)
+	}
+}
+
+func TestStorePinnedKeys(t *testing.T) {
+	store, err := NewStore(filepath.Join(t.TempDir(), knownHostsFile), ModeTOFU)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := newHostKey(t)
+	seed := string(gossh.MarshalAuthorizedKey(key))
+	callback := store.HostKeyCallback(seed)
+	if err = callback("10.0.0.1:22", remote, key); err != nil {
+		t.Fatalf("pinned key should be accepted but %s", err)
+	}
+	var changedErr *KeyChangedError
+	if err = callback("10.0.0.1:22", remote, newHostKey(t)); !errors.As(err, &changedErr) {
+		t.Fatalf("key not pinned should be rejected but %v", err)
+	}
+}
+
+func TestStoreOff(t *testing.T) {
+	path := filepath.Join(t.TempDir(), knownHostsFile)
+	store, err := NewStore(path, ModeOff)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = store.HostKeyCallback()("10.0.0.1:22", remote, newHostKey(t)); err != nil {
+		t.Fatalf("off mode should accept any key but %s", err)
+	}
+	if _, err = os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("off mode should not save host key")
+	}
+}
+
+func TestStoreCorruptFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), knownHostsFile)
+	if err := os.WriteFile(path, []byte("10.0.0.1 ssh-ed25519 not-base64\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	store, err := NewStore(path, ModeTOFU)
+	if err == nil {
+		t.Fatal("corrupt known hosts should return error")
+	}
+	if err = store.HostKeyCallback()("10.0.0.1:22", remote, newHostKey(t)); err == nil {
+		t.Fatal("corrupt known hosts should reject connection")
+	}
+}
+
+func TestParseMode(t *testing.T) {
+	for input, expected := range map[string]string{
+		"":         ModeTOFU,
+		"TOFU":     ModeTOFU,
+		" strict ": ModeStrict,
+		"off":      ModeOff,
+	} {
+		if mode, err := ParseMode(input); err != nil || mode != expected {
+			t.Errorf("mode of %q should be %s but %s %v", input, expected, mode, err)
+		}
+	}
+	if _, err := ParseMode("yes"); err == nil {
+		t.Error("unknown mode should return error")
+	}
+}
@@ -18,6 +18,8 @@ type Asset struct {
 	OrgName   string   `json:"org_name"`
 	Platform  string   `json:"platform"`
 	IsActive  bool     `json:"is_active"` // 判断资产是否禁用
+
+	SSHHostKeys []string `json:"ssh_host_keys,omitempty"` // 预置的主机密钥
 }
 
 func (a *Asset) String() string {
@@ -56,6 +58,29 @@ type Gateway struct {
 	Username   string `json:"username"`
 	Password   string `json:"password"`
 	PrivateKey string `json:"private_key"`
+
+	SSHHostKeys []string `json:"ssh_host_keys,omitempty"` // 预置的主机密钥
+
+	// Jumps 是连接网关前依次经过的跳板, 第一个直接连接, 最后一个连接该网关 (ProxyJump)
+	Jumps []Gateway `json:"jumps,omitempty"`
+}
+
+// 网关的协议, SOCKS5 和 HTTP 网关是只转发连接的代理
+const (
+	GatewayProtocolSSH    = "ssh"
+	GatewayProtocolSOCKS5 = "socks5"
+	GatewayProtocolHTTP   = "http"
+)
+
+func (g *Gateway) String() string {
+	if len(g.Jumps) == 0 {
+		return g.Name
+	}
+	names := make([]string, 0, len(g.Jumps)+1)
+	for i := range g.Jumps {
+		names = append(names, g.Jumps[i].Name)
+	}
+	return strings.Join(append(names, g.Name), " -> ")
 }
 
 type Domain struct {
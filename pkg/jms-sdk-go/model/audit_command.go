@@ -13,6 +13,17 @@ type Command struct {
 	Timestamp  int64  `json:"timestamp"`
 	RiskLevel  int64  `json:"risk_level"`
 
+	// 数据库会话中命令包含的语句类型 (如 DROP TABLE), 语句分类 (如 DDL),
+	// 操作的对象 (表, 集合或键) 和按规则计算的风险分值
+	StatementTypes []string `json:"statement_types,omitempty"`
+	Categories     []string `json:"statement_categories,omitempty"`
+	Objects        []string `json:"objects,omitempty"`
+	RiskScore      int64    `json:"risk_score,omitempty"`
+	// 数据库代理对结果集执行的脱敏, 如 shop.users.phone: partial(3,4)
+	MaskedColumns []string `json:"masked_columns,omitempty"`
+	// 违反的查询限制, 如 max_rows=1000, statement_timeout=30s
+	Violations []string `json:"guardrail_violations,omitempty"`
+
 	DateCreated time.Time `json:"@timestamp"`
 }
 
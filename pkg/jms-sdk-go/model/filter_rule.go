@@ -16,6 +16,8 @@ const (
 
 	TypeRegex = "regex"
 	TypeCmd   = "command"
+	// TypeSQL 规则的 Content 是按语句类型匹配的 SQL 规则, 只用于数据库会话
+	TypeSQL = "sql"
 )
 
 type FilterRule struct {
@@ -6,4 +6,19 @@ type HeartbeatData struct {
 	CpuUsed          float64  `json:"cpu_load"`
 	MemoryUsed       float64  `json:"memory_used"`
 	DiskUsed         float64  `json:"disk_used"`
+
+	Gateways []GatewayStatus `json:"gateways,omitempty"`
+}
+
+// GatewayStatus 是网关的健康状态
+type GatewayStatus struct {
+	ID          string  `json:"id"`
+	Name        string  `json:"name"`
+	Domain      string  `json:"domain"`
+	Healthy     bool    `json:"healthy"`
+	Latency     float64 `json:"latency"` // 毫秒
+	Connections int     `json:"connections"`
+	Failures    int     `json:"failures"`
+	LastError   string  `json:"last_error,omitempty"`
+	LastChecked int64   `json:"last_checked,omitempty"`
 }
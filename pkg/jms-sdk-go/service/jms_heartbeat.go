@@ -6,13 +6,14 @@ import (
 	"github.com/meowgen/koko/pkg/jms-sdk-go/model"
 )
 
-func (s *JMService) TerminalHeartBeat(sIds []string) (res []model.TerminalTask, err error) {
+func (s *JMService) TerminalHeartBeat(sIds []string, gateways []model.GatewayStatus) (res []model.TerminalTask, err error) {
 	data := model.HeartbeatData{
 		SessionOnlineIds: sIds,
 		CpuUsed:          common.CpuLoad1Usage(),
 		MemoryUsed:       common.MemoryUsagePercent(),
 		DiskUsed:         common.DiskUsagePercent(),
 		SessionOnline:    len(sIds),
+		Gateways:         gateways,
 	}
 	_, err = s.authClient.Post(TerminalHeartBeatURL, data, &res)
 	return
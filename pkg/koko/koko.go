@@ -1,9 +1,11 @@
 package koko
 
 import (
+	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
-	mysqlProxy "github.com/meowgen/koko/pkg/go-mysql-proxy"
+	"net"
 	"os"
 	"os/signal"
 	"syscall"
@@ -11,9 +13,16 @@ import (
 
 	"github.com/meowgen/koko/pkg/config"
 	"github.com/meowgen/koko/pkg/exchange"
+	mongoProxy "github.com/meowgen/koko/pkg/go-mongo-proxy"
+	mysqlProxy "github.com/meowgen/koko/pkg/go-mysql-proxy"
+	pgProxy "github.com/meowgen/koko/pkg/go-pg-proxy"
+	redisProxy "github.com/meowgen/koko/pkg/go-redis-proxy"
 	"github.com/meowgen/koko/pkg/httpd"
 	"github.com/meowgen/koko/pkg/i18n"
 	"github.com/meowgen/koko/pkg/logger"
+	"github.com/meowgen/koko/pkg/proxy"
+	"github.com/meowgen/koko/pkg/proxybase"
+	"github.com/meowgen/koko/pkg/srvconn"
 	"github.com/meowgen/koko/pkg/sshd"
 
 	"github.com/meowgen/koko/pkg/jms-sdk-go/model"
@@ -24,9 +33,15 @@ import (
 var Version = "unknown"
 
 type Koko struct {
-	webSrv *httpd.Server
-	sshSrv *sshd.Server
-	dbSrv  *mysqlProxy.FakeServer
+	webSrv    *httpd.Server
+	sshSrv    *sshd.Server
+	proxySrvs []dbProxyServer
+}
+
+// dbProxyServer 是数据库协议代理的服务
+type dbProxyServer interface {
+	Start()
+	Stop()
 }
 
 const (
@@ -41,10 +56,15 @@ func (k *Koko) Start() {
 	fmt.Printf(startWelcomeMsg, time.Now().Format(timeFormat), Version)
 	go k.webSrv.Start()
 	go k.sshSrv.Start()
-	go k.dbSrv.Start()
+	for _, srv := range k.proxySrvs {
+		go srv.Start()
+	}
 }
 
 func (k *Koko) Stop() {
+	for _, srv := range k.proxySrvs {
+		srv.Stop()
+	}
 	k.sshSrv.Stop()
 	k.webSrv.Stop()
 	logger.Info("Quit The KoKo")
@@ -53,6 +73,7 @@ func (k *Koko) Stop() {
 func RunForever(confPath string) {
 	config.Setup(confPath)
 	bootstrap()
+	proxy.LoadForwardAllowedPorts()
 	gracefulStop := make(chan os.Signal, 1)
 	signal.Notify(gracefulStop, syscall.SIGTERM, syscall.SIGINT, syscall.SIGQUIT)
 	jmsService := MustJMService()
@@ -61,9 +82,9 @@ func RunForever(confPath string) {
 	registerWebHandlers(jmsService, webSrv)
 	sshSrv := sshd.NewSSHServer(srv)
 	app := &Koko{
-		webSrv: webSrv,
-		sshSrv: sshSrv,
-		dbSrv:  &mysqlProxy.FakeServer{JmsService: webSrv.JmsService},
+		webSrv:    webSrv,
+		sshSrv:    sshSrv,
+		proxySrvs: newDBProxyServers(jmsService),
 	}
 	app.Start()
 
@@ -73,6 +94,64 @@ func RunForever(confPath string) {
 	app.Stop()
 }
 
+// newDBProxyServers 按配置创建开启的数据库代理, 配置了证书时允许客户端使用 TLS 连接
+func newDBProxyServers(jmsService *service.JMService) []dbProxyServer {
+	conf := config.GetConf()
+	proxies := []struct {
+		name            string
+		enable          bool
+		host, port      string
+		sslCert, sslKey string
+		newServer       func(addr string, tlsConfig *tls.Config) dbProxyServer
+	}{
+		{"MySQL", conf.EnableMySQLProxy, conf.MySQLProxyHost, conf.MySQLProxyPort,
+			conf.MySQLProxySSLCert, conf.MySQLProxySSLKey,
+			func(addr string, tlsConfig *tls.Config) dbProxyServer {
+				srv := mysqlProxy.NewFakeServer(addr, jmsService)
+				srv.MaskStmtParams = conf.MySQLProxyMaskParams
+				srv.TLSConfig = tlsConfig
+				srv.RequireSSL = tlsConfig != nil && conf.MySQLProxyRequireSSL
+				return srv
+			}},
+		{"PostgreSQL", conf.EnablePostgreSQLProxy, conf.PostgreSQLProxyHost, conf.PostgreSQLProxyPort,
+			conf.PostgreSQLProxySSLCert, conf.PostgreSQLProxySSLKey,
+			func(addr string, tlsConfig *tls.Config) dbProxyServer {
+				srv := pgProxy.NewFakeServer(addr, jmsService)
+				srv.TLSConfig = tlsConfig
+				return srv
+			}},
+		{"Redis", conf.EnableRedisProxy, conf.RedisProxyHost, conf.RedisProxyPort,
+			conf.RedisProxySSLCert, conf.RedisProxySSLKey,
+			func(addr string, tlsConfig *tls.Config) dbProxyServer {
+				srv := redisProxy.NewFakeServer(addr, jmsService)
+				srv.TLSConfig = tlsConfig
+				return srv
+			}},
+		{"MongoDB", conf.EnableMongoDBProxy, conf.MongoDBProxyHost, conf.MongoDBProxyPort,
+			conf.MongoDBProxySSLCert, conf.MongoDBProxySSLKey,
+			func(addr string, tlsConfig *tls.Config) dbProxyServer {
+				srv := mongoProxy.NewFakeServer(addr, jmsService)
+				srv.TLSConfig = tlsConfig
+				return srv
+			}},
+	}
+	var servers []dbProxyServer
+	for _, p := range proxies {
+		if !p.enable {
+			continue
+		}
+		var tlsConfig *tls.Config
+		if p.sslCert != "" && p.sslKey != "" {
+			var err error
+			if tlsConfig, err = proxybase.LoadServerTLSConfig(p.sslCert, p.sslKey); err != nil {
+				logger.Fatal(fmt.Sprintf("Load %s proxy certificate failed: %s", p.name, err))
+			}
+		}
+		servers = append(servers, p.newServer(net.JoinHostPort(p.host, p.port), tlsConfig))
+	}
+	return servers
+}
+
 func bootstrap() {
 	i18n.Initial()
 	logger.Initial()
@@ -84,6 +163,10 @@ func runTasks(jmsService *service.JMService) {
 		go uploadRemainReplay(jmsService)
 	}
 	go keepHeartbeat(jmsService)
+	if interval := config.GetConf().GatewayHealthCheckInterval; interval > 0 {
+		timeout := time.Duration(config.GetConf().SSHTimeout) * time.Second
+		go srvconn.DefaultGatewayPool().Run(time.Duration(interval)*time.Second, timeout)
+	}
 }
 
 func NewServer(jmsService *service.JMService) *server {
@@ -92,8 +175,10 @@ func NewServer(jmsService *service.JMService) *server {
 		logger.Fatal(err)
 	}
 	app := server{
-		jmsService:    jmsService,
-		vscodeClients: make(map[string]*vscodeReq),
+		jmsService:     jmsService,
+		vscodeClients:  make(map[string]*vscodeReq),
+		remoteForwards: make(map[string]context.CancelFunc),
+		localForwards:  make(map[string]*localForward),
 	}
 	app.UpdateTerminalConfig(terminalConf)
 	go app.run()
@@ -1,6 +1,7 @@
 package koko
 
 import (
+	"context"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -18,6 +19,9 @@ type server struct {
 	sync.Mutex
 
 	vscodeClients map[string]*vscodeReq
+
+	remoteForwards map[string]context.CancelFunc
+	localForwards  map[string]*localForward
 }
 
 func (s *server) run() {
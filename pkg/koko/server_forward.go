@@ -0,0 +1,388 @@
+package koko
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+
+	"github.com/gliderlabs/ssh"
+	gossh "golang.org/x/crypto/ssh"
+
+	"github.com/meowgen/koko/pkg/auth"
+	"github.com/meowgen/koko/pkg/config"
+	"github.com/meowgen/koko/pkg/handler"
+	"github.com/meowgen/koko/pkg/jms-sdk-go/model"
+	"github.com/meowgen/koko/pkg/logger"
+	"github.com/meowgen/koko/pkg/proxy"
+	"github.com/meowgen/koko/pkg/srvconn"
+	"github.com/meowgen/koko/pkg/sshd"
+)
+
+// forwardTarget 是端口转发的资产会话和在资产上使用的地址
+type forwardTarget struct {
+	srv  *proxy.Server
+	addr string
+}
+
+// maxPendingForwardChannels 是本地转发等待资产连接建立时排队的通道数
+const maxPendingForwardChannels = 64
+
+// localForward 是用户 SSH 连接上转发到一个目标的会话, 转发到同一目标的通道共用资产的 SSH 连接和会话
+type localForward struct {
+	mu       sync.Mutex
+	closed   bool
+	channels chan proxy.ForwardChannel
+
+	// remove 从用户 SSH 连接的转发中删除, 之后的通道创建新的会话
+	remove func()
+}
+
+func newLocalForward(remove func()) *localForward {
+	return &localForward{
+		channels: make(chan proxy.ForwardChannel, maxPendingForwardChannels),
+		remove:   remove,
+	}
+}
+
+// add 把通道交给转发的会话, 会话已经结束时返回 false
+func (f *localForward) add(ch *forwardChannel) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return false
+	}
+	select {
+	case f.channels <- ch:
+	default:
+		ch.reject(gossh.ResourceShortage, errors.New("too many pending forward channels"))
+	}
+	return true
+}
+
+// close 结束转发, 拒绝还没有处理的通道. 先删除转发, 之后的通道不会再拿到已经结束的转发
+func (f *localForward) close(reason gossh.RejectionReason, err error) {
+	f.remove()
+	f.mu.Lock()
+	f.closed = true
+	close(f.channels)
+	f.mu.Unlock()
+	if err == nil {
+		err = errors.New("forward session closed")
+	}
+	for ch := range f.channels {
+		ch.(*forwardChannel).reject(reason, err)
+	}
+}
+
+// forwardChannel 是 direct-tcpip 通道
+type forwardChannel struct {
+	newChan gossh.NewChannel
+}
+
+func (c *forwardChannel) Accept() (io.ReadWriteCloser, error) {
+	ch, reqs, err := c.newChan.Accept()
+	if err != nil {
+		return nil, err
+	}
+	go gossh.DiscardRequests(reqs)
+	return ch, nil
+}
+
+func (c *forwardChannel) Reject(err error) {
+	c.reject(gossh.ConnectionFailed, err)
+}
+
+func (c *forwardChannel) reject(reason gossh.RejectionReason, err error) {
+	_ = c.newChan.Reject(reason, err.Error())
+}
+
+// proxyLocalForward 把通道交给用户 SSH 连接上转发到同一目标的会话, 没有时创建
+func (s *server) proxyLocalForward(ctx ssh.Context, newChan gossh.NewChannel, destAddr string) {
+	host, port, err := parseForwardAddr(destAddr)
+	if err != nil {
+		logger.Errorf("Local forward to %s err: %s", destAddr, err)
+		_ = newChan.Reject(gossh.ConnectionFailed, err.Error())
+		return
+	}
+	ch := &forwardChannel{newChan: newChan}
+	key := forwardKey(ctx, host, port)
+	for {
+		forward, created := s.getOrCreateLocalForward(key)
+		if created {
+			go s.runLocalForward(ctx, key, forward, host, port)
+		}
+		if forward.add(ch) {
+			return
+		}
+		// 会话刚刚结束, 重新创建
+	}
+}
+
+func (s *server) runLocalForward(ctx ssh.Context, key string, forward *localForward, host string, port uint32) {
+	target, err := s.getForwardTarget(ctx, ctx, host, port)
+	if err != nil {
+		logger.Errorf("Local forward to %s err: %s", key, err)
+		forward.close(gossh.Prohibited, err)
+		return
+	}
+	err = target.srv.LocalForward(target.addr, forward.channels)
+	forward.close(gossh.ConnectionFailed, err)
+}
+
+func (s *server) getOrCreateLocalForward(key string) (*localForward, bool) {
+	s.Lock()
+	defer s.Unlock()
+	if forward, ok := s.localForwards[key]; ok {
+		return forward, false
+	}
+	var forward *localForward
+	forward = newLocalForward(func() { s.deleteLocalForward(key, forward) })
+	s.localForwards[key] = forward
+	return forward, true
+}
+
+func (s *server) deleteLocalForward(key string, forward *localForward) {
+	s.Lock()
+	defer s.Unlock()
+	if s.localForwards[key] == forward {
+		delete(s.localForwards, key)
+	}
+}
+
+func (s *server) RemotePortForwardingPermission(ctx ssh.Context, bindHost string, bindPort uint32) bool {
+	return config.GetConf().EnableRemotePortForward
+}
+
+type remoteForwardResult struct {
+	port uint32
+	err  error
+}
+
+// RemotePortForwardHandler 在资产上监听端口, 监听成功后返回资产上的端口, 转发在后台进行直到用户取消或者断开连接.
+// 用户请求端口为 0 时, 监听成功后按资产上实际监听的端口记录转发, 用户取消时使用的是实际的端口
+func (s *server) RemotePortForwardHandler(ctx ssh.Context, conn *gossh.ServerConn,
+	bindHost string, bindPort uint32) (uint32, error) {
+	forwardCtx, cancel := context.WithCancel(ctx)
+	var key string
+	if bindPort != 0 {
+		key = forwardKey(ctx, bindHost, bindPort)
+		if !s.addRemoteForward(key, cancel) {
+			cancel()
+			return 0, fmt.Errorf("remote forward %s already exists", key)
+		}
+	}
+	target, err := s.getForwardTarget(ctx, forwardCtx, bindHost, bindPort)
+	if err != nil {
+		s.deleteRemoteForward(key)
+		cancel()
+		return 0, err
+	}
+	result := make(chan remoteForwardResult, 1)
+	go func() {
+		defer cancel()
+		// onListen 在 RemoteForward 返回之前调用, key 在这之后不再修改
+		defer func() { s.deleteRemoteForward(key) }()
+		forwardPort := bindPort
+		target.srv.RemoteForward(target.addr, func(port uint32, err error) {
+			if err == nil && bindPort == 0 {
+				forwardPort = port
+				key = forwardKey(ctx, bindHost, port)
+				if !s.addRemoteForward(key, cancel) {
+					key = ""
+					err = fmt.Errorf("remote forward %s already exists", forwardKey(ctx, bindHost, port))
+					cancel()
+				}
+			}
+			result <- remoteForwardResult{port: port, err: err}
+		}, func(originAddr string, originPort uint32) (io.ReadWriteCloser, error) {
+			return sshd.OpenForwardedTCPIPChannel(conn, bindHost, forwardPort, originAddr, originPort)
+		})
+	}()
+	ret := <-result
+	return ret.port, ret.err
+}
+
+func (s *server) CancelRemotePortForwardHandler(ctx ssh.Context, bindHost string, bindPort uint32) {
+	key := forwardKey(ctx, bindHost, bindPort)
+	s.Lock()
+	cancel, ok := s.remoteForwards[key]
+	s.Unlock()
+	if ok {
+		logger.Infof("Cancel remote forward %s", key)
+		cancel()
+	}
+}
+
+// forwardKey 是用户 SSH 连接上转发的地址
+func forwardKey(ctx ssh.Context, host string, port uint32) string {
+	return ctx.SessionID() + "/" + net.JoinHostPort(host, strconv.FormatUint(uint64(port), 10))
+}
+
+func (s *server) addRemoteForward(key string, cancel context.CancelFunc) bool {
+	s.Lock()
+	defer s.Unlock()
+	if _, ok := s.remoteForwards[key]; ok {
+		return false
+	}
+	s.remoteForwards[key] = cancel
+	return true
+}
+
+func (s *server) deleteRemoteForward(key string) {
+	if key == "" {
+		return
+	}
+	s.Lock()
+	defer s.Unlock()
+	delete(s.remoteForwards, key)
+}
+
+// getForwardTarget 检查端口策略, 按转发的主机找到有权限的资产和系统用户, 创建转发的会话
+func (s *server) getForwardTarget(sshCtx ssh.Context, ctx context.Context,
+	host string, port uint32) (*forwardTarget, error) {
+	user, ok := sshCtx.Value(auth.ContextKeyUser).(*model.User)
+	if !ok || user.ID == "" {
+		return nil, errors.New("not auth user")
+	}
+	if !proxy.IsForwardPortAllowed(port) {
+		return nil, fmt.Errorf("%w: %d", proxy.ErrForwardPortDenied, port)
+	}
+	asset, systemUser, err := s.getForwardAsset(sshCtx, user, host)
+	if err != nil {
+		return nil, err
+	}
+	forwardHost := asset.IP
+	if isLoopbackHost(host) {
+		forwardHost = "127.0.0.1"
+	}
+	remoteAddr, _, _ := net.SplitHostPort(sshCtx.RemoteAddr().String())
+	conn := handler.NewForwardSession(ctx, remoteAddr)
+	srv, err := proxy.NewServer(conn,
+		s.jmsService,
+		proxy.ConnectProtocolType(systemUser.Protocol),
+		proxy.ConnectUser(user),
+		proxy.ConnectAsset(&asset),
+		proxy.ConnectSystemUser(&systemUser),
+	)
+	if err != nil {
+		logger.Errorf("User %s forward to %s failed: %s %s", user.Name, asset.String(), err, conn.Message())
+		return nil, err
+	}
+	return &forwardTarget{
+		srv:  srv,
+		addr: net.JoinHostPort(forwardHost, strconv.FormatUint(uint64(port), 10)),
+	}, nil
+}
+
+// getForwardAsset 返回转发的资产和系统用户. 指定资产登录时主机可以是本地地址, 表示登录的资产;
+// 否则主机需要是有权限资产的主机名或者 IP
+func (s *server) getForwardAsset(ctx ssh.Context, user *model.User,
+	host string) (model.Asset, model.SystemUser, error) {
+	var (
+		asset       model.Asset
+		systemUsers []model.SystemUser
+	)
+	directRequest, isDirect := ctx.Value(auth.ContextKeyDirectLoginFormat).(*auth.DirectLoginAssetReq)
+	switch {
+	case isDirect && directRequest.IsToken():
+		return asset, model.SystemUser{}, fmt.Errorf("%w: connection token", proxy.ErrForwardUnsupported)
+	case isDirect:
+		assets, err := s.getMatchedAssetsByDirectReq(user, directRequest)
+		if err != nil {
+			return asset, model.SystemUser{}, err
+		}
+		if len(assets) != 1 {
+			return asset, model.SystemUser{}, fmt.Errorf("must be unique asset for %s", directRequest.AssetInfo)
+		}
+		asset = assets[0]
+		if !isLoopbackHost(host) && !matchAssetHost(asset.Hostname, asset.IP, host) {
+			return asset, model.SystemUser{}, fmt.Errorf("forward host %s is not asset %s", host, asset.String())
+		}
+		systemUsers, err = s.getMatchedSystemUsers(user, directRequest, asset)
+		if err != nil {
+			return asset, model.SystemUser{}, err
+		}
+	default:
+		if isLoopbackHost(host) {
+			return asset, model.SystemUser{}, errors.New("forward host must be asset hostname or IP")
+		}
+		param := model.PaginationParam{Searches: []string{host}}
+		res, err := s.jmsService.GetUserPermsAssets(user.ID, param)
+		if err != nil {
+			return asset, model.SystemUser{}, err
+		}
+		assetIDs := make([]string, 0, 1)
+		for i := range res.Data {
+			hostname, _ := res.Data[i]["hostname"].(string)
+			ip, _ := res.Data[i]["ip"].(string)
+			if id, ok := res.Data[i]["id"].(string); ok && matchAssetHost(hostname, ip, host) {
+				assetIDs = append(assetIDs, id)
+			}
+		}
+		if len(assetIDs) != 1 {
+			return asset, model.SystemUser{}, fmt.Errorf("must be unique asset for %s", host)
+		}
+		if asset, err = s.jmsService.GetAssetById(assetIDs[0]); err != nil {
+			return asset, model.SystemUser{}, err
+		}
+		if systemUsers, err = s.jmsService.GetSystemUsersByUserIdAndAssetId(user.ID, asset.ID); err != nil {
+			return asset, model.SystemUser{}, err
+		}
+	}
+	if !asset.IsActive {
+		return asset, model.SystemUser{}, fmt.Errorf("asset %s is inactive", asset.String())
+	}
+	systemUser, err := selectForwardSystemUser(systemUsers)
+	if err != nil {
+		return asset, model.SystemUser{}, fmt.Errorf("%s: %w", asset.String(), err)
+	}
+	return asset, systemUser, nil
+}
+
+// selectForwardSystemUser 返回优先级最高的 SSH 系统用户, 需要唯一
+func selectForwardSystemUser(systemUsers []model.SystemUser) (model.SystemUser, error) {
+	sshUsers := make([]model.SystemUser, 0, len(systemUsers))
+	for i := range systemUsers {
+		if systemUsers[i].Protocol == srvconn.ProtocolSSH {
+			sshUsers = append(sshUsers, systemUsers[i])
+		}
+	}
+	if len(sshUsers) == 0 {
+		return model.SystemUser{}, errors.New("no ssh system user")
+	}
+	model.SortSystemUserByPriority(sshUsers)
+	if len(sshUsers) > 1 && sshUsers[0].Priority == sshUsers[1].Priority {
+		return model.SystemUser{}, errors.New("must be unique ssh system user")
+	}
+	return sshUsers[0], nil
+}
+
+// parseForwardAddr 解析 direct-tcpip 通道的目标地址
+func parseForwardAddr(addr string) (string, uint32, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid forward address %q: %w", addr, err)
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid forward port %q", portStr)
+	}
+	return host, uint32(port), nil
+}
+
+func matchAssetHost(hostname, ip, host string) bool {
+	return host != "" && (host == hostname || host == ip)
+}
+
+func isLoopbackHost(host string) bool {
+	switch host {
+	case "", "localhost":
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
@@ -4,7 +4,6 @@ import (
 	"fmt"
 	"io"
 	"net"
-	"strconv"
 	"time"
 
 	"github.com/gliderlabs/ssh"
@@ -18,7 +17,9 @@ import (
 	"github.com/meowgen/koko/pkg/i18n"
 	"github.com/meowgen/koko/pkg/jms-sdk-go/model"
 	"github.com/meowgen/koko/pkg/logger"
+	"github.com/meowgen/koko/pkg/proxy"
 	"github.com/meowgen/koko/pkg/srvconn"
+	"github.com/meowgen/koko/pkg/sshcert"
 	"github.com/meowgen/koko/pkg/sshd"
 	"github.com/meowgen/koko/pkg/utils"
 
@@ -124,20 +125,16 @@ func (s *server) LocalPortForwardingPermission(ctx ssh.Context, destinationHost
 	return config.GlobalConfig.EnableLocalPortForward
 }
 func (s *server) DirectTCPIPChannelHandler(ctx ssh.Context, newChan gossh.NewChannel, destAddr string) {
-	if !config.GetConf().EnableVscodeSupport {
-		_ = newChan.Reject(gossh.Prohibited, "port forwarding is disabled")
-		return
-	}
-	reqId, ok := ctx.Value(ctxID).(string)
-	if !ok {
-		_ = newChan.Reject(gossh.Prohibited, "port forwarding is disabled")
-		return
-	}
-	vsReq := s.getVSCodeReq(reqId)
-	if vsReq == nil {
-		_ = newChan.Reject(gossh.Prohibited, "port forwarding is disabled")
-		return
+	if reqId, ok := ctx.Value(ctxID).(string); ok && config.GetConf().EnableVscodeSupport {
+		if vsReq := s.getVSCodeReq(reqId); vsReq != nil {
+			s.proxyVscodeForward(newChan, destAddr, vsReq)
+			return
+		}
 	}
+	s.proxyLocalForward(ctx, newChan, destAddr)
+}
+
+func (s *server) proxyVscodeForward(newChan gossh.NewChannel, destAddr string, vsReq *vscodeReq) {
 	dConn, err := vsReq.client.Dial("tcp", destAddr)
 	if err != nil {
 		_ = newChan.Reject(gossh.ConnectionFailed, err.Error())
@@ -193,12 +190,31 @@ func (s *server) SessionHandler(sess ssh.Session) {
 		utils.IgnoreErrWriteWindowTitle(sess, termConf.HeaderTitle)
 		return
 	}
+	directRequest, isDirect := directReq.(*auth.DirectLoginAssetReq)
+	if isDirect && sess.RawCommand() != "" && !handler.IsVSCodeRequest(sess.RawCommand()) {
+		// 开启 vscode 支持时, VSCode 请求的 shell 按 vscode 处理, 其他命令在资产上执行
+		opts := buildDirectRequestOptions(user, directRequest)
+		opts = append(opts, handler.DirectTerminalConf(&termConf))
+		opts = append(opts, handler.DirectExecCommand(sess.RawCommand()))
+		directSrv, err := handler.NewDirectHandler(sess, s.jmsService, opts...)
+		if err != nil {
+			logger.Errorf("User %s direct exec request err: %s", user.Name, err)
+			_ = sess.Exit(proxy.ExecExitCodeFailed)
+			return
+		}
+		directSrv.DispatchExec()
+		return
+	}
+	if !isDirect && handler.IsBatchExecCommand(sess.Command()) {
+		handler.NewBatchExecHandler(sess, user, s.jmsService).Dispatch()
+		return
+	}
 	if !config.GetConf().EnableVscodeSupport {
 		utils.IgnoreErrWriteString(sess, "No PTY requested.\n")
 		return
 	}
 
-	if directRequest, ok3 := directReq.(*auth.DirectLoginAssetReq); ok3 {
+	if isDirect {
 		if directRequest.IsToken() {
 			// connection token 的方式使用 vscode 连接
 			tokenInfo := directRequest.Info
@@ -275,7 +291,8 @@ func (s *server) proxyVscode(sess ssh.Session, user *model.User, asset model.Ass
 		}
 		domainGateways = &domainInfo
 	}
-	sshAuthOpts := buildSSHClientOptions(&asset, &systemUserAuthInfo, domainGateways)
+	certReq := sshcert.Request{SessionID: ctxId, User: user.Username, ExpireAt: permInfo.ExpireAt}
+	sshAuthOpts := buildSSHClientOptions(&asset, &systemUserAuthInfo, domainGateways, certReq)
 	sshClient, err := srvconn.NewSSHClient(sshAuthOpts...)
 	if err != nil {
 		logger.Errorf("Get SSH Client failed: %s", err)
@@ -304,7 +321,8 @@ func (s *server) proxyVscodeByTokenInfo(sess ssh.Session, tokeInfo *model.Connec
 	asset := tokeInfo.Asset
 	systemUserAuthInfo := tokeInfo.SystemUserAuthInfo
 	domain := tokeInfo.Domain
-	sshAuthOpts := buildSSHClientOptions(asset, systemUserAuthInfo, domain)
+	certReq := sshcert.Request{SessionID: ctxId, User: tokeInfo.User.Username, ExpireAt: tokeInfo.ExpiredAt}
+	sshAuthOpts := buildSSHClientOptions(asset, systemUserAuthInfo, domain, certReq)
 	sshClient, err := srvconn.NewSSHClient(sshAuthOpts...)
 	if err != nil {
 		logger.Errorf("Get SSH Client failed: %s", err)
@@ -383,14 +401,19 @@ func (s *server) proxyVscodeShell(sess ssh.Session, vsReq *vscodeReq, sshClient
 }
 
 func buildSSHClientOptions(asset *model.Asset, systemUserAuthInfo *model.SystemUserAuthInfo,
-	domainGateways *model.Domain) []srvconn.SSHClientOption {
+	domainGateways *model.Domain, certReq sshcert.Request) []srvconn.SSHClientOption {
 	timeout := config.GlobalConfig.SSHTimeout
 	sshAuthOpts := make([]srvconn.SSHClientOption, 0, 7)
 	sshAuthOpts = append(sshAuthOpts, srvconn.SSHClientUsername(systemUserAuthInfo.Username))
 	sshAuthOpts = append(sshAuthOpts, srvconn.SSHClientHost(asset.IP))
+	sshAuthOpts = append(sshAuthOpts, srvconn.SSHClientHostKeys(asset.SSHHostKeys...))
 	sshAuthOpts = append(sshAuthOpts, srvconn.SSHClientPort(asset.ProtocolPort(systemUserAuthInfo.Protocol)))
 	sshAuthOpts = append(sshAuthOpts, srvconn.SSHClientPassword(systemUserAuthInfo.Password))
 	sshAuthOpts = append(sshAuthOpts, srvconn.SSHClientTimeout(timeout))
+	certReq.Principals = []string{systemUserAuthInfo.Username}
+	if certAuth, err := sshcert.Issue(certReq); err == nil && certAuth != nil {
+		sshAuthOpts = append(sshAuthOpts, srvconn.SSHClientCertAuth(certAuth))
+	}
 	if systemUserAuthInfo.PrivateKey != "" {
 		// 先使用 password 解析 PrivateKey
 		if signer, err1 := gossh.ParsePrivateKeyWithPassphrase([]byte(systemUserAuthInfo.PrivateKey),
@@ -405,20 +428,7 @@ func buildSSHClientOptions(asset *model.Asset, systemUserAuthInfo *model.SystemU
 	}
 
 	if domainGateways != nil && len(domainGateways.Gateways) > 0 {
-		proxyArgs := make([]srvconn.SSHClientOptions, 0, len(domainGateways.Gateways))
-		for i := range domainGateways.Gateways {
-			gateway := domainGateways.Gateways[i]
-			proxyArg := srvconn.SSHClientOptions{
-				Host:       gateway.IP,
-				Port:       strconv.Itoa(gateway.Port),
-				Username:   gateway.Username,
-				Password:   gateway.Password,
-				Passphrase: gateway.Password, // 兼容 带密码的private_key,
-				PrivateKey: gateway.PrivateKey,
-				Timeout:    timeout,
-			}
-			proxyArgs = append(proxyArgs, proxyArg)
-		}
+		proxyArgs := srvconn.NewDomainGatewayOptions(domainGateways, timeout)
 		sshAuthOpts = append(sshAuthOpts, srvconn.SSHClientProxyClient(proxyArgs...))
 	}
 	return sshAuthOpts
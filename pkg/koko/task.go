@@ -12,6 +12,7 @@ import (
 	"github.com/meowgen/koko/pkg/jms-sdk-go/service"
 	"github.com/meowgen/koko/pkg/logger"
 	"github.com/meowgen/koko/pkg/proxy"
+	"github.com/meowgen/koko/pkg/srvconn"
 )
 
 // uploadRemainReplay 上传遗留的录像
@@ -81,7 +82,7 @@ func keepHeartbeat(jmsService *service.JMService) {
 	for {
 		time.Sleep(30 * time.Second)
 		data := proxy.GetAliveSessions()
-		tasks, err := jmsService.TerminalHeartBeat(data)
+		tasks, err := jmsService.TerminalHeartBeat(data, srvconn.GatewayHealthStatus())
 		if err != nil {
 			logger.Error(err)
 			continue
@@ -8,11 +8,10 @@ import (
 	"sync"
 	"time"
 
-	gossh "golang.org/x/crypto/ssh"
-
 	"github.com/meowgen/koko/pkg/config"
 	"github.com/meowgen/koko/pkg/jms-sdk-go/model"
 	"github.com/meowgen/koko/pkg/logger"
+	"github.com/meowgen/koko/pkg/srvconn"
 )
 
 type domainGateway struct {
@@ -20,9 +19,17 @@ type domainGateway struct {
 	dstIP   string
 	dstPort int
 
-	sshClient       *gossh.Client
-	selectedGateway *model.Gateway
-	ln              net.Listener
+	client srvconn.GatewayClient
+	// firstConn 是选择网关时建立的到目标的连接, 留给第一个本地连接使用
+	firstConn   net.Conn
+	firstConnAt time.Time
+	ln          net.Listener
+
+	mu     sync.Mutex
+	closed bool
+	// switching 在切换网关期间不为空, 切换完成后关闭
+	switching chan struct{}
+	switchErr error
 
 	once sync.Once
 }
@@ -43,39 +50,143 @@ func (d *domainGateway) run() {
 func (d *domainGateway) handlerConn(srcCon net.Conn) {
 	defer srcCon.Close()
 	dstAddr := net.JoinHostPort(d.dstIP, strconv.Itoa(d.dstPort))
-	dstCon, err := d.sshClient.Dial("tcp", dstAddr)
-	if err != nil {
-		logger.Errorf("Domain gateway connect %s err: %s", dstAddr, err)
-		return
+	client := d.currentClient()
+	dstCon := d.takeFirstConn()
+	if dstCon == nil {
+		var err error
+		if client, dstCon, err = d.dial(dstAddr); err != nil {
+			logger.Errorf("Domain gateway connect %s err: %s", dstAddr, err)
+			return
+		}
 	}
 	defer dstCon.Close()
-	logger.Infof("Gateway %s connected %s(%p)", d.selectedGateway.Name, dstAddr, dstCon)
+	logger.Infof("Gateway %s connected %s(%p)", client, dstAddr, dstCon)
 	done := make(chan struct{}, 2)
 	go func() {
 		_, _ = io.Copy(dstCon, srcCon)
 		done <- struct{}{}
-		logger.Debugf("Gateway %s dst %s(%p) stop write", d.selectedGateway.Name,
+		logger.Debugf("Gateway %s dst %s(%p) stop write", client,
 			dstAddr, dstCon)
 	}()
 	go func() {
 		_, _ = io.Copy(srcCon, dstCon)
 		done <- struct{}{}
-		logger.Debugf("Gateway %s dst %s(%p) stop read", d.selectedGateway.Name,
+		logger.Debugf("Gateway %s dst %s(%p) stop read", client,
 			dstAddr, dstCon)
 	}()
 	<-done
-	logger.Infof("Gateway %s connect %s(%p) done", d.selectedGateway.Name, dstAddr, dstCon)
+	logger.Infof("Gateway %s connect %s(%p) done", client, dstAddr, dstCon)
+}
+
+func (d *domainGateway) currentClient() srvconn.GatewayClient {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.client
+}
+
+// dial 经当前的网关连接 dstAddr, 失败时切换网关
+func (d *domainGateway) dial(dstAddr string) (srvconn.GatewayClient, net.Conn, error) {
+	client := d.currentClient()
+	if client != nil {
+		dstCon, err := client.Dial("tcp", dstAddr)
+		if err == nil {
+			return client, dstCon, nil
+		}
+		logger.Errorf("Domain %s gateway %s dial %s err: %s, try to switch gateway",
+			d.domain.Name, client, dstAddr, err)
+		return d.failover(client, dstAddr, err)
+	}
+	return d.failover(nil, dstAddr, nil)
+}
+
+// failover 释放无法连接目标的网关, 经网关池重新选择网关. 多个连接同时失败时只切换一次,
+// 切换期间其他连接等待切换的结果. 释放和选择网关可能耗时较长, 不持有 d.mu
+func (d *domainGateway) failover(broken srvconn.GatewayClient, dstAddr string,
+	dialErr error) (srvconn.GatewayClient, net.Conn, error) {
+	d.mu.Lock()
+	if d.closed {
+		d.mu.Unlock()
+		return nil, nil, ErrDomainGatewayClosed
+	}
+	if d.client != nil && d.client != broken {
+		// 其他连接已经切换了网关
+		client := d.client
+		d.mu.Unlock()
+		dstCon, err := client.Dial("tcp", dstAddr)
+		return client, dstCon, err
+	}
+	if switching := d.switching; switching != nil {
+		d.mu.Unlock()
+		<-switching
+		return d.afterSwitch(dstAddr)
+	}
+	switching := make(chan struct{})
+	d.switching = switching
+	// 之前切换失败时 broken 已经释放, client 为空
+	drop := broken != nil && d.client == broken
+	d.client = nil
+	d.mu.Unlock()
+
+	if drop {
+		srvconn.DropGatewayClient(broken, dialErr)
+	}
+	proxyArgs := srvconn.NewDomainGatewayOptions(d.domain, config.GetConf().SSHTimeout)
+	client, dstCon, err := srvconn.DialGateway(proxyArgs, dstAddr)
+	if err != nil {
+		logger.Errorf("Domain %s has no available gateway: %s", d.domain.Name, err)
+		err = &srvconn.ConnectError{Kind: ErrNoAvailable, Err: err}
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.switching = nil
+	d.switchErr = err
+	close(switching)
+	if err != nil {
+		return nil, nil, err
+	}
+	if d.closed {
+		_ = dstCon.Close()
+		_ = client.Close()
+		return nil, nil, ErrDomainGatewayClosed
+	}
+	logger.Infof("Domain %s switch to gateway %s", d.domain.Name, client)
+	d.client = client
+	return client, dstCon, nil
+}
+
+// afterSwitch 在其他连接完成网关切换后, 经切换后的网关连接 dstAddr
+func (d *domainGateway) afterSwitch(dstAddr string) (srvconn.GatewayClient, net.Conn, error) {
+	d.mu.Lock()
+	if d.closed {
+		d.mu.Unlock()
+		return nil, nil, ErrDomainGatewayClosed
+	}
+	client, err := d.client, d.switchErr
+	d.mu.Unlock()
+	if client == nil {
+		if err == nil {
+			err = &srvconn.ConnectError{Kind: ErrNoAvailable, Err: ErrNoAvailable}
+		}
+		return nil, nil, err
+	}
+	dstCon, err := client.Dial("tcp", dstAddr)
+	return client, dstCon, err
 }
 
-var ErrNoAvailable = errors.New("no available domain")
+var (
+	ErrNoAvailable         = errors.New("no available domain")
+	ErrDomainGatewayClosed = errors.New("domain gateway closed")
+)
 
 func (d *domainGateway) Start() (err error) {
-	if !d.getAvailableGateway() {
-		return ErrNoAvailable
+	if err = d.getAvailableGateway(); err != nil {
+		return err
 	}
 	d.ln, err = net.Listen("tcp", "127.0.0.1:0")
 	if err != nil {
-		_ = d.sshClient.Close()
+		_ = d.firstConn.Close()
+		_ = d.client.Close()
 		return err
 	}
 	go d.run()
@@ -87,47 +198,36 @@ func (d *domainGateway) GetListenAddr() *net.TCPAddr {
 	return d.ln.Addr().(*net.TCPAddr)
 }
 
-func (d *domainGateway) getAvailableGateway() bool {
-	configTimeout := time.Duration(config.GetConf().SSHTimeout)
-	for i := range d.domain.Gateways {
-		gateway := d.domain.Gateways[i]
-		if gateway.Protocol == "ssh" {
-			auths := make([]gossh.AuthMethod, 0, 3)
-			if gateway.Password != "" {
-				auths = append(auths, gossh.Password(gateway.Password))
-				auths = append(auths, gossh.KeyboardInteractive(func(user, instruction string,
-					questions []string, echos []bool) (answers []string, err error) {
-					return []string{gateway.Password}, nil
-				}))
-			}
-			if gateway.PrivateKey != "" {
-				if signer, err := gossh.ParsePrivateKey([]byte(gateway.PrivateKey)); err != nil {
-					logger.Errorf("Domain gateway Parse private key error: %s", err)
-				} else {
-					auths = append(auths, gossh.PublicKeys(signer))
-				}
-			}
-			sshConfig := gossh.ClientConfig{
-				User:            gateway.Username,
-				Auth:            auths,
-				HostKeyCallback: gossh.InsecureIgnoreHostKey(),
-				Timeout:         configTimeout * time.Second,
-			}
-			addr := net.JoinHostPort(gateway.IP, strconv.Itoa(gateway.Port))
-			sshClient, err := gossh.Dial("tcp", addr, &sshConfig)
-			logger.Debugf("Domain %s try dial gateway %s", d.domain.Name, gateway.Name)
-			if err != nil {
-				logger.Errorf("Dial gateway %s err: %s ", gateway.Name, err)
-				continue
-			}
-			logger.Infof("Domain %s use gateway %s", d.domain.Name, gateway.Name)
-			d.sshClient = sshClient
-			d.selectedGateway = &gateway
-			return true
-		}
+// firstConnExpire 之后目标可能已经关闭空闲的连接, 不再使用 firstConn
+const firstConnExpire = 5 * time.Second
+
+func (d *domainGateway) takeFirstConn() net.Conn {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	conn := d.firstConn
+	d.firstConn = nil
+	if conn != nil && time.Since(d.firstConnAt) > firstConnExpire {
+		_ = conn.Close()
+		return nil
+	}
+	return conn
+}
+
+// getAvailableGateway 按网关池的选择策略选择可以连接目标的网关, 网关可以是 SSH, SOCKS5 或 HTTP 代理
+func (d *domainGateway) getAvailableGateway() error {
+	proxyArgs := srvconn.NewDomainGatewayOptions(d.domain, config.GetConf().SSHTimeout)
+	dstAddr := net.JoinHostPort(d.dstIP, strconv.Itoa(d.dstPort))
+	logger.Debugf("Domain %s try dial %s via gateways", d.domain.Name, dstAddr)
+	client, dstConn, err := srvconn.DialGateway(proxyArgs, dstAddr)
+	if err != nil {
+		logger.Errorf("Domain %s has no available gateway: %s", d.domain.Name, err)
+		return &srvconn.ConnectError{Kind: ErrNoAvailable, Err: err}
 	}
-	logger.Errorf("Domain %s has no available gateway", d.domain.Name)
-	return false
+	logger.Infof("Domain %s use gateway %s", d.domain.Name, client)
+	d.client = client
+	d.firstConn = dstConn
+	d.firstConnAt = time.Now()
+	return nil
 }
 
 func (d *domainGateway) Stop() {
@@ -137,7 +237,17 @@ func (d *domainGateway) Stop() {
 func (d *domainGateway) closeOnce() {
 	d.once.Do(func() {
 		_ = d.ln.Close()
-		_ = d.sshClient.Close()
+		if conn := d.takeFirstConn(); conn != nil {
+			_ = conn.Close()
+		}
+		d.mu.Lock()
+		d.closed = true
+		client := d.client
+		d.client = nil
+		d.mu.Unlock()
+		if client != nil {
+			_ = client.Close()
+		}
 		logger.Debugf("Domain %s close listen and gateway ssh client", d.domain.Name)
 	})
 }
@@ -0,0 +1,130 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"testing"
+
+	"github.com/meowgen/koko/pkg/jms-sdk-go/model"
+)
+
+// brokenGatewayClient 是已经断开的网关客户端
+type brokenGatewayClient struct {
+	closed bool
+}
+
+func (c *brokenGatewayClient) Dial(network, addr string) (net.Conn, error) {
+	return nil, errors.New("gateway connection closed")
+}
+
+func (c *brokenGatewayClient) Close() error {
+	c.closed = true
+	return nil
+}
+
+func (c *brokenGatewayClient) String() string { return "broken" }
+
+// startConnectProxy 启动不需要认证的 HTTP CONNECT 代理, 返回监听的端口
+func startConnectProxy(t *testing.T) int {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				req, err := http.ReadRequest(bufio.NewReader(conn))
+				if err != nil || req.Method != http.MethodConnect {
+					return
+				}
+				target, err := net.Dial("tcp", req.Host)
+				if err != nil {
+					_, _ = conn.Write([]byte("HTTP/1.1 502 Bad Gateway\r\n\r\n"))
+					return
+				}
+				defer target.Close()
+				_, _ = conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+				(&Server{}).pipeForward(context.Background(), conn, target, &forwardStats{})
+			}()
+		}
+	}()
+	return ln.Addr().(*net.TCPAddr).Port
+}
+
+func TestDomainGatewayFailover(t *testing.T) {
+	setupCertConfig(t)
+	host, port, err := net.SplitHostPort(startEchoServer(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dstPort, _ := strconv.Atoi(port)
+	proxyPort := startConnectProxy(t)
+	broken := &brokenGatewayClient{}
+	d := &domainGateway{
+		domain: &model.Domain{ID: "failover", Name: "failover", Gateways: []model.Gateway{
+			{ID: "http-proxy", Name: "http", IP: "127.0.0.1", Port: proxyPort,
+				Protocol: model.GatewayProtocolHTTP},
+		}},
+		dstIP:   host,
+		dstPort: dstPort,
+		client:  broken,
+	}
+	defer d.Stop()
+	d.ln, err = net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go d.run()
+
+	// 共用的网关断开后, 之后的连接切换到其他网关
+	for _, msg := range []string{"hello", "world"} {
+		conn, err := net.Dial("tcp", d.GetListenAddr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = conn.Write([]byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, len(msg))
+		if _, err = io.ReadFull(conn, buf); err != nil || string(buf) != msg {
+			t.Fatalf("echo %q, %v", buf, err)
+		}
+		_ = conn.Close()
+	}
+	if !broken.closed {
+		t.Fatal("broken gateway client should be closed")
+	}
+	if client := d.currentClient(); client == nil || client == broken {
+		t.Fatalf("domain gateway should switch client, got %v", client)
+	}
+}
+
+func TestDomainGatewayFailoverNoGateway(t *testing.T) {
+	setupCertConfig(t)
+	broken := &brokenGatewayClient{}
+	d := &domainGateway{
+		domain: &model.Domain{ID: "no-gateway", Name: "no-gateway"},
+		client: broken,
+	}
+	// 切换失败后 client 为空, 之后在同一个断开的网关上失败的连接不能使用空的 client
+	for i := 0; i < 2; i++ {
+		client, conn, err := d.failover(broken, "127.0.0.1:1", errors.New("closed"))
+		if err == nil || client != nil || conn != nil {
+			t.Fatalf("failover %d should fail, got %v %v %v", i, client, conn, err)
+		}
+	}
+	if client := d.currentClient(); client != nil {
+		t.Fatalf("domain gateway client should be nil, got %v", client)
+	}
+}
@@ -0,0 +1,241 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	gossh "golang.org/x/crypto/ssh"
+
+	"github.com/meowgen/koko/pkg/hostkey"
+	"github.com/meowgen/koko/pkg/jms-sdk-go/model"
+	"github.com/meowgen/koko/pkg/logger"
+	"github.com/meowgen/koko/pkg/srvconn"
+	"github.com/meowgen/koko/pkg/utils"
+)
+
+const (
+	// ExecExitCodeSuccess 是命令执行成功的退出码
+	ExecExitCodeSuccess = 0
+	// ExecExitCodeCommandFailed 是命令已经执行但没有成功时的退出码, 如批量执行时部分资产上的命令失败
+	ExecExitCodeCommandFailed = 1
+	// ExecExitCodeFailed 是命令没有在资产上执行时返回的退出码, 与 ssh 客户端出错时一致
+	ExecExitCodeFailed = 255
+)
+
+// execOutputLimit 是命令记录中保存的输出长度
+const execOutputLimit = 1024
+
+var (
+	ErrExecUnsupported = errors.New("exec request unsupported")
+	ErrExecForbidden   = errors.New("exec command forbidden")
+)
+
+// Exec 经 SSH exec 通道在资产上执行一条命令并返回退出码, 不分配终端, 用于自动化脚本.
+// 用户连接的输入作为命令的标准输入, 标准输出写入 stdout, 标准错误和提示信息写回用户连接.
+// 不能交互的流程 (手动输入认证信息, 登录复核, 命令复核) 直接拒绝.
+func (s *Server) Exec(command string, stdout io.Writer) int {
+	lang := s.connOpts.getLang()
+	writeErr := func(msg string) {
+		utils.IgnoreErrWriteString(s.UserConn, msg+"\n")
+	}
+	if err := s.checkNonInteractiveRequest(ErrExecUnsupported); err != nil {
+		logger.Errorf("Conn[%s] exec request failed: %s", s.UserConn.ID(), err)
+		writeErr(err.Error())
+		return ExecExitCodeFailed
+	}
+	confirmSrv := s.newLoginConfirmService()
+	if need, err := confirmSrv.CheckIsNeedLoginConfirm(); err != nil || need {
+		msg := lang.T("validate Login confirm err: Core Api failed")
+		if err == nil {
+			msg = lang.T("Login confirm required, exec request is not allowed")
+			err = ErrExecUnsupported
+		}
+		logger.Errorf("Conn[%s] exec login confirm: %s", s.UserConn.ID(), err)
+		writeErr(msg)
+		return ExecExitCodeFailed
+	}
+
+	ctx, cancel := context.WithCancel(s.UserConn.Context())
+	defer cancel()
+	sw := SwitchSession{
+		ID:     s.ID,
+		Ctx:    ctx,
+		Cancel: cancel,
+		P:      s,
+	}
+	if err := s.CreateSessionCallback(); err != nil {
+		logger.Errorf("Conn[%s] submit session %s to core server err: %s", s.UserConn.ID(), s.ID, err)
+		writeErr(lang.T("Connect with api server failed"))
+		return ExecExitCodeFailed
+	}
+	AddCommonSwitch(&sw)
+	defer RemoveCommonSwitch(&sw)
+	defer func() {
+		if err := s.DisConnectedCallback(); err != nil {
+			logger.Errorf("Conn[%s] update session %s err: %+v", s.UserConn.ID(), s.ID, err)
+		}
+	}()
+
+	parser := s.GetFilterParser()
+	defer parser.Close()
+	if rule, cmd, ok := parser.IsMatchCommandRule(command); ok {
+		switch rule.Action {
+		case model.ActionDeny, model.ActionConfirm:
+			// exec 请求不能等待复核, 需要复核的命令同样拒绝
+			msg := fmt.Sprintf(lang.T("Command `%s` is forbidden"), cmd)
+			writeErr(msg)
+			s.recordExecCommand(command, msg, model.DangerLevel, time.Now())
+			if err := s.ConnectedFailedCallback(ErrExecForbidden); err != nil {
+				logger.Errorf("Conn[%s] update session err: %s", s.UserConn.ID(), err)
+			}
+			logger.Infof("Conn[%s] exec command %s forbidden by rule %s", s.UserConn.ID(), command, rule.ID)
+			return ExecExitCodeFailed
+		}
+	}
+
+	sshClient, err := srvconn.NewSSHClient(s.getSSHClientOptions(s.systemUserAuthInfo)...)
+	if err != nil {
+		logger.Errorf("Conn[%s] exec get ssh client err: %s", s.UserConn.ID(), err)
+		writeErr(fmt.Sprintf("%s error: %s", s.connOpts.ConnectMsg(), s.ConvertErrorToReadableMsg(err)))
+		s.recordHostKeyChanged(err)
+		if err2 := s.ConnectedFailedCallback(err); err2 != nil {
+			logger.Errorf("Conn[%s] update session err: %s", s.UserConn.ID(), err2)
+		}
+		return ExecExitCodeFailed
+	}
+	defer sshClient.Close()
+	if err2 := s.ConnectedSuccessCallback(); err2 != nil {
+		logger.Errorf("Conn[%s] update session %s err: %s", s.UserConn.ID(), s.ID, err2)
+	}
+	startTime := time.Now()
+	output := &limitedBuffer{limit: execOutputLimit}
+	code, err := s.runExecCommand(ctx, sshClient, command, stdout, output)
+	if err != nil {
+		logger.Errorf("Conn[%s] exec command %s err: %s", s.UserConn.ID(), command, err)
+		writeErr(err.Error())
+	}
+	s.recordExecCommand(command, output.String(), model.NormalLevel, startTime)
+	logger.Infof("Conn[%s] exec command %s on %s exit status %d", s.UserConn.ID(),
+		command, sshClient, code)
+	return code
+}
+
+// checkNonInteractiveRequest 检查 exec 和端口转发请求需要的认证信息是否完整, 不支持时返回 errUnsupported
+func (s *Server) checkNonInteractiveRequest(errUnsupported error) error {
+	if s.connOpts.ProtocolType != srvconn.ProtocolSSH {
+		return fmt.Errorf("%w: protocol %s", errUnsupported, s.connOpts.ProtocolType)
+	}
+	if s.suFromSystemUserAuthInfo != nil {
+		return fmt.Errorf("%w: switch user %s", errUnsupported, s.systemUserAuthInfo)
+	}
+	// 开启 SSH CA 时使用签发的证书登录, 系统用户可以没有密码和私钥
+	authInfo := s.systemUserAuthInfo
+	noAuth := authInfo.Password == "" && authInfo.PrivateKey == "" && !s.useSSHCertificate()
+	if authInfo.Username == "" || noAuth {
+		return fmt.Errorf("%w: %s", ErrNoAuthInfo, authInfo)
+	}
+	return nil
+}
+
+// runExecCommand 执行命令并等待结束, 会话被终断或者权限过期时关闭命令
+func (s *Server) runExecCommand(ctx context.Context, sshClient *srvconn.SSHClient, command string,
+	stdout io.Writer, output *limitedBuffer) (int, error) {
+	sess, err := sshClient.AcquireSession()
+	if err != nil {
+		return ExecExitCodeFailed, err
+	}
+	defer sshClient.ReleaseSession(sess)
+	defer sess.Close()
+	stdin, err := sess.StdinPipe()
+	if err != nil {
+		return ExecExitCodeFailed, err
+	}
+	sess.Stdout = io.MultiWriter(stdout, output)
+	sess.Stderr = io.MultiWriter(s.UserConn, output)
+	if err = sess.Start(command); err != nil {
+		return ExecExitCodeFailed, err
+	}
+	go func() {
+		_, _ = io.Copy(stdin, s.UserConn)
+		_ = stdin.Close()
+	}()
+	done := make(chan error, 1)
+	go func() {
+		done <- sess.Wait()
+	}()
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case err = <-done:
+			var exitErr *gossh.ExitError
+			switch {
+			case err == nil:
+				return 0, nil
+			case errors.As(err, &exitErr):
+				return exitErr.ExitStatus(), nil
+			}
+			return ExecExitCodeFailed, err
+		case <-ctx.Done():
+			logger.Infof("Conn[%s] exec command end as session done", s.UserConn.ID())
+			_ = sess.Close()
+			return ExecExitCodeFailed, <-done
+		case now := <-ticker.C:
+			if s.CheckPermissionExpired(now) {
+				logger.Infof("Conn[%s] exec command end as permission has expired", s.UserConn.ID())
+				_ = sess.Close()
+				<-done
+				return ExecExitCodeFailed, ErrPermission
+			}
+		}
+	}
+}
+
+func (s *Server) recordExecCommand(command, output string, riskLevel int64, createdDate time.Time) {
+	if len(command) > 128 {
+		command = command[:128]
+	}
+	cmdRecorder := s.GetCommandRecorder()
+	cmdRecorder.RecordCommand(s.GenerateCommandItem(s.connOpts.user.String(), command,
+		output, riskLevel, createdDate))
+	cmdRecorder.End()
+}
+
+// recordHostKeyChanged 资产或网关的主机密钥不一致时记录一条高危命令, 管理员可以在会话的命令记录中看到
+func (s *Server) recordHostKeyChanged(err error) {
+	var keyErr *hostkey.KeyChangedError
+	if !errors.As(err, &keyErr) {
+		return
+	}
+	s.recordExecCommand("ssh host key check", keyErr.Error(), model.DangerLevel, time.Now())
+}
+
+// limitedBuffer 只保存前 limit 个字节, 用于命令记录的输出
+type limitedBuffer struct {
+	mu    sync.Mutex
+	limit int
+	buf   []byte
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if remain := b.limit - len(b.buf); remain > 0 {
+		if len(p) > remain {
+			b.buf = append(b.buf, p[:remain]...)
+		} else {
+			b.buf = append(b.buf, p...)
+		}
+	}
+	return len(p), nil
+}
+
+func (b *limitedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return string(b.buf)
+}
@@ -0,0 +1,77 @@
+package proxy
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/meowgen/koko/pkg/jms-sdk-go/model"
+)
+
+func TestLimitedBuffer(t *testing.T) {
+	buf := &limitedBuffer{limit: 8}
+	for _, s := range []string{"hello", " world", "!"} {
+		if n, err := buf.Write([]byte(s)); err != nil || n != len(s) {
+			t.Fatalf("write %q = %d, %v", s, n, err)
+		}
+	}
+	if got := buf.String(); got != "hello wo" {
+		t.Fatalf("buffer = %q", got)
+	}
+}
+
+type testCommandStorage struct {
+	mu    sync.Mutex
+	saved []*model.Command
+}
+
+func (s *testCommandStorage) BulkSave(commands []*model.Command) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.saved = append(s.saved, commands...)
+	return nil
+}
+
+func (s *testCommandStorage) TypeName() string {
+	return "test"
+}
+
+func TestCommandRecorderEnd(t *testing.T) {
+	storage := &testCommandStorage{}
+	recorder := CommandRecorder{
+		SessionID: "exec",
+		Storage:   storage,
+		Queue:     make(chan *model.Command, 10),
+		Closed:    make(chan struct{}),
+	}
+	done := make(chan struct{})
+	go func() {
+		recorder.Record()
+		close(done)
+	}()
+	// exec 请求记录命令后立即结束, 队列中的命令需要保存
+	recorder.RecordCommand(&model.Command{Input: "ls"})
+	recorder.End()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("recorder not closed")
+	}
+	if len(storage.saved) != 1 {
+		t.Fatalf("saved %d commands", len(storage.saved))
+	}
+}
+
+func TestCheckNonInteractiveRequestCertOnly(t *testing.T) {
+	setupCertConfig(t)
+	s := newCertTestServer(22)
+	// 开启 SSH CA 时没有密码和私钥的系统用户可以执行 exec 和端口转发
+	if err := s.checkNonInteractiveRequest(ErrExecUnsupported); err != nil {
+		t.Fatalf("cert-only system user: %s", err)
+	}
+	s.systemUserAuthInfo.Username = ""
+	if err := s.checkNonInteractiveRequest(ErrExecUnsupported); !errors.Is(err, ErrNoAuthInfo) {
+		t.Fatalf("empty username err = %v", err)
+	}
+}
@@ -0,0 +1,353 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/meowgen/koko/pkg/config"
+	"github.com/meowgen/koko/pkg/jms-sdk-go/model"
+	"github.com/meowgen/koko/pkg/logger"
+	"github.com/meowgen/koko/pkg/srvconn"
+)
+
+var (
+	ErrForwardUnsupported = errors.New("port forwarding unsupported")
+	ErrForwardPortDenied  = errors.New("port forwarding to the port is not allowed")
+)
+
+// forwardPorts 缓存解析后的 PORT_FORWARD_ALLOWED_PORTS, 配置变化时重新解析
+var forwardPorts struct {
+	sync.Mutex
+	setting string
+	loaded  bool
+	ranges  [][2]uint32
+}
+
+// LoadForwardAllowedPorts 解析 PORT_FORWARD_ALLOWED_PORTS, 配置错误时只记录一次日志, 并拒绝所有端口
+func LoadForwardAllowedPorts() [][2]uint32 {
+	setting := config.GetConf().PortForwardAllowedPorts
+	forwardPorts.Lock()
+	defer forwardPorts.Unlock()
+	if forwardPorts.loaded && forwardPorts.setting == setting {
+		return forwardPorts.ranges
+	}
+	ranges, err := parsePortRanges(setting)
+	if err != nil {
+		logger.Errorf("Config PORT_FORWARD_ALLOWED_PORTS is invalid, deny all ports: %s", err)
+		ranges = nil
+	}
+	forwardPorts.setting, forwardPorts.loaded, forwardPorts.ranges = setting, true, ranges
+	return ranges
+}
+
+// IsForwardPortAllowed 检查端口是否在 PORT_FORWARD_ALLOWED_PORTS 中, 未配置或者配置错误时拒绝所有端口
+func IsForwardPortAllowed(port uint32) bool {
+	for _, item := range LoadForwardAllowedPorts() {
+		if port >= item[0] && port <= item[1] {
+			return true
+		}
+	}
+	return false
+}
+
+// parsePortRanges 解析端口列表, 如 80,443,8000-9000
+func parsePortRanges(s string) ([][2]uint32, error) {
+	ranges := make([][2]uint32, 0, 4)
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		start, end := item, item
+		if index := strings.Index(item, "-"); index > 0 {
+			start, end = item[:index], item[index+1:]
+		}
+		startPort, err := strconv.ParseUint(strings.TrimSpace(start), 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid port %q", item)
+		}
+		endPort, err := strconv.ParseUint(strings.TrimSpace(end), 10, 16)
+		if err != nil || startPort > endPort {
+			return nil, fmt.Errorf("invalid port %q", item)
+		}
+		ranges = append(ranges, [2]uint32{uint32(startPort), uint32(endPort)})
+	}
+	return ranges, nil
+}
+
+// forwardStats 记录转发的字节数
+type forwardStats struct {
+	sent     int64 // 用户发往资产
+	received int64 // 资产发往用户
+}
+
+func (f *forwardStats) String() string {
+	return fmt.Sprintf("sent %d bytes, received %d bytes",
+		atomic.LoadInt64(&f.sent), atomic.LoadInt64(&f.received))
+}
+
+type forwardServeFunc func(ctx context.Context, stats *forwardStats)
+
+// ForwardChannel 是本地转发中用户的一个通道
+type ForwardChannel interface {
+	// Accept 在资产上的连接建立后接受通道
+	Accept() (io.ReadWriteCloser, error)
+	// Reject 拒绝通道, err 是连接资产失败的原因
+	Reject(err error)
+}
+
+// LocalForward 经资产的 SSH 连接把 channels 中的通道转发到资产上的 destAddr.
+// 所有通道共用一个资产连接和会话, 直到 channels 关闭或者会话结束, 结束时记录转发的字节数和时长.
+func (s *Server) LocalForward(destAddr string, channels <-chan ForwardChannel) error {
+	desc := fmt.Sprintf("local forward %s", destAddr)
+	return s.runForward(desc, func(sshClient *srvconn.SSHClient) (forwardServeFunc, error) {
+		return func(ctx context.Context, stats *forwardStats) {
+			s.serveLocalForward(ctx, sshClient, destAddr, channels, stats)
+		}, nil
+	})
+}
+
+func (s *Server) serveLocalForward(ctx context.Context, sshClient *srvconn.SSHClient, destAddr string,
+	channels <-chan ForwardChannel, stats *forwardStats) {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for {
+		var (
+			ch ForwardChannel
+			ok bool
+		)
+		select {
+		case <-ctx.Done():
+			return
+		case ch, ok = <-channels:
+			if !ok {
+				return
+			}
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assetConn, err := sshClient.Dial("tcp", destAddr)
+			if err != nil {
+				logger.Errorf("Conn[%s] local forward dial %s err: %s", s.UserConn.ID(), destAddr, err)
+				ch.Reject(err)
+				return
+			}
+			userConn, err := ch.Accept()
+			if err != nil {
+				_ = assetConn.Close()
+				return
+			}
+			s.pipeForward(ctx, userConn, assetConn, stats)
+		}()
+	}
+}
+
+// RemoteForward 经资产的 SSH 连接在资产上监听 bindAddr, 监听的结果经 onListen 返回.
+// 资产上接受的连接经 openChannel 转发给用户, 直到用户取消转发或者会话结束.
+// 监听期间作为一个会话记录, 结束时记录转发的字节数和时长.
+func (s *Server) RemoteForward(bindAddr string, onListen func(port uint32, err error),
+	openChannel func(originAddr string, originPort uint32) (io.ReadWriteCloser, error)) {
+	var listened bool
+	desc := fmt.Sprintf("remote forward %s", bindAddr)
+	err := s.runForward(desc, func(sshClient *srvconn.SSHClient) (forwardServeFunc, error) {
+		ln, err := sshClient.Listen("tcp", bindAddr)
+		if err != nil {
+			return nil, err
+		}
+		var port uint32
+		if addr, ok := ln.Addr().(*net.TCPAddr); ok {
+			port = uint32(addr.Port)
+		}
+		listened = true
+		onListen(port, nil)
+		return func(ctx context.Context, stats *forwardStats) {
+			s.serveRemoteForward(ctx, ln, openChannel, stats)
+		}, nil
+	})
+	if !listened {
+		onListen(0, err)
+	}
+}
+
+func (s *Server) serveRemoteForward(ctx context.Context, ln net.Listener,
+	openChannel func(originAddr string, originPort uint32) (io.ReadWriteCloser, error), stats *forwardStats) {
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-done:
+		}
+		_ = ln.Close()
+	}()
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for {
+		assetConn, err := ln.Accept()
+		if err != nil {
+			logger.Debugf("Conn[%s] remote forward accept end: %s", s.UserConn.ID(), err)
+			_ = ln.Close()
+			return
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var (
+				originAddr string
+				originPort uint32
+			)
+			if addr, ok := assetConn.RemoteAddr().(*net.TCPAddr); ok {
+				originAddr, originPort = addr.IP.String(), uint32(addr.Port)
+			}
+			userConn, err := openChannel(originAddr, originPort)
+			if err != nil {
+				logger.Errorf("Conn[%s] remote forward open channel err: %s", s.UserConn.ID(), err)
+				_ = assetConn.Close()
+				return
+			}
+			s.pipeForward(ctx, userConn, assetConn, stats)
+		}()
+	}
+}
+
+// pipeForward 双向转发数据, 一端结束时关闭另一端的写入, 会话结束时关闭两端
+func (s *Server) pipeForward(ctx context.Context, userConn, assetConn io.ReadWriteCloser, stats *forwardStats) {
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		n, _ := io.Copy(assetConn, userConn)
+		atomic.AddInt64(&stats.sent, n)
+		closeWrite(assetConn)
+	}()
+	go func() {
+		defer wg.Done()
+		n, _ := io.Copy(userConn, assetConn)
+		atomic.AddInt64(&stats.received, n)
+		closeWrite(userConn)
+	}()
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+	}
+	_ = userConn.Close()
+	_ = assetConn.Close()
+	<-done
+}
+
+type closeWriter interface {
+	CloseWrite() error
+}
+
+func closeWrite(conn io.ReadWriteCloser) {
+	if c, ok := conn.(closeWriter); ok {
+		_ = c.CloseWrite()
+		return
+	}
+	_ = conn.Close()
+}
+
+// runForward 创建转发的会话和资产的 SSH 连接, connect 成功后开始转发, 直到转发结束, 会话被终断或者权限过期
+func (s *Server) runForward(desc string, connect func(*srvconn.SSHClient) (forwardServeFunc, error)) error {
+	if err := s.checkNonInteractiveRequest(ErrForwardUnsupported); err != nil {
+		logger.Errorf("Conn[%s] %s failed: %s", s.UserConn.ID(), desc, err)
+		return err
+	}
+	confirmSrv := s.newLoginConfirmService()
+	if need, err := confirmSrv.CheckIsNeedLoginConfirm(); err != nil || need {
+		if err == nil {
+			err = fmt.Errorf("%w: login confirm required", ErrForwardUnsupported)
+		}
+		logger.Errorf("Conn[%s] %s login confirm: %s", s.UserConn.ID(), desc, err)
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(s.UserConn.Context())
+	defer cancel()
+	sw := SwitchSession{
+		ID:     s.ID,
+		Ctx:    ctx,
+		Cancel: cancel,
+		P:      s,
+	}
+	if err := s.CreateSessionCallback(); err != nil {
+		logger.Errorf("Conn[%s] submit session %s to core server err: %s", s.UserConn.ID(), s.ID, err)
+		return fmt.Errorf("%w: %s", ErrAPIFailed, err)
+	}
+	AddCommonSwitch(&sw)
+	defer RemoveCommonSwitch(&sw)
+	defer func() {
+		if err := s.DisConnectedCallback(); err != nil {
+			logger.Errorf("Conn[%s] update session %s err: %+v", s.UserConn.ID(), s.ID, err)
+		}
+	}()
+
+	startTime := time.Now()
+	sshClient, err := srvconn.NewSSHClient(s.getSSHClientOptions(s.systemUserAuthInfo)...)
+	if err != nil {
+		logger.Errorf("Conn[%s] %s get ssh client err: %s", s.UserConn.ID(), desc, err)
+		s.recordHostKeyChanged(err)
+		if err2 := s.ConnectedFailedCallback(err); err2 != nil {
+			logger.Errorf("Conn[%s] update session err: %s", s.UserConn.ID(), err2)
+		}
+		return err
+	}
+	defer sshClient.Close()
+	serve, err := connect(sshClient)
+	if err != nil {
+		logger.Errorf("Conn[%s] %s on %s err: %s", s.UserConn.ID(), desc, sshClient, err)
+		if err2 := s.ConnectedFailedCallback(err); err2 != nil {
+			logger.Errorf("Conn[%s] update session err: %s", s.UserConn.ID(), err2)
+		}
+		s.recordExecCommand(desc, err.Error(), model.NormalLevel, startTime)
+		return err
+	}
+	if err2 := s.ConnectedSuccessCallback(); err2 != nil {
+		logger.Errorf("Conn[%s] update session %s err: %s", s.UserConn.ID(), s.ID, err2)
+	}
+	logger.Infof("Conn[%s] %s on %s start", s.UserConn.ID(), desc, sshClient)
+	stats := &forwardStats{}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		serve(ctx, stats)
+	}()
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+loop:
+	for {
+		select {
+		case <-done:
+			break loop
+		case <-ctx.Done():
+			logger.Infof("Conn[%s] %s end as session done", s.UserConn.ID(), desc)
+			<-done
+			break loop
+		case now := <-ticker.C:
+			if s.CheckPermissionExpired(now) {
+				logger.Infof("Conn[%s] %s end as permission has expired", s.UserConn.ID(), desc)
+				cancel()
+				<-done
+				break loop
+			}
+		}
+	}
+	output := fmt.Sprintf("%s, duration %s", stats, time.Since(startTime).Round(time.Second))
+	s.recordExecCommand(desc, output, model.NormalLevel, startTime)
+	logger.Infof("Conn[%s] %s on %s end: %s", s.UserConn.ID(), desc, sshClient, output)
+	return nil
+}
@@ -0,0 +1,220 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	gossh "golang.org/x/crypto/ssh"
+
+	"github.com/meowgen/koko/pkg/config"
+	"github.com/meowgen/koko/pkg/srvconn"
+)
+
+func TestParsePortRanges(t *testing.T) {
+	got, err := parsePortRanges(" 22, 8000-9000,,443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][2]uint32{{22, 22}, {8000, 9000}, {443, 443}}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("ranges = %v, want %v", got, want)
+	}
+	for _, s := range []string{"abc", "9000-8000", "70000", "-1"} {
+		if _, err := parsePortRanges(s); err == nil {
+			t.Fatalf("parsePortRanges(%q) should fail", s)
+		}
+	}
+}
+
+func TestIsForwardPortAllowed(t *testing.T) {
+	conf := config.GlobalConfig
+	defer func() { config.GlobalConfig = conf }()
+	tests := []struct {
+		setting string
+		port    uint32
+		allowed bool
+	}{
+		{"", 22, false},
+		{"invalid", 22, false},
+		{"22,8000-9000", 22, true},
+		{"22,8000-9000", 8080, true},
+		{"22,8000-9000", 3306, false},
+		{"1-65535", 3306, true},
+	}
+	for _, tt := range tests {
+		config.GlobalConfig = &config.Config{PortForwardAllowedPorts: tt.setting}
+		if got := IsForwardPortAllowed(tt.port); got != tt.allowed {
+			t.Errorf("IsForwardPortAllowed(%d) with %q = %v, want %v", tt.port, tt.setting, got, tt.allowed)
+		}
+	}
+}
+
+func TestPipeForward(t *testing.T) {
+	userConn, userPeer := net.Pipe()
+	assetConn, assetPeer := net.Pipe()
+	stats := &forwardStats{}
+	done := make(chan struct{})
+	go func() {
+		(&Server{}).pipeForward(context.Background(), userConn, assetConn, stats)
+		close(done)
+	}()
+	buf := make([]byte, 5)
+	_, _ = userPeer.Write([]byte("hello"))
+	if _, err := io.ReadFull(assetPeer, buf); err != nil || string(buf) != "hello" {
+		t.Fatalf("asset read %q, %v", buf, err)
+	}
+	_, _ = assetPeer.Write([]byte("hi"))
+	if _, err := io.ReadFull(userPeer, buf[:2]); err != nil || string(buf[:2]) != "hi" {
+		t.Fatalf("user read %q, %v", buf[:2], err)
+	}
+	_ = userPeer.Close()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("forward not closed")
+	}
+	if stats.sent != 5 || stats.received != 2 {
+		t.Fatalf("stats = %s", stats)
+	}
+}
+
+// pipeChannel 是测试的转发通道, 用户一端为 peer
+type pipeChannel struct {
+	conn     net.Conn
+	peer     net.Conn
+	rejected chan error
+}
+
+func newPipeChannel() *pipeChannel {
+	conn, peer := net.Pipe()
+	return &pipeChannel{conn: conn, peer: peer, rejected: make(chan error, 1)}
+}
+
+func (c *pipeChannel) Accept() (io.ReadWriteCloser, error) { return c.conn, nil }
+func (c *pipeChannel) Reject(err error)                    { c.rejected <- err }
+
+// handleDirectTCPIP 连接 direct-tcpip 通道请求的地址并转发数据
+func handleDirectTCPIP(newChan gossh.NewChannel) {
+	var payload struct {
+		Host       string
+		Port       uint32
+		OriginHost string
+		OriginPort uint32
+	}
+	if err := gossh.Unmarshal(newChan.ExtraData(), &payload); err != nil {
+		_ = newChan.Reject(gossh.ConnectionFailed, err.Error())
+		return
+	}
+	conn, err := net.Dial("tcp", net.JoinHostPort(payload.Host, strconv.Itoa(int(payload.Port))))
+	if err != nil {
+		_ = newChan.Reject(gossh.ConnectionFailed, err.Error())
+		return
+	}
+	ch, reqs, err := newChan.Accept()
+	if err != nil {
+		_ = conn.Close()
+		return
+	}
+	go gossh.DiscardRequests(reqs)
+	(&Server{}).pipeForward(context.Background(), ch, conn, &forwardStats{})
+}
+
+// startEchoServer 启动回显服务, 返回监听的地址
+func startEchoServer(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_, _ = io.Copy(conn, conn)
+				_ = conn.Close()
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestServeLocalForward(t *testing.T) {
+	authority := setupCertConfig(t)
+	port := startCertSSHServer(t, authority.PublicKey(), handleDirectTCPIP)
+	s := newCertTestServer(port)
+	sshClient, err := srvconn.NewSSHClient(s.getSSHClientOptions(s.systemUserAuthInfo)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sshClient.Close()
+
+	channels := make(chan ForwardChannel, 2)
+	stats := &forwardStats{}
+	done := make(chan struct{})
+	go func() {
+		s.serveLocalForward(context.Background(), sshClient, startEchoServer(t), channels, stats)
+		close(done)
+	}()
+	// 两个通道共用同一个资产连接
+	for _, msg := range []string{"hello", "world"} {
+		ch := newPipeChannel()
+		channels <- ch
+		if _, err = ch.peer.Write([]byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, len(msg))
+		if _, err = io.ReadFull(ch.peer, buf); err != nil || string(buf) != msg {
+			t.Fatalf("echo %q, %v", buf, err)
+		}
+		_ = ch.peer.Close()
+	}
+	close(channels)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("local forward not closed")
+	}
+	if stats.sent != 10 || stats.received != 10 {
+		t.Fatalf("stats = %s", stats)
+	}
+}
+
+func TestServeLocalForwardDialFailed(t *testing.T) {
+	authority := setupCertConfig(t)
+	port := startCertSSHServer(t, authority.PublicKey(), handleDirectTCPIP)
+	s := newCertTestServer(port)
+	sshClient, err := srvconn.NewSSHClient(s.getSSHClientOptions(s.systemUserAuthInfo)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sshClient.Close()
+
+	// 关闭的端口, 资产上连接失败
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	destAddr := ln.Addr().String()
+	_ = ln.Close()
+	channels := make(chan ForwardChannel, 1)
+	ch := newPipeChannel()
+	channels <- ch
+	close(channels)
+	s.serveLocalForward(context.Background(), sshClient, destAddr, channels, &forwardStats{})
+	select {
+	case err = <-ch.rejected:
+		if err == nil {
+			t.Fatal("reject without reason")
+		}
+	default:
+		t.Fatal("channel should be rejected")
+	}
+}
@@ -15,6 +15,8 @@ import (
 	"github.com/meowgen/koko/pkg/jms-sdk-go/model"
 	"github.com/meowgen/koko/pkg/jms-sdk-go/service"
 	"github.com/meowgen/koko/pkg/logger"
+	"github.com/meowgen/koko/pkg/sqlparser"
+	"github.com/meowgen/koko/pkg/srvconn"
 	"github.com/meowgen/koko/pkg/utils"
 	"github.com/meowgen/koko/pkg/zmodem"
 )
@@ -68,6 +70,17 @@ type Parser struct {
 	cmdFilterRules []model.FilterRule
 	closed         chan struct{}
 
+	// sqlMatcher 不为空时按 SQL 语句匹配过滤规则, sqlInput 是客户端中还没有结束的语句
+	sqlMatcher *sqlparser.Matcher
+	sqlInput   string
+	// sqlDelimiter 是 mysql 客户端 delimiter 命令设置的语句结束符, 为空时使用 ;
+	sqlDelimiter string
+	// sqlStatements 是当前命令中结束的语句, 用于命令记录
+	sqlStatements []*sqlparser.Statement
+
+	// statementChan 不为空时按连接执行的语句记录命令, 不再按输入行记录
+	statementChan <-chan *srvconn.ExecutedStatement
+
 	confirmStatus commandConfirmStatus
 
 	zmodemParser        *zmodem.ZmodemParser
@@ -139,6 +152,20 @@ func (p *Parser) ParseStream(userInChan chan *exchange.RoomMessage, srvInChan <-
 				case p.srvOutputChan <- b:
 				}
 
+			case stmt, ok := <-p.statementChan:
+				if !ok {
+					p.statementChan = nil
+					continue
+				}
+				p.cmdRecordChan <- &ExecutedCommand{
+					Command:     stmt.Input,
+					Output:      stmt.Output,
+					CreatedDate: stmt.CreatedDate,
+					RiskLevel:   model.LessRiskFlag,
+					User:        p.currentActiveUser,
+					Statements:  stmt.Statements,
+					Violations:  stmt.Violations,
+				}
 			}
 		}
 	}()
@@ -251,6 +278,11 @@ func (p *Parser) parseInputState(b []byte) []byte {
 		return nil
 	}
 
+	if p.sqlMatcher != nil && bytes.IndexByte(b, CharCTRLC) >= 0 {
+		// 数据库客户端按 Ctrl+C 时会丢弃没有结束的语句
+		p.sqlInput = ""
+	}
+
 	if bytes.LastIndex(b, charEnter) == 0 {
 		// 连续输入enter key, 结算上一条可能存在的命令结果
 		p.sendCommandRecord()
@@ -305,8 +337,10 @@ func (p *Parser) forbiddenCommand(cmd string) {
 		Output:      fbdMsg,
 		CreatedDate: p.cmdCreateDate,
 		RiskLevel:   model.HighRiskFlag,
-		User:        p.currentActiveUser}
+		User:        p.currentActiveUser,
+		Statements:  p.commandStatements()}
 	p.command = ""
+	p.sqlStatements = nil
 	p.output = ""
 	p.userOutputChan <- p.breakInputPacket()
 }
@@ -405,6 +439,9 @@ func (p *Parser) ParseServerOutput(b []byte) []byte {
 
 // IsMatchCommandRule 判断命令是不是在过滤规则中
 func (p *Parser) IsMatchCommandRule(command string) (model.FilterRule, string, bool) {
+	if p.sqlMatcher != nil {
+		return p.matchSQLCommandRule(command)
+	}
 	for _, rule := range p.cmdFilterRules {
 		allowed, cmd := rule.Match(command)
 		switch allowed {
@@ -418,6 +455,86 @@ func (p *Parser) IsMatchCommandRule(command string) (model.FilterRule, string, b
 	return model.FilterRule{}, "", false
 }
 
+// 数据库客户端自己处理的命令, 不需要以分号结束
+var sqlClientCommands = map[string]bool{
+	"use": true, "exit": true, "quit": true, "source": true, "help": true, "status": true,
+	"connect": true, "delimiter": true, "clear": true, "pager": true, "nopager": true, "tee": true,
+	"notee": true, "system": true, "prompt": true, "charset": true, "warnings": true,
+	"nowarning": true, "rehash": true, "ego": true, "go": true, "print": true, "edit": true,
+}
+
+func isSQLClientCommand(line string) bool {
+	if strings.HasPrefix(line, `\`) || strings.HasPrefix(line, ":") {
+		return true
+	}
+	fields := strings.Fields(strings.TrimSuffix(line, ";"))
+	return len(fields) > 0 && sqlClientCommands[strings.ToLower(fields[0])]
+}
+
+// parseSQLDelimiter 解析 mysql 客户端的 delimiter 和 \d 命令, 返回新的语句结束符
+func parseSQLDelimiter(line string) (string, bool) {
+	fields := strings.Fields(line)
+	if len(fields) < 2 {
+		return "", false
+	}
+	if !strings.EqualFold(fields[0], "delimiter") && fields[0] != `\d` {
+		return "", false
+	}
+	return fields[1], true
+}
+
+// commandStatements 返回当前命令中的语句, redis-cli 的命令按空白拆分参数
+func (p *Parser) commandStatements() []*sqlparser.Statement {
+	if p.protocolType == srvconn.ProtocolRedis {
+		if args := strings.Fields(p.command); len(args) > 0 {
+			return []*sqlparser.Statement{sqlparser.RedisStatement(args)}
+		}
+	}
+	return p.sqlStatements
+}
+
+// matchSQLCommandRule 数据库客户端缓存多行输入直到语句结束, 语句结束时按完整的语句匹配规则,
+// 没有结束的输入只匹配正则和命令类型的规则
+func (p *Parser) matchSQLCommandRule(command string) (model.FilterRule, string, bool) {
+	line := strings.TrimSpace(command)
+	if strings.HasSuffix(line, `\c`) {
+		// mysql 客户端的 \c 清除当前的语句
+		p.sqlInput = ""
+		return model.FilterRule{}, "", false
+	}
+	if p.sqlInput == "" && isSQLClientCommand(line) {
+		p.sqlStatements = p.sqlMatcher.Classify(line)
+		rule, cmd, ok := p.sqlMatcher.MatchStatements(p.cmdFilterRules, line, p.sqlStatements)
+		if delimiter, isDelimiter := parseSQLDelimiter(line); isDelimiter && (!ok || rule.Action != model.ActionDeny) {
+			p.sqlDelimiter = delimiter
+		}
+		return rule, cmd, ok
+	}
+	input := p.sqlInput + command + "\n"
+	stmts, rest := sqlparser.SplitStatementsByDelimiter(input, p.sqlMatcher.Dialect(), p.sqlDelimiter)
+	var (
+		rule model.FilterRule
+		cmd  string
+		ok   bool
+	)
+	if len(stmts) == 0 {
+		rule, cmd, ok = p.sqlMatcher.MatchText(p.cmdFilterRules, command)
+		rest = input
+	} else {
+		sql := strings.Join(stmts, ";\n")
+		p.sqlStatements = p.sqlMatcher.Classify(sql)
+		rule, cmd, ok = p.sqlMatcher.MatchStatements(p.cmdFilterRules, sql, p.sqlStatements)
+	}
+	// 被禁止的输入不会发送到客户端, 保留之前没有结束的语句
+	if !ok || rule.Action != model.ActionDeny {
+		p.sqlInput = rest
+		if strings.TrimSpace(rest) == "" {
+			p.sqlInput = ""
+		}
+	}
+	return rule, cmd, ok
+}
+
 func (p *Parser) waitCommandConfirm() {
 	cmd := p.confirmStatus.Cmd
 	resp, err := p.jmsService.SubmitCommandConfirm(p.id, p.confirmStatus.Rule.ID, p.confirmStatus.Cmd)
@@ -523,7 +640,17 @@ func (p *Parser) Close() {
 	logger.Infof("Session %s: Parser close", p.id)
 }
 
+// RecordStatements 使用连接执行的语句记录命令, 多行的语句记录为一条命令
+func (p *Parser) RecordStatements(conn srvconn.StatementConnection) {
+	p.statementChan = conn.ExecutedStatements()
+}
+
 func (p *Parser) sendCommandRecord() {
+	if p.statementChan != nil {
+		p.command = ""
+		p.output = ""
+		return
+	}
 	if p.command != "" {
 		p.parseCmdOutput()
 		p.cmdRecordChan <- &ExecutedCommand{
@@ -532,8 +659,10 @@ func (p *Parser) sendCommandRecord() {
 			CreatedDate: p.cmdCreateDate,
 			RiskLevel:   model.LessRiskFlag,
 			User:        p.currentActiveUser,
+			Statements:  p.commandStatements(),
 		}
 		p.command = ""
+		p.sqlStatements = nil
 		p.output = ""
 	}
 }
@@ -557,6 +686,11 @@ type ExecutedCommand struct {
 	CreatedDate time.Time
 	RiskLevel   string
 	User        CurrentActiveUser
+
+	// Statements 是数据库会话中命令包含的语句
+	Statements []*sqlparser.Statement
+	// Violations 是命令违反的查询限制
+	Violations []string
 }
 
 type CurrentActiveUser struct {
@@ -0,0 +1,68 @@
+package proxy
+
+import (
+	"testing"
+
+	"github.com/meowgen/koko/pkg/jms-sdk-go/model"
+	"github.com/meowgen/koko/pkg/sqlparser"
+)
+
+func TestParser_MatchSQLCommandRule(t *testing.T) {
+	p := &Parser{
+		cmdFilterRules: model.FilterRules{
+			{ID: "sql", Type: model.TypeSQL, Content: "DELETE WITHOUT WHERE", Action: model.ActionDeny},
+		},
+		sqlMatcher: sqlparser.NewMatcher(sqlparser.DialectMySQL, "app"),
+	}
+	tests := []struct {
+		line  string
+		match bool
+	}{
+		{"delete", false},
+		{"from t", false},
+		{";", true},
+		{"\\c", false},
+		{"delete from t where id = 1;", false},
+		{"use app", false},
+		{"delete from t", false},
+		{"where id = 1;", false},
+	}
+	for _, tt := range tests {
+		if _, _, ok := p.IsMatchCommandRule(tt.line); ok != tt.match {
+			t.Errorf("IsMatchCommandRule(%q) = %v, want %v", tt.line, ok, tt.match)
+		}
+	}
+	if p.sqlInput != "" {
+		t.Errorf("sqlInput = %q, want empty", p.sqlInput)
+	}
+}
+
+func TestParser_MatchSQLCommandRuleDelimiter(t *testing.T) {
+	p := &Parser{
+		cmdFilterRules: model.FilterRules{
+			{ID: "sql", Type: model.TypeSQL, Content: "DELETE WITHOUT WHERE", Action: model.ActionDeny},
+		},
+		sqlMatcher: sqlparser.NewMatcher(sqlparser.DialectMySQL, "app"),
+	}
+	tests := []struct {
+		line  string
+		match bool
+	}{
+		{"delimiter //", false},
+		{"delete from users//", true},
+		{"create procedure p() begin", false},
+		{"delete from t;", false},
+		{"end//", false},
+		{"delete from t where id = 1//", false},
+		{"delimiter ;", false},
+		{"delete from users;", true},
+	}
+	for _, tt := range tests {
+		if _, _, ok := p.IsMatchCommandRule(tt.line); ok != tt.match {
+			t.Errorf("IsMatchCommandRule(%q) = %v, want %v", tt.line, ok, tt.match)
+		}
+	}
+	if p.sqlDelimiter != ";" || p.sqlInput != "" {
+		t.Errorf("sqlDelimiter = %q, sqlInput = %q", p.sqlDelimiter, p.sqlInput)
+	}
+}
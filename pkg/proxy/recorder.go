@@ -51,6 +51,14 @@ func (c *CommandRecorder) Record() {
 	for {
 		select {
 		case <-c.Closed:
+			// 保存结束前已经加入队列的命令
+			for len(c.Queue) > 0 {
+				p := <-c.Queue
+				if p.RiskLevel == model.DangerLevel {
+					notificationList = append(notificationList, p)
+				}
+				cmdList = append(cmdList, p)
+			}
 			if len(cmdList) == 0 {
 				return
 			}
@@ -18,11 +18,14 @@ import (
 	"github.com/meowgen/koko/pkg/auth"
 	"github.com/meowgen/koko/pkg/common"
 	"github.com/meowgen/koko/pkg/config"
+	"github.com/meowgen/koko/pkg/guardrail"
 	modelCommon "github.com/meowgen/koko/pkg/jms-sdk-go/common"
 	"github.com/meowgen/koko/pkg/jms-sdk-go/model"
 	"github.com/meowgen/koko/pkg/jms-sdk-go/service"
 	"github.com/meowgen/koko/pkg/logger"
+	"github.com/meowgen/koko/pkg/sqlparser"
 	"github.com/meowgen/koko/pkg/srvconn"
+	"github.com/meowgen/koko/pkg/sshcert"
 	"github.com/meowgen/koko/pkg/utils"
 	"github.com/meowgen/koko/pkg/zmodem"
 )
@@ -424,6 +427,9 @@ func (s *Server) GetFilterParser() *Parser {
 		i18nLang:       s.connOpts.i18nLang,
 		platform:       s.platform,
 	}
+	if dialect, ok := sqlparser.DialectFromProtocol(s.connOpts.ProtocolType); ok && s.connOpts.app != nil {
+		parser.sqlMatcher = sqlparser.NewMatcher(dialect, s.connOpts.app.Attrs.Database)
+	}
 	parser.initial()
 	return &parser
 }
@@ -575,7 +581,8 @@ func (s *Server) checkRequiredAuth() error {
 				s.UserConn.ID(), s.connOpts.systemUser.Name, s.connOpts.asset.Hostname)
 		}
 
-		if s.systemUserAuthInfo.PrivateKey == "" {
+		// 使用签发的证书登录时不需要输入密码, 证书认证失败时在登录时再输入
+		if s.systemUserAuthInfo.PrivateKey == "" && !s.useSSHCertificate() {
 			if err := s.getAuthPasswordIfNeed(); err != nil {
 				msg := utils.WrapperWarn(lang.T("Get auth password failed"))
 				utils.IgnoreErrWriteString(s.UserConn, msg)
@@ -588,6 +595,15 @@ func (s *Server) checkRequiredAuth() error {
 	return nil
 }
 
+// useSSHCertificate 表示系统用户没有私钥, 登录资产时先使用 SSH CA 签发的证书.
+// 手动登录的系统用户由用户输入的凭据登录, 不使用证书
+func (s *Server) useSSHCertificate() bool {
+	if s.systemUserAuthInfo.PrivateKey != "" || sshcert.Default() == nil {
+		return false
+	}
+	return s.connOpts.systemUser == nil || s.connOpts.systemUser.LoginMode != model.LoginModeManual
+}
+
 const (
 	linuxPlatform = "Linux"
 )
@@ -757,6 +773,30 @@ func (s *Server) getSQLiteConn(localTunnelAddr *net.TCPAddr) (srvConn *srvconn.S
 	return
 }
 
+func (s *Server) getSQLShellConn(localTunnelAddr *net.TCPAddr) (srvConn *srvconn.SQLShellConn, err error) {
+	host := s.connOpts.app.Attrs.Host
+	port := s.connOpts.app.Attrs.Port
+	if localTunnelAddr != nil {
+		host = "127.0.0.1"
+		port = localTunnelAddr.Port
+	}
+	srvConn, err = srvconn.NewSQLShellConnection(s.connOpts.ProtocolType,
+		srvconn.SqlHost(host),
+		srvconn.SqlPort(port),
+		srvconn.SqlUsername(s.systemUserAuthInfo.Username),
+		srvconn.SqlPassword(s.systemUserAuthInfo.Password),
+		srvconn.SqlDBName(s.connOpts.app.Attrs.Database),
+		srvconn.SqlPathToDb(s.connOpts.app.Attrs.PathToDb),
+		srvconn.SqlCreateDbIfNotExist(s.connOpts.app.Attrs.CreateDbIfNotExist),
+		srvconn.SqlGuardrail(guardrail.ForApplication(s.connOpts.app.Name)),
+		srvconn.SqlPtyWin(srvconn.Windows{
+			Width:  s.UserConn.Pty().Window.Width,
+			Height: s.UserConn.Pty().Window.Height,
+		}),
+	)
+	return
+}
+
 func (s *Server) getRedisConn(localTunnelAddr *net.TCPAddr) (srvConn *srvconn.RedisConn, err error) {
 	host := s.connOpts.app.Attrs.Host
 	port := s.connOpts.app.Attrs.Port
@@ -782,6 +822,31 @@ func (s *Server) getRedisConn(localTunnelAddr *net.TCPAddr) (srvConn *srvconn.Re
 	return
 }
 
+func (s *Server) getRedisConsoleConn(localTunnelAddr *net.TCPAddr) (srvConn *srvconn.RedisConsoleConn, err error) {
+	host := s.connOpts.app.Attrs.Host
+	port := s.connOpts.app.Attrs.Port
+	if localTunnelAddr != nil {
+		host = "127.0.0.1"
+		port = localTunnelAddr.Port
+	}
+	srvConn, err = srvconn.NewRedisConsoleConnection(
+		srvconn.SqlHost(host),
+		srvconn.SqlPort(port),
+		srvconn.SqlUsername(s.systemUserAuthInfo.Username),
+		srvconn.SqlPassword(s.systemUserAuthInfo.Password),
+		srvconn.SqlDBName(s.connOpts.app.Attrs.Database),
+		srvconn.SqlUseSSL(s.connOpts.app.Attrs.UseSSL),
+		srvconn.SqlCaCert(s.connOpts.app.Attrs.CaCert),
+		srvconn.SqlClientCert(s.connOpts.app.Attrs.ClientCert),
+		srvconn.SqlCertKey(s.connOpts.app.Attrs.CertKey),
+		srvconn.SqlPtyWin(srvconn.Windows{
+			Width:  s.UserConn.Pty().Window.Width,
+			Height: s.UserConn.Pty().Window.Height,
+		}),
+	)
+	return
+}
+
 func (s *Server) getMongoDBConn(localTunnelAddr *net.TCPAddr) (srvConn *srvconn.MongoDBConn, err error) {
 	host := s.connOpts.app.Attrs.Host
 	port := s.connOpts.app.Attrs.Port
@@ -808,6 +873,31 @@ func (s *Server) getMongoDBConn(localTunnelAddr *net.TCPAddr) (srvConn *srvconn.
 	return
 }
 
+func (s *Server) getMongoDBConsoleConn(localTunnelAddr *net.TCPAddr) (srvConn *srvconn.MongoDBConsoleConn, err error) {
+	host := s.connOpts.app.Attrs.Host
+	port := s.connOpts.app.Attrs.Port
+	if localTunnelAddr != nil {
+		host = "127.0.0.1"
+		port = localTunnelAddr.Port
+	}
+	srvConn, err = srvconn.NewMongoDBConsoleConnection(
+		srvconn.SqlHost(host),
+		srvconn.SqlPort(port),
+		srvconn.SqlUsername(s.systemUserAuthInfo.Username),
+		srvconn.SqlPassword(s.systemUserAuthInfo.Password),
+		srvconn.SqlDBName(s.connOpts.app.Attrs.Database),
+		srvconn.SqlUseSSL(s.connOpts.app.Attrs.UseSSL),
+		srvconn.SqlCaCert(s.connOpts.app.Attrs.CaCert),
+		srvconn.SqlCertKey(s.connOpts.app.Attrs.CertKey),
+		srvconn.SqlAllowInvalidCert(s.connOpts.app.Attrs.AllowInvalidCert),
+		srvconn.SqlPtyWin(srvconn.Windows{
+			Width:  s.UserConn.Pty().Window.Width,
+			Height: s.UserConn.Pty().Window.Height,
+		}),
+	)
+	return
+}
+
 func (s *Server) getSQLServerConn(localTunnelAddr *net.TCPAddr) (srvConn *srvconn.SQLServerConn, err error) {
 	host := s.connOpts.app.Attrs.Host
 	port := s.connOpts.app.Attrs.Port
@@ -879,60 +969,15 @@ func (s *Server) getSSHConn() (srvConn *srvconn.SSHConnection, err error) {
 
 	key := srvconn.MakeReuseSSHClientKey(s.connOpts.user.ID, s.connOpts.asset.ID, loginSystemUser.ID,
 		s.connOpts.asset.IP, loginSystemUser.Username)
-	timeout := config.GlobalConfig.SSHTimeout
-	sshAuthOpts := make([]srvconn.SSHClientOption, 0, 6)
-	sshAuthOpts = append(sshAuthOpts, srvconn.SSHClientUsername(loginSystemUser.Username))
-	sshAuthOpts = append(sshAuthOpts, srvconn.SSHClientHost(s.connOpts.asset.IP))
-	sshAuthOpts = append(sshAuthOpts, srvconn.SSHClientPort(s.connOpts.asset.ProtocolPort(loginSystemUser.Protocol)))
-	sshAuthOpts = append(sshAuthOpts, srvconn.SSHClientPassword(loginSystemUser.Password))
-	sshAuthOpts = append(sshAuthOpts, srvconn.SSHClientTimeout(timeout))
-
-	if loginSystemUser.PrivateKey != "" {
-		// 先使用 password 解析 PrivateKey
-		if signer, err1 := gossh.ParsePrivateKeyWithPassphrase([]byte(loginSystemUser.PrivateKey),
-			[]byte(loginSystemUser.Password)); err1 == nil {
-			sshAuthOpts = append(sshAuthOpts, srvconn.SSHClientPrivateAuth(signer))
-		} else {
-			// 如果之前使用password解析失败，则去掉 password, 尝试直接解析 PrivateKey 防止错误的passphrase
-			if signer, err1 = gossh.ParsePrivateKey([]byte(loginSystemUser.PrivateKey)); err1 == nil {
-				sshAuthOpts = append(sshAuthOpts, srvconn.SSHClientPrivateAuth(signer))
-			}
-		}
-	}
-	password := loginSystemUser.Password
-	privateKey := loginSystemUser.PrivateKey
-	kb := srvconn.SSHClientKeyboardAuth(func(user, instruction string,
-		questions []string, echos []bool) (answers []string, err error) {
-		s.setKeyBoardMode()
-		termReader := utils.NewTerminal(s.UserConn, "")
-		utils.IgnoreErrWriteString(s.UserConn, "\r\n")
-		ans := make([]string, len(questions))
-		for i := range questions {
-			q := questions[i]
-			termReader.SetPrompt(questions[i])
-			logger.Debugf("Conn[%s] keyboard auth question [ %s ]", s.UserConn.ID(), q)
-			if strings.Contains(strings.ToLower(q), "password") {
-				if privateKey != "" || password != "" {
-					ans[i] = password
-					continue
-				}
-			}
-			line, err2 := termReader.ReadLine()
-			if err2 != nil {
-				logger.Errorf("Conn[%s] keyboard auth read err: %s", s.UserConn.ID(), err2)
-			}
-			ans[i] = line
+	sshClient, err := s.newSSHClient(loginSystemUser)
+	if err != nil && s.needPasswordAfterCertAuth(loginSystemUser, err) {
+		// 资产不信任 SSH CA 时, 输入密码后重新登录
+		logger.Infof("Conn[%s] ssh certificate auth failed, fallback to password", s.UserConn.ID())
+		if err2 := s.getAuthPasswordIfNeed(); err2 != nil {
+			return nil, err2
 		}
-		s.resetKeyboardMode()
-		return ans, nil
-	})
-	sshAuthOpts = append(sshAuthOpts, kb)
-	// 获取网关配置
-	proxyArgs := s.getGatewayProxyOptions()
-	if proxyArgs != nil {
-		sshAuthOpts = append(sshAuthOpts, srvconn.SSHClientProxyClient(proxyArgs...))
+		sshClient, err = s.newSSHClient(loginSystemUser)
 	}
-	sshClient, err := srvconn.NewSSHClient(sshAuthOpts...)
 	if err != nil {
 		logger.Errorf("Get new ssh client err: %s", err)
 		return nil, err
@@ -990,6 +1035,86 @@ func (s *Server) getSSHConn() (srvConn *srvconn.SSHConnection, err error) {
 
 }
 
+// newSSHClient 使用系统用户登录资产, 需要输入时由用户完成 keyboard interactive 认证
+func (s *Server) newSSHClient(loginSystemUser *model.SystemUserAuthInfo) (*srvconn.SSHClient, error) {
+	sshAuthOpts := s.getSSHClientOptions(loginSystemUser)
+	password := loginSystemUser.Password
+	privateKey := loginSystemUser.PrivateKey
+	kb := srvconn.SSHClientKeyboardAuth(func(user, instruction string,
+		questions []string, echos []bool) (answers []string, err error) {
+		s.setKeyBoardMode()
+		termReader := utils.NewTerminal(s.UserConn, "")
+		utils.IgnoreErrWriteString(s.UserConn, "\r\n")
+		ans := make([]string, len(questions))
+		for i := range questions {
+			q := questions[i]
+			termReader.SetPrompt(questions[i])
+			logger.Debugf("Conn[%s] keyboard auth question [ %s ]", s.UserConn.ID(), q)
+			if strings.Contains(strings.ToLower(q), "password") {
+				if privateKey != "" || password != "" {
+					ans[i] = password
+					continue
+				}
+			}
+			line, err2 := termReader.ReadLine()
+			if err2 != nil {
+				logger.Errorf("Conn[%s] keyboard auth read err: %s", s.UserConn.ID(), err2)
+			}
+			ans[i] = line
+		}
+		s.resetKeyboardMode()
+		return ans, nil
+	})
+	sshAuthOpts = append(sshAuthOpts, kb)
+	return srvconn.NewSSHClient(sshAuthOpts...)
+}
+
+// needPasswordAfterCertAuth 表示没有密码的系统用户使用证书认证失败, 需要用户输入密码
+func (s *Server) needPasswordAfterCertAuth(loginSystemUser *model.SystemUserAuthInfo, err error) bool {
+	return loginSystemUser == s.systemUserAuthInfo && loginSystemUser.Password == "" &&
+		s.useSSHCertificate() && strings.Contains(err.Error(), "unable to authenticate")
+}
+
+// getSSHClientOptions 返回登录资产的 SSH 客户端配置, 包括网关配置
+func (s *Server) getSSHClientOptions(loginSystemUser *model.SystemUserAuthInfo) []srvconn.SSHClientOption {
+	timeout := config.GlobalConfig.SSHTimeout
+	sshAuthOpts := make([]srvconn.SSHClientOption, 0, 8)
+	sshAuthOpts = append(sshAuthOpts, srvconn.SSHClientUsername(loginSystemUser.Username))
+	sshAuthOpts = append(sshAuthOpts, srvconn.SSHClientHost(s.connOpts.asset.IP))
+	sshAuthOpts = append(sshAuthOpts, srvconn.SSHClientHostKeys(s.connOpts.asset.SSHHostKeys...))
+	sshAuthOpts = append(sshAuthOpts, srvconn.SSHClientPort(s.connOpts.asset.ProtocolPort(loginSystemUser.Protocol)))
+	sshAuthOpts = append(sshAuthOpts, srvconn.SSHClientPassword(loginSystemUser.Password))
+	sshAuthOpts = append(sshAuthOpts, srvconn.SSHClientTimeout(timeout))
+	certReq := sshcert.Request{
+		SessionID:  s.ID,
+		User:       s.connOpts.user.Username,
+		Principals: []string{loginSystemUser.Username},
+		ExpireAt:   s.expireInfo.ExpireAt,
+	}
+	if certAuth, err1 := sshcert.Issue(certReq); err1 == nil && certAuth != nil {
+		sshAuthOpts = append(sshAuthOpts, srvconn.SSHClientCertAuth(certAuth))
+	}
+
+	if loginSystemUser.PrivateKey != "" {
+		// 先使用 password 解析 PrivateKey
+		if signer, err1 := gossh.ParsePrivateKeyWithPassphrase([]byte(loginSystemUser.PrivateKey),
+			[]byte(loginSystemUser.Password)); err1 == nil {
+			sshAuthOpts = append(sshAuthOpts, srvconn.SSHClientPrivateAuth(signer))
+		} else {
+			// 如果之前使用password解析失败，则去掉 password, 尝试直接解析 PrivateKey 防止错误的passphrase
+			if signer, err1 = gossh.ParsePrivateKey([]byte(loginSystemUser.PrivateKey)); err1 == nil {
+				sshAuthOpts = append(sshAuthOpts, srvconn.SSHClientPrivateAuth(signer))
+			}
+		}
+	}
+	// 获取网关配置
+	proxyArgs := s.getGatewayProxyOptions()
+	if proxyArgs != nil {
+		sshAuthOpts = append(sshAuthOpts, srvconn.SSHClientProxyClient(proxyArgs...))
+	}
+	return sshAuthOpts
+}
+
 func (s *Server) getTelnetConn() (srvConn *srvconn.TelnetConnection, err error) {
 	telnetOpts := make([]srvconn.TelnetOption, 0, 8)
 	timeout := config.GlobalConfig.SSHTimeout
@@ -1029,21 +1154,7 @@ func (s *Server) getGatewayProxyOptions() []srvconn.SSHClientOptions {
 	*/
 	if s.domainGateways != nil && len(s.domainGateways.Gateways) != 0 {
 		timeout := config.GlobalConfig.SSHTimeout
-		proxyArgs := make([]srvconn.SSHClientOptions, 0, len(s.domainGateways.Gateways))
-		for i := range s.domainGateways.Gateways {
-			gateway := s.domainGateways.Gateways[i]
-			proxyArg := srvconn.SSHClientOptions{
-				Host:       gateway.IP,
-				Port:       strconv.Itoa(gateway.Port),
-				Username:   gateway.Username,
-				Password:   gateway.Password,
-				Passphrase: gateway.Password, // 兼容 带密码的private_key,
-				PrivateKey: gateway.PrivateKey,
-				Timeout:    timeout,
-			}
-			proxyArgs = append(proxyArgs, proxyArg)
-		}
-		return proxyArgs
+		return srvconn.NewDomainGatewayOptions(s.domainGateways, timeout)
 	}
 	return nil
 }
@@ -1058,6 +1169,15 @@ func (s *Server) getServerConn(proxyAddr *net.TCPAddr) (srvconn.ServerConnection
 		close(done)
 	}()
 	go s.sendConnectingMsg(done)
+	conf := config.GetConf()
+	switch {
+	case conf.EnableBuiltinSQLShell && srvconn.IsSQLShellProtocol(s.connOpts.ProtocolType):
+		return s.getSQLShellConn(proxyAddr)
+	case conf.EnableBuiltinRedisConsole && s.connOpts.ProtocolType == srvconn.ProtocolRedis:
+		return s.getRedisConsoleConn(proxyAddr)
+	case conf.EnableBuiltinMongoDBConsole && s.connOpts.ProtocolType == srvconn.ProtocolMongoDB:
+		return s.getMongoDBConsoleConn(proxyAddr)
+	}
 	switch s.connOpts.ProtocolType {
 	case srvconn.ProtocolSSH:
 		return s.getSSHConn()
@@ -1116,6 +1236,13 @@ func (s *Server) sendConnectingMsg(done chan struct{}) {
 }
 
 func (s *Server) checkLoginConfirm() bool {
+	confirmSrv := s.newLoginConfirmService()
+	ok := s.validateLoginConfirm(&confirmSrv, s.UserConn)
+	s.loginTicketId = confirmSrv.GetTicketId()
+	return ok
+}
+
+func (s *Server) newLoginConfirmService() auth.LoginConfirmService {
 	opts := make([]auth.ConfirmOption, 0, 4)
 	opts = append(opts, auth.ConfirmWithUser(s.connOpts.user))
 	opts = append(opts, auth.ConfirmWithSystemUser(s.systemUserAuthInfo))
@@ -1134,10 +1261,7 @@ func (s *Server) checkLoginConfirm() bool {
 	}
 	opts = append(opts, auth.ConfirmWithTargetType(targetType))
 	opts = append(opts, auth.ConfirmWithTargetID(targetId))
-	confirmSrv := auth.NewLoginConfirm(s.jmsService, opts...)
-	ok := s.validateLoginConfirm(&confirmSrv, s.UserConn)
-	s.loginTicketId = confirmSrv.GetTicketId()
-	return ok
+	return auth.NewLoginConfirm(s.jmsService, opts...)
 }
 
 func (s *Server) Proxy() {
@@ -1204,9 +1328,10 @@ func (s *Server) Proxy() {
 			err = dGateway.Start()
 			if err != nil {
 				msg := lang.T("Start domain gateway failed %s")
-				msg = fmt.Sprintf(msg, err)
+				msg = fmt.Sprintf(msg, s.ConvertErrorToReadableMsg(err))
 				utils.IgnoreErrWriteString(s.UserConn, utils.WrapperWarn(msg))
-				logger.Error(msg)
+				logger.Errorf("%s: %s", msg, err)
+				s.recordHostKeyChanged(err)
 				return
 			}
 			defer dGateway.Stop()
@@ -1218,6 +1343,7 @@ func (s *Server) Proxy() {
 	if err != nil {
 		logger.Error(err)
 		s.sendConnectErrorMsg(err)
+		s.recordHostKeyChanged(err)
 		if err2 := s.ConnectedFailedCallback(err); err2 != nil {
 			logger.Errorf("Conn[%s] update session err: %s", s.UserConn.ID(), err2)
 		}
@@ -0,0 +1,201 @@
+package proxy
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/gliderlabs/ssh"
+	gossh "golang.org/x/crypto/ssh"
+
+	"github.com/meowgen/koko/pkg/config"
+	"github.com/meowgen/koko/pkg/exchange"
+	"github.com/meowgen/koko/pkg/jms-sdk-go/model"
+	"github.com/meowgen/koko/pkg/srvconn"
+	"github.com/meowgen/koko/pkg/sshcert"
+)
+
+var certConfigOnce sync.Once
+
+// setupCertConfig 开启 SSH CA, 关闭主机密钥校验, CA 和主机密钥库只初始化一次
+func setupCertConfig(t *testing.T) *sshcert.Authority {
+	certConfigOnce.Do(func() {
+		dir, err := os.MkdirTemp("", "koko-proxy")
+		if err != nil {
+			t.Fatal(err)
+		}
+		config.GlobalConfig = &config.Config{
+			SSHTimeout:           5,
+			DataFolderPath:       dir,
+			SSHHostKeyChecking:   "off",
+			EnableSSHCertificate: true,
+			SSHCertificateCAKey:  filepath.Join(dir, "ssh_ca"),
+			SSHCertificateTTL:    3600,
+		}
+	})
+	authority := sshcert.Default()
+	if authority == nil {
+		t.Fatal("ssh certificate CA not enabled")
+	}
+	return authority
+}
+
+// testUserConn 是没有输入的用户连接, 读取时表示需要用户输入
+type testUserConn struct {
+	ctx context.Context
+}
+
+var errUnexpectedInput = errors.New("unexpected user input")
+
+func (c *testUserConn) Read(p []byte) (int, error)                    { return 0, errUnexpectedInput }
+func (c *testUserConn) Write(p []byte) (int, error)                   { return len(p), nil }
+func (c *testUserConn) Close() error                                  { return nil }
+func (c *testUserConn) ID() string                                    { return "test" }
+func (c *testUserConn) WinCh() <-chan ssh.Window                      { return nil }
+func (c *testUserConn) LoginFrom() string                             { return "ST" }
+func (c *testUserConn) RemoteAddr() string                            { return "127.0.0.1" }
+func (c *testUserConn) Pty() ssh.Pty                                  { return ssh.Pty{} }
+func (c *testUserConn) Context() context.Context                      { return c.ctx }
+func (c *testUserConn) HandleRoomEvent(string, *exchange.RoomMessage) {}
+
+// startCertSSHServer 启动只信任 CA 证书的 SSH 服务, 返回监听的端口. handleChannel 为空时拒绝所有通道
+func startCertSSHServer(t *testing.T, ca gossh.PublicKey, handleChannel func(gossh.NewChannel)) int {
+	checker := &gossh.CertChecker{
+		IsUserAuthority: func(auth gossh.PublicKey) bool {
+			return string(auth.Marshal()) == string(ca.Marshal())
+		},
+	}
+	serverConf := &gossh.ServerConfig{
+		PublicKeyCallback: checker.Authenticate,
+		PasswordCallback: func(gossh.ConnMetadata, []byte) (*gossh.Permissions, error) {
+			return nil, errors.New("password auth disabled")
+		},
+	}
+	_, hostKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostSigner, err := gossh.NewSignerFromKey(hostKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverConf.AddHostKey(hostSigner)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_, chans, reqs, err := gossh.NewServerConn(conn, serverConf)
+				if err != nil {
+					_ = conn.Close()
+					return
+				}
+				go gossh.DiscardRequests(reqs)
+				for ch := range chans {
+					if handleChannel == nil {
+						_ = ch.Reject(gossh.Prohibited, "no channel")
+						continue
+					}
+					go handleChannel(ch)
+				}
+			}()
+		}
+	}()
+	return ln.Addr().(*net.TCPAddr).Port
+}
+
+func newCertTestServer(port int) *Server {
+	asset := &model.Asset{
+		Hostname:  "web1",
+		IP:        "127.0.0.1",
+		Protocols: []string{"ssh/" + strconv.Itoa(port)},
+	}
+	systemUser := &model.SystemUser{Name: "root", Username: "root", Protocol: srvconn.ProtocolSSH}
+	return &Server{
+		ID:       "cert-session",
+		UserConn: &testUserConn{ctx: context.Background()},
+		connOpts: &ConnectionOptions{
+			ProtocolType: srvconn.ProtocolSSH,
+			user:         &model.User{Username: "admin"},
+			systemUser:   systemUser,
+			asset:        asset,
+		},
+		systemUserAuthInfo: &model.SystemUserAuthInfo{
+			Username: "root",
+			Protocol: srvconn.ProtocolSSH,
+		},
+		expireInfo: &model.ExpireInfo{},
+	}
+}
+
+func TestCertOnlySystemUserConnect(t *testing.T) {
+	authority := setupCertConfig(t)
+	port := startCertSSHServer(t, authority.PublicKey(), nil)
+	s := newCertTestServer(port)
+	// 没有密码和私钥的系统用户不需要输入密码
+	if err := s.checkRequiredAuth(); err != nil {
+		t.Fatalf("check required auth: %s", err)
+	}
+	if s.systemUserAuthInfo.Password != "" {
+		t.Fatal("password should not be prompted")
+	}
+	sshClient, err := srvconn.NewSSHClient(s.getSSHClientOptions(s.systemUserAuthInfo)...)
+	if err != nil {
+		t.Fatalf("connect with certificate: %s", err)
+	}
+	_ = sshClient.Close()
+}
+
+func TestManualLoginSystemUserWithCertificate(t *testing.T) {
+	authority := setupCertConfig(t)
+	port := startCertSSHServer(t, authority.PublicKey(), nil)
+	s := newCertTestServer(port)
+	s.connOpts.systemUser.LoginMode = model.LoginModeManual
+	// 手动登录的系统用户不使用证书, 需要输入密码
+	if s.useSSHCertificate() {
+		t.Fatal("manual login system user should not use certificate")
+	}
+	if err := s.checkRequiredAuth(); !errors.Is(err, errUnexpectedInput) {
+		t.Fatalf("password should be prompted, got %v", err)
+	}
+}
+
+func TestCertificateAuthFailedFallback(t *testing.T) {
+	setupCertConfig(t)
+	// 资产信任的是其他 CA, 证书认证失败后需要输入密码
+	_, otherKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherCA, err := gossh.NewSignerFromKey(otherKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := startCertSSHServer(t, otherCA.PublicKey(), nil)
+	s := newCertTestServer(port)
+	_, err = srvconn.NewSSHClient(s.getSSHClientOptions(s.systemUserAuthInfo)...)
+	if err == nil {
+		t.Fatal("certificate signed by untrusted CA should fail")
+	}
+	if !s.needPasswordAfterCertAuth(s.systemUserAuthInfo, err) {
+		t.Fatalf("password should be prompted after certificate auth failed: %s", err)
+	}
+	s.systemUserAuthInfo.Password = "secret"
+	if s.needPasswordAfterCertAuth(s.systemUserAuthInfo, err) {
+		t.Fatal("password should not be prompted again")
+	}
+}
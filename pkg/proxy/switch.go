@@ -13,6 +13,7 @@ import (
 	"github.com/meowgen/koko/pkg/jms-sdk-go/common"
 	"github.com/meowgen/koko/pkg/jms-sdk-go/model"
 	"github.com/meowgen/koko/pkg/logger"
+	"github.com/meowgen/koko/pkg/sqlparser"
 	"github.com/meowgen/koko/pkg/srvconn"
 	"github.com/meowgen/koko/pkg/utils"
 	"github.com/meowgen/koko/pkg/zmodem"
@@ -98,13 +99,21 @@ func (s *SwitchSession) generateCommandResult(item *ExecutedCommand) *model.Comm
 	default:
 		riskLevel = model.NormalLevel
 	}
-	return s.P.GenerateCommandItem(user, input, output, riskLevel, item.CreatedDate)
+	cmd := s.P.GenerateCommandItem(user, input, output, riskLevel, item.CreatedDate)
+	if len(item.Statements) > 0 {
+		sqlparser.TagCommand(cmd, item.Statements)
+	}
+	cmd.Violations = item.Violations
+	return cmd
 }
 
 // Bridge 桥接两个链接
 func (s *SwitchSession) Bridge(userConn UserConnection, srvConn srvconn.ServerConnection) (err error) {
 
 	parser := s.P.GetFilterParser()
+	if stmtConn, ok := srvConn.(srvconn.StatementConnection); ok {
+		parser.RecordStatements(stmtConn)
+	}
 	logger.Infof("Conn[%s] create ParseEngine success", userConn.ID())
 	replayRecorder := s.P.GetReplayRecorder()
 	logger.Infof("Conn[%s] create replay success", userConn.ID())
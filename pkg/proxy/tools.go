@@ -1,10 +1,14 @@
 package proxy
 
 import (
+	"errors"
+	"fmt"
 	"net"
 	"net/url"
 	"strconv"
 	"strings"
+
+	"github.com/meowgen/koko/pkg/hostkey"
 )
 
 const (
@@ -24,6 +28,18 @@ func (s *Server) ConvertErrorToReadableMsg(e error) string {
 	}
 	errMsg := e.Error()
 	lang := s.connOpts.getLang()
+	var (
+		keyChangedErr  *hostkey.KeyChangedError
+		unknownHostErr *hostkey.UnknownHostError
+	)
+	if errors.As(e, &keyChangedErr) {
+		return fmt.Sprintf("%s: %s %s", lang.T("Host key has changed, possible man-in-the-middle attack"),
+			keyChangedErr.Host, keyChangedErr.Fingerprint)
+	}
+	if errors.As(e, &unknownHostErr) {
+		return fmt.Sprintf("%s: %s %s", lang.T("Host key is unknown"),
+			unknownHostErr.Host, unknownHostErr.Fingerprint)
+	}
 	if strings.Contains(errMsg, UnAuth) || strings.Contains(errMsg, LoginFailed) {
 		return lang.T("Authentication failed")
 	}
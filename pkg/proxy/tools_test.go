@@ -0,0 +1,21 @@
+package proxy
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/meowgen/koko/pkg/hostkey"
+	"github.com/meowgen/koko/pkg/srvconn"
+)
+
+func TestConvertHostKeyChangedErr(t *testing.T) {
+	s := &Server{connOpts: &ConnectionOptions{i18nLang: "en"}}
+	keyErr := &hostkey.KeyChangedError{Host: "domain-d1/10.0.0.5", Fingerprint: "SHA256:got",
+		Want: []string{"SHA256:want"}}
+	err := &srvconn.ConnectError{Kind: srvconn.ErrNoAvailable, Err: keyErr}
+	msg := s.ConvertErrorToReadableMsg(err)
+	if !strings.Contains(msg, "Host key has changed") || !strings.Contains(msg, keyErr.Host) ||
+		!strings.Contains(msg, keyErr.Fingerprint) {
+		t.Fatalf("unexpected readable message %q", msg)
+	}
+}
@@ -0,0 +1,142 @@
+package proxybase
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/meowgen/koko/pkg/config"
+	"github.com/meowgen/koko/pkg/i18n"
+	"github.com/meowgen/koko/pkg/jms-sdk-go/model"
+	"github.com/meowgen/koko/pkg/jms-sdk-go/service"
+	"github.com/meowgen/koko/pkg/logger"
+)
+
+const confirmCheckInterval = 10 * time.Second
+
+// MatchFunc 返回命令命中的过滤规则和命中的内容
+type MatchFunc func(rules []model.FilterRule, command string) (model.FilterRule, string, bool)
+
+// MatchRules 按规则的顺序匹配命令文本, 返回第一个命中的规则
+func MatchRules(rules []model.FilterRule, command string) (model.FilterRule, string, bool) {
+	for _, rule := range rules {
+		action, cmd := rule.Match(command)
+		switch action {
+		case model.ActionAllow, model.ActionConfirm, model.ActionDeny:
+			return rule, cmd, true
+		default:
+		}
+	}
+	return model.FilterRule{}, "", false
+}
+
+// LoadFilterRules 优先使用连接令牌中携带的命令过滤规则, 否则从 core 获取
+func LoadFilterRules(jmsService *service.JMService, token *service.TokenAuthInfoResponse) (model.FilterRules, error) {
+	rules := token.Info.CmdFilterRules
+	if rules == nil {
+		var err error
+		rules, err = jmsService.GetCommandFilterRules(token.Info.User.ID,
+			token.Info.SystemUserAuthInfo.ID, "", token.Info.Application.ID)
+		if err != nil {
+			return nil, err
+		}
+	}
+	sort.Sort(rules)
+	return rules, nil
+}
+
+// CommandFilter 按命令过滤规则检查客户端的命令, 需要复核的命令提交工单并等待处理
+type CommandFilter struct {
+	// ConfirmInterval 是查询复核工单状态的间隔
+	ConfirmInterval time.Duration
+
+	name       string
+	jmsService *service.JMService
+	rules      model.FilterRules
+	match      MatchFunc
+}
+
+func NewCommandFilter(name string, jmsService *service.JMService, rules model.FilterRules,
+	match MatchFunc) *CommandFilter {
+	return &CommandFilter{
+		ConfirmInterval: confirmCheckInterval,
+		name:            name,
+		jmsService:      jmsService,
+		rules:           rules,
+		match:           match,
+	}
+}
+
+// IsMatchCommandRule 判断命令是否命中过滤规则
+func (f *CommandFilter) IsMatchCommandRule(command string) (model.FilterRule, string, bool) {
+	return f.match(f.rules, command)
+}
+
+// Check 返回命令是否允许转发到后端; 不允许时返回给客户端的错误信息
+func (f *CommandFilter) Check(sess *Session, command string) (bool, string) {
+	rule, cmd, ok := f.IsMatchCommandRule(command)
+	if !ok {
+		return true, ""
+	}
+	lang := i18n.NewLang(config.GetConf().LanguageCode)
+	forbiddenMsg := fmt.Sprintf(lang.T("Command `%s` is forbidden"), cmd)
+	switch rule.Action {
+	case model.ActionAllow:
+		return true, ""
+	case model.ActionConfirm:
+		action, processor := f.waitCommandConfirm(sess, rule, command)
+		if action == model.ActionAllow {
+			logger.Infof("Session %s: %s proxy command confirm approved by %s",
+				sess.Sess.ID, f.name, processor)
+			return true, ""
+		}
+		if processor != "" {
+			forbiddenMsg = fmt.Sprintf(lang.T("%s rejected"), processor) + ": " + forbiddenMsg
+		}
+		return false, forbiddenMsg
+	default:
+		return false, forbiddenMsg
+	}
+}
+
+// waitCommandConfirm 提交命令复核工单, 阻塞直到工单被处理或会话结束
+func (f *CommandFilter) waitCommandConfirm(sess *Session, rule model.FilterRule,
+	command string) (model.RuleAction, string) {
+	sid := sess.Sess.ID
+	resp, err := f.jmsService.SubmitCommandConfirm(sid, rule.ID, command)
+	if err != nil {
+		logger.Errorf("Session %s: submit command confirm api err: %s", sid, err)
+		return model.ActionDeny, ""
+	}
+	logger.Infof("Session %s: %s proxy wait command confirm, reviewers %v, detail %s",
+		sid, f.name, resp.Reviewers, resp.TicketDetailUrl)
+	checkTimer := time.NewTicker(f.ConfirmInterval)
+	defer checkTimer.Stop()
+	ctx := sess.SwSess.Ctx
+	for {
+		select {
+		case <-ctx.Done():
+			if err = f.jmsService.CancelConfirmByRequestInfo(resp.CloseReq); err != nil {
+				logger.Errorf("Session %s: Cancel command confirm err: %s", sid, err)
+			}
+			logger.Infof("Session %s: Closed, cancel command confirm", sid)
+			return model.ActionDeny, ""
+		case <-checkTimer.C:
+		}
+		statusResp, err := f.jmsService.CheckConfirmStatusByRequestInfo(resp.CheckReq)
+		if err != nil {
+			logger.Errorf("Session %s: check command confirm status err: %s", sid, err)
+			continue
+		}
+		switch statusResp.State {
+		case model.TicketOpen:
+			continue
+		case model.TicketApproved:
+			return model.ActionAllow, statusResp.Processor
+		case model.TicketRejected, model.TicketClosed:
+			return model.ActionDeny, statusResp.Processor
+		default:
+			logger.Errorf("Receive unknown command confirm status %s", statusResp.Status)
+		}
+	}
+}
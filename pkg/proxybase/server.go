@@ -0,0 +1,154 @@
+package proxybase
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/meowgen/koko/pkg/logger"
+)
+
+const (
+	shutdownTimeout = 5 * time.Second
+	maxAcceptDelay  = time.Second
+)
+
+var ErrServerClosed = errors.New("proxy: server closed")
+
+// Conn 是数据库代理的客户端连接, 由协议包实现
+type Conn interface {
+	// Serve 处理客户端连接直到连接结束
+	Serve()
+	// Close 断开客户端和后端的连接, 可以重复调用
+	Close()
+}
+
+// Server 监听数据库代理的端口, 管理客户端连接的生命周期, 协议由 newConn 创建的连接处理
+type Server struct {
+	Name string // 代理名称, 用于日志, 如 MySQL
+	Addr string
+
+	newConn  func(net.Conn) Conn
+	listener net.Listener
+	conns    map[Conn]struct{}
+	closed   chan struct{}
+	wg       sync.WaitGroup
+	mu       sync.Mutex
+	once     sync.Once
+}
+
+func NewServer(name, addr string, newConn func(net.Conn) Conn) *Server {
+	return &Server{
+		Name:    name,
+		Addr:    addr,
+		newConn: newConn,
+		conns:   make(map[Conn]struct{}),
+		closed:  make(chan struct{}),
+	}
+}
+
+func (s *Server) Start() {
+	logger.Infof("Start %s proxy server at %s", s.Name, s.Addr)
+	ln, err := net.Listen("tcp", s.Addr)
+	if err != nil {
+		logger.Errorf("%s proxy listen on %s err: %s", s.Name, s.Addr, err)
+		return
+	}
+	if err = s.Serve(ln); err != nil && !errors.Is(err, ErrServerClosed) {
+		logger.Errorf("%s proxy server stop: %s", s.Name, err)
+	}
+}
+
+// Serve 接受 ln 上的连接直到 Stop 或者监听出错, 临时错误时退避重试
+func (s *Server) Serve(ln net.Listener) error {
+	s.mu.Lock()
+	select {
+	case <-s.closed:
+		s.mu.Unlock()
+		_ = ln.Close()
+		return ErrServerClosed
+	default:
+	}
+	s.listener = ln
+	s.mu.Unlock()
+	var delay time.Duration
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			select {
+			case <-s.closed:
+				return ErrServerClosed
+			default:
+			}
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				if delay == 0 {
+					delay = 5 * time.Millisecond
+				} else {
+					delay *= 2
+				}
+				if delay > maxAcceptDelay {
+					delay = maxAcceptDelay
+				}
+				logger.Errorf("%s proxy accept err: %s; retrying in %s", s.Name, err, delay)
+				time.Sleep(delay)
+				continue
+			}
+			return err
+		}
+		delay = 0
+		c := s.newConn(conn)
+		if !s.trackConn(c, true) {
+			_ = conn.Close()
+			return ErrServerClosed
+		}
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			defer s.trackConn(c, false)
+			c.Serve()
+		}()
+	}
+}
+
+func (s *Server) trackConn(c Conn, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if add {
+		select {
+		case <-s.closed:
+			return false
+		default:
+		}
+		s.conns[c] = struct{}{}
+		return true
+	}
+	delete(s.conns, c)
+	return true
+}
+
+// Stop 关闭监听, 断开所有代理中的连接并等待会话结束
+func (s *Server) Stop() {
+	s.once.Do(func() {
+		s.mu.Lock()
+		close(s.closed)
+		if s.listener != nil {
+			_ = s.listener.Close()
+		}
+		for c := range s.conns {
+			c.Close()
+		}
+		s.mu.Unlock()
+	})
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(shutdownTimeout):
+		logger.Errorf("%s proxy wait connections closed timeout", s.Name)
+	}
+}
@@ -0,0 +1,79 @@
+package proxybase
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// echoConn 回显客户端数据, Close 后 Serve 返回
+type echoConn struct {
+	conn net.Conn
+	once sync.Once
+}
+
+func (c *echoConn) Serve() {
+	buf := make([]byte, 512)
+	for {
+		n, err := c.conn.Read(buf)
+		if err != nil {
+			return
+		}
+		if _, err = c.conn.Write(buf[:n]); err != nil {
+			return
+		}
+	}
+}
+
+func (c *echoConn) Close() {
+	c.once.Do(func() { _ = c.conn.Close() })
+}
+
+func TestServer_ServeAndStop(t *testing.T) {
+	srv := NewServer("Test", "127.0.0.1:0", func(conn net.Conn) Conn {
+		return &echoConn{conn: conn}
+	})
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serveErr := make(chan error, 1)
+	go func() { serveErr <- srv.Serve(ln) }()
+
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if _, err = client.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	_ = client.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err = client.Read(buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("echo = %q, %v", buf, err)
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		srv.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(shutdownTimeout):
+		t.Fatal("Stop did not return")
+	}
+	if err = <-serveErr; !errors.Is(err, ErrServerClosed) {
+		t.Fatalf("Serve err = %v, want ErrServerClosed", err)
+	}
+	// Stop 后客户端连接被断开
+	if _, err = client.Read(buf); err == nil {
+		t.Fatal("client connection should be closed")
+	}
+	if err = srv.Serve(ln); !errors.Is(err, ErrServerClosed) {
+		t.Fatalf("Serve after Stop err = %v", err)
+	}
+}
@@ -0,0 +1,128 @@
+package proxybase
+
+import (
+	"context"
+	"time"
+
+	"github.com/meowgen/koko/pkg/common"
+	modelCommon "github.com/meowgen/koko/pkg/jms-sdk-go/common"
+	"github.com/meowgen/koko/pkg/jms-sdk-go/model"
+	"github.com/meowgen/koko/pkg/jms-sdk-go/service"
+	"github.com/meowgen/koko/pkg/logger"
+	"github.com/meowgen/koko/pkg/proxy"
+)
+
+// Session 是代理连接在 core 中的会话, 包括录像, 命令记录和会话终断
+type Session struct {
+	Sess                     *model.Session
+	ReplRecorder             *proxy.ReplyRecorder
+	CmdRecorder              *proxy.CommandRecorder
+	CreateSessionCallback    func() error
+	ConnectedSuccessCallback func() error
+	ConnectedFailedCallback  func(err error) error
+	DisConnectedCallback     func() error
+	SwSess                   *proxy.SwitchSession
+
+	name       string
+	jmsService *service.JMService
+}
+
+// NewSession 使用连接令牌中的用户, 应用和系统用户创建会话, CreateSessionCallback 时提交到 core
+func NewSession(name string, jmsService *service.JMService, token *service.TokenAuthInfoResponse,
+	remoteAddr string) *Session {
+	apiSession := &model.Session{
+		ID:           common.UUID(),
+		User:         token.Info.User.String(),
+		SystemUser:   token.Info.SystemUserAuthInfo.String(),
+		LoginFrom:    "DT",
+		RemoteAddr:   remoteAddr,
+		Protocol:     token.Info.SystemUserAuthInfo.Protocol,
+		UserID:       token.Info.User.ID,
+		SystemUserID: token.Info.SystemUserAuthInfo.ID,
+		Asset:        token.Info.Application.String(),
+		AssetID:      token.Info.Application.ID,
+		OrgID:        token.Info.Application.OrgID,
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Session{
+		Sess: apiSession,
+		CreateSessionCallback: func() error {
+			apiSession.DateStart = modelCommon.NewNowUTCTime()
+			return jmsService.CreateSession(*apiSession)
+		},
+		ConnectedSuccessCallback: func() error {
+			return jmsService.SessionSuccess(apiSession.ID)
+		},
+		ConnectedFailedCallback: func(err error) error {
+			return jmsService.SessionFailed(apiSession.ID, err)
+		},
+		DisConnectedCallback: func() error {
+			return jmsService.SessionDisconnect(apiSession.ID)
+		},
+		SwSess: &proxy.SwitchSession{
+			ID:            apiSession.ID,
+			MaxIdleTime:   120,
+			KeepAliveTime: 10000,
+			Ctx:           ctx,
+			Cancel:        cancel,
+		},
+		name:       name,
+		jmsService: jmsService,
+	}
+}
+
+// StartRecord 按终端配置创建会话的录像和命令记录
+func (s *Session) StartRecord() {
+	termConf, err := s.jmsService.GetTerminalConfig()
+	if err != nil {
+		logger.Errorf("%s proxy get terminal config err: %s", s.name, err)
+	}
+	info := &proxy.ReplyInfo{
+		Width:     80,
+		Height:    36,
+		TimeStamp: time.Now(),
+	}
+	s.ReplRecorder, err = proxy.NewReplayRecord(s.Sess.ID, s.jmsService,
+		proxy.NewReplayStorage(s.jmsService, &termConf), info)
+	if err != nil {
+		logger.Error(err)
+	}
+	s.CmdRecorder = &proxy.CommandRecorder{
+		SessionID:  s.Sess.ID,
+		Storage:    proxy.NewCommandStorage(s.jmsService, &termConf),
+		Queue:      make(chan *model.Command, 10),
+		Closed:     make(chan struct{}),
+		JmsService: s.jmsService,
+	}
+	go s.CmdRecorder.Record()
+}
+
+// NewCommand 返回会话的命令记录, 协议包补充语句类型等信息后交给 CmdRecorder
+func (s *Session) NewCommand(input, output string, riskLevel int64, createdAt time.Time) *model.Command {
+	return &model.Command{
+		SessionID:   s.Sess.ID,
+		OrgID:       s.Sess.OrgID,
+		Input:       input,
+		Output:      output,
+		User:        s.Sess.User,
+		Server:      s.Sess.Asset,
+		SystemUser:  s.Sess.SystemUser,
+		Timestamp:   createdAt.Unix(),
+		RiskLevel:   riskLevel,
+		DateCreated: createdAt.UTC(),
+	}
+}
+
+// End 结束录像和命令记录并通知 core 会话断开, 只调用一次
+func (s *Session) End() {
+	if s.CmdRecorder != nil {
+		s.CmdRecorder.End()
+	}
+	if s.ReplRecorder != nil {
+		s.ReplRecorder.End()
+	}
+	if err := s.DisConnectedCallback(); err != nil {
+		logger.Errorf("Session %s: %s proxy disconnect session err: %s", s.Sess.ID, s.name, err)
+	}
+	logger.Infof("Session %s: %s proxy session end", s.Sess.ID, s.name)
+}
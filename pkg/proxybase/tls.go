@@ -0,0 +1,45 @@
+package proxybase
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+
+	"github.com/meowgen/koko/pkg/jms-sdk-go/model"
+)
+
+// LoadServerTLSConfig 加载客户端连接数据库代理时使用的证书
+func LoadServerTLSConfig(certFile, keyFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// UpstreamTLSConfig 根据应用的 CA, 客户端证书和私钥生成连接后端的 TLS 配置
+func UpstreamTLSConfig(host string, attrs model.Attrs) (*tls.Config, error) {
+	cfg := &tls.Config{
+		ServerName:         host,
+		InsecureSkipVerify: attrs.AllowInvalidCert,
+		MinVersion:         tls.VersionTLS12,
+	}
+	if attrs.CaCert != "" {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM([]byte(attrs.CaCert)) {
+			return nil, errors.New("invalid CA certificate")
+		}
+		cfg.RootCAs = pool
+	}
+	if attrs.ClientCert != "" && attrs.CertKey != "" {
+		cert, err := tls.X509KeyPair([]byte(attrs.ClientCert), []byte(attrs.CertKey))
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
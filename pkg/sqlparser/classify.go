@@ -0,0 +1,610 @@
+package sqlparser
+
+import (
+	"strings"
+)
+
+// 语句的分类
+const (
+	CategoryDDL   = "DDL"
+	CategoryDML   = "DML"
+	CategoryDQL   = "DQL"
+	CategoryDCL   = "DCL"
+	CategoryTCL   = "TCL"
+	CategoryOther = "OTHER"
+)
+
+var statementCategories = map[string]string{
+	"CREATE":   CategoryDDL,
+	"ALTER":    CategoryDDL,
+	"DROP":     CategoryDDL,
+	"TRUNCATE": CategoryDDL,
+	"RENAME":   CategoryDDL,
+	"COMMENT":  CategoryDDL,
+
+	"INSERT":  CategoryDML,
+	"UPDATE":  CategoryDML,
+	"DELETE":  CategoryDML,
+	"REPLACE": CategoryDML,
+	"MERGE":   CategoryDML,
+	"COPY":    CategoryDML,
+	"LOAD":    CategoryDML,
+
+	"SELECT":   CategoryDQL,
+	"SHOW":     CategoryDQL,
+	"DESCRIBE": CategoryDQL,
+	"EXPLAIN":  CategoryDQL,
+
+	"GRANT":  CategoryDCL,
+	"REVOKE": CategoryDCL,
+	"DENY":   CategoryDCL,
+
+	"BEGIN":     CategoryTCL,
+	"START":     CategoryTCL,
+	"COMMIT":    CategoryTCL,
+	"ROLLBACK":  CategoryTCL,
+	"SAVEPOINT": CategoryTCL,
+	"RELEASE":   CategoryTCL,
+}
+
+// 语句类型的别名
+var statementAliases = map[string]string{
+	"DESC":   "DESCRIBE",
+	"VALUES": "SELECT",
+	"TABLE":  "SELECT",
+	"EXEC":   "EXECUTE",
+	"CALL":   "EXECUTE",
+	"END":    "COMMIT",
+}
+
+// 对象类型的别名
+var objectAliases = map[string]string{
+	"PROC": "PROCEDURE",
+}
+
+// 账号相关的对象, CREATE USER 等语句属于 DCL
+var accountObjects = map[string]bool{
+	"USER":  true,
+	"ROLE":  true,
+	"LOGIN": true,
+}
+
+// 不属于某个 schema 的对象, 名称不需要加上默认的 schema
+var globalObjects = map[string]bool{
+	"DATABASE":   true,
+	"SCHEMA":     true,
+	"USER":       true,
+	"ROLE":       true,
+	"LOGIN":      true,
+	"EXTENSION":  true,
+	"TABLESPACE": true,
+	"SERVER":     true,
+}
+
+// CREATE, ALTER, DROP 与对象类型之间的修饰词
+var ddlModifiers = map[string]bool{
+	"OR":           true,
+	"REPLACE":      true,
+	"TEMPORARY":    true,
+	"TEMP":         true,
+	"GLOBAL":       true,
+	"LOCAL":        true,
+	"UNIQUE":       true,
+	"UNLOGGED":     true,
+	"MATERIALIZED": true,
+	"FOREIGN":      true,
+	"CLUSTERED":    true,
+	"NONCLUSTERED": true,
+	"FULLTEXT":     true,
+	"SPATIAL":      true,
+	"ONLINE":       true,
+	"OFFLINE":      true,
+	"IGNORE":       true,
+	"RECURSIVE":    true,
+	"EXTERNAL":     true,
+	"UNDO":         true,
+	"SQL":          true,
+	"SECURITY":     true,
+	"DEFINER":      true,
+	"INVOKER":      true,
+	"ALGORITHM":    true,
+}
+
+// 表名之后不是别名的关键字
+var clauseKeywords = map[string]bool{
+	"WHERE": true, "JOIN": true, "INNER": true, "LEFT": true, "RIGHT": true, "FULL": true,
+	"CROSS": true, "OUTER": true, "NATURAL": true, "STRAIGHT_JOIN": true, "ON": true, "USING": true,
+	"GROUP": true, "ORDER": true, "LIMIT": true, "HAVING": true, "UNION": true, "EXCEPT": true,
+	"INTERSECT": true, "MINUS": true, "SET": true, "WINDOW": true, "OFFSET": true, "FETCH": true,
+	"FOR": true, "WITH": true, "VALUES": true, "VALUE": true, "RETURNING": true, "INTO": true,
+	"OPTION": true, "LATERAL": true, "TABLESAMPLE": true, "PARTITION": true, "USE": true,
+	"FORCE": true, "IGNORE": true, "OUTPUT": true, "WHEN": true, "SELECT": true, "FROM": true,
+	"LOCK": true, "APPLY": true, "PIVOT": true, "UNPIVOT": true, "TO": true, "DEFAULT": true,
+	"ADD": true, "DROP": true, "ALTER": true, "RENAME": true, "MODIFY": true, "CHANGE": true,
+	"CASCADE": true, "RESTRICT": true, "DUPLICATE": true, "CONFLICT": true, "OUTFILE": true, "DUMPFILE": true,
+}
+
+// Statement 是一条 SQL 语句的分类结果
+type Statement struct {
+	// Text 是去掉注释并规范化空白之后的语句
+	Text string
+	// Type 是语句的类型, 如 SELECT, DELETE, DROP
+	Type string
+	// Object 是 DDL 和 DCL 语句操作的对象类型, 如 TABLE, DATABASE
+	Object string
+	// Category 是 DDL, DML, DQL, DCL, TCL 或 OTHER
+	Category string
+	// Targets 是语句操作的对象, 小写的完整名称, 没有指定 schema 的表使用默认的 schema
+	Targets []string
+	// HasWhere 表示语句有 WHERE 条件, 恒为真的条件 (如 1=1) 不算
+	HasWhere bool
+}
+
+// Classifier 按方言识别 SQL 语句的类型和操作的对象
+type Classifier struct {
+	dialect Dialect
+	// defaultSchema 是没有指定 schema 的表所属的 schema
+	defaultSchema string
+}
+
+// NewClassifier 创建语句分类器, MySQL 使用 database 作为默认的 schema,
+// PostgreSQL 和 SQL Server 分别使用 public 和 dbo
+func NewClassifier(dialect Dialect, database string) *Classifier {
+	c := &Classifier{dialect: dialect}
+	switch dialect {
+	case DialectMySQL:
+		c.defaultSchema = strings.ToLower(database)
+	case DialectPostgreSQL:
+		c.defaultSchema = "public"
+	case DialectSQLServer:
+		c.defaultSchema = "dbo"
+	}
+	return c
+}
+
+func (c *Classifier) Dialect() Dialect {
+	return c.dialect
+}
+
+// Classify 拆分并识别 SQL 中的每条语句, MySQL 的 USE 语句会切换之后语句的默认 schema
+func (c *Classifier) Classify(sql string) []*Statement {
+	stmts, rest := splitTokens(tokenize(sql, c.dialect), c.dialect)
+	if len(rest) > 0 {
+		stmts = append(stmts, rest)
+	}
+	result := make([]*Statement, 0, len(stmts))
+	for _, tokens := range stmts {
+		stmt := c.classify(tokens)
+		if stmt.Type == "USE" && c.dialect == DialectMySQL && len(stmt.Targets) == 1 {
+			c.defaultSchema = stmt.Targets[0]
+		}
+		result = append(result, stmt)
+	}
+	return result
+}
+
+// statementParser 分析单条语句的 token
+type statementParser struct {
+	c      *Classifier
+	tokens []token
+	stmt   *Statement
+	seen   map[string]bool
+	// verb 是语句类型关键字的位置, WITH 开头的语句是主语句的位置
+	verb int
+}
+
+func (c *Classifier) classify(tokens []token) *Statement {
+	p := &statementParser{
+		c:      c,
+		tokens: tokens,
+		stmt:   &Statement{Text: normalizeTokens(tokens), Category: CategoryOther},
+		seen:   make(map[string]bool),
+	}
+	p.parse()
+	return p.stmt
+}
+
+func (p *statementParser) at(i int) *token {
+	if i >= 0 && i < len(p.tokens) {
+		return &p.tokens[i]
+	}
+	return &token{kind: tokenPunct}
+}
+
+func (p *statementParser) parse() {
+	i := 0
+	for p.at(i).isPunct("(") {
+		i++
+	}
+	if i >= len(p.tokens) || p.at(i).kind != tokenWord {
+		return
+	}
+	if p.at(i).isWord("WITH") {
+		i = p.skipCTE(i + 1)
+	}
+	p.verb = i
+	verb := p.at(i).value
+	if alias, ok := statementAliases[verb]; ok {
+		verb = alias
+	}
+	p.stmt.Type = verb
+	if category, ok := statementCategories[verb]; ok {
+		p.stmt.Category = category
+	}
+	switch verb {
+	case "CREATE", "ALTER", "DROP":
+		p.parseDDL(i + 1)
+	case "TRUNCATE":
+		p.stmt.Object = "TABLE"
+		j := p.skipWords(i+1, "TABLE", "ONLY")
+		p.parseNameList(j, true)
+	case "RENAME":
+		p.parseRename(i + 1)
+	case "COPY":
+		p.parseNameList(i+1, true)
+	case "GRANT", "REVOKE", "DENY":
+		p.parseGrant(i + 1)
+	case "USE":
+		p.stmt.Object = "DATABASE"
+		if name, _, ok := p.parseName(i + 1); ok {
+			p.addTarget(name, false)
+		}
+	case "UPDATE":
+		j := p.skipWords(i+1, "LOW_PRIORITY", "IGNORE", "ONLY")
+		j = p.skipTop(j)
+		p.parseNameList(j, true)
+	case "DELETE":
+		j := p.skipWords(i+1, "LOW_PRIORITY", "QUICK", "IGNORE")
+		j = p.skipTop(j)
+		if !p.at(j).isWord("FROM") {
+			// DELETE t WHERE ... 和 MySQL 的 DELETE t1, t2 FROM ...
+			p.parseNameList(j, true)
+		}
+	case "INSERT", "REPLACE":
+		j := p.skipWords(i+1, "LOW_PRIORITY", "DELAYED", "HIGH_PRIORITY", "IGNORE")
+		j = p.skipTop(j)
+		if !p.at(j).isWord("INTO") {
+			// SQL Server 的 INTO 可以省略
+			p.parseNameList(j, true)
+		}
+	}
+	p.scanTables()
+	p.stmt.HasWhere = p.hasEffectiveWhere(i)
+}
+
+// skipCTE 跳过 WITH 定义的公用表表达式, 返回主语句的位置
+func (p *statementParser) skipCTE(i int) int {
+	depth := 0
+	for ; i < len(p.tokens); i++ {
+		tok := p.at(i)
+		switch {
+		case tok.isPunct("("):
+			depth++
+		case tok.isPunct(")"):
+			depth--
+		case depth == 0 && tok.isWord("SELECT", "INSERT", "UPDATE", "DELETE", "MERGE", "VALUES", "TABLE"):
+			return i
+		}
+	}
+	return i
+}
+
+func (p *statementParser) skipWords(i int, words ...string) int {
+	for p.at(i).isWord(words...) {
+		i++
+	}
+	return i
+}
+
+// skipTop 跳过 SQL Server 的 TOP (n) [PERCENT]
+func (p *statementParser) skipTop(i int) int {
+	if !p.at(i).isWord("TOP") {
+		return i
+	}
+	i++
+	if p.at(i).isPunct("(") {
+		i = p.skipParens(i)
+	} else {
+		i++
+	}
+	return p.skipWords(i, "PERCENT")
+}
+
+// skipParens 跳过从 i 开始的括号, 返回右括号之后的位置
+func (p *statementParser) skipParens(i int) int {
+	depth := 0
+	for ; i < len(p.tokens); i++ {
+		if p.at(i).isPunct("(") {
+			depth++
+		} else if p.at(i).isPunct(")") {
+			depth--
+			if depth == 0 {
+				return i + 1
+			}
+		}
+	}
+	return i
+}
+
+func (p *statementParser) parseDDL(i int) {
+	for {
+		tok := p.at(i)
+		if tok.isWord("DEFINER", "ALGORITHM") && p.at(i+1).isPunct("=") {
+			// MySQL 的 DEFINER = user@host 和 ALGORITHM = MERGE
+			i += 3
+			for p.at(i).kind == tokenParam || !p.at(i).space && (p.at(i).kind == tokenIdent || p.at(i).kind == tokenString) {
+				i++
+			}
+			continue
+		}
+		if tok.kind != tokenWord || !ddlModifiers[tok.value] {
+			break
+		}
+		i++
+	}
+	object := p.at(i).value
+	if p.at(i).kind != tokenWord {
+		return
+	}
+	if alias, ok := objectAliases[object]; ok {
+		object = alias
+	}
+	p.stmt.Object = object
+	if accountObjects[object] {
+		p.stmt.Category = CategoryDCL
+	}
+	i = p.skipWords(i+1, "IF", "NOT", "EXISTS", "CONCURRENTLY")
+	qualify := !globalObjects[object]
+	next := p.parseNameList(i, qualify)
+	if object == "INDEX" {
+		// CREATE INDEX idx ON t, DROP INDEX idx ON t
+		for j := next; j < len(p.tokens); j++ {
+			if p.at(j).isWord("ON") {
+				p.parseNameList(p.skipWords(j+1, "ONLY"), true)
+				break
+			}
+		}
+	}
+}
+
+// parseRename 解析 MySQL 的 RENAME TABLE a TO b, c TO d
+func (p *statementParser) parseRename(i int) {
+	if p.at(i).kind != tokenWord {
+		return
+	}
+	object := p.at(i).value
+	p.stmt.Object = object
+	if accountObjects[object] {
+		p.stmt.Category = CategoryDCL
+	}
+	qualify := !globalObjects[object]
+	for i++; i < len(p.tokens); i++ {
+		name, next, ok := p.parseName(i)
+		if !ok {
+			return
+		}
+		p.addTarget(name, qualify)
+		i = next
+		if !p.at(i).isWord("TO") && !p.at(i).isPunct(",") {
+			return
+		}
+	}
+}
+
+// parseGrant 解析 GRANT ... ON [object] name 中的对象
+func (p *statementParser) parseGrant(i int) {
+	depth := 0
+	for ; i < len(p.tokens); i++ {
+		tok := p.at(i)
+		if tok.isPunct("(") {
+			depth++
+		} else if tok.isPunct(")") {
+			depth--
+		} else if depth == 0 && tok.isWord("ON") {
+			break
+		}
+	}
+	if i >= len(p.tokens) {
+		return
+	}
+	i++
+	object := "TABLE"
+	switch {
+	case p.at(i).isWord("ALL") && p.at(i+1).isWord("TABLES", "SEQUENCES", "FUNCTIONS", "PROCEDURES") && p.at(i+2).isWord("IN"):
+		// PostgreSQL 的 ALL TABLES IN SCHEMA x
+		object = "SCHEMA"
+		i += 4
+	case p.at(i).kind == tokenWord && p.at(i+1).isPunct("::"):
+		// SQL Server 的 OBJECT::name, SCHEMA::name
+		object = p.at(i).value
+		i += 2
+	case p.at(i).isWord("TABLE", "SCHEMA", "DATABASE", "SEQUENCE", "FUNCTION", "PROCEDURE", "TYPE", "TABLESPACE") &&
+		(p.at(i+1).kind == tokenWord || p.at(i+1).kind == tokenIdent || p.at(i+1).isPunct("*")):
+		object = p.at(i).value
+		i++
+	}
+	if object == "OBJECT" {
+		object = "TABLE"
+	}
+	p.stmt.Object = object
+	p.parseNameList(i, !globalObjects[object])
+}
+
+// parseNameList 解析以逗号分隔的名称, 跳过名称之后的别名, 返回之后的位置
+func (p *statementParser) parseNameList(i int, qualify bool) int {
+	for {
+		name, next, ok := p.parseName(i)
+		if !ok {
+			return i
+		}
+		if p.at(next).isPunct("(") && !p.isDDLName() {
+			// 函数调用, 如 FROM generate_series(1, 10)
+			return next
+		}
+		p.addTarget(name, qualify)
+		i = p.skipAlias(next)
+		if !p.at(i).isPunct(",") {
+			return i
+		}
+		i++
+	}
+}
+
+// isDDLName 表示名称之后的括号是列定义或参数, 而不是函数调用
+func (p *statementParser) isDDLName() bool {
+	return p.stmt.Category == CategoryDDL || p.stmt.Category == CategoryDCL ||
+		p.stmt.Type == "INSERT" || p.stmt.Type == "REPLACE"
+}
+
+func (p *statementParser) skipAlias(i int) int {
+	tok := p.at(i)
+	switch {
+	case tok.isWord("AS"):
+		return i + 2
+	case tok.kind == tokenIdent, tok.kind == tokenWord && !clauseKeywords[tok.value]:
+		return i + 1
+	}
+	return i
+}
+
+// parseName 解析以点分隔的名称, 如 db.schema.table, MySQL 的 db.* 中可以使用 *
+func (p *statementParser) parseName(i int) (string, int, bool) {
+	var parts []string
+	for {
+		tok := p.at(i)
+		switch {
+		case tok.kind == tokenWord && (len(parts) > 0 || !clauseKeywords[tok.value]):
+			parts = append(parts, strings.ToLower(tok.text))
+		case tok.kind == tokenIdent:
+			parts = append(parts, strings.ToLower(tok.value))
+		case tok.isPunct("*"):
+			parts = append(parts, "*")
+		case tok.isPunct(".") && len(parts) > 0:
+			// SQL Server 的 db..table 省略了 schema
+			parts = append(parts, "")
+			i++
+			continue
+		default:
+			return "", i, false
+		}
+		i++
+		if !p.at(i).isPunct(".") {
+			break
+		}
+		i++
+	}
+	return strings.Join(parts, "."), i, true
+}
+
+func (p *statementParser) addTarget(name string, qualify bool) {
+	if name == "" || name == "*" && !qualify {
+		return
+	}
+	if qualify && !strings.Contains(name, ".") && p.c.defaultSchema != "" {
+		name = p.c.defaultSchema + "." + name
+	}
+	if !p.seen[name] {
+		p.seen[name] = true
+		p.stmt.Targets = append(p.stmt.Targets, name)
+	}
+}
+
+// scanTables 收集 FROM, JOIN, INTO, USING 和 MERGE 之后的表, 包括子查询中的表
+func (p *statementParser) scanTables() {
+	// queries 记录每层括号是否是子查询, FROM 只在查询中表示表, 如 EXTRACT(YEAR FROM d) 中的不是
+	queries := []bool{true}
+	for i := 0; i < len(p.tokens); i++ {
+		tok := p.at(i)
+		switch {
+		case tok.isPunct("("):
+			queries = append(queries, false)
+		case tok.isPunct(")"):
+			if len(queries) > 1 {
+				queries = queries[:len(queries)-1]
+			}
+		case tok.isWord("SELECT"):
+			queries[len(queries)-1] = true
+		case tok.isWord("FROM") && queries[len(queries)-1] && !p.at(i-1).isWord("DISTINCT"),
+			tok.isWord("JOIN", "APPLY"),
+			tok.isWord("INTO") && !p.at(i-1).isWord("INSERT", "REPLACE", "MERGE", "SELECT") && p.stmt.Category == CategoryDQL:
+			p.parseNameList(p.skipWords(i+1, "ONLY", "LATERAL"), true)
+		case tok.isWord("INTO") && p.at(i-1).isWord("INSERT", "REPLACE", "MERGE", "IGNORE", "DELAYED", "LOW_PRIORITY", "HIGH_PRIORITY"),
+			tok.isWord("INTO") && p.stmt.Type == "LOAD",
+			tok.isWord("USING") && (p.stmt.Type == "MERGE" || p.stmt.Type == "DELETE") && !p.at(i+1).isPunct("("),
+			tok.isWord("MERGE") && i == p.verb && !p.at(i+1).isWord("INTO"):
+			p.parseNameList(p.skipWords(i+1, "TABLE", "ONLY"), true)
+		}
+	}
+}
+
+// hasEffectiveWhere 判断语句的最外层是否有 WHERE 条件, 恒为真的条件不算
+func (p *statementParser) hasEffectiveWhere(start int) bool {
+	depth := 0
+	for i := start; i < len(p.tokens); i++ {
+		tok := p.at(i)
+		switch {
+		case tok.isPunct("("):
+			depth++
+		case tok.isPunct(")"):
+			depth--
+		case depth == 0 && tok.isWord("WHERE"):
+			return !p.isTautology(i + 1)
+		}
+	}
+	return false
+}
+
+// isTautology 判断从 i 开始的条件是否恒为真, 如 1=1, true, 'a'='a', 或者包含 OR 1=1
+func (p *statementParser) isTautology(i int) bool {
+	var term []*token
+	depth := 0
+	for ; ; i++ {
+		tok := p.at(i)
+		end := i >= len(p.tokens) || depth == 0 && tok.isWord("ORDER", "LIMIT", "RETURNING", "OPTION", "GROUP",
+			"HAVING", "UNION", "FOR", "OFFSET", "FETCH", "WINDOW")
+		if end || depth == 0 && tok.isWord("OR") {
+			if isTrueTerm(term) {
+				return true
+			}
+			if end {
+				return false
+			}
+			term = term[:0]
+			continue
+		}
+		if tok.isPunct("(") {
+			depth++
+		} else if tok.isPunct(")") {
+			depth--
+		}
+		term = append(term, tok)
+	}
+}
+
+func isTrueTerm(term []*token) bool {
+	// 去掉外层的括号
+	for len(term) >= 2 && term[0].isPunct("(") && term[len(term)-1].isPunct(")") {
+		term = term[1 : len(term)-1]
+	}
+	switch len(term) {
+	case 1:
+		tok := term[0]
+		return tok.isWord("TRUE") || tok.kind == tokenNumber && strings.Trim(tok.text, "0.") != ""
+	case 3:
+		left, op, right := term[0], term[1], term[2]
+		if left.kind == tokenParam || right.kind == tokenParam || left.kind != right.kind {
+			return false
+		}
+		same := left.text == right.text
+		if left.kind == tokenWord {
+			same = left.value == right.value
+		}
+		switch op.text {
+		case "=":
+			return same
+		case "<>", "!=":
+			return !same && (left.kind == tokenNumber || left.kind == tokenString)
+		}
+	}
+	return false
+}
@@ -0,0 +1,89 @@
+package sqlparser
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestClassify(t *testing.T) {
+	tests := []struct {
+		sql      string
+		dialect  Dialect
+		typ      string
+		object   string
+		category string
+		targets  []string
+		hasWhere bool
+	}{
+		{"SELECT a FROM t1 JOIN s.t2 ON t1.id = t2.id WHERE a > 1", DialectMySQL,
+			"SELECT", "", CategoryDQL, []string{"app.t1", "s.t2"}, true},
+		{"select extract(year from d) from (select d from logs) x", DialectPostgreSQL,
+			"SELECT", "", CategoryDQL, []string{"public.logs"}, false},
+		{"with x as (select * from a where b = 1) delete from t", DialectPostgreSQL,
+			"DELETE", "", CategoryDML, []string{"public.a", "public.t"}, false},
+		{"DELETE FROM t WHERE id = 1", DialectMySQL, "DELETE", "", CategoryDML, []string{"app.t"}, true},
+		{"delete from t where 1=1", DialectMySQL, "DELETE", "", CategoryDML, []string{"app.t"}, false},
+		{"delete from t where id = 1 or 'a' = 'a'", DialectMySQL, "DELETE", "", CategoryDML, []string{"app.t"}, false},
+		{"delete from t where (true) limit 10", DialectMySQL, "DELETE", "", CategoryDML, []string{"app.t"}, false},
+		{"DELETE TOP (10) dbo.t", DialectSQLServer, "DELETE", "", CategoryDML, []string{"dbo.t"}, false},
+		{"update t set a = (select max(a) from s where s.id = t.id)", DialectMySQL,
+			"UPDATE", "", CategoryDML, []string{"app.t", "app.s"}, false},
+		{"UPDATE t1 AS a, t2 SET a.x = t2.x WHERE a.id = t2.id", DialectMySQL,
+			"UPDATE", "", CategoryDML, []string{"app.t1", "app.t2"}, true},
+		{"INSERT INTO t (a) SELECT a FROM s", DialectMySQL, "INSERT", "", CategoryDML, []string{"app.t", "app.s"}, false},
+		{"insert dbo.t values (1)", DialectSQLServer, "INSERT", "", CategoryDML, []string{"dbo.t"}, false},
+		{"DROP TABLE IF EXISTS a, b.c CASCADE", DialectPostgreSQL, "DROP", "TABLE", CategoryDDL,
+			[]string{"public.a", "b.c"}, false},
+		{"drop database Sales", DialectMySQL, "DROP", "DATABASE", CategoryDDL, []string{"sales"}, false},
+		{"/*!40000 DROP */ SCHEMA `x`", DialectMySQL, "DROP", "SCHEMA", CategoryDDL, []string{"x"}, false},
+		{"DROP INDEX idx ON t", DialectMySQL, "DROP", "INDEX", CategoryDDL, []string{"app.idx", "app.t"}, false},
+		{"CREATE OR REPLACE VIEW v AS SELECT * FROM t", DialectPostgreSQL, "CREATE", "VIEW", CategoryDDL,
+			[]string{"public.v", "public.t"}, false},
+		{"CREATE DEFINER=`root`@`%` VIEW v AS SELECT 1", DialectMySQL, "CREATE", "VIEW", CategoryDDL,
+			[]string{"app.v"}, false},
+		{"create user bob identified by 'x'", DialectMySQL, "CREATE", "USER", CategoryDCL, []string{"bob"}, false},
+		{"TRUNCATE TABLE t", DialectMySQL, "TRUNCATE", "TABLE", CategoryDDL, []string{"app.t"}, false},
+		{"RENAME TABLE a TO b, c TO d.e", DialectMySQL, "RENAME", "TABLE", CategoryDDL,
+			[]string{"app.a", "app.b", "app.c", "d.e"}, false},
+		{"GRANT ALL ON sales.* TO bob", DialectMySQL, "GRANT", "TABLE", CategoryDCL, []string{"sales.*"}, false},
+		{"GRANT USAGE ON SCHEMA s TO bob", DialectPostgreSQL, "GRANT", "SCHEMA", CategoryDCL, []string{"s"}, false},
+		{"GRANT SELECT ON ALL TABLES IN SCHEMA s TO bob", DialectPostgreSQL, "GRANT", "SCHEMA", CategoryDCL,
+			[]string{"s"}, false},
+		{"GRANT SELECT ON SCHEMA::sales TO bob", DialectSQLServer, "GRANT", "SCHEMA", CategoryDCL,
+			[]string{"sales"}, false},
+		{"use Sales", DialectMySQL, "USE", "DATABASE", CategoryOther, []string{"sales"}, false},
+		{"desc t", DialectMySQL, "DESCRIBE", "", CategoryDQL, nil, false},
+		{"begin", DialectPostgreSQL, "BEGIN", "", CategoryTCL, nil, false},
+		{"", DialectMySQL, "", "", CategoryOther, nil, false},
+	}
+	for _, tt := range tests {
+		stmts := NewClassifier(tt.dialect, "App").Classify(tt.sql)
+		if tt.sql == "" {
+			if len(stmts) != 0 {
+				t.Errorf("Classify(%q) = %d statements, want 0", tt.sql, len(stmts))
+			}
+			continue
+		}
+		if len(stmts) != 1 {
+			t.Errorf("Classify(%q) = %d statements, want 1", tt.sql, len(stmts))
+			continue
+		}
+		stmt := stmts[0]
+		if stmt.Type != tt.typ || stmt.Object != tt.object || stmt.Category != tt.category ||
+			!reflect.DeepEqual(stmt.Targets, tt.targets) || stmt.HasWhere != tt.hasWhere {
+			t.Errorf("Classify(%q) = %s %s %s %q where=%v, want %s %s %s %q where=%v", tt.sql,
+				stmt.Type, stmt.Object, stmt.Category, stmt.Targets, stmt.HasWhere,
+				tt.typ, tt.object, tt.category, tt.targets, tt.hasWhere)
+		}
+	}
+}
+
+func TestClassifyUse(t *testing.T) {
+	stmts := NewClassifier(DialectMySQL, "app").Classify("drop table a; use other; drop table b")
+	if len(stmts) != 3 {
+		t.Fatalf("got %d statements, want 3", len(stmts))
+	}
+	if !reflect.DeepEqual(stmts[0].Targets, []string{"app.a"}) || !reflect.DeepEqual(stmts[2].Targets, []string{"other.b"}) {
+		t.Errorf("unexpected targets %q and %q", stmts[0].Targets, stmts[2].Targets)
+	}
+}
@@ -0,0 +1,446 @@
+package sqlparser
+
+import (
+	"strings"
+
+	"github.com/meowgen/koko/pkg/jms-sdk-go/model"
+)
+
+// Dialect 是 SQL 方言, 影响字符串, 标识符和注释的解析
+type Dialect int
+
+const (
+	DialectMySQL Dialect = iota + 1
+	DialectPostgreSQL
+	DialectSQLServer
+)
+
+// DialectFromProtocol 返回数据库协议对应的方言, 不支持的协议返回 false
+func DialectFromProtocol(protocol string) (Dialect, bool) {
+	switch protocol {
+	case model.AppTypeMySQL, model.AppTypeMariaDB:
+		return DialectMySQL, true
+	case model.AppTypePostgres:
+		return DialectPostgreSQL, true
+	case model.AppTypeSQLServer:
+		return DialectSQLServer, true
+	}
+	return 0, false
+}
+
+func (d Dialect) String() string {
+	switch d {
+	case DialectMySQL:
+		return "mysql"
+	case DialectPostgreSQL:
+		return "postgresql"
+	case DialectSQLServer:
+		return "sqlserver"
+	}
+	return "unknown"
+}
+
+type tokenKind int
+
+const (
+	// tokenWord 是关键字或没有引号的标识符
+	tokenWord tokenKind = iota
+	// tokenIdent 是带引号的标识符
+	tokenIdent
+	tokenString
+	tokenNumber
+	// tokenParam 是变量和参数, 如 @name, $1, :name
+	tokenParam
+	tokenPunct
+)
+
+type token struct {
+	kind tokenKind
+	// text 是 SQL 中的原始文本
+	text string
+	// value 对于关键字是大写的文本, 对于带引号的标识符是去掉引号后的名称
+	value string
+	// pos 和 end 是 token 在 SQL 中的位置
+	pos, end int
+	// space 表示与前一个 token 之间有空白或注释
+	space bool
+	// newline 表示与前一个 token 之间有换行
+	newline bool
+}
+
+func (t *token) isWord(values ...string) bool {
+	if t.kind != tokenWord {
+		return false
+	}
+	for _, v := range values {
+		if t.value == v {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *token) isPunct(text string) bool {
+	return t.kind == tokenPunct && t.text == text
+}
+
+// 多个字符组成的运算符
+var multiCharPuncts = []string{"->>", "::", "<>", "<=", ">=", "!=", "||", ":=", "->", "=>"}
+
+type lexer struct {
+	dialect Dialect
+	sql     string
+	pos     int
+
+	space   bool
+	newline bool
+	// execComment 表示正在 MySQL 的 /*! ... */ 可执行注释中, 注释中的内容会被执行
+	execComment bool
+
+	tokens []token
+}
+
+// tokenize 按方言把 SQL 拆分为 token, 注释被当作空白; 没有结束的字符串和注释延续到 SQL 结尾
+func tokenize(sql string, dialect Dialect) []token {
+	l := &lexer{dialect: dialect, sql: sql}
+	for l.pos < len(l.sql) {
+		l.next()
+	}
+	return l.tokens
+}
+
+func (l *lexer) emit(kind tokenKind, start int, value string) {
+	l.tokens = append(l.tokens, token{
+		kind:    kind,
+		text:    l.sql[start:l.pos],
+		value:   value,
+		pos:     start,
+		end:     l.pos,
+		space:   l.space,
+		newline: l.newline,
+	})
+	l.space, l.newline = false, false
+}
+
+func (l *lexer) peek(offset int) byte {
+	if l.pos+offset < len(l.sql) {
+		return l.sql[l.pos+offset]
+	}
+	return 0
+}
+
+func (l *lexer) next() {
+	s := l.sql
+	c := s[l.pos]
+	start := l.pos
+	switch {
+	case isSpace(c):
+		if c == '\n' {
+			l.newline = true
+		}
+		l.space = true
+		l.pos++
+	case c == '-' && l.peek(1) == '-' && (l.dialect != DialectMySQL || l.peek(2) == 0 || isSpace(l.peek(2))):
+		l.skipLineComment()
+	case c == '#' && l.dialect == DialectMySQL:
+		l.skipLineComment()
+	case c == '/' && l.peek(1) == '*':
+		l.skipBlockComment()
+	case c == '*' && l.peek(1) == '/' && l.execComment:
+		l.execComment = false
+		l.space = true
+		l.pos += 2
+	case c == '\'':
+		l.scanQuoted('\'', l.dialect == DialectMySQL)
+		l.emit(tokenString, start, "")
+	case c == '"' && l.dialect == DialectMySQL:
+		l.scanQuoted('"', true)
+		l.emit(tokenString, start, "")
+	case c == '"':
+		l.scanQuoted('"', false)
+		l.emit(tokenIdent, start, unquote(s[start:l.pos], "\""))
+	case c == '`' && l.dialect == DialectMySQL:
+		l.scanQuoted('`', false)
+		l.emit(tokenIdent, start, unquote(s[start:l.pos], "`"))
+	case c == '[' && l.dialect == DialectSQLServer:
+		l.scanQuoted(']', false)
+		l.emit(tokenIdent, start, unquote(s[start:l.pos], "]"))
+	case c == '$' && l.dialect == DialectPostgreSQL && l.scanDollarQuoted():
+		l.emit(tokenString, start, "")
+	case isDigit(c) || c == '.' && isDigit(l.peek(1)):
+		l.scanNumber()
+		l.emit(tokenNumber, start, "")
+	case c == '@' || c == '$' && isDigit(l.peek(1)) || c == ':' && isWordStart(l.peek(1)) || c == '?':
+		l.pos++
+		for l.pos < len(s) && (isWordChar(s[l.pos]) || s[l.pos] == '@') {
+			l.pos++
+		}
+		l.emit(tokenParam, start, "")
+	case isWordStart(c) || c == '#' && l.dialect == DialectSQLServer:
+		l.pos++
+		for l.pos < len(s) && (isWordChar(s[l.pos]) || s[l.pos] == '#' && l.dialect == DialectSQLServer ||
+			s[l.pos] == '$' && l.dialect != DialectSQLServer) {
+			l.pos++
+		}
+		// E'...', N'...', X'...' 等带前缀的字符串
+		if l.pos-start == 1 && l.peek(0) == '\'' && strings.ContainsRune("eEnNxXbB", rune(c)) {
+			backslash := l.dialect == DialectMySQL || c == 'e' || c == 'E'
+			l.scanQuoted('\'', backslash)
+			l.emit(tokenString, start, "")
+			return
+		}
+		l.emit(tokenWord, start, strings.ToUpper(s[start:l.pos]))
+	default:
+		for _, p := range multiCharPuncts {
+			if strings.HasPrefix(s[l.pos:], p) {
+				l.pos += len(p)
+				l.emit(tokenPunct, start, p)
+				return
+			}
+		}
+		l.pos++
+		l.emit(tokenPunct, start, s[start:l.pos])
+	}
+}
+
+func (l *lexer) skipLineComment() {
+	for l.pos < len(l.sql) && l.sql[l.pos] != '\n' {
+		l.pos++
+	}
+	l.space = true
+}
+
+func (l *lexer) skipBlockComment() {
+	if l.dialect == DialectMySQL {
+		// /*!40101 ... */ 和 /*M!100101 ... */ 中的内容会被 MySQL 执行, 只跳过注释的标记
+		rest := l.sql[l.pos+2:]
+		if strings.HasPrefix(rest, "!") || strings.HasPrefix(rest, "M!") {
+			l.pos += 2 + strings.IndexByte(rest, '!') + 1
+			for l.pos < len(l.sql) && isDigit(l.sql[l.pos]) {
+				l.pos++
+			}
+			l.execComment = true
+			l.space = true
+			return
+		}
+	}
+	// PostgreSQL 和 SQL Server 的块注释可以嵌套
+	nested := l.dialect != DialectMySQL
+	depth := 0
+	for l.pos < len(l.sql) {
+		switch {
+		case strings.HasPrefix(l.sql[l.pos:], "/*"):
+			if depth == 0 || nested {
+				depth++
+			}
+			l.pos += 2
+		case strings.HasPrefix(l.sql[l.pos:], "*/"):
+			depth--
+			l.pos += 2
+			if depth == 0 {
+				l.space = true
+				return
+			}
+		default:
+			l.pos++
+		}
+	}
+	l.space = true
+}
+
+// scanQuoted 读取以当前字符开始, 以 quote 结束的字符串, 连续两个 quote 表示 quote 本身
+func (l *lexer) scanQuoted(quote byte, backslash bool) {
+	l.pos++
+	for l.pos < len(l.sql) {
+		c := l.sql[l.pos]
+		switch {
+		case backslash && c == '\\':
+			l.pos += 2
+		case c == quote && l.peek(1) == quote:
+			l.pos += 2
+		case c == quote:
+			l.pos++
+			return
+		default:
+			l.pos++
+		}
+	}
+	l.pos = len(l.sql)
+}
+
+// scanDollarQuoted 读取 PostgreSQL 的 $tag$...$tag$ 字符串
+func (l *lexer) scanDollarQuoted() bool {
+	s := l.sql
+	i := l.pos + 1
+	for i < len(s) && isWordChar(s[i]) && !(i == l.pos+1 && isDigit(s[i])) {
+		i++
+	}
+	if i >= len(s) || s[i] != '$' {
+		return false
+	}
+	tag := s[l.pos : i+1]
+	if end := strings.Index(s[i+1:], tag); end >= 0 {
+		l.pos = i + 1 + end + len(tag)
+	} else {
+		l.pos = len(s)
+	}
+	return true
+}
+
+func (l *lexer) scanNumber() {
+	s := l.sql
+	if s[l.pos] == '0' && (l.peek(1) == 'x' || l.peek(1) == 'X') {
+		l.pos += 2
+		for l.pos < len(s) && isWordChar(s[l.pos]) {
+			l.pos++
+		}
+		return
+	}
+	for l.pos < len(s) && (isDigit(s[l.pos]) || s[l.pos] == '.') {
+		l.pos++
+	}
+	if l.pos < len(s) && (s[l.pos] == 'e' || s[l.pos] == 'E') {
+		i := l.pos + 1
+		if i < len(s) && (s[i] == '+' || s[i] == '-') {
+			i++
+		}
+		if i < len(s) && isDigit(s[i]) {
+			l.pos = i
+			for l.pos < len(s) && isDigit(s[l.pos]) {
+				l.pos++
+			}
+		}
+	}
+}
+
+func unquote(text, closing string) string {
+	if len(text) < 2 || !strings.HasSuffix(text, closing) {
+		return text[1:]
+	}
+	inner := text[1 : len(text)-1]
+	return strings.ReplaceAll(inner, closing+closing, closing)
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f' || c == '\v'
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isWordStart(c byte) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= 0x80
+}
+
+func isWordChar(c byte) bool {
+	return isWordStart(c) || isDigit(c)
+}
+
+// splitTokens 按语句结束符拆分 token, 返回已结束的语句和最后一条没有结束的语句
+func splitTokens(tokens []token, dialect Dialect) (stmts [][]token, rest []token) {
+	start := 0
+	for i := 0; i < len(tokens); i++ {
+		tok := &tokens[i]
+		end := -1
+		switch {
+		case tok.isPunct(";"):
+			end = i + 1
+		case tok.isPunct(`\`) && i+1 < len(tokens) && tokens[i+1].isWord("G") && !tokens[i+1].space &&
+			dialect != DialectSQLServer:
+			// 客户端的 \g 和 \G 结束符
+			end = i + 2
+		case tok.isWord("GO") && dialect == DialectSQLServer && (i == 0 || tok.newline) &&
+			(i+1 == len(tokens) || tokens[i+1].newline):
+			// sqlcmd 的 GO 批处理分隔符
+			end = i + 1
+		}
+		if end < 0 {
+			continue
+		}
+		if i > start {
+			stmts = append(stmts, tokens[start:i])
+		}
+		start = end
+		i = end - 1
+	}
+	return stmts, tokens[start:]
+}
+
+// SplitStatements 按方言拆分 SQL, 返回已结束的语句和最后没有结束的部分
+func SplitStatements(sql string, dialect Dialect) (stmts []string, rest string) {
+	stmtTokens, restTokens := splitTokens(tokenize(sql, dialect), dialect)
+	for _, tokens := range stmtTokens {
+		stmts = append(stmts, sql[tokens[0].pos:tokens[len(tokens)-1].end])
+	}
+	if len(restTokens) > 0 {
+		rest = sql[restTokens[0].pos:]
+	}
+	return stmts, rest
+}
+
+// SplitStatementsByDelimiter 按 mysql 客户端 delimiter 命令设置的结束符拆分 SQL,
+// 结束符不在字符串和带引号的标识符中, 且需要在 token 的边界上; 结束符为 ; 时与 SplitStatements 相同
+func SplitStatementsByDelimiter(sql string, dialect Dialect, delimiter string) (stmts []string, rest string) {
+	if delimiter == "" || delimiter == ";" {
+		return SplitStatements(sql, dialect)
+	}
+	tokens := tokenize(sql, dialect)
+	ends := make(map[int]bool, len(tokens))
+	for i := range tokens {
+		ends[tokens[i].end] = true
+	}
+	start := 0
+	for i := 0; i < len(tokens); i++ {
+		tok := &tokens[i]
+		if tok.kind == tokenString || tok.kind == tokenIdent {
+			continue
+		}
+		delimEnd := tok.pos + len(delimiter)
+		if !strings.HasPrefix(sql[tok.pos:], delimiter) || !ends[delimEnd] {
+			continue
+		}
+		if i > start {
+			stmts = append(stmts, sql[tokens[start].pos:tokens[i-1].end])
+		}
+		for i < len(tokens) && tokens[i].pos < delimEnd {
+			i++
+		}
+		start = i
+		i--
+	}
+	if start < len(tokens) {
+		rest = sql[tokens[start].pos:]
+	}
+	return stmts, rest
+}
+
+// normalizeTokens 去掉注释, 把连续的空白合并为一个空格, 关键字和没有引号的标识符转为小写
+func normalizeTokens(tokens []token) string {
+	var b strings.Builder
+	for i := range tokens {
+		tok := &tokens[i]
+		if i > 0 && tok.space {
+			b.WriteByte(' ')
+		}
+		if tok.kind == tokenWord {
+			b.WriteString(strings.ToLower(tok.text))
+		} else {
+			b.WriteString(tok.text)
+		}
+	}
+	return b.String()
+}
+
+// Normalize 返回规范化之后的 SQL, 多条语句以 "; " 分隔
+func Normalize(sql string, dialect Dialect) string {
+	stmts, rest := splitTokens(tokenize(sql, dialect), dialect)
+	if len(rest) > 0 {
+		stmts = append(stmts, rest)
+	}
+	texts := make([]string, 0, len(stmts))
+	for _, tokens := range stmts {
+		texts = append(texts, normalizeTokens(tokens))
+	}
+	return strings.Join(texts, "; ")
+}
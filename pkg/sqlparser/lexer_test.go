@@ -0,0 +1,78 @@
+package sqlparser
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitStatements(t *testing.T) {
+	tests := []struct {
+		sql     string
+		dialect Dialect
+		stmts   []string
+		rest    string
+	}{
+		{"select 1; select 2;", DialectMySQL, []string{"select 1", "select 2"}, ""},
+		{"select ';' from t;\nselect", DialectMySQL, []string{"select ';' from t"}, "select"},
+		{`select 'a\';b';`, DialectMySQL, []string{`select 'a\';b'`}, ""},
+		{`select 'a\';b';`, DialectPostgreSQL, []string{`select 'a\'`}, "b';"},
+		{"select $$a;b$$, $f$;$f$;", DialectPostgreSQL, []string{"select $$a;b$$, $f$;$f$"}, ""},
+		{"select * from t\\G", DialectMySQL, []string{"select * from t"}, ""},
+		{"select [a;b] from t\ngo\n", DialectSQLServer, []string{"select [a;b] from t"}, ""},
+		{"select 1 -- ;\n", DialectPostgreSQL, nil, "select 1 -- ;\n"},
+		{"select /* ; /* ; */ ; */ 1;", DialectPostgreSQL, []string{"select /* ; /* ; */ ; */ 1"}, ""},
+		{";;", DialectMySQL, nil, ""},
+	}
+	for _, tt := range tests {
+		stmts, rest := SplitStatements(tt.sql, tt.dialect)
+		if !reflect.DeepEqual(stmts, tt.stmts) || rest != tt.rest {
+			t.Errorf("SplitStatements(%q, %s) = %q, %q, want %q, %q", tt.sql, tt.dialect, stmts, rest, tt.stmts, tt.rest)
+		}
+	}
+}
+
+func TestSplitStatementsByDelimiter(t *testing.T) {
+	tests := []struct {
+		sql       string
+		delimiter string
+		stmts     []string
+		rest      string
+	}{
+		{"select 1; select 2;", ";", []string{"select 1", "select 2"}, ""},
+		{"delete from users//\n", "//", []string{"delete from users"}, ""},
+		{"create procedure p() begin delete from t; select 1; end//select", "//",
+			[]string{"create procedure p() begin delete from t; select 1; end"}, "select"},
+		{"select '//' from t//", "//", []string{"select '//' from t"}, ""},
+		{"select 1 / 2 /3$$", "$$", []string{"select 1 / 2 /3"}, ""},
+		{"select 1;\n", "//", nil, "select 1;\n"},
+		{"drop table t;; select 1", ";;", []string{"drop table t"}, "select 1"},
+	}
+	for _, tt := range tests {
+		stmts, rest := SplitStatementsByDelimiter(tt.sql, DialectMySQL, tt.delimiter)
+		if !reflect.DeepEqual(stmts, tt.stmts) || rest != tt.rest {
+			t.Errorf("SplitStatementsByDelimiter(%q, %q) = %q, %q, want %q, %q",
+				tt.sql, tt.delimiter, stmts, rest, tt.stmts, tt.rest)
+		}
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	tests := []struct {
+		sql     string
+		dialect Dialect
+		want    string
+	}{
+		{"DROP/**/TABLE\n\t`Users`", DialectMySQL, "drop table `Users`"},
+		{"dRoP -- comment\n  table t", DialectPostgreSQL, "drop table t"},
+		{"/*!50000 DROP */ TABLE t", DialectMySQL, "drop table t"},
+		{"select 'A  B' # comment", DialectMySQL, "select 'A  B'"},
+		{"select 1--1", DialectMySQL, "select 1--1"},
+		{"select 1; SELECT 2", DialectMySQL, "select 1; select 2"},
+		{"DELETE FROM [Order Details]", DialectSQLServer, "delete from [Order Details]"},
+	}
+	for _, tt := range tests {
+		if got := Normalize(tt.sql, tt.dialect); got != tt.want {
+			t.Errorf("Normalize(%q, %s) = %q, want %q", tt.sql, tt.dialect, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package sqlparser
+
+import (
+	"sync"
+
+	"github.com/meowgen/koko/pkg/jms-sdk-go/model"
+	"github.com/meowgen/koko/pkg/logger"
+)
+
+// Matcher 使用语句分类匹配数据库会话的命令过滤规则:
+// SQL 类型的规则按语句类型, WHERE 条件和操作的对象匹配;
+// 正则和命令类型的规则除了原始的输入, 还匹配去掉注释, 合并空白, 关键字转为小写之后的每条语句,
+// 避免通过注释, 大小写和空白绕过规则
+type Matcher struct {
+	mu         sync.Mutex
+	classifier *Classifier
+	// rules 缓存解析过的 SQL 规则, 以规则内容为键
+	rules map[string]parsedRules
+}
+
+type parsedRules struct {
+	rules []Rule
+	err   error
+}
+
+// NewMatcher 创建匹配器, database 是会话连接的数据库
+func NewMatcher(dialect Dialect, database string) *Matcher {
+	return &Matcher{
+		classifier: NewClassifier(dialect, database),
+		rules:      make(map[string]parsedRules),
+	}
+}
+
+func (m *Matcher) Dialect() Dialect {
+	return m.classifier.Dialect()
+}
+
+// Classify 识别 SQL 中的语句, 与 Match 共用 USE 语句切换的默认 schema
+func (m *Matcher) Classify(sql string) []*Statement {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.classifier.Classify(sql)
+}
+
+// Match 返回第一个命中的规则和命中的语句, rules 需要已经按优先级排序
+func (m *Matcher) Match(rules []model.FilterRule, sql string) (model.FilterRule, string, bool) {
+	return m.MatchStatements(rules, sql, m.Classify(sql))
+}
+
+// MatchStatements 使用已经识别的语句匹配规则, stmts 是 sql 的识别结果
+func (m *Matcher) MatchStatements(rules []model.FilterRule, sql string, stmts []*Statement) (model.FilterRule, string, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := range rules {
+		rule := &rules[i]
+		var action model.RuleAction
+		var matched string
+		if rule.Type == model.TypeSQL {
+			action, matched = m.matchSQLRule(rule, stmts)
+		} else {
+			action, matched = matchTextRule(rule, sql, stmts)
+		}
+		switch action {
+		case model.ActionAllow, model.ActionConfirm, model.ActionDeny:
+			return *rule, matched, true
+		}
+	}
+	return model.FilterRule{}, "", false
+}
+
+// MatchText 只使用正则和命令类型的规则匹配输入, 用于还没有输入完的语句
+func (m *Matcher) MatchText(rules []model.FilterRule, text string) (model.FilterRule, string, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var stmts []*Statement
+	if tokens := tokenize(text, m.classifier.dialect); len(tokens) > 0 {
+		stmts = append(stmts, &Statement{Text: normalizeTokens(tokens)})
+	}
+	for i := range rules {
+		rule := &rules[i]
+		if rule.Type == model.TypeSQL {
+			continue
+		}
+		switch action, matched := matchTextRule(rule, text, stmts); action {
+		case model.ActionAllow, model.ActionConfirm, model.ActionDeny:
+			return *rule, matched, true
+		}
+	}
+	return model.FilterRule{}, "", false
+}
+
+// matchSQLRule 匹配 SQL 类型的规则; 规则无法解析时拒绝和复核的规则命中所有语句, 允许的规则不生效
+func (m *Matcher) matchSQLRule(rule *model.FilterRule, stmts []*Statement) (model.RuleAction, string) {
+	parsed, ok := m.rules[rule.Content]
+	if !ok {
+		parsed.rules, parsed.err = ParseRules(rule.Content)
+		if parsed.err != nil {
+			logger.Errorf("Command filter rule %s is invalid: %s", rule.ID, parsed.err)
+		}
+		m.rules[rule.Content] = parsed
+	}
+	if parsed.err != nil {
+		switch rule.Action {
+		case model.ActionDeny, model.ActionConfirm:
+			if len(stmts) > 0 {
+				return rule.Action, stmts[0].Text
+			}
+		}
+		return model.ActionUnknown, ""
+	}
+	for _, stmt := range stmts {
+		for i := range parsed.rules {
+			if parsed.rules[i].Match(stmt) {
+				return rule.Action, stmt.Text
+			}
+		}
+	}
+	return model.ActionUnknown, ""
+}
+
+func matchTextRule(rule *model.FilterRule, sql string, stmts []*Statement) (model.RuleAction, string) {
+	if action, matched := rule.Match(sql); action != model.ActionUnknown {
+		return action, matched
+	}
+	for _, stmt := range stmts {
+		if action, matched := rule.Match(stmt.Text); action != model.ActionUnknown {
+			return action, matched
+		}
+	}
+	return model.ActionUnknown, ""
+}
@@ -0,0 +1,81 @@
+package sqlparser
+
+import "strings"
+
+// MongoDB 命令对应的语句类型和对象类型, 使删除集合和数据库的规则与 SQL 通用
+var mongoStatementTypes = map[string][2]string{
+	"find":             {"FIND", ""},
+	"insert":           {"INSERT", ""},
+	"update":           {"UPDATE", ""},
+	"delete":           {"DELETE", ""},
+	"findandmodify":    {"UPDATE", ""},
+	"create":           {"CREATE", "COLLECTION"},
+	"drop":             {"DROP", "COLLECTION"},
+	"dropdatabase":     {"DROP", "DATABASE"},
+	"createindexes":    {"CREATE", "INDEX"},
+	"dropindexes":      {"DROP", "INDEX"},
+	"renamecollection": {"RENAME", "COLLECTION"},
+	"collmod":          {"ALTER", "COLLECTION"},
+	"createuser":       {"CREATE", "USER"},
+	"updateuser":       {"ALTER", "USER"},
+	"dropuser":         {"DROP", "USER"},
+	"createrole":       {"CREATE", "ROLE"},
+	"updaterole":       {"ALTER", "ROLE"},
+	"droprole":         {"DROP", "ROLE"},
+}
+
+// 没有对应 SQL 语句的 MongoDB 命令的分类, 没有列出的命令属于 OTHER
+var mongoCategories = map[string]string{
+	"find":            CategoryDQL,
+	"aggregate":       CategoryDQL,
+	"count":           CategoryDQL,
+	"distinct":        CategoryDQL,
+	"listcollections": CategoryDQL,
+	"listdatabases":   CategoryDQL,
+	"listindexes":     CategoryDQL,
+	"dbstats":         CategoryDQL,
+	"collstats":       CategoryDQL,
+
+	"grantrolestouser":         CategoryDCL,
+	"revokerolesfromuser":      CategoryDCL,
+	"grantrolestorole":         CategoryDCL,
+	"revokerolesfromrole":      CategoryDCL,
+	"grantprivilegestorole":    CategoryDCL,
+	"revokeprivilegesfromrole": CategoryDCL,
+
+	"committransaction": CategoryTCL,
+	"aborttransaction":  CategoryTCL,
+}
+
+// MongoStatement 识别 MongoDB 命令, name 是命令名, 如 find, dropDatabase;
+// 操作的对象是 database.collection, 没有集合时为 database.
+// hasFilter 表示 update 和 delete 的每个操作都指定了非空的查询条件
+func MongoStatement(name, database, collection string, hasFilter bool) *Statement {
+	lower := strings.ToLower(name)
+	stmt := &Statement{Type: strings.ToUpper(name), Category: CategoryOther}
+	if typ, ok := mongoStatementTypes[lower]; ok {
+		stmt.Type, stmt.Object = typ[0], typ[1]
+	}
+	if category, ok := statementCategories[stmt.Type]; ok {
+		stmt.Category = category
+	} else if category, ok := mongoCategories[lower]; ok {
+		stmt.Category = category
+	}
+	if accountObjects[stmt.Object] {
+		stmt.Category = CategoryDCL
+	}
+	stmt.HasWhere = hasFilter
+	switch {
+	case stmt.Object == "DATABASE":
+		stmt.Targets = []string{database}
+	case accountObjects[stmt.Object] || stmt.Category == CategoryDCL || lower == "listdatabases":
+		// 账号, 权限和列出数据库的命令不操作集合
+	case collection != "" && database != "":
+		stmt.Targets = []string{database + "." + collection}
+	case collection != "":
+		stmt.Targets = []string{collection}
+	case database != "":
+		stmt.Targets = []string{database}
+	}
+	return stmt
+}
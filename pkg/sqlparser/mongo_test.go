@@ -0,0 +1,35 @@
+package sqlparser
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMongoStatement(t *testing.T) {
+	tests := []struct {
+		name       string
+		collection string
+		hasFilter  bool
+		typ        string
+		object     string
+		category   string
+		targets    []string
+	}{
+		{"find", "users", true, "FIND", "", CategoryDQL, []string{"app.users"}},
+		{"delete", "users", false, "DELETE", "", CategoryDML, []string{"app.users"}},
+		{"drop", "users", false, "DROP", "COLLECTION", CategoryDDL, []string{"app.users"}},
+		{"dropDatabase", "", false, "DROP", "DATABASE", CategoryDDL, []string{"app"}},
+		{"createUser", "bob", false, "CREATE", "USER", CategoryDCL, nil},
+		{"aggregate", "users", false, "AGGREGATE", "", CategoryDQL, []string{"app.users"}},
+		{"listDatabases", "", false, "LISTDATABASES", "", CategoryDQL, nil},
+		{"serverStatus", "", false, "SERVERSTATUS", "", CategoryOther, []string{"app"}},
+	}
+	for _, tt := range tests {
+		stmt := MongoStatement(tt.name, "app", tt.collection, tt.hasFilter)
+		if stmt.Type != tt.typ || stmt.Object != tt.object || stmt.Category != tt.category ||
+			!reflect.DeepEqual(stmt.Targets, tt.targets) || stmt.HasWhere != tt.hasFilter {
+			t.Errorf("MongoStatement(%q, %q) = %s %s %s %q", tt.name, tt.collection,
+				stmt.Type, stmt.Object, stmt.Category, stmt.Targets)
+		}
+	}
+}
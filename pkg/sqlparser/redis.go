@@ -0,0 +1,125 @@
+package sqlparser
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Redis 命令的分类, 没有列出的命令属于 OTHER
+var redisCategories = map[string]string{
+	"FLUSHALL": CategoryDDL, "FLUSHDB": CategoryDDL, "SWAPDB": CategoryDDL,
+
+	"ACL": CategoryDCL,
+
+	"MULTI": CategoryTCL, "EXEC": CategoryTCL, "DISCARD": CategoryTCL,
+	"WATCH": CategoryTCL, "UNWATCH": CategoryTCL,
+}
+
+func init() {
+	for _, name := range strings.Fields(`GET MGET EXISTS TYPE TTL PTTL KEYS SCAN RANDOMKEY DBSIZE DUMP
+		OBJECT STRLEN GETRANGE SUBSTR BITCOUNT BITPOS GETBIT HGET HMGET HGETALL HKEYS HVALS HLEN HEXISTS
+		HSTRLEN HSCAN HRANDFIELD LRANGE LLEN LINDEX LPOS SMEMBERS SISMEMBER SMISMEMBER SCARD SSCAN
+		SRANDMEMBER SUNION SINTER SDIFF ZRANGE ZRANGEBYSCORE ZRANGEBYLEX ZREVRANGE ZREVRANGEBYSCORE
+		ZREVRANGEBYLEX ZSCORE ZMSCORE ZCARD ZRANK ZREVRANK ZCOUNT ZLEXCOUNT ZSCAN ZRANDMEMBER PFCOUNT
+		XRANGE XREVRANGE XLEN XREAD XINFO XPENDING GEOPOS GEODIST GEOHASH GEORADIUS_RO
+		GEORADIUSBYMEMBER_RO GEOSEARCH`) {
+		redisCategories[name] = CategoryDQL
+	}
+	for _, name := range strings.Fields(`SET SETNX SETEX PSETEX MSET MSETNX APPEND INCR INCRBY INCRBYFLOAT
+		DECR DECRBY GETSET GETDEL GETEX SETRANGE SETBIT BITOP BITFIELD DEL UNLINK EXPIRE PEXPIRE EXPIREAT
+		PEXPIREAT PERSIST RENAME RENAMENX MOVE COPY RESTORE TOUCH HSET HSETNX HMSET HDEL HINCRBY
+		HINCRBYFLOAT LPUSH RPUSH LPUSHX RPUSHX LPOP RPOP LSET LREM LTRIM LINSERT RPOPLPUSH LMOVE BLPOP
+		BRPOP BRPOPLPUSH BLMOVE SADD SREM SPOP SMOVE SUNIONSTORE SINTERSTORE SDIFFSTORE ZADD ZREM ZINCRBY
+		ZREMRANGEBYSCORE ZREMRANGEBYRANK ZREMRANGEBYLEX ZPOPMIN ZPOPMAX BZPOPMIN BZPOPMAX ZUNIONSTORE
+		ZINTERSTORE ZDIFFSTORE ZRANGESTORE PFADD PFMERGE XADD XDEL XTRIM XGROUP XACK XCLAIM GEOADD
+		GEOSEARCHSTORE`) {
+		redisCategories[name] = CategoryDML
+	}
+}
+
+// 带子命令的 Redis 命令, 子命令作为语句的对象类型, 如 CONFIG SET
+var redisContainerCommands = map[string]bool{
+	"ACL": true, "CONFIG": true, "CLIENT": true, "SCRIPT": true, "FUNCTION": true,
+	"CLUSTER": true, "MODULE": true, "MEMORY": true, "OBJECT": true, "XINFO": true, "XGROUP": true,
+}
+
+// Redis 中所有参数都是键的命令
+var redisAllKeysCommands = map[string]bool{
+	"MGET": true, "DEL": true, "UNLINK": true, "EXISTS": true, "TOUCH": true, "WATCH": true,
+	"SUNION": true, "SINTER": true, "SDIFF": true, "SUNIONSTORE": true, "SINTERSTORE": true,
+	"SDIFFSTORE": true, "PFCOUNT": true, "PFMERGE": true,
+}
+
+// RedisStatement 识别 Redis 命令, 语句类型是大写的命令名, 操作的对象是命令中的键
+func RedisStatement(args []string) *Statement {
+	if len(args) == 0 {
+		return nil
+	}
+	name := strings.ToUpper(args[0])
+	category, ok := redisCategories[name]
+	if !ok {
+		category = CategoryOther
+	}
+	stmt := &Statement{
+		Text:     strings.Join(args, " "),
+		Type:     name,
+		Category: category,
+		// Redis 命令总是操作指定的键, 只有清空数据库的命令视为没有 WHERE 条件
+		HasWhere: name != "FLUSHALL" && name != "FLUSHDB",
+	}
+	if redisContainerCommands[name] && len(args) > 1 {
+		stmt.Object = strings.ToUpper(args[1])
+	}
+	stmt.Targets = redisKeys(name, args)
+	return stmt
+}
+
+func redisKeys(name string, args []string) []string {
+	switch {
+	case redisAllKeysCommands[name]:
+		return args[1:]
+	case name == "MSET" || name == "MSETNX":
+		var keys []string
+		for i := 1; i < len(args); i += 2 {
+			keys = append(keys, args[i])
+		}
+		return keys
+	case name == "RENAME" || name == "RENAMENX" || name == "SMOVE" || name == "RPOPLPUSH" ||
+		name == "LMOVE" || name == "BRPOPLPUSH" || name == "BLMOVE" || name == "COPY":
+		if len(args) > 2 {
+			return args[1:3]
+		}
+	case name == "BLPOP" || name == "BRPOP" || name == "BZPOPMIN" || name == "BZPOPMAX":
+		// 最后一个参数是超时时间
+		if len(args) > 2 {
+			return args[1 : len(args)-1]
+		}
+	case name == "BITOP":
+		if len(args) > 2 {
+			return args[2:]
+		}
+	case name == "ZUNIONSTORE" || name == "ZINTERSTORE" || name == "ZDIFFSTORE":
+		// dest numkeys key [key ...]
+		if len(args) > 3 {
+			keys := []string{args[1]}
+			n, _ := strconv.Atoi(args[2])
+			if n > 0 && 3+n <= len(args) {
+				keys = append(keys, args[3:3+n]...)
+			}
+			return keys
+		}
+	case name == "OBJECT" || name == "MEMORY" || name == "XINFO" || name == "XGROUP":
+		if len(args) > 2 {
+			return args[2:3]
+		}
+	case name == "ACL" || name == "XREAD" || name == "KEYS" || name == "SCAN" || name == "RANDOMKEY" || name == "DBSIZE" || name == "MULTI" ||
+		name == "EXEC" || name == "DISCARD" || name == "UNWATCH" || name == "FLUSHALL" || name == "FLUSHDB" ||
+		name == "SWAPDB":
+		return nil
+	case redisCategories[name] != "":
+		if len(args) > 1 {
+			return args[1:2]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,43 @@
+package sqlparser
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRedisStatement(t *testing.T) {
+	tests := []struct {
+		command  string
+		typ      string
+		object   string
+		category string
+		targets  []string
+		hasWhere bool
+	}{
+		{"get User:1", "GET", "", CategoryDQL, []string{"User:1"}, true},
+		{"del a b c", "DEL", "", CategoryDML, []string{"a", "b", "c"}, true},
+		{"mset a 1 b 2", "MSET", "", CategoryDML, []string{"a", "b"}, true},
+		{"blpop q1 q2 0", "BLPOP", "", CategoryDML, []string{"q1", "q2"}, true},
+		{"zunionstore out 2 a b weights 1 2", "ZUNIONSTORE", "", CategoryDML, []string{"out", "a", "b"}, true},
+		{"config set maxmemory 1gb", "CONFIG", "SET", CategoryOther, nil, true},
+		{"acl setuser bob on", "ACL", "SETUSER", CategoryDCL, nil, true},
+		{"flushall async", "FLUSHALL", "", CategoryDDL, nil, false},
+		{"multi", "MULTI", "", CategoryTCL, nil, true},
+	}
+	for _, tt := range tests {
+		stmt := RedisStatement(strings.Fields(tt.command))
+		if stmt.Type != tt.typ || stmt.Object != tt.object || stmt.Category != tt.category ||
+			!reflect.DeepEqual(stmt.Targets, tt.targets) || stmt.HasWhere != tt.hasWhere {
+			t.Errorf("RedisStatement(%q) = %s %s %s %q where=%v", tt.command,
+				stmt.Type, stmt.Object, stmt.Category, stmt.Targets, stmt.HasWhere)
+		}
+	}
+	if RedisStatement(nil) != nil {
+		t.Error("RedisStatement(nil) should be nil")
+	}
+	rule, _ := ParseRule("DEL ON user:*")
+	if !rule.Match(RedisStatement([]string{"DEL", "User:1"})) {
+		t.Error("rule should match keys case-insensitively")
+	}
+}
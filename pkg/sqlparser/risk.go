@@ -0,0 +1,118 @@
+package sqlparser
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/meowgen/koko/pkg/config"
+	"github.com/meowgen/koko/pkg/jms-sdk-go/model"
+	"github.com/meowgen/koko/pkg/logger"
+)
+
+// 命令记录中最多保存的对象数量
+const maxCommandObjects = 32
+
+// RiskRule 是风险分值规则, 格式为 "<分值> <规则>", 规则的语法同 Rule, 例如:
+//
+//	90 DROP DATABASE, DROP SCHEMA
+//	80 DELETE, UPDATE WITHOUT WHERE
+type RiskRule struct {
+	Score int64
+	Rule  Rule
+}
+
+// ParseRiskRules 解析风险分值规则, 规则以换行或分号分隔, 忽略空行和以 # 开头的注释
+func ParseRiskRules(content string) ([]RiskRule, error) {
+	var rules []RiskRule
+	lines := strings.FieldsFunc(content, func(r rune) bool {
+		return r == '\n' || r == ';'
+	})
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.SplitN(line, " ", 2)
+		score, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil || score < 0 || len(fields) < 2 {
+			return nil, fmt.Errorf("risk rule %q: expect <score> <rule>", line)
+		}
+		rule, err := ParseRule(fields[1])
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, RiskRule{Score: score, Rule: rule})
+	}
+	return rules, nil
+}
+
+// RiskScore 返回语句命中的规则中最高的分值, 没有命中时为 0
+func RiskScore(rules []RiskRule, stmts []*Statement) int64 {
+	var score int64
+	for _, stmt := range stmts {
+		if stmt == nil {
+			continue
+		}
+		for i := range rules {
+			if rules[i].Score > score && rules[i].Rule.Match(stmt) {
+				score = rules[i].Score
+			}
+		}
+	}
+	return score
+}
+
+var (
+	riskRulesOnce sync.Once
+	riskRules     []RiskRule
+)
+
+// configRiskRules 返回配置文件中的风险分值规则, 配置有误时不计算分值
+func configRiskRules() []RiskRule {
+	riskRulesOnce.Do(func() {
+		rules, err := ParseRiskRules(config.GetConf().CommandRiskRules)
+		if err != nil {
+			logger.Errorf("Config COMMAND_RISK_RULES is invalid: %s", err)
+			return
+		}
+		riskRules = rules
+	})
+	return riskRules
+}
+
+// TagCommand 在命令记录中加上语句的类型, 分类, 操作的对象和风险分值
+func TagCommand(cmd *model.Command, stmts []*Statement) {
+	tagCommand(cmd, stmts, configRiskRules())
+}
+
+func tagCommand(cmd *model.Command, stmts []*Statement, rules []RiskRule) {
+	for _, stmt := range stmts {
+		if stmt == nil || stmt.Type == "" {
+			continue
+		}
+		kind := stmt.Type
+		if stmt.Object != "" {
+			kind += " " + stmt.Object
+		}
+		cmd.StatementTypes = appendUnique(cmd.StatementTypes, kind)
+		cmd.Categories = appendUnique(cmd.Categories, stmt.Category)
+		for _, target := range stmt.Targets {
+			if len(cmd.Objects) >= maxCommandObjects {
+				break
+			}
+			cmd.Objects = appendUnique(cmd.Objects, target)
+		}
+	}
+	cmd.RiskScore = RiskScore(rules, stmts)
+}
+
+func appendUnique(items []string, item string) []string {
+	for _, v := range items {
+		if v == item {
+			return items
+		}
+	}
+	return append(items, item)
+}
@@ -0,0 +1,52 @@
+package sqlparser
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/meowgen/koko/pkg/jms-sdk-go/model"
+)
+
+func TestParseRiskRules(t *testing.T) {
+	rules, err := ParseRiskRules("# comment\n90 DROP DATABASE\n80 DELETE, UPDATE WITHOUT WHERE; 20 DML\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != 3 || rules[0].Score != 90 || rules[2].Score != 20 {
+		t.Errorf("unexpected rules %+v", rules)
+	}
+	for _, content := range []string{"DROP", "x DROP", "-1 DROP", "10 ON x"} {
+		if _, err := ParseRiskRules(content); err == nil {
+			t.Errorf("ParseRiskRules(%q) should fail", content)
+		}
+	}
+}
+
+func TestTagCommand(t *testing.T) {
+	rules, err := ParseRiskRules("90 DROP ON prod\n80 DELETE WITHOUT WHERE\n20 DML")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		sql        string
+		types      []string
+		categories []string
+		objects    []string
+		score      int64
+	}{
+		{"select * from t", []string{"SELECT"}, []string{CategoryDQL}, []string{"prod.t"}, 0},
+		{"delete from t where id = 1; delete from s", []string{"DELETE"}, []string{CategoryDML},
+			[]string{"prod.t", "prod.s"}, 80},
+		{"insert into t values (1); drop table x", []string{"INSERT", "DROP TABLE"},
+			[]string{CategoryDML, CategoryDDL}, []string{"prod.t", "prod.x"}, 90},
+	}
+	for _, tt := range tests {
+		cmd := &model.Command{}
+		tagCommand(cmd, NewClassifier(DialectMySQL, "prod").Classify(tt.sql), rules)
+		if !reflect.DeepEqual(cmd.StatementTypes, tt.types) || !reflect.DeepEqual(cmd.Categories, tt.categories) ||
+			!reflect.DeepEqual(cmd.Objects, tt.objects) || cmd.RiskScore != tt.score {
+			t.Errorf("tag %q = %q %q %q %d, want %q %q %q %d", tt.sql, cmd.StatementTypes, cmd.Categories,
+				cmd.Objects, cmd.RiskScore, tt.types, tt.categories, tt.objects, tt.score)
+		}
+	}
+}
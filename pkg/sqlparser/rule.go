@@ -0,0 +1,170 @@
+package sqlparser
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// Rule 是 SQL 类型的命令过滤规则, 每行一条, 格式为:
+//
+//	<语句类型>[, <语句类型>...] [WITHOUT WHERE] [ON <对象>[, <对象>...]]
+//
+// 语句类型可以是 DELETE, DROP 等语句, DDL, DML 等分类, 或者 * 表示所有语句,
+// 之后可以跟对象类型, 如 DROP DATABASE. 对象是以点分隔的名称, 可以使用通配符 *,
+// 名称匹配对象本身和其中的所有对象, 如 ON sales 匹配 sales 数据库和 sales.orders 表. 例如:
+//
+//	DELETE, UPDATE WITHOUT WHERE
+//	DROP, TRUNCATE ON prod
+//	DCL
+type Rule struct {
+	Types        []TypePattern
+	WithoutWhere bool
+	Targets      []string
+}
+
+// TypePattern 匹配语句的类型或分类, Object 不为空时还需要匹配对象类型
+type TypePattern struct {
+	Type   string
+	Object string
+}
+
+var categories = map[string]bool{
+	CategoryDDL:   true,
+	CategoryDML:   true,
+	CategoryDQL:   true,
+	CategoryDCL:   true,
+	CategoryTCL:   true,
+	CategoryOther: true,
+}
+
+// ParseRules 解析多行的 SQL 过滤规则, 忽略空行和以 # 开头的注释
+func ParseRules(content string) ([]Rule, error) {
+	var rules []Rule
+	for _, line := range strings.Split(content, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		rule, err := ParseRule(line)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// ParseRule 解析一条 SQL 过滤规则
+func ParseRule(line string) (Rule, error) {
+	var rule Rule
+	fields := strings.Fields(strings.ReplaceAll(line, ",", " , "))
+	i := 0
+	// 语句类型
+	for i < len(fields) {
+		word := strings.ToUpper(fields[i])
+		if word == "WITHOUT" || word == "ON" {
+			break
+		}
+		i++
+		if word == "," {
+			continue
+		}
+		if alias, ok := statementAliases[word]; ok {
+			word = alias
+		}
+		pattern := TypePattern{Type: word}
+		if i < len(fields) && fields[i] != "," && !isRuleKeyword(fields[i]) {
+			pattern.Object = strings.ToUpper(fields[i])
+			if alias, ok := objectAliases[pattern.Object]; ok {
+				pattern.Object = alias
+			}
+			i++
+		}
+		rule.Types = append(rule.Types, pattern)
+	}
+	if len(rule.Types) == 0 {
+		return rule, fmt.Errorf("sql rule %q: missing statement type", line)
+	}
+	if i < len(fields) && strings.EqualFold(fields[i], "WITHOUT") {
+		if i+1 >= len(fields) || !strings.EqualFold(fields[i+1], "WHERE") {
+			return rule, fmt.Errorf("sql rule %q: expect WITHOUT WHERE", line)
+		}
+		rule.WithoutWhere = true
+		i += 2
+	}
+	if i < len(fields) && strings.EqualFold(fields[i], "ON") {
+		for _, field := range fields[i+1:] {
+			if field == "," {
+				continue
+			}
+			name := strings.ToLower(strings.Trim(field, "`\"[]"))
+			if _, err := path.Match(name, ""); err != nil {
+				return rule, fmt.Errorf("sql rule %q: invalid object %q", line, field)
+			}
+			rule.Targets = append(rule.Targets, name)
+		}
+		if len(rule.Targets) == 0 {
+			return rule, fmt.Errorf("sql rule %q: missing object after ON", line)
+		}
+		i = len(fields)
+	}
+	if i < len(fields) {
+		return rule, fmt.Errorf("sql rule %q: unexpected %q", line, fields[i])
+	}
+	return rule, nil
+}
+
+func isRuleKeyword(field string) bool {
+	return strings.EqualFold(field, "WITHOUT") || strings.EqualFold(field, "ON")
+}
+
+// Match 判断语句是否命中规则
+func (r *Rule) Match(stmt *Statement) bool {
+	if !r.matchType(stmt) {
+		return false
+	}
+	if r.WithoutWhere && stmt.HasWhere {
+		return false
+	}
+	if len(r.Targets) == 0 {
+		return true
+	}
+	for _, target := range stmt.Targets {
+		// Redis 的键区分大小写, 匹配时统一转为小写
+		target = strings.ToLower(target)
+		for _, pattern := range r.Targets {
+			if matchObjectName(pattern, target) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (r *Rule) matchType(stmt *Statement) bool {
+	for _, pattern := range r.Types {
+		typeMatched := pattern.Type == "*" || pattern.Type == stmt.Type ||
+			categories[pattern.Type] && pattern.Type == stmt.Category
+		if typeMatched && (pattern.Object == "" || pattern.Object == stmt.Object) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchObjectName 判断名称是否匹配规则中的对象, 规则中的对象匹配名称本身和以它开头的名称,
+// 如 sales 匹配 sales 和 sales.orders, *.orders 匹配所有 schema 中的 orders 表
+func matchObjectName(pattern, name string) bool {
+	patternParts := strings.Split(pattern, ".")
+	nameParts := strings.Split(name, ".")
+	if len(patternParts) > len(nameParts) {
+		return false
+	}
+	for i, part := range patternParts {
+		if ok, _ := path.Match(part, nameParts[i]); !ok {
+			return false
+		}
+	}
+	return true
+}
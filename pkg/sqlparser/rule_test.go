@@ -0,0 +1,112 @@
+package sqlparser
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/meowgen/koko/pkg/jms-sdk-go/model"
+)
+
+func TestParseRule(t *testing.T) {
+	tests := []struct {
+		line string
+		rule Rule
+		err  bool
+	}{
+		{"DELETE, UPDATE WITHOUT WHERE", Rule{
+			Types:        []TypePattern{{Type: "DELETE"}, {Type: "UPDATE"}},
+			WithoutWhere: true,
+		}, false},
+		{"drop database, drop schema on Prod,`stage`", Rule{
+			Types:   []TypePattern{{Type: "DROP", Object: "DATABASE"}, {Type: "DROP", Object: "SCHEMA"}},
+			Targets: []string{"prod", "stage"},
+		}, false},
+		{"ddl on *.users", Rule{Types: []TypePattern{{Type: "DDL"}}, Targets: []string{"*.users"}}, false},
+		{"on x", Rule{}, true},
+		{"delete without", Rule{}, true},
+		{"drop on", Rule{}, true},
+		{"drop on x y z", Rule{}, false},
+		{"drop on a[b", Rule{}, true},
+	}
+	for _, tt := range tests {
+		rule, err := ParseRule(tt.line)
+		if (err != nil) != tt.err {
+			t.Errorf("ParseRule(%q) err = %v, want err %v", tt.line, err, tt.err)
+			continue
+		}
+		if err == nil && len(tt.rule.Types) > 0 && !reflect.DeepEqual(rule, tt.rule) {
+			t.Errorf("ParseRule(%q) = %+v, want %+v", tt.line, rule, tt.rule)
+		}
+	}
+}
+
+func TestRuleMatch(t *testing.T) {
+	tests := []struct {
+		rule  string
+		sql   string
+		match bool
+	}{
+		{"DELETE, UPDATE WITHOUT WHERE", "delete from t", true},
+		{"DELETE, UPDATE WITHOUT WHERE", "DeLeTe/**/FROM t WHERE 1 = 1", true},
+		{"DELETE, UPDATE WITHOUT WHERE", "delete from t where id = 1", false},
+		{"DELETE, UPDATE WITHOUT WHERE", "update t set a = (select 1 from s where x)", true},
+		{"DELETE, UPDATE WITHOUT WHERE", "select * from t", false},
+		{"DROP ON prod", "drop database prod", true},
+		{"DROP ON prod", "drop table prod.users", true},
+		{"DROP ON prod", "drop table users", true},
+		{"DROP ON prod", "drop table stage.users", false},
+		{"DROP ON prod", "truncate table prod.users", false},
+		{"DROP TABLE ON *.users", "drop table users", true},
+		{"DROP TABLE ON *.users", "drop view users", false},
+		{"DDL", "/*!50000 ALTER */ TABLE t ADD c int", true},
+		{"DCL", "grant all on *.* to bob", true},
+		{"*", "select 1", true},
+	}
+	for _, tt := range tests {
+		rule, err := ParseRule(tt.rule)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stmts := NewClassifier(DialectMySQL, "prod").Classify(tt.sql)
+		if got := rule.Match(stmts[0]); got != tt.match {
+			t.Errorf("rule %q match %q = %v, want %v", tt.rule, tt.sql, got, tt.match)
+		}
+	}
+}
+
+func TestMatcher(t *testing.T) {
+	rules := model.FilterRules{
+		{ID: "allow", Type: model.TypeRegex, RePattern: `^select`, Action: model.ActionAllow, Priority: 1},
+		{ID: "sql", Type: model.TypeSQL, Content: "DELETE WITHOUT WHERE\nDROP ON prod", Action: model.ActionDeny, Priority: 2},
+		{ID: "regex", Type: model.TypeCmd, RePattern: `\btruncate table\b`, Action: model.ActionConfirm, Priority: 3},
+		{ID: "invalid-allow", Type: model.TypeSQL, Content: "ON x", Action: model.ActionAllow, Priority: 4},
+		{ID: "invalid", Type: model.TypeSQL, Content: "ON x", Action: model.ActionDeny, Priority: 5},
+	}
+	tests := []struct {
+		sql     string
+		ruleID  string
+		matched string
+	}{
+		{"select * from t", "allow", "select"},
+		{"update t set a = 1; DELETE -- x\nFROM t", "sql", "delete from t"},
+		{"use prod; drop table t", "sql", "drop table t"},
+		{"TRUNCATE /* x */ TABLE t", "regex", "truncate table"},
+		// 无法解析的拒绝规则命中所有语句, 允许规则不生效
+		{"delete from t where id = 1", "invalid", "delete from t where id = 1"},
+		{"", "", ""},
+	}
+	for _, tt := range tests {
+		matcher := NewMatcher(DialectMySQL, "app")
+		rule, matched, ok := matcher.Match(rules, tt.sql)
+		if ok != (tt.ruleID != "") || rule.ID != tt.ruleID || matched != tt.matched {
+			t.Errorf("Match(%q) = %s %q %v, want %s %q", tt.sql, rule.ID, matched, ok, tt.ruleID, tt.matched)
+		}
+	}
+	matcher := NewMatcher(DialectMySQL, "app")
+	if _, _, ok := matcher.MatchText(rules, "delete from t"); ok {
+		t.Error("MatchText should skip sql rules")
+	}
+	if rule, _, ok := matcher.MatchText(rules, "truncate  table t"); !ok || rule.ID != "regex" {
+		t.Errorf("MatchText(truncate) = %s %v, want regex", rule.ID, ok)
+	}
+}
@@ -14,6 +14,7 @@ import (
 	"time"
 
 	"github.com/meowgen/koko/pkg/common"
+	"github.com/meowgen/koko/pkg/config"
 	"github.com/meowgen/koko/pkg/localcommand"
 	"github.com/meowgen/koko/pkg/logger"
 )
@@ -76,6 +77,17 @@ var supportedMap = map[string]supportedChecker{
 }
 
 func IsSupportedProtocol(p string) error {
+	// 使用内置 SQL 终端时不需要本地安装数据库客户端
+	conf := config.GetConf()
+	if conf.EnableBuiltinSQLShell && IsSQLShellProtocol(p) {
+		return nil
+	}
+	if conf.EnableBuiltinRedisConsole && p == ProtocolRedis {
+		return nil
+	}
+	if conf.EnableBuiltinMongoDBConsole && p == ProtocolMongoDB {
+		return nil
+	}
 	if checker, ok := supportedMap[p]; ok {
 		return checker()
 	}
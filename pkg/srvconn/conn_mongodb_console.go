@@ -0,0 +1,898 @@
+package srvconn
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/meowgen/koko/pkg/logger"
+	"github.com/meowgen/koko/pkg/sqlparser"
+	"github.com/meowgen/koko/pkg/utils"
+)
+
+const (
+	// mongoConsolePageSize 查询结果每页显示的文档数, 输入 it 显示下一页
+	mongoConsolePageSize = 20
+
+	mongoConsoleConnectTimeout = 15 * time.Second
+
+	mongoConsoleContinuePrompt = "... "
+)
+
+var (
+	_ ServerConnection    = (*MongoDBConsoleConn)(nil)
+	_ StatementConnection = (*MongoDBConsoleConn)(nil)
+)
+
+const mongoConsoleHelp = `List of commands:
+  show dbs, show databases        list databases
+  show collections, show tables   list collections of the current database
+  use <db>                        switch the current database
+  db                              print the current database
+  it                              show the next page of the last query
+  cls                             clear the screen
+  exit, quit                      quit the console
+
+Supported operations, arguments are written in (extended) JSON:
+  db.<coll>.find(filter, projection).sort(...).skip(n).limit(n)
+  db.<coll>.findOne(filter, projection)
+  db.<coll>.insertOne(doc)             db.<coll>.insertMany([docs])
+  db.<coll>.updateOne(filter, update, {upsert: true})
+  db.<coll>.updateMany(filter, update, {upsert: true})
+  db.<coll>.replaceOne(filter, doc, {upsert: true})
+  db.<coll>.deleteOne(filter)          db.<coll>.deleteMany(filter)
+  db.<coll>.aggregate([pipeline])      db.<coll>.distinct(field, filter)
+  db.<coll>.countDocuments(filter)     db.<coll>.estimatedDocumentCount()
+  db.<coll>.createIndex(keys)          db.<coll>.getIndexes()
+  db.<coll>.drop()
+  db.runCommand(cmd)                   db.adminCommand(cmd)
+  db.getCollectionNames()              db.dropDatabase()
+
+ObjectId(), ISODate(), NumberLong(), NumberInt() and NumberDecimal() can be used in arguments.
+`
+
+// NewMongoDBConsoleConnection 使用 mongo-driver 直接连接 MongoDB, 在进程内提供 mongosh 风格的终端, 不依赖 mongosh
+func NewMongoDBConsoleConnection(ops ...SqlOption) (*MongoDBConsoleConn, error) {
+	args := &sqlOption{
+		Host:   "127.0.0.1",
+		Port:   27017,
+		DBName: "test",
+		win: Windows{
+			Width:  80,
+			Height: 120,
+		},
+	}
+	for _, setter := range ops {
+		setter(args)
+	}
+	if args.DBName == "" {
+		args.DBName = "test"
+	}
+	clientOptions, err := args.MongoDBClientOptions()
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	connectCtx, connectCancel := context.WithTimeout(ctx, mongoConsoleConnectTimeout)
+	defer connectCancel()
+	client, err := mongo.Connect(connectCtx, clientOptions)
+	if err == nil {
+		if err = client.Ping(connectCtx, nil); err != nil {
+			_ = client.Disconnect(context.Background())
+		}
+	}
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	outReader, outWriter := io.Pipe()
+	conn := &MongoDBConsoleConn{
+		options:    args,
+		client:     client,
+		db:         args.DBName,
+		ctx:        ctx,
+		cancel:     cancel,
+		input:      newConsoleInput(),
+		outReader:  outReader,
+		outWriter:  outWriter,
+		statements: make(chan *ExecutedStatement, 64),
+	}
+	conn.term = utils.NewTerminal(&consoleIO{in: conn.input, out: outWriter}, conn.prompt())
+	_ = conn.term.SetSize(args.win.Width, args.win.Height)
+	go conn.run()
+	return conn, nil
+}
+
+// MongoDBClientOptions 返回连接 MongoDB 的选项, 证书只在内存中使用
+func (opt *sqlOption) MongoDBClientOptions() (*options.ClientOptions, error) {
+	// authSource 与 checkMongoDBAccount 保持一致, 暂且只使用 admin
+	uri := BuildMongoDBURI(
+		MongoHost(net.JoinHostPort(opt.Host, strconv.Itoa(opt.Port))),
+		MongoAuth(opt.Username, opt.Password),
+		MongoDBName(opt.DBName),
+		MongoParams(map[string]string{"authSource": "admin"}),
+	)
+	clientOptions := options.Client().ApplyURI(uri).
+		SetConnectTimeout(mongoConsoleConnectTimeout).
+		SetServerSelectionTimeout(mongoConsoleConnectTimeout)
+	if opt.UseSSL {
+		tlsConfig := &tls.Config{InsecureSkipVerify: opt.AllowInvalidCert}
+		if opt.CaCert != "" {
+			rootCAs := x509.NewCertPool()
+			rootCAs.AppendCertsFromPEM([]byte(opt.CaCert))
+			tlsConfig.RootCAs = rootCAs
+		}
+		if opt.CertKey != "" {
+			// 与 tlsCertificateKeyFile 相同, 证书和私钥在同一个 PEM 中
+			cert, err := tls.X509KeyPair([]byte(opt.CertKey), []byte(opt.CertKey))
+			if err != nil {
+				return nil, err
+			}
+			tlsConfig.Certificates = []tls.Certificate{cert}
+		}
+		clientOptions.SetTLSConfig(tlsConfig)
+	}
+	return clientOptions, nil
+}
+
+// MongoDBConsoleConn 是内置的 MongoDB 终端, 支持 mongosh 常用的命令和集合操作
+type MongoDBConsoleConn struct {
+	options *sqlOption
+
+	client *mongo.Client
+	db     string
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// cursor 是最近一次查询未显示完的结果, 输入 it 继续显示
+	cursor *mongo.Cursor
+
+	term      *utils.Terminal
+	input     *consoleInput
+	outReader *io.PipeReader
+	outWriter *io.PipeWriter
+
+	statements chan *ExecutedStatement
+
+	// 用户输入 Ctrl+C 时取消正在执行的操作, 并丢弃未结束的输入
+	mu          sync.Mutex
+	opCancel    context.CancelFunc
+	interrupted bool
+
+	closeOnce sync.Once
+}
+
+// ExecutedStatements 返回已执行的操作, 会话使用它按操作记录命令
+func (conn *MongoDBConsoleConn) ExecutedStatements() <-chan *ExecutedStatement {
+	return conn.statements
+}
+
+func (conn *MongoDBConsoleConn) Read(p []byte) (int, error) {
+	return conn.outReader.Read(p)
+}
+
+func (conn *MongoDBConsoleConn) Write(p []byte) (int, error) {
+	if bytes.IndexByte(p, 3) >= 0 {
+		conn.interrupt()
+	}
+	return conn.input.Write(p)
+}
+
+func (conn *MongoDBConsoleConn) SetWinSize(width, height int) error {
+	return conn.term.SetSize(width, height)
+}
+
+func (conn *MongoDBConsoleConn) KeepAlive() error {
+	return nil
+}
+
+func (conn *MongoDBConsoleConn) Close() error {
+	var err error
+	conn.closeOnce.Do(func() {
+		conn.cancel()
+		_ = conn.input.Close()
+		_ = conn.outWriter.Close()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		err = conn.client.Disconnect(ctx)
+	})
+	return err
+}
+
+func (conn *MongoDBConsoleConn) prompt() string {
+	return conn.db + "> "
+}
+
+func (conn *MongoDBConsoleConn) run() {
+	defer conn.Close()
+	defer conn.closeCursor()
+	conn.writeString("Welcome to the mongodb console. Type help for help.\n\n")
+	var pending []string
+	for {
+		line, err := conn.term.ReadLine()
+		if err != nil && !errors.Is(err, utils.ErrPasteIndicator) {
+			if err != io.EOF {
+				logger.Debugf("MongoDB console read line err: %s", err)
+			}
+			return
+		}
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case trimmed == "" && conn.takeInterrupt():
+			pending = nil
+		case len(pending) == 0:
+			if quit, ok := conn.handleShellCommand(trimmed); ok {
+				if quit {
+					return
+				}
+				break
+			}
+			fallthrough
+		default:
+			pending = append(pending, line)
+			stmt := strings.TrimSpace(strings.Join(pending, "\n"))
+			if isMongoShellComplete(stmt) {
+				pending = nil
+				conn.execute(stmt)
+			}
+		}
+		if len(pending) == 0 {
+			conn.term.SetPrompt(conn.prompt())
+		} else {
+			conn.term.SetPrompt(mongoConsoleContinuePrompt)
+		}
+	}
+}
+
+// handleShellCommand 处理终端命令, 返回是否退出和是否已处理
+func (conn *MongoDBConsoleConn) handleShellCommand(line string) (quit bool, ok bool) {
+	switch strings.TrimSpace(strings.TrimSuffix(line, ";")) {
+	case "":
+	case "exit", "quit", "exit()", "quit()":
+		return true, true
+	case "help", "help()":
+		conn.writeString(mongoConsoleHelp)
+	case "cls":
+		conn.writeString(utils.CharClear)
+	case "db":
+		conn.writeString(conn.db + "\n")
+	case "it":
+		ctx, done := conn.operationContext()
+		defer done()
+		output, err := conn.nextPage(ctx)
+		if err != nil {
+			conn.writeString(utils.WrapperWarn(mongoConsoleError(err)) + "\n")
+		} else {
+			conn.writeString(output)
+		}
+	default:
+		return false, false
+	}
+	return false, true
+}
+
+// execute 执行一条语句并输出结果, 每条语句生成一条命令记录
+func (conn *MongoDBConsoleConn) execute(stmt string) {
+	ctx, done := conn.operationContext()
+	defer done()
+
+	createdAt := time.Now()
+	// 在执行之前识别, 记录的对象使用执行语句时所在的数据库
+	classified := conn.classify(stmt)
+	output, err := conn.runStatement(ctx, stmt)
+	if err != nil {
+		output = mongoConsoleError(err)
+		conn.writeString(utils.WrapperWarn(output) + "\n")
+	} else {
+		conn.writeString(output)
+	}
+	conn.recordStatement(stmt, output, createdAt, classified)
+}
+
+// 内置终端中的方法对应的 MongoDB 命令
+var mongoConsoleCommands = map[string]string{
+	"find":                   "find",
+	"findOne":                "find",
+	"insertOne":              "insert",
+	"insertMany":             "insert",
+	"updateOne":              "update",
+	"updateMany":             "update",
+	"replaceOne":             "update",
+	"deleteOne":              "delete",
+	"deleteMany":             "delete",
+	"aggregate":              "aggregate",
+	"countDocuments":         "count",
+	"estimatedDocumentCount": "count",
+	"distinct":               "distinct",
+	"createIndex":            "createIndexes",
+	"getIndexes":             "listIndexes",
+	"drop":                   "drop",
+	"getCollectionNames":     "listCollections",
+	"stats":                  "dbStats",
+	"dropDatabase":           "dropDatabase",
+}
+
+// classify 识别语句执行的 MongoDB 命令, 无法识别时返回 nil
+func (conn *MongoDBConsoleConn) classify(stmt string) *sqlparser.Statement {
+	fields := strings.Fields(strings.TrimSuffix(stmt, ";"))
+	if len(fields) == 2 && strings.EqualFold(fields[0], "show") {
+		switch strings.ToLower(fields[1]) {
+		case "dbs", "databases":
+			return sqlparser.MongoStatement("listDatabases", "", "", false)
+		case "collections", "tables":
+			return sqlparser.MongoStatement("listCollections", conn.db, "", false)
+		}
+	}
+	expr, err := parseMongoShellExpr(stmt)
+	if err != nil {
+		return nil
+	}
+	if expr.Method == "runCommand" || expr.Method == "adminCommand" {
+		cmd, err := mongoCommandArg(expr.Args)
+		if err != nil || len(cmd) == 0 {
+			return nil
+		}
+		database := conn.db
+		if expr.Method == "adminCommand" {
+			database = "admin"
+		}
+		collection, _ := cmd[0].Value.(string)
+		return sqlparser.MongoStatement(cmd[0].Key, database, collection, false)
+	}
+	name, ok := mongoConsoleCommands[expr.Method]
+	if !ok {
+		return nil
+	}
+	// 更新和删除的第一个参数是查询条件
+	hasFilter := false
+	if len(expr.Args) > 0 {
+		filter, ok := expr.Args[0].(bson.D)
+		hasFilter = ok && len(filter) > 0
+	}
+	return sqlparser.MongoStatement(name, conn.db, expr.Collection, hasFilter)
+}
+
+func (conn *MongoDBConsoleConn) runStatement(ctx context.Context, stmt string) (string, error) {
+	fields := strings.Fields(strings.TrimSuffix(stmt, ";"))
+	switch strings.ToLower(fields[0]) {
+	case "show":
+		if len(fields) == 2 {
+			switch strings.ToLower(fields[1]) {
+			case "dbs", "databases":
+				return conn.showDatabases(ctx)
+			case "collections", "tables":
+				return conn.showCollections(ctx)
+			}
+		}
+		return "", fmt.Errorf("unsupported show command: %s", strings.Join(fields[1:], " "))
+	case "use":
+		if len(fields) != 2 {
+			return "", errors.New("use requires a database name")
+		}
+		conn.db = fields[1]
+		return fmt.Sprintf("switched to db %s\n", conn.db), nil
+	}
+	expr, err := parseMongoShellExpr(stmt)
+	if err != nil {
+		return "", err
+	}
+	if expr.Collection == "" {
+		return conn.runDatabaseMethod(ctx, expr)
+	}
+	return conn.runCollectionMethod(ctx, expr)
+}
+
+func (conn *MongoDBConsoleConn) showDatabases(ctx context.Context) (string, error) {
+	result, err := conn.client.ListDatabases(ctx, bson.D{})
+	if err != nil {
+		return "", err
+	}
+	width := 0
+	for _, db := range result.Databases {
+		if len(db.Name) > width {
+			width = len(db.Name)
+		}
+	}
+	var b strings.Builder
+	for _, db := range result.Databases {
+		b.WriteString(fmt.Sprintf("%-*s  %s\n", width, db.Name, formatMongoSize(db.SizeOnDisk)))
+	}
+	return b.String(), nil
+}
+
+func (conn *MongoDBConsoleConn) showCollections(ctx context.Context) (string, error) {
+	names, err := conn.client.Database(conn.db).ListCollectionNames(ctx, bson.D{})
+	if err != nil {
+		return "", err
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	for _, name := range names {
+		b.WriteString(name + "\n")
+	}
+	return b.String(), nil
+}
+
+func (conn *MongoDBConsoleConn) runDatabaseMethod(ctx context.Context, expr *mongoShellExpr) (string, error) {
+	if err := checkMongoModifiers(expr); err != nil {
+		return "", err
+	}
+	db := conn.client.Database(conn.db)
+	switch expr.Method {
+	case "runCommand", "adminCommand":
+		cmd, err := mongoCommandArg(expr.Args)
+		if err != nil {
+			return "", err
+		}
+		if expr.Method == "adminCommand" {
+			db = conn.client.Database("admin")
+		}
+		var result bson.D
+		if err = db.RunCommand(ctx, cmd).Decode(&result); err != nil {
+			return "", err
+		}
+		return formatMongoValue(result) + "\n", nil
+	case "getCollectionNames":
+		names, err := db.ListCollectionNames(ctx, bson.D{})
+		if err != nil {
+			return "", err
+		}
+		sort.Strings(names)
+		return formatMongoValue(names) + "\n", nil
+	case "getName":
+		return conn.db + "\n", nil
+	case "stats":
+		var result bson.D
+		if err := db.RunCommand(ctx, bson.D{{Key: "dbStats", Value: 1}}).Decode(&result); err != nil {
+			return "", err
+		}
+		return formatMongoValue(result) + "\n", nil
+	case "dropDatabase":
+		if err := db.Drop(ctx); err != nil {
+			return "", err
+		}
+		return formatMongoValue(bson.D{
+			{Key: "ok", Value: 1},
+			{Key: "dropped", Value: conn.db},
+		}) + "\n", nil
+	}
+	return "", fmt.Errorf("db.%s is not supported", expr.Method)
+}
+
+func (conn *MongoDBConsoleConn) runCollectionMethod(ctx context.Context, expr *mongoShellExpr) (string, error) {
+	coll := conn.client.Database(conn.db).Collection(expr.Collection)
+	args := expr.Args
+	if expr.Method != "find" {
+		if err := checkMongoModifiers(expr, "pretty", "toArray"); err != nil {
+			return "", err
+		}
+	}
+	switch expr.Method {
+	case "find":
+		return conn.find(ctx, coll, expr)
+	case "findOne":
+		filter, err := mongoDocArg(args, 0)
+		if err != nil {
+			return "", err
+		}
+		opts := options.FindOne()
+		if len(args) > 1 {
+			projection, err := mongoDocArg(args, 1)
+			if err != nil {
+				return "", err
+			}
+			opts.SetProjection(projection)
+		}
+		var doc bson.D
+		err = coll.FindOne(ctx, filter, opts).Decode(&doc)
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return "null\n", nil
+		}
+		if err != nil {
+			return "", err
+		}
+		return formatMongoValue(doc) + "\n", nil
+	case "insertOne":
+		doc, err := mongoDocArg(args, 0)
+		if err != nil {
+			return "", err
+		}
+		result, err := coll.InsertOne(ctx, doc)
+		if err != nil {
+			return "", err
+		}
+		return formatMongoValue(bson.D{
+			{Key: "acknowledged", Value: true},
+			{Key: "insertedId", Value: result.InsertedID},
+		}) + "\n", nil
+	case "insertMany":
+		docs, err := mongoArrayArg(args, 0)
+		if err != nil {
+			return "", err
+		}
+		result, err := coll.InsertMany(ctx, docs)
+		if err != nil {
+			return "", err
+		}
+		return formatMongoValue(bson.D{
+			{Key: "acknowledged", Value: true},
+			{Key: "insertedIds", Value: result.InsertedIDs},
+		}) + "\n", nil
+	case "updateOne", "updateMany", "replaceOne":
+		return conn.update(ctx, coll, expr)
+	case "deleteOne", "deleteMany":
+		filter, err := mongoDocArg(args, 0)
+		if err != nil {
+			return "", err
+		}
+		var result *mongo.DeleteResult
+		if expr.Method == "deleteOne" {
+			result, err = coll.DeleteOne(ctx, filter)
+		} else {
+			result, err = coll.DeleteMany(ctx, filter)
+		}
+		if err != nil {
+			return "", err
+		}
+		return formatMongoValue(bson.D{
+			{Key: "acknowledged", Value: true},
+			{Key: "deletedCount", Value: result.DeletedCount},
+		}) + "\n", nil
+	case "aggregate":
+		pipeline, err := mongoArrayArg(args, 0)
+		if err != nil {
+			return "", err
+		}
+		opts := options.Aggregate().SetBatchSize(mongoConsolePageSize)
+		cursor, err := coll.Aggregate(ctx, pipeline, opts)
+		if err != nil {
+			return "", err
+		}
+		return conn.openCursor(ctx, cursor)
+	case "countDocuments":
+		filter, err := mongoDocArg(args, 0)
+		if err != nil {
+			return "", err
+		}
+		count, err := coll.CountDocuments(ctx, filter)
+		if err != nil {
+			return "", err
+		}
+		return strconv.FormatInt(count, 10) + "\n", nil
+	case "estimatedDocumentCount":
+		count, err := coll.EstimatedDocumentCount(ctx)
+		if err != nil {
+			return "", err
+		}
+		return strconv.FormatInt(count, 10) + "\n", nil
+	case "distinct":
+		field, ok := firstStringArg(args)
+		if !ok {
+			return "", errors.New("distinct requires a field name")
+		}
+		filter, err := mongoDocArg(args, 1)
+		if err != nil {
+			return "", err
+		}
+		values, err := coll.Distinct(ctx, field, filter)
+		if err != nil {
+			return "", err
+		}
+		return formatMongoValue(values) + "\n", nil
+	case "createIndex":
+		keys, err := mongoDocArg(args, 0)
+		if err != nil {
+			return "", err
+		}
+		name, err := coll.Indexes().CreateOne(ctx, mongo.IndexModel{Keys: keys})
+		if err != nil {
+			return "", err
+		}
+		return name + "\n", nil
+	case "getIndexes":
+		cursor, err := coll.Indexes().List(ctx)
+		if err != nil {
+			return "", err
+		}
+		defer cursor.Close(ctx)
+		var indexes []bson.D
+		if err = cursor.All(ctx, &indexes); err != nil {
+			return "", err
+		}
+		return formatMongoValue(indexes) + "\n", nil
+	case "drop":
+		if err := coll.Drop(ctx); err != nil {
+			return "", err
+		}
+		return "true\n", nil
+	}
+	return "", fmt.Errorf("db.collection.%s is not supported", expr.Method)
+}
+
+func (conn *MongoDBConsoleConn) find(ctx context.Context, coll *mongo.Collection, expr *mongoShellExpr) (string, error) {
+	filter, err := mongoDocArg(expr.Args, 0)
+	if err != nil {
+		return "", err
+	}
+	opts := options.Find().SetBatchSize(mongoConsolePageSize)
+	if len(expr.Args) > 1 {
+		projection, err := mongoDocArg(expr.Args, 1)
+		if err != nil {
+			return "", err
+		}
+		opts.SetProjection(projection)
+	}
+	for _, modifier := range expr.Modifiers {
+		switch modifier.Name {
+		case "sort", "projection":
+			doc, err := mongoDocArg(modifier.Args, 0)
+			if err != nil {
+				return "", err
+			}
+			if modifier.Name == "sort" {
+				opts.SetSort(doc)
+			} else {
+				opts.SetProjection(doc)
+			}
+		case "limit", "skip":
+			n, err := mongoIntArg(modifier.Args, 0)
+			if err != nil {
+				return "", err
+			}
+			if modifier.Name == "limit" {
+				opts.SetLimit(n)
+			} else {
+				opts.SetSkip(n)
+			}
+		case "pretty", "toArray":
+		default:
+			return "", fmt.Errorf("cursor.%s is not supported", modifier.Name)
+		}
+	}
+	cursor, err := coll.Find(ctx, filter, opts)
+	if err != nil {
+		return "", err
+	}
+	return conn.openCursor(ctx, cursor)
+}
+
+func (conn *MongoDBConsoleConn) update(ctx context.Context, coll *mongo.Collection, expr *mongoShellExpr) (string, error) {
+	filter, err := mongoDocArg(expr.Args, 0)
+	if err != nil {
+		return "", err
+	}
+	if len(expr.Args) < 2 {
+		return "", fmt.Errorf("%s requires an update", expr.Method)
+	}
+	// update 可以是文档, 也可以是聚合管道
+	update := expr.Args[1]
+	opts, err := mongoDocArg(expr.Args, 2)
+	if err != nil {
+		return "", err
+	}
+	upsert, _ := opts.Map()["upsert"].(bool)
+	var result *mongo.UpdateResult
+	switch expr.Method {
+	case "updateOne":
+		result, err = coll.UpdateOne(ctx, filter, update, options.Update().SetUpsert(upsert))
+	case "updateMany":
+		result, err = coll.UpdateMany(ctx, filter, update, options.Update().SetUpsert(upsert))
+	default:
+		result, err = coll.ReplaceOne(ctx, filter, update, options.Replace().SetUpsert(upsert))
+	}
+	if err != nil {
+		return "", err
+	}
+	return formatMongoValue(bson.D{
+		{Key: "acknowledged", Value: true},
+		{Key: "insertedId", Value: result.UpsertedID},
+		{Key: "matchedCount", Value: result.MatchedCount},
+		{Key: "modifiedCount", Value: result.ModifiedCount},
+		{Key: "upsertedCount", Value: result.UpsertedCount},
+	}) + "\n", nil
+}
+
+// openCursor 保存查询的游标并显示第一页, 之前未显示完的结果被丢弃
+func (conn *MongoDBConsoleConn) openCursor(ctx context.Context, cursor *mongo.Cursor) (string, error) {
+	conn.closeCursor()
+	conn.cursor = cursor
+	return conn.nextPage(ctx)
+}
+
+// nextPage 显示游标的下一页, 游标中还有结果时提示输入 it
+func (conn *MongoDBConsoleConn) nextPage(ctx context.Context) (string, error) {
+	if conn.cursor == nil {
+		return "", errors.New("no cursor")
+	}
+	var b strings.Builder
+	for i := 0; i < mongoConsolePageSize && conn.cursor.Next(ctx); i++ {
+		var doc bson.D
+		if err := conn.cursor.Decode(&doc); err != nil {
+			conn.closeCursor()
+			return "", err
+		}
+		b.WriteString(formatMongoValue(doc) + "\n")
+	}
+	if err := conn.cursor.Err(); err != nil {
+		conn.closeCursor()
+		return "", err
+	}
+	if conn.cursor.ID() == 0 && conn.cursor.RemainingBatchLength() == 0 {
+		conn.closeCursor()
+	} else {
+		b.WriteString("Type \"it\" for more\n")
+	}
+	return b.String(), nil
+}
+
+func (conn *MongoDBConsoleConn) closeCursor() {
+	if conn.cursor == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_ = conn.cursor.Close(ctx)
+	conn.cursor = nil
+}
+
+// operationContext 返回执行单个操作使用的 context, 用户输入 Ctrl+C 时取消
+func (conn *MongoDBConsoleConn) operationContext() (context.Context, func()) {
+	ctx, cancel := context.WithCancel(conn.ctx)
+	conn.mu.Lock()
+	conn.opCancel = cancel
+	conn.mu.Unlock()
+	return ctx, func() {
+		conn.mu.Lock()
+		conn.opCancel = nil
+		conn.mu.Unlock()
+		cancel()
+	}
+}
+
+// recordStatement 按操作生成命令记录, 会话结束时丢弃未读取的记录
+func (conn *MongoDBConsoleConn) recordStatement(input, output string, createdAt time.Time, stmt *sqlparser.Statement) {
+	executed := &ExecutedStatement{Input: input, Output: output, CreatedDate: createdAt}
+	if stmt != nil {
+		executed.Statements = []*sqlparser.Statement{stmt}
+	}
+	select {
+	case conn.statements <- executed:
+	case <-conn.ctx.Done():
+	}
+}
+
+func (conn *MongoDBConsoleConn) interrupt() {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	conn.interrupted = true
+	if conn.opCancel != nil {
+		conn.opCancel()
+	}
+}
+
+// takeInterrupt 返回用户是否输入过 Ctrl+C, 并清除该状态
+func (conn *MongoDBConsoleConn) takeInterrupt() bool {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	interrupted := conn.interrupted
+	conn.interrupted = false
+	return interrupted
+}
+
+func (conn *MongoDBConsoleConn) writeString(s string) {
+	_, _ = conn.term.Write([]byte(s))
+}
+
+func mongoConsoleError(err error) string {
+	var serverErr mongo.ServerError
+	if errors.As(err, &serverErr) {
+		return "MongoServerError: " + err.Error()
+	}
+	return "Error: " + err.Error()
+}
+
+// checkMongoModifiers 检查表达式只使用了允许的游标方法
+func checkMongoModifiers(expr *mongoShellExpr, allowed ...string) error {
+	for _, modifier := range expr.Modifiers {
+		ok := false
+		for _, name := range allowed {
+			ok = ok || modifier.Name == name
+		}
+		if !ok {
+			return fmt.Errorf("%s is not supported after %s", modifier.Name, expr.Method)
+		}
+	}
+	return nil
+}
+
+// mongoDocArg 返回第 i 个参数, 参数不存在时返回空文档
+func mongoDocArg(args bson.A, i int) (bson.D, error) {
+	if i >= len(args) || args[i] == nil {
+		return bson.D{}, nil
+	}
+	doc, ok := args[i].(bson.D)
+	if !ok {
+		return nil, fmt.Errorf("argument %d must be a document", i+1)
+	}
+	return doc, nil
+}
+
+func mongoArrayArg(args bson.A, i int) ([]interface{}, error) {
+	if i < len(args) {
+		if arr, ok := args[i].(bson.A); ok {
+			return arr, nil
+		}
+	}
+	return nil, fmt.Errorf("argument %d must be an array", i+1)
+}
+
+func mongoIntArg(args bson.A, i int) (int64, error) {
+	if i < len(args) {
+		switch v := args[i].(type) {
+		case int32:
+			return int64(v), nil
+		case int64:
+			return v, nil
+		case float64:
+			if v == float64(int64(v)) {
+				return int64(v), nil
+			}
+		}
+	}
+	return 0, fmt.Errorf("argument %d must be an integer", i+1)
+}
+
+// mongoCommandArg 返回 runCommand 的命令, 字符串 "ping" 等同于 {ping: 1}
+func mongoCommandArg(args bson.A) (bson.D, error) {
+	if name, ok := firstStringArg(args); ok {
+		return bson.D{{Key: name, Value: 1}}, nil
+	}
+	if len(args) == 0 {
+		return nil, errors.New("missing command")
+	}
+	return mongoDocArg(args, 0)
+}
+
+// formatMongoValue 使用 relaxed extended JSON 格式化文档或其它值
+func formatMongoValue(v interface{}) string {
+	if doc, ok := v.(bson.D); ok {
+		data, err := bson.MarshalExtJSONIndent(doc, false, false, "", "  ")
+		if err != nil {
+			return fmt.Sprint(v)
+		}
+		return string(data)
+	}
+	// extended JSON 只能格式化文档, 其它值放在文档中格式化后再去掉外层
+	data, err := bson.MarshalExtJSONIndent(bson.D{{Key: "v", Value: v}}, false, false, "", "  ")
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	s := strings.TrimPrefix(string(data), "{\n  \"v\": ")
+	s = strings.TrimSuffix(s, "\n}")
+	return strings.ReplaceAll(s, "\n  ", "\n")
+}
+
+func formatMongoSize(size int64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB"}
+	value := float64(size)
+	i := 0
+	for value >= 1024 && i < len(units)-1 {
+		value /= 1024
+		i++
+	}
+	return fmt.Sprintf("%.2f %s", value, units[i])
+}
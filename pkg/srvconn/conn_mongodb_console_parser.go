@@ -0,0 +1,353 @@
+package srvconn
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// mongoShellStep 是 mongosh 表达式中的一段, 如 db.users.find({...}) 中的 users 和 find({...})
+type mongoShellStep struct {
+	Name string
+	Args bson.A
+	Call bool
+}
+
+// mongoShellExpr 是解析后的 db.<collection>.<method>(...) 表达式
+type mongoShellExpr struct {
+	// Collection 为空时 Method 是数据库方法, 如 db.runCommand
+	Collection string
+	Method     string
+	Args       bson.A
+
+	// Modifiers 是游标方法, 如 sort, limit, skip
+	Modifiers []mongoShellStep
+}
+
+// 可以在参数中使用的 mongosh 构造函数
+var mongoShellConstructors = map[string]bool{
+	"ObjectId":      true,
+	"ISODate":       true,
+	"Date":          true,
+	"NumberLong":    true,
+	"NumberInt":     true,
+	"NumberDecimal": true,
+}
+
+// parseMongoShellExpr 解析 db 开头的表达式, 参数使用 extended JSON, 也支持 mongosh 中不带引号的键和单引号字符串
+func parseMongoShellExpr(input string) (*mongoShellExpr, error) {
+	s := strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(input), ";"))
+	if !strings.HasPrefix(s, "db.") {
+		return nil, errors.New("expression must start with db.")
+	}
+	var steps []mongoShellStep
+	i := len("db")
+	for i < len(s) {
+		i = skipShellSpaces(s, i)
+		if s[i] != '.' {
+			return nil, fmt.Errorf("unexpected %q at position %d", s[i], i)
+		}
+		i = skipShellSpaces(s, i+1)
+		end := scanShellIdent(s, i)
+		if end == i {
+			return nil, fmt.Errorf("missing name at position %d", i)
+		}
+		step := mongoShellStep{Name: s[i:end]}
+		i = skipShellSpaces(s, end)
+		if i < len(s) && s[i] == '(' {
+			closing, err := matchShellParen(s, i)
+			if err != nil {
+				return nil, err
+			}
+			if step.Args, err = parseMongoShellArgs(s[i+1 : closing]); err != nil {
+				return nil, err
+			}
+			step.Call = true
+			i = closing + 1
+		}
+		steps = append(steps, step)
+	}
+
+	expr := &mongoShellExpr{}
+	switch {
+	case len(steps) == 0:
+		return nil, errors.New("missing method")
+	case steps[0].Call && steps[0].Name == "getCollection":
+		name, ok := firstStringArg(steps[0].Args)
+		if !ok {
+			return nil, errors.New("getCollection requires a collection name")
+		}
+		expr.Collection = name
+		steps = steps[1:]
+	case steps[0].Call:
+		// 数据库方法
+		expr.Method, expr.Args = steps[0].Name, steps[0].Args
+		expr.Modifiers = steps[1:]
+		return expr, nil
+	default:
+		// 集合名可以包含点, 如 db.system.users.find()
+		names := make([]string, 0, len(steps))
+		for len(steps) > 0 && !steps[0].Call {
+			names = append(names, steps[0].Name)
+			steps = steps[1:]
+		}
+		expr.Collection = strings.Join(names, ".")
+	}
+	if len(steps) == 0 {
+		return nil, fmt.Errorf("missing method on collection %s", expr.Collection)
+	}
+	expr.Method, expr.Args = steps[0].Name, steps[0].Args
+	for _, step := range steps[1:] {
+		if !step.Call {
+			return nil, fmt.Errorf("%s is not a method", step.Name)
+		}
+	}
+	expr.Modifiers = steps[1:]
+	return expr, nil
+}
+
+// parseMongoShellArgs 解析以逗号分隔的参数
+func parseMongoShellArgs(s string) (bson.A, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+	normalized, err := normalizeShellJSON(s)
+	if err != nil {
+		return nil, err
+	}
+	var doc bson.D
+	if err = bson.UnmarshalExtJSON([]byte(`{"args":[`+normalized+`]}`), false, &doc); err != nil {
+		return nil, fmt.Errorf("invalid arguments: %w", err)
+	}
+	args, _ := doc[0].Value.(bson.A)
+	return args, nil
+}
+
+// normalizeShellJSON 把 mongosh 的写法转换为 extended JSON: 键加上双引号, 单引号字符串改为双引号, 转换 ObjectId 等构造函数
+func normalizeShellJSON(s string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == '"' || c == '\'':
+			str, n, err := readShellString(s[i:])
+			if err != nil {
+				return "", err
+			}
+			writeJSONString(&b, str)
+			i += n
+		case isShellIdentStart(c):
+			end := scanShellIdent(s, i)
+			ident := s[i:end]
+			next := skipShellSpaces(s, end)
+			switch {
+			case next < len(s) && s[next] == ':':
+				writeJSONString(&b, ident)
+				i = end
+			case ident == "new":
+				i = next
+			case next < len(s) && s[next] == '(' && mongoShellConstructors[ident]:
+				closing, err := matchShellParen(s, next)
+				if err != nil {
+					return "", err
+				}
+				value, err := shellConstructorJSON(ident, strings.TrimSpace(s[next+1:closing]))
+				if err != nil {
+					return "", err
+				}
+				b.WriteString(value)
+				i = closing + 1
+			case ident == "undefined":
+				b.WriteString("null")
+				i = end
+			default:
+				b.WriteString(ident)
+				i = end
+			}
+		default:
+			b.WriteByte(c)
+			i++
+		}
+	}
+	return b.String(), nil
+}
+
+// shellConstructorJSON 把 ObjectId("...") 等构造函数转换为 extended JSON
+func shellConstructorJSON(name, arg string) (string, error) {
+	value := arg
+	if arg != "" && (arg[0] == '"' || arg[0] == '\'') {
+		str, n, err := readShellString(arg)
+		if err != nil {
+			return "", err
+		}
+		if n != len(arg) {
+			return "", fmt.Errorf("invalid argument for %s", name)
+		}
+		value = str
+	}
+	var b strings.Builder
+	switch name {
+	case "ObjectId":
+		b.WriteString(`{"$oid":`)
+		writeJSONString(&b, value)
+	case "ISODate", "Date":
+		t := time.Now()
+		if value != "" {
+			var err error
+			if t, err = parseShellDate(value); err != nil {
+				return "", err
+			}
+		}
+		b.WriteString(`{"$date":{"$numberLong":"` + strconv.FormatInt(t.UnixNano()/int64(time.Millisecond), 10) + `"}`)
+	case "NumberLong":
+		b.WriteString(`{"$numberLong":`)
+		writeJSONString(&b, value)
+	case "NumberInt":
+		b.WriteString(`{"$numberInt":`)
+		writeJSONString(&b, value)
+	case "NumberDecimal":
+		b.WriteString(`{"$numberDecimal":`)
+		writeJSONString(&b, value)
+	}
+	b.WriteByte('}')
+	return b.String(), nil
+}
+
+var shellDateLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05",
+	"2006-01-02",
+}
+
+func parseShellDate(value string) (time.Time, error) {
+	if ms, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(0, ms*int64(time.Millisecond)).UTC(), nil
+	}
+	for _, layout := range shellDateLayouts {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid date %q", value)
+}
+
+// readShellString 读取以单引号或双引号开头的字符串, 返回字符串的值和使用的长度
+func readShellString(s string) (string, int, error) {
+	quote := s[0]
+	var b strings.Builder
+	for i := 1; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == quote:
+			return b.String(), i + 1, nil
+		case c == '\\' && i+1 < len(s):
+			i++
+			switch s[i] {
+			case 'n':
+				b.WriteByte('\n')
+			case 'r':
+				b.WriteByte('\r')
+			case 't':
+				b.WriteByte('\t')
+			case 'u':
+				if i+4 < len(s) {
+					if r, err := strconv.ParseUint(s[i+1:i+5], 16, 32); err == nil {
+						b.WriteRune(rune(r))
+						i += 4
+						continue
+					}
+				}
+				b.WriteByte('u')
+			default:
+				b.WriteByte(s[i])
+			}
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return "", 0, errors.New("unterminated string")
+}
+
+func writeJSONString(b *strings.Builder, s string) {
+	data, _ := json.Marshal(s)
+	b.Write(data)
+}
+
+// matchShellParen 返回与 s[open] 的左括号匹配的右括号位置, 忽略字符串中的括号
+func matchShellParen(s string, open int) (int, error) {
+	depth := 0
+	for i := open; i < len(s); i++ {
+		switch s[i] {
+		case '"', '\'':
+			_, n, err := readShellString(s[i:])
+			if err != nil {
+				return 0, err
+			}
+			i += n - 1
+		case '(', '[', '{':
+			depth++
+		case ')', ']', '}':
+			depth--
+			if depth == 0 {
+				if s[i] != ')' {
+					return 0, fmt.Errorf("unexpected %q at position %d", s[i], i)
+				}
+				return i, nil
+			}
+		}
+	}
+	return 0, errors.New("missing )")
+}
+
+// isMongoShellComplete 判断输入的括号和字符串是否已经结束, 未结束时继续读取下一行
+func isMongoShellComplete(s string) bool {
+	depth := 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '"', '\'':
+			_, n, err := readShellString(s[i:])
+			if err != nil {
+				return false
+			}
+			i += n - 1
+		case '(', '[', '{':
+			depth++
+		case ')', ']', '}':
+			depth--
+		}
+	}
+	return depth <= 0
+}
+
+func firstStringArg(args bson.A) (string, bool) {
+	if len(args) == 0 {
+		return "", false
+	}
+	s, ok := args[0].(string)
+	return s, ok
+}
+
+func isShellIdentStart(c byte) bool {
+	return c == '_' || c == '$' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+func scanShellIdent(s string, i int) int {
+	for i < len(s) && (isShellIdentStart(s[i]) || s[i] >= '0' && s[i] <= '9') {
+		i++
+	}
+	return i
+}
+
+func skipShellSpaces(s string, i int) int {
+	for i < len(s) && (s[i] == ' ' || s[i] == '\t' || s[i] == '\n' || s[i] == '\r') {
+		i++
+	}
+	return i
+}
@@ -0,0 +1,129 @@
+package srvconn
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestNormalizeShellJSON(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+		err   bool
+	}{
+		{`{name: 'alice', age: {$gt: 18}}`, `{"name": "alice", "age": {"$gt": 18}}`, false},
+		{`{"a": "it's"}`, `{"a": "it's"}`, false},
+		{`{s: 'say "hi"'}`, `{"s": "say \"hi\""}`, false},
+		{`{_id: ObjectId("5f1d7f3b9d1e8a1b2c3d4e5f")}`, `{"_id": {"$oid":"5f1d7f3b9d1e8a1b2c3d4e5f"}}`, false},
+		{`{n: NumberLong(42), i: NumberInt("7")}`, `{"n": {"$numberLong":"42"}, "i": {"$numberInt":"7"}}`, false},
+		{`{d: new Date('2022-01-02')}`, `{"d": {"$date":{"$numberLong":"1641081600000"}}}`, false},
+		{`{ok: true, v: null, u: undefined}`, `{"ok": true, "v": null, "u": null}`, false},
+		{`{a: 'unterminated}`, "", true},
+	}
+	for _, tt := range tests {
+		got, err := normalizeShellJSON(tt.input)
+		if (err != nil) != tt.err {
+			t.Errorf("normalizeShellJSON(%q) err = %v, want err %v", tt.input, err, tt.err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("normalizeShellJSON(%q) = %q, want %q", tt.input, got, tt.want)
+		}
+	}
+}
+
+func TestParseMongoShellExpr(t *testing.T) {
+	expr, err := parseMongoShellExpr(`db.users.find({age: {$gte: 18}}, {name: 1}).sort({name: -1}).limit(5);`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expr.Collection != "users" || expr.Method != "find" || len(expr.Args) != 2 {
+		t.Fatalf("unexpected expr: %+v", expr)
+	}
+	filter := bson.D{{Key: "age", Value: bson.D{{Key: "$gte", Value: int32(18)}}}}
+	if !reflect.DeepEqual(expr.Args[0], filter) {
+		t.Errorf("filter = %#v, want %#v", expr.Args[0], filter)
+	}
+	if len(expr.Modifiers) != 2 || expr.Modifiers[0].Name != "sort" || expr.Modifiers[1].Name != "limit" ||
+		!reflect.DeepEqual(expr.Modifiers[1].Args, bson.A{int32(5)}) {
+		t.Errorf("unexpected modifiers: %+v", expr.Modifiers)
+	}
+
+	expr, err = parseMongoShellExpr("db.system.users.insertOne({\n  _id: ObjectId('5f1d7f3b9d1e8a1b2c3d4e5f'),\n  at: ISODate('2022-01-02T03:04:05Z')\n})")
+	if err != nil {
+		t.Fatal(err)
+	}
+	oid, _ := primitive.ObjectIDFromHex("5f1d7f3b9d1e8a1b2c3d4e5f")
+	at := primitive.NewDateTimeFromTime(time.Date(2022, 1, 2, 3, 4, 5, 0, time.UTC))
+	doc := bson.D{{Key: "_id", Value: oid}, {Key: "at", Value: at}}
+	if expr.Collection != "system.users" || expr.Method != "insertOne" || !reflect.DeepEqual(expr.Args, bson.A{doc}) {
+		t.Errorf("unexpected expr: %+v", expr)
+	}
+
+	expr, err = parseMongoShellExpr(`db.getCollection("my-coll").deleteMany({})`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expr.Collection != "my-coll" || expr.Method != "deleteMany" {
+		t.Errorf("unexpected expr: %+v", expr)
+	}
+
+	expr, err = parseMongoShellExpr(`db.runCommand({ping: 1})`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expr.Collection != "" || expr.Method != "runCommand" {
+		t.Errorf("unexpected expr: %+v", expr)
+	}
+
+	for _, input := range []string{
+		"show dbs",
+		"db.users",
+		"db.users.find(",
+		"db.users.find({a: })",
+		"db.users.find().limit",
+	} {
+		if _, err = parseMongoShellExpr(input); err == nil {
+			t.Errorf("parseMongoShellExpr(%q) should fail", input)
+		}
+	}
+}
+
+func TestIsMongoShellComplete(t *testing.T) {
+	tests := map[string]bool{
+		"db.users.find()":                true,
+		"db.users.find({":                false,
+		"db.users.find({\n  a: 1\n})":    true,
+		"db.users.find({a: '})'":         false,
+		"db.users.insertOne({a: '}'})":   true,
+		`db.users.insertOne({a: "\"}"})`: true,
+	}
+	for input, want := range tests {
+		if got := isMongoShellComplete(input); got != want {
+			t.Errorf("isMongoShellComplete(%q) = %v, want %v", input, got, want)
+		}
+	}
+}
+
+func TestFormatMongoValue(t *testing.T) {
+	tests := []struct {
+		value interface{}
+		want  string
+	}{
+		{bson.D{{Key: "a", Value: int32(1)}}, "{\n  \"a\": 1\n}"},
+		{bson.D{}, "{}"},
+		{[]string{"x", "y"}, "[\n  \"x\",\n  \"y\"\n]"},
+		{bson.A{bson.D{{Key: "a", Value: true}}}, "[\n  {\n    \"a\": true\n  }\n]"},
+		{nil, "null"},
+		{int64(3), "3"},
+	}
+	for _, tt := range tests {
+		if got := formatMongoValue(tt.value); got != tt.want {
+			t.Errorf("formatMongoValue(%#v) = %q, want %q", tt.value, got, tt.want)
+		}
+	}
+}
@@ -17,6 +17,7 @@ import (
 
 	_ "github.com/go-sql-driver/mysql"
 
+	"github.com/meowgen/koko/pkg/guardrail"
 	"github.com/meowgen/koko/pkg/localcommand"
 	"github.com/meowgen/koko/pkg/logger"
 )
@@ -203,6 +204,9 @@ type sqlOption struct {
 	disableMySQLAutoRehash bool
 	PathToDb               string
 	CreateDbIfNotExist     bool
+
+	// guard 是内置 SQL 终端的查询限制
+	guard guardrail.Policy
 }
 
 func (opt *sqlOption) CommandArgs() []string {
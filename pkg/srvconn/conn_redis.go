@@ -3,7 +3,7 @@ package srvconn
 import (
 	"crypto/tls"
 	"crypto/x509"
-	"fmt"
+	"net"
 	"os"
 	"strconv"
 	"time"
@@ -137,37 +137,45 @@ func (opt *sqlOption) RedisCommandArgs() []string {
 }
 
 func checkRedisAccount(args *sqlOption) error {
+	dialOptions, err := args.RedisDialOptions()
+	if err != nil {
+		return err
+	}
+	addr := net.JoinHostPort(args.Host, strconv.Itoa(args.Port))
+	conn, err := radix.Dial("tcp", addr, dialOptions...)
+	if err != nil || conn == nil {
+		return err
+	}
+	defer conn.Close()
+	return nil
+}
+
+// RedisDialOptions 返回连接 Redis 的认证和 TLS 选项, 证书只在内存中使用
+func (opt *sqlOption) RedisDialOptions() ([]radix.DialOpt, error) {
 	var dialOptions []radix.DialOpt
-	addr := fmt.Sprintf("%s:%s", args.Host, strconv.Itoa(args.Port))
-	if args.Username != "" {
-		dialOptions = append(dialOptions, radix.DialAuthUser(args.Username, args.Password))
+	if opt.Username != "" {
+		dialOptions = append(dialOptions, radix.DialAuthUser(opt.Username, opt.Password))
 	} else {
-		dialOptions = append(dialOptions, radix.DialAuthPass(args.Password))
+		dialOptions = append(dialOptions, radix.DialAuthPass(opt.Password))
 	}
 
-	if args.UseSSL{
+	if opt.UseSSL {
 		tlsConfig := tls.Config{}
-		if args.CaCert != "" {
+		if opt.CaCert != "" {
 			rootCAs := x509.NewCertPool()
-			rootCAs.AppendCertsFromPEM([]byte(args.CaCert))
+			rootCAs.AppendCertsFromPEM([]byte(opt.CaCert))
 			tlsConfig.RootCAs = rootCAs
 			tlsConfig.InsecureSkipVerify = true
 		}
-		if args.CertKey != "" && args.ClientCert != "" {
+		if opt.CertKey != "" && opt.ClientCert != "" {
 			var err error
 			tlsConfig.Certificates = make([]tls.Certificate, 1)
-			tlsConfig.Certificates[0], err = tls.X509KeyPair([]byte(args.ClientCert), []byte(args.CertKey))
+			tlsConfig.Certificates[0], err = tls.X509KeyPair([]byte(opt.ClientCert), []byte(opt.CertKey))
 			if err != nil {
-				return err
+				return nil, err
 			}
 		}
 		dialOptions = append(dialOptions, radix.DialUseTLS(&tlsConfig))
 	}
-
-	conn, err := radix.Dial("tcp", addr, dialOptions...)
-	if err != nil || conn == nil {
-		return err
-	}
-	defer conn.Close()
-	return nil
+	return dialOptions, nil
 }
@@ -0,0 +1,609 @@
+package srvconn
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mediocregopher/radix/v3"
+	"github.com/mediocregopher/radix/v3/resp/resp2"
+
+	"github.com/meowgen/koko/pkg/logger"
+	"github.com/meowgen/koko/pkg/sqlparser"
+	"github.com/meowgen/koko/pkg/utils"
+)
+
+const (
+	// redisConsoleMaxRedirects 单条命令最多跟随的集群重定向次数
+	redisConsoleMaxRedirects = 5
+
+	redisConsoleDialTimeout = 15 * time.Second
+
+	redisMaskedArgValue = "******"
+)
+
+var (
+	_ ServerConnection    = (*RedisConsoleConn)(nil)
+	_ StatementConnection = (*RedisConsoleConn)(nil)
+
+	errRedisInvalidArgs = errors.New("invalid argument(s)")
+)
+
+// 需要持续读取推送消息的命令, 内置终端不支持
+var redisConsoleUnsupported = map[string]bool{
+	"SUBSCRIBE":  true,
+	"PSUBSCRIBE": true,
+	"SSUBSCRIBE": true,
+	"MONITOR":    true,
+	"SYNC":       true,
+	"PSYNC":      true,
+}
+
+// 用于 Tab 补全的命令
+var redisConsoleCommands = []string{
+	"ACL", "APPEND", "AUTH", "BGREWRITEAOF", "BGSAVE", "BITCOUNT", "BITFIELD", "BITOP", "BITPOS",
+	"BLMOVE", "BLPOP", "BRPOP", "BRPOPLPUSH", "BZPOPMAX", "BZPOPMIN", "CLIENT", "CLUSTER", "COMMAND",
+	"CONFIG", "COPY", "DBSIZE", "DECR", "DECRBY", "DEL", "DISCARD", "DUMP", "ECHO", "EVAL", "EVALSHA",
+	"EXEC", "EXISTS", "EXPIRE", "EXPIREAT", "EXPIRETIME", "FLUSHALL", "FLUSHDB", "GEOADD", "GEODIST",
+	"GEOHASH", "GEOPOS", "GEORADIUS", "GEOSEARCH", "GET", "GETBIT", "GETDEL", "GETEX", "GETRANGE",
+	"GETSET", "HDEL", "HELLO", "HEXISTS", "HGET", "HGETALL", "HINCRBY", "HINCRBYFLOAT", "HKEYS", "HLEN",
+	"HMGET", "HMSET", "HRANDFIELD", "HSCAN", "HSET", "HSETNX", "HSTRLEN", "HVALS", "INCR", "INCRBY",
+	"INCRBYFLOAT", "INFO", "KEYS", "LASTSAVE", "LATENCY", "LINDEX", "LINSERT", "LLEN", "LMOVE", "LPOP",
+	"LPOS", "LPUSH", "LPUSHX", "LRANGE", "LREM", "LSET", "LTRIM", "MEMORY", "MGET", "MOVE", "MSET",
+	"MSETNX", "MULTI", "OBJECT", "PERSIST", "PEXPIRE", "PEXPIREAT", "PFADD", "PFCOUNT", "PFMERGE",
+	"PING", "PSETEX", "PTTL", "PUBLISH", "PUBSUB", "RANDOMKEY", "RENAME", "RENAMENX", "RESTORE",
+	"ROLE", "RPOP", "RPOPLPUSH", "RPUSH", "RPUSHX", "SADD", "SAVE", "SCAN", "SCARD", "SCRIPT", "SDIFF",
+	"SDIFFSTORE", "SELECT", "SET", "SETBIT", "SETEX", "SETNX", "SETRANGE", "SINTER", "SINTERSTORE",
+	"SISMEMBER", "SLOWLOG", "SMEMBERS", "SMISMEMBER", "SMOVE", "SORT", "SPOP", "SRANDMEMBER", "SREM",
+	"SSCAN", "STRLEN", "SUNION", "SUNIONSTORE", "SWAPDB", "TIME", "TOUCH", "TTL", "TYPE", "UNLINK",
+	"UNWATCH", "WAIT", "WATCH", "XACK", "XADD", "XAUTOCLAIM", "XCLAIM", "XDEL", "XGROUP", "XINFO",
+	"XLEN", "XPENDING", "XRANGE", "XREAD", "XREADGROUP", "XREVRANGE", "XTRIM", "ZADD", "ZCARD",
+	"ZCOUNT", "ZDIFF", "ZINCRBY", "ZINTER", "ZINTERSTORE", "ZLEXCOUNT", "ZMSCORE", "ZPOPMAX",
+	"ZPOPMIN", "ZRANDMEMBER", "ZRANGE", "ZRANGEBYLEX", "ZRANGEBYSCORE", "ZRANK", "ZREM",
+	"ZREMRANGEBYLEX", "ZREMRANGEBYRANK", "ZREMRANGEBYSCORE", "ZREVRANGE", "ZREVRANGEBYSCORE",
+	"ZREVRANK", "ZSCAN", "ZSCORE", "ZUNION", "ZUNIONSTORE",
+}
+
+const redisConsoleHelp = `Type a Redis command and press Enter, arguments with spaces can be quoted.
+  <Tab>          complete the command name
+  clear          clear the screen
+  exit, quit     quit the console
+
+Cluster redirections (MOVED/ASK) are followed automatically.
+`
+
+// NewRedisConsoleConnection 使用 radix 直接连接 Redis, 在进程内提供 redis-cli 风格的终端, 不依赖 redis-cli
+func NewRedisConsoleConnection(ops ...SqlOption) (*RedisConsoleConn, error) {
+	args := &sqlOption{
+		Host:   "127.0.0.1",
+		Port:   6379,
+		DBName: "0",
+		win: Windows{
+			Width:  80,
+			Height: 120,
+		},
+	}
+	for _, setter := range ops {
+		setter(args)
+	}
+	dialOpts, err := args.RedisDialOptions()
+	if err != nil {
+		return nil, err
+	}
+	dialOpts = append(dialOpts, radix.DialConnectTimeout(redisConsoleDialTimeout))
+	var db int
+	if args.DBName != "" {
+		if db, err = strconv.Atoi(args.DBName); err != nil {
+			return nil, fmt.Errorf("invalid redis db %q", args.DBName)
+		}
+	}
+	outReader, outWriter := io.Pipe()
+	conn := &RedisConsoleConn{
+		options:    args,
+		addr:       net.JoinHostPort(args.Host, strconv.Itoa(args.Port)),
+		db:         db,
+		dialOpts:   dialOpts,
+		nodes:      make(map[string]radix.Conn),
+		input:      newConsoleInput(),
+		outReader:  outReader,
+		outWriter:  outWriter,
+		statements: make(chan *ExecutedStatement, 64),
+		done:       make(chan struct{}),
+	}
+	if _, err = conn.node(conn.addr); err != nil {
+		return nil, err
+	}
+	conn.term = utils.NewTerminal(&consoleIO{in: conn.input, out: outWriter}, conn.prompt())
+	conn.term.AutoCompleteCallback = conn.autoComplete
+	_ = conn.term.SetSize(args.win.Width, args.win.Height)
+	go conn.run()
+	return conn, nil
+}
+
+// RedisConsoleConn 是内置的 Redis 终端, 命令按 redis-cli 的规则解析参数后通过 radix 执行
+type RedisConsoleConn struct {
+	options *sqlOption
+
+	// addr 是当前连接的节点, 集群返回 MOVED 之后切换到新的节点
+	addr     string
+	db       int
+	dialOpts []radix.DialOpt
+
+	mu      sync.Mutex
+	nodes   map[string]radix.Conn
+	running radix.Conn
+
+	term      *utils.Terminal
+	input     *consoleInput
+	outReader *io.PipeReader
+	outWriter *io.PipeWriter
+
+	statements chan *ExecutedStatement
+	done       chan struct{}
+	closeOnce  sync.Once
+}
+
+// ExecutedStatements 返回已执行的命令, 会话使用它按命令记录
+func (conn *RedisConsoleConn) ExecutedStatements() <-chan *ExecutedStatement {
+	return conn.statements
+}
+
+func (conn *RedisConsoleConn) Read(p []byte) (int, error) {
+	return conn.outReader.Read(p)
+}
+
+func (conn *RedisConsoleConn) Write(p []byte) (int, error) {
+	if bytes.IndexByte(p, 3) >= 0 {
+		conn.interrupt()
+	}
+	return conn.input.Write(p)
+}
+
+func (conn *RedisConsoleConn) SetWinSize(width, height int) error {
+	return conn.term.SetSize(width, height)
+}
+
+func (conn *RedisConsoleConn) KeepAlive() error {
+	return nil
+}
+
+func (conn *RedisConsoleConn) Close() error {
+	conn.closeOnce.Do(func() {
+		close(conn.done)
+		_ = conn.input.Close()
+		_ = conn.outWriter.Close()
+		conn.mu.Lock()
+		defer conn.mu.Unlock()
+		for addr, node := range conn.nodes {
+			_ = node.Close()
+			delete(conn.nodes, addr)
+		}
+	})
+	return nil
+}
+
+func (conn *RedisConsoleConn) prompt() string {
+	if conn.db != 0 {
+		return fmt.Sprintf("%s[%d]> ", conn.addr, conn.db)
+	}
+	return conn.addr + "> "
+}
+
+func (conn *RedisConsoleConn) run() {
+	defer conn.Close()
+	conn.writeString("Welcome to the redis console. Type help for help.\n\n")
+	for {
+		line, err := conn.term.ReadLine()
+		if err != nil && !errors.Is(err, utils.ErrPasteIndicator) {
+			if err != io.EOF {
+				logger.Debugf("Redis console read line err: %s", err)
+			}
+			return
+		}
+		args, err := splitRedisArgs(line)
+		if err != nil {
+			conn.writeString(utils.WrapperWarn(err.Error()) + "\n")
+			continue
+		}
+		if len(args) == 0 {
+			continue
+		}
+		switch strings.ToLower(args[0]) {
+		case "exit", "quit":
+			return
+		case "clear":
+			conn.writeString(utils.CharClear)
+			continue
+		case "help":
+			conn.writeString(redisConsoleHelp)
+			continue
+		}
+		conn.execute(args)
+		conn.term.SetPrompt(conn.prompt())
+	}
+}
+
+func (conn *RedisConsoleConn) execute(args []string) {
+	createdAt := time.Now()
+	var output string
+	name := strings.ToUpper(args[0])
+	if redisConsoleUnsupported[name] {
+		output = fmt.Sprintf("(error) ERR %s is not supported in the console", name)
+	} else if reply, err := conn.do(args); err != nil {
+		output = "(error) " + err.Error()
+	} else {
+		output = formatRedisReply(reply)
+		if name == "SELECT" && len(args) == 2 && bytes.HasPrefix(reply, []byte("+OK")) {
+			conn.db, _ = strconv.Atoi(args[1])
+		}
+	}
+	conn.writeString(output + "\n")
+	select {
+	case conn.statements <- &ExecutedStatement{
+		Input:       formatRedisCommand(args),
+		Output:      output,
+		CreatedDate: createdAt,
+		Statements:  []*sqlparser.Statement{sqlparser.RedisStatement(args)},
+	}:
+	case <-conn.done:
+	}
+}
+
+// do 在当前节点执行命令, 集群返回 MOVED 或 ASK 时按 redis-cli -c 的方式重定向
+func (conn *RedisConsoleConn) do(args []string) (resp2.RawMessage, error) {
+	addr := conn.addr
+	asking := false
+	for i := 0; i <= redisConsoleMaxRedirects; i++ {
+		node, err := conn.node(addr)
+		if err != nil {
+			return nil, err
+		}
+		var reply resp2.RawMessage
+		conn.setRunning(node)
+		if asking {
+			err = node.Do(radix.Cmd(&resp2.RawMessage{}, "ASKING"))
+		}
+		if err == nil {
+			err = node.Do(radix.Cmd(&reply, args[0], args[1:]...))
+		}
+		conn.setRunning(nil)
+		if err != nil {
+			// 连接出错或被 Ctrl+C 中断, 下次执行命令时重新连接
+			conn.dropNode(addr)
+			return nil, err
+		}
+		kind, slot, target, ok := parseRedisRedirect(reply)
+		if !ok {
+			return reply, nil
+		}
+		conn.writeString(fmt.Sprintf("-> Redirected to slot [%s] located at %s\n", slot, target))
+		addr, asking = target, kind == "ASK"
+		if !asking {
+			conn.addr = target
+		}
+	}
+	return nil, errors.New("too many cluster redirections")
+}
+
+// node 返回节点的连接, 不存在时使用相同的认证信息建立连接
+func (conn *RedisConsoleConn) node(addr string) (radix.Conn, error) {
+	conn.mu.Lock()
+	node, ok := conn.nodes[addr]
+	conn.mu.Unlock()
+	if ok {
+		return node, nil
+	}
+	opts := conn.dialOpts
+	if conn.db != 0 {
+		opts = append(opts[:len(opts):len(opts)], radix.DialSelectDB(conn.db))
+	}
+	node, err := radix.Dial("tcp", addr, opts...)
+	if err != nil {
+		return nil, err
+	}
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	select {
+	case <-conn.done:
+		_ = node.Close()
+		return nil, io.ErrClosedPipe
+	default:
+	}
+	conn.nodes[addr] = node
+	return node, nil
+}
+
+func (conn *RedisConsoleConn) dropNode(addr string) {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	if node, ok := conn.nodes[addr]; ok {
+		_ = node.Close()
+		delete(conn.nodes, addr)
+	}
+}
+
+func (conn *RedisConsoleConn) setRunning(node radix.Conn) {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	conn.running = node
+}
+
+// interrupt 用户输入 Ctrl+C 时关闭正在执行命令的连接, 用于中断 BLPOP 等阻塞命令
+func (conn *RedisConsoleConn) interrupt() {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	if conn.running != nil {
+		_ = conn.running.Close()
+	}
+}
+
+// autoComplete 按 Tab 时补全命令名
+func (conn *RedisConsoleConn) autoComplete(line string, pos int, key rune) (string, int, bool) {
+	if key != '\t' || strings.ContainsAny(line[:pos], " \t") {
+		return "", 0, false
+	}
+	prefix := strings.ToUpper(line[:pos])
+	var matches []string
+	for _, name := range redisConsoleCommands {
+		if strings.HasPrefix(name, prefix) {
+			matches = append(matches, name)
+		}
+	}
+	if len(matches) == 0 {
+		return "", 0, false
+	}
+	completed := commonPrefix(matches)
+	if len(matches) == 1 {
+		completed += " "
+	} else if completed == prefix {
+		conn.writeString(strings.Join(matches, "  ") + "\n")
+		return line, pos, true
+	}
+	if line[:pos] == strings.ToLower(line[:pos]) {
+		completed = strings.ToLower(completed)
+	}
+	return completed + line[pos:], len(completed), true
+}
+
+func (conn *RedisConsoleConn) writeString(s string) {
+	_, _ = conn.term.Write([]byte(s))
+}
+
+func commonPrefix(names []string) string {
+	sort.Strings(names)
+	first, last := names[0], names[len(names)-1]
+	i := 0
+	for i < len(first) && i < len(last) && first[i] == last[i] {
+		i++
+	}
+	return first[:i]
+}
+
+// parseRedisRedirect 解析集群的 -MOVED <slot> <addr> 和 -ASK <slot> <addr> 回复
+func parseRedisRedirect(reply []byte) (kind, slot, addr string, ok bool) {
+	if !bytes.HasPrefix(reply, []byte("-MOVED ")) && !bytes.HasPrefix(reply, []byte("-ASK ")) {
+		return "", "", "", false
+	}
+	fields := strings.Fields(string(reply[1:]))
+	if len(fields) != 3 {
+		return "", "", "", false
+	}
+	return fields[0], fields[1], fields[2], true
+}
+
+// splitRedisArgs 按 redis-cli 的规则拆分参数, 支持双引号中的转义和单引号
+func splitRedisArgs(line string) ([]string, error) {
+	var args []string
+	i := 0
+	for {
+		for i < len(line) && isRedisArgSpace(line[i]) {
+			i++
+		}
+		if i == len(line) {
+			return args, nil
+		}
+		var (
+			arg   []byte
+			quote byte
+		)
+		if line[i] == '"' || line[i] == '\'' {
+			quote = line[i]
+			i++
+		}
+		for {
+			if i == len(line) {
+				if quote != 0 {
+					return nil, errRedisInvalidArgs
+				}
+				break
+			}
+			c := line[i]
+			if quote == 0 {
+				if isRedisArgSpace(c) {
+					break
+				}
+				arg = append(arg, c)
+				i++
+				continue
+			}
+			if c == quote {
+				// 结束的引号之后必须是空白或者结尾
+				if i+1 < len(line) && !isRedisArgSpace(line[i+1]) {
+					return nil, errRedisInvalidArgs
+				}
+				i++
+				break
+			}
+			if c == '\\' && i+1 < len(line) {
+				if quote == '\'' {
+					if line[i+1] == '\'' {
+						arg = append(arg, '\'')
+						i += 2
+						continue
+					}
+				} else if b, n := unescapeRedisChar(line[i+1:]); n > 0 {
+					arg = append(arg, b)
+					i += n + 1
+					continue
+				}
+			}
+			arg = append(arg, c)
+			i++
+		}
+		args = append(args, string(arg))
+	}
+}
+
+// unescapeRedisChar 解析双引号中 \ 之后的转义字符, 返回字符和使用的长度
+func unescapeRedisChar(s string) (byte, int) {
+	switch s[0] {
+	case 'n':
+		return '\n', 1
+	case 'r':
+		return '\r', 1
+	case 't':
+		return '\t', 1
+	case 'b':
+		return '\b', 1
+	case 'a':
+		return '\a', 1
+	case 'x':
+		if len(s) >= 3 {
+			if v, err := strconv.ParseUint(s[1:3], 16, 8); err == nil {
+				return byte(v), 3
+			}
+		}
+	}
+	return s[0], 1
+}
+
+func isRedisArgSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r'
+}
+
+// formatRedisCommand 以 redis-cli 的格式输出命令, 用于命令记录, 隐藏 AUTH 的密码
+func formatRedisCommand(args []string) string {
+	parts := make([]string, len(args))
+	for i, arg := range args {
+		switch {
+		case i == 0:
+			parts[i] = arg
+		case strings.EqualFold(args[0], "AUTH") && i == len(args)-1,
+			strings.EqualFold(args[0], "HELLO") && i >= 3 && strings.EqualFold(args[i-2], "AUTH"):
+			parts[i] = redisMaskedArgValue
+		default:
+			parts[i] = quoteRedisArg(arg)
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+func quoteRedisArg(arg string) string {
+	if arg == "" {
+		return `""`
+	}
+	for i := 0; i < len(arg); i++ {
+		if c := arg[i]; c <= ' ' || c == '"' || c == '\'' || c == '\\' || c >= 0x7f {
+			return formatRedisBulkString([]byte(arg))
+		}
+	}
+	return arg
+}
+
+// formatRedisBulkString 按 redis-cli 的方式转义字符串
+func formatRedisBulkString(s []byte) string {
+	var buf strings.Builder
+	buf.WriteByte('"')
+	for _, c := range s {
+		switch c {
+		case '\\', '"':
+			buf.WriteByte('\\')
+			buf.WriteByte(c)
+		case '\n':
+			buf.WriteString(`\n`)
+		case '\r':
+			buf.WriteString(`\r`)
+		case '\t':
+			buf.WriteString(`\t`)
+		default:
+			if c < ' ' || c >= 0x7f {
+				buf.WriteString(fmt.Sprintf(`\x%02x`, c))
+			} else {
+				buf.WriteByte(c)
+			}
+		}
+	}
+	buf.WriteByte('"')
+	return buf.String()
+}
+
+// formatRedisReply 以 redis-cli 的格式输出 RESP2 回复
+func formatRedisReply(reply []byte) string {
+	output, _, err := formatRedisValue(reply, "")
+	if err != nil {
+		return "(error) " + err.Error()
+	}
+	return output
+}
+
+func formatRedisValue(b []byte, indent string) (string, []byte, error) {
+	end := bytes.Index(b, []byte("\r\n"))
+	if end < 1 {
+		return "", nil, errors.New("malformed reply")
+	}
+	body, rest := string(b[1:end]), b[end+2:]
+	switch b[0] {
+	case '+':
+		return body, rest, nil
+	case '-':
+		return "(error) " + body, rest, nil
+	case ':':
+		return "(integer) " + body, rest, nil
+	case '$':
+		n, err := strconv.Atoi(body)
+		if err != nil {
+			return "", nil, err
+		}
+		if n < 0 {
+			return "(nil)", rest, nil
+		}
+		if len(rest) < n+2 {
+			return "", nil, errors.New("malformed reply")
+		}
+		return formatRedisBulkString(rest[:n]), rest[n+2:], nil
+	case '*':
+		n, err := strconv.Atoi(body)
+		if err != nil {
+			return "", nil, err
+		}
+		switch {
+		case n < 0:
+			return "(nil)", rest, nil
+		case n == 0:
+			return "(empty array)", rest, nil
+		}
+		width := len(strconv.Itoa(n))
+		lines := make([]string, 0, n)
+		for i := 0; i < n; i++ {
+			prefix := fmt.Sprintf("%*d) ", width, i+1)
+			var item string
+			item, rest, err = formatRedisValue(rest, indent+strings.Repeat(" ", len(prefix)))
+			if err != nil {
+				return "", nil, err
+			}
+			if i > 0 {
+				prefix = indent + prefix
+			}
+			lines = append(lines, prefix+item)
+		}
+		return strings.Join(lines, "\n"), rest, nil
+	}
+	return "", nil, fmt.Errorf("unknown reply type %q", b[0])
+}
@@ -0,0 +1,205 @@
+package srvconn
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSplitRedisArgs(t *testing.T) {
+	tests := []struct {
+		line string
+		args []string
+		err  bool
+	}{
+		{"get foo", []string{"get", "foo"}, false},
+		{"  set  foo   bar  ", []string{"set", "foo", "bar"}, false},
+		{`set foo "hello world"`, []string{"set", "foo", "hello world"}, false},
+		{`set foo "a\nb\x41\"c"`, []string{"set", "foo", "a\nbA\"c"}, false},
+		{`set foo 'it\'s'`, []string{"set", "foo", "it's"}, false},
+		{`set foo 'a\nb'`, []string{"set", "foo", `a\nb`}, false},
+		{`set foo ""`, []string{"set", "foo", ""}, false},
+		{`set foo "bar`, nil, true},
+		{`set foo "bar"baz`, nil, true},
+		{"", nil, false},
+	}
+	for _, tt := range tests {
+		args, err := splitRedisArgs(tt.line)
+		if (err != nil) != tt.err {
+			t.Errorf("splitRedisArgs(%q) err = %v, want err %v", tt.line, err, tt.err)
+			continue
+		}
+		if !reflect.DeepEqual(args, tt.args) {
+			t.Errorf("splitRedisArgs(%q) = %q, want %q", tt.line, args, tt.args)
+		}
+	}
+}
+
+func TestFormatRedisReply(t *testing.T) {
+	tests := []struct {
+		reply string
+		want  string
+	}{
+		{"+OK\r\n", "OK"},
+		{"-ERR unknown command\r\n", "(error) ERR unknown command"},
+		{":42\r\n", "(integer) 42"},
+		{"$5\r\nhello\r\n", `"hello"`},
+		{"$2\r\n\x00\n\r\n", `"\x00\n"`},
+		{"$-1\r\n", "(nil)"},
+		{"*0\r\n", "(empty array)"},
+		{"*-1\r\n", "(nil)"},
+		{"*2\r\n$1\r\na\r\n:1\r\n", "1) \"a\"\n2) (integer) 1"},
+		{"*2\r\n*2\r\n$1\r\na\r\n$1\r\nb\r\n$1\r\nc\r\n", "1) 1) \"a\"\n   2) \"b\"\n2) \"c\""},
+	}
+	for _, tt := range tests {
+		if got := formatRedisReply([]byte(tt.reply)); got != tt.want {
+			t.Errorf("formatRedisReply(%q) = %q, want %q", tt.reply, got, tt.want)
+		}
+	}
+	var items strings.Builder
+	items.WriteString("*10\r\n")
+	for i := 1; i <= 10; i++ {
+		items.WriteString(":" + strconv.Itoa(i) + "\r\n")
+	}
+	if got := formatRedisReply([]byte(items.String())); !strings.HasPrefix(got, " 1) (integer) 1\n") ||
+		!strings.HasSuffix(got, "10) (integer) 10") {
+		t.Errorf("formatRedisReply pads indexes incorrectly: %q", got)
+	}
+}
+
+func TestFormatRedisCommand(t *testing.T) {
+	tests := map[string][]string{
+		"get foo":                   {"get", "foo"},
+		`set foo "hello world"`:     {"set", "foo", "hello world"},
+		`set "" "\x00"`:             {"set", "", "\x00"},
+		`set foo "say \"hi\""`:      {"set", "foo", `say "hi"`},
+		`set foo "multi\nline"`:     {"set", "foo", "multi\nline"},
+		"AUTH ******":               {"AUTH", "secret"},
+		"auth admin ******":         {"auth", "admin", "secret"},
+		"HELLO 3 AUTH admin ******": {"HELLO", "3", "AUTH", "admin", "secret"},
+	}
+	for want, args := range tests {
+		if got := formatRedisCommand(args); got != want {
+			t.Errorf("formatRedisCommand(%q) = %q, want %q", args, got, want)
+		}
+	}
+}
+
+// fakeRedisNode 按命令名回复固定内容, 用于测试集群重定向
+func fakeRedisNode(t *testing.T, replies map[string]string) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(c net.Conn) {
+				defer c.Close()
+				r := bufio.NewReader(c)
+				for {
+					args, err := readRedisCommand(r)
+					if err != nil {
+						return
+					}
+					reply, ok := replies[strings.ToUpper(args[0])]
+					if !ok {
+						reply = fmt.Sprintf("-ERR unknown command '%s'\r\n", args[0])
+					}
+					if _, err = c.Write([]byte(reply)); err != nil {
+						return
+					}
+				}
+			}(c)
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func readRedisCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, n)
+	for i := range args {
+		if line, err = r.ReadString('\n'); err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, size+2)
+		if _, err = io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		args[i] = string(buf[:size])
+	}
+	return args, nil
+}
+
+func TestRedisConsoleConnRedirect(t *testing.T) {
+	target := fakeRedisNode(t, map[string]string{"GET": "$3\r\nbar\r\n"})
+	source := fakeRedisNode(t, map[string]string{
+		"GET":  "-MOVED 12182 " + target + "\r\n",
+		"PING": "+PONG\r\n",
+	})
+	host, port, _ := net.SplitHostPort(source)
+	portNum, _ := strconv.Atoi(port)
+	conn, err := NewRedisConsoleConnection(SqlHost(host), SqlPort(portNum))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	output := &shellOutput{}
+	done := make(chan struct{})
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, err := conn.Read(buf)
+			_, _ = output.Write(buf[:n])
+			if err != nil {
+				close(done)
+				return
+			}
+		}
+	}()
+	output.waitFor(t, source+"> ")
+
+	_, _ = conn.Write([]byte("ping\r"))
+	output.waitFor(t, "PONG")
+	_, _ = conn.Write([]byte("get foo\r"))
+	output.waitFor(t, "-> Redirected to slot [12182] located at "+target)
+	output.waitFor(t, `"bar"`)
+	output.waitFor(t, target+"> ")
+	for _, want := range []string{"ping", "get foo"} {
+		stmt := <-conn.ExecutedStatements()
+		if stmt.Input != want {
+			t.Errorf("command input = %q, want %q", stmt.Input, want)
+		}
+	}
+	_, _ = conn.Write([]byte("subscribe news\r"))
+	output.waitFor(t, "SUBSCRIBE is not supported")
+	_, _ = conn.Write([]byte("exit\r"))
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("console did not exit")
+	}
+}
@@ -0,0 +1,606 @@
+package srvconn
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/meowgen/koko/pkg/common"
+	"github.com/meowgen/koko/pkg/guardrail"
+	"github.com/meowgen/koko/pkg/logger"
+	"github.com/meowgen/koko/pkg/sqlparser"
+	"github.com/meowgen/koko/pkg/utils"
+)
+
+const (
+	// sqlShellMaxRows 查询结果最多显示的行数
+	sqlShellMaxRows = 1000
+
+	// sqlShellMaxColumnWidth 表格输出时每列最大宽度, 超出的部分截断
+	sqlShellMaxColumnWidth = 64
+
+	sqlShellContinuePrompt = "    -> "
+)
+
+var (
+	_ ServerConnection    = (*SQLShellConn)(nil)
+	_ StatementConnection = (*SQLShellConn)(nil)
+)
+
+// 内置 SQL 终端支持的协议和对应的数据库驱动
+var sqlShellDrivers = map[string]string{
+	ProtocolMySQL:      "mysql",
+	ProtocolMariadb:    "mysql",
+	ProtocolPostgreSQL: "postgres",
+	ProtocolSQLServer:  "mssql",
+	ProtocolOracle:     "godror",
+	ProtocolSQLite:     "sqlite3",
+}
+
+// 查看所有表的语句, 用于 \dt 和 show tables
+var sqlShellListTables = map[string]string{
+	ProtocolMySQL:      "SHOW TABLES",
+	ProtocolMariadb:    "SHOW TABLES",
+	ProtocolPostgreSQL: "SELECT schemaname AS schema, tablename AS name, tableowner AS owner FROM pg_catalog.pg_tables WHERE schemaname NOT IN ('pg_catalog', 'information_schema') ORDER BY 1, 2",
+	ProtocolSQLServer:  "SELECT TABLE_SCHEMA AS [schema], TABLE_NAME AS name, TABLE_TYPE AS type FROM INFORMATION_SCHEMA.TABLES ORDER BY 1, 2",
+	ProtocolOracle:     "SELECT table_name FROM user_tables ORDER BY table_name",
+	ProtocolSQLite:     "SELECT name FROM sqlite_master WHERE type = 'table' AND name NOT LIKE 'sqlite_%' ORDER BY name",
+}
+
+// 以这些关键字开头的语句会返回结果集, 使用 Query 执行
+var sqlShellQueryKeywords = map[string]bool{
+	"select":   true,
+	"show":     true,
+	"desc":     true,
+	"describe": true,
+	"explain":  true,
+	"with":     true,
+	"pragma":   true,
+	"values":   true,
+	"table":    true,
+	"call":     true,
+	"exec":     true,
+	"execute":  true,
+}
+
+const sqlShellHelp = `List of commands:
+  \dt, show tables    list tables
+  \x                  toggle expanded output
+  \c                  clear the current input statement
+  \q, exit, quit      quit the shell
+  \?, help            show this help
+
+Statements are terminated by ";" and may span multiple lines.
+`
+
+// IsSQLShellProtocol 判断协议是否可以使用内置 SQL 终端连接
+func IsSQLShellProtocol(protocol string) bool {
+	_, ok := sqlShellDrivers[protocol]
+	return ok
+}
+
+// NewSQLShellConnection 使用数据库驱动直接连接数据库, 在进程内提供 SQL 终端, 不依赖本地的数据库客户端
+func NewSQLShellConnection(protocol string, ops ...SqlOption) (*SQLShellConn, error) {
+	driver, ok := sqlShellDrivers[protocol]
+	if !ok {
+		return nil, ErrUnSupportedProtocol
+	}
+	args := &sqlOption{
+		Host: "127.0.0.1",
+		win: Windows{
+			Width:  80,
+			Height: 120,
+		},
+	}
+	for _, setter := range ops {
+		setter(args)
+	}
+	db, err := sql.Open(driver, args.SQLShellDataSourceName(protocol))
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	// 使用同一个连接执行所有语句, 保留 USE, SET 等会话状态
+	dbConn, err := db.Conn(ctx)
+	if err == nil {
+		err = dbConn.PingContext(ctx)
+	}
+	if err != nil {
+		cancel()
+		if dbConn != nil {
+			_ = dbConn.Close()
+		}
+		_ = db.Close()
+		return nil, err
+	}
+	outReader, outWriter := io.Pipe()
+	conn := &SQLShellConn{
+		protocol:   protocol,
+		options:    args,
+		db:         db,
+		conn:       dbConn,
+		ctx:        ctx,
+		cancel:     cancel,
+		input:      newConsoleInput(),
+		statements: make(chan *ExecutedStatement, 64),
+		outReader:  outReader,
+		outWriter:  outWriter,
+	}
+	if dialect, ok := sqlparser.DialectFromProtocol(protocol); ok {
+		conn.classifier = sqlparser.NewClassifier(dialect, args.DBName)
+	}
+	conn.term = utils.NewTerminal(&consoleIO{in: conn.input, out: outWriter}, conn.prompt())
+	_ = conn.term.SetSize(args.win.Width, args.win.Height)
+	conn.loadThreadID()
+	go conn.run()
+	return conn, nil
+}
+
+// SQLShellConn 是内置的 SQL 终端, 用户的输入经过行编辑之后按语句在数据库执行
+type SQLShellConn struct {
+	protocol string
+	options  *sqlOption
+
+	db     *sql.DB
+	conn   *sql.Conn
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	term      *utils.Terminal
+	input     *consoleInput
+	outReader *io.PipeReader
+	outWriter *io.PipeWriter
+
+	expanded bool
+
+	statements chan *ExecutedStatement
+	// classifier 识别语句的类型和操作的对象, 不支持的方言为空
+	classifier *sqlparser.Classifier
+
+	// 用户输入 Ctrl+C 时取消正在执行的语句, 并丢弃未结束的输入
+	mu          sync.Mutex
+	stmtCancel  context.CancelFunc
+	interrupted bool
+
+	// threadID 是 MySQL 连接的线程 ID, txTimer 在事务开始时按查询限制计时
+	threadID int64
+	txTimer  *time.Timer
+
+	closeOnce sync.Once
+}
+
+// ExecutedStatements 返回已执行的语句, 会话使用它按语句记录命令
+func (conn *SQLShellConn) ExecutedStatements() <-chan *ExecutedStatement {
+	return conn.statements
+}
+
+func (conn *SQLShellConn) Read(p []byte) (int, error) {
+	return conn.outReader.Read(p)
+}
+
+func (conn *SQLShellConn) Write(p []byte) (int, error) {
+	if bytes.IndexByte(p, 3) >= 0 {
+		conn.interrupt()
+	}
+	return conn.input.Write(p)
+}
+
+func (conn *SQLShellConn) SetWinSize(width, height int) error {
+	return conn.term.SetSize(width, height)
+}
+
+func (conn *SQLShellConn) KeepAlive() error {
+	return nil
+}
+
+func (conn *SQLShellConn) Close() error {
+	var err error
+	conn.closeOnce.Do(func() {
+		conn.cancel()
+		conn.stopTransactionTimer()
+		_ = conn.input.Close()
+		_ = conn.outWriter.Close()
+		conn.mu.Lock()
+		_ = conn.conn.Close()
+		conn.mu.Unlock()
+		err = conn.db.Close()
+	})
+	return err
+}
+
+func (conn *SQLShellConn) prompt() string {
+	return conn.protocol + "> "
+}
+
+func (conn *SQLShellConn) run() {
+	defer conn.Close()
+	conn.writeString(fmt.Sprintf("Welcome to the %s shell. Type \\? for help.\n\n", conn.protocol))
+	backslashEscape := sqlShellDrivers[conn.protocol] == "mysql"
+	var pending string
+	for {
+		line, err := conn.term.ReadLine()
+		if err != nil && !errors.Is(err, utils.ErrPasteIndicator) {
+			if err != io.EOF {
+				logger.Debugf("SQL shell read line err: %s", err)
+			}
+			return
+		}
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case trimmed == `\c`, trimmed == "" && conn.takeInterrupt():
+			pending = ""
+		case pending == "":
+			if quit, ok := conn.handleMetaCommand(trimmed); ok {
+				if quit {
+					return
+				}
+				continue
+			}
+			fallthrough
+		default:
+			var stmts []string
+			stmts, pending = splitSQLStatements(pending+line+"\n", backslashEscape)
+			for _, stmt := range stmts {
+				conn.execute(stmt, stmt)
+			}
+		}
+		if strings.TrimSpace(pending) == "" {
+			pending = ""
+			conn.term.SetPrompt(conn.prompt())
+		} else {
+			conn.term.SetPrompt(sqlShellContinuePrompt)
+		}
+	}
+}
+
+// handleMetaCommand 处理终端命令, 返回是否退出和是否已处理
+func (conn *SQLShellConn) handleMetaCommand(line string) (quit bool, ok bool) {
+	cmd := strings.ToLower(strings.TrimSpace(strings.TrimSuffix(line, ";")))
+	switch cmd {
+	case "":
+		return false, true
+	case `\q`, "exit", "quit":
+		return true, true
+	case `\?`, "help":
+		conn.writeString(sqlShellHelp)
+	case `\x`:
+		conn.expanded = !conn.expanded
+		if conn.expanded {
+			conn.writeString("Expanded display is on.\n")
+		} else {
+			conn.writeString("Expanded display is off.\n")
+		}
+	case `\dt`, "show tables":
+		conn.execute(line, sqlShellListTables[conn.protocol])
+	default:
+		return false, false
+	}
+	return false, true
+}
+
+// execute 执行语句并输出结果, input 是用户输入的命令, 用于命令记录
+func (conn *SQLShellConn) execute(input, stmt string) {
+	ctx, cancel := context.WithCancel(conn.ctx)
+	conn.mu.Lock()
+	conn.stmtCancel = cancel
+	conn.mu.Unlock()
+	defer func() {
+		conn.mu.Lock()
+		conn.stmtCancel = nil
+		conn.mu.Unlock()
+		cancel()
+	}()
+
+	guard := conn.options.guard
+	var violations []string
+	createdAt := time.Now()
+	stopTimer := conn.startStatementTimer(cancel)
+	output, truncated, err := conn.runStatement(ctx, stmt)
+	timedOut := stopTimer()
+	if truncated {
+		violations = append(violations, guard.Violation(guardrail.ViolationMaxRows))
+	}
+	if timedOut {
+		violations = append(violations, guard.Violation(guardrail.ViolationStatementTimeout))
+	}
+	var classified []*sqlparser.Statement
+	if conn.classifier != nil {
+		classified = conn.classifier.Classify(stmt)
+	}
+	switch {
+	case err != nil && timedOut:
+		output = "ERROR: " + guard.StatementTimedOut()
+		conn.writeString(utils.WrapperWarn(output) + "\n\n")
+		conn.resetConnIfBroken()
+	case err != nil:
+		output = "ERROR: " + err.Error()
+		conn.writeString(utils.WrapperWarn(output) + "\n\n")
+		conn.resetConnIfBroken()
+	default:
+		conn.writeString(output)
+		conn.trackTransaction(classified)
+	}
+	conn.recordStatement(input, output, createdAt, classified, violations)
+}
+
+// runStatement 执行语句并返回输出, 同时返回结果集是否被查询限制截断
+func (conn *SQLShellConn) runStatement(ctx context.Context, stmt string) (string, bool, error) {
+	start := time.Now()
+	if !isSQLQueryStatement(stmt) {
+		result, err := conn.conn.ExecContext(ctx, stmt)
+		if err != nil {
+			return "", false, err
+		}
+		affected, _ := result.RowsAffected()
+		return fmt.Sprintf("Query OK, %d %s affected (%s)\n\n",
+			affected, pluralRows(affected), formatSQLDuration(time.Since(start))), false, nil
+	}
+	rows, err := conn.conn.QueryContext(ctx, stmt)
+	if err != nil {
+		return "", false, err
+	}
+	defer rows.Close()
+	limit, guarded := conn.rowLimit()
+	columns, data, truncated, err := readSQLRows(rows, limit)
+	if err != nil {
+		return "", false, err
+	}
+	elapsed := formatSQLDuration(time.Since(start))
+	var b strings.Builder
+	switch {
+	case len(columns) == 0:
+		return fmt.Sprintf("Query OK (%s)\n\n", elapsed), false, nil
+	case len(data) == 0:
+		return fmt.Sprintf("Empty set (%s)\n\n", elapsed), false, nil
+	case conn.expanded:
+		b.WriteString(formatSQLRecords(columns, data))
+	default:
+		b.WriteString(formatSQLTable(columns, data))
+	}
+	switch {
+	case truncated && guarded:
+		b.WriteString(utils.WrapperWarn(conn.options.guard.RowsTruncated()) + "\n")
+	case truncated:
+		b.WriteString(fmt.Sprintf("Only the first %d rows are displayed\n", sqlShellMaxRows))
+	}
+	count := int64(len(data))
+	b.WriteString(fmt.Sprintf("%d %s in set (%s)\n\n", count, pluralRows(count), elapsed))
+	return b.String(), truncated && guarded, nil
+}
+
+// recordStatement 按语句生成命令记录, 会话结束时丢弃未读取的记录
+func (conn *SQLShellConn) recordStatement(input, output string, createdAt time.Time, stmts []*sqlparser.Statement,
+	violations []string) {
+	executed := &ExecutedStatement{Input: input, Output: output, CreatedDate: createdAt, Statements: stmts,
+		Violations: violations}
+	select {
+	case conn.statements <- executed:
+	case <-conn.ctx.Done():
+	}
+}
+
+func (conn *SQLShellConn) interrupt() {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	conn.interrupted = true
+	if conn.stmtCancel != nil {
+		conn.stmtCancel()
+	}
+}
+
+// takeInterrupt 返回用户是否输入过 Ctrl+C, 并清除该状态
+func (conn *SQLShellConn) takeInterrupt() bool {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	interrupted := conn.interrupted
+	conn.interrupted = false
+	return interrupted
+}
+
+// resetConnIfBroken 连接已断开(如取消了执行中的语句)时重新获取连接
+func (conn *SQLShellConn) resetConnIfBroken() {
+	if conn.ctx.Err() != nil || conn.conn.PingContext(conn.ctx) == nil {
+		return
+	}
+	dbConn, err := conn.db.Conn(conn.ctx)
+	if err != nil {
+		logger.Errorf("SQL shell reconnect err: %s", err)
+		return
+	}
+	conn.mu.Lock()
+	oldConn := conn.conn
+	conn.conn = dbConn
+	conn.mu.Unlock()
+	_ = oldConn.Close()
+	conn.stopTransactionTimer()
+	conn.loadThreadID()
+	conn.writeString("Connection was reset, session state is lost.\n\n")
+}
+
+func (conn *SQLShellConn) writeString(s string) {
+	_, _ = conn.term.Write([]byte(s))
+}
+
+func (opt *sqlOption) SQLShellDataSourceName(protocol string) string {
+	switch protocol {
+	case ProtocolPostgreSQL:
+		return opt.PostgreSQLDataSourceName()
+	case ProtocolSQLServer:
+		return opt.SQLServerSourceName()
+	case ProtocolOracle:
+		return fmt.Sprintf("user=%q password=%q connectString=%q",
+			opt.Username, opt.Password, fmt.Sprintf("%s:%d/%s", opt.Host, opt.Port, opt.DBName))
+	case ProtocolSQLite:
+		mode := "rw"
+		if opt.CreateDbIfNotExist {
+			mode = "rwc"
+		}
+		return fmt.Sprintf("file:%s?mode=%s", opt.PathToDb, mode)
+	}
+	return opt.DataSourceName()
+}
+
+// splitSQLStatements 按引号和注释之外的分号拆分语句, 返回完整的语句和剩余未结束的输入
+func splitSQLStatements(input string, backslashEscape bool) ([]string, string) {
+	var (
+		stmts []string
+		start int
+		quote byte
+	)
+	for i := 0; i < len(input); i++ {
+		c := input[i]
+		switch {
+		case quote == '-':
+			if c == '\n' {
+				quote = 0
+			}
+		case quote == '*':
+			if c == '*' && i+1 < len(input) && input[i+1] == '/' {
+				quote = 0
+				i++
+			}
+		case quote != 0:
+			if c == '\\' && backslashEscape && quote != '`' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"' || c == '`':
+			quote = c
+		case c == '-' && i+1 < len(input) && input[i+1] == '-':
+			quote = '-'
+			i++
+		case c == '#' && backslashEscape:
+			quote = '-'
+		case c == '/' && i+1 < len(input) && input[i+1] == '*':
+			quote = '*'
+			i++
+		case c == ';':
+			if stmt := strings.TrimSpace(input[start:i]); stmt != "" {
+				stmts = append(stmts, stmt)
+			}
+			start = i + 1
+		}
+	}
+	return stmts, input[start:]
+}
+
+// isSQLQueryStatement 判断语句是否返回结果集
+func isSQLQueryStatement(stmt string) bool {
+	stmt = strings.TrimLeft(stmt, "( \t\r\n")
+	end := strings.IndexFunc(stmt, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z')
+	})
+	if end >= 0 {
+		stmt = stmt[:end]
+	}
+	return sqlShellQueryKeywords[strings.ToLower(stmt)]
+}
+
+// readSQLRows 读取最多 limit 行结果, 所有值转换为字符串
+func readSQLRows(rows *sql.Rows, limit int) ([]string, [][]string, bool, error) {
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, nil, false, err
+	}
+	var data [][]string
+	values := make([]interface{}, len(columns))
+	dest := make([]interface{}, len(columns))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+	for rows.Next() {
+		if len(data) == limit {
+			return columns, data, true, nil
+		}
+		if err = rows.Scan(dest...); err != nil {
+			return nil, nil, false, err
+		}
+		row := make([]string, len(columns))
+		for i, v := range values {
+			row[i] = formatSQLValue(v)
+		}
+		data = append(data, row)
+	}
+	return columns, data, false, rows.Err()
+}
+
+func formatSQLValue(v interface{}) string {
+	switch value := v.(type) {
+	case nil:
+		return "NULL"
+	case []byte:
+		if utf8.Valid(value) {
+			return string(value)
+		}
+		return fmt.Sprintf("0x%X", value)
+	case time.Time:
+		return value.Format("2006-01-02 15:04:05.999999")
+	}
+	return fmt.Sprint(v)
+}
+
+// formatSQLTable 以表格输出查询结果
+func formatSQLTable(columns []string, data [][]string) string {
+	fields := make([]string, len(columns))
+	fieldsSize := make(map[string][3]int, len(columns))
+	for i := range columns {
+		fields[i] = strconv.Itoa(i)
+		fieldsSize[fields[i]] = [3]int{0, 0, sqlShellMaxColumnWidth}
+	}
+	tableData := make([]map[string]string, len(data))
+	for i, row := range data {
+		record := make(map[string]string, len(row))
+		for j, value := range row {
+			record[fields[j]] = strings.NewReplacer("\r", `\r`, "\n", `\n`, "\t", `\t`).Replace(value)
+		}
+		tableData[i] = record
+	}
+	table := common.WrapperTable{
+		Labels:      columns,
+		Fields:      fields,
+		FieldsSize:  fieldsSize,
+		Data:        tableData,
+		TruncPolicy: common.TruncSuffix,
+	}
+	table.Initial()
+	return table.Display()
+}
+
+// formatSQLRecords 以扩展格式输出查询结果, 每个字段一行
+func formatSQLRecords(columns []string, data [][]string) string {
+	var labelWidth int
+	for _, column := range columns {
+		if n := utf8.RuneCountInString(column); n > labelWidth {
+			labelWidth = n
+		}
+	}
+	var b strings.Builder
+	for i, row := range data {
+		b.WriteString(fmt.Sprintf("-[ RECORD %d ]%s\n", i+1, strings.Repeat("-", labelWidth)))
+		for j, value := range row {
+			padding := labelWidth - utf8.RuneCountInString(columns[j])
+			b.WriteString(columns[j] + strings.Repeat(" ", padding) + " | " + value + "\n")
+		}
+	}
+	return b.String()
+}
+
+func formatSQLDuration(d time.Duration) string {
+	return fmt.Sprintf("%.2f sec", d.Seconds())
+}
+
+func pluralRows(n int64) string {
+	if n == 1 {
+		return "row"
+	}
+	return "rows"
+}
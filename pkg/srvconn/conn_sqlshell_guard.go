@@ -0,0 +1,147 @@
+package srvconn
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/meowgen/koko/pkg/guardrail"
+	"github.com/meowgen/koko/pkg/logger"
+	"github.com/meowgen/koko/pkg/sqlparser"
+	"github.com/meowgen/koko/pkg/utils"
+)
+
+// SqlGuardrail 设置内置 SQL 终端的查询限制
+func SqlGuardrail(policy guardrail.Policy) SqlOption {
+	return func(args *sqlOption) {
+		args.guard = policy
+	}
+}
+
+// rowLimit 返回查询结果最多读取的行数, 以及是否由查询限制决定
+func (conn *SQLShellConn) rowLimit() (int, bool) {
+	maxRows := conn.options.guard.MaxRows
+	if maxRows > 0 && maxRows < sqlShellMaxRows {
+		return maxRows, true
+	}
+	return sqlShellMaxRows, false
+}
+
+// loadThreadID 记录 MySQL 连接的线程 ID, 语句超时后用于 KILL QUERY
+func (conn *SQLShellConn) loadThreadID() {
+	if conn.options.guard.StatementTimeout <= 0 || sqlShellDrivers[conn.protocol] != "mysql" {
+		return
+	}
+	var threadID int64
+	if err := conn.conn.QueryRowContext(conn.ctx, "SELECT CONNECTION_ID()").Scan(&threadID); err != nil {
+		logger.Errorf("SQL shell get connection id err: %s", err)
+		return
+	}
+	conn.mu.Lock()
+	conn.threadID = threadID
+	conn.mu.Unlock()
+}
+
+// startStatementTimer 语句超时后终止语句, MySQL 使用 KILL QUERY 以保留连接, 其他驱动取消执行的 context
+func (conn *SQLShellConn) startStatementTimer(cancel context.CancelFunc) (stop func() bool) {
+	timeout := conn.options.guard.StatementTimeout
+	if timeout <= 0 {
+		return func() bool { return false }
+	}
+	timedOut := make(chan struct{})
+	timer := time.AfterFunc(timeout, func() {
+		close(timedOut)
+		conn.mu.Lock()
+		threadID := conn.threadID
+		conn.mu.Unlock()
+		if threadID == 0 {
+			cancel()
+			return
+		}
+		ctx, cancelKill := context.WithTimeout(conn.ctx, 10*time.Second)
+		defer cancelKill()
+		if _, err := conn.db.ExecContext(ctx, fmt.Sprintf("KILL QUERY %d", threadID)); err != nil {
+			logger.Errorf("SQL shell kill query %d err: %s", threadID, err)
+			cancel()
+		}
+	})
+	return func() bool {
+		if timer.Stop() {
+			return false
+		}
+		<-timedOut
+		return true
+	}
+}
+
+// trackTransaction 按执行成功的语句开始或结束事务计时
+func (conn *SQLShellConn) trackTransaction(stmts []*sqlparser.Statement) {
+	timeout := conn.options.guard.TransactionTimeout
+	if timeout <= 0 {
+		return
+	}
+	for _, stmt := range stmts {
+		begin, end := transactionChange(conn.protocol, stmt)
+		conn.mu.Lock()
+		switch {
+		case begin && conn.txTimer == nil:
+			conn.txTimer = time.AfterFunc(timeout, conn.transactionTimeout)
+		case end && conn.txTimer != nil:
+			conn.txTimer.Stop()
+			conn.txTimer = nil
+		}
+		conn.mu.Unlock()
+	}
+}
+
+// stopTransactionTimer 连接重置或关闭时事务已结束
+func (conn *SQLShellConn) stopTransactionTimer() {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	if conn.txTimer != nil {
+		conn.txTimer.Stop()
+		conn.txTimer = nil
+	}
+}
+
+// transactionTimeout 回滚超时的事务并提示用户, 正在执行的语句结束后才会回滚
+func (conn *SQLShellConn) transactionTimeout() {
+	conn.mu.Lock()
+	conn.txTimer = nil
+	dbConn := conn.conn
+	conn.mu.Unlock()
+	guard := conn.options.guard
+	output := guard.TransactionTimedOut()
+	if _, err := dbConn.ExecContext(conn.ctx, "ROLLBACK"); err != nil {
+		if conn.ctx.Err() != nil {
+			return
+		}
+		logger.Errorf("SQL shell rollback timed out transaction err: %s", err)
+		output += ": " + err.Error()
+	}
+	conn.writeString("\n" + utils.WrapperWarn(output) + "\n")
+	var classified []*sqlparser.Statement
+	if conn.classifier != nil {
+		classified = conn.classifier.Classify("ROLLBACK")
+	}
+	violations := []string{guard.Violation(guardrail.ViolationTransactionTimeout)}
+	conn.recordStatement("ROLLBACK", output, time.Now(), classified, violations)
+}
+
+// transactionChange 判断语句是否开始或结束事务, ROLLBACK TO 回滚到保存点不结束事务
+func transactionChange(protocol string, stmt *sqlparser.Statement) (begin, end bool) {
+	text := strings.ToUpper(stmt.Text)
+	switch stmt.Type {
+	case "BEGIN":
+		// SQL Server 的 BEGIN 开始语句块, BEGIN TRAN 才开始事务
+		return protocol != ProtocolSQLServer || strings.HasPrefix(text, "BEGIN TRAN"), false
+	case "START":
+		return strings.HasPrefix(text, "START TRANSACTION"), false
+	case "COMMIT":
+		return false, true
+	case "ROLLBACK":
+		return false, !strings.Contains(text, " TO ")
+	}
+	return false, false
+}
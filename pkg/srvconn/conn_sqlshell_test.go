@@ -0,0 +1,215 @@
+package srvconn
+
+import (
+	"bytes"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/meowgen/koko/pkg/guardrail"
+	"github.com/meowgen/koko/pkg/sqlparser"
+)
+
+func TestSplitSQLStatements(t *testing.T) {
+	tests := []struct {
+		input           string
+		backslashEscape bool
+		stmts           []string
+		rest            string
+	}{
+		{"select 1;", false, []string{"select 1"}, ""},
+		{"select 1; select 2;\n", false, []string{"select 1", "select 2"}, "\n"},
+		{"select 1;\nselect", false, []string{"select 1"}, "\nselect"},
+		{"select ';' from t;", false, []string{"select ';' from t"}, ""},
+		{`select "a;b", ` + "`c;d`;", false, []string{`select "a;b", ` + "`c;d`"}, ""},
+		{"select 1 -- comment;\n;", false, []string{"select 1 -- comment;"}, ""},
+		{"select /* ; */ 1;", false, []string{"select /* ; */ 1"}, ""},
+		{"select 'it''s';", false, []string{"select 'it''s'"}, ""},
+		{`select 'a\';b';`, true, []string{`select 'a\';b'`}, ""},
+		{`select 'a\';b';`, false, []string{`select 'a\'`}, "b';"},
+		{"select 1 # comment;\n;", true, []string{"select 1 # comment;"}, ""},
+		{";;", false, nil, ""},
+	}
+	for _, tt := range tests {
+		stmts, rest := splitSQLStatements(tt.input, tt.backslashEscape)
+		if !reflect.DeepEqual(stmts, tt.stmts) || rest != tt.rest {
+			t.Errorf("splitSQLStatements(%q) = %q, %q, want %q, %q", tt.input, stmts, rest, tt.stmts, tt.rest)
+		}
+	}
+}
+
+func TestIsSQLQueryStatement(t *testing.T) {
+	tests := map[string]bool{
+		"SELECT 1":                      true,
+		"  select * from t":             true,
+		"(select 1) union (select 2)":   true,
+		"with t as (select 1) select *": true,
+		"show databases":                true,
+		"PRAGMA table_info(t)":          true,
+		"insert into t values (1)":      false,
+		"update t set a = 1":            false,
+		"selection":                     false,
+		"":                              false,
+	}
+	for stmt, want := range tests {
+		if got := isSQLQueryStatement(stmt); got != want {
+			t.Errorf("isSQLQueryStatement(%q) = %v, want %v", stmt, got, want)
+		}
+	}
+}
+
+// shellOutput 收集 SQL 终端的输出
+type shellOutput struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (o *shellOutput) Write(p []byte) (int, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.buf.Write(p)
+}
+
+func (o *shellOutput) waitFor(t *testing.T, substr string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		o.mu.Lock()
+		output := o.buf.String()
+		o.mu.Unlock()
+		if strings.Contains(output, substr) {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	t.Fatalf("output does not contain %q:\n%s", substr, o.buf.String())
+}
+
+func TestSQLShellConnSQLite(t *testing.T) {
+	conn, err := NewSQLShellConnection(ProtocolSQLite,
+		SqlPathToDb(filepath.Join(t.TempDir(), "test.db")),
+		SqlCreateDbIfNotExist(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	output := &shellOutput{}
+	done := make(chan struct{})
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, err := conn.Read(buf)
+			_, _ = output.Write(buf[:n])
+			if err != nil {
+				close(done)
+				return
+			}
+		}
+	}()
+	output.waitFor(t, "sqlite> ")
+
+	_, _ = conn.Write([]byte("create table users (id integer, name text);\r"))
+	output.waitFor(t, "Query OK, 0 rows affected")
+	_, _ = conn.Write([]byte("insert into users values (1, 'alice'),\r"))
+	output.waitFor(t, sqlShellContinuePrompt)
+	_, _ = conn.Write([]byte("(2, NULL);\r"))
+	output.waitFor(t, "Query OK, 2 rows affected")
+	for _, want := range []string{
+		"create table users (id integer, name text)",
+		"insert into users values (1, 'alice'),\n(2, NULL)",
+	} {
+		stmt := <-conn.ExecutedStatements()
+		if stmt.Input != want {
+			t.Errorf("statement input = %q, want %q", stmt.Input, want)
+		}
+	}
+	_, _ = conn.Write([]byte("\\dt\r"))
+	output.waitFor(t, "1 row in set")
+	_, _ = conn.Write([]byte("select id, name from users order by id;\r"))
+	output.waitFor(t, "2 rows in set")
+	output.waitFor(t, "NULL")
+	_, _ = conn.Write([]byte("\\x\r"))
+	output.waitFor(t, "Expanded display is on.")
+	_, _ = conn.Write([]byte("select name from users where id = 1;\r"))
+	output.waitFor(t, "-[ RECORD 1 ]")
+	output.waitFor(t, "name | alice")
+	_, _ = conn.Write([]byte("select * from missing;\r"))
+	output.waitFor(t, "no such table: missing")
+	_, _ = conn.Write([]byte("\\q\r"))
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("shell did not exit after \\q")
+	}
+}
+
+func TestSQLShellConnGuardrail(t *testing.T) {
+	conn, err := NewSQLShellConnection(ProtocolSQLite,
+		SqlPathToDb(filepath.Join(t.TempDir(), "test.db")),
+		SqlCreateDbIfNotExist(true),
+		SqlGuardrail(guardrail.Policy{MaxRows: 2}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	output := &shellOutput{}
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, err := conn.Read(buf)
+			_, _ = output.Write(buf[:n])
+			if err != nil {
+				return
+			}
+		}
+	}()
+	output.waitFor(t, "sqlite> ")
+
+	_, _ = conn.Write([]byte("create table t (id integer);\r"))
+	output.waitFor(t, "Query OK, 0 rows affected")
+	_, _ = conn.Write([]byte("insert into t values (1), (2), (3);\r"))
+	output.waitFor(t, "Query OK, 3 rows affected")
+	_, _ = conn.Write([]byte("select id from t;\r"))
+	output.waitFor(t, "Result truncated to 2 rows by query guardrail")
+	output.waitFor(t, "2 rows in set")
+	for i := 0; i < 2; i++ {
+		if stmt := <-conn.ExecutedStatements(); len(stmt.Violations) > 0 {
+			t.Errorf("statement %q should not violate guardrail", stmt.Input)
+		}
+	}
+	stmt := <-conn.ExecutedStatements()
+	if expected := []string{"max_rows=2"}; !reflect.DeepEqual(stmt.Violations, expected) {
+		t.Errorf("violations should be %v but %v", expected, stmt.Violations)
+	}
+}
+
+func TestTransactionChange(t *testing.T) {
+	classifier := sqlparser.NewClassifier(sqlparser.DialectMySQL, "test")
+	tests := []struct {
+		protocol   string
+		stmt       string
+		begin, end bool
+	}{
+		{ProtocolMySQL, "begin", true, false},
+		{ProtocolMySQL, "start transaction read only", true, false},
+		{ProtocolMySQL, "commit", false, true},
+		{ProtocolMySQL, "rollback", false, true},
+		{ProtocolMySQL, "rollback to savepoint a", false, false},
+		{ProtocolMySQL, "select 1", false, false},
+		{ProtocolSQLServer, "begin tran", true, false},
+		{ProtocolSQLServer, "begin", false, false},
+	}
+	for _, tt := range tests {
+		stmts := classifier.Classify(tt.stmt)
+		begin, end := transactionChange(tt.protocol, stmts[0])
+		if begin != tt.begin || end != tt.end {
+			t.Errorf("transactionChange(%s, %q) = %v, %v, want %v, %v",
+				tt.protocol, tt.stmt, begin, end, tt.begin, tt.end)
+		}
+	}
+}
@@ -32,16 +32,12 @@ func NewTelnetConnection(opts ...TelnetOption) (*TelnetConnection, error) {
 	var (
 		conn        net.Conn
 		err         error
-		proxyClient *SSHClient
+		proxyClient GatewayClient
 		client      *tclientlib.Client
 	)
 	dstAddr := net.JoinHostPort(cfg.Host, cfg.Port)
 	if cfg.proxySSHClientOptions != nil {
-		if proxyClient, err = getAvailableProxyClient(cfg.proxySSHClientOptions...); err != nil {
-			return nil, err
-		}
-		if conn, err = proxyClient.Dial("tcp", dstAddr); err != nil {
-			_ = proxyClient.Close()
+		if proxyClient, conn, err = DialGateway(cfg.proxySSHClientOptions, dstAddr); err != nil {
 			return nil, err
 		}
 	} else {
@@ -120,7 +116,7 @@ func newTelnetClient(conn net.Conn, cfg *TelnetConfig) (*tclientlib.Client, erro
 type TelnetConnection struct {
 	cfg       *TelnetConfig
 	conn      *tclientlib.Client
-	proxyConn *SSHClient
+	proxyConn GatewayClient
 
 	transformReader io.Reader
 	transformWriter io.Writer
@@ -0,0 +1,85 @@
+package srvconn
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/meowgen/koko/pkg/sqlparser"
+)
+
+// ExecutedStatement 是连接在进程内执行的一条语句或命令
+type ExecutedStatement struct {
+	Input       string
+	Output      string
+	CreatedDate time.Time
+
+	// Statements 是输入中语句的分类结果, 用于命令记录
+	Statements []*sqlparser.Statement
+	// Violations 是语句违反的查询限制
+	Violations []string
+}
+
+// StatementConnection 由按语句执行命令的连接实现, 会话按语句而不是按输入行记录命令
+type StatementConnection interface {
+	ExecutedStatements() <-chan *ExecutedStatement
+}
+
+// consoleIO 是内置终端中 utils.Terminal 的输入输出
+type consoleIO struct {
+	in  *consoleInput
+	out io.Writer
+}
+
+func (c *consoleIO) Read(p []byte) (int, error) {
+	return c.in.Read(p)
+}
+
+func (c *consoleIO) Write(p []byte) (int, error) {
+	return c.out.Write(p)
+}
+
+// consoleInput 缓存用户的输入, 命令执行期间用户的输入不会阻塞
+type consoleInput struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	buf    bytes.Buffer
+	closed bool
+}
+
+func newConsoleInput() *consoleInput {
+	in := &consoleInput{}
+	in.cond = sync.NewCond(&in.mu)
+	return in
+}
+
+func (in *consoleInput) Read(p []byte) (int, error) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	for in.buf.Len() == 0 && !in.closed {
+		in.cond.Wait()
+	}
+	if in.buf.Len() == 0 {
+		return 0, io.EOF
+	}
+	return in.buf.Read(p)
+}
+
+func (in *consoleInput) Write(p []byte) (int, error) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	if in.closed {
+		return 0, io.ErrClosedPipe
+	}
+	in.cond.Signal()
+	return in.buf.Write(p)
+}
+
+func (in *consoleInput) Close() error {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	in.closed = true
+	in.cond.Broadcast()
+	return nil
+}
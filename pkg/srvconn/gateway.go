@@ -0,0 +1,152 @@
+package srvconn
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/meowgen/koko/pkg/jms-sdk-go/model"
+	"github.com/meowgen/koko/pkg/logger"
+)
+
+// NewDomainGatewayOptions 返回连接网域中各个支持的网关的参数, 并登记到网关池中探测健康状态
+func NewDomainGatewayOptions(domain *model.Domain, timeout int) []SSHClientOptions {
+	supported := model.Domain{ID: domain.ID, Name: domain.Name}
+	for i := range domain.Gateways {
+		if IsSupportedGatewayProtocol(domain.Gateways[i].Protocol) {
+			supported.Gateways = append(supported.Gateways, domain.Gateways[i])
+		}
+	}
+	DefaultGatewayPool().Register(&supported)
+	proxyArgs := make([]SSHClientOptions, 0, len(supported.Gateways))
+	for i := range supported.Gateways {
+		proxyArg := NewGatewayOptions(&supported.Gateways[i], timeout)
+		proxyArg.gatewayDomain = domain.ID
+		proxyArgs = append(proxyArgs, proxyArg)
+	}
+	return proxyArgs
+}
+
+// NewGatewayOptions 返回连接网关的参数, 网关配置了跳板时依次经过每个跳板连接,
+// 每一跳使用自己的认证信息
+func NewGatewayOptions(gateway *model.Gateway, timeout int) SSHClientOptions {
+	var jump *SSHClientOptions
+	for i := range gateway.Jumps {
+		hop := gatewayHopOptions(&gateway.Jumps[i], timeout)
+		if jump != nil {
+			hop.proxySSHClientOptions = []SSHClientOptions{*jump}
+		}
+		jump = &hop
+	}
+	cfg := gatewayHopOptions(gateway, timeout)
+	if jump != nil {
+		cfg.proxySSHClientOptions = []SSHClientOptions{*jump}
+	}
+	cfg.gatewayID = gateway.ID
+	return cfg
+}
+
+func gatewayHopOptions(gateway *model.Gateway, timeout int) SSHClientOptions {
+	return SSHClientOptions{
+		Host:       gateway.IP,
+		Port:       strconv.Itoa(gateway.Port),
+		Username:   gateway.Username,
+		Password:   gateway.Password,
+		Passphrase: gateway.Password, // 兼容 带密码的private_key,
+		PrivateKey: gateway.PrivateKey,
+		Timeout:    timeout,
+		HostKeys:   gateway.SSHHostKeys,
+
+		gatewayProtocol: gateway.Protocol,
+	}
+}
+
+// DialGateway 按网关池的选择策略依次尝试网关, 返回网关的客户端和经网关到 dstAddr 的连接.
+// 网关可以是 SSH, SOCKS5 或 HTTP CONNECT 代理.
+// 网关连接失败或者网关无法连接 dstAddr 时切换到下一个网关. SSH 网关的连接在会话间共用
+func DialGateway(cfgs []SSHClientOptions, dstAddr string) (GatewayClient, net.Conn, error) {
+	pool := DefaultGatewayPool()
+	var lastErr error
+	ordered := pool.Order(cfgs)
+	for i := range ordered {
+		cfg := ordered[i]
+		var (
+			proxyClient GatewayClient
+			dstConn     net.Conn
+			err         error
+		)
+		if isProxyGateway(&cfg) {
+			proxyClient, dstConn, err = dialViaProxy(&cfg, dstAddr)
+		} else {
+			proxyClient, dstConn, err = dialViaGateway(&cfg, dstAddr)
+		}
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		pool.Report(cfg.gatewayID, 0, nil)
+		setGatewayLease(proxyClient, pool.Lease(cfg.gatewayID))
+		logger.Infof("Get gateway client(%s) success ", proxyClient)
+		return proxyClient, dstConn, nil
+	}
+	if lastErr != nil {
+		// 保留最后一个网关的错误, 主机密钥不一致等原因可以提示给用户
+		return nil, nil, &ConnectError{Kind: ErrNoAvailable, Err: lastErr}
+	}
+	return nil, nil, ErrNoAvailable
+}
+
+// setGatewayLease 把网关的连接计数交给 DialGateway 返回的客户端, 客户端 Close 时释放.
+// 连接失败时关闭的客户端和共用连接的其他引用没有 lease, 不影响网关的连接数
+func setGatewayLease(client GatewayClient, lease *gatewayLease) {
+	switch c := client.(type) {
+	case *SSHClient:
+		c.lease = lease
+	case *proxyGatewayClient:
+		c.lease = lease
+	default:
+		lease.Release()
+	}
+}
+
+// dialViaGateway 经网关连接 dstAddr, 复用的网关连接已经断开时重新连接网关
+func dialViaGateway(cfg *SSHClientOptions, dstAddr string) (*SSHClient, net.Conn, error) {
+	clients := DefaultGatewayClients()
+	for {
+		proxyClient, reused, err := clients.Get(cfg)
+		if err != nil {
+			logger.Errorf("Connect gateway %s err: %s", cfg.Host, err)
+			DefaultGatewayPool().Report(cfg.gatewayID, 0, err)
+			return nil, nil, err
+		}
+		dstConn, err := proxyClient.Dial("tcp", dstAddr)
+		if err == nil {
+			return proxyClient, dstConn, nil
+		}
+		timeout := time.Duration(cfg.Timeout) * time.Second
+		if reused && keepAlive(proxyClient, timeout) != nil {
+			logger.Errorf("Gateway client(%s) is broken, reconnect gateway", proxyClient)
+			clients.Invalidate(proxyClient)
+			_ = proxyClient.Close()
+			continue
+		}
+		_ = proxyClient.Close()
+		logger.Errorf("Gateway %s dial %s err: %s, try next gateway", proxyClient, dstAddr, err)
+		return nil, nil, fmt.Errorf("%w: %s", ErrGatewayDial, err)
+	}
+}
+
+// DropGatewayClient 释放无法连接目标的网关客户端. 共用的 SSH 网关连接已经断开时从缓存中移除,
+// 并在网关池中记录失败, 之后经 DialGateway 重新连接或者切换到其他网关
+func DropGatewayClient(client GatewayClient, dialErr error) {
+	if sshClient, ok := client.(*SSHClient); ok && sshClient.Cfg != nil {
+		timeout := time.Duration(sshClient.Cfg.Timeout) * time.Second
+		if err := keepAlive(sshClient, timeout); err != nil {
+			logger.Errorf("Gateway client(%s) is broken: %s", sshClient, err)
+			DefaultGatewayClients().Invalidate(sshClient)
+			DefaultGatewayPool().Report(sshClient.Cfg.gatewayID, 0, dialErr)
+		}
+	}
+	_ = client.Close()
+}
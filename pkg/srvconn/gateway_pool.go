@@ -0,0 +1,350 @@
+package srvconn
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/meowgen/koko/pkg/config"
+	"github.com/meowgen/koko/pkg/jms-sdk-go/model"
+	"github.com/meowgen/koko/pkg/logger"
+)
+
+// 网关的选择策略
+const (
+	// GatewayRoundRobin 在健康的网关间轮询
+	GatewayRoundRobin = "round_robin"
+	// GatewayLeastConnections 优先使用当前连接数最少的网关
+	GatewayLeastConnections = "least_connections"
+	// GatewayLowestLatency 优先使用探测延迟最低的网关
+	GatewayLowestLatency = "lowest_latency"
+)
+
+// gatewayExpireDuration 之后没有再使用的网关不再探测
+const gatewayExpireDuration = 30 * time.Minute
+
+// latencyWeight 是新的探测延迟在平滑延迟中的权重
+const latencyWeight = 0.3
+
+// ParseGatewayStrategy 解析网关选择策略, 为空时使用 lowest_latency
+func ParseGatewayStrategy(strategy string) (string, error) {
+	switch strategy = strings.ToLower(strings.TrimSpace(strategy)); strategy {
+	case "":
+		return GatewayLowestLatency, nil
+	case GatewayRoundRobin, GatewayLeastConnections, GatewayLowestLatency:
+		return strategy, nil
+	}
+	return "", fmt.Errorf("unknown gateway select strategy %q", strategy)
+}
+
+type gatewayState struct {
+	id     string
+	name   string
+	domain string
+	// addr 是直接连接的地址, 网关有跳板时为第一个跳板
+	addr string
+	// banner 表示 addr 是 SSH 服务, 探测时读取版本信息, 代理网关只检查 TCP 连接
+	banner bool
+
+	healthy     bool
+	latency     time.Duration
+	failures    int
+	conns       int
+	lastErr     string
+	lastChecked time.Time
+	lastUsed    time.Time
+}
+
+// GatewayPool 记录各网域网关的健康状态, 按选择策略排列可用的网关
+type GatewayPool struct {
+	strategy string
+
+	mu     sync.Mutex
+	states map[string]*gatewayState
+	// next 是每个网域轮询的位置
+	next map[string]int
+	now  func() time.Time
+}
+
+func NewGatewayPool(strategy string) *GatewayPool {
+	return &GatewayPool{
+		strategy: strategy,
+		states:   make(map[string]*gatewayState),
+		next:     make(map[string]int),
+		now:      time.Now,
+	}
+}
+
+// Register 登记网域的网关, 之后由后台探测其健康状态
+func (p *GatewayPool) Register(domain *model.Domain) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := p.now()
+	for i := range domain.Gateways {
+		gateway := &domain.Gateways[i]
+		state, ok := p.states[gateway.ID]
+		if !ok {
+			state = &gatewayState{id: gateway.ID, healthy: true}
+			p.states[gateway.ID] = state
+		}
+		state.name = gateway.String()
+		state.domain = domain.ID
+		state.addr, state.banner = gatewayAddr(gateway)
+		state.lastUsed = now
+	}
+}
+
+func gatewayAddr(gateway *model.Gateway) (string, bool) {
+	if len(gateway.Jumps) > 0 {
+		gateway = &gateway.Jumps[0]
+	}
+	banner := gateway.Protocol != model.GatewayProtocolSOCKS5 &&
+		gateway.Protocol != model.GatewayProtocolHTTP
+	return net.JoinHostPort(gateway.IP, strconv.Itoa(gateway.Port)), banner
+}
+
+// Order 按选择策略排列网关, 不健康的网关排在最后, 其他网关都不可用时仍会尝试
+func (p *GatewayPool) Order(cfgs []SSHClientOptions) []SSHClientOptions {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	healthy := make([]SSHClientOptions, 0, len(cfgs))
+	unhealthy := make([]SSHClientOptions, 0, len(cfgs))
+	for i := range cfgs {
+		if state, ok := p.states[cfgs[i].gatewayID]; ok && !state.healthy {
+			unhealthy = append(unhealthy, cfgs[i])
+			continue
+		}
+		healthy = append(healthy, cfgs[i])
+	}
+	switch p.strategy {
+	case GatewayRoundRobin:
+		if len(healthy) > 1 {
+			domain := healthy[0].gatewayDomain
+			start := p.next[domain] % len(healthy)
+			p.next[domain] = start + 1
+			rotated := make([]SSHClientOptions, 0, len(healthy))
+			rotated = append(rotated, healthy[start:]...)
+			healthy = append(rotated, healthy[:start]...)
+		}
+	case GatewayLeastConnections:
+		sort.SliceStable(healthy, func(i, j int) bool {
+			return p.conns(healthy[i].gatewayID) < p.conns(healthy[j].gatewayID)
+		})
+	case GatewayLowestLatency:
+		// 没有探测过的网关排在已知延迟的网关之后
+		sort.SliceStable(healthy, func(i, j int) bool {
+			li, lj := p.latency(healthy[i].gatewayID), p.latency(healthy[j].gatewayID)
+			if li == 0 || lj == 0 {
+				return lj == 0 && li != 0
+			}
+			return li < lj
+		})
+	}
+	return append(healthy, unhealthy...)
+}
+
+func (p *GatewayPool) conns(id string) int {
+	if state, ok := p.states[id]; ok {
+		return state.conns
+	}
+	return 0
+}
+
+func (p *GatewayPool) latency(id string) time.Duration {
+	if state, ok := p.states[id]; ok {
+		return state.latency
+	}
+	return 0
+}
+
+// Report 记录一次连接网关的结果, 连接失败的网关在下次成功前排在最后, latency 为 0 时不更新延迟
+func (p *GatewayPool) Report(id string, latency time.Duration, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	state, ok := p.states[id]
+	if !ok {
+		return
+	}
+	state.update(p.now(), latency, err)
+}
+
+func (s *gatewayState) update(now time.Time, latency time.Duration, err error) {
+	s.lastChecked = now
+	if err != nil {
+		s.healthy = false
+		s.failures++
+		s.lastErr = err.Error()
+		return
+	}
+	s.healthy = true
+	s.failures = 0
+	s.lastErr = ""
+	if latency <= 0 {
+		return
+	}
+	if s.latency == 0 {
+		s.latency = latency
+		return
+	}
+	s.latency = time.Duration(latencyWeight*float64(latency) + (1-latencyWeight)*float64(s.latency))
+}
+
+// Acquire 增加网关的连接数
+func (p *GatewayPool) Acquire(id string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if state, ok := p.states[id]; ok {
+		state.conns++
+		state.lastUsed = p.now()
+	}
+}
+
+// Release 减少网关的连接数
+func (p *GatewayPool) Release(id string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if state, ok := p.states[id]; ok && state.conns > 0 {
+		state.conns--
+	}
+}
+
+// gatewayLease 是经网关建立的一个连接在网关池中的计数, 创建时增加连接数, 只释放一次
+type gatewayLease struct {
+	pool     *GatewayPool
+	id       string
+	released int32
+}
+
+// Lease 增加网关的连接数, 返回的 lease 在连接关闭时释放
+func (p *GatewayPool) Lease(id string) *gatewayLease {
+	p.Acquire(id)
+	return &gatewayLease{pool: p, id: id}
+}
+
+// Release 减少 lease 对应网关的连接数, lease 为空或者已经释放时不处理
+func (l *gatewayLease) Release() {
+	if l != nil && atomic.CompareAndSwapInt32(&l.released, 0, 1) {
+		l.pool.Release(l.id)
+	}
+}
+
+// Status 返回所有网关的健康状态, 用于心跳上报
+func (p *GatewayPool) Status() []model.GatewayStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	status := make([]model.GatewayStatus, 0, len(p.states))
+	for _, state := range p.states {
+		item := model.GatewayStatus{
+			ID:          state.id,
+			Name:        state.name,
+			Domain:      state.domain,
+			Healthy:     state.healthy,
+			Latency:     float64(state.latency) / float64(time.Millisecond),
+			Connections: state.conns,
+			Failures:    state.failures,
+			LastError:   state.lastErr,
+		}
+		if !state.lastChecked.IsZero() {
+			item.LastChecked = state.lastChecked.Unix()
+		}
+		status = append(status, item)
+	}
+	sort.Slice(status, func(i, j int) bool {
+		return status[i].ID < status[j].ID
+	})
+	return status
+}
+
+// Probe 探测所有登记的网关, 并清除长时间没有使用的网关
+func (p *GatewayPool) Probe(timeout time.Duration) {
+	p.mu.Lock()
+	now := p.now()
+	targets := make([]gatewayState, 0, len(p.states))
+	for id, state := range p.states {
+		if state.conns == 0 && now.Sub(state.lastUsed) > gatewayExpireDuration {
+			delete(p.states, id)
+			continue
+		}
+		targets = append(targets, *state)
+	}
+	p.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for i := range targets {
+		wg.Add(1)
+		go func(target *gatewayState) {
+			defer wg.Done()
+			latency, err := probeGateway(target.addr, target.banner, timeout)
+			if err != nil {
+				logger.Debugf("Probe gateway %s(%s) err: %s", target.id, target.addr, err)
+			}
+			p.Report(target.id, latency, err)
+		}(&targets[i])
+	}
+	wg.Wait()
+}
+
+// probeGateway 连接网关, banner 为 true 时读取 SSH 版本信息, 返回所用的时间
+func probeGateway(addr string, banner bool, timeout time.Duration) (time.Duration, error) {
+	start := time.Now()
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	if !banner {
+		return time.Since(start), nil
+	}
+	_ = conn.SetReadDeadline(start.Add(timeout))
+	reader := bufio.NewReader(conn)
+	// 版本信息前可能有其他行, 见 RFC 4253 4.2
+	for i := 0; i < 10; i++ {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return 0, err
+		}
+		if strings.HasPrefix(line, "SSH-") {
+			return time.Since(start), nil
+		}
+	}
+	return 0, fmt.Errorf("no ssh version banner from %s", addr)
+}
+
+// Run 每隔 interval 探测一次网关
+func (p *GatewayPool) Run(interval, timeout time.Duration) {
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for range tick.C {
+		p.Probe(timeout)
+	}
+}
+
+var (
+	gatewayPoolOnce    sync.Once
+	defaultGatewayPool *GatewayPool
+)
+
+// DefaultGatewayPool 返回使用 GATEWAY_SELECT_STRATEGY 选择网关的全局网关池
+func DefaultGatewayPool() *GatewayPool {
+	gatewayPoolOnce.Do(func() {
+		strategy, err := ParseGatewayStrategy(config.GetConf().GatewaySelectStrategy)
+		if err != nil {
+			logger.Errorf("Config GATEWAY_SELECT_STRATEGY is invalid, use %s: %s", GatewayLowestLatency, err)
+			strategy = GatewayLowestLatency
+		}
+		defaultGatewayPool = NewGatewayPool(strategy)
+		logger.Infof("Gateway select strategy %s", strategy)
+	})
+	return defaultGatewayPool
+}
+
+// GatewayHealthStatus 返回全局网关池中网关的健康状态
+func GatewayHealthStatus() []model.GatewayStatus {
+	return DefaultGatewayPool().Status()
+}
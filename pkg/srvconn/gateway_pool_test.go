@@ -0,0 +1,149 @@
+package srvconn
+
+import (
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/meowgen/koko/pkg/jms-sdk-go/model"
+)
+
+func newTestGatewayPool(strategy string) (*GatewayPool, []SSHClientOptions) {
+	domain := model.Domain{ID: "d1", Name: "domain", Gateways: []model.Gateway{
+		{ID: "g1", Name: "g1", IP: "10.0.0.1", Port: 22},
+		{ID: "g2", Name: "g2", IP: "10.0.0.2", Port: 22},
+		{ID: "g3", Name: "g3", IP: "10.0.0.3", Port: 22},
+	}}
+	pool := NewGatewayPool(strategy)
+	pool.Register(&domain)
+	cfgs := make([]SSHClientOptions, 0, len(domain.Gateways))
+	for i := range domain.Gateways {
+		cfg := NewGatewayOptions(&domain.Gateways[i], 15)
+		cfg.gatewayDomain = domain.ID
+		cfgs = append(cfgs, cfg)
+	}
+	return pool, cfgs
+}
+
+func gatewayIDs(cfgs []SSHClientOptions) []string {
+	ids := make([]string, 0, len(cfgs))
+	for i := range cfgs {
+		ids = append(ids, cfgs[i].gatewayID)
+	}
+	return ids
+}
+
+func TestGatewayPoolRoundRobin(t *testing.T) {
+	pool, cfgs := newTestGatewayPool(GatewayRoundRobin)
+	want := [][]string{
+		{"g1", "g2", "g3"},
+		{"g2", "g3", "g1"},
+		{"g3", "g1", "g2"},
+		{"g1", "g2", "g3"},
+	}
+	for i := range want {
+		if got := gatewayIDs(pool.Order(cfgs)); !reflect.DeepEqual(got, want[i]) {
+			t.Fatalf("round %d order = %v, want %v", i, got, want[i])
+		}
+	}
+	if got := gatewayIDs(cfgs); !reflect.DeepEqual(got, want[0]) {
+		t.Fatalf("input modified: %v", got)
+	}
+}
+
+func TestGatewayPoolLeastConnections(t *testing.T) {
+	pool, cfgs := newTestGatewayPool(GatewayLeastConnections)
+	pool.Acquire("g1")
+	pool.Acquire("g1")
+	pool.Acquire("g2")
+	if got, want := gatewayIDs(pool.Order(cfgs)), []string{"g3", "g2", "g1"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("order = %v, want %v", got, want)
+	}
+	pool.Release("g1")
+	pool.Release("g1")
+	if got, want := gatewayIDs(pool.Order(cfgs)), []string{"g1", "g3", "g2"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("order = %v, want %v", got, want)
+	}
+}
+
+func TestGatewayPoolLowestLatency(t *testing.T) {
+	pool, cfgs := newTestGatewayPool(GatewayLowestLatency)
+	pool.Report("g1", 300*time.Millisecond, nil)
+	pool.Report("g3", 20*time.Millisecond, nil)
+	// g2 没有探测过, 排在已知延迟的网关之后
+	if got, want := gatewayIDs(pool.Order(cfgs)), []string{"g3", "g1", "g2"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("order = %v, want %v", got, want)
+	}
+	// 连接成功但没有延迟时不改变平滑延迟
+	pool.Report("g3", 0, nil)
+	for i := 0; i < 10; i++ {
+		pool.Report("g3", 500*time.Millisecond, nil)
+	}
+	if got, want := gatewayIDs(pool.Order(cfgs)), []string{"g1", "g3", "g2"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("order = %v, want %v", got, want)
+	}
+}
+
+func TestGatewayPoolUnhealthyLast(t *testing.T) {
+	pool, cfgs := newTestGatewayPool(GatewayLowestLatency)
+	pool.Report("g1", 10*time.Millisecond, nil)
+	pool.Report("g2", 20*time.Millisecond, nil)
+	pool.Report("g3", 30*time.Millisecond, nil)
+	pool.Report("g1", 0, errors.New("dial timeout"))
+	if got, want := gatewayIDs(pool.Order(cfgs)), []string{"g2", "g3", "g1"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("order = %v, want %v", got, want)
+	}
+	status := pool.Status()
+	if len(status) != 3 || status[0].ID != "g1" || status[0].Healthy ||
+		status[0].Failures != 1 || status[0].LastError != "dial timeout" {
+		t.Fatalf("unexpected status %+v", status)
+	}
+	pool.Report("g1", 10*time.Millisecond, nil)
+	if got, want := gatewayIDs(pool.Order(cfgs)), []string{"g1", "g2", "g3"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("order = %v, want %v", got, want)
+	}
+}
+
+func TestGatewayPoolProbe(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			_, _ = conn.Write([]byte("SSH-2.0-OpenSSH_8.9\r\n"))
+			_ = conn.Close()
+		}
+	}()
+	addr := ln.Addr().(*net.TCPAddr)
+	pool := NewGatewayPool(GatewayLowestLatency)
+	pool.Register(&model.Domain{ID: "d1", Gateways: []model.Gateway{
+		{ID: "up", IP: "127.0.0.1", Port: addr.Port},
+		{ID: "down", IP: "127.0.0.1", Port: 1},
+	}})
+	pool.Probe(time.Second)
+	status := pool.Status()
+	if len(status) != 2 {
+		t.Fatalf("unexpected status %+v", status)
+	}
+	if down := status[0]; down.ID != "down" || down.Healthy || down.LastChecked == 0 {
+		t.Fatalf("unexpected status %+v", down)
+	}
+	if up := status[1]; up.ID != "up" || !up.Healthy || up.Latency <= 0 {
+		t.Fatalf("unexpected status %+v", up)
+	}
+
+	// 长时间没有使用的网关不再探测
+	pool.now = func() time.Time { return time.Now().Add(gatewayExpireDuration + time.Minute) }
+	pool.Probe(time.Second)
+	if status = pool.Status(); len(status) != 0 {
+		t.Fatalf("expired gateways not removed: %+v", status)
+	}
+}
@@ -0,0 +1,306 @@
+package srvconn
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/meowgen/koko/pkg/jms-sdk-go/model"
+	"github.com/meowgen/koko/pkg/logger"
+)
+
+// GatewayClient 是经网关建立连接的客户端, SSH 网关为 *SSHClient
+type GatewayClient interface {
+	Dial(network, addr string) (net.Conn, error)
+	Close() error
+}
+
+// errProxyUnavailable 表示代理网关本身不可用, 例如无法连接或者认证失败, 与目标不可达区分
+var errProxyUnavailable = errors.New("proxy gateway unavailable")
+
+// IsSupportedGatewayProtocol 返回 koko 能否经该协议的网关连接资产, 为空时按 SSH 网关处理
+func IsSupportedGatewayProtocol(protocol string) bool {
+	switch protocol {
+	case "", model.GatewayProtocolSSH, model.GatewayProtocolSOCKS5, model.GatewayProtocolHTTP:
+		return true
+	}
+	return false
+}
+
+func isProxyGateway(cfg *SSHClientOptions) bool {
+	return cfg.gatewayProtocol == model.GatewayProtocolSOCKS5 ||
+		cfg.gatewayProtocol == model.GatewayProtocolHTTP
+}
+
+// proxyGatewayClient 经 SOCKS5 或 HTTP CONNECT 代理建立连接, 每次 Dial 新建一个到代理的连接
+type proxyGatewayClient struct {
+	cfg *SSHClientOptions
+	// forward 是连接代理前经过的跳板, 为空时直接连接代理
+	forward GatewayClient
+	// lease 是 DialGateway 返回时网关池中的连接计数
+	lease *gatewayLease
+
+	released int32
+}
+
+func newProxyGatewayClient(cfg *SSHClientOptions) (*proxyGatewayClient, error) {
+	client := &proxyGatewayClient{cfg: cfg}
+	if len(cfg.proxySSHClientOptions) > 0 {
+		forward, conn, err := DialGateway(cfg.proxySSHClientOptions, client.proxyAddr())
+		if err != nil {
+			return nil, err
+		}
+		_ = conn.Close()
+		client.forward = forward
+	}
+	return client, nil
+}
+
+func (c *proxyGatewayClient) proxyAddr() string {
+	return net.JoinHostPort(c.cfg.Host, c.cfg.Port)
+}
+
+func (c *proxyGatewayClient) String() string {
+	if c.cfg.Username == "" {
+		return fmt.Sprintf("%s://%s", c.cfg.gatewayProtocol, c.proxyAddr())
+	}
+	return fmt.Sprintf("%s://%s@%s", c.cfg.gatewayProtocol, c.cfg.Username, c.proxyAddr())
+}
+
+func (c *proxyGatewayClient) Dial(network, addr string) (net.Conn, error) {
+	timeout := time.Duration(c.cfg.Timeout) * time.Second
+	var (
+		conn net.Conn
+		err  error
+	)
+	if c.forward != nil {
+		conn, err = c.forward.Dial("tcp", c.proxyAddr())
+	} else {
+		conn, err = net.DialTimeout("tcp", c.proxyAddr(), timeout)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", errProxyUnavailable, err)
+	}
+	if timeout > 0 {
+		_ = conn.SetDeadline(time.Now().Add(timeout))
+	}
+	switch c.cfg.gatewayProtocol {
+	case model.GatewayProtocolSOCKS5:
+		err = socks5Connect(conn, addr, c.cfg.Username, c.cfg.Password)
+	default:
+		conn, err = httpConnect(conn, addr, c.cfg.Username, c.cfg.Password)
+	}
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	_ = conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+func (c *proxyGatewayClient) Close() error {
+	if !atomic.CompareAndSwapInt32(&c.released, 0, 1) {
+		return nil
+	}
+	c.lease.Release()
+	if c.forward != nil {
+		return c.forward.Close()
+	}
+	return nil
+}
+
+// dialViaProxy 经代理网关连接 dstAddr, 代理不可用时标记网关不健康
+func dialViaProxy(cfg *SSHClientOptions, dstAddr string) (GatewayClient, net.Conn, error) {
+	client, err := newProxyGatewayClient(cfg)
+	if err != nil {
+		logger.Errorf("Connect gateway %s err: %s", cfg.Host, err)
+		DefaultGatewayPool().Report(cfg.gatewayID, 0, err)
+		return nil, nil, err
+	}
+	dstConn, err := client.Dial("tcp", dstAddr)
+	if err != nil {
+		if client.forward != nil {
+			_ = client.forward.Close()
+		}
+		logger.Errorf("Gateway %s dial %s err: %s, try next gateway", client, dstAddr, err)
+		if errors.Is(err, errProxyUnavailable) {
+			DefaultGatewayPool().Report(cfg.gatewayID, 0, err)
+			return nil, nil, err
+		}
+		return nil, nil, fmt.Errorf("%w: %s", ErrGatewayDial, err)
+	}
+	return client, dstConn, nil
+}
+
+// SOCKS5 协议, 见 RFC 1928 和 RFC 1929
+const (
+	socks5Version        = 0x05
+	socks5AuthNone       = 0x00
+	socks5AuthPassword   = 0x02
+	socks5CmdConnect     = 0x01
+	socks5AddrIPv4       = 0x01
+	socks5AddrDomain     = 0x03
+	socks5AddrIPv6       = 0x04
+	socks5PasswordVer    = 0x01
+	socks5ReplySucceeded = 0x00
+)
+
+var socks5ReplyMessages = map[byte]string{
+	0x01: "general SOCKS server failure",
+	0x02: "connection not allowed by ruleset",
+	0x03: "network unreachable",
+	0x04: "host unreachable",
+	0x05: "connection refused",
+	0x06: "TTL expired",
+	0x07: "command not supported",
+	0x08: "address type not supported",
+}
+
+// socks5Connect 在到代理的连接上完成认证并请求连接 addr
+func socks5Connect(conn net.Conn, addr, username, password string) error {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return fmt.Errorf("invalid port %q", portStr)
+	}
+	methods := []byte{socks5AuthNone}
+	if username != "" {
+		methods = []byte{socks5AuthPassword, socks5AuthNone}
+	}
+	req := append([]byte{socks5Version, byte(len(methods))}, methods...)
+	if _, err = conn.Write(req); err != nil {
+		return fmt.Errorf("%w: %s", errProxyUnavailable, err)
+	}
+	buf := make([]byte, 2)
+	if _, err = io.ReadFull(conn, buf); err != nil {
+		return fmt.Errorf("%w: %s", errProxyUnavailable, err)
+	}
+	if buf[0] != socks5Version {
+		return fmt.Errorf("%w: unexpected socks version %d", errProxyUnavailable, buf[0])
+	}
+	switch buf[1] {
+	case socks5AuthNone:
+	case socks5AuthPassword:
+		if len(username) > 255 || len(password) > 255 {
+			return fmt.Errorf("%w: socks5 username or password too long", errProxyUnavailable)
+		}
+		auth := []byte{socks5PasswordVer, byte(len(username))}
+		auth = append(auth, username...)
+		auth = append(auth, byte(len(password)))
+		auth = append(auth, password...)
+		if _, err = conn.Write(auth); err != nil {
+			return fmt.Errorf("%w: %s", errProxyUnavailable, err)
+		}
+		if _, err = io.ReadFull(conn, buf); err != nil {
+			return fmt.Errorf("%w: %s", errProxyUnavailable, err)
+		}
+		if buf[1] != 0x00 {
+			return fmt.Errorf("%w: socks5 authentication failed", errProxyUnavailable)
+		}
+	default:
+		return fmt.Errorf("%w: no acceptable socks5 authentication methods", errProxyUnavailable)
+	}
+
+	req = []byte{socks5Version, socks5CmdConnect, 0x00}
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			req = append(append(req, socks5AddrIPv4), ip4...)
+		} else {
+			req = append(append(req, socks5AddrIPv6), ip.To16()...)
+		}
+	} else {
+		if len(host) > 255 {
+			return fmt.Errorf("host name too long: %s", host)
+		}
+		req = append(append(req, socks5AddrDomain, byte(len(host))), host...)
+	}
+	req = append(req, byte(port>>8), byte(port))
+	if _, err = conn.Write(req); err != nil {
+		return fmt.Errorf("%w: %s", errProxyUnavailable, err)
+	}
+	reply := make([]byte, 4)
+	if _, err = io.ReadFull(conn, reply); err != nil {
+		return fmt.Errorf("%w: %s", errProxyUnavailable, err)
+	}
+	if reply[1] != socks5ReplySucceeded {
+		msg, ok := socks5ReplyMessages[reply[1]]
+		if !ok {
+			msg = fmt.Sprintf("unknown reply %d", reply[1])
+		}
+		return fmt.Errorf("socks5 connect %s: %s", addr, msg)
+	}
+	// 跳过代理绑定的地址
+	var skip int
+	switch reply[3] {
+	case socks5AddrIPv4:
+		skip = net.IPv4len
+	case socks5AddrIPv6:
+		skip = net.IPv6len
+	case socks5AddrDomain:
+		if _, err = io.ReadFull(conn, reply[:1]); err != nil {
+			return fmt.Errorf("%w: %s", errProxyUnavailable, err)
+		}
+		skip = int(reply[0])
+	default:
+		return fmt.Errorf("%w: unknown socks5 address type %d", errProxyUnavailable, reply[3])
+	}
+	if _, err = io.ReadFull(conn, make([]byte, skip+2)); err != nil {
+		return fmt.Errorf("%w: %s", errProxyUnavailable, err)
+	}
+	return nil
+}
+
+// httpConnect 向 HTTP 代理发送 CONNECT 请求, 返回的连接包含代理响应后已读取的数据
+func httpConnect(conn net.Conn, addr, username, password string) (net.Conn, error) {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if username != "" {
+		token := base64.StdEncoding.EncodeToString([]byte(username + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+token)
+	}
+	if err := req.Write(conn); err != nil {
+		return conn, fmt.Errorf("%w: %s", errProxyUnavailable, err)
+	}
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		return conn, fmt.Errorf("%w: %s", errProxyUnavailable, err)
+	}
+	_ = resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusOK:
+	case resp.StatusCode == http.StatusProxyAuthRequired:
+		return conn, fmt.Errorf("%w: http proxy authentication failed", errProxyUnavailable)
+	default:
+		return conn, fmt.Errorf("http connect %s: %s", addr, resp.Status)
+	}
+	if reader.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, reader: reader}, nil
+	}
+	return conn, nil
+}
+
+// bufferedConn 先返回读取代理响应时多读的数据, 例如资产先发送的 SSH 版本信息
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
@@ -0,0 +1,303 @@
+package srvconn
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"reflect"
+	"strconv"
+	"testing"
+
+	"github.com/meowgen/koko/pkg/jms-sdk-go/model"
+)
+
+// startTestListener 启动在 127.0.0.1 上监听的服务, 每个连接交给 handle 处理
+func startTestListener(t *testing.T, handle func(conn net.Conn)) int {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go handle(conn)
+		}
+	}()
+	return ln.Addr().(*net.TCPAddr).Port
+}
+
+// startEchoTarget 模拟先发送版本信息的资产, 之后原样返回收到的数据
+func startEchoTarget(t *testing.T) int {
+	return startTestListener(t, func(conn net.Conn) {
+		defer conn.Close()
+		_, _ = conn.Write([]byte("HELLO\n"))
+		_, _ = io.Copy(conn, conn)
+	})
+}
+
+func pipeConn(a, b net.Conn) {
+	go func() {
+		_, _ = io.Copy(a, b)
+		_ = a.Close()
+	}()
+	_, _ = io.Copy(b, a)
+	_ = b.Close()
+}
+
+// startTestSOCKS5 启动需要用户名密码认证的 SOCKS5 代理, 见 RFC 1928 和 RFC 1929
+func startTestSOCKS5(t *testing.T, username, password string) int {
+	return startTestListener(t, func(conn net.Conn) {
+		defer conn.Close()
+		buf := make([]byte, 512)
+		if _, err := io.ReadFull(conn, buf[:2]); err != nil || buf[0] != socks5Version {
+			return
+		}
+		methods := buf[2 : 2+int(buf[1])]
+		if _, err := io.ReadFull(conn, methods); err != nil {
+			return
+		}
+		if methods[0] != socks5AuthPassword {
+			_, _ = conn.Write([]byte{socks5Version, 0xff})
+			return
+		}
+		_, _ = conn.Write([]byte{socks5Version, socks5AuthPassword})
+		if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+			return
+		}
+		user := make([]byte, buf[1])
+		_, _ = io.ReadFull(conn, user)
+		_, _ = io.ReadFull(conn, buf[:1])
+		pass := make([]byte, buf[0])
+		_, _ = io.ReadFull(conn, pass)
+		if string(user) != username || string(pass) != password {
+			_, _ = conn.Write([]byte{socks5PasswordVer, 0x01})
+			return
+		}
+		_, _ = conn.Write([]byte{socks5PasswordVer, 0x00})
+
+		if _, err := io.ReadFull(conn, buf[:4]); err != nil || buf[1] != socks5CmdConnect {
+			return
+		}
+		var host string
+		switch buf[3] {
+		case socks5AddrIPv4:
+			ip := make([]byte, net.IPv4len)
+			_, _ = io.ReadFull(conn, ip)
+			host = net.IP(ip).String()
+		case socks5AddrDomain:
+			_, _ = io.ReadFull(conn, buf[:1])
+			name := make([]byte, buf[0])
+			_, _ = io.ReadFull(conn, name)
+			host = string(name)
+		default:
+			return
+		}
+		if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+			return
+		}
+		port := int(buf[0])<<8 | int(buf[1])
+		target, err := net.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+		if err != nil {
+			_, _ = conn.Write([]byte{socks5Version, 0x05, 0x00, socks5AddrIPv4, 0, 0, 0, 0, 0, 0})
+			return
+		}
+		_, _ = conn.Write([]byte{socks5Version, socks5ReplySucceeded, 0x00, socks5AddrIPv4, 127, 0, 0, 1, 0, 0})
+		pipeConn(conn, target)
+	})
+}
+
+// startTestHTTPProxy 启动需要 Basic 认证的 HTTP CONNECT 代理
+func startTestHTTPProxy(t *testing.T, username, password string) int {
+	token := "Basic " + base64.StdEncoding.EncodeToString([]byte(username+":"+password))
+	return startTestListener(t, func(conn net.Conn) {
+		defer conn.Close()
+		req, err := http.ReadRequest(bufio.NewReader(conn))
+		if err != nil || req.Method != http.MethodConnect {
+			return
+		}
+		if req.Header.Get("Proxy-Authorization") != token {
+			_, _ = conn.Write([]byte("HTTP/1.1 407 Proxy Authentication Required\r\n\r\n"))
+			return
+		}
+		target, err := net.Dial("tcp", req.Host)
+		if err != nil {
+			_, _ = conn.Write([]byte("HTTP/1.1 502 Bad Gateway\r\n\r\n"))
+			return
+		}
+		// 等待资产的版本信息, 与代理响应一起发送
+		banner := make([]byte, 6)
+		if _, err = io.ReadFull(target, banner); err != nil {
+			return
+		}
+		_, _ = conn.Write(append([]byte("HTTP/1.1 200 Connection established\r\n\r\n"), banner...))
+		pipeConn(conn, target)
+	})
+}
+
+func proxyGatewayOptions(protocol string, port int, username, password string) SSHClientOptions {
+	gateway := model.Gateway{ID: "proxy-" + strconv.Itoa(port), Name: protocol, IP: "127.0.0.1",
+		Port: port, Protocol: protocol, Username: username, Password: password}
+	return NewGatewayOptions(&gateway, 5)
+}
+
+func assertEcho(t *testing.T, conn net.Conn) {
+	t.Helper()
+	reader := bufio.NewReader(conn)
+	if line, err := reader.ReadString('\n'); err != nil || line != "HELLO\n" {
+		t.Fatalf("banner = %q, err %v", line, err)
+	}
+	if _, err := conn.Write([]byte("ping\n")); err != nil {
+		t.Fatal(err)
+	}
+	if line, err := reader.ReadString('\n'); err != nil || line != "ping\n" {
+		t.Fatalf("echo = %q, err %v", line, err)
+	}
+}
+
+func TestDialGatewaySOCKS5(t *testing.T) {
+	targetAddr := net.JoinHostPort("127.0.0.1", strconv.Itoa(startEchoTarget(t)))
+	proxyPort := startTestSOCKS5(t, "proxy", "secret")
+
+	cfgs := []SSHClientOptions{proxyGatewayOptions(model.GatewayProtocolSOCKS5, proxyPort, "proxy", "secret")}
+	client, conn, err := DialGateway(cfgs, targetAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEcho(t, conn)
+	_ = conn.Close()
+
+	// 同一个网关客户端可以再次建立连接, 例如数据库隧道的后续连接
+	conn, err = client.Dial("tcp", targetAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEcho(t, conn)
+	_ = conn.Close()
+	_ = client.Close()
+
+	cfgs = []SSHClientOptions{proxyGatewayOptions(model.GatewayProtocolSOCKS5, proxyPort, "proxy", "wrong")}
+	if _, _, err = DialGateway(cfgs, targetAddr); !errors.Is(err, ErrNoAvailable) {
+		t.Fatalf("wrong password err = %v", err)
+	}
+	if _, _, err = dialViaProxy(&cfgs[0], targetAddr); !errors.Is(err, errProxyUnavailable) {
+		t.Fatalf("auth failure should mark gateway unavailable: %v", err)
+	}
+
+	cfgs = []SSHClientOptions{proxyGatewayOptions(model.GatewayProtocolSOCKS5, proxyPort, "proxy", "secret")}
+	if _, _, err = dialViaProxy(&cfgs[0], "127.0.0.1:1"); !errors.Is(err, ErrGatewayDial) ||
+		errors.Is(err, errProxyUnavailable) {
+		t.Fatalf("unreachable target err = %v", err)
+	}
+}
+
+func TestDialGatewayHTTPConnect(t *testing.T) {
+	targetAddr := net.JoinHostPort("127.0.0.1", strconv.Itoa(startEchoTarget(t)))
+	proxyPort := startTestHTTPProxy(t, "proxy", "secret")
+
+	cfgs := []SSHClientOptions{proxyGatewayOptions(model.GatewayProtocolHTTP, proxyPort, "proxy", "secret")}
+	client, conn, err := DialGateway(cfgs, targetAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEcho(t, conn)
+	_ = conn.Close()
+	_ = client.Close()
+
+	cfgs = []SSHClientOptions{proxyGatewayOptions(model.GatewayProtocolHTTP, proxyPort, "proxy", "wrong")}
+	if _, _, err = dialViaProxy(&cfgs[0], targetAddr); !errors.Is(err, errProxyUnavailable) {
+		t.Fatalf("auth failure err = %v", err)
+	}
+}
+
+func TestDialGatewayProxyFailover(t *testing.T) {
+	targetAddr := net.JoinHostPort("127.0.0.1", strconv.Itoa(startEchoTarget(t)))
+	proxyPort := startTestSOCKS5(t, "proxy", "secret")
+	down := startTestListener(t, func(conn net.Conn) { _ = conn.Close() })
+
+	cfgs := []SSHClientOptions{
+		proxyGatewayOptions(model.GatewayProtocolSOCKS5, down, "proxy", "secret"),
+		proxyGatewayOptions(model.GatewayProtocolSOCKS5, proxyPort, "proxy", "secret"),
+	}
+	client, conn, err := DialGateway(cfgs, targetAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	defer conn.Close()
+	if got := client.(*proxyGatewayClient).cfg.Port; got != strconv.Itoa(proxyPort) {
+		t.Fatalf("used gateway port %s, want %d", got, proxyPort)
+	}
+	assertEcho(t, conn)
+}
+
+func TestNewDomainGatewayOptionsProtocols(t *testing.T) {
+	domain := model.Domain{ID: "d-proto", Gateways: []model.Gateway{
+		{ID: "ssh", Protocol: model.GatewayProtocolSSH},
+		{ID: "rdp", Protocol: "rdp"},
+		{ID: "socks", Protocol: model.GatewayProtocolSOCKS5},
+		{ID: "http", Protocol: model.GatewayProtocolHTTP},
+	}}
+	cfgs := NewDomainGatewayOptions(&domain, 5)
+	if got, want := gatewayIDs(cfgs), []string{"ssh", "socks", "http"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("gateways = %v, want %v", got, want)
+	}
+	if isProxyGateway(&cfgs[0]) || !isProxyGateway(&cfgs[1]) || !isProxyGateway(&cfgs[2]) {
+		t.Fatal("unexpected gateway protocols")
+	}
+}
+
+// poolConns 返回网关池中网关的连接数
+func poolConns(p *GatewayPool, id string) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.conns(id)
+}
+
+func TestDialGatewayLease(t *testing.T) {
+	targetAddr := net.JoinHostPort("127.0.0.1", strconv.Itoa(startEchoTarget(t)))
+	proxyPort := startTestSOCKS5(t, "proxy", "secret")
+	good := proxyGatewayOptions(model.GatewayProtocolSOCKS5, proxyPort, "proxy", "secret")
+	bad := proxyGatewayOptions(model.GatewayProtocolSOCKS5, proxyPort, "proxy", "wrong")
+	bad.gatewayID = "lease-bad"
+	pool := DefaultGatewayPool()
+	pool.Register(&model.Domain{ID: "lease", Gateways: []model.Gateway{{ID: good.gatewayID}, {ID: bad.gatewayID}}})
+
+	// 另一个会话的连接
+	other := pool.Lease(good.gatewayID)
+	defer other.Release()
+
+	// 连接失败时关闭的客户端不减少其他连接的计数
+	if _, _, err := DialGateway([]SSHClientOptions{bad}, targetAddr); err == nil {
+		t.Fatal("dial with wrong password should fail")
+	}
+	if _, _, err := DialGateway([]SSHClientOptions{good}, "127.0.0.1:1"); err == nil {
+		t.Fatal("dial unreachable target should fail")
+	}
+	if got := poolConns(pool, good.gatewayID); got != 1 {
+		t.Fatalf("conns after failed dial = %d, want 1", got)
+	}
+	if got := poolConns(pool, bad.gatewayID); got != 0 {
+		t.Fatalf("conns of failed gateway = %d, want 0", got)
+	}
+
+	client, conn, err := DialGateway([]SSHClientOptions{good}, targetAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.Close()
+	if got := poolConns(pool, good.gatewayID); got != 2 {
+		t.Fatalf("conns after dial = %d, want 2", got)
+	}
+	_ = client.Close()
+	_ = client.Close()
+	if got := poolConns(pool, good.gatewayID); got != 1 {
+		t.Fatalf("conns after close = %d, want 1", got)
+	}
+}
@@ -0,0 +1,69 @@
+package srvconn
+
+import (
+	"testing"
+
+	"github.com/meowgen/koko/pkg/jms-sdk-go/model"
+)
+
+func TestNewGatewayOptions(t *testing.T) {
+	gateway := model.Gateway{
+		Name: "regional", IP: "10.0.0.3", Port: 22, Username: "gw3", Password: "p3",
+		Jumps: []model.Gateway{
+			{Name: "bastion", IP: "10.0.0.1", Port: 2222, Username: "gw1", PrivateKey: "k1"},
+			{Name: "middle", IP: "10.0.0.2", Port: 22, Username: "gw2", Password: "p2"},
+		},
+	}
+	if got := gateway.String(); got != "bastion -> middle -> regional" {
+		t.Fatalf("gateway string = %q", got)
+	}
+	cfg := NewGatewayOptions(&gateway, 15)
+	want := []struct {
+		host     string
+		port     string
+		username string
+	}{
+		{"10.0.0.3", "22", "gw3"},
+		{"10.0.0.2", "22", "gw2"},
+		{"10.0.0.1", "2222", "gw1"},
+	}
+	hop := &cfg
+	for i, w := range want {
+		if hop == nil {
+			t.Fatalf("hop %d missing", i)
+		}
+		if hop.Host != w.host || hop.Port != w.port || hop.Username != w.username {
+			t.Fatalf("hop %d = %s@%s:%s, want %s@%s:%s", i, hop.Username,
+				hop.Host, hop.Port, w.username, w.host, w.port)
+		}
+		if hop.Timeout != 15 {
+			t.Fatalf("hop %d timeout = %d", i, hop.Timeout)
+		}
+		switch len(hop.proxySSHClientOptions) {
+		case 0:
+			hop = nil
+		case 1:
+			hop = &hop.proxySSHClientOptions[0]
+		default:
+			t.Fatalf("hop %d has %d proxies", i, len(hop.proxySSHClientOptions))
+		}
+	}
+	if hop != nil {
+		t.Fatalf("unexpected extra hop %s", hop.Host)
+	}
+}
+
+func TestHostKeyScope(t *testing.T) {
+	domain := model.Domain{ID: "d1", Gateways: []model.Gateway{{ID: "g1", IP: "10.0.0.1", Port: 22}}}
+	proxyArgs := NewDomainGatewayOptions(&domain, 5)
+	if scope := hostKeyScope(&proxyArgs[0]); scope != "gateway-g1" {
+		t.Errorf("gateway scope = %q", scope)
+	}
+	asset := SSHClientOptions{Host: "10.0.0.5", Port: "22", proxySSHClientOptions: proxyArgs}
+	if scope := hostKeyScope(&asset); scope != "domain-d1" {
+		t.Errorf("asset scope = %q", scope)
+	}
+	if scope := hostKeyScope(&SSHClientOptions{Host: "10.0.0.5"}); scope != "" {
+		t.Errorf("direct scope = %q", scope)
+	}
+}
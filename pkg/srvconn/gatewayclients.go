@@ -0,0 +1,246 @@
+package srvconn
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	gossh "golang.org/x/crypto/ssh"
+
+	"github.com/meowgen/koko/pkg/config"
+	"github.com/meowgen/koko/pkg/logger"
+)
+
+// gatewayKeepAliveInterval 是检查网关连接的间隔, 同时发送 keepalive 保持连接
+const gatewayKeepAliveInterval = 30 * time.Second
+
+var errKeepAliveTimeout = errors.New("keepalive timeout")
+
+// sharedGatewayClient 是多个会话共用的网关连接, 引用数为 0 且空闲超时后关闭
+type sharedGatewayClient struct {
+	key     string
+	client  *SSHClient
+	manager *GatewayClientManager
+
+	// 以下字段由 manager.mu 保护
+	refs     int
+	broken   bool
+	lastUsed time.Time
+}
+
+func (c *sharedGatewayClient) release() {
+	c.manager.release(c)
+}
+
+// GatewayClientManager 按网关和认证信息缓存网关的 SSH 连接, 会话通过引用共用同一个连接
+type GatewayClientManager struct {
+	idleTimeout time.Duration
+
+	mu      sync.Mutex
+	clients map[string]*sharedGatewayClient
+	now     func() time.Time
+	// dial 创建新的网关连接, 测试时替换
+	dial func(cfg *SSHClientOptions) (*SSHClient, error)
+}
+
+// NewGatewayClientManager 创建网关连接缓存, idleTimeout 为 0 时不复用连接
+func NewGatewayClientManager(idleTimeout time.Duration) *GatewayClientManager {
+	return &GatewayClientManager{
+		idleTimeout: idleTimeout,
+		clients:     make(map[string]*sharedGatewayClient),
+		now:         time.Now,
+		dial:        NewSSHClientWithCfg,
+	}
+}
+
+// Get 返回网关连接的引用, reused 表示使用的是已有的连接. 引用用完后需要 Close
+func (m *GatewayClientManager) Get(cfg *SSHClientOptions) (client *SSHClient, reused bool, err error) {
+	key := gatewayClientKey(cfg)
+	if m.idleTimeout > 0 {
+		m.mu.Lock()
+		if shared, ok := m.clients[key]; ok && !shared.broken {
+			lease := m.acquire(shared)
+			m.mu.Unlock()
+			logger.Debugf("Reuse gateway client(%s) refs %d", shared.client, lease.shared.refs)
+			return lease, true, nil
+		}
+		m.mu.Unlock()
+	}
+	sshClient, err := m.dial(cfg)
+	if err != nil {
+		return nil, false, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	shared := &sharedGatewayClient{key: key, client: sshClient, manager: m}
+	if m.idleTimeout > 0 {
+		if exist, ok := m.clients[key]; ok && !exist.broken {
+			// 其他会话同时建立了连接, 使用已缓存的连接
+			_ = sshClient.Close()
+			return m.acquire(exist), true, nil
+		}
+		m.clients[key] = shared
+		logger.Infof("Store new gateway client(%s) remain %d", sshClient, len(m.clients))
+	}
+	return m.acquire(shared), false, nil
+}
+
+// acquire 增加引用并返回一个引用该连接的 SSHClient, 需持有锁
+func (m *GatewayClientManager) acquire(shared *sharedGatewayClient) *SSHClient {
+	shared.refs++
+	shared.lastUsed = m.now()
+	return &SSHClient{Client: shared.client.Client, Cfg: shared.client.Cfg,
+		traceSessionMap: make(map[*gossh.Session]time.Time),
+		shared:          shared}
+}
+
+func (m *GatewayClientManager) release(shared *sharedGatewayClient) {
+	m.mu.Lock()
+	shared.refs--
+	shared.lastUsed = m.now()
+	closeNow := shared.refs <= 0 && (shared.broken || m.idleTimeout <= 0)
+	m.mu.Unlock()
+	if closeNow {
+		_ = shared.client.Close()
+	}
+}
+
+// Invalidate 标记连接不可用, 之后的会话建立新的连接, 已有的引用释放后关闭
+func (m *GatewayClientManager) Invalidate(client *SSHClient) {
+	if client.shared == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.invalidate(client.shared)
+}
+
+// invalidate 需持有锁
+func (m *GatewayClientManager) invalidate(shared *sharedGatewayClient) {
+	shared.broken = true
+	if m.clients[shared.key] == shared {
+		delete(m.clients, shared.key)
+	}
+}
+
+// Count 返回缓存的网关连接数
+func (m *GatewayClientManager) Count() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.clients)
+}
+
+// Check 关闭空闲超时的连接, 并对其他连接发送 keepalive, 失败的连接不再复用
+func (m *GatewayClientManager) Check(timeout time.Duration) {
+	m.mu.Lock()
+	now := m.now()
+	idle := make([]*sharedGatewayClient, 0)
+	alive := make([]*sharedGatewayClient, 0, len(m.clients))
+	for key, shared := range m.clients {
+		if shared.refs <= 0 && now.Sub(shared.lastUsed) > m.idleTimeout {
+			delete(m.clients, key)
+			idle = append(idle, shared)
+			continue
+		}
+		alive = append(alive, shared)
+	}
+	m.mu.Unlock()
+	for i := range idle {
+		_ = idle[i].client.Close()
+	}
+	if len(idle) > 0 {
+		logger.Infof("Remove %d idle gateway clients", len(idle))
+	}
+
+	var wg sync.WaitGroup
+	for i := range alive {
+		wg.Add(1)
+		go func(shared *sharedGatewayClient) {
+			defer wg.Done()
+			if err := keepAlive(shared.client, timeout); err != nil {
+				logger.Errorf("Gateway client(%s) keepalive err: %s", shared.client, err)
+				m.mu.Lock()
+				m.invalidate(shared)
+				closeNow := shared.refs <= 0
+				m.mu.Unlock()
+				if closeNow {
+					_ = shared.client.Close()
+				}
+			}
+		}(alive[i])
+	}
+	wg.Wait()
+}
+
+// Run 定期检查缓存的网关连接
+func (m *GatewayClientManager) Run(timeout time.Duration) {
+	tick := time.NewTicker(gatewayKeepAliveInterval)
+	defer tick.Stop()
+	for range tick.C {
+		m.Check(timeout)
+	}
+}
+
+// keepAlive 发送 keepalive 请求, 网关在 timeout 内没有回应时返回错误
+func keepAlive(client *SSHClient, timeout time.Duration) error {
+	done := make(chan error, 1)
+	go func() {
+		_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(timeout):
+		return errKeepAliveTimeout
+	}
+}
+
+// gatewayClientKey 由网关和认证信息生成缓存的 key, 经过的跳板不同时不共用连接
+func gatewayClientKey(cfg *SSHClientOptions) string {
+	h := sha256.New()
+	writeGatewayKey(h, cfg)
+	return cfg.gatewayID + "_" + hex.EncodeToString(h.Sum(nil))
+}
+
+func writeGatewayKey(h interface{ Write([]byte) (int, error) }, cfg *SSHClientOptions) {
+	fields := []string{cfg.Host, cfg.Port, cfg.Username, cfg.Password,
+		cfg.PrivateKey, cfg.Passphrase, strings.Join(cfg.HostKeys, "\n")}
+	for i := range fields {
+		_, _ = h.Write([]byte(fields[i]))
+		_, _ = h.Write([]byte{0})
+	}
+	for i := range cfg.proxySSHClientOptions {
+		_, _ = h.Write([]byte("proxy"))
+		writeGatewayKey(h, &cfg.proxySSHClientOptions[i])
+	}
+}
+
+var (
+	gatewayClientsOnce    sync.Once
+	defaultGatewayClients *GatewayClientManager
+)
+
+// DefaultGatewayClients 返回全局的网关连接缓存, 空闲超时为 GATEWAY_IDLE_TIMEOUT
+func DefaultGatewayClients() *GatewayClientManager {
+	gatewayClientsOnce.Do(func() {
+		conf := config.GetConf()
+		defaultGatewayClients = NewGatewayClientManager(time.Duration(conf.GatewayIdleTimeout) * time.Second)
+		if conf.GatewayIdleTimeout > 0 {
+			go defaultGatewayClients.Run(time.Duration(conf.SSHTimeout) * time.Second)
+		}
+	})
+	return defaultGatewayClients
+}
+
+// releaseShared 释放共用连接的引用, 只释放一次
+func (s *SSHClient) releaseShared() {
+	if atomic.CompareAndSwapInt32(&s.released, 0, 1) {
+		s.shared.release()
+		logger.Debugf("SSHClient(%s) release gateway client", s)
+	}
+}
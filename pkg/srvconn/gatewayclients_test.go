@@ -0,0 +1,243 @@
+package srvconn
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	gossh "golang.org/x/crypto/ssh"
+
+	"github.com/meowgen/koko/pkg/jms-sdk-go/model"
+)
+
+// testSSHServer 是只接受 keepalive 请求的 SSH 服务, 用于模拟网关
+type testSSHServer struct {
+	ln    net.Listener
+	mu    sync.Mutex
+	conns []*gossh.ServerConn
+}
+
+func newTestSSHServer(t *testing.T) *testSSHServer {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := gossh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := &gossh.ServerConfig{
+		PasswordCallback: func(conn gossh.ConnMetadata, password []byte) (*gossh.Permissions, error) {
+			return nil, nil
+		},
+	}
+	conf.AddHostKey(signer)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &testSSHServer{ln: ln}
+	go func() {
+		for {
+			nConn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				conn, chans, reqs, err := gossh.NewServerConn(nConn, conf)
+				if err != nil {
+					return
+				}
+				srv.mu.Lock()
+				srv.conns = append(srv.conns, conn)
+				srv.mu.Unlock()
+				go gossh.DiscardRequests(reqs)
+				for ch := range chans {
+					_ = ch.Reject(gossh.Prohibited, "test")
+				}
+			}()
+		}
+	}()
+	t.Cleanup(func() { _ = ln.Close() })
+	return srv
+}
+
+func (s *testSSHServer) closeConns() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range s.conns {
+		_ = s.conns[i].Close()
+	}
+}
+
+func (s *testSSHServer) options(username string) SSHClientOptions {
+	addr := s.ln.Addr().(*net.TCPAddr)
+	return SSHClientOptions{Host: "127.0.0.1", Port: strconv.Itoa(addr.Port),
+		Username: username, Password: "secret", Timeout: 5, gatewayID: "g1"}
+}
+
+func newTestGatewayClients(idleTimeout time.Duration) (*GatewayClientManager, *int) {
+	m := NewGatewayClientManager(idleTimeout)
+	dials := 0
+	m.dial = func(cfg *SSHClientOptions) (*SSHClient, error) {
+		dials++
+		client, err := gossh.Dial("tcp", net.JoinHostPort(cfg.Host, cfg.Port), &gossh.ClientConfig{
+			User:            cfg.Username,
+			Auth:            cfg.AuthMethods(),
+			HostKeyCallback: gossh.InsecureIgnoreHostKey(),
+			Timeout:         time.Duration(cfg.Timeout) * time.Second,
+		})
+		if err != nil {
+			return nil, err
+		}
+		return &SSHClient{Client: client, Cfg: cfg,
+			traceSessionMap: make(map[*gossh.Session]time.Time)}, nil
+	}
+	return m, &dials
+}
+
+func TestGatewayClientManagerReuse(t *testing.T) {
+	srv := newTestSSHServer(t)
+	m, dials := newTestGatewayClients(time.Minute)
+	cfg := srv.options("gw")
+
+	first, reused, err := m.Get(&cfg)
+	if err != nil || reused {
+		t.Fatalf("first get reused=%v err=%v", reused, err)
+	}
+	second, reused, err := m.Get(&cfg)
+	if err != nil || !reused {
+		t.Fatalf("second get reused=%v err=%v", reused, err)
+	}
+	if first.Client != second.Client || *dials != 1 {
+		t.Fatalf("gateway client not shared, dials %d", *dials)
+	}
+	other := srv.options("other")
+	if _, reused, err = m.Get(&other); err != nil || reused || *dials != 2 {
+		t.Fatalf("different credentials reused=%v err=%v dials=%d", reused, err, *dials)
+	}
+
+	_ = first.Close()
+	_ = first.Close()
+	_ = second.Close()
+	if first.shared.refs != 0 {
+		t.Fatalf("refs = %d after close", first.shared.refs)
+	}
+	// 空闲的连接在超时前保持可用
+	m.Check(time.Second)
+	if _, _, err = first.shared.client.SendRequest("keepalive@openssh.com", true, nil); err != nil {
+		t.Fatalf("idle client closed before timeout: %s", err)
+	}
+	if m.Count() != 2 {
+		t.Fatalf("count = %d", m.Count())
+	}
+
+	m.now = func() time.Time { return time.Now().Add(2 * time.Minute) }
+	m.Check(time.Second)
+	if m.Count() != 1 {
+		t.Fatalf("idle client not evicted, count = %d", m.Count())
+	}
+	if _, _, err = first.shared.client.SendRequest("keepalive@openssh.com", true, nil); err == nil {
+		t.Fatal("evicted client still open")
+	}
+}
+
+func TestGatewayClientManagerBroken(t *testing.T) {
+	srv := newTestSSHServer(t)
+	m, dials := newTestGatewayClients(time.Minute)
+	cfg := srv.options("gw")
+
+	lease, _, err := m.Get(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.closeConns()
+	m.Check(time.Second)
+	if m.Count() != 0 {
+		t.Fatalf("broken client still cached, count = %d", m.Count())
+	}
+	fresh, reused, err := m.Get(&cfg)
+	if err != nil || reused || *dials != 2 {
+		t.Fatalf("get after broken reused=%v err=%v dials=%d", reused, err, *dials)
+	}
+	_ = lease.Close()
+	_ = fresh.Close()
+}
+
+func TestGatewayClientManagerNoReuse(t *testing.T) {
+	srv := newTestSSHServer(t)
+	m, dials := newTestGatewayClients(0)
+	cfg := srv.options("gw")
+
+	first, _, err := m.Get(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, reused, err := m.Get(&cfg)
+	if err != nil || reused || *dials != 2 || m.Count() != 0 {
+		t.Fatalf("reused=%v err=%v dials=%d count=%d", reused, err, *dials, m.Count())
+	}
+	_ = first.Close()
+	if _, _, err = first.shared.client.SendRequest("keepalive@openssh.com", true, nil); err == nil {
+		t.Fatal("client not closed after release")
+	}
+	_ = second.Close()
+}
+
+func TestGatewayClientManagerPoolConns(t *testing.T) {
+	srv := newTestSSHServer(t)
+	m, _ := newTestGatewayClients(time.Minute)
+	cfg := srv.options("gw")
+	cfg.gatewayID = "shared-conns"
+	pool := DefaultGatewayPool()
+	pool.Register(&model.Domain{ID: "shared", Gateways: []model.Gateway{{ID: cfg.gatewayID}}})
+	other := pool.Lease(cfg.gatewayID)
+	defer other.Release()
+
+	// 复用共用连接时只有 DialGateway 返回的客户端计入网关的连接数
+	for i := 0; i < 3; i++ {
+		client, _, err := m.Get(&cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = client.Close()
+		_ = client.Close()
+	}
+	if got := poolConns(pool, cfg.gatewayID); got != 1 {
+		t.Fatalf("conns after reuse = %d, want 1", got)
+	}
+	// 网关拒绝转发时关闭的共用连接同样不计数, DialGateway 使用测试的网关连接缓存
+	DefaultGatewayClients()
+	defaultClients := defaultGatewayClients
+	defaultGatewayClients = m
+	defer func() { defaultGatewayClients = defaultClients }()
+	if _, _, err := DialGateway([]SSHClientOptions{cfg}, "127.0.0.1:1"); err == nil {
+		t.Fatal("dial via gateway rejecting channels should fail")
+	}
+	if got := poolConns(pool, cfg.gatewayID); got != 1 {
+		t.Fatalf("conns after failed dial = %d, want 1", got)
+	}
+	clients := make([]*SSHClient, 0, 3)
+	for i := 0; i < 3; i++ {
+		client, reused, err := m.Get(&cfg)
+		if err != nil || !reused {
+			t.Fatalf("get reused=%v err=%v", reused, err)
+		}
+		setGatewayLease(client, pool.Lease(cfg.gatewayID))
+		clients = append(clients, client)
+	}
+	if got := poolConns(pool, cfg.gatewayID); got != 4 {
+		t.Fatalf("conns with shared clients = %d, want 4", got)
+	}
+	for i := range clients {
+		_ = clients[i].Close()
+		_ = clients[i].Close()
+	}
+	if got := poolConns(pool, cfg.gatewayID); got != 1 {
+		t.Fatalf("conns after close = %d, want 1", got)
+	}
+}
@@ -4,7 +4,6 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
-	"strconv"
 	"strings"
 	"sync"
 	"syscall"
@@ -18,12 +17,14 @@ import (
 	"github.com/meowgen/koko/pkg/jms-sdk-go/model"
 	"github.com/meowgen/koko/pkg/jms-sdk-go/service"
 	"github.com/meowgen/koko/pkg/logger"
+	"github.com/meowgen/koko/pkg/sshcert"
 )
 
 type AssetDir struct {
 	ID         string
 	folderName string
 	addr       string
+	connID     string
 	modeTime   time.Time
 
 	user        *model.User
@@ -619,9 +620,19 @@ func (ad *AssetDir) getNewSftpConn(su *model.SystemUser) (conn *SftpConn, err er
 	sshAuthOpts := make([]SSHClientOption, 0, 6)
 	sshAuthOpts = append(sshAuthOpts, SSHClientUsername(su.Username))
 	sshAuthOpts = append(sshAuthOpts, SSHClientHost(ad.detailAsset.IP))
+	sshAuthOpts = append(sshAuthOpts, SSHClientHostKeys(ad.detailAsset.SSHHostKeys...))
 	sshAuthOpts = append(sshAuthOpts, SSHClientPort(ad.detailAsset.ProtocolPort(su.Protocol)))
 	sshAuthOpts = append(sshAuthOpts, SSHClientPassword(su.Password))
 	sshAuthOpts = append(sshAuthOpts, SSHClientTimeout(timeout))
+	// SFTP 没有会话, 证书记录 SFTP 连接 ID, 有效期为最长有效期
+	certReq := sshcert.Request{
+		SessionID:  ad.connID,
+		User:       ad.user.Username,
+		Principals: []string{su.Username},
+	}
+	if certAuth, err1 := sshcert.Issue(certReq); err1 == nil && certAuth != nil {
+		sshAuthOpts = append(sshAuthOpts, SSHClientCertAuth(certAuth))
+	}
 	if su.PrivateKey != "" {
 		// 先使用 password 解析 PrivateKey
 		if signer, err1 := gossh.ParsePrivateKeyWithPassphrase([]byte(su.PrivateKey),
@@ -635,20 +646,7 @@ func (ad *AssetDir) getNewSftpConn(su *model.SystemUser) (conn *SftpConn, err er
 		}
 	}
 	if ad.domain != nil && len(ad.domain.Gateways) > 0 {
-		proxyArgs := make([]SSHClientOptions, 0, len(ad.domain.Gateways))
-		for i := range ad.domain.Gateways {
-			gateway := ad.domain.Gateways[i]
-			proxyArg := SSHClientOptions{
-				Host:       gateway.IP,
-				Port:       strconv.Itoa(gateway.Port),
-				Username:   gateway.Username,
-				Password:   gateway.Password,
-				Passphrase: gateway.Password, // 兼容 带密码的private_key,
-				PrivateKey: gateway.PrivateKey,
-				Timeout:    timeout,
-			}
-			proxyArgs = append(proxyArgs, proxyArg)
-		}
+		proxyArgs := NewDomainGatewayOptions(ad.domain, timeout)
 		sshAuthOpts = append(sshAuthOpts, SSHClientProxyClient(proxyArgs...))
 	}
 	sshClient, err := NewSSHClient(sshAuthOpts...)
@@ -10,6 +10,7 @@ import (
 
 	"github.com/pkg/sftp"
 
+	"github.com/meowgen/koko/pkg/common"
 	"github.com/meowgen/koko/pkg/jms-sdk-go/model"
 	"github.com/meowgen/koko/pkg/jms-sdk-go/service"
 	"github.com/meowgen/koko/pkg/logger"
@@ -18,6 +19,8 @@ import (
 var errNoSelectAsset = errors.New("please select one of the assets")
 
 type UserSftpConn struct {
+	// ID 是 SFTP 连接的 ID, 记录在签发的 SSH 证书中
+	ID   string
 	User *model.User
 	Addr string
 	Dirs map[string]os.FileInfo
@@ -317,7 +320,7 @@ func (u *UserSftpConn) generateSubFoldersFromNodeTree(nodeTrees model.NodeTreeLi
 			folderName := cleanFolderName(asset.Hostname)
 			folderName = findAvailableKeyByPaddingSuffix(matchFunc, folderName, paddingCharacter)
 			assetDir := NewAssetDir(u.jmsService, u.User, u.logChan, WithFolderID(asset.ID),
-				WithFolderName(folderName), WitRemoteAddr(u.Addr))
+				WithFolderName(folderName), WitRemoteAddr(u.Addr), WithConnectionID(u.ID))
 			dirs[folderName] = &assetDir
 		}
 	}
@@ -337,7 +340,7 @@ func (u *UserSftpConn) generateSubFoldersFromAssets(assets []model.Asset, system
 		folderName := cleanFolderName(assets[i].Hostname)
 		folderName = findAvailableKeyByPaddingSuffix(matchFunc, folderName, paddingCharacter)
 		assetDir := NewAssetDir(u.jmsService, u.User, u.logChan, WithFolderID(assets[i].ID),
-			WithFolderName(folderName), WitRemoteAddr(u.Addr),
+			WithFolderName(folderName), WitRemoteAddr(u.Addr), WithConnectionID(u.ID),
 			WithAsset(assets[i]), WithSystemUsers(systemUsers))
 		dirs[folderName] = &assetDir
 	}
@@ -402,6 +405,7 @@ func (u *UserSftpConn) Search(key string) (res []os.FileInfo, err error) {
 func NewUserSftpConn(jmsService *service.JMService, user *model.User, addr string,
 	assets []model.Asset, systemUsers []model.SystemUser) *UserSftpConn {
 	u := UserSftpConn{
+		ID:         common.UUID(),
 		User:       user,
 		Addr:       addr,
 		Dirs:       map[string]os.FileInfo{},
@@ -416,6 +420,7 @@ func NewUserSftpConn(jmsService *service.JMService, user *model.User, addr strin
 		u.Dirs = u.generateSubFoldersFromRootTree()
 	}
 	go u.loopPushFTPLog()
+	logger.Infof("User %s SFTP connection %s from %s", user.Username, u.ID, addr)
 	return &u
 }
 
@@ -93,6 +93,7 @@ type folderOptions struct {
 	ID          string
 	Name        string
 	RemoteAddr  string
+	connID      string
 	loadSubFunc SubFoldersLoadFunc
 
 	asset       *model.Asset
@@ -118,6 +119,13 @@ func WitRemoteAddr(addr string) FolderBuilderOption {
 	}
 }
 
+// WithConnectionID 设置资产目录所属的 SFTP 连接 ID
+func WithConnectionID(id string) FolderBuilderOption {
+	return func(info *folderOptions) {
+		info.connID = id
+	}
+}
+
 func WithSubFoldersLoadFunc(loadFunc SubFoldersLoadFunc) FolderBuilderOption {
 	return func(info *folderOptions) {
 		info.loadSubFunc = loadFunc
@@ -153,6 +161,7 @@ func NewAssetDir(jmsService *service.JMService, user *model.User, logChan chan<-
 		ID:          dirOpts.ID,
 		folderName:  dirOpts.Name,
 		addr:        dirOpts.RemoteAddr,
+		connID:      dirOpts.connID,
 		user:        user,
 		detailAsset: dirOpts.asset,
 		domain:      dirOpts.domain,
@@ -11,6 +11,7 @@ import (
 
 	gossh "golang.org/x/crypto/ssh"
 
+	"github.com/meowgen/koko/pkg/hostkey"
 	"github.com/meowgen/koko/pkg/logger"
 )
 
@@ -26,13 +27,25 @@ type SSHClientOptions struct {
 	Timeout      int
 	keyboardAuth gossh.KeyboardInteractiveChallenge
 	PrivateAuth  gossh.Signer
+	// CertAuth 是 CA 为会话签发的证书, 优先使用
+	CertAuth gossh.Signer
+	// HostKeys 是资产指定的 authorized_keys 格式的主机密钥, 指定时只允许这些密钥
+	HostKeys []string
 
 	proxySSHClientOptions []SSHClientOptions
+
+	// gatewayID 和 gatewayDomain 在连接网域的网关时设置, 用于记录网关的健康状态
+	gatewayID       string
+	gatewayDomain   string
+	gatewayProtocol string
 }
 
 func (cfg *SSHClientOptions) AuthMethods() []gossh.AuthMethod {
 	authMethods := make([]gossh.AuthMethod, 0, 3)
 
+	if cfg.CertAuth != nil {
+		authMethods = append(authMethods, gossh.PublicKeys(cfg.CertAuth))
+	}
 	if cfg.PrivateKey != "" {
 		var (
 			signer gossh.Signer
@@ -123,6 +136,18 @@ func SSHClientPrivateAuth(privateAuth gossh.Signer) SSHClientOption {
 	}
 }
 
+func SSHClientCertAuth(certAuth gossh.Signer) SSHClientOption {
+	return func(args *SSHClientOptions) {
+		args.CertAuth = certAuth
+	}
+}
+
+func SSHClientHostKeys(hostKeys ...string) SSHClientOption {
+	return func(args *SSHClientOptions) {
+		args.HostKeys = hostKeys
+	}
+}
+
 func SSHClientProxyClient(proxyArgs ...SSHClientOptions) SSHClientOption {
 	return func(args *SSHClientOptions) {
 		args.proxySSHClientOptions = proxyArgs
@@ -152,41 +177,79 @@ var (
 	ErrSSHClient   = errors.New("new ssh client failed")
 )
 
-func getAvailableProxyClient(cfgs ...SSHClientOptions) (*SSHClient, error) {
-	for i := range cfgs {
-		if proxyClient, err := NewSSHClientWithCfg(&cfgs[i]); err == nil {
-			return proxyClient, nil
+// hostKeyScope 返回保存主机密钥的范围: 网关按网关 ID, 经网域网关连接的资产按网域 ID,
+// 不同网络中相同的地址不共用主机密钥. koko 直连的主机为空
+func hostKeyScope(cfg *SSHClientOptions) string {
+	if cfg.gatewayID != "" {
+		return "gateway-" + cfg.gatewayID
+	}
+	for i := range cfg.proxySSHClientOptions {
+		if domain := cfg.proxySSHClientOptions[i].gatewayDomain; domain != "" {
+			return "domain-" + domain
 		}
 	}
-	return nil, ErrNoAvailable
+	return ""
+}
+
+// ConnectError 是连接失败的错误, errors.Is 匹配 Kind, errors.As 可以取出 Err 中主机密钥不一致等原因
+type ConnectError struct {
+	Kind error
+	Err  error
+}
+
+func (e *ConnectError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Kind, e.Err)
+}
+
+func (e *ConnectError) Is(target error) bool {
+	return target == e.Kind
+}
+
+func (e *ConnectError) Unwrap() error {
+	return e.Err
+}
+
+// hostKeyChecker 记录主机密钥校验的错误. 握手失败时 gossh 只返回错误信息,
+// 使用记录的错误调用方可以经 errors.As 取出 hostkey.KeyChangedError
+type hostKeyChecker struct {
+	callback gossh.HostKeyCallback
+	err      error
+}
+
+func (c *hostKeyChecker) check(hostname string, remote net.Addr, key gossh.PublicKey) error {
+	c.err = c.callback(hostname, remote, key)
+	return c.err
+}
+
+// handshakeErr 返回握手失败的原因, 主机密钥校验失败时为校验的错误
+func (c *hostKeyChecker) handshakeErr(err error) error {
+	if c.err != nil {
+		return c.err
+	}
+	return err
 }
 
 func NewSSHClientWithCfg(cfg *SSHClientOptions) (*SSHClient, error) {
+	checker := hostKeyChecker{callback: hostkey.ScopedHostKeyCallback(hostKeyScope(cfg), cfg.HostKeys...)}
 	gosshCfg := gossh.ClientConfig{
 		User:            cfg.Username,
 		Auth:            cfg.AuthMethods(),
 		Timeout:         time.Duration(cfg.Timeout) * time.Second,
-		HostKeyCallback: gossh.InsecureIgnoreHostKey(),
+		HostKeyCallback: checker.check,
 		Config:          createSSHConfig(),
 	}
 	destAddr := net.JoinHostPort(cfg.Host, cfg.Port)
 	if len(cfg.proxySSHClientOptions) > 0 {
-		proxyClient, err := getAvailableProxyClient(cfg.proxySSHClientOptions...)
+		proxyClient, destConn, err := DialGateway(cfg.proxySSHClientOptions, destAddr)
 		if err != nil {
 			logger.Errorf("Get gateway client err: %s", err)
 			return nil, err
 		}
-		logger.Infof("Get gateway client(%s) success ", proxyClient)
-		destConn, err := proxyClient.Dial("tcp", destAddr)
-		if err != nil {
-			_ = proxyClient.Close()
-			return nil, fmt.Errorf("%w: %s", ErrGatewayDial, err)
-		}
 		proxyConn, chans, reqs, err := gossh.NewClientConn(destConn, destAddr, &gosshCfg)
 		if err != nil {
 			_ = proxyClient.Close()
 			_ = destConn.Close()
-			return nil, fmt.Errorf("%w: %s", ErrSSHClient, err)
+			return nil, &ConnectError{Kind: ErrSSHClient, Err: checker.handshakeErr(err)}
 		}
 		gosshClient := gossh.NewClient(proxyConn, chans, reqs)
 		return &SSHClient{Cfg: cfg, Client: gosshClient,
@@ -195,7 +258,7 @@ func NewSSHClientWithCfg(cfg *SSHClientOptions) (*SSHClient, error) {
 	}
 	gosshClient, err := gossh.Dial("tcp", destAddr, &gosshCfg)
 	if err != nil {
-		return nil, err
+		return nil, checker.handshakeErr(err)
 	}
 	return &SSHClient{Client: gosshClient, Cfg: cfg,
 		traceSessionMap: make(map[*gossh.Session]time.Time)}, nil
@@ -204,13 +267,19 @@ func NewSSHClientWithCfg(cfg *SSHClientOptions) (*SSHClient, error) {
 type SSHClient struct {
 	*gossh.Client
 	Cfg         *SSHClientOptions
-	ProxyClient *SSHClient
+	ProxyClient GatewayClient
 
 	sync.Mutex
 
 	traceSessionMap map[*gossh.Session]time.Time
 
 	refCount int32
+
+	// shared 不为空时是共用的网关连接的引用, Close 只释放引用
+	shared   *sharedGatewayClient
+	released int32
+	// lease 是 DialGateway 返回时网关池中的连接计数
+	lease *gatewayLease
 }
 
 func (s *SSHClient) String() string {
@@ -219,6 +288,11 @@ func (s *SSHClient) String() string {
 }
 
 func (s *SSHClient) Close() error {
+	s.lease.Release()
+	if s.shared != nil {
+		s.releaseShared()
+		return nil
+	}
 	if s.ProxyClient != nil {
 		_ = s.ProxyClient.Close()
 		logger.Infof("SSHClient(%s) proxy (%s) close", s, s.ProxyClient)
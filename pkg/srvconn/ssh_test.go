@@ -0,0 +1,38 @@
+package srvconn
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"testing"
+
+	gossh "golang.org/x/crypto/ssh"
+
+	"github.com/meowgen/koko/pkg/hostkey"
+)
+
+func TestNewSSHClientHostKeyChanged(t *testing.T) {
+	srv := newTestSSHServer(t)
+	cfg := srv.options("user")
+	cfg.gatewayID = ""
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := gossh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 资产指定的主机密钥与服务的密钥不一致
+	cfg.HostKeys = []string{string(gossh.MarshalAuthorizedKey(key))}
+	_, err = NewSSHClientWithCfg(&cfg)
+	var keyErr *hostkey.KeyChangedError
+	if !errors.As(err, &keyErr) {
+		t.Fatalf("error should be host key changed but %v", err)
+	}
+
+	wrapped := error(&ConnectError{Kind: ErrNoAvailable, Err: err})
+	if !errors.Is(wrapped, ErrNoAvailable) || !errors.As(wrapped, &keyErr) {
+		t.Fatalf("connect error should keep kind and cause: %v", wrapped)
+	}
+}
@@ -0,0 +1,213 @@
+package sshcert
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	gossh "golang.org/x/crypto/ssh"
+
+	"github.com/meowgen/koko/pkg/config"
+	"github.com/meowgen/koko/pkg/logger"
+)
+
+// clockSkew 证书生效时间提前一段时间, 避免资产的时钟比 koko 慢时证书尚未生效
+const clockSkew = time.Minute
+
+// 允许会话使用的证书扩展
+var defaultExtensions = map[string]string{
+	"permit-pty":             "",
+	"permit-port-forwarding": "",
+}
+
+var ErrPermissionExpired = errors.New("ssh certificate: permission has expired")
+
+// Request 是签发证书的会话信息
+type Request struct {
+	SessionID  string
+	User       string   // koko 的用户, 记录在证书的 key id 中
+	Principals []string // 登录资产使用的系统用户名
+	ExpireAt   int64    // 授权的过期时间, 为 0 时只使用最长有效期
+}
+
+// Authority 使用 CA 私钥为会话签发 OpenSSH 用户证书
+type Authority struct {
+	signer        gossh.Signer
+	ttl           time.Duration
+	sourceAddress string
+}
+
+// NewAuthority 创建签发证书的 CA, sourceAddress 是逗号分隔的 IP 或 CIDR
+func NewAuthority(signer gossh.Signer, ttl time.Duration, sourceAddress string) (*Authority, error) {
+	if ttl <= 0 {
+		return nil, fmt.Errorf("invalid ssh certificate ttl %s", ttl)
+	}
+	var addrs []string
+	for _, addr := range strings.Split(sourceAddress, ",") {
+		if addr = strings.TrimSpace(addr); addr == "" {
+			continue
+		}
+		if _, _, err := net.ParseCIDR(addr); err != nil && net.ParseIP(addr) == nil {
+			return nil, fmt.Errorf("invalid ssh certificate source address %q", addr)
+		}
+		addrs = append(addrs, addr)
+	}
+	return &Authority{signer: signer, ttl: ttl, sourceAddress: strings.Join(addrs, ",")}, nil
+}
+
+// PublicKey 返回 CA 公钥, 资产通过 TrustedUserCAKeys 信任该公钥
+func (a *Authority) PublicKey() gossh.PublicKey {
+	return a.signer.PublicKey()
+}
+
+// Sign 生成会话的临时密钥并签发证书, 返回可用于登录资产的 Signer
+func (a *Authority) Sign(req Request, now time.Time) (gossh.Signer, *gossh.Certificate, error) {
+	validBefore := now.Add(a.ttl)
+	if req.ExpireAt > 0 {
+		expireAt := time.Unix(req.ExpireAt, 0)
+		if !expireAt.After(now) {
+			return nil, nil, ErrPermissionExpired
+		}
+		if expireAt.Before(validBefore) {
+			validBefore = expireAt
+		}
+	}
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	signer, err := gossh.NewSignerFromKey(privateKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := randomSerial()
+	if err != nil {
+		return nil, nil, err
+	}
+	cert := &gossh.Certificate{
+		Key:             signer.PublicKey(),
+		Serial:          serial,
+		CertType:        gossh.UserCert,
+		KeyId:           fmt.Sprintf("koko:%s:%s", req.User, req.SessionID),
+		ValidPrincipals: req.Principals,
+		ValidAfter:      uint64(now.Add(-clockSkew).Unix()),
+		ValidBefore:     uint64(validBefore.Unix()),
+		Permissions: gossh.Permissions{
+			Extensions: make(map[string]string, len(defaultExtensions)),
+		},
+	}
+	for name, value := range defaultExtensions {
+		cert.Extensions[name] = value
+	}
+	if a.sourceAddress != "" {
+		cert.CriticalOptions = map[string]string{"source-address": a.sourceAddress}
+	}
+	if err = cert.SignCert(rand.Reader, a.signer); err != nil {
+		return nil, nil, err
+	}
+	certSigner, err := gossh.NewCertSigner(cert, signer)
+	if err != nil {
+		return nil, nil, err
+	}
+	return certSigner, cert, nil
+}
+
+func randomSerial() (uint64, error) {
+	var buf [8]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint64(buf[:]), nil
+}
+
+// LoadOrCreateKey 加载 CA 私钥, 不存在时生成 ed25519 私钥, 并把公钥保存到 path.pub
+func LoadOrCreateKey(path string) (gossh.Signer, error) {
+	data, err := os.ReadFile(path)
+	if err == nil {
+		return gossh.ParsePrivateKey(data)
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := gossh.NewSignerFromKey(privateKey)
+	if err != nil {
+		return nil, err
+	}
+	if err = os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	data = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	if err = os.WriteFile(path, data, 0600); err != nil {
+		return nil, err
+	}
+	if err = os.WriteFile(path+".pub", gossh.MarshalAuthorizedKey(signer.PublicKey()), 0644); err != nil {
+		return nil, err
+	}
+	logger.Infof("Generate SSH certificate CA key %s", path)
+	return signer, nil
+}
+
+var (
+	defaultOnce      sync.Once
+	defaultAuthority *Authority
+)
+
+// Default 返回配置的 CA, 未开启或者 CA 私钥加载失败时为 nil
+func Default() *Authority {
+	defaultOnce.Do(func() {
+		conf := config.GetConf()
+		if !conf.EnableSSHCertificate {
+			return
+		}
+		signer, err := LoadOrCreateKey(conf.SSHCertificateCAKey)
+		if err != nil {
+			logger.Errorf("Load SSH certificate CA key %s err: %s", conf.SSHCertificateCAKey, err)
+			return
+		}
+		ttl := time.Duration(conf.SSHCertificateTTL) * time.Second
+		defaultAuthority, err = NewAuthority(signer, ttl, conf.SSHCertificateSourceAddress)
+		if err != nil {
+			logger.Errorf("Config SSH certificate err: %s", err)
+			return
+		}
+		logger.Infof("SSH certificate CA enabled: %s %s", signer.PublicKey().Type(),
+			gossh.FingerprintSHA256(signer.PublicKey()))
+	})
+	return defaultAuthority
+}
+
+// Issue 使用默认的 CA 为会话签发证书, 未开启时返回 nil
+func Issue(req Request) (gossh.Signer, error) {
+	authority := Default()
+	if authority == nil {
+		return nil, nil
+	}
+	signer, cert, err := authority.Sign(req, time.Now())
+	if err != nil {
+		logger.Errorf("Session %s: issue SSH certificate for %s err: %s", req.SessionID,
+			strings.Join(req.Principals, ","), err)
+		return nil, err
+	}
+	logger.Infof("Session %s: issue SSH certificate serial %d key id %s principals %s valid before %s",
+		req.SessionID, cert.Serial, cert.KeyId, strings.Join(cert.ValidPrincipals, ","),
+		time.Unix(int64(cert.ValidBefore), 0).Format(time.RFC3339))
+	return signer, nil
+}
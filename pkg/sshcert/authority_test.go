@@ -0,0 +1,135 @@
+package sshcert
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	gossh "golang.org/x/crypto/ssh"
+)
+
+func newAuthority(t *testing.T, ttl time.Duration, sourceAddress string) *Authority {
+	signer, err := LoadOrCreateKey(filepath.Join(t.TempDir(), "ssh_ca"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	authority, err := NewAuthority(signer, ttl, sourceAddress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return authority
+}
+
+func TestAuthoritySign(t *testing.T) {
+	authority := newAuthority(t, time.Hour, "10.0.0.0/8, 192.168.1.1")
+	now := time.Now()
+	req := Request{SessionID: "s1", User: "admin", Principals: []string{"root"}}
+	signer, cert, err := authority.Sign(req, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(signer.PublicKey().Marshal(), cert.Marshal()) {
+		t.Error("signer should use the certificate as public key")
+	}
+	if cert.KeyId != "koko:admin:s1" || cert.CertType != gossh.UserCert {
+		t.Errorf("unexpected key id %s or type %d", cert.KeyId, cert.CertType)
+	}
+	if cert.ValidBefore != uint64(now.Add(time.Hour).Unix()) {
+		t.Errorf("certificate should be valid for ttl but before %d", cert.ValidBefore)
+	}
+	if addr := cert.CriticalOptions["source-address"]; addr != "10.0.0.0/8,192.168.1.1" {
+		t.Errorf("unexpected source address %q", addr)
+	}
+
+	checker := gossh.CertChecker{
+		IsUserAuthority: func(auth gossh.PublicKey) bool {
+			return bytes.Equal(auth.Marshal(), authority.PublicKey().Marshal())
+		},
+	}
+	if _, err = checker.Authenticate(connMetadata("root"), cert); err != nil {
+		t.Errorf("certificate should be accepted for root: %s", err)
+	}
+	if _, err = checker.Authenticate(connMetadata("admin"), cert); err == nil {
+		t.Error("certificate should not be accepted for other principals")
+	}
+
+	_, other, err := authority.Sign(req, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other.Serial == cert.Serial || bytes.Equal(other.Key.Marshal(), cert.Key.Marshal()) {
+		t.Error("each session should use a new key and serial")
+	}
+}
+
+func TestAuthoritySignExpireAt(t *testing.T) {
+	authority := newAuthority(t, time.Hour, "")
+	now := time.Now()
+	expireAt := now.Add(10 * time.Minute).Unix()
+	_, cert, err := authority.Sign(Request{Principals: []string{"root"}, ExpireAt: expireAt}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert.ValidBefore != uint64(expireAt) {
+		t.Errorf("certificate should expire with permission at %d but %d", expireAt, cert.ValidBefore)
+	}
+	if len(cert.CriticalOptions) != 0 {
+		t.Errorf("unexpected critical options %v", cert.CriticalOptions)
+	}
+	_, _, err = authority.Sign(Request{Principals: []string{"root"}, ExpireAt: now.Unix() - 1}, now)
+	if !errors.Is(err, ErrPermissionExpired) {
+		t.Errorf("expired permission should not issue certificate but %v", err)
+	}
+}
+
+func TestNewAuthorityInvalid(t *testing.T) {
+	signer, err := LoadOrCreateKey(filepath.Join(t.TempDir(), "ssh_ca"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = NewAuthority(signer, 0, ""); err == nil {
+		t.Error("zero ttl should return error")
+	}
+	if _, err = NewAuthority(signer, time.Hour, "10.0.0.0/33"); err == nil {
+		t.Error("invalid source address should return error")
+	}
+}
+
+func TestLoadOrCreateKey(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys", "ssh_ca")
+	signer, err := LoadOrCreateKey(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadOrCreateKey(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(signer.PublicKey().Marshal(), loaded.PublicKey().Marshal()) {
+		t.Error("existing CA key should be loaded")
+	}
+	pub, err := os.ReadFile(path + ".pub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, _, _, _, err := gossh.ParseAuthorizedKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(key.Marshal(), signer.PublicKey().Marshal()) {
+		t.Error("public key file should match CA key")
+	}
+}
+
+type connMetadata string
+
+func (c connMetadata) User() string          { return string(c) }
+func (c connMetadata) SessionID() []byte     { return nil }
+func (c connMetadata) ClientVersion() []byte { return nil }
+func (c connMetadata) ServerVersion() []byte { return nil }
+func (c connMetadata) RemoteAddr() net.Addr  { return &net.TCPAddr{IP: net.ParseIP("10.0.0.5")} }
+func (c connMetadata) LocalAddr() net.Addr   { return &net.TCPAddr{IP: net.ParseIP("10.0.0.1")} }
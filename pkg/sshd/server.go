@@ -17,9 +17,13 @@ import (
 )
 
 const (
-	sshChannelSession     = "session"
-	sshChannelDirectTCPIP = "direct-tcpip"
-	sshSubSystemSFTP      = "sftp"
+	sshChannelSession        = "session"
+	sshChannelDirectTCPIP    = "direct-tcpip"
+	sshChannelForwardedTCPIP = "forwarded-tcpip"
+	sshSubSystemSFTP         = "sftp"
+
+	sshRequestTCPIPForward       = "tcpip-forward"
+	sshRequestCancelTCPIPForward = "cancel-tcpip-forward"
 )
 
 type Server struct {
@@ -53,6 +57,9 @@ type SSHHandler interface {
 	SFTPHandler(ssh.Session)
 	LocalPortForwardingPermission(ctx ssh.Context, destinationHost string, destinationPort uint32) bool
 	DirectTCPIPChannelHandler(ctx ssh.Context, newChan gossh.NewChannel, destAddr string)
+	RemotePortForwardingPermission(ctx ssh.Context, bindHost string, bindPort uint32) bool
+	RemotePortForwardHandler(ctx ssh.Context, conn *gossh.ServerConn, bindHost string, bindPort uint32) (uint32, error)
+	CancelRemotePortForwardHandler(ctx ssh.Context, bindHost string, bindPort uint32)
 }
 
 type AuthStatus ssh.AuthResult
@@ -69,6 +76,9 @@ func NewSSHServer(handler SSHHandler) *Server {
 		LocalPortForwardingCallback: func(ctx ssh.Context, destinationHost string, destinationPort uint32) bool {
 			return handler.LocalPortForwardingPermission(ctx, destinationHost, destinationPort)
 		},
+		ReversePortForwardingCallback: func(ctx ssh.Context, bindHost string, bindPort uint32) bool {
+			return handler.RemotePortForwardingPermission(ctx, bindHost, bindPort)
+		},
 		Addr: handler.GetSSHAddr(),
 		KeyboardInteractiveHandler: func(ctx ssh.Context, challenger gossh.KeyboardInteractiveChallenge) ssh.AuthResult {
 			return ssh.AuthResult(handler.KeyboardInteractiveAuth(ctx, challenger))
@@ -104,10 +114,64 @@ func NewSSHServer(handler SSHHandler) *Server {
 				handler.DirectTCPIPChannelHandler(ctx, newChan, dest)
 			},
 		},
+		RequestHandlers: map[string]ssh.RequestHandler{
+			sshRequestTCPIPForward: func(ctx ssh.Context, srv *ssh.Server, req *gossh.Request) (bool, []byte) {
+				var reqPayload remoteForwardRequest
+				if err := gossh.Unmarshal(req.Payload, &reqPayload); err != nil {
+					logger.Errorf("Parse remote forward request err: %s", err)
+					return false, nil
+				}
+				if srv.ReversePortForwardingCallback == nil ||
+					!srv.ReversePortForwardingCallback(ctx, reqPayload.BindAddr, reqPayload.BindPort) {
+					return false, []byte("port forwarding is disabled")
+				}
+				conn, ok := ctx.Value(ssh.ContextKeyConn).(*gossh.ServerConn)
+				if !ok {
+					return false, nil
+				}
+				port, err := handler.RemotePortForwardHandler(ctx, conn, reqPayload.BindAddr, reqPayload.BindPort)
+				if err != nil {
+					logger.Errorf("Remote forward %s err: %s", net.JoinHostPort(reqPayload.BindAddr,
+						strconv.FormatInt(int64(reqPayload.BindPort), 10)), err)
+					return false, nil
+				}
+				if reqPayload.BindPort != 0 {
+					return true, nil
+				}
+				// 请求端口为 0 时返回实际监听的端口
+				return true, gossh.Marshal(&remoteForwardSuccess{BindPort: port})
+			},
+			sshRequestCancelTCPIPForward: func(ctx ssh.Context, srv *ssh.Server, req *gossh.Request) (bool, []byte) {
+				var reqPayload remoteForwardRequest
+				if err := gossh.Unmarshal(req.Payload, &reqPayload); err != nil {
+					logger.Errorf("Parse cancel remote forward request err: %s", err)
+					return false, nil
+				}
+				handler.CancelRemotePortForwardHandler(ctx, reqPayload.BindAddr, reqPayload.BindPort)
+				return true, nil
+			},
+		},
 	}
 	return &Server{srv}
 }
 
+// OpenForwardedTCPIPChannel 打开 forwarded-tcpip 通道, 把远程转发监听到的连接转给用户
+func OpenForwardedTCPIPChannel(conn *gossh.ServerConn, bindHost string, bindPort uint32,
+	originAddr string, originPort uint32) (gossh.Channel, error) {
+	payload := gossh.Marshal(&remoteForwardChannelData{
+		DestAddr:   bindHost,
+		DestPort:   bindPort,
+		OriginAddr: originAddr,
+		OriginPort: originPort,
+	})
+	ch, reqs, err := conn.OpenChannel(sshChannelForwardedTCPIP, payload)
+	if err != nil {
+		return nil, err
+	}
+	go gossh.DiscardRequests(reqs)
+	return ch, nil
+}
+
 type localForwardChannelData struct {
 	DestAddr string
 	DestPort uint32
@@ -115,3 +179,19 @@ type localForwardChannelData struct {
 	OriginAddr string
 	OriginPort uint32
 }
+
+type remoteForwardRequest struct {
+	BindAddr string
+	BindPort uint32
+}
+
+type remoteForwardSuccess struct {
+	BindPort uint32
+}
+
+type remoteForwardChannelData struct {
+	DestAddr   string
+	DestPort   uint32
+	OriginAddr string
+	OriginPort uint32
+}